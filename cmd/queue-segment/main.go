@@ -0,0 +1,201 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI Ltd. All rights reserved.
+ * web: https://infinilabs.com
+ * mail: hello#infini.ltd */
+
+// queue-segment inspects and repairs disk_queue segment files offline, eg:
+//
+//	queue-segment -op dump -file data/queue/<id>/000000012.dat
+//	queue-segment -op verify -file data/queue/<id>/000000012.dat.zstd
+//	queue-segment -op repair -file data/queue/<id>/000000012.dat
+//	queue-segment -op compress -file data/queue/<id>/000000012.dat
+//	queue-segment -op decompress -file data/queue/<id>/000000012.dat.zstd
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/core/util/zstd"
+	queue "infini.sh/framework/modules/queue/disk_queue"
+)
+
+var (
+	flagOp                 = flag.String("op", "dump", "dump, verify, repair, compress or decompress")
+	flagFile               = flag.String("file", "", "the segment file, .dat or .dat.zstd")
+	flagMinMsgSize         = flag.Int("min_msg_size", 1, "min_msg_size of the disk_queue")
+	flagMaxMsgSize         = flag.Int("max_msg_size", 104857600, "max_msg_size of the disk_queue")
+	flagCompressedMessages = flag.Bool("compressed_messages", false, "the messages were written with compress.message.enabled")
+	flagLimit              = flag.Int("limit", 0, "max records to dump, 0 for all")
+	flagMaxDataBytes       = flag.Int("max_data_bytes", 256, "max bytes of data to print per record, 0 for all")
+	flagBackup             = flag.Bool("backup", true, "keep a copy of the segment as .bak before repairing")
+)
+
+var errLimitReached = errors.New("limit reached")
+
+func main() {
+	flag.Parse()
+	if *flagFile == "" {
+		fail(errors.New("no segment file specified, use -file"))
+	}
+
+	var err error
+	switch *flagOp {
+	case "dump":
+		err = dump(*flagFile)
+	case "verify":
+		err = verify(*flagFile)
+	case "repair":
+		err = repair(*flagFile)
+	case "compress":
+		if strings.HasSuffix(*flagFile, ".zstd") {
+			err = errors.New("segment is already compressed")
+			break
+		}
+		err = zstd.CompressFile(*flagFile, *flagFile+".zstd")
+	case "decompress":
+		if !strings.HasSuffix(*flagFile, ".zstd") {
+			err = errors.New("segment is not compressed")
+			break
+		}
+		err = zstd.DecompressFile(&sync.RWMutex{}, *flagFile, strings.TrimSuffix(*flagFile, ".zstd"))
+	default:
+		err = fmt.Errorf("unknown op: %v", *flagOp)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func scanOptions() queue.SegmentScanOptions {
+	return queue.SegmentScanOptions{
+		MinMsgSize:         int32(*flagMinMsgSize),
+		MaxMsgSize:         int32(*flagMaxMsgSize),
+		CompressedMessages: *flagCompressedMessages,
+	}
+}
+
+func dump(file string) error {
+	segment, _ := queue.ParseSegmentFileName(file)
+	var count int
+	size, err := queue.ScanSegment(file, scanOptions(), func(r *queue.SegmentRecord) error {
+		if *flagLimit > 0 && count >= *flagLimit {
+			return errLimitReached
+		}
+		count++
+
+		line := []string{fmt.Sprintf("offset=%v,%v", segment, r.Position), fmt.Sprintf("size=%v", r.Size)}
+		if r.Checksum {
+			line = append(line, "crc32c=ok")
+		}
+		if !r.Time.IsZero() {
+			prefix := ""
+			if !r.TimeExact {
+				prefix = ">="
+			}
+			line = append(line, fmt.Sprintf("time=%v%v", prefix, r.Time.Format(time.RFC3339Nano)))
+		}
+		if r.Key != nil {
+			line = append(line, fmt.Sprintf("key=%q", r.Key))
+		}
+		if len(r.Headers) > 0 {
+			names := make([]string, 0, len(r.Headers))
+			for k := range r.Headers {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+			headers := make([]string, 0, len(names))
+			for _, k := range names {
+				headers = append(headers, k+"="+r.Headers[k])
+			}
+			line = append(line, fmt.Sprintf("headers=%q", strings.Join(headers, ",")))
+		}
+		data := r.Data
+		if *flagMaxDataBytes > 0 && len(data) > *flagMaxDataBytes {
+			data = data[:*flagMaxDataBytes]
+		}
+		line = append(line, fmt.Sprintf("data=%q", data))
+		fmt.Println(strings.Join(line, " "))
+		return nil
+	})
+	if err == errLimitReached {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%v, %v bytes of good records", err, size)
+	}
+	return nil
+}
+
+func verify(file string) error {
+	var count int
+	size, err := queue.ScanSegment(file, scanOptions(), func(r *queue.SegmentRecord) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%v: %v, %v good records, %v bytes", file, err, count, size)
+	}
+	fmt.Printf("%v: ok, %v records, %v bytes\n", file, count, size)
+	return nil
+}
+
+// repair cuts the segment after the last good record
+func repair(file string) error {
+	size, err := queue.ScanSegment(file, scanOptions(), nil)
+	if err == nil {
+		fmt.Printf("%v: ok, nothing to repair\n", file)
+		return nil
+	}
+	if _, ok := err.(*queue.SegmentCorruption); !ok {
+		return err
+	}
+	fmt.Printf("%v: %v\n", file, err)
+
+	if *flagBackup {
+		_, err = util.CopyFile(file, file+".bak")
+		if err != nil {
+			return err
+		}
+	}
+	err = queue.TruncateSegment(file, size)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v: truncated to %v bytes\n", file, size)
+	return nil
+}
@@ -41,11 +41,14 @@ func RunConformance(t *testing.T, b Backend) {
 	t.Run("pipelines", func(t *testing.T) { conformancePipelines(t, b) })
 	t.Run("deep chain", func(t *testing.T) { conformanceDeepChain(t, b) })
 	t.Run("empty set", func(t *testing.T) { conformanceEmptySet(t, b) })
+	t.Run("nested query scope", func(t *testing.T) { conformanceNestedQuery(t, b) })
 }
 
 func fixtureDocs() []Doc {
 	docs := []Doc{}
-	// 6 hours × 2 streams; n increases; severities cycle.
+	// 6 hours × 2 streams; n increases; severities cycle. Every doc has a
+	// nested "labels" array with an env and a pool label, both valued
+	// "prod" on alpha but only the pool on beta.
 	for h := 0; h < 6; h++ {
 		for _, stream := range []string{"alpha", "beta"} {
 			n := float64(h + 1)
@@ -56,12 +59,20 @@ func fixtureDocs() []Doc {
 			if h%3 == 0 {
 				sev = "error"
 			}
+			env := "prod"
+			if stream == "beta" {
+				env = "dev"
+			}
 			docs = append(docs, Doc{
 				"id":       docID(stream, h),
 				"ts":       tsAt(h),
 				"stream":   stream,
 				"severity": sev,
 				"n":        n,
+				"labels": []interface{}{
+					map[string]interface{}{"key": "env", "value": env},
+					map[string]interface{}{"key": "pool", "value": "prod"},
+				},
 			})
 		}
 	}
@@ -293,6 +304,24 @@ func conformanceEmptySet(t *testing.T, b Backend) {
 	assert.False(t, res.Aggs["total"].ValueSet, "sum over empty set has no value")
 }
 
+func conformanceNestedQuery(t *testing.T, b Backend) {
+	// env=prod must hold on one label: beta has env and prod on two.
+	ctx, cleanup := b.Setup(t, fixtureDocs())
+	t.Cleanup(cleanup)
+	qb := orm.NewQuery().Filter(orm.NestedQuery("labels", orm.MustQuery(
+		orm.TermQuery("labels.key", "env"),
+		orm.TermQuery("labels.value", "prod"),
+	)))
+	qb.SetAggs(
+		"total", &orm.MetricAggregation{Type: orm.MetricSum, Field: "n"},
+		"cnt", &orm.MetricAggregation{Type: orm.MetricCount, Field: "n"},
+	)
+	res, err := b.Aggregate(ctx, qb)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 6, res.Aggs["cnt"].Value, 1e-9)    // alpha only
+	assert.InEpsilon(t, 21, res.Aggs["total"].Value, 1e-9) // 1+...+6
+}
+
 // RunParity executes the same spec against two backends and deep-compares
 // the typed results (float epsilon; percentiles skipped — approximation
 // strategies legitimately differ).
@@ -344,6 +344,10 @@ func (g *generator[T, P]) get(w http.ResponseWriter, req *http.Request, ps httpr
 			return
 		}
 	}
+	if v := orm.GetObjectVersion(obj); v != nil {
+		g.WriteGetOKJSONWithVersion(w, id, *obj, v.SeqNo, v.PrimaryTerm)
+		return
+	}
 	g.WriteGetOKJSON(w, id, *obj)
 }
 
@@ -361,6 +365,14 @@ func (g *generator[T, P]) update(w http.ResponseWriter, req *http.Request, ps ht
 		}
 	}
 
+	// if_seq_no/if_primary_term opt the update into optimistic concurrency
+	// control for models embedding orm.VersionedObjectBase
+	expected, err := orm.ParseObjectVersion(req)
+	if err != nil {
+		g.WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	ctx := g.ctxFor(req, ActionUpdate)
 	ctx.Refresh = orm.WaitForRefresh
 
@@ -396,6 +408,9 @@ func (g *generator[T, P]) update(w http.ResponseWriter, req *http.Request, ps ht
 			}
 		}
 		obj.SetID(id)
+		if expected != nil {
+			orm.SetObjectVersion(obj, expected)
+		}
 		if g.cfg.PrepareUpdate != nil {
 			if err := g.cfg.PrepareUpdate(obj, body); err != nil {
 				g.WriteError(w, err.Error(), http.StatusBadRequest)
@@ -403,6 +418,10 @@ func (g *generator[T, P]) update(w http.ResponseWriter, req *http.Request, ps ht
 			}
 		}
 		if err := orm.Update(ctx, obj); err != nil {
+			if orm.IsVersionConflict(err) {
+				g.WriteError(w, err.Error(), http.StatusConflict)
+				return
+			}
 			if strings.Contains(err.Error(), "not found") {
 				g.WriteOpRecordNotFoundJSON(w, id)
 				return
@@ -429,7 +448,14 @@ func (g *generator[T, P]) update(w http.ResponseWriter, req *http.Request, ps ht
 			return
 		}
 	}
+	if expected != nil {
+		orm.SetObjectVersion(obj, expected)
+	}
 	if err := orm.UpdatePartialFields(ctx, obj, delta); err != nil {
+		if orm.IsVersionConflict(err) {
+			g.WriteError(w, err.Error(), http.StatusConflict)
+			return
+		}
 		if strings.Contains(err.Error(), "not found") {
 			g.WriteOpRecordNotFoundJSON(w, id)
 			return
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -89,6 +90,9 @@ func setupGizmos(t *testing.T) Handlers {
 		if err := handler.RegisterSchemaWithName(gizmo{}, "gizmos"); err != nil {
 			panic(err)
 		}
+		if err := handler.RegisterSchemaWithName(versionedGizmo{}, "versioned_gizmos"); err != nil {
+			panic(err)
+		}
 		orm.Register("sqlite", handler)
 	})
 
@@ -115,6 +119,13 @@ func setupGizmos(t *testing.T) Handlers {
 	return NewHandlers[gizmo](cfg)
 }
 
+// versionedGizmo opts into optimistic concurrency control.
+type versionedGizmo struct {
+	orm.ORMObjectBase
+	orm.VersionedObjectBase
+	Name string `json:"name,omitempty" elastic_mapping:"name:{type:keyword}"`
+}
+
 type errString string
 
 func (e errString) Error() string { return string(e) }
@@ -225,3 +236,33 @@ func TestRegisterCRUD_ValidatesConfig(t *testing.T) {
 }
 
 var _ = util.MapStr{}
+
+func TestCRUD_VersionConflict(t *testing.T) {
+	setupGizmos(t)
+	// call() resolves :id from /gizmos/ paths, the prefix only matters for routing
+	h := NewHandlers[versionedGizmo](Config[versionedGizmo]{Prefix: "/gizmos", Resource: "versioned gizmo"})
+
+	w, out := call(t, h.Create, "POST", "/gizmos/", `{"name":"v"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	id, _ := out["_id"].(string)
+
+	w, out = call(t, h.Get, "GET", "/gizmos/"+id, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	seqNo, ok := out["_seq_no"].(float64)
+	require.True(t, ok, "get exposes the version: %v", out)
+	stale := strconv.FormatInt(int64(seqNo), 10)
+
+	w, _ = call(t, h.Update, "PUT", "/gizmos/"+id+"?if_seq_no="+stale, `{"name":"first"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// a second writer holding the same version loses
+	w, _ = call(t, h.Update, "PUT", "/gizmos/"+id+"?if_seq_no="+stale, `{"name":"second"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w, out = call(t, h.Get, "GET", "/gizmos/"+id, "")
+	src, _ := out["_source"].(map[string]interface{})
+	assert.Equal(t, "first", src["name"])
+
+	w, _ = call(t, h.Update, "PUT", "/gizmos/"+id+"?if_seq_no=x", `{"name":"bad"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -296,6 +296,10 @@ func (handler Handler) WriteGetOKJSON(w http.ResponseWriter, id, obj interface{}
 	WriteGetOKJSON(w, id, obj)
 }
 
+func (handler Handler) WriteGetOKJSONWithVersion(w http.ResponseWriter, id, obj interface{}, seqNo, primaryTerm int64) {
+	WriteGetOKJSONWithVersion(w, id, obj, seqNo, primaryTerm)
+}
+
 func (handler Handler) WriteGetMissingJSON(w http.ResponseWriter, id string) {
 	WriteGetMissingJSON(w, id)
 }
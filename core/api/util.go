@@ -301,6 +301,18 @@ func WriteGetOKJSON(w http.ResponseWriter, id, obj interface{}) {
 	}, 200)
 }
 
+// WriteGetOKJSONWithVersion adds the optimistic concurrency token of obj,
+// clients send it back as if_seq_no and if_primary_term when updating.
+func WriteGetOKJSONWithVersion(w http.ResponseWriter, id, obj interface{}, seqNo, primaryTerm int64) {
+	WriteJSON(w, util.MapStr{
+		"found":         true,
+		"_id":           id,
+		"_source":       obj,
+		"_seq_no":       seqNo,
+		"_primary_term": primaryTerm,
+	}, 200)
+}
+
 func WriteGetMissingJSON(w http.ResponseWriter, id string) {
 	WriteJSON(w, util.MapStr{
 		"found": false,
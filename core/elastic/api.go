@@ -41,6 +41,7 @@ package elastic
 
 import (
 	"context"
+	"errors"
 	"net/url"
 
 	"infini.sh/framework/core/util"
@@ -49,6 +50,7 @@ import (
 
 type API interface {
 	ScrollAPI
+	PointInTimeAPI
 	MappingAPI
 	TemplateAPI
 	ReplicationAPI
@@ -79,6 +81,11 @@ type API interface {
 	Create(indexName, docType string, id interface{}, data interface{}, refresh string) (*InsertResponse, error)
 	Update(indexName, docType string, id interface{}, data interface{}, refresh string) (*InsertResponse, error)
 
+	// IndexIfMatch and UpdateIfMatch only write when the document's current
+	// _seq_no and _primary_term match, ErrVersionConflict otherwise.
+	IndexIfMatch(indexName, docType string, id interface{}, data interface{}, seqNo, primaryTerm int64, refresh string) (*InsertResponse, error)
+	UpdateIfMatch(indexName, docType string, id interface{}, data interface{}, seqNo, primaryTerm int64, refresh string) (*InsertResponse, error)
+
 	Get(indexName, docType, id string) (*GetResponse, error)
 	Delete(indexName, docType, id string, refresh ...string) (*DeleteResponse, error)
 
@@ -167,6 +174,19 @@ type ScrollAPI interface {
 	ClearScroll(scrollId string) error
 }
 
+// PointInTimeAPI reads a consistent view of indices with search_after,
+// Elasticsearch from 7.10 and OpenSearch from 2.4. Older clusters and other
+// distributions return ErrPointInTimeNotSupported from OpenPointInTime.
+type PointInTimeAPI interface {
+	OpenPointInTime(indexNames string, keepAlive string) (string, error)
+	// SearchWithPointInTime runs the query against the point in time; the
+	// response carries the pit_id to use for the next page.
+	SearchWithPointInTime(pitID string, keepAlive string, query *SearchRequest) ([]byte, error)
+	ClosePointInTime(pitID string) error
+}
+
+var ErrPointInTimeNotSupported = errors.New("point in time is not supported by this cluster")
+
 type ScriptAPI interface {
 	ScriptExists(scriptName string) (bool, error)
 	PutScript(scriptName string, script []byte) ([]byte, error)
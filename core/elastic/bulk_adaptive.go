@@ -0,0 +1,553 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/stats"
+)
+
+// ──────────────────────────────────────────────────────────────────────────
+// Adaptive bulk sizing.
+//
+// With `adaptive.enabled`, a BulkProcessor no longer ships fixed-size batches.
+// Every bulk response is fed to an AdaptiveBulkController shared by all the
+// processors of the same tag and cluster, which grows the batch size, the
+// batch doc count and the number of concurrent bulk requests additively while
+// the cluster keeps up, and cuts them multiplicatively (AIMD) on:
+//
+//   - rejected:             429 responses / es_rejected_execution_exception items
+//   - error:                transport errors and 5xx responses
+//   - thread_pool_queue:    a node's write thread-pool queue above the limit
+//   - thread_pool_rejected: a node's write thread pool rejected new tasks
+//   - latency:              average bulk latency above the target
+//
+// The current limits are published as gauges under
+// `elasticsearch.bulk.adaptive.<tag>.<cluster>` and every adjustment increments
+// `increase.<reason>` / `decrease.<reason>` in the same category; the full
+// state, including the last reason, is also reported in the `bulk_adaptive`
+// section of the stats API.
+// ──────────────────────────────────────────────────────────────────────────
+
+const (
+	AdaptiveReasonHealthy            = "healthy"
+	AdaptiveReasonRejected           = "rejected"
+	AdaptiveReasonError              = "error"
+	AdaptiveReasonThreadPoolQueue    = "thread_pool_queue"
+	AdaptiveReasonThreadPoolRejected = "thread_pool_rejected"
+	AdaptiveReasonLatency            = "latency"
+)
+
+type AdaptiveBulkConfig struct {
+	Enabled bool `config:"enabled"`
+
+	MinBulkSizeInKb  int `config:"min_batch_size_in_kb"`
+	MaxBulkSizeInKb  int `config:"max_batch_size_in_kb"`
+	BulkSizeStepInKb int `config:"batch_size_step_in_kb"`
+
+	MinBulkDocsCount  int `config:"min_batch_size_in_docs"`
+	MaxBulkDocsCount  int `config:"max_batch_size_in_docs"`
+	BulkDocsCountStep int `config:"batch_size_step_in_docs"`
+
+	//max_concurrency <= 0 leaves the number of in-flight bulk requests unbounded
+	MinConcurrency int `config:"min_concurrency"`
+	MaxConcurrency int `config:"max_concurrency"`
+
+	DecreaseFactor     float64 `config:"decrease_factor"`
+	AdjustIntervalInMs int     `config:"adjust_interval_in_ms"`
+
+	TargetLatencyInMs int     `config:"target_latency_in_ms"`
+	MaxRejectRatio    float64 `config:"max_reject_ratio"`
+
+	//poll the write thread pool of the cluster nodes, 0 to disable
+	ThreadPoolCheckIntervalInSeconds int `config:"thread_pool_check_interval_in_seconds"`
+	MaxThreadPoolQueue               int `config:"max_thread_pool_queue"`
+
+	MaxRejectDelayInSeconds int `config:"max_reject_retry_delay_in_seconds"`
+}
+
+var DefaultAdaptiveBulkConfig = AdaptiveBulkConfig{
+	MinBulkSizeInKb:                  512,
+	MaxBulkSizeInKb:                  50 * 1024,
+	BulkSizeStepInKb:                 1024,
+	MinBulkDocsCount:                 100,
+	MaxBulkDocsCount:                 10000,
+	BulkDocsCountStep:                100,
+	MinConcurrency:                   1,
+	DecreaseFactor:                   0.5,
+	AdjustIntervalInMs:               1000,
+	TargetLatencyInMs:                5000,
+	MaxRejectRatio:                   0,
+	ThreadPoolCheckIntervalInSeconds: 10,
+	MaxThreadPoolQueue:               1000,
+	MaxRejectDelayInSeconds:          60,
+}
+
+// BulkSample is the outcome of a single bulk request attempt
+type BulkSample struct {
+	Latency  time.Duration
+	Docs     int
+	Rejected int
+	//the whole request was rejected with 429
+	Throttled bool
+	//transport error or 5xx response
+	Failed bool
+}
+
+// ThreadPoolPressure is the worst write thread-pool state across the nodes
+type ThreadPoolPressure struct {
+	Queue    int64
+	Rejected int64
+}
+
+type ThreadPoolStatsFunc func() (*ThreadPoolPressure, error)
+
+type AdaptiveBulkStatus struct {
+	BulkSizeInBytes int       `json:"batch_size_in_bytes"`
+	BulkDocsCount   int       `json:"batch_size_in_docs"`
+	Concurrency     int       `json:"concurrency"`
+	InFlight        int       `json:"in_flight"`
+	LastAction      string    `json:"last_action,omitempty"`
+	LastReason      string    `json:"last_reason,omitempty"`
+	LastAdjusted    time.Time `json:"last_adjusted,omitempty"`
+}
+
+type adaptiveWindow struct {
+	requests  int
+	docs      int
+	rejected  int
+	throttled int
+	failed    int
+	latency   time.Duration
+}
+
+type AdaptiveBulkController struct {
+	key    string
+	config AdaptiveBulkConfig
+	//the config as passed in, before the defaults
+	source AdaptiveBulkConfig
+
+	lock sync.Mutex
+	cond *sync.Cond
+
+	sizeInBytes int
+	docsCount   int
+	concurrency int
+	inFlight    int
+	backoffs    int
+
+	window      adaptiveWindow
+	windowStart time.Time
+
+	threadPoolStats     ThreadPoolStatsFunc
+	lastThreadPoolCheck time.Time
+	lastPoolRejected    int64
+	threadPoolChecked   bool
+	pollingThreadPool   bool
+
+	lastAction   string
+	lastReason   string
+	lastAdjusted time.Time
+}
+
+// NewAdaptiveBulkController starts from the static batch limits of cfg and
+// keeps every limit inside the adaptive bounds
+func NewAdaptiveBulkController(key string, cfg BulkProcessorConfig, threadPoolStats ThreadPoolStatsFunc) *AdaptiveBulkController {
+	c := &AdaptiveBulkController{
+		key:             key,
+		config:          cfg.Adaptive,
+		source:          cfg.Adaptive,
+		threadPoolStats: threadPoolStats,
+		windowStart:     time.Now(),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	c.applyDefaults()
+
+	c.sizeInBytes = clampInt(cfg.GetBulkSizeInBytes(), c.config.MinBulkSizeInKb*1024, c.config.MaxBulkSizeInKb*1024)
+	c.docsCount = cfg.BulkMaxDocsCount
+	if c.docsCount <= 0 {
+		c.docsCount = DefaultBulkProcessorConfig.BulkMaxDocsCount
+	}
+	c.docsCount = clampInt(c.docsCount, c.config.MinBulkDocsCount, c.config.MaxBulkDocsCount)
+	c.concurrency = c.config.MinConcurrency
+	if c.config.MaxConcurrency > 0 {
+		c.concurrency = c.config.MaxConcurrency
+	}
+	c.publish()
+	return c
+}
+
+// reconfigure switches the controller to a changed adaptive config, the
+// current limits are kept within the new bounds
+func (c *AdaptiveBulkController) reconfigure(cfg AdaptiveBulkConfig) {
+	c.lock.Lock()
+	if c.source == cfg {
+		c.lock.Unlock()
+		return
+	}
+	unbounded := c.config.MaxConcurrency <= 0
+	c.source = cfg
+	c.config = cfg
+	c.applyDefaults()
+	c.sizeInBytes = clampInt(c.sizeInBytes, c.config.MinBulkSizeInKb*1024, c.config.MaxBulkSizeInKb*1024)
+	c.docsCount = clampInt(c.docsCount, c.config.MinBulkDocsCount, c.config.MaxBulkDocsCount)
+	if c.config.MaxConcurrency <= 0 {
+		c.concurrency = c.config.MinConcurrency
+	} else if unbounded {
+		c.concurrency = c.config.MaxConcurrency
+	} else {
+		c.concurrency = clampInt(c.concurrency, c.config.MinConcurrency, c.config.MaxConcurrency)
+	}
+	c.lock.Unlock()
+	c.cond.Broadcast()
+
+	log.Infof("adaptive bulk [%v] reconfigured", c.key)
+	c.publish()
+}
+
+func (c *AdaptiveBulkController) applyDefaults() {
+	d := DefaultAdaptiveBulkConfig
+	if c.config.MinBulkSizeInKb <= 0 {
+		c.config.MinBulkSizeInKb = d.MinBulkSizeInKb
+	}
+	if c.config.MaxBulkSizeInKb < c.config.MinBulkSizeInKb {
+		c.config.MaxBulkSizeInKb = max(d.MaxBulkSizeInKb, c.config.MinBulkSizeInKb)
+	}
+	if c.config.BulkSizeStepInKb <= 0 {
+		c.config.BulkSizeStepInKb = d.BulkSizeStepInKb
+	}
+	if c.config.MinBulkDocsCount <= 0 {
+		c.config.MinBulkDocsCount = d.MinBulkDocsCount
+	}
+	if c.config.MaxBulkDocsCount < c.config.MinBulkDocsCount {
+		c.config.MaxBulkDocsCount = max(d.MaxBulkDocsCount, c.config.MinBulkDocsCount)
+	}
+	if c.config.BulkDocsCountStep <= 0 {
+		c.config.BulkDocsCountStep = d.BulkDocsCountStep
+	}
+	if c.config.MinConcurrency <= 0 {
+		c.config.MinConcurrency = d.MinConcurrency
+	}
+	if c.config.MaxConcurrency > 0 && c.config.MaxConcurrency < c.config.MinConcurrency {
+		c.config.MaxConcurrency = c.config.MinConcurrency
+	}
+	if c.config.DecreaseFactor <= 0 || c.config.DecreaseFactor >= 1 {
+		c.config.DecreaseFactor = d.DecreaseFactor
+	}
+	if c.config.AdjustIntervalInMs < 0 {
+		c.config.AdjustIntervalInMs = 0
+	}
+	if c.config.MaxRejectDelayInSeconds <= 0 {
+		c.config.MaxRejectDelayInSeconds = d.MaxRejectDelayInSeconds
+	}
+}
+
+func (c *AdaptiveBulkController) BulkSizeInBytes() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sizeInBytes
+}
+
+func (c *AdaptiveBulkController) BulkMaxDocsCount() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.docsCount
+}
+
+func (c *AdaptiveBulkController) Concurrency() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.concurrency
+}
+
+// Acquire blocks until the number of in-flight bulk requests is below the
+// current concurrency, it never blocks when max_concurrency is not set
+func (c *AdaptiveBulkController) Acquire() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.config.MaxConcurrency > 0 {
+		for c.inFlight >= c.concurrency {
+			c.cond.Wait()
+		}
+	}
+	c.inFlight++
+}
+
+func (c *AdaptiveBulkController) Release() {
+	c.lock.Lock()
+	c.inFlight--
+	c.lock.Unlock()
+	c.cond.Signal()
+}
+
+// RejectDelay doubles the configured reject retry delay for every consecutive
+// decrease, up to max_reject_retry_delay_in_seconds
+func (c *AdaptiveBulkController) RejectDelay(base time.Duration) time.Duration {
+	c.lock.Lock()
+	backoffs := c.backoffs
+	c.lock.Unlock()
+
+	maxDelay := time.Duration(c.config.MaxRejectDelayInSeconds) * time.Second
+	delay := base
+	for i := 0; i < backoffs && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// Observe records a bulk attempt, once per adjust interval the collected
+// samples decide whether the limits grow or shrink
+func (c *AdaptiveBulkController) Observe(sample BulkSample) {
+	pressure := c.checkThreadPool()
+
+	c.lock.Lock()
+	c.window.requests++
+	c.window.docs += sample.Docs
+	c.window.rejected += sample.Rejected
+	c.window.latency += sample.Latency
+	if sample.Throttled {
+		c.window.throttled++
+	}
+	if sample.Failed {
+		c.window.failed++
+	}
+
+	if pressure == "" && time.Since(c.windowStart) < time.Duration(c.config.AdjustIntervalInMs)*time.Millisecond {
+		c.lock.Unlock()
+		return
+	}
+
+	reason := pressure
+	if reason == "" {
+		reason = c.evaluate()
+	}
+	c.window = adaptiveWindow{}
+	c.windowStart = time.Now()
+
+	if reason == AdaptiveReasonHealthy {
+		c.increase()
+	} else {
+		c.decrease()
+	}
+	c.lastReason = reason
+	c.lastAdjusted = time.Now()
+	action := c.lastAction
+	size, docs, concurrency := c.sizeInBytes, c.docsCount, c.concurrency
+	c.lock.Unlock()
+	c.cond.Broadcast()
+
+	stats.Increment(c.statsCategory(), action, reason)
+	c.publish()
+
+	if action == "decrease" {
+		log.Debugf("adaptive bulk [%v] shrinks on %v, size: %v, docs: %v, concurrency: %v", c.key, reason, size, docs, concurrency)
+	}
+}
+
+func (c *AdaptiveBulkController) evaluate() string {
+	w := c.window
+	if w.throttled > 0 {
+		return AdaptiveReasonRejected
+	}
+	if w.rejected > 0 && (w.docs <= 0 || float64(w.rejected)/float64(w.docs) > c.config.MaxRejectRatio) {
+		return AdaptiveReasonRejected
+	}
+	if w.failed > 0 {
+		return AdaptiveReasonError
+	}
+	if c.config.TargetLatencyInMs > 0 && w.requests > 0 &&
+		w.latency/time.Duration(w.requests) > time.Duration(c.config.TargetLatencyInMs)*time.Millisecond {
+		return AdaptiveReasonLatency
+	}
+	return AdaptiveReasonHealthy
+}
+
+func (c *AdaptiveBulkController) increase() {
+	c.lastAction = "increase"
+	c.backoffs = 0
+	c.sizeInBytes = clampInt(c.sizeInBytes+c.config.BulkSizeStepInKb*1024, c.config.MinBulkSizeInKb*1024, c.config.MaxBulkSizeInKb*1024)
+	c.docsCount = clampInt(c.docsCount+c.config.BulkDocsCountStep, c.config.MinBulkDocsCount, c.config.MaxBulkDocsCount)
+	if c.config.MaxConcurrency > 0 {
+		c.concurrency = clampInt(c.concurrency+1, c.config.MinConcurrency, c.config.MaxConcurrency)
+	}
+}
+
+func (c *AdaptiveBulkController) decrease() {
+	c.lastAction = "decrease"
+	c.backoffs++
+	factor := c.config.DecreaseFactor
+	c.sizeInBytes = clampInt(int(float64(c.sizeInBytes)*factor), c.config.MinBulkSizeInKb*1024, c.config.MaxBulkSizeInKb*1024)
+	c.docsCount = clampInt(int(float64(c.docsCount)*factor), c.config.MinBulkDocsCount, c.config.MaxBulkDocsCount)
+	if c.config.MaxConcurrency > 0 {
+		c.concurrency = clampInt(int(float64(c.concurrency)*factor), c.config.MinConcurrency, c.config.MaxConcurrency)
+	}
+}
+
+// checkThreadPool polls the thread pool stats when due, only one caller polls
+// at a time and the others carry on without waiting for it
+func (c *AdaptiveBulkController) checkThreadPool() string {
+	if c.threadPoolStats == nil || c.config.ThreadPoolCheckIntervalInSeconds <= 0 {
+		return ""
+	}
+
+	c.lock.Lock()
+	if c.pollingThreadPool || time.Since(c.lastThreadPoolCheck) < time.Duration(c.config.ThreadPoolCheckIntervalInSeconds)*time.Second {
+		c.lock.Unlock()
+		return ""
+	}
+	c.pollingThreadPool = true
+	c.lock.Unlock()
+
+	pressure, err := c.threadPoolStats()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pollingThreadPool = false
+	c.lastThreadPoolCheck = time.Now()
+	if err != nil || pressure == nil {
+		log.Debugf("adaptive bulk [%v] failed to check thread pool: %v", c.key, err)
+		return ""
+	}
+
+	//rejected is a counter since node start, only the growth counts
+	checked := c.threadPoolChecked
+	rejected := pressure.Rejected - c.lastPoolRejected
+	c.threadPoolChecked = true
+	c.lastPoolRejected = pressure.Rejected
+	if checked && rejected > 0 {
+		return AdaptiveReasonThreadPoolRejected
+	}
+	if c.config.MaxThreadPoolQueue > 0 && pressure.Queue > int64(c.config.MaxThreadPoolQueue) {
+		return AdaptiveReasonThreadPoolQueue
+	}
+	return ""
+}
+
+func (c *AdaptiveBulkController) Status() AdaptiveBulkStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return AdaptiveBulkStatus{
+		BulkSizeInBytes: c.sizeInBytes,
+		BulkDocsCount:   c.docsCount,
+		Concurrency:     c.concurrency,
+		InFlight:        c.inFlight,
+		LastAction:      c.lastAction,
+		LastReason:      c.lastReason,
+		LastAdjusted:    c.lastAdjusted,
+	}
+}
+
+func (c *AdaptiveBulkController) statsCategory() string {
+	return "elasticsearch.bulk.adaptive." + c.key
+}
+
+func (c *AdaptiveBulkController) publish() {
+	status := c.Status()
+	category := c.statsCategory()
+	stats.Gauge(category, "batch_size_in_bytes", int64(status.BulkSizeInBytes))
+	stats.Gauge(category, "batch_size_in_docs", int64(status.BulkDocsCount))
+	stats.Gauge(category, "concurrency", int64(status.Concurrency))
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if max > 0 && v > max {
+		return max
+	}
+	return v
+}
+
+var adaptiveControllers = sync.Map{}
+var adaptiveControllersLock sync.Mutex
+var registerAdaptiveStats sync.Once
+
+// GetAdaptiveBulkController returns the controller shared by the bulk
+// processors of the same tag and cluster, so that their limits add up. A
+// processor started with a changed adaptive config updates the controller.
+func GetAdaptiveBulkController(tag, esClusterID string, cfg BulkProcessorConfig) *AdaptiveBulkController {
+	key := fmt.Sprintf("%v.%v", tag, esClusterID)
+	if v, ok := adaptiveControllers.Load(key); ok {
+		c := v.(*AdaptiveBulkController)
+		c.reconfigure(cfg.Adaptive)
+		return c
+	}
+
+	adaptiveControllersLock.Lock()
+	defer adaptiveControllersLock.Unlock()
+	if v, ok := adaptiveControllers.Load(key); ok {
+		c := v.(*AdaptiveBulkController)
+		c.reconfigure(cfg.Adaptive)
+		return c
+	}
+
+	registerAdaptiveStats.Do(func() {
+		stats.RegisterStats("bulk_adaptive", func() interface{} {
+			status := map[string]AdaptiveBulkStatus{}
+			adaptiveControllers.Range(func(k, v any) bool {
+				status[k.(string)] = v.(*AdaptiveBulkController).Status()
+				return true
+			})
+			return status
+		})
+	})
+
+	c := NewAdaptiveBulkController(key, cfg, NodesWriteThreadPoolStats(esClusterID))
+	adaptiveControllers.Store(key, c)
+	return c
+}
+
+// NodesWriteThreadPoolStats reads the write (or legacy bulk) thread pool of
+// every node and reports the largest queue and the total rejected count
+func NodesWriteThreadPoolStats(esClusterID string) ThreadPoolStatsFunc {
+	return func() (*ThreadPoolPressure, error) {
+		client := GetClientNoPanic(esClusterID)
+		if client == nil {
+			return nil, fmt.Errorf("elasticsearch client [%v] was not found", esClusterID)
+		}
+		nodesStats := client.GetNodesStats("", "", "")
+		if nodesStats == nil {
+			return nil, fmt.Errorf("empty nodes stats of [%v]", esClusterID)
+		}
+		if nodesStats.ErrorObject != nil {
+			return nil, nodesStats.ErrorObject
+		}
+		return ParseWriteThreadPoolPressure(nodesStats.Nodes), nil
+	}
+}
+
+func ParseWriteThreadPoolPressure(nodes map[string]interface{}) *ThreadPoolPressure {
+	pressure := &ThreadPoolPressure{}
+	for _, node := range nodes {
+		nodeObj, ok := node.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		pools, ok := nodeObj["thread_pool"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		pool, ok := pools["write"].(map[string]interface{})
+		if !ok {
+			pool, ok = pools["bulk"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+		}
+		if queue, ok := pool["queue"].(float64); ok && int64(queue) > pressure.Queue {
+			pressure.Queue = int64(queue)
+		}
+		if rejected, ok := pool["rejected"].(float64); ok {
+			pressure.Rejected += int64(rejected)
+		}
+	}
+	return pressure
+}
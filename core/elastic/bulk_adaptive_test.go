@@ -0,0 +1,226 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAdaptiveConfig() BulkProcessorConfig {
+	cfg := DefaultBulkProcessorConfig
+	cfg.BulkSizeInMb = 0
+	cfg.BulkSizeInKb = 4096
+	cfg.BulkMaxDocsCount = 1000
+	cfg.Adaptive = AdaptiveBulkConfig{
+		Enabled:                          true,
+		MinBulkSizeInKb:                  1024,
+		MaxBulkSizeInKb:                  6144,
+		BulkSizeStepInKb:                 1024,
+		MinBulkDocsCount:                 200,
+		MaxBulkDocsCount:                 1200,
+		BulkDocsCountStep:                100,
+		MinConcurrency:                   1,
+		MaxConcurrency:                   4,
+		DecreaseFactor:                   0.5,
+		TargetLatencyInMs:                1000,
+		ThreadPoolCheckIntervalInSeconds: 1,
+		MaxThreadPoolQueue:               100,
+	}
+	return cfg
+}
+
+func newTestAdaptiveController(threadPoolStats ThreadPoolStatsFunc) *AdaptiveBulkController {
+	return NewAdaptiveBulkController("test", newTestAdaptiveConfig(), threadPoolStats)
+}
+
+func TestAdaptiveBulkController_AIMD(t *testing.T) {
+	c := newTestAdaptiveController(nil)
+	assert.Equal(t, 4096*1024, c.BulkSizeInBytes())
+	assert.Equal(t, 1000, c.BulkMaxDocsCount())
+	assert.Equal(t, 4, c.Concurrency())
+
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000})
+	assert.Equal(t, 5120*1024, c.BulkSizeInBytes())
+	assert.Equal(t, 1100, c.BulkMaxDocsCount())
+	assert.Equal(t, "increase", c.Status().LastAction)
+	assert.Equal(t, AdaptiveReasonHealthy, c.Status().LastReason)
+
+	//additive increase stops at the upper bounds
+	for i := 0; i < 5; i++ {
+		c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000})
+	}
+	assert.Equal(t, 6144*1024, c.BulkSizeInBytes())
+	assert.Equal(t, 1200, c.BulkMaxDocsCount())
+	assert.Equal(t, 4, c.Concurrency())
+
+	//es_rejected_execution_exception items halve everything
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000, Rejected: 3})
+	status := c.Status()
+	assert.Equal(t, "decrease", status.LastAction)
+	assert.Equal(t, AdaptiveReasonRejected, status.LastReason)
+	assert.Equal(t, 3072*1024, status.BulkSizeInBytes)
+	assert.Equal(t, 600, status.BulkDocsCount)
+	assert.Equal(t, 2, status.Concurrency)
+
+	//multiplicative decrease stops at the lower bounds
+	for i := 0; i < 5; i++ {
+		c.Observe(BulkSample{Throttled: true})
+	}
+	assert.Equal(t, 1024*1024, c.BulkSizeInBytes())
+	assert.Equal(t, 200, c.BulkMaxDocsCount())
+	assert.Equal(t, 1, c.Concurrency())
+}
+
+func TestGetAdaptiveBulkController(t *testing.T) {
+	cfg := newTestAdaptiveConfig()
+	c := GetAdaptiveBulkController("test", t.Name(), cfg)
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000})
+	assert.Same(t, c, GetAdaptiveBulkController("test", t.Name(), cfg))
+	assert.Equal(t, 5120*1024, c.BulkSizeInBytes())
+	assert.Equal(t, 4, c.Concurrency())
+
+	//a changed config narrows the limits of the shared controller
+	cfg.Adaptive.MaxBulkSizeInKb = 2048
+	cfg.Adaptive.MaxConcurrency = 2
+	assert.Same(t, c, GetAdaptiveBulkController("test", t.Name(), cfg))
+	assert.Equal(t, 2048*1024, c.BulkSizeInBytes())
+	assert.Equal(t, 1100, c.BulkMaxDocsCount())
+	assert.Equal(t, 2, c.Concurrency())
+
+	//without a bound on concurrency requests are no longer held back
+	cfg.Adaptive.MaxConcurrency = 0
+	GetAdaptiveBulkController("test", t.Name(), cfg)
+	for i := 0; i < 5; i++ {
+		c.Acquire()
+	}
+	assert.Equal(t, 5, c.Status().InFlight)
+}
+
+func TestAdaptiveBulkController_Reasons(t *testing.T) {
+	c := newTestAdaptiveController(nil)
+
+	c.Observe(BulkSample{Latency: 2 * time.Second, Docs: 1000})
+	assert.Equal(t, AdaptiveReasonLatency, c.Status().LastReason)
+
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000, Failed: true})
+	assert.Equal(t, AdaptiveReasonError, c.Status().LastReason)
+
+	//rejections below the tolerated ratio do not shrink the batch
+	c.config.MaxRejectRatio = 0.01
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000, Rejected: 5})
+	assert.Equal(t, AdaptiveReasonHealthy, c.Status().LastReason)
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000, Rejected: 50})
+	assert.Equal(t, AdaptiveReasonRejected, c.Status().LastReason)
+}
+
+func TestAdaptiveBulkController_AdjustInterval(t *testing.T) {
+	c := newTestAdaptiveController(nil)
+	c.config.AdjustIntervalInMs = 60000
+
+	//samples within the window are collected, not acted upon
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000, Rejected: 10})
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000})
+	assert.Equal(t, 4096*1024, c.BulkSizeInBytes())
+	assert.Equal(t, "", c.Status().LastReason)
+
+	c.windowStart = time.Now().Add(-time.Minute)
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000})
+	assert.Equal(t, AdaptiveReasonRejected, c.Status().LastReason)
+	assert.Equal(t, 2048*1024, c.BulkSizeInBytes())
+}
+
+func TestAdaptiveBulkController_ThreadPool(t *testing.T) {
+	pressure := &ThreadPoolPressure{Queue: 10, Rejected: 500}
+	c := newTestAdaptiveController(func() (*ThreadPoolPressure, error) {
+		return pressure, nil
+	})
+
+	//the rejected counter of the first poll is only a baseline
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000})
+	assert.Equal(t, AdaptiveReasonHealthy, c.Status().LastReason)
+
+	pressure = &ThreadPoolPressure{Queue: 10, Rejected: 520}
+	c.lastThreadPoolCheck = time.Time{}
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000})
+	assert.Equal(t, AdaptiveReasonThreadPoolRejected, c.Status().LastReason)
+
+	pressure = &ThreadPoolPressure{Queue: 300, Rejected: 520}
+	c.lastThreadPoolCheck = time.Time{}
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000})
+	assert.Equal(t, AdaptiveReasonThreadPoolQueue, c.Status().LastReason)
+
+	//not polled again before the check interval
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000})
+	assert.Equal(t, AdaptiveReasonHealthy, c.Status().LastReason)
+}
+
+func TestAdaptiveBulkController_Concurrency(t *testing.T) {
+	c := newTestAdaptiveController(nil)
+	for i := 0; i < 5; i++ {
+		c.Observe(BulkSample{Throttled: true})
+	}
+	assert.Equal(t, 1, c.Concurrency())
+
+	c.Acquire()
+	acquired := make(chan struct{})
+	go func() {
+		c.Acquire()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired a second slot with concurrency 1")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.Release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("slot was not handed over after release")
+	}
+	assert.Equal(t, 1, c.Status().InFlight)
+	c.Release()
+}
+
+func TestAdaptiveBulkController_RejectDelay(t *testing.T) {
+	c := newTestAdaptiveController(nil)
+	c.config.MaxRejectDelayInSeconds = 10
+	assert.Equal(t, time.Second, c.RejectDelay(time.Second))
+
+	c.Observe(BulkSample{Throttled: true})
+	c.Observe(BulkSample{Throttled: true})
+	assert.Equal(t, 4*time.Second, c.RejectDelay(time.Second))
+
+	for i := 0; i < 5; i++ {
+		c.Observe(BulkSample{Throttled: true})
+	}
+	assert.Equal(t, 10*time.Second, c.RejectDelay(time.Second))
+
+	c.Observe(BulkSample{Latency: 100 * time.Millisecond, Docs: 1000})
+	assert.Equal(t, time.Second, c.RejectDelay(time.Second))
+}
+
+func TestParseWriteThreadPoolPressure(t *testing.T) {
+	nodes := map[string]interface{}{
+		"node1": map[string]interface{}{
+			"thread_pool": map[string]interface{}{
+				"write":  map[string]interface{}{"queue": float64(12), "rejected": float64(3)},
+				"search": map[string]interface{}{"queue": float64(900), "rejected": float64(100)},
+			},
+		},
+		"node2": map[string]interface{}{
+			"thread_pool": map[string]interface{}{
+				"bulk": map[string]interface{}{"queue": float64(40), "rejected": float64(7)},
+			},
+		},
+		"node3": map[string]interface{}{},
+	}
+	pressure := ParseWriteThreadPoolPressure(nodes)
+	assert.Equal(t, int64(40), pressure.Queue)
+	assert.Equal(t, int64(10), pressure.Rejected)
+}
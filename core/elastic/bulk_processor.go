@@ -322,6 +322,8 @@ type BulkProcessorConfig struct {
 	BulkResponseParseConfig BulkResponseParseConfig `config:"response_handle"`
 
 	RemoveDuplicatedNewlines bool `config:"remove_duplicated_newlines"`
+
+	Adaptive AdaptiveBulkConfig `config:"adaptive"`
 }
 
 type BulkResponseParseConfig struct {
@@ -451,12 +453,15 @@ var DefaultBulkProcessorConfig = BulkProcessorConfig{
 	},
 	RetryRules:             RetryRules{Retry429: true, Default: true, Retry4xx: false},
 	RequestTimeoutInSecond: 60,
+	Adaptive:               DefaultAdaptiveBulkConfig,
 }
 
 type BulkProcessor struct {
 	Config         BulkProcessorConfig
 	BulkBufferPool *BulkBufferPool
 	HttpPool       *fasthttp.RequestResponsePool
+	//only set when adaptive is enabled
+	Adaptive *AdaptiveBulkController
 }
 
 func NewBulkProcessor(tag, esClusterID string, cfg BulkProcessorConfig) BulkProcessor {
@@ -468,10 +473,37 @@ func NewBulkProcessor(tag, esClusterID string, cfg BulkProcessorConfig) BulkProc
 	if bulkProcessor.Config.DeadletterRequestsQueue == "" {
 		bulkProcessor.Config.DeadletterRequestsQueue = fmt.Sprintf("%v-bulk-dead_letter-items", esClusterID)
 	}
+	if cfg.Adaptive.Enabled {
+		bulkProcessor.Adaptive = GetAdaptiveBulkController(tag, esClusterID, cfg)
+	}
 
 	return bulkProcessor
 }
 
+// GetBulkSizeInBytes returns the batch size to fill before calling Bulk
+func (joint *BulkProcessor) GetBulkSizeInBytes() int {
+	if joint.Adaptive != nil {
+		return joint.Adaptive.BulkSizeInBytes()
+	}
+	return joint.Config.GetBulkSizeInBytes()
+}
+
+// GetBulkMaxDocsCount returns the batch doc count to fill before calling Bulk
+func (joint *BulkProcessor) GetBulkMaxDocsCount() int {
+	if joint.Adaptive != nil {
+		return joint.Adaptive.BulkMaxDocsCount()
+	}
+	return joint.Config.BulkMaxDocsCount
+}
+
+func (joint *BulkProcessor) observe(start time.Time, sample BulkSample) {
+	if joint.Adaptive == nil {
+		return
+	}
+	sample.Latency = time.Since(start)
+	joint.Adaptive.Observe(sample)
+}
+
 // bulkResult is valid only if max_reject_retry_times == 0
 func (joint *BulkProcessor) Bulk(ctx context.Context, tag string, metadata *ElasticsearchMetadata, host string, buffer *BulkBuffer) (continueNext bool, statsRet map[int]int, bulkResult *BulkResult, err error) {
 
@@ -563,6 +595,11 @@ func (joint *BulkProcessor) Bulk(ctx context.Context, tag string, metadata *Elas
 	defer joint.BulkBufferPool.ReturnBulkBuffer(retryableItems)
 	defer joint.BulkBufferPool.ReturnBulkBuffer(successItems)
 
+	if joint.Adaptive != nil {
+		joint.Adaptive.Acquire()
+		defer joint.Adaptive.Release()
+	}
+
 DO:
 
 	if req.GetBodyLength() <= 0 {
@@ -575,6 +612,11 @@ DO:
 
 	req.SetURI(clonedURI)
 	//execute
+	start := time.Now()
+	attemptDocs := buffer.GetMessageCount()
+	if retryTimes > 0 {
+		attemptDocs = retryableItems.GetMessageCount()
+	}
 	err = httpClient.DoTimeout(req, resp, time.Duration(joint.Config.RequestTimeoutInSecond)*time.Second)
 	//restore schema
 	clonedURI.SetScheme(orignalSchema)
@@ -586,6 +628,7 @@ DO:
 	}
 
 	if err != nil {
+		joint.observe(start, BulkSample{Docs: attemptDocs, Failed: true})
 		if rate.GetRateLimiter(metadata.Config.ID, host+"5xx_on_error", 1, 1, 5*time.Second).Allow() {
 			log.Error("status:", resp.StatusCode(), ",", host, ",", err, " ", util.SubString(util.UnsafeBytesToString(resp.GetRawBody()), 0, 256))
 			time.Sleep(2 * time.Second)
@@ -628,6 +671,8 @@ DO:
 		if util.ContainStr(string(req.Header.RequestURI()), "_bulk") {
 
 			containError, statsCodeStats, bulkResult := HandleBulkResponse(req, resp, labels, data, resbody, successItems, nonRetryableItems, retryableItems, joint.Config.BulkResponseParseConfig, joint.Config.RetryRules)
+			//es_rejected_execution_exception items come back as 429
+			joint.observe(start, BulkSample{Docs: attemptDocs, Rejected: statsCodeStats[429]})
 
 			for k, v := range statsCodeStats {
 				if global.Env().IsDebug {
@@ -654,7 +699,11 @@ DO:
 						delayTime = 5
 					}
 
-					time.Sleep(time.Duration(delayTime) * time.Second)
+					delay := time.Duration(delayTime) * time.Second
+					if joint.Adaptive != nil {
+						delay = joint.Adaptive.RejectDelay(delay)
+					}
+					time.Sleep(delay)
 
 					if joint.Config.MaxRejectRetryTimes < 0 {
 						joint.Config.MaxRejectRetryTimes = 3
@@ -697,6 +746,7 @@ DO:
 		return true, statsRet, bulkResult, nil
 	} else {
 		statsRet[resp.StatusCode()] = statsRet[resp.StatusCode()] + buffer.GetMessageCount()
+		joint.observe(start, BulkSample{Docs: attemptDocs, Throttled: resp.StatusCode() == 429, Failed: resp.StatusCode() >= 500})
 
 		var bulkResult *BulkResult
 
@@ -722,6 +772,10 @@ DO:
 			if !joint.Config.RetryRules.Retryable(resp.StatusCode(), util.UnsafeBytesToString(resp.GetRawBody())) {
 				truncatedResponse := util.SubString(util.UnsafeBytesToString(resbody), 0, joint.Config.BulkResponseParseConfig.BulkResultMessageMaxRequestBodyLength)
 				log.Warnf("code: %v, but hit condition to skip retry, response: %v", resp.StatusCode(), truncatedResponse)
+				//park the request like the 4xx ones, continuing without it would drop it
+				if joint.Config.InvalidRequestsQueue != "" {
+					queue.Push(queue.GetOrInitConfig(joint.Config.InvalidRequestsQueue), data)
+				}
 				return true, statsRet, bulkResult, errors.Errorf("code: %v, response: %v", resp.StatusCode(), truncatedResponse)
 			}
 
@@ -0,0 +1,1414 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"infini.sh/framework/core/aggregate"
+)
+
+type aggSpec struct {
+	name string
+	kind string
+	body map[string]interface{}
+	meta interface{}
+	subs []*aggSpec
+}
+
+// pipeline aggregations computed over the buckets of their parent, and
+// over the buckets of a sibling aggregation.
+var (
+	parentPipelines = map[string]bool{
+		"derivative": true, "cumulative_sum": true, "bucket_script": true, "bucket_selector": true,
+		"bucket_sort": true, "serial_diff": true,
+	}
+	siblingPipelines = map[string]bool{
+		"sum_bucket": true, "avg_bucket": true, "min_bucket": true, "max_bucket": true,
+		"stats_bucket": true, "percentiles_bucket": true,
+	}
+)
+
+func parseAggs(raw map[string]interface{}) ([]*aggSpec, error) {
+	names := make([]string, 0, len(raw))
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []*aggSpec
+	for _, name := range names {
+		m, ok := asMap(raw[name])
+		if !ok {
+			return nil, parsingError("Expected [START_OBJECT] under [%v], but got a [VALUE_STRING] in [%v]", name, name)
+		}
+		spec := &aggSpec{name: name}
+		for k, v := range m {
+			switch k {
+			case "aggs", "aggregations":
+				sub, _ := asMap(v)
+				subs, err := parseAggs(sub)
+				if err != nil {
+					return nil, err
+				}
+				spec.subs = subs
+			case "meta":
+				spec.meta = v
+			default:
+				if spec.kind != "" {
+					return nil, parsingError("Found two aggregation type definitions in [%v]: [%v] and [%v]", name, spec.kind, k)
+				}
+				spec.kind = k
+				spec.body, _ = asMap(v)
+				if spec.body == nil {
+					spec.body = map[string]interface{}{}
+				}
+			}
+		}
+		if spec.kind == "" {
+			return nil, parsingError("Missing definition for aggregation [%v]", name)
+		}
+		out = append(out, spec)
+	}
+	return out, nil
+}
+
+// aggRunner evaluates an aggregation tree over candidates; nested
+// aggregations swap documents for their nested objects.
+type aggRunner struct {
+	s       *Server
+	qc      *queryContext
+	indices []*index
+	scores  map[*document]float64
+}
+
+func (s *Server) aggregate(qc *queryContext, indices []*index, raw map[string]interface{}, hits []*hit) (map[string]interface{}, error) {
+	specs, err := parseAggs(raw)
+	if err != nil {
+		return nil, err
+	}
+	a := &aggRunner{s: s, qc: qc, indices: indices, scores: map[*document]float64{}}
+	docs := make([]candidate, 0, len(hits))
+	for _, h := range hits {
+		a.scores[h.doc] = h.score
+		docs = append(docs, candidate{idx: h.idx, doc: h.doc, src: h.doc.fields})
+	}
+	for _, spec := range specs {
+		if parentPipelines[spec.kind] {
+			return nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+				reason: fmt.Sprintf("Validation Failed: 1: %v aggregation [%v] must have a histogram, date_histogram or auto_date_histogram as parent;", spec.kind, spec.name)}
+		}
+	}
+	out, err := a.run(specs, docs)
+	if err != nil {
+		return nil, err
+	}
+	if a.qc.err != nil {
+		return nil, a.qc.err
+	}
+	return out, nil
+}
+
+// run evaluates one level: bucket and metric aggregations first, then the
+// sibling pipelines reading them. Parent pipelines are left to the
+// enclosing multi-bucket aggregation.
+func (a *aggRunner) run(specs []*aggSpec, docs []candidate) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	for _, spec := range specs {
+		if parentPipelines[spec.kind] || siblingPipelines[spec.kind] {
+			continue
+		}
+		r, err := a.runOne(spec, docs)
+		if err != nil {
+			return nil, err
+		}
+		if spec.meta != nil {
+			r["meta"] = spec.meta
+		}
+		out[spec.name] = r
+	}
+	for _, spec := range specs {
+		if !siblingPipelines[spec.kind] {
+			continue
+		}
+		r, err := a.sibling(spec, out)
+		if err != nil {
+			return nil, err
+		}
+		out[spec.name] = r
+	}
+	return out, nil
+}
+
+func (a *aggRunner) runOne(spec *aggSpec, docs []candidate) (map[string]interface{}, error) {
+	switch spec.kind {
+	case "avg", "sum", "min", "max", "stats", "extended_stats", "value_count", "cardinality",
+		"percentiles", "median_absolute_deviation":
+		return a.metric(spec, docs)
+	case "top_hits":
+		return a.topHits(spec, docs)
+	case "terms":
+		return a.terms(spec, docs)
+	case "histogram":
+		return a.histogram(spec, docs)
+	case "date_histogram":
+		return a.dateHistogram(spec, docs)
+	case "range", "date_range":
+		return a.ranges(spec, docs)
+	case "filter":
+		m, err := a.qc.compile(spec.body)
+		if err != nil {
+			return nil, err
+		}
+		return a.singleBucket(spec, filterDocs(docs, m))
+	case "filters":
+		return a.filters(spec, docs)
+	case "missing":
+		field := toString(spec.body["field"])
+		var missing []candidate
+		for _, c := range docs {
+			if values, _ := c.values(field); len(values) == 0 {
+				missing = append(missing, c)
+			}
+		}
+		return a.singleBucket(spec, missing)
+	case "nested":
+		path := toString(spec.body["path"])
+		var nested []candidate
+		for _, c := range docs {
+			for _, obj := range nestedObjects(c.src, path) {
+				nested = append(nested, candidate{idx: c.idx, doc: c.doc, src: withPath(c.src, path, obj)})
+			}
+		}
+		return a.singleBucket(spec, nested)
+	case "global":
+		hits, err := a.s.match(a.indices, a.qc, nil)
+		if err != nil {
+			return nil, err
+		}
+		all := make([]candidate, 0, len(hits))
+		for _, h := range hits {
+			all = append(all, candidate{idx: h.idx, doc: h.doc, src: h.doc.fields})
+		}
+		return a.singleBucket(spec, all)
+	}
+	return nil, &esError{status: http.StatusBadRequest, typ: "x_content_parse_exception",
+		reason: fmt.Sprintf("[1:1] [aggregations] unknown field [%v]", spec.kind)}
+}
+
+func filterDocs(docs []candidate, m matcher) []candidate {
+	var out []candidate
+	for _, c := range docs {
+		if ok, _ := m(c); ok {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func (a *aggRunner) singleBucket(spec *aggSpec, docs []candidate) (map[string]interface{}, error) {
+	out, err := a.run(spec.subs, docs)
+	if err != nil {
+		return nil, err
+	}
+	out["doc_count"] = len(docs)
+	return out, nil
+}
+
+// bucket computes the sub-aggregations of a bucket and adds doc_count.
+func (a *aggRunner) bucket(spec *aggSpec, docs []candidate, fields map[string]interface{}) (map[string]interface{}, error) {
+	out, err := a.run(spec.subs, docs)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		out[k] = v
+	}
+	out["doc_count"] = len(docs)
+	return out, nil
+}
+
+func (a *aggRunner) checkField(spec *aggSpec, field string) error {
+	if field == "" {
+		if _, ok := spec.body["script"]; ok {
+			return badRequest("[%v] scripts are not supported by elastictest", spec.name)
+		}
+		return badRequest("Required one of fields [field, script], but none were specified.")
+	}
+	for _, idx := range a.indices {
+		if fieldType, _, ok := idx.lookupField(field); ok && kindOf(fieldType) == kindText && !idx.fieldDataEnabled(field) {
+			return textFieldError(field)
+		}
+	}
+	return nil
+}
+
+// fieldKind returns the kind and type of a field in the first index that
+// maps it.
+func (a *aggRunner) fieldKind(field string) (int, string) {
+	for _, idx := range a.indices {
+		if fieldType, _, ok := idx.lookupField(field); ok {
+			return kindOf(fieldType), fieldType
+		}
+	}
+	return kindKeyword, ""
+}
+
+// numbers collects the numeric values of a field, falling back to the
+// missing value for documents without one.
+func numbers(docs []candidate, field string, missing interface{}) []float64 {
+	var out []float64
+	for _, c := range docs {
+		values, _ := c.values(field)
+		if len(values) == 0 && missing != nil {
+			if f, ok := toFloat(missing); ok {
+				out = append(out, f)
+			}
+			continue
+		}
+		for _, v := range values {
+			switch x := v.(type) {
+			case float64:
+				out = append(out, x)
+			case bool:
+				if x {
+					out = append(out, 1)
+				} else {
+					out = append(out, 0)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// percentile interpolates linearly between the closest ranks of sorted
+// values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return math.NaN()
+	}
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	if hi >= len(sorted) {
+		hi = len(sorted) - 1
+	}
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+func percentKey(p float64) string {
+	s := strconv.FormatFloat(p, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+func nullable(f float64, ok bool) interface{} {
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil
+	}
+	return f
+}
+
+func (a *aggRunner) metric(spec *aggSpec, docs []candidate) (map[string]interface{}, error) {
+	field := toString(spec.body["field"])
+	if err := a.checkField(spec, field); err != nil {
+		return nil, err
+	}
+	kind, fieldType := a.fieldKind(field)
+	missing := spec.body["missing"]
+
+	switch spec.kind {
+	case "value_count":
+		count := 0
+		for _, c := range docs {
+			values, _ := c.values(field)
+			count += len(values)
+		}
+		return map[string]interface{}{"value": count}, nil
+	case "cardinality":
+		seen := map[interface{}]bool{}
+		for _, c := range docs {
+			values, _ := c.values(field)
+			for _, v := range values {
+				seen[v] = true
+			}
+		}
+		return map[string]interface{}{"value": len(seen)}, nil
+	}
+
+	if kind == kindKeyword && fieldType != "" {
+		return nil, badRequest("Field [%v] of type [%v] is not supported for aggregation [%v]", field, fieldType, spec.kind)
+	}
+	values := numbers(docs, field, missing)
+	sort.Float64s(values)
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	n := len(values)
+	minV, maxV, avg := math.NaN(), math.NaN(), math.NaN()
+	if n > 0 {
+		minV, maxV, avg = values[0], values[n-1], sum/float64(n)
+	}
+	withString := func(out map[string]interface{}, key string, v float64) {
+		if kind == kindDate && !math.IsNaN(v) {
+			out[key+"_as_string"] = formatDate(time.UnixMilli(int64(v)).UTC(), toString(spec.body["format"]))
+		}
+	}
+
+	out := map[string]interface{}{}
+	switch spec.kind {
+	case "avg":
+		out["value"] = nullable(avg, n > 0)
+		withString(out, "value", avg)
+	case "sum":
+		out["value"] = sum
+		withString(out, "value", sum)
+	case "min":
+		out["value"] = nullable(minV, n > 0)
+		withString(out, "value", minV)
+	case "max":
+		out["value"] = nullable(maxV, n > 0)
+		withString(out, "value", maxV)
+	case "stats", "extended_stats":
+		out["count"] = n
+		out["min"] = nullable(minV, n > 0)
+		out["max"] = nullable(maxV, n > 0)
+		out["avg"] = nullable(avg, n > 0)
+		out["sum"] = sum
+		if spec.kind == "extended_stats" {
+			var squares float64
+			for _, v := range values {
+				squares += v * v
+			}
+			variance := math.NaN()
+			if n > 0 {
+				variance = squares/float64(n) - avg*avg
+			}
+			std := math.Sqrt(variance)
+			sigma, ok := toFloat(spec.body["sigma"])
+			if !ok {
+				sigma = 2
+			}
+			out["sum_of_squares"] = nullable(squares, n > 0)
+			out["variance"] = nullable(variance, n > 0)
+			out["std_deviation"] = nullable(std, n > 0)
+			out["std_deviation_bounds"] = map[string]interface{}{
+				"upper": nullable(avg+sigma*std, n > 0),
+				"lower": nullable(avg-sigma*std, n > 0),
+			}
+		}
+	case "percentiles":
+		percents := []float64{1, 5, 25, 50, 75, 95, 99}
+		if list, ok := spec.body["percents"].([]interface{}); ok {
+			percents = percents[:0]
+			for _, p := range list {
+				f, _ := toFloat(p)
+				percents = append(percents, f)
+			}
+		}
+		keyed := true
+		if b, ok := toBool(spec.body["keyed"]); ok {
+			keyed = b
+		}
+		if keyed {
+			vals := map[string]interface{}{}
+			for _, p := range percents {
+				vals[percentKey(p)] = nullable(percentile(values, p), n > 0)
+			}
+			out["values"] = vals
+		} else {
+			var vals []interface{}
+			for _, p := range percents {
+				vals = append(vals, map[string]interface{}{"key": p, "value": nullable(percentile(values, p), n > 0)})
+			}
+			out["values"] = vals
+		}
+	case "median_absolute_deviation":
+		median := percentile(values, 50)
+		deviations := make([]float64, 0, n)
+		for _, v := range values {
+			deviations = append(deviations, math.Abs(v-median))
+		}
+		sort.Float64s(deviations)
+		out["value"] = nullable(percentile(deviations, 50), n > 0)
+	}
+	return out, nil
+}
+
+func (a *aggRunner) topHits(spec *aggSpec, docs []candidate) (map[string]interface{}, error) {
+	sr := &searchRequest{size: toInt(spec.body["size"], 3), from: toInt(spec.body["from"], 0), trackTotalHits: -1}
+	sr.totalAsInt = a.s.major < 7
+	var err error
+	if sr.sort, err = parseSortSpecs(spec.body["sort"]); err != nil {
+		return nil, err
+	}
+	if sr.source, err = parseSourceFilter(spec.body["_source"]); err != nil {
+		return nil, err
+	}
+	sr.version, _ = toBool(spec.body["version"])
+	sr.seqNoPrimaryTerm, _ = toBool(spec.body["seq_no_primary_term"])
+	seen := map[*document]bool{}
+	var hits []*hit
+	for _, c := range docs {
+		if c.doc == nil || seen[c.doc] {
+			continue
+		}
+		seen[c.doc] = true
+		hits = append(hits, &hit{idx: c.idx, doc: c.doc, score: a.scores[c.doc]})
+	}
+	a.s.sortHits(hits, sr.sort)
+	total := len(hits)
+	if sr.from < len(hits) {
+		hits = hits[sr.from:]
+	} else {
+		hits = nil
+	}
+	if len(hits) > sr.size {
+		hits = hits[:sr.size]
+	}
+	return map[string]interface{}{"hits": a.s.renderHits(hits, total, sr)}, nil
+}
+
+// bucketKey renders a bucket key like Elasticsearch: numbers, epoch
+// millis plus key_as_string for dates, 1/0 plus key_as_string for
+// booleans.
+func bucketKey(v interface{}, kind int, fieldType, format string) map[string]interface{} {
+	switch kind {
+	case kindDate:
+		f := v.(float64)
+		return map[string]interface{}{"key": int64(f), "key_as_string": formatDate(time.UnixMilli(int64(f)).UTC(), format)}
+	case kindBool:
+		if v.(bool) {
+			return map[string]interface{}{"key": 1, "key_as_string": "true"}
+		}
+		return map[string]interface{}{"key": 0, "key_as_string": "false"}
+	case kindNumber:
+		f := v.(float64)
+		if isIntegerType(fieldType) {
+			return map[string]interface{}{"key": int64(f)}
+		}
+		return map[string]interface{}{"key": f}
+	}
+	return map[string]interface{}{"key": v}
+}
+
+func includeFilter(v interface{}) (func(string) bool, error) {
+	switch x := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		re, err := regexp.Compile("^(?:" + x + ")$")
+		if err != nil {
+			return nil, badRequest("invalid include/exclude pattern [%v]", x)
+		}
+		return re.MatchString, nil
+	case []interface{}:
+		set := map[string]bool{}
+		for _, e := range x {
+			set[toString(e)] = true
+		}
+		return func(s string) bool { return set[s] }, nil
+	}
+	return nil, badRequest("[include] partitions are not supported by elastictest")
+}
+
+type termsOrder struct {
+	path string
+	desc bool
+}
+
+func parseTermsOrder(v interface{}) []termsOrder {
+	var list []interface{}
+	switch x := v.(type) {
+	case nil:
+		return []termsOrder{{"_count", true}, {"_key", false}}
+	case []interface{}:
+		list = x
+	default:
+		list = []interface{}{x}
+	}
+	var out []termsOrder
+	for _, e := range list {
+		m, _ := asMap(e)
+		for k, dir := range m {
+			if k == "_term" {
+				k = "_key"
+			}
+			out = append(out, termsOrder{path: k, desc: toString(dir) == "desc"})
+		}
+	}
+	return append(out, termsOrder{"_key", false})
+}
+
+func (a *aggRunner) terms(spec *aggSpec, docs []candidate) (map[string]interface{}, error) {
+	field := toString(spec.body["field"])
+	if err := a.checkField(spec, field); err != nil {
+		return nil, err
+	}
+	kind, fieldType := a.fieldKind(field)
+	size := toInt(spec.body["size"], 10)
+	minDocCount := toInt(spec.body["min_doc_count"], 1)
+	include, err := includeFilter(spec.body["include"])
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := includeFilter(spec.body["exclude"])
+	if err != nil {
+		return nil, err
+	}
+	missing := spec.body["missing"]
+
+	groups := map[interface{}][]candidate{}
+	var keys []interface{}
+	for _, c := range docs {
+		values, valueKind := c.values(field)
+		if valueKind == kindText {
+			var tokens []interface{}
+			for _, v := range values {
+				for _, tok := range tokenize(v.(string)) {
+					tokens = append(tokens, tok)
+				}
+			}
+			values = tokens
+		}
+		if len(values) == 0 && missing != nil {
+			if cv, ok := comparable(missing, kind); ok {
+				values = []interface{}{cv}
+			}
+		}
+		seen := map[interface{}]bool{}
+		for _, v := range values {
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+			label := toString(v)
+			if kind == kindDate {
+				label = formatDate(time.UnixMilli(int64(v.(float64))).UTC(), "")
+			}
+			if (include != nil && !include(label)) || (exclude != nil && exclude(label)) {
+				continue
+			}
+			if _, ok := groups[v]; !ok {
+				keys = append(keys, v)
+			}
+			groups[v] = append(groups[v], c)
+		}
+	}
+
+	buckets := make([]map[string]interface{}, 0, len(keys))
+	sortKeys := map[int]interface{}{}
+	for _, k := range keys {
+		if len(groups[k]) < minDocCount {
+			continue
+		}
+		b, err := a.bucket(spec, groups[k], bucketKey(k, kind, fieldType, toString(spec.body["format"])))
+		if err != nil {
+			return nil, err
+		}
+		sortKeys[len(buckets)] = k
+		b["__sort_key"] = k
+		buckets = append(buckets, b)
+	}
+	order := parseTermsOrder(spec.body["order"])
+	sort.SliceStable(buckets, func(i, j int) bool {
+		for _, o := range order {
+			var x, y interface{}
+			if o.path == "_key" {
+				x, y = buckets[i]["__sort_key"], buckets[j]["__sort_key"]
+			} else {
+				fx, okx := bucketValue(buckets[i], o.path)
+				fy, oky := bucketValue(buckets[j], o.path)
+				if !okx {
+					fx = math.Inf(-1)
+				}
+				if !oky {
+					fy = math.Inf(-1)
+				}
+				x, y = fx, fy
+			}
+			cmp := compareValues(x, y)
+			if o.desc {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+	other := 0
+	if size > 0 && len(buckets) > size {
+		for _, b := range buckets[size:] {
+			other += b["doc_count"].(int)
+		}
+		buckets = buckets[:size]
+	}
+	for _, b := range buckets {
+		delete(b, "__sort_key")
+	}
+	buckets, err = a.applyParentPipelines(spec, buckets)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"doc_count_error_upper_bound": 0,
+		"sum_other_doc_count":         other,
+		"buckets":                     bucketList(buckets),
+	}, nil
+}
+
+func bucketList(buckets []map[string]interface{}) []interface{} {
+	out := make([]interface{}, len(buckets))
+	for i, b := range buckets {
+		out[i] = b
+	}
+	return out
+}
+
+func (a *aggRunner) histogram(spec *aggSpec, docs []candidate) (map[string]interface{}, error) {
+	field := toString(spec.body["field"])
+	if err := a.checkField(spec, field); err != nil {
+		return nil, err
+	}
+	interval, ok := toFloat(spec.body["interval"])
+	if !ok || interval <= 0 {
+		return nil, badRequest("[interval] must be >0 for histogram aggregation [%v]", spec.name)
+	}
+	offset, _ := toFloat(spec.body["offset"])
+	minDocCount := toInt(spec.body["min_doc_count"], 0)
+	keyOf := func(v float64) float64 {
+		return math.Floor((v-offset)/interval)*interval + offset
+	}
+
+	groups := map[float64][]candidate{}
+	for _, c := range docs {
+		seen := map[float64]bool{}
+		for _, v := range numbers([]candidate{c}, field, spec.body["missing"]) {
+			k := keyOf(v)
+			if !seen[k] {
+				seen[k] = true
+				groups[k] = append(groups[k], c)
+			}
+		}
+	}
+	var keys []float64
+	if minDocCount == 0 {
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for k := range groups {
+			lo, hi = math.Min(lo, k), math.Max(hi, k)
+		}
+		if bounds, ok := asMap(spec.body["extended_bounds"]); ok {
+			if f, ok := toFloat(bounds["min"]); ok {
+				lo = math.Min(lo, keyOf(f))
+			}
+			if f, ok := toFloat(bounds["max"]); ok {
+				hi = math.Max(hi, keyOf(f))
+			}
+		}
+		for k := lo; k <= hi; k += interval {
+			keys = append(keys, k)
+		}
+	} else {
+		for k := range groups {
+			keys = append(keys, k)
+		}
+		sort.Float64s(keys)
+	}
+	var buckets []map[string]interface{}
+	for _, k := range keys {
+		if len(groups[k]) < minDocCount {
+			continue
+		}
+		b, err := a.bucket(spec, groups[k], map[string]interface{}{"key": k})
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	buckets, err := a.applyParentPipelines(spec, buckets)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"buckets": bucketList(buckets)}, nil
+}
+
+var calendarUnits = map[string]byte{
+	"minute": 'm', "1m": 'm', "hour": 'h', "1h": 'h', "day": 'd', "1d": 'd', "week": 'w', "1w": 'w',
+	"month": 'M', "1M": 'M', "quarter": 'q', "1q": 'q', "year": 'y', "1y": 'y',
+}
+
+var fixedInterval = regexp.MustCompile(`^(\d+)(ms|s|m|h|d)$`)
+
+func parseFixedInterval(v string) (time.Duration, bool) {
+	m := fixedInterval.FindStringSubmatch(v)
+	if m == nil {
+		return 0, false
+	}
+	n, _ := strconv.Atoi(m[1])
+	unit := map[string]time.Duration{"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[m[2]]
+	return time.Duration(n) * unit, n > 0
+}
+
+func (a *aggRunner) dateHistogram(spec *aggSpec, docs []candidate) (map[string]interface{}, error) {
+	field := toString(spec.body["field"])
+	if err := a.checkField(spec, field); err != nil {
+		return nil, err
+	}
+	loc, err := loadLocation(toString(spec.body["time_zone"]))
+	if err != nil {
+		return nil, err
+	}
+	format := toString(spec.body["format"])
+	minDocCount := toInt(spec.body["min_doc_count"], 0)
+
+	var unit byte
+	var fixed time.Duration
+	switch {
+	case spec.body["calendar_interval"] != nil:
+		v := toString(spec.body["calendar_interval"])
+		var ok bool
+		if unit, ok = calendarUnits[v]; !ok {
+			return nil, badRequest("The supplied interval [%v] could not be parsed as a calendar interval.", v)
+		}
+	case spec.body["fixed_interval"] != nil:
+		v := toString(spec.body["fixed_interval"])
+		var ok bool
+		if fixed, ok = parseFixedInterval(v); !ok {
+			return nil, badRequest("failed to parse setting [date_histogram.fixedInterval] with value [%v] as a time value: unit is missing or unrecognized", v)
+		}
+	case spec.body["interval"] != nil:
+		v := toString(spec.body["interval"])
+		var ok bool
+		if unit, ok = calendarUnits[v]; !ok {
+			if fixed, ok = parseFixedInterval(v); !ok {
+				return nil, badRequest("Unable to parse interval [%v]", v)
+			}
+		}
+	default:
+		return nil, badRequest("Invalid interval specified, must be non-null and non-empty")
+	}
+	var offset time.Duration
+	if v := toString(spec.body["offset"]); v != "" {
+		sign := time.Duration(1)
+		if v[0] == '-' {
+			sign = -1
+		}
+		d, ok := parseFixedInterval(strings.TrimLeft(v, "+-"))
+		if !ok {
+			return nil, badRequest("failed to parse offset [%v]", v)
+		}
+		offset = sign * d
+	}
+
+	start := func(t time.Time) time.Time {
+		t = t.In(loc).Add(-offset)
+		if unit != 0 {
+			return truncateUnit(t, unit).Add(offset)
+		}
+		_, zone := t.Zone()
+		shift := time.Duration(zone) * time.Second
+		ms := t.UnixMilli() + shift.Milliseconds()
+		step := fixed.Milliseconds()
+		floor := ms - ((ms%step)+step)%step
+		return time.UnixMilli(floor - shift.Milliseconds()).In(loc).Add(offset)
+	}
+	next := func(t time.Time) time.Time {
+		if unit == 'q' {
+			return t.Add(-offset).AddDate(0, 3, 0).Add(offset)
+		}
+		if unit != 0 {
+			return addUnit(t.Add(-offset), unit, 1).Add(offset)
+		}
+		return t.Add(fixed)
+	}
+
+	groups := map[int64][]candidate{}
+	for _, c := range docs {
+		seen := map[int64]bool{}
+		for _, v := range numbers([]candidate{c}, field, nil) {
+			k := start(time.UnixMilli(int64(v))).UnixMilli()
+			if !seen[k] {
+				seen[k] = true
+				groups[k] = append(groups[k], c)
+			}
+		}
+	}
+	var keys []int64
+	if minDocCount == 0 && (len(groups) > 0 || spec.body["extended_bounds"] != nil) {
+		lo, hi := int64(math.MaxInt64), int64(math.MinInt64)
+		for k := range groups {
+			if k < lo {
+				lo = k
+			}
+			if k > hi {
+				hi = k
+			}
+		}
+		if bounds, ok := asMap(spec.body["extended_bounds"]); ok {
+			for key, v := range bounds {
+				t, err := parseDateMath(v, a.qc.now, loc, false)
+				if err != nil {
+					return nil, err
+				}
+				k := start(t).UnixMilli()
+				if key == "min" && k < lo {
+					lo = k
+				}
+				if key == "max" && k > hi {
+					hi = k
+				}
+			}
+		}
+		for t := time.UnixMilli(lo).In(loc); t.UnixMilli() <= hi; t = next(t) {
+			keys = append(keys, t.UnixMilli())
+		}
+	} else {
+		for k := range groups {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	}
+
+	var buckets []map[string]interface{}
+	for _, k := range keys {
+		if len(groups[k]) < minDocCount {
+			continue
+		}
+		b, err := a.bucket(spec, groups[k], map[string]interface{}{
+			"key":           k,
+			"key_as_string": formatDate(time.UnixMilli(k).In(loc), format),
+		})
+		if err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	buckets, err = a.applyParentPipelines(spec, buckets)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"buckets": bucketList(buckets)}, nil
+}
+
+// formatDouble renders a range bound the way Java prints a double.
+func formatDouble(f float64) string {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return strconv.FormatFloat(f, 'f', 1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (a *aggRunner) ranges(spec *aggSpec, docs []candidate) (map[string]interface{}, error) {
+	field := toString(spec.body["field"])
+	if err := a.checkField(spec, field); err != nil {
+		return nil, err
+	}
+	isDate := spec.kind == "date_range"
+	loc, err := loadLocation(toString(spec.body["time_zone"]))
+	if err != nil {
+		return nil, err
+	}
+	format := toString(spec.body["format"])
+	list, _ := spec.body["ranges"].([]interface{})
+	if len(list) == 0 {
+		return nil, badRequest("No [ranges] specified for the [%v] aggregation", spec.name)
+	}
+	bound := func(v interface{}) (float64, bool, error) {
+		if v == nil {
+			return 0, false, nil
+		}
+		if isDate {
+			t, err := parseDateMath(v, a.qc.now, loc, false)
+			if err != nil {
+				return 0, false, err
+			}
+			return float64(t.UnixMilli()), true, nil
+		}
+		f, ok := toFloat(v)
+		if !ok {
+			return 0, false, badRequest("[%v] failed to parse range bound [%v]", spec.name, v)
+		}
+		return f, true, nil
+	}
+	render := func(f float64) string {
+		if isDate {
+			return formatDate(time.UnixMilli(int64(f)).In(loc), format)
+		}
+		return formatDouble(f)
+	}
+
+	keyed, _ := toBool(spec.body["keyed"])
+	var buckets []map[string]interface{}
+	keyedBuckets := map[string]interface{}{}
+	for _, e := range list {
+		r, _ := asMap(e)
+		from, hasFrom, err := bound(r["from"])
+		if err != nil {
+			return nil, err
+		}
+		to, hasTo, err := bound(r["to"])
+		if err != nil {
+			return nil, err
+		}
+		var matched []candidate
+		for _, c := range docs {
+			for _, v := range numbers([]candidate{c}, field, spec.body["missing"]) {
+				if (!hasFrom || v >= from) && (!hasTo || v < to) {
+					matched = append(matched, c)
+					break
+				}
+			}
+		}
+		key := toString(r["key"])
+		fields := map[string]interface{}{}
+		lo, hi := "*", "*"
+		if hasFrom {
+			fields["from"] = from
+			lo = render(from)
+			if isDate || format != "" {
+				fields["from_as_string"] = lo
+			}
+		}
+		if hasTo {
+			fields["to"] = to
+			hi = render(to)
+			if isDate || format != "" {
+				fields["to_as_string"] = hi
+			}
+		}
+		if key == "" {
+			key = lo + "-" + hi
+		}
+		b, err := a.bucket(spec, matched, fields)
+		if err != nil {
+			return nil, err
+		}
+		if keyed {
+			keyedBuckets[key] = b
+			continue
+		}
+		b["key"] = key
+		buckets = append(buckets, b)
+	}
+	if keyed {
+		return map[string]interface{}{"buckets": keyedBuckets}, nil
+	}
+	buckets, err = a.applyParentPipelines(spec, buckets)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"buckets": bucketList(buckets)}, nil
+}
+
+func (a *aggRunner) filters(spec *aggSpec, docs []candidate) (map[string]interface{}, error) {
+	otherBucket, _ := toBool(spec.body["other_bucket"])
+	otherKey := toString(spec.body["other_bucket_key"])
+	if otherKey != "" {
+		otherBucket = true
+	} else {
+		otherKey = "_other_"
+	}
+	matchedAny := map[*document]bool{}
+	run := func(q interface{}) (map[string]interface{}, error) {
+		m, err := a.qc.compile(q)
+		if err != nil {
+			return nil, err
+		}
+		matched := filterDocs(docs, m)
+		for _, c := range matched {
+			matchedAny[c.doc] = true
+		}
+		return a.bucket(spec, matched, nil)
+	}
+	other := func() (map[string]interface{}, error) {
+		var rest []candidate
+		for _, c := range docs {
+			if !matchedAny[c.doc] {
+				rest = append(rest, c)
+			}
+		}
+		return a.bucket(spec, rest, nil)
+	}
+
+	switch x := spec.body["filters"].(type) {
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for name, q := range x {
+			b, err := run(q)
+			if err != nil {
+				return nil, err
+			}
+			out[name] = b
+		}
+		if otherBucket {
+			b, err := other()
+			if err != nil {
+				return nil, err
+			}
+			out[otherKey] = b
+		}
+		return map[string]interface{}{"buckets": out}, nil
+	case []interface{}:
+		var buckets []map[string]interface{}
+		for _, q := range x {
+			b, err := run(q)
+			if err != nil {
+				return nil, err
+			}
+			buckets = append(buckets, b)
+		}
+		if otherBucket {
+			b, err := other()
+			if err != nil {
+				return nil, err
+			}
+			buckets = append(buckets, b)
+		}
+		buckets, err := a.applyParentPipelines(spec, buckets)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"buckets": bucketList(buckets)}, nil
+	}
+	return nil, parsingError("[filters] requires an object or an array of filters")
+}
+
+// bucketValue resolves a buckets_path inside one bucket: _count, _key,
+// metric, metric.stat, percentiles[50.0] or single>metric.
+func bucketValue(b map[string]interface{}, path string) (float64, bool) {
+	switch path {
+	case "_count":
+		return toFloat(b["doc_count"])
+	case "_key":
+		return toFloat(b["key"])
+	}
+	head, rest, nested := strings.Cut(path, ">")
+	if nested {
+		inner, ok := asMap(b[head])
+		if !ok {
+			return 0, false
+		}
+		return bucketValue(inner, rest)
+	}
+	name, stat := path, "value"
+	if i := strings.Index(path, "["); i > 0 && strings.HasSuffix(path, "]") {
+		name, stat = path[:i], path[i+1:len(path)-1]
+	} else if i := strings.Index(path, "."); i > 0 {
+		name, stat = path[:i], path[i+1:]
+	}
+	node, ok := asMap(b[name])
+	if !ok {
+		return 0, false
+	}
+	if values, ok := asMap(node["values"]); ok {
+		if stat == "value" {
+			return 0, false
+		}
+		if v, ok := values[stat]; ok {
+			return toFloat(v)
+		}
+		if f, err := strconv.ParseFloat(stat, 64); err == nil {
+			return toFloat(values[percentKey(f)])
+		}
+		return 0, false
+	}
+	if stat == "doc_count" || (stat == "value" && node["value"] == nil && node["doc_count"] != nil) {
+		return toFloat(node["doc_count"])
+	}
+	return toFloat(node[stat])
+}
+
+func scriptSource(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case map[string]interface{}:
+		if s := toString(x["source"]); s != "" {
+			return s
+		}
+		return toString(x["inline"])
+	}
+	return ""
+}
+
+func scriptParams(b map[string]interface{}, paths interface{}) (map[string]float64, bool) {
+	params := map[string]float64{}
+	switch x := paths.(type) {
+	case map[string]interface{}:
+		for name, p := range x {
+			v, ok := bucketValue(b, toString(p))
+			if !ok {
+				return nil, false
+			}
+			params[name] = v
+		}
+	case string:
+		v, ok := bucketValue(b, x)
+		if !ok {
+			return nil, false
+		}
+		params["_value0"] = v
+	}
+	return params, true
+}
+
+var comparisonOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// evalCondition evaluates a bucket_selector script: a comparison of two
+// arithmetic expressions, or an expression that is true when non-zero.
+func evalCondition(script string, params map[string]float64) (bool, error) {
+	for _, op := range comparisonOperators {
+		lhs, rhs, ok := strings.Cut(script, op)
+		if !ok {
+			continue
+		}
+		l, err := aggregate.EvalScript(lhs, params)
+		if err != nil {
+			return false, err
+		}
+		r, err := aggregate.EvalScript(rhs, params)
+		if err != nil {
+			return false, err
+		}
+		switch op {
+		case ">=":
+			return l >= r, nil
+		case "<=":
+			return l <= r, nil
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		case ">":
+			return l > r, nil
+		}
+		return l < r, nil
+	}
+	v, err := aggregate.EvalScript(script, params)
+	return v != 0, err
+}
+
+// applyParentPipelines computes derivative, cumulative_sum, serial_diff
+// and bucket_script values into the buckets, then applies bucket_selector
+// and bucket_sort.
+func (a *aggRunner) applyParentPipelines(spec *aggSpec, buckets []map[string]interface{}) ([]map[string]interface{}, error) {
+	var reducers []*aggSpec
+	for _, sub := range spec.subs {
+		if !parentPipelines[sub.kind] {
+			continue
+		}
+		if sub.kind == "bucket_selector" || sub.kind == "bucket_sort" {
+			reducers = append(reducers, sub)
+			continue
+		}
+		path := sub.body["buckets_path"]
+		switch sub.kind {
+		case "derivative", "serial_diff":
+			lag := 1
+			if sub.kind == "serial_diff" {
+				lag = toInt(sub.body["lag"], 1)
+			}
+			for i := lag; i < len(buckets); i++ {
+				cur, ok1 := bucketValue(buckets[i], toString(path))
+				prev, ok2 := bucketValue(buckets[i-lag], toString(path))
+				if ok1 && ok2 {
+					buckets[i][sub.name] = map[string]interface{}{"value": cur - prev}
+				} else {
+					buckets[i][sub.name] = map[string]interface{}{"value": nil}
+				}
+			}
+		case "cumulative_sum":
+			var sum float64
+			for _, b := range buckets {
+				if v, ok := bucketValue(b, toString(path)); ok {
+					sum += v
+				}
+				b[sub.name] = map[string]interface{}{"value": sum}
+			}
+		case "bucket_script":
+			script := scriptSource(sub.body["script"])
+			for _, b := range buckets {
+				params, ok := scriptParams(b, path)
+				if !ok {
+					continue
+				}
+				v, err := aggregate.EvalScript(script, params)
+				if err != nil {
+					return nil, badRequest("[%v] %v", sub.name, err)
+				}
+				b[sub.name] = map[string]interface{}{"value": nullable(v, true)}
+			}
+		}
+	}
+
+	for _, sub := range reducers {
+		switch sub.kind {
+		case "bucket_selector":
+			script := scriptSource(sub.body["script"])
+			var kept []map[string]interface{}
+			for _, b := range buckets {
+				params, ok := scriptParams(b, sub.body["buckets_path"])
+				if !ok {
+					continue
+				}
+				keep, err := evalCondition(script, params)
+				if err != nil {
+					return nil, badRequest("[%v] %v", sub.name, err)
+				}
+				if keep {
+					kept = append(kept, b)
+				}
+			}
+			buckets = kept
+		case "bucket_sort":
+			specs, err := parseSortSpecs(sub.body["sort"])
+			if err != nil {
+				return nil, err
+			}
+			if len(specs) > 0 {
+				sort.SliceStable(buckets, func(i, j int) bool {
+					for _, s := range specs {
+						x, okx := bucketValue(buckets[i], s.field)
+						y, oky := bucketValue(buckets[j], s.field)
+						if !okx {
+							x = math.Inf(-1)
+						}
+						if !oky {
+							y = math.Inf(-1)
+						}
+						if x != y {
+							if s.desc {
+								return x > y
+							}
+							return x < y
+						}
+					}
+					return false
+				})
+			}
+			from := toInt(sub.body["from"], 0)
+			if from > len(buckets) {
+				from = len(buckets)
+			}
+			buckets = buckets[from:]
+			if size := toInt(sub.body["size"], -1); size >= 0 && size < len(buckets) {
+				buckets = buckets[:size]
+			}
+		}
+	}
+	return buckets, nil
+}
+
+// sibling computes a *_bucket pipeline over the buckets of a sibling
+// multi-bucket aggregation addressed as agg>metric.
+func (a *aggRunner) sibling(spec *aggSpec, level map[string]interface{}) (map[string]interface{}, error) {
+	path := toString(spec.body["buckets_path"])
+	head, rest, ok := strings.Cut(path, ">")
+	if !ok {
+		rest = "_count"
+	}
+	node, _ := asMap(level[head])
+	var buckets []map[string]interface{}
+	switch x := node["buckets"].(type) {
+	case []interface{}:
+		for _, b := range x {
+			if m, ok := asMap(b); ok {
+				buckets = append(buckets, m)
+			}
+		}
+	case map[string]interface{}:
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if m, ok := asMap(x[name]); ok {
+				m = deepCopy(m).(map[string]interface{})
+				m["key"] = name
+				buckets = append(buckets, m)
+			}
+		}
+	default:
+		return nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+			reason: fmt.Sprintf("Validation Failed: 1: No aggregation found for path [%v];", path)}
+	}
+
+	var values []float64
+	var keys []interface{}
+	for _, b := range buckets {
+		if v, ok := bucketValue(b, rest); ok && !math.IsNaN(v) {
+			values = append(values, v)
+			key := b["key_as_string"]
+			if key == nil {
+				key = toString(b["key"])
+			}
+			keys = append(keys, key)
+		}
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	n := len(values)
+	switch spec.kind {
+	case "sum_bucket":
+		return map[string]interface{}{"value": sum}, nil
+	case "avg_bucket":
+		return map[string]interface{}{"value": nullable(sum/float64(n), n > 0)}, nil
+	case "min_bucket", "max_bucket":
+		best := math.NaN()
+		var bestKeys []interface{}
+		for i, v := range values {
+			better := math.IsNaN(best) || (spec.kind == "min_bucket" && v < best) || (spec.kind == "max_bucket" && v > best)
+			if better {
+				best, bestKeys = v, []interface{}{keys[i]}
+			} else if v == best {
+				bestKeys = append(bestKeys, keys[i])
+			}
+		}
+		if bestKeys == nil {
+			bestKeys = []interface{}{}
+		}
+		return map[string]interface{}{"value": nullable(best, n > 0), "keys": bestKeys}, nil
+	case "stats_bucket":
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		out := map[string]interface{}{"count": n, "sum": sum, "min": nil, "max": nil, "avg": nil}
+		if n > 0 {
+			out["min"], out["max"], out["avg"] = sorted[0], sorted[n-1], sum/float64(n)
+		}
+		return out, nil
+	case "percentiles_bucket":
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		percents := []float64{1, 5, 25, 50, 75, 95, 99}
+		if list, ok := spec.body["percents"].([]interface{}); ok {
+			percents = percents[:0]
+			for _, p := range list {
+				f, _ := toFloat(p)
+				percents = append(percents, f)
+			}
+		}
+		vals := map[string]interface{}{}
+		for _, p := range percents {
+			vals[percentKey(p)] = nullable(percentile(sorted, p), n > 0)
+		}
+		return map[string]interface{}{"values": vals}, nil
+	}
+	return nil, badRequest("unsupported pipeline aggregation [%v]", spec.kind)
+}
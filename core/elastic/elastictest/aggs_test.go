@@ -0,0 +1,123 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runAggs(t *testing.T, srv *Server, aggs string) interface{} {
+	t.Helper()
+	status, resp := call(t, srv, http.MethodPost, "/orders/_search", `{"size":0,"aggs":`+aggs+`}`)
+	require.Equal(t, http.StatusOK, status, resp)
+	return path(resp, "aggregations")
+}
+
+func TestMetricAggregations(t *testing.T) {
+	srv := newTestServer(t, Options{})
+	seedOrders(t, srv)
+
+	aggs := runAggs(t, srv, `{
+		"sum": {"sum": {"field": "total"}},
+		"avg": {"avg": {"field": "total"}},
+		"min": {"min": {"field": "at"}},
+		"stats": {"stats": {"field": "qty"}},
+		"count": {"value_count": {"field": "customer"}},
+		"customers": {"cardinality": {"field": "customer"}},
+		"pct": {"percentiles": {"field": "total", "percents": [50]}}
+	}`)
+	assert.EqualValues(t, 210, path(aggs, "sum", "value"))
+	assert.EqualValues(t, 35, path(aggs, "avg", "value"))
+	assert.Equal(t, "2024-03-01T08:00:00.000Z", path(aggs, "min", "value_as_string"))
+	assert.EqualValues(t, 6, path(aggs, "stats", "count"))
+	assert.EqualValues(t, 6, path(aggs, "stats", "max"))
+	assert.EqualValues(t, 6, path(aggs, "count", "value"))
+	assert.EqualValues(t, 3, path(aggs, "customers", "value"))
+	assert.EqualValues(t, 35, path(aggs, "pct", "values", "50.0"))
+
+	aggs = runAggs(t, srv, `{"none": {"filter": {"term": {"customer": "nobody"}}, "aggs": {"avg": {"avg": {"field": "total"}}, "sum": {"sum": {"field": "total"}}}}}`)
+	assert.EqualValues(t, 0, path(aggs, "none", "doc_count"))
+	assert.Nil(t, path(aggs, "none", "avg", "value"))
+	assert.EqualValues(t, 0, path(aggs, "none", "sum", "value"))
+}
+
+func TestBucketAggregations(t *testing.T) {
+	srv := newTestServer(t, Options{})
+	seedOrders(t, srv)
+
+	aggs := runAggs(t, srv, `{
+		"by_customer": {"terms": {"field": "customer", "size": 2, "order": {"spent": "desc"}},
+			"aggs": {"spent": {"sum": {"field": "total"}}}},
+		"per_day": {"date_histogram": {"field": "at", "calendar_interval": "1d"}},
+		"per_qty": {"histogram": {"field": "qty", "interval": 4}},
+		"ranges": {"range": {"field": "total", "ranges": [{"to": 30}, {"from": 30}]}},
+		"kinds": {"filters": {"filters": {"express": {"match": {"note": "express"}}, "gift": {"match": {"note": "gift"}}}}},
+		"lines": {"nested": {"path": "items"}, "aggs": {"skus": {"terms": {"field": "items.sku"}}}}
+	}`)
+
+	assert.Equal(t, "carol", path(aggs, "by_customer", "buckets", 0, "key"))
+	assert.EqualValues(t, 110, path(aggs, "by_customer", "buckets", 0, "spent", "value"))
+	assert.Equal(t, "bob", path(aggs, "by_customer", "buckets", 1, "key"))
+	assert.EqualValues(t, 2, path(aggs, "by_customer", "sum_other_doc_count"))
+
+	assert.Equal(t, "2024-03-01T00:00:00.000Z", path(aggs, "per_day", "buckets", 0, "key_as_string"))
+	assert.EqualValues(t, 1709251200000, path(aggs, "per_day", "buckets", 0, "key"))
+	assert.EqualValues(t, 3, path(aggs, "per_day", "buckets", 1, "doc_count"))
+
+	assert.Len(t, path(aggs, "per_qty", "buckets"), 2)
+	assert.EqualValues(t, 3, path(aggs, "per_qty", "buckets", 0, "doc_count"))
+
+	assert.Equal(t, "*-30.0", path(aggs, "ranges", "buckets", 0, "key"))
+	assert.EqualValues(t, 2, path(aggs, "ranges", "buckets", 0, "doc_count"))
+	assert.Equal(t, "30.0-*", path(aggs, "ranges", "buckets", 1, "key"))
+
+	assert.EqualValues(t, 3, path(aggs, "kinds", "buckets", "express", "doc_count"))
+	assert.EqualValues(t, 1, path(aggs, "kinds", "buckets", "gift", "doc_count"))
+
+	assert.EqualValues(t, 6, path(aggs, "lines", "doc_count"))
+	assert.Equal(t, "a", path(aggs, "lines", "skus", "buckets", 0, "key"))
+	assert.EqualValues(t, 2, path(aggs, "lines", "skus", "buckets", 0, "doc_count"))
+
+	status, resp := call(t, srv, http.MethodPost, "/orders/_search", `{"aggs":{"notes":{"terms":{"field":"note"}}}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "illegal_argument_exception", path(resp, "error", "type"))
+}
+
+func TestPipelineAggregations(t *testing.T) {
+	srv := newTestServer(t, Options{})
+	seedOrders(t, srv)
+
+	aggs := runAggs(t, srv, `{
+		"per_day": {"date_histogram": {"field": "at", "fixed_interval": "12h"}, "aggs": {
+			"revenue": {"sum": {"field": "total"}},
+			"growth": {"derivative": {"buckets_path": "revenue"}},
+			"running": {"cumulative_sum": {"buckets_path": "revenue"}},
+			"per_item": {"bucket_script": {"buckets_path": {"r": "revenue", "n": "_count"}, "script": "params.r / params.n"}},
+			"busy": {"bucket_selector": {"buckets_path": {"n": "_count"}, "script": "params.n > 1"}}
+		}},
+		"best_day": {"max_bucket": {"buckets_path": "per_day>revenue"}},
+		"avg_day": {"avg_bucket": {"buckets_path": "per_day>revenue"}}
+	}`)
+
+	buckets, _ := path(aggs, "per_day", "buckets").([]interface{})
+	require.Len(t, buckets, 2)
+	assert.Equal(t, "2024-03-01T12:00:00.000Z", path(buckets, 0, "key_as_string"))
+	assert.EqualValues(t, 50, path(buckets, 0, "revenue", "value"))
+	assert.EqualValues(t, 60, path(buckets, 0, "running", "value"))
+	assert.EqualValues(t, 25, path(buckets, 0, "per_item", "value"))
+	assert.EqualValues(t, 110, path(buckets, 1, "revenue", "value"))
+	//derivative runs before the selector dropped the 03-02T00 bucket
+	assert.EqualValues(t, 70, path(buckets, 1, "growth", "value"))
+
+	assert.EqualValues(t, 110, path(aggs, "best_day", "value"))
+	assert.Equal(t, []interface{}{"2024-03-02T12:00:00.000Z"}, path(aggs, "best_day", "keys"))
+	assert.EqualValues(t, 80, path(aggs, "avg_day", "value"))
+
+	status, resp := call(t, srv, http.MethodPost, "/orders/_search", `{"aggs":{"d":{"derivative":{"buckets_path":"_count"}}}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, path(resp, "error", "reason"), "must have a histogram")
+}
@@ -0,0 +1,674 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nodeIP        = "127.0.0.1"
+	transportPort = "9300"
+	heapMaxBytes  = 1 << 30
+	diskBytes     = 100 << 30
+)
+
+func (s *Server) replicas(idx *index) int {
+	n, _ := strconv.Atoi(idx.settings["index.number_of_replicas"])
+	return n
+}
+
+// health summarizes the single-node cluster: every index has one primary
+// shard, replicas can never be assigned.
+func (s *Server) health(indices []*index) (string, int, int) {
+	active, unassigned := 0, 0
+	for _, idx := range indices {
+		active++
+		unassigned += s.replicas(idx)
+	}
+	status := "green"
+	if unassigned > 0 {
+		status = "yellow"
+	}
+	return status, active, unassigned
+}
+
+func (s *Server) allIndices() []*index {
+	out := make([]*index, 0, len(s.indices))
+	for _, name := range s.sortedIndexNames() {
+		out = append(out, s.indices[name])
+	}
+	return out
+}
+
+func (s *Server) handleCluster(req *request, rest []string) (int, interface{}, error) {
+	if len(rest) == 0 {
+		return 0, nil, noHandler(req.Request)
+	}
+	switch rest[0] {
+	case "health":
+		return s.clusterHealth(req, rest[1:])
+	case "state":
+		return s.clusterState(req, rest[1:])
+	case "stats":
+		return s.clusterStats()
+	case "settings":
+		return s.clusterSettingsAPI(req)
+	case "pending_tasks":
+		return http.StatusOK, map[string]interface{}{"tasks": []interface{}{}}, nil
+	case "allocation":
+		if len(rest) > 1 && rest[1] == "explain" {
+			return s.allocationExplain()
+		}
+	}
+	return 0, nil, noHandler(req.Request)
+}
+
+func (s *Server) clusterHealth(req *request, rest []string) (int, interface{}, error) {
+	indices := s.allIndices()
+	if len(rest) > 0 {
+		var err error
+		if indices, err = s.resolve(rest[0], false); err != nil {
+			return 0, nil, err
+		}
+	}
+	status, active, unassigned := s.health(indices)
+	percent := 100.0
+	if active+unassigned > 0 {
+		percent = float64(active) * 100 / float64(active+unassigned)
+	}
+	out := map[string]interface{}{
+		"cluster_name":                     s.opts.ClusterName,
+		"status":                           status,
+		"timed_out":                        false,
+		"number_of_nodes":                  1,
+		"number_of_data_nodes":             1,
+		"active_primary_shards":            active,
+		"active_shards":                    active,
+		"relocating_shards":                0,
+		"initializing_shards":              0,
+		"unassigned_shards":                unassigned,
+		"delayed_unassigned_shards":        0,
+		"number_of_pending_tasks":          0,
+		"number_of_in_flight_fetch":        0,
+		"task_max_waiting_in_queue_millis": 0,
+		"active_shards_percent_as_number":  percent,
+	}
+	if level := req.param("level"); level == "indices" || level == "shards" {
+		perIndex := map[string]interface{}{}
+		for _, idx := range indices {
+			st, _, un := s.health([]*index{idx})
+			perIndex[idx.name] = map[string]interface{}{
+				"status":                st,
+				"number_of_shards":      1,
+				"number_of_replicas":    s.replicas(idx),
+				"active_primary_shards": 1,
+				"active_shards":         1,
+				"relocating_shards":     0,
+				"initializing_shards":   0,
+				"unassigned_shards":     un,
+			}
+		}
+		out["indices"] = perIndex
+	}
+	return http.StatusOK, out, nil
+}
+
+func (s *Server) nodeSummary() map[string]interface{} {
+	return map[string]interface{}{
+		"name":              s.opts.NodeName,
+		"ephemeral_id":      s.nodeID,
+		"transport_address": nodeIP + ":" + transportPort,
+		"attributes":        map[string]interface{}{},
+	}
+}
+
+func (s *Server) clusterState(req *request, rest []string) (int, interface{}, error) {
+	indices := s.allIndices()
+	if len(rest) > 1 {
+		var err error
+		if indices, err = s.resolve(rest[1], req.flag("ignore_unavailable")); err != nil {
+			return 0, nil, err
+		}
+	}
+	meta := map[string]interface{}{}
+	routing := map[string]interface{}{}
+	for _, idx := range indices {
+		aliases := make([]string, 0, len(idx.aliases))
+		for alias := range idx.aliases {
+			aliases = append(aliases, alias)
+		}
+		sort.Strings(aliases)
+		meta[idx.name] = map[string]interface{}{
+			"state":    "open",
+			"settings": nestSettings(idx.settings),
+			"mappings": s.renderMappings(req, idx),
+			"aliases":  aliases,
+		}
+		shards := []interface{}{map[string]interface{}{
+			"state": "STARTED", "primary": true, "node": s.nodeID, "relocating_node": nil, "shard": 0, "index": idx.name,
+		}}
+		for i := 0; i < s.replicas(idx); i++ {
+			shards = append(shards, map[string]interface{}{
+				"state": "UNASSIGNED", "primary": false, "node": nil, "relocating_node": nil, "shard": 0, "index": idx.name,
+			})
+		}
+		routing[idx.name] = map[string]interface{}{"shards": map[string]interface{}{"0": shards}}
+	}
+	templates := map[string]interface{}{}
+	for name, tmpl := range s.templates {
+		templates[name] = tmpl
+	}
+	return http.StatusOK, map[string]interface{}{
+		"cluster_name":  s.opts.ClusterName,
+		"cluster_uuid":  s.clusterUUID,
+		"version":       s.sequence,
+		"state_uuid":    fmt.Sprintf("elastictest-state-%d", s.sequence),
+		"master_node":   s.nodeID,
+		"nodes":         map[string]interface{}{s.nodeID: s.nodeSummary()},
+		"metadata":      map[string]interface{}{"cluster_uuid": s.clusterUUID, "indices": meta, "templates": templates},
+		"routing_table": map[string]interface{}{"indices": routing},
+	}, nil
+}
+
+func (s *Server) clusterStats() (int, interface{}, error) {
+	indices := s.allIndices()
+	status, active, _ := s.health(indices)
+	var docs, size int
+	for _, idx := range indices {
+		docs += len(idx.docs)
+		for _, doc := range idx.docs {
+			size += len(doc.source)
+		}
+	}
+	return http.StatusOK, map[string]interface{}{
+		"_nodes":       map[string]interface{}{"total": 1, "successful": 1, "failed": 0},
+		"cluster_name": s.opts.ClusterName,
+		"cluster_uuid": s.clusterUUID,
+		"timestamp":    time.Now().UnixMilli(),
+		"status":       status,
+		"indices": map[string]interface{}{
+			"count":  len(indices),
+			"shards": map[string]interface{}{"total": active, "primaries": active, "replication": 0},
+			"docs":   map[string]interface{}{"count": docs, "deleted": 0},
+			"store":  map[string]interface{}{"size_in_bytes": size},
+		},
+		"nodes": map[string]interface{}{
+			"count":    map[string]interface{}{"total": 1, "data": 1, "master": 1, "ingest": 1},
+			"versions": []string{s.opts.Version},
+			"jvm":      map[string]interface{}{"mem": map[string]interface{}{"heap_used_in_bytes": heapMaxBytes / 4, "heap_max_in_bytes": heapMaxBytes}},
+			"fs":       map[string]interface{}{"total_in_bytes": diskBytes, "free_in_bytes": diskBytes - size, "available_in_bytes": diskBytes - size},
+		},
+	}, nil
+}
+
+// flattenClusterSettings turns nested or flat cluster settings into dotted
+// keys; a null value is kept so that it can clear the setting.
+func flattenClusterSettings(v interface{}, prefix string, out map[string]interface{}) {
+	m, ok := asMap(v)
+	if !ok {
+		if v == nil {
+			out[prefix] = nil
+		} else {
+			out[prefix] = toString(v)
+		}
+		return
+	}
+	for k, e := range m {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		flattenClusterSettings(e, k, out)
+	}
+}
+
+func (s *Server) clusterSettingsAPI(req *request) (int, interface{}, error) {
+	render := func(scope string) interface{} {
+		flat, _ := asMap(s.clusterSettings[scope])
+		if req.flag("flat_settings") {
+			return flat
+		}
+		strs := map[string]string{}
+		for k, v := range flat {
+			strs[k] = toString(v)
+		}
+		return nestSettings(strs)
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		out := map[string]interface{}{"persistent": render("persistent"), "transient": render("transient")}
+		if req.flag("include_defaults") {
+			out["defaults"] = map[string]interface{}{}
+		}
+		return http.StatusOK, out, nil
+	case http.MethodPut:
+		body, err := req.jsonBody()
+		if err != nil {
+			return 0, nil, err
+		}
+		out := map[string]interface{}{"acknowledged": true}
+		for _, scope := range []string{"persistent", "transient"} {
+			changes := map[string]interface{}{}
+			flattenClusterSettings(body[scope], "", changes)
+			delete(changes, "")
+			current, _ := asMap(s.clusterSettings[scope])
+			for k, v := range changes {
+				if v == nil {
+					delete(current, k)
+				} else {
+					current[k] = v
+				}
+			}
+			strs := map[string]string{}
+			for k, v := range changes {
+				if v != nil {
+					strs[k] = toString(v)
+				}
+			}
+			out[scope] = nestSettings(strs)
+		}
+		return http.StatusOK, out, nil
+	}
+	return 0, nil, noHandler(req.Request)
+}
+
+func (s *Server) allocationExplain() (int, interface{}, error) {
+	for _, idx := range s.allIndices() {
+		if s.replicas(idx) == 0 {
+			continue
+		}
+		return http.StatusOK, map[string]interface{}{
+			"index":                idx.name,
+			"shard":                0,
+			"primary":              false,
+			"current_state":        "unassigned",
+			"unassigned_info":      map[string]interface{}{"reason": "INDEX_CREATED", "at": idx.created.UTC().Format(time.RFC3339), "last_allocation_status": "no_attempt"},
+			"can_allocate":         "no",
+			"allocate_explanation": "cannot allocate because allocation is not permitted to any of the nodes",
+			"node_allocation_decisions": []interface{}{map[string]interface{}{
+				"node_id":           s.nodeID,
+				"node_name":         s.opts.NodeName,
+				"node_decision":     "no",
+				"deciders":          []interface{}{map[string]interface{}{"decider": "same_shard", "decision": "NO", "explanation": "a copy of this shard is already allocated to this node"}},
+				"transport_address": nodeIP + ":" + transportPort,
+			}},
+		}, nil
+	}
+	return 0, nil, badRequest("No shard was specified in the request which means the response should explain a randomly-chosen unassigned shard, but there are no unassigned shards in this cluster.")
+}
+
+// writePoolName is the name of the write thread pool, "bulk" before 6.0.
+func (s *Server) writePoolName() string {
+	if s.major < 6 {
+		return "bulk"
+	}
+	return "write"
+}
+
+func (s *Server) nodeInfo() map[string]interface{} {
+	host := s.Host()
+	info := s.nodeSummary()
+	info["host"] = nodeIP
+	info["ip"] = nodeIP
+	info["version"] = s.opts.Version
+	info["build_flavor"] = "default"
+	info["build_type"] = "tar"
+	info["build_hash"] = "elastictest"
+	info["roles"] = []string{"data", "ingest", "master"}
+	info["settings"] = map[string]interface{}{
+		"cluster": map[string]interface{}{"name": s.opts.ClusterName},
+		"node":    map[string]interface{}{"name": s.opts.NodeName},
+		"path":    map[string]interface{}{"home": "/usr/share/elasticsearch"},
+	}
+	info["os"] = map[string]interface{}{"name": "Linux", "arch": "amd64", "available_processors": 4, "allocated_processors": 4}
+	info["process"] = map[string]interface{}{"id": 1, "mlockall": false}
+	info["jvm"] = map[string]interface{}{
+		"pid":                  1,
+		"version":              "21",
+		"start_time_in_millis": s.started.UnixMilli(),
+		"mem":                  map[string]interface{}{"heap_init_in_bytes": heapMaxBytes, "heap_max_in_bytes": heapMaxBytes},
+	}
+	info["http"] = map[string]interface{}{"bound_address": []string{host}, "publish_address": host, "max_content_length_in_bytes": 100 << 20}
+	info["transport"] = map[string]interface{}{"bound_address": []string{nodeIP + ":" + transportPort}, "publish_address": nodeIP + ":" + transportPort}
+	info["thread_pool"] = map[string]interface{}{
+		s.writePoolName(): map[string]interface{}{"type": "fixed", "size": 4, "queue_size": 10000},
+		"search":          map[string]interface{}{"type": "fixed_auto_queue_size", "size": 7, "queue_size": 1000},
+	}
+	return info
+}
+
+func (s *Server) nodeStats() map[string]interface{} {
+	indices := s.allIndices()
+	var docs, size int
+	var indexTotal, deleteTotal, searchTotal int64
+	for _, idx := range indices {
+		docs += len(idx.docs)
+		for _, doc := range idx.docs {
+			size += len(doc.source)
+		}
+		indexTotal += idx.indexTotal
+		deleteTotal += idx.deleteTotal
+		searchTotal += idx.searchTotal
+	}
+	st := s.nodeSummary()
+	st["timestamp"] = time.Now().UnixMilli()
+	st["host"] = nodeIP
+	st["ip"] = nodeIP
+	st["roles"] = []string{"data", "ingest", "master"}
+	st["indices"] = map[string]interface{}{
+		"docs":     map[string]interface{}{"count": docs, "deleted": 0},
+		"store":    map[string]interface{}{"size_in_bytes": size},
+		"indexing": map[string]interface{}{"index_total": indexTotal, "index_time_in_millis": 0, "delete_total": deleteTotal},
+		"search":   map[string]interface{}{"query_total": searchTotal, "query_time_in_millis": 0},
+		"segments": map[string]interface{}{"count": len(indices), "memory_in_bytes": 0},
+	}
+	st["os"] = map[string]interface{}{
+		"timestamp": time.Now().UnixMilli(),
+		"cpu":       map[string]interface{}{"percent": 1, "load_average": map[string]interface{}{"1m": 0.1, "5m": 0.1, "15m": 0.1}},
+		"mem":       map[string]interface{}{"total_in_bytes": 4 * heapMaxBytes, "free_in_bytes": 2 * heapMaxBytes, "used_percent": 50},
+	}
+	st["process"] = map[string]interface{}{"open_file_descriptors": 100, "max_file_descriptors": 65535, "cpu": map[string]interface{}{"percent": 1}}
+	st["jvm"] = map[string]interface{}{
+		"timestamp":        time.Now().UnixMilli(),
+		"uptime_in_millis": time.Since(s.started).Milliseconds(),
+		"mem": map[string]interface{}{
+			"heap_used_in_bytes": heapMaxBytes / 4, "heap_used_percent": 25, "heap_committed_in_bytes": heapMaxBytes, "heap_max_in_bytes": heapMaxBytes,
+		},
+	}
+	st["thread_pool"] = map[string]interface{}{
+		s.writePoolName(): map[string]interface{}{
+			"threads": 4, "queue": 0, "active": 0, "rejected": s.writeRejected, "largest": 4, "completed": s.writeCompleted,
+		},
+		"search": map[string]interface{}{
+			"threads": 7, "queue": 0, "active": 0, "rejected": 0, "largest": 7, "completed": searchTotal,
+		},
+	}
+	st["fs"] = map[string]interface{}{"total": map[string]interface{}{
+		"total_in_bytes": diskBytes, "free_in_bytes": diskBytes - size, "available_in_bytes": diskBytes - size,
+	}}
+	st["http"] = map[string]interface{}{"current_open": 1, "total_opened": 1}
+	return st
+}
+
+// nodeMatches reports whether a node filter (_all, _local, _master, the
+// node id or name, or a wildcard) selects the single node.
+func (s *Server) nodeMatches(filter string) bool {
+	if filter == "" {
+		return true
+	}
+	for _, f := range strings.Split(filter, ",") {
+		switch f {
+		case "_all", "_local", "_master", "*", s.nodeID, s.opts.NodeName, nodeIP:
+			return true
+		}
+		if globMatch(f, s.nodeID) || globMatch(f, s.opts.NodeName) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleNodes answers _nodes, _nodes/{filter}, _nodes/stats and
+// _nodes/{filter}/stats; metric filters are ignored.
+func (s *Server) handleNodes(req *request, rest []string) (int, interface{}, error) {
+	filter := ""
+	stats := false
+	switch {
+	case len(rest) > 0 && rest[0] == "stats":
+		stats = true
+	case len(rest) > 1 && rest[1] == "stats":
+		filter, stats = rest[0], true
+	case len(rest) > 0:
+		filter = rest[0]
+	}
+	nodes := map[string]interface{}{}
+	if s.nodeMatches(filter) {
+		if stats {
+			nodes[s.nodeID] = s.nodeStats()
+		} else {
+			nodes[s.nodeID] = s.nodeInfo()
+		}
+	}
+	return http.StatusOK, map[string]interface{}{
+		"_nodes":       map[string]interface{}{"total": len(nodes), "successful": len(nodes), "failed": 0},
+		"cluster_name": s.opts.ClusterName,
+		"nodes":        nodes,
+	}, nil
+}
+
+func formatBytes(n int, unit string) string {
+	switch unit {
+	case "b":
+		return strconv.Itoa(n)
+	case "kb":
+		return strconv.Itoa(n / 1024)
+	case "mb":
+		return strconv.Itoa(n >> 20)
+	case "gb":
+		return strconv.Itoa(n >> 30)
+	}
+	switch {
+	case n >= 1<<30:
+		return strconv.FormatFloat(float64(n)/(1<<30), 'f', 1, 64) + "gb"
+	case n >= 1<<20:
+		return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + "mb"
+	case n >= 1<<10:
+		return strconv.FormatFloat(float64(n)/(1<<10), 'f', 1, 64) + "kb"
+	}
+	return strconv.Itoa(n) + "b"
+}
+
+// catTable renders _cat rows as JSON (format=json) or as the aligned text
+// table, honoring the h (columns) and v (header) parameters.
+func catTable(req *request, columns []string, rows []map[string]string) (int, interface{}, error) {
+	if h := req.param("h"); h != "" {
+		columns = strings.Split(h, ",")
+	}
+	if req.param("format") == "json" {
+		out := make([]interface{}, 0, len(rows))
+		for _, row := range rows {
+			m := map[string]interface{}{}
+			for _, c := range columns {
+				m[c] = row[c]
+			}
+			out = append(out, m)
+		}
+		return http.StatusOK, out, nil
+	}
+	lines := [][]string{}
+	if req.flag("v") {
+		lines = append(lines, columns)
+	}
+	for _, row := range rows {
+		line := make([]string, len(columns))
+		for i, c := range columns {
+			line[i] = row[c]
+		}
+		lines = append(lines, line)
+	}
+	widths := make([]int, len(columns))
+	for _, line := range lines {
+		for i, v := range line {
+			if len(v) > widths[i] {
+				widths[i] = len(v)
+			}
+		}
+	}
+	var b strings.Builder
+	for _, line := range lines {
+		for i, v := range line {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			if i < len(line)-1 {
+				v = fmt.Sprintf("%-*s", widths[i], v)
+			}
+			b.WriteString(v)
+		}
+		b.WriteByte('\n')
+	}
+	return http.StatusOK, b.String(), nil
+}
+
+var catEndpoints = []string{
+	"/_cat/allocation", "/_cat/shards", "/_cat/shards/{index}", "/_cat/nodes", "/_cat/indices", "/_cat/indices/{index}",
+	"/_cat/count", "/_cat/count/{index}", "/_cat/health", "/_cat/aliases", "/_cat/aliases/{alias}", "/_cat/templates",
+}
+
+func (s *Server) handleCat(req *request, rest []string) (int, interface{}, error) {
+	if len(rest) == 0 {
+		return http.StatusOK, "=^.^=\n" + strings.Join(catEndpoints, "\n") + "\n", nil
+	}
+	target := ""
+	if len(rest) > 1 {
+		target = rest[1]
+	}
+	now := time.Now()
+	bytesUnit := req.param("bytes")
+	var indices []*index
+	if target != "" && rest[0] != "aliases" && rest[0] != "templates" {
+		var err error
+		if indices, err = s.resolve(target, false); err != nil {
+			return 0, nil, err
+		}
+	} else {
+		indices = s.allIndices()
+	}
+	sizeOf := func(idx *index) int {
+		var size int
+		for _, doc := range idx.docs {
+			size += len(doc.source)
+		}
+		return size
+	}
+
+	switch rest[0] {
+	case "indices":
+		var rows []map[string]string
+		for _, idx := range indices {
+			status, _, _ := s.health([]*index{idx})
+			size := formatBytes(sizeOf(idx), bytesUnit)
+			rows = append(rows, map[string]string{
+				"health": status, "status": "open", "index": idx.name, "uuid": idx.uuid,
+				"pri": "1", "rep": strconv.Itoa(s.replicas(idx)),
+				"docs.count": strconv.Itoa(len(idx.docs)), "docs.deleted": "0",
+				"store.size": size, "pri.store.size": size,
+				"creation.date": strconv.FormatInt(idx.created.UnixMilli(), 10), "segments.count": "1",
+			})
+		}
+		return catTable(req, []string{"health", "status", "index", "uuid", "pri", "rep", "docs.count", "docs.deleted", "store.size", "pri.store.size"}, rows)
+	case "health":
+		status, active, unassigned := s.health(indices)
+		return catTable(req, []string{"epoch", "timestamp", "cluster", "status", "node.total", "node.data", "shards", "pri", "relo", "init", "unassign", "pending_tasks", "max_task_wait_time", "active_shards_percent"},
+			[]map[string]string{{
+				"epoch": strconv.FormatInt(now.Unix(), 10), "timestamp": now.UTC().Format("15:04:05"),
+				"cluster": s.opts.ClusterName, "status": status, "node.total": "1", "node.data": "1",
+				"shards": strconv.Itoa(active), "pri": strconv.Itoa(active), "relo": "0", "init": "0",
+				"unassign": strconv.Itoa(unassigned), "pending_tasks": "0", "max_task_wait_time": "-",
+				"active_shards_percent": "100.0%",
+			}})
+	case "nodes":
+		id := s.nodeID
+		if !req.flag("full_id") {
+			id = id[:4]
+		}
+		return catTable(req, []string{"ip", "heap.percent", "ram.percent", "cpu", "load_1m", "load_5m", "load_15m", "node.role", "master", "name"},
+			[]map[string]string{{
+				"id": id, "ip": nodeIP, "port": transportPort, "http_address": s.Host(),
+				"heap.percent": "25", "ram.percent": "50", "cpu": "1", "load_1m": "0.10", "load_5m": "0.10", "load_15m": "0.10",
+				"node.role": "dim", "master": "*", "name": s.opts.NodeName, "version": s.opts.Version,
+				"disk.avail": "100gb", "disk.used": "0b", "disk.total": "100gb", "uptime": time.Since(s.started).Truncate(time.Second).String(),
+				"heap.max": "1gb",
+			}})
+	case "shards":
+		var rows []map[string]string
+		for _, idx := range indices {
+			rows = append(rows, map[string]string{
+				"index": idx.name, "shard": "0", "prirep": "p", "state": "STARTED",
+				"docs": strconv.Itoa(len(idx.docs)), "store": formatBytes(sizeOf(idx), bytesUnit),
+				"ip": nodeIP, "id": s.nodeID, "node": s.opts.NodeName,
+			})
+			for i := 0; i < s.replicas(idx); i++ {
+				rows = append(rows, map[string]string{
+					"index": idx.name, "shard": "0", "prirep": "r", "state": "UNASSIGNED", "unassigned.reason": "INDEX_CREATED",
+				})
+			}
+		}
+		return catTable(req, []string{"index", "shard", "prirep", "state", "docs", "store", "ip", "node"}, rows)
+	case "count":
+		count := 0
+		for _, idx := range indices {
+			count += len(idx.docs)
+		}
+		return catTable(req, []string{"epoch", "timestamp", "count"}, []map[string]string{{
+			"epoch": strconv.FormatInt(now.Unix(), 10), "timestamp": now.UTC().Format("15:04:05"), "count": strconv.Itoa(count),
+		}})
+	case "allocation":
+		size := 0
+		for _, idx := range indices {
+			size += sizeOf(idx)
+		}
+		return catTable(req, []string{"shards", "disk.indices", "disk.used", "disk.avail", "disk.total", "disk.percent", "host", "ip", "node"},
+			[]map[string]string{{
+				"shards": strconv.Itoa(len(indices)), "disk.indices": formatBytes(size, bytesUnit), "disk.used": formatBytes(size, bytesUnit),
+				"disk.avail": formatBytes(diskBytes-size, bytesUnit), "disk.total": formatBytes(diskBytes, bytesUnit), "disk.percent": "0",
+				"host": nodeIP, "ip": nodeIP, "node": s.opts.NodeName,
+			}})
+	case "aliases":
+		var rows []map[string]string
+		for _, idx := range indices {
+			names := make([]string, 0, len(idx.aliases))
+			for alias := range idx.aliases {
+				names = append(names, alias)
+			}
+			sort.Strings(names)
+			for _, alias := range names {
+				if target != "" && !globMatch(target, alias) {
+					continue
+				}
+				def := idx.aliases[alias]
+				row := map[string]string{"alias": alias, "index": idx.name, "filter": "-", "routing.index": "-", "routing.search": "-", "is_write_index": "-"}
+				if def["filter"] != nil {
+					row["filter"] = "*"
+				}
+				if v, ok := def["is_write_index"]; ok {
+					row["is_write_index"] = toString(v)
+				}
+				rows = append(rows, row)
+			}
+		}
+		return catTable(req, []string{"alias", "index", "filter", "routing.index", "routing.search", "is_write_index"}, rows)
+	case "templates":
+		var rows []map[string]string
+		add := func(store map[string]map[string]interface{}, composable bool) {
+			for name, tmpl := range store {
+				if target != "" && !globMatch(target, name) {
+					continue
+				}
+				patterns := toStrings(tmpl["index_patterns"])
+				if len(patterns) == 0 {
+					patterns = toStrings(tmpl["template"])
+				}
+				order := toString(tmpl["order"])
+				if composable {
+					order = toString(tmpl["priority"])
+				}
+				rows = append(rows, map[string]string{
+					"name": name, "index_patterns": "[" + strings.Join(patterns, ", ") + "]",
+					"order": order, "version": toString(tmpl["version"]),
+				})
+			}
+		}
+		add(s.templates, false)
+		add(s.indexTemplates, true)
+		sort.Slice(rows, func(i, j int) bool { return rows[i]["name"] < rows[j]["name"] })
+		return catTable(req, []string{"name", "index_patterns", "order", "version"}, rows)
+	}
+	return 0, nil, noHandler(req.Request)
+}
@@ -0,0 +1,817 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// document is a stored document; writes bump version and seq_no the way a
+// single primary shard does.
+type document struct {
+	id          string
+	source      json.RawMessage
+	fields      map[string]interface{}
+	version     int64
+	seqNo       int64
+	primaryTerm int64
+	order       int64
+	routing     string
+}
+
+// writeOp is a single index/create/update/delete, from a document endpoint
+// or a _bulk line.
+type writeOp struct {
+	action        string
+	index         string
+	docType       string
+	id            string
+	routing       string
+	ifSeqNo       *int64
+	ifPrimaryTerm *int64
+	version       *int64
+	versionType   string
+	body          []byte
+}
+
+func parseInt64Ptr(v interface{}) (*int64, error) {
+	if v == nil {
+		return nil, nil
+	}
+	s := toString(v)
+	if s == "" {
+		return nil, nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, badRequest("failed to parse [%v] as a long", s)
+	}
+	return &i, nil
+}
+
+func (s *Server) newID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatInt(s.nextSequence(), 36)
+}
+
+func (s *Server) versionConflict(idx *index, id, reason string) *esError {
+	prefix := "[" + id + "]"
+	if s.major < 7 {
+		prefix = "[" + s.typeName(idx, "") + "]" + prefix
+	}
+	return &esError{status: http.StatusConflict, typ: "version_conflict_engine_exception",
+		reason: prefix + ": version conflict, " + reason, index: idx.name}
+}
+
+func (s *Server) documentMissing(idx *index, id string) *esError {
+	return &esError{status: http.StatusNotFound, typ: "document_missing_exception",
+		reason: fmt.Sprintf("[%v][%v]: document missing", s.typeName(idx, ""), id), index: idx.name}
+}
+
+// checkPreconditions enforces op_type=create, if_seq_no/if_primary_term
+// and external versions.
+func (s *Server) checkPreconditions(idx *index, op *writeOp, doc *document) error {
+	if op.action == "create" && doc != nil {
+		return s.versionConflict(idx, op.id, fmt.Sprintf("document already exists (current version [%d])", doc.version))
+	}
+	if op.ifSeqNo != nil || op.ifPrimaryTerm != nil {
+		var seqNo, term int64 = -2, 0
+		if op.ifSeqNo != nil {
+			seqNo = *op.ifSeqNo
+		}
+		if op.ifPrimaryTerm != nil {
+			term = *op.ifPrimaryTerm
+		}
+		if doc == nil {
+			return s.versionConflict(idx, op.id, fmt.Sprintf("required seqNo [%d], primary term [%d] but no document was found", seqNo, term))
+		}
+		if doc.seqNo != seqNo || doc.primaryTerm != term {
+			return s.versionConflict(idx, op.id, fmt.Sprintf("required seqNo [%d], primary term [%d]. current document has seqNo [%d] and primary term [%d]",
+				seqNo, term, doc.seqNo, doc.primaryTerm))
+		}
+	}
+	if op.version != nil && strings.HasPrefix(op.versionType, "external") && doc != nil {
+		if *op.version < doc.version || (*op.version == doc.version && op.versionType != "external_gte") {
+			return s.versionConflict(idx, op.id, fmt.Sprintf("current version [%d] is higher or equal to the one provided [%d]", doc.version, *op.version))
+		}
+	}
+	return nil
+}
+
+// store writes a source under id, applying dynamic mappings first.
+func (s *Server) store(idx *index, op *writeOp, fields map[string]interface{}, raw []byte) (*document, bool, error) {
+	if err := idx.mapDocument(fields); err != nil {
+		return nil, false, err
+	}
+	existing := idx.docs[op.id]
+	doc := &document{
+		id:          op.id,
+		source:      append(json.RawMessage(nil), raw...),
+		fields:      fields,
+		version:     1,
+		seqNo:       idx.seqNo,
+		primaryTerm: 1,
+		order:       s.nextSequence(),
+		routing:     op.routing,
+	}
+	if existing != nil {
+		doc.version = existing.version + 1
+	}
+	if op.version != nil && strings.HasPrefix(op.versionType, "external") {
+		doc.version = *op.version
+	}
+	idx.seqNo++
+	idx.indexTotal++
+	idx.docs[op.id] = doc
+	return doc, existing == nil, nil
+}
+
+func parseSource(raw []byte) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	if err := decodeJSON(raw, &fields); err != nil || fields == nil {
+		reason := "failed to parse"
+		if err != nil {
+			reason = "failed to parse: " + err.Error()
+		}
+		return nil, &esError{status: http.StatusBadRequest, typ: "mapper_parsing_exception", reason: reason}
+	}
+	return fields, nil
+}
+
+// execute runs a write and returns its status and result body.
+func (s *Server) execute(op *writeOp) (int, map[string]interface{}, error) {
+	var idx *index
+	var err error
+	switch op.action {
+	case "index", "create", "update":
+		idx, err = s.writeIndex(op.index)
+	case "delete":
+		idx = s.indices[op.index]
+		if idx == nil {
+			indices, _ := s.resolve(op.index, true)
+			if len(indices) != 1 {
+				return 0, nil, indexNotFound(op.index)
+			}
+			idx = indices[0]
+		}
+	default:
+		return 0, nil, badRequest("unknown action [%v]", op.action)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if s.major < 7 && op.docType != "" && op.docType != "_doc" && idx.docType == "" {
+		idx.docType = op.docType
+	}
+	if op.id == "" {
+		if op.action == "update" || op.action == "delete" {
+			return 0, nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception", reason: "Validation Failed: 1: id is missing;"}
+		}
+		op.id = s.newID()
+	}
+
+	existing := idx.docs[op.id]
+	if err := s.checkPreconditions(idx, op, existing); err != nil {
+		return 0, nil, err
+	}
+
+	var doc *document
+	result := ""
+	status := http.StatusOK
+	switch op.action {
+	case "index", "create":
+		fields, err := parseSource(op.body)
+		if err != nil {
+			return 0, nil, err
+		}
+		var created bool
+		doc, created, err = s.store(idx, op, fields, op.body)
+		if err != nil {
+			return 0, nil, err
+		}
+		result = "updated"
+		if created {
+			result, status = "created", http.StatusCreated
+		}
+	case "update":
+		doc, result, err = s.update(idx, op, existing)
+		if err != nil {
+			return 0, nil, err
+		}
+		if result == "created" {
+			status = http.StatusCreated
+		}
+	case "delete":
+		if existing == nil {
+			resp := s.writeResult(idx, op.id, "not_found", &document{version: 1, seqNo: idx.seqNo, primaryTerm: 1})
+			if s.major < 6 {
+				resp["found"] = false
+			}
+			return http.StatusNotFound, resp, nil
+		}
+		delete(idx.docs, op.id)
+		idx.deleteTotal++
+		doc = &document{version: existing.version + 1, seqNo: idx.seqNo, primaryTerm: 1}
+		idx.seqNo++
+		result = "deleted"
+	}
+
+	resp := s.writeResult(idx, op.id, result, doc)
+	if s.major < 6 {
+		switch op.action {
+		case "index", "create":
+			resp["created"] = result == "created"
+		case "delete":
+			resp["found"] = true
+		}
+	}
+	return status, resp, nil
+}
+
+func (s *Server) writeResult(idx *index, id, result string, doc *document) map[string]interface{} {
+	replicas, _ := strconv.Atoi(idx.settings["index.number_of_replicas"])
+	resp := map[string]interface{}{
+		"_index":   idx.name,
+		"_id":      id,
+		"_version": doc.version,
+		"result":   result,
+		"_shards":  map[string]interface{}{"total": replicas + 1, "successful": 1, "failed": 0},
+	}
+	if s.major < 8 {
+		resp["_type"] = s.typeName(idx, "")
+	}
+	if s.major >= 6 {
+		resp["_seq_no"] = doc.seqNo
+		resp["_primary_term"] = doc.primaryTerm
+	}
+	if result == "noop" {
+		delete(resp, "_shards")
+	}
+	return resp
+}
+
+// update applies a partial document, an upsert or a script.
+func (s *Server) update(idx *index, op *writeOp, existing *document) (*document, string, error) {
+	body, err := parseSource(op.body)
+	if err != nil {
+		return nil, "", err
+	}
+	partial, hasDoc := asMap(body["doc"])
+	script, hasScript := body["script"]
+	if !hasDoc && !hasScript {
+		return nil, "", &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+			reason: "Validation Failed: 1: script or doc is missing;"}
+	}
+
+	var fields map[string]interface{}
+	created := existing == nil
+	if existing == nil {
+		docAsUpsert, _ := toBool(body["doc_as_upsert"])
+		upsert, hasUpsert := asMap(body["upsert"])
+		scriptedUpsert, _ := toBool(body["scripted_upsert"])
+		switch {
+		case hasDoc && docAsUpsert:
+			fields = deepCopy(partial).(map[string]interface{})
+		case hasUpsert:
+			fields = deepCopy(upsert).(map[string]interface{})
+			if hasScript && scriptedUpsert {
+				if _, err := applyScript(fields, script); err != nil {
+					return nil, "", err
+				}
+			}
+		default:
+			return nil, "", s.documentMissing(idx, op.id)
+		}
+	} else {
+		fields = deepCopy(existing.fields).(map[string]interface{})
+		if hasDoc {
+			mergeSource(fields, partial)
+		}
+		if hasScript {
+			ctxOp, err := applyScript(fields, script)
+			if err != nil {
+				return nil, "", err
+			}
+			switch ctxOp {
+			case "delete":
+				delete(idx.docs, op.id)
+				idx.seqNo++
+				return &document{version: existing.version + 1, seqNo: idx.seqNo - 1, primaryTerm: 1}, "deleted", nil
+			case "noop", "none":
+				return existing, "noop", nil
+			}
+		}
+		detectNoop, set := toBool(body["detect_noop"])
+		if !set {
+			detectNoop = true
+		}
+		if detectNoop && hasDoc && !hasScript {
+			before, _ := json.Marshal(existing.fields)
+			after, _ := json.Marshal(fields)
+			if bytes.Equal(before, after) {
+				return existing, "noop", nil
+			}
+		}
+	}
+
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return nil, "", err
+	}
+	doc, _, err := s.store(idx, op, fields, raw)
+	if err != nil {
+		return nil, "", err
+	}
+	if created {
+		return doc, "created", nil
+	}
+	return doc, "updated", nil
+}
+
+// mergeSource deep-merges objects; any other value replaces the old one.
+func mergeSource(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sub, ok := asMap(v); ok {
+			if existing, ok := asMap(dst[k]); ok {
+				mergeSource(existing, sub)
+				continue
+			}
+		}
+		dst[k] = deepCopy(v)
+	}
+}
+
+func setSourcePath(src map[string]interface{}, path string, v interface{}) {
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		src[path] = v
+		return
+	}
+	child, ok := asMap(src[head])
+	if !ok {
+		child = map[string]interface{}{}
+		src[head] = child
+	}
+	setSourcePath(child, rest, v)
+}
+
+func removeSourcePath(src map[string]interface{}, path string) {
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		delete(src, path)
+		return
+	}
+	if child, ok := asMap(src[head]); ok {
+		removeSourcePath(child, rest)
+	}
+}
+
+// applyScript runs the tiny painless subset the fake understands:
+// `ctx._source.f = <expr>`, `+=`, `-=`, `ctx._source.remove('f')` and
+// `ctx.op = 'noop'|'delete'`, where <expr> is a literal, params.x or
+// another ctx._source field. It returns the requested ctx.op.
+func applyScript(src map[string]interface{}, script interface{}) (string, error) {
+	var code string
+	params := map[string]interface{}{}
+	switch x := script.(type) {
+	case string:
+		code = x
+	case map[string]interface{}:
+		code = toString(x["source"])
+		if code == "" {
+			code = toString(x["inline"])
+		}
+		if p, ok := asMap(x["params"]); ok {
+			params = p
+		}
+	}
+	unsupported := func(stmt string) error {
+		return badRequest("script [%v] is not supported by elastictest", stmt)
+	}
+	eval := func(expr string) (interface{}, error) {
+		expr = strings.TrimSpace(expr)
+		switch {
+		case strings.HasPrefix(expr, "params."):
+			return params[expr[len("params."):]], nil
+		case strings.HasPrefix(expr, "params['") || strings.HasPrefix(expr, "params[\""):
+			return params[strings.Trim(expr[len("params["):], "'\"]")], nil
+		case strings.HasPrefix(expr, "ctx._source."):
+			values := fieldValues(src, expr[len("ctx._source."):])
+			if len(values) == 1 {
+				return values[0], nil
+			}
+			return nil, nil
+		case len(expr) >= 2 && (expr[0] == '\'' || expr[0] == '"'):
+			return expr[1 : len(expr)-1], nil
+		case expr == "true" || expr == "false":
+			return expr == "true", nil
+		case expr == "null":
+			return nil, nil
+		}
+		if _, err := strconv.ParseFloat(expr, 64); err == nil {
+			return json.Number(expr), nil
+		}
+		return nil, unsupported(expr)
+	}
+
+	op := ""
+	for _, stmt := range strings.Split(code, ";") {
+		stmt = strings.TrimSpace(stmt)
+		switch {
+		case stmt == "":
+			continue
+		case strings.HasPrefix(stmt, "ctx.op"):
+			_, v, _ := strings.Cut(stmt, "=")
+			value, err := eval(v)
+			if err != nil {
+				return "", err
+			}
+			op = toString(value)
+		case strings.HasPrefix(stmt, "ctx._source.remove("):
+			field := strings.Trim(stmt[len("ctx._source.remove("):], "'\") ")
+			removeSourcePath(src, field)
+		case strings.HasPrefix(stmt, "ctx._source."):
+			lhs, rhs, ok := strings.Cut(stmt, "=")
+			if !ok {
+				return "", unsupported(stmt)
+			}
+			lhs = strings.TrimSpace(lhs[len("ctx._source."):])
+			value, err := eval(rhs)
+			if err != nil {
+				return "", err
+			}
+			if strings.HasSuffix(lhs, "+") || strings.HasSuffix(lhs, "-") {
+				sign := lhs[len(lhs)-1]
+				lhs = strings.TrimSpace(lhs[:len(lhs)-1])
+				current := fieldValues(src, lhs)
+				if len(current) == 1 {
+					if s, ok := current[0].(string); ok && sign == '+' {
+						value = s + toString(value)
+					} else {
+						a, _ := toFloat(current[0])
+						b, _ := toFloat(value)
+						if sign == '-' {
+							b = -b
+						}
+						value = jsonNumber(a + b)
+					}
+				}
+			}
+			setSourcePath(src, lhs, value)
+		default:
+			return "", unsupported(stmt)
+		}
+	}
+	return op, nil
+}
+
+func (s *Server) writeOpFromRequest(req *request, target, docType, id, action string) (*writeOp, error) {
+	op := &writeOp{action: action, index: target, docType: docType, id: id, routing: req.param("routing"),
+		versionType: req.param("version_type"), body: req.body}
+	var err error
+	if op.ifSeqNo, err = parseInt64Ptr(req.param("if_seq_no")); err != nil {
+		return nil, err
+	}
+	if op.ifPrimaryTerm, err = parseInt64Ptr(req.param("if_primary_term")); err != nil {
+		return nil, err
+	}
+	if op.version, err = parseInt64Ptr(req.param("version")); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+func (s *Server) handleDocument(req *request, target, docType, endpoint string, rest []string) (int, interface{}, error) {
+	id := ""
+	if len(rest) > 0 {
+		id = rest[0]
+	}
+	if len(rest) > 1 {
+		return 0, nil, noHandler(req.Request)
+	}
+
+	action := ""
+	switch {
+	case endpoint == "_source" || req.Method == http.MethodGet || req.Method == http.MethodHead:
+		if id == "" {
+			return 0, nil, noHandler(req.Request)
+		}
+		return s.getDocument(req, target, docType, id, endpoint == "_source")
+	case endpoint == "_update" && req.Method == http.MethodPost:
+		action = "update"
+	case endpoint == "_create" && (req.Method == http.MethodPut || req.Method == http.MethodPost):
+		action = "create"
+	case endpoint == "_doc" && req.Method == http.MethodDelete:
+		action = "delete"
+	case endpoint == "_doc" && req.Method == http.MethodPost:
+		action = "index"
+	case endpoint == "_doc" && req.Method == http.MethodPut:
+		if id == "" {
+			return 0, nil, noHandler(req.Request)
+		}
+		action = "index"
+	default:
+		return 0, nil, noHandler(req.Request)
+	}
+	if action == "index" && req.param("op_type") == "create" {
+		action = "create"
+	}
+	if action == "create" && id == "" {
+		return 0, nil, noHandler(req.Request)
+	}
+
+	op, err := s.writeOpFromRequest(req, target, docType, id, action)
+	if err != nil {
+		return 0, nil, err
+	}
+	status, resp, err := s.execute(op)
+	if err != nil {
+		return 0, nil, err
+	}
+	if refresh := req.param("refresh"); refresh == "true" || (refresh == "" && req.flag("refresh")) {
+		resp["forced_refresh"] = true
+	}
+	return status, resp, nil
+}
+
+func (s *Server) getDocument(req *request, target, docType, id string, sourceOnly bool) (int, interface{}, error) {
+	idx := s.indices[target]
+	if idx == nil {
+		indices, _ := s.resolve(target, true)
+		if len(indices) != 1 {
+			return 0, nil, indexNotFound(target)
+		}
+		idx = indices[0]
+	}
+	doc := idx.docs[id]
+	if sourceOnly {
+		if doc == nil {
+			return 0, nil, &esError{status: http.StatusNotFound, typ: "resource_not_found_exception",
+				reason: fmt.Sprintf("Document not found [%v]/[%v]", idx.name, id)}
+		}
+		return http.StatusOK, json.RawMessage(doc.source), nil
+	}
+	resp := map[string]interface{}{"_index": idx.name, "_id": id}
+	if s.major < 8 {
+		resp["_type"] = s.typeName(idx, docType)
+	}
+	if doc == nil {
+		resp["found"] = false
+		return http.StatusNotFound, resp, nil
+	}
+	resp["found"] = true
+	resp["_version"] = doc.version
+	if s.major >= 6 {
+		resp["_seq_no"] = doc.seqNo
+		resp["_primary_term"] = doc.primaryTerm
+	}
+	if doc.routing != "" {
+		resp["_routing"] = doc.routing
+	}
+	filter, err := sourceFilterFromParams(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	if source := filter.apply(doc); source != nil {
+		resp["_source"] = source
+	}
+	return http.StatusOK, resp, nil
+}
+
+func (s *Server) handleMultiGet(req *request, target string) (int, interface{}, error) {
+	body, err := req.jsonBody()
+	if err != nil {
+		return 0, nil, err
+	}
+	var specs []map[string]interface{}
+	if docs, ok := body["docs"].([]interface{}); ok {
+		for _, d := range docs {
+			if m, ok := asMap(d); ok {
+				specs = append(specs, m)
+			}
+		}
+	}
+	for _, id := range toStrings(body["ids"]) {
+		specs = append(specs, map[string]interface{}{"_id": id})
+	}
+	out := make([]interface{}, 0, len(specs))
+	for _, spec := range specs {
+		name := toString(spec["_index"])
+		if name == "" {
+			name = target
+		}
+		id := toString(spec["_id"])
+		_, resp, err := s.getDocument(req, name, toString(spec["_type"]), id, false)
+		if err != nil {
+			e := err.(*esError)
+			resp = map[string]interface{}{"_index": name, "_id": id, "error": e.body()["error"]}
+		}
+		out = append(out, resp)
+	}
+	return http.StatusOK, map[string]interface{}{"docs": out}, nil
+}
+
+var bulkActions = map[string]bool{"index": true, "create": true, "update": true, "delete": true}
+
+func (s *Server) handleBulk(req *request, defaultIndex, defaultType string) (int, interface{}, error) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		return 0, nil, noHandler(req.Request)
+	}
+	start := time.Now()
+	if s.rejectBulkRequests > 0 {
+		s.rejectBulkRequests--
+		s.writeRejected++
+		return 0, nil, &esError{status: http.StatusTooManyRequests, typ: "es_rejected_execution_exception",
+			reason: "rejected execution of coordinating operation [coordinating_and_primary_bytes=0, replica_bytes=0, all_bytes=0, coordinating_operation_bytes=0, max_coordinating_and_primary_bytes=0]"}
+	}
+	if len(req.body) > 0 && req.body[len(req.body)-1] != '\n' {
+		return 0, nil, badRequest("The bulk request must be terminated by a newline [\\n]")
+	}
+
+	lines := bytes.Split(req.body, []byte("\n"))
+	items := []interface{}{}
+	hasErrors := false
+	for i := 0; i < len(lines); i++ {
+		line := bytes.TrimSpace(lines[i])
+		if len(line) == 0 {
+			continue
+		}
+		var meta map[string]interface{}
+		if err := decodeJSON(line, &meta); err != nil || len(meta) != 1 {
+			return 0, nil, badRequest("Malformed action/metadata line [%d], expected START_OBJECT but found [VALUE_STRING]", i+1)
+		}
+		var action string
+		var params map[string]interface{}
+		for k, v := range meta {
+			action = k
+			params, _ = asMap(v)
+		}
+		if !bulkActions[action] {
+			return 0, nil, badRequest("Malformed action/metadata line [%d], expected field [create], [delete], [index] or [update] but found [%v]", i+1, action)
+		}
+
+		op := &writeOp{action: action, index: toString(params["_index"]), docType: toString(params["_type"]),
+			id: toString(params["_id"]), routing: toString(params["routing"]), versionType: toString(params["version_type"])}
+		if op.index == "" {
+			op.index = defaultIndex
+		}
+		if op.docType == "" {
+			op.docType = defaultType
+		}
+		if op.routing == "" {
+			op.routing = toString(params["_routing"])
+		}
+		var err error
+		if op.ifSeqNo, err = parseInt64Ptr(params["if_seq_no"]); err != nil {
+			return 0, nil, err
+		}
+		if op.ifPrimaryTerm, err = parseInt64Ptr(params["if_primary_term"]); err != nil {
+			return 0, nil, err
+		}
+		if op.version, err = parseInt64Ptr(params["version"]); err != nil {
+			return 0, nil, err
+		}
+		if action != "delete" {
+			i++
+			if i >= len(lines) || len(bytes.TrimSpace(lines[i])) == 0 {
+				return 0, nil, badRequest("Malformed action/metadata line [%d], expected a source line after the action", i)
+			}
+			op.body = bytes.TrimSpace(lines[i])
+		}
+		if op.index == "" {
+			return 0, nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+				reason: "Validation Failed: 1: index is missing;"}
+		}
+
+		var item map[string]interface{}
+		if s.rejectBulkItems > 0 {
+			s.rejectBulkItems--
+			s.writeRejected++
+			item = s.bulkItemError(op, &esError{status: http.StatusTooManyRequests, typ: "es_rejected_execution_exception",
+				reason: "rejected execution of processing of [" + strconv.FormatInt(s.nextSequence(), 10) + "][indices:data/write/bulk[s][p]]: request: BulkShardRequest [[" + op.index + "][0]] containing [1] requests, target allocation id: elastictest, primary term: 1 on EsThreadPoolExecutor[name = " + s.opts.NodeName + "/write, queue capacity = 10000]"})
+		} else {
+			status, resp, err := s.execute(op)
+			if err != nil {
+				e, ok := err.(*esError)
+				if !ok {
+					e = &esError{status: http.StatusInternalServerError, typ: "exception", reason: err.Error()}
+				}
+				item = s.bulkItemError(op, e)
+			} else {
+				resp["status"] = status
+				item = resp
+			}
+			s.writeCompleted++
+		}
+		if _, failed := item["error"]; failed {
+			hasErrors = true
+		}
+		items = append(items, map[string]interface{}{action: item})
+	}
+	return http.StatusOK, bulkResponse{Took: time.Since(start).Milliseconds(), Errors: hasErrors, Items: items}, nil
+}
+
+// bulkResponse keeps took and errors ahead of the items like Elasticsearch
+// does; clients sniff "errors":true from the first bytes of the body.
+type bulkResponse struct {
+	Took   int64         `json:"took"`
+	Errors bool          `json:"errors"`
+	Items  []interface{} `json:"items"`
+}
+
+func (s *Server) bulkItemError(op *writeOp, e *esError) map[string]interface{} {
+	cause := map[string]interface{}{"type": e.typ, "reason": e.reason, "index": op.index, "shard": "0"}
+	if idx, ok := s.indices[op.index]; ok {
+		cause["index_uuid"] = idx.uuid
+	}
+	item := map[string]interface{}{"_index": op.index, "_id": op.id, "status": e.status, "error": cause}
+	if s.major < 8 {
+		item["_type"] = s.typeName(s.indices[op.index], op.docType)
+	}
+	return item
+}
+
+func byQueryResponse(start time.Time, total int) map[string]interface{} {
+	return map[string]interface{}{
+		"took":                   time.Since(start).Milliseconds(),
+		"timed_out":              false,
+		"total":                  total,
+		"batches":                1,
+		"version_conflicts":      0,
+		"noops":                  0,
+		"retries":                map[string]interface{}{"bulk": 0, "search": 0},
+		"throttled_millis":       0,
+		"requests_per_second":    -1.0,
+		"throttled_until_millis": 0,
+		"failures":               []interface{}{},
+	}
+}
+
+func (s *Server) handleDeleteByQuery(req *request, target string) (int, interface{}, error) {
+	start := time.Now()
+	matched, err := s.queryDocuments(req, target)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, m := range matched {
+		delete(m.idx.docs, m.doc.id)
+		m.idx.seqNo++
+		m.idx.deleteTotal++
+	}
+	resp := byQueryResponse(start, len(matched))
+	resp["deleted"] = len(matched)
+	if req.param("wait_for_completion") == "false" {
+		return http.StatusOK, map[string]interface{}{"task": s.nodeID + ":" + strconv.FormatInt(s.nextSequence(), 10)}, nil
+	}
+	return http.StatusOK, resp, nil
+}
+
+func (s *Server) handleUpdateByQuery(req *request, target string) (int, interface{}, error) {
+	start := time.Now()
+	body, err := req.jsonBody()
+	if err != nil {
+		return 0, nil, err
+	}
+	matched, err := s.queryDocuments(req, target)
+	if err != nil {
+		return 0, nil, err
+	}
+	updated, noops, deleted := 0, 0, 0
+	for _, m := range matched {
+		fields := deepCopy(m.doc.fields).(map[string]interface{})
+		if script, ok := body["script"]; ok {
+			op, err := applyScript(fields, script)
+			if err != nil {
+				return 0, nil, err
+			}
+			switch op {
+			case "noop", "none":
+				noops++
+				continue
+			case "delete":
+				delete(m.idx.docs, m.doc.id)
+				m.idx.seqNo++
+				deleted++
+				continue
+			}
+		}
+		raw, _ := json.Marshal(fields)
+		if _, _, err := s.store(m.idx, &writeOp{id: m.doc.id, routing: m.doc.routing}, fields, raw); err != nil {
+			return 0, nil, err
+		}
+		updated++
+	}
+	resp := byQueryResponse(start, len(matched))
+	resp["updated"] = updated
+	resp["deleted"] = deleted
+	resp["noops"] = noops
+	if req.param("wait_for_completion") == "false" {
+		return http.StatusOK, map[string]interface{}{"task": s.nodeID + ":" + strconv.FormatInt(s.nextSequence(), 10)}, nil
+	}
+	return http.StatusOK, resp, nil
+}
@@ -0,0 +1,1031 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// index is one in-memory index. Mappings are stored typeless, the legacy
+// mapping type (5.x/6.x) is kept aside in docType.
+type index struct {
+	name     string
+	uuid     string
+	created  time.Time
+	docType  string
+	mappings map[string]interface{}
+	settings map[string]string
+	aliases  map[string]map[string]interface{}
+	docs     map[string]*document
+	seqNo    int64
+
+	indexTotal  int64
+	deleteTotal int64
+	searchTotal int64
+}
+
+// mapping root parameters, anything else at the root of a mapping body is
+// a legacy type name.
+var mappingRootKeys = map[string]bool{
+	"properties": true, "dynamic": true, "_source": true, "_meta": true, "dynamic_templates": true,
+	"_routing": true, "date_detection": true, "numeric_detection": true, "_all": true,
+	"_field_names": true, "runtime": true, "enabled": true, "_size": true, "dynamic_date_formats": true,
+}
+
+// untypeMapping strips a legacy {"type":{...}} wrapper.
+func untypeMapping(m map[string]interface{}) (string, map[string]interface{}) {
+	if len(m) == 1 {
+		for k, v := range m {
+			if inner, ok := asMap(v); ok && !mappingRootKeys[k] {
+				return k, inner
+			}
+		}
+	}
+	return "", m
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			out[k] = deepCopy(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = deepCopy(e)
+		}
+		return out
+	}
+	return v
+}
+
+func mappingType(def map[string]interface{}) string {
+	if t, ok := def["type"].(string); ok {
+		return t
+	}
+	return "object"
+}
+
+func properties(m map[string]interface{}) map[string]interface{} {
+	props, ok := asMap(m["properties"])
+	if !ok {
+		props = map[string]interface{}{}
+		m["properties"] = props
+	}
+	return props
+}
+
+// mergeMapping merges src into dst, refusing to change the type of an
+// existing field like Elasticsearch does.
+func mergeMapping(dst, src map[string]interface{}) error {
+	for k, v := range src {
+		if k == "properties" {
+			props, _ := asMap(v)
+			if err := mergeProperties(properties(dst), props, ""); err != nil {
+				return err
+			}
+			continue
+		}
+		dst[k] = deepCopy(v)
+	}
+	return nil
+}
+
+func mergeProperties(dst, src map[string]interface{}, prefix string) error {
+	for name, v := range src {
+		def, ok := asMap(v)
+		if !ok {
+			return &esError{status: http.StatusBadRequest, typ: "mapper_parsing_exception",
+				reason: fmt.Sprintf("Expected map for property [fields] on field [%v] but got a class java.lang.String", name)}
+		}
+		if head, rest, dotted := strings.Cut(name, "."); dotted {
+			def = map[string]interface{}{"properties": map[string]interface{}{rest: def}}
+			name = head
+		}
+		existing, ok := asMap(dst[name])
+		if !ok {
+			dst[name] = deepCopy(def)
+			continue
+		}
+		oldType, newType := mappingType(existing), mappingType(def)
+		if _, typed := def["type"]; typed && oldType != newType {
+			return badRequest("mapper [%v%v] cannot be changed from type [%v] to [%v]", prefix, name, oldType, newType)
+		}
+		for k, e := range def {
+			switch k {
+			case "properties", "fields":
+				sub, _ := asMap(e)
+				target, ok := asMap(existing[k])
+				if !ok {
+					target = map[string]interface{}{}
+					existing[k] = target
+				}
+				if err := mergeProperties(target, sub, prefix+name+"."); err != nil {
+					return err
+				}
+			default:
+				existing[k] = deepCopy(e)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupField resolves a dotted field name to its mapped type and to the
+// source path holding its values; multi-fields such as name.keyword read
+// the values of their parent.
+func (idx *index) lookupField(path string) (fieldType, sourcePath string, ok bool) {
+	props, _ := asMap(idx.mappings["properties"])
+	parts := strings.Split(path, ".")
+	for i := 0; i < len(parts); i++ {
+		def, found := asMap(props[parts[i]])
+		if !found {
+			return "", path, false
+		}
+		if i == len(parts)-1 {
+			if mappingType(def) == "alias" {
+				if target, ok := def["path"].(string); ok && target != path {
+					return idx.lookupField(target)
+				}
+			}
+			return mappingType(def), path, true
+		}
+		if sub, ok := asMap(def["properties"]); ok {
+			props = sub
+			continue
+		}
+		if fields, ok := asMap(def["fields"]); ok && i == len(parts)-2 {
+			if sub, ok := asMap(fields[parts[i+1]]); ok {
+				return mappingType(sub), strings.Join(parts[:i+1], "."), true
+			}
+		}
+		return "", path, false
+	}
+	return "", path, false
+}
+
+// walkFields visits every leaf field (and multi-field) of the mapping.
+func walkFields(props map[string]interface{}, prefix string, fn func(path string, def map[string]interface{})) {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		def, ok := asMap(props[name])
+		if !ok {
+			continue
+		}
+		path := prefix + name
+		fn(path, def)
+		if sub, ok := asMap(def["properties"]); ok {
+			walkFields(sub, path+".", fn)
+		}
+		if fields, ok := asMap(def["fields"]); ok {
+			walkFields(fields, path+".", fn)
+		}
+	}
+}
+
+// mapDocument adds dynamic mappings for the unmapped fields of a source.
+func (idx *index) mapDocument(src map[string]interface{}) error {
+	dynamic := toString(idx.mappings["dynamic"])
+	if dynamic == "false" {
+		return nil
+	}
+	return mapDynamic(properties(idx.mappings), src, "", dynamic == "strict")
+}
+
+func mapDynamic(props, src map[string]interface{}, prefix string, strict bool) error {
+	for k, v := range src {
+		if head, rest, dotted := strings.Cut(k, "."); dotted {
+			if err := mapDynamic(props, map[string]interface{}{head: map[string]interface{}{rest: v}}, prefix, strict); err != nil {
+				return err
+			}
+			continue
+		}
+		existing, mapped := asMap(props[k])
+		if !mapped {
+			def := inferMapping(v)
+			if def == nil {
+				continue
+			}
+			if strict {
+				return &esError{status: http.StatusBadRequest, typ: "strict_dynamic_mapping_exception",
+					reason: fmt.Sprintf("mapping set to strict, dynamic introduction of [%v] within [%v] is not allowed", k, strings.TrimSuffix(prefix, ".")+"_doc")}
+			}
+			props[k] = def
+			existing = def
+		}
+		if _, isObject := existing["properties"]; !isObject && kindOf(mappingType(existing)) != kindObject {
+			continue
+		}
+		if toString(existing["dynamic"]) == "false" || toString(existing["enabled"]) == "false" {
+			continue
+		}
+		for _, obj := range flatten(v) {
+			if m, ok := asMap(obj); ok {
+				if err := mapDynamic(properties(existing), m, prefix+k+".", strict); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// inferMapping is the default dynamic mapping of a JSON value.
+func inferMapping(v interface{}) map[string]interface{} {
+	for _, e := range flatten(v) {
+		switch x := e.(type) {
+		case map[string]interface{}:
+			return map[string]interface{}{"properties": map[string]interface{}{}}
+		case bool:
+			return map[string]interface{}{"type": "boolean"}
+		case json.Number:
+			if strings.ContainsAny(x.String(), ".eE") {
+				return map[string]interface{}{"type": "float"}
+			}
+			return map[string]interface{}{"type": "long"}
+		case float64:
+			return map[string]interface{}{"type": "float"}
+		case string:
+			if looksLikeDate(x) {
+				return map[string]interface{}{"type": "date"}
+			}
+			return map[string]interface{}{"type": "text", "fields": map[string]interface{}{
+				"keyword": map[string]interface{}{"type": "keyword", "ignore_above": json.Number("256")}}}
+		}
+	}
+	return nil
+}
+
+func looksLikeDate(s string) bool {
+	if len(s) < 10 || (s[4] != '-' && s[4] != '/') {
+		return false
+	}
+	_, ok := parseDate(s, time.UTC)
+	return ok
+}
+
+// defaultSettings are the index settings every index starts with.
+func (s *Server) defaultSettings(name string) map[string]string {
+	return map[string]string{
+		"index.number_of_shards":   "1",
+		"index.number_of_replicas": strconv.Itoa(s.opts.Replicas),
+		"index.provided_name":      name,
+		"index.creation_date":      strconv.FormatInt(time.Now().UnixMilli(), 10),
+		"index.version.created":    fmt.Sprintf("%d%02d0099", s.major, s.minor),
+	}
+}
+
+// flattenSettings turns nested or flat settings into index.* keys.
+func flattenSettings(v interface{}, prefix string, out map[string]string) {
+	m, ok := asMap(v)
+	if !ok {
+		key := prefix
+		if !strings.HasPrefix(key, "index.") {
+			key = "index." + key
+		}
+		out[key] = toString(v)
+		return
+	}
+	for k, e := range m {
+		if prefix != "" {
+			k = prefix + "." + k
+		}
+		flattenSettings(e, k, out)
+	}
+}
+
+func nestSettings(flat map[string]string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range flat {
+		parts := strings.Split(k, ".")
+		node := out
+		for _, p := range parts[:len(parts)-1] {
+			child, ok := asMap(node[p])
+			if !ok {
+				child = map[string]interface{}{}
+				node[p] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = v
+	}
+	return out
+}
+
+func validIndexName(name string) error {
+	if name == "" || name != strings.ToLower(name) || strings.ContainsAny(name, "\\/*?\"<>| ,#:") ||
+		strings.HasPrefix(name, "_") || strings.HasPrefix(name, "-") || strings.HasPrefix(name, "+") {
+		return &esError{status: http.StatusBadRequest, typ: "invalid_index_name_exception",
+			reason: fmt.Sprintf("Invalid index name [%v], must be lowercase and must not contain special characters", name), index: name}
+	}
+	return nil
+}
+
+// createIndex creates an index from the matching templates and the body
+// of a create-index request.
+func (s *Server) createIndex(name string, body map[string]interface{}) (*index, error) {
+	if err := validIndexName(name); err != nil {
+		return nil, err
+	}
+	if existing, ok := s.indices[name]; ok {
+		return nil, &esError{status: http.StatusBadRequest, typ: "resource_already_exists_exception",
+			reason: fmt.Sprintf("index [%v/%v] already exists", name, existing.uuid), index: name}
+	}
+	idx := &index{
+		name:     name,
+		uuid:     fmt.Sprintf("elastictest-%d", s.nextSequence()),
+		created:  time.Now(),
+		mappings: map[string]interface{}{},
+		settings: s.defaultSettings(name),
+		aliases:  map[string]map[string]interface{}{},
+		docs:     map[string]*document{},
+	}
+	idx.settings["index.uuid"] = idx.uuid
+
+	layers := s.matchingTemplates(name)
+	if body != nil {
+		layers = append(layers, body)
+	}
+	for _, layer := range layers {
+		if settings, ok := layer["settings"]; ok {
+			if nested, ok := asMap(settings); ok {
+				if inner, ok := asMap(nested["settings"]); ok && len(nested) == 1 {
+					settings = inner
+				}
+			}
+			flattenSettings(settings, "", idx.settings)
+		}
+		if m, ok := asMap(layer["mappings"]); ok {
+			docType, mapping := untypeMapping(m)
+			if docType != "" {
+				idx.docType = docType
+			}
+			if err := mergeMapping(idx.mappings, mapping); err != nil {
+				return nil, err
+			}
+		}
+		if aliases, ok := asMap(layer["aliases"]); ok {
+			for alias, v := range aliases {
+				def, _ := asMap(v)
+				if def == nil {
+					def = map[string]interface{}{}
+				}
+				idx.aliases[alias] = deepCopy(def).(map[string]interface{})
+			}
+		}
+	}
+	s.indices[name] = idx
+	return idx, nil
+}
+
+// matchingTemplates returns the template bodies that apply to a new index,
+// in the order they are merged. A matching composable template wins over
+// legacy ones, as on 7.8+.
+func (s *Server) matchingTemplates(name string) []map[string]interface{} {
+	var best map[string]interface{}
+	bestPriority := -1
+	for _, tmpl := range s.indexTemplates {
+		if !templateMatches(tmpl, name) {
+			continue
+		}
+		if p := toInt(tmpl["priority"], 0); p > bestPriority {
+			best, bestPriority = tmpl, p
+		}
+	}
+	if best != nil {
+		inner, _ := asMap(best["template"])
+		if inner == nil {
+			return nil
+		}
+		return []map[string]interface{}{inner}
+	}
+
+	var legacy []map[string]interface{}
+	for _, tmpl := range s.templates {
+		if templateMatches(tmpl, name) {
+			legacy = append(legacy, tmpl)
+		}
+	}
+	sort.SliceStable(legacy, func(i, j int) bool {
+		return toInt(legacy[i]["order"], 0) < toInt(legacy[j]["order"], 0)
+	})
+	return legacy
+}
+
+func templateMatches(tmpl map[string]interface{}, name string) bool {
+	patterns := toStrings(tmpl["index_patterns"])
+	if t, ok := tmpl["template"].(string); ok {
+		patterns = append(patterns, t)
+	}
+	for _, p := range patterns {
+		if globMatch(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve expands an index expression (names, aliases, wildcards, _all
+// and -exclusions) to indices sorted by name.
+func (s *Server) resolve(expr string, ignoreUnavailable bool) ([]*index, error) {
+	selected := map[string]bool{}
+	if expr == "" || expr == "_all" || expr == "*" {
+		for name := range s.indices {
+			selected[name] = true
+		}
+	}
+	for _, part := range strings.Split(expr, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" || part == "_all" || part == "*" {
+			continue
+		}
+		if strings.HasPrefix(part, "-") && len(selected) > 0 {
+			for name := range selected {
+				if globMatch(part[1:], name) {
+					delete(selected, name)
+				}
+			}
+			continue
+		}
+		found := false
+		for name, idx := range s.indices {
+			if globMatch(part, name) {
+				selected[name], found = true, true
+				continue
+			}
+			for alias := range idx.aliases {
+				if globMatch(part, alias) {
+					selected[name], found = true, true
+				}
+			}
+		}
+		if !found && !ignoreUnavailable && !strings.ContainsAny(part, "*?") {
+			return nil, indexNotFound(part)
+		}
+	}
+	out := make([]*index, 0, len(selected))
+	for _, name := range s.sortedIndexNames() {
+		if selected[name] {
+			out = append(out, s.indices[name])
+		}
+	}
+	return out, nil
+}
+
+// writeIndex resolves the target of a write, following aliases and
+// auto-creating missing indices.
+func (s *Server) writeIndex(name string) (*index, error) {
+	if idx, ok := s.indices[name]; ok {
+		return idx, nil
+	}
+	var candidates []*index
+	for _, idxName := range s.sortedIndexNames() {
+		idx := s.indices[idxName]
+		if def, ok := idx.aliases[name]; ok {
+			if b, _ := toBool(def["is_write_index"]); b {
+				return idx, nil
+			}
+			candidates = append(candidates, idx)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return s.createIndex(name, nil)
+	case 1:
+		return candidates[0], nil
+	}
+	return nil, badRequest("no write index is defined for alias [%v]. The write index may be explicitly disabled using is_write_index=false or the alias points to multiple indices without one being designated as a write index", name)
+}
+
+// typeName is the _type reported for documents of the index.
+func (s *Server) typeName(idx *index, pathType string) string {
+	if s.major >= 7 {
+		return "_doc"
+	}
+	if idx != nil && idx.docType != "" {
+		return idx.docType
+	}
+	if pathType != "" {
+		return pathType
+	}
+	if s.major == 6 {
+		return "_doc"
+	}
+	return "doc"
+}
+
+func (s *Server) renderMappings(req *request, idx *index) map[string]interface{} {
+	mapping := deepCopy(idx.mappings).(map[string]interface{})
+	typed := s.major < 7 || (s.major == 7 && req.flag("include_type_name"))
+	if !typed {
+		return mapping
+	}
+	if len(mapping) == 0 && idx.docType == "" {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{s.typeName(idx, ""): mapping}
+}
+
+func (s *Server) renderSettings(req *request, idx *index) map[string]interface{} {
+	if req.flag("flat_settings") {
+		out := map[string]interface{}{}
+		for k, v := range idx.settings {
+			out[k] = v
+		}
+		return out
+	}
+	return nestSettings(idx.settings)
+}
+
+func acknowledged() map[string]interface{} {
+	return map[string]interface{}{"acknowledged": true}
+}
+
+func (s *Server) handleIndex(req *request, target string) (int, interface{}, error) {
+	switch req.Method {
+	case http.MethodPut:
+		body, err := req.jsonBody()
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, err := s.createIndex(target, body); err != nil {
+			return 0, nil, err
+		}
+		return http.StatusOK, map[string]interface{}{"acknowledged": true, "shards_acknowledged": true, "index": target}, nil
+	case http.MethodHead:
+		indices, err := s.resolve(target, false)
+		if err != nil || len(indices) == 0 {
+			return http.StatusNotFound, nil, nil
+		}
+		return http.StatusOK, nil, nil
+	case http.MethodGet:
+		indices, err := s.resolve(target, req.flag("ignore_unavailable"))
+		if err != nil {
+			return 0, nil, err
+		}
+		out := map[string]interface{}{}
+		for _, idx := range indices {
+			aliases := map[string]interface{}{}
+			for k, v := range idx.aliases {
+				aliases[k] = v
+			}
+			out[idx.name] = map[string]interface{}{
+				"aliases":  aliases,
+				"mappings": s.renderMappings(req, idx),
+				"settings": s.renderSettings(req, idx),
+			}
+		}
+		return http.StatusOK, out, nil
+	case http.MethodDelete:
+		indices, err := s.resolve(target, req.flag("ignore_unavailable"))
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, idx := range indices {
+			delete(s.indices, idx.name)
+		}
+		return http.StatusOK, acknowledged(), nil
+	}
+	return 0, nil, noHandler(req.Request)
+}
+
+func (s *Server) handleMapping(req *request, target string, rest []string) (int, interface{}, error) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		indices, err := s.resolve(target, req.flag("ignore_unavailable"))
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(rest) > 0 && rest[0] == "field" {
+			return s.fieldMappings(indices, rest[1:])
+		}
+		out := map[string]interface{}{}
+		for _, idx := range indices {
+			out[idx.name] = map[string]interface{}{"mappings": s.renderMappings(req, idx)}
+		}
+		return http.StatusOK, out, nil
+	case http.MethodPut, http.MethodPost:
+		if target == "" {
+			return 0, nil, badRequest("index is missing")
+		}
+		indices, err := s.resolve(target, false)
+		if err != nil {
+			return 0, nil, err
+		}
+		body, err := req.jsonBody()
+		if err != nil {
+			return 0, nil, err
+		}
+		docType, mapping := untypeMapping(body)
+		if len(rest) > 0 {
+			docType = rest[0]
+		}
+		for _, idx := range indices {
+			if s.major == 6 && docType != "" && idx.docType != "" && idx.docType != docType {
+				return 0, nil, badRequest("Rejecting mapping update to [%v] as the final mapping would have more than 1 type: [%v, %v]", idx.name, idx.docType, docType)
+			}
+			if err := mergeMapping(idx.mappings, mapping); err != nil {
+				return 0, nil, err
+			}
+			if docType != "" && s.major < 7 {
+				idx.docType = docType
+			}
+		}
+		return http.StatusOK, acknowledged(), nil
+	}
+	return 0, nil, noHandler(req.Request)
+}
+
+func (s *Server) fieldMappings(indices []*index, rest []string) (int, interface{}, error) {
+	var patterns []string
+	if len(rest) > 0 {
+		patterns = strings.Split(rest[0], ",")
+	}
+	out := map[string]interface{}{}
+	for _, idx := range indices {
+		fields := map[string]interface{}{}
+		props, _ := asMap(idx.mappings["properties"])
+		walkFields(props, "", func(path string, def map[string]interface{}) {
+			for _, p := range patterns {
+				if globMatch(p, path) {
+					leaf := path[strings.LastIndex(path, ".")+1:]
+					fields[path] = map[string]interface{}{"full_name": path, "mapping": map[string]interface{}{leaf: def}}
+				}
+			}
+		})
+		out[idx.name] = map[string]interface{}{"mappings": fields}
+	}
+	return http.StatusOK, out, nil
+}
+
+func (s *Server) handleSettings(req *request, target string, rest []string) (int, interface{}, error) {
+	indices, err := s.resolve(target, req.flag("ignore_unavailable"))
+	if err != nil {
+		return 0, nil, err
+	}
+	switch req.Method {
+	case http.MethodGet:
+		out := map[string]interface{}{}
+		for _, idx := range indices {
+			settings := s.renderSettings(req, idx)
+			if len(rest) > 0 {
+				flat := map[string]string{}
+				for k, v := range idx.settings {
+					for _, p := range strings.Split(rest[0], ",") {
+						if globMatch(p, k) || globMatch("index."+p, k) {
+							flat[k] = v
+						}
+					}
+				}
+				settings = nestSettings(flat)
+			}
+			entry := map[string]interface{}{"settings": settings}
+			if req.flag("include_defaults") {
+				entry["defaults"] = map[string]interface{}{}
+			}
+			out[idx.name] = entry
+		}
+		return http.StatusOK, out, nil
+	case http.MethodPut:
+		body, err := req.jsonBody()
+		if err != nil {
+			return 0, nil, err
+		}
+		if inner, ok := asMap(body["settings"]); ok && len(body) == 1 {
+			body = inner
+		}
+		flat := map[string]string{}
+		flattenSettings(body, "", flat)
+		if _, ok := flat["index.number_of_shards"]; ok {
+			return 0, nil, badRequest("Can't update non dynamic settings [[index.number_of_shards]] for open indices")
+		}
+		for _, idx := range indices {
+			for k, v := range flat {
+				idx.settings[k] = v
+			}
+		}
+		return http.StatusOK, acknowledged(), nil
+	}
+	return 0, nil, noHandler(req.Request)
+}
+
+func (s *Server) handleAliases(req *request, target string, segs []string) (int, interface{}, error) {
+	var names []string
+	if len(segs) > 1 {
+		names = strings.Split(segs[1], ",")
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		indices, err := s.resolve(target, true)
+		if err != nil {
+			return 0, nil, err
+		}
+		out := map[string]interface{}{}
+		found := false
+		for _, idx := range indices {
+			aliases := map[string]interface{}{}
+			for alias, def := range idx.aliases {
+				match := len(names) == 0
+				for _, n := range names {
+					match = match || globMatch(n, alias)
+				}
+				if match {
+					aliases[alias] = def
+					found = true
+				}
+			}
+			if len(aliases) > 0 || len(names) == 0 {
+				out[idx.name] = map[string]interface{}{"aliases": aliases}
+			}
+		}
+		if len(names) > 0 && !found {
+			return http.StatusNotFound, map[string]interface{}{"error": fmt.Sprintf("alias [%v] missing", segs[1]), "status": 404}, nil
+		}
+		return http.StatusOK, out, nil
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		if segs[0] == "_aliases" && req.Method == http.MethodPost {
+			return s.aliasActions(req)
+		}
+		if target == "" || len(names) == 0 {
+			return 0, nil, noHandler(req.Request)
+		}
+		indices, err := s.resolve(target, false)
+		if err != nil {
+			return 0, nil, err
+		}
+		body, err := req.jsonBody()
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, idx := range indices {
+			for _, n := range names {
+				if req.Method == http.MethodDelete {
+					if _, ok := idx.aliases[n]; !ok {
+						return http.StatusNotFound, map[string]interface{}{"error": fmt.Sprintf("aliases [%v] missing", n), "status": 404}, nil
+					}
+					delete(idx.aliases, n)
+				} else {
+					idx.aliases[n] = body
+				}
+			}
+		}
+		return http.StatusOK, acknowledged(), nil
+	}
+	return 0, nil, noHandler(req.Request)
+}
+
+func (s *Server) aliasActions(req *request) (int, interface{}, error) {
+	body, err := req.jsonBody()
+	if err != nil {
+		return 0, nil, err
+	}
+	actions, _ := body["actions"].([]interface{})
+	for _, a := range actions {
+		kind, v, err := singleEntry(a, "actions")
+		if err != nil {
+			return 0, nil, err
+		}
+		def, _ := asMap(v)
+		targets := toStrings(def["indices"])
+		if name, ok := def["index"].(string); ok {
+			targets = append(targets, name)
+		}
+		aliases := toStrings(def["aliases"])
+		if name, ok := def["alias"].(string); ok {
+			aliases = append(aliases, name)
+		}
+		indices, err := s.resolve(strings.Join(targets, ","), false)
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, idx := range indices {
+			switch kind {
+			case "add":
+				for _, alias := range aliases {
+					entry := map[string]interface{}{}
+					for _, k := range []string{"filter", "is_write_index", "routing", "index_routing", "search_routing", "is_hidden"} {
+						if e, ok := def[k]; ok {
+							entry[k] = e
+						}
+					}
+					idx.aliases[alias] = entry
+				}
+			case "remove":
+				for _, alias := range aliases {
+					for name := range idx.aliases {
+						if globMatch(alias, name) {
+							delete(idx.aliases, name)
+						}
+					}
+				}
+			case "remove_index":
+				delete(s.indices, idx.name)
+			default:
+				return 0, nil, parsingError("[aliases] unknown field [%v]", kind)
+			}
+		}
+	}
+	return http.StatusOK, acknowledged(), nil
+}
+
+func (s *Server) handleTemplate(req *request, rest []string, store map[string]map[string]interface{}, composable bool) (int, interface{}, error) {
+	name := ""
+	if len(rest) > 0 {
+		name = rest[0]
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		var matched []string
+		for n := range store {
+			if name == "" {
+				matched = append(matched, n)
+				continue
+			}
+			for _, p := range strings.Split(name, ",") {
+				if globMatch(p, n) {
+					matched = append(matched, n)
+					break
+				}
+			}
+		}
+		sort.Strings(matched)
+		if name != "" && len(matched) == 0 {
+			if composable {
+				return 0, nil, &esError{status: http.StatusNotFound, typ: "resource_not_found_exception",
+					reason: fmt.Sprintf("index template matching [%v] not found", name)}
+			}
+			return http.StatusNotFound, map[string]interface{}{}, nil
+		}
+		if composable {
+			list := make([]interface{}, 0, len(matched))
+			for _, n := range matched {
+				list = append(list, map[string]interface{}{"name": n, "index_template": store[n]})
+			}
+			return http.StatusOK, map[string]interface{}{"index_templates": list}, nil
+		}
+		out := map[string]interface{}{}
+		for _, n := range matched {
+			out[n] = store[n]
+		}
+		return http.StatusOK, out, nil
+	case http.MethodPut, http.MethodPost:
+		if name == "" {
+			return 0, nil, noHandler(req.Request)
+		}
+		body, err := req.jsonBody()
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, ok := body["index_patterns"]; !ok {
+			if _, ok := body["template"].(string); !ok {
+				return 0, nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+					reason: "Validation Failed: 1: index patterns are missing;"}
+			}
+		}
+		if req.flag("create") {
+			if _, ok := store[name]; ok {
+				return 0, nil, badRequest("index_template [%v] already exists", name)
+			}
+		}
+		store[name] = body
+		return http.StatusOK, acknowledged(), nil
+	case http.MethodDelete:
+		if _, ok := store[name]; !ok {
+			return 0, nil, &esError{status: http.StatusNotFound, typ: "index_template_missing_exception",
+				reason: fmt.Sprintf("index_template [%v] missing", name)}
+		}
+		delete(store, name)
+		return http.StatusOK, acknowledged(), nil
+	}
+	return 0, nil, noHandler(req.Request)
+}
+
+func (s *Server) handleScripts(req *request, rest []string) (int, interface{}, error) {
+	if len(rest) == 0 {
+		return 0, nil, noHandler(req.Request)
+	}
+	id := rest[0]
+	switch req.Method {
+	case http.MethodGet:
+		script, ok := s.scripts[id]
+		if !ok {
+			return http.StatusNotFound, map[string]interface{}{"_id": id, "found": false}, nil
+		}
+		return http.StatusOK, map[string]interface{}{"_id": id, "found": true, "script": script}, nil
+	case http.MethodPut, http.MethodPost:
+		body, err := req.jsonBody()
+		if err != nil {
+			return 0, nil, err
+		}
+		s.scripts[id] = body["script"]
+		return http.StatusOK, acknowledged(), nil
+	case http.MethodDelete:
+		if _, ok := s.scripts[id]; !ok {
+			return 0, nil, &esError{status: http.StatusNotFound, typ: "resource_not_found_exception",
+				reason: fmt.Sprintf("stored script [%v] does not exist", id)}
+		}
+		delete(s.scripts, id)
+		return http.StatusOK, acknowledged(), nil
+	}
+	return 0, nil, noHandler(req.Request)
+}
+
+func shardsHeader(n int) map[string]interface{} {
+	return map[string]interface{}{"total": n, "successful": n, "skipped": 0, "failed": 0}
+}
+
+// handleRefresh answers refresh, flush, forcemerge, cache clearing and
+// open/close; writes are always visible, so there is nothing to do.
+func (s *Server) handleRefresh(req *request, target string) (int, interface{}, error) {
+	indices, err := s.resolve(target, req.flag("ignore_unavailable"))
+	if err != nil {
+		return 0, nil, err
+	}
+	segs := req.segments
+	if last := segs[len(segs)-1]; last == "_open" || last == "_close" {
+		return http.StatusOK, map[string]interface{}{"acknowledged": true, "shards_acknowledged": true}, nil
+	}
+	return http.StatusOK, map[string]interface{}{"_shards": shardsHeader(len(indices))}, nil
+}
+
+func (idx *index) stats() map[string]interface{} {
+	var size int
+	for _, doc := range idx.docs {
+		size += len(doc.source)
+	}
+	return map[string]interface{}{
+		"docs":          map[string]interface{}{"count": len(idx.docs), "deleted": 0},
+		"store":         map[string]interface{}{"size_in_bytes": size},
+		"indexing":      map[string]interface{}{"index_total": idx.indexTotal, "index_time_in_millis": 0, "delete_total": idx.deleteTotal},
+		"search":        map[string]interface{}{"query_total": idx.searchTotal, "query_time_in_millis": 0},
+		"refresh":       map[string]interface{}{"total": 0, "total_time_in_millis": 0},
+		"flush":         map[string]interface{}{"total": 0, "total_time_in_millis": 0},
+		"merges":        map[string]interface{}{"total": 0, "total_time_in_millis": 0},
+		"segments":      map[string]interface{}{"count": 1, "memory_in_bytes": 0},
+		"fielddata":     map[string]interface{}{"memory_size_in_bytes": 0, "evictions": 0},
+		"query_cache":   map[string]interface{}{"memory_size_in_bytes": 0, "hit_count": 0, "miss_count": 0},
+		"request_cache": map[string]interface{}{"memory_size_in_bytes": 0, "hit_count": 0, "miss_count": 0},
+	}
+}
+
+func (s *Server) handleStats(req *request, target string, rest []string) (int, interface{}, error) {
+	indices, err := s.resolve(target, req.flag("ignore_unavailable"))
+	if err != nil {
+		return 0, nil, err
+	}
+	perIndex := map[string]interface{}{}
+	var docs, size int
+	for _, idx := range indices {
+		st := idx.stats()
+		docs += len(idx.docs)
+		size += st["store"].(map[string]interface{})["size_in_bytes"].(int)
+		perIndex[idx.name] = map[string]interface{}{"uuid": idx.uuid, "primaries": st, "total": st}
+	}
+	all := map[string]interface{}{
+		"docs":  map[string]interface{}{"count": docs, "deleted": 0},
+		"store": map[string]interface{}{"size_in_bytes": size},
+	}
+	return http.StatusOK, map[string]interface{}{
+		"_shards": shardsHeader(len(indices)),
+		"_all":    map[string]interface{}{"primaries": all, "total": all},
+		"indices": perIndex,
+	}, nil
+}
+
+func (s *Server) handleFieldCaps(req *request, target string) (int, interface{}, error) {
+	indices, err := s.resolve(target, req.flag("ignore_unavailable"))
+	if err != nil {
+		return 0, nil, err
+	}
+	patterns := strings.Split(req.param("fields"), ",")
+	fields := map[string]interface{}{}
+	names := make([]string, 0, len(indices))
+	for _, idx := range indices {
+		names = append(names, idx.name)
+		props, _ := asMap(idx.mappings["properties"])
+		walkFields(props, "", func(path string, def map[string]interface{}) {
+			for _, p := range patterns {
+				if !globMatch(p, path) {
+					continue
+				}
+				t := mappingType(def)
+				fields[path] = map[string]interface{}{t: map[string]interface{}{
+					"type": t, "searchable": t != "object", "aggregatable": t != "text" && t != "object"}}
+			}
+		})
+	}
+	return http.StatusOK, map[string]interface{}{"indices": names, "fields": fields}, nil
+}
@@ -0,0 +1,168 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pointInTime is an open point in time: a frozen copy of the indices it
+// was opened on. Documents are replaced, never mutated, on write, so a
+// copy of each index's document map is enough.
+type pointInTime struct {
+	indices   []*index
+	keepAlive time.Duration
+	expires   time.Time
+}
+
+// supportsPointInTime reports whether the distribution has point in time
+// searches: Elasticsearch from 7.10, OpenSearch from 2.4.
+func (s *Server) supportsPointInTime() bool {
+	switch s.opts.Distribution {
+	case Elasticsearch:
+		return versionAtLeast(s.opts.Version, 7, 10)
+	case Opensearch:
+		return versionAtLeast(s.opts.Version, 2, 4)
+	}
+	return false
+}
+
+func versionAtLeast(version string, major, minor int) bool {
+	parts := strings.SplitN(version, ".", 3)
+	m, _ := strconv.Atoi(parts[0])
+	n := 0
+	if len(parts) > 1 {
+		n, _ = strconv.Atoi(parts[1])
+	}
+	return m > major || m == major && n >= minor
+}
+
+func (s *Server) expirePointsInTime() {
+	now := time.Now()
+	for id, pit := range s.pits {
+		if now.After(pit.expires) {
+			delete(s.pits, id)
+		}
+	}
+}
+
+// handleOpenPointInTime serves POST /{index}/_pit (Elasticsearch) and
+// POST /{index}/_search/point_in_time (OpenSearch).
+func (s *Server) handleOpenPointInTime(req *request, target string) (int, interface{}, error) {
+	if req.Method != http.MethodPost || !s.supportsPointInTime() {
+		return 0, nil, noHandler(req.Request)
+	}
+	keepAlive := req.param("keep_alive")
+	if keepAlive == "" {
+		return 0, nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+			reason: "Validation Failed: 1: [keep_alive] is not specified;"}
+	}
+	ttl, err := parseTimeValue(keepAlive)
+	if err != nil {
+		return 0, nil, err
+	}
+	indices, err := s.resolve(target, req.flag("ignore_unavailable"))
+	if err != nil {
+		return 0, nil, err
+	}
+	s.expirePointsInTime()
+	pit := &pointInTime{keepAlive: ttl, expires: time.Now().Add(ttl)}
+	for _, idx := range indices {
+		frozen := *idx
+		frozen.docs = make(map[string]*document, len(idx.docs))
+		for id, doc := range idx.docs {
+			frozen.docs[id] = doc
+		}
+		pit.indices = append(pit.indices, &frozen)
+	}
+	id := base64.URLEncoding.EncodeToString([]byte("elastictest-pit-" + strconv.FormatInt(s.nextSequence(), 10)))
+	s.pits[id] = pit
+	if s.opts.Distribution == Opensearch {
+		return http.StatusOK, map[string]interface{}{
+			"pit_id":        id,
+			"_shards":       shardsHeader(len(indices)),
+			"creation_time": time.Now().UnixMilli(),
+		}, nil
+	}
+	return http.StatusOK, map[string]interface{}{"id": id}, nil
+}
+
+// handleClosePointInTime serves DELETE /_pit with {"id": ...}
+// (Elasticsearch) and DELETE /_search/point_in_time[/_all] with
+// {"pit_id": [...]} (OpenSearch).
+func (s *Server) handleClosePointInTime(req *request, rest []string) (int, interface{}, error) {
+	if req.Method != http.MethodDelete || !s.supportsPointInTime() {
+		return 0, nil, noHandler(req.Request)
+	}
+	s.expirePointsInTime()
+	if s.opts.Distribution == Opensearch {
+		var ids []string
+		if len(rest) > 0 && rest[0] == "_all" {
+			for id := range s.pits {
+				ids = append(ids, id)
+			}
+		} else {
+			body, err := req.jsonBody()
+			if err != nil {
+				return 0, nil, err
+			}
+			ids = toStrings(body["pit_id"])
+		}
+		pits := make([]interface{}, 0, len(ids))
+		for _, id := range ids {
+			_, ok := s.pits[id]
+			delete(s.pits, id)
+			pits = append(pits, map[string]interface{}{"pit_id": id, "successful": ok})
+		}
+		return http.StatusOK, map[string]interface{}{"pits": pits}, nil
+	}
+
+	body, err := req.jsonBody()
+	if err != nil {
+		return 0, nil, err
+	}
+	id := toString(body["id"])
+	if id == "" {
+		return 0, nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+			reason: "Validation Failed: 1: point in time id is missing;"}
+	}
+	if _, ok := s.pits[id]; !ok {
+		return http.StatusNotFound, map[string]interface{}{"succeeded": true, "num_freed": 0}, nil
+	}
+	delete(s.pits, id)
+	return http.StatusOK, map[string]interface{}{"succeeded": true, "num_freed": 1}, nil
+}
+
+// pointInTimeIndices returns the frozen indices of the search's pit clause
+// and extends its keep alive.
+func (s *Server) pointInTimeIndices(req *request, target string, clause map[string]interface{}) (string, []*index, error) {
+	if target != "" {
+		return "", nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+			reason: "Validation Failed: 1: [indices] cannot be used with point in time. Do not specify any index with point in time.;"}
+	}
+	if req.param("scroll") != "" {
+		return "", nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+			reason: "Validation Failed: 1: using [point in time] is not allowed in a scroll context;"}
+	}
+	s.expirePointsInTime()
+	id := toString(clause["id"])
+	pit, ok := s.pits[id]
+	if !ok {
+		return "", nil, &esError{status: http.StatusNotFound, typ: "search_context_missing_exception",
+			reason: fmt.Sprintf("No search context found for id [%v]", id)}
+	}
+	if v := toString(clause["keep_alive"]); v != "" {
+		ttl, err := parseTimeValue(v)
+		if err != nil {
+			return "", nil, err
+		}
+		pit.keepAlive = ttl
+	}
+	pit.expires = time.Now().Add(pit.keepAlive)
+	return id, pit.indices, nil
+}
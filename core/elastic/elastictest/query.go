@@ -0,0 +1,823 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// candidate is a document (or a nested object of one) under evaluation.
+type candidate struct {
+	idx *index
+	doc *document
+	src map[string]interface{}
+}
+
+// values returns the values of a field as comparables of the field's kind;
+// text values stay raw strings for the analyzer.
+func (c candidate) values(field string) ([]interface{}, int) {
+	switch field {
+	case "_id":
+		if c.doc == nil {
+			return nil, kindKeyword
+		}
+		return []interface{}{c.doc.id}, kindKeyword
+	case "_index":
+		return []interface{}{c.idx.name}, kindKeyword
+	case "_routing":
+		if c.doc == nil || c.doc.routing == "" {
+			return nil, kindKeyword
+		}
+		return []interface{}{c.doc.routing}, kindKeyword
+	}
+	fieldType, path, _ := c.idx.lookupField(field)
+	kind := kindOf(fieldType)
+	raw := fieldValues(c.src, path)
+	if kind == kindObject {
+		return raw, kind
+	}
+	out := make([]interface{}, 0, len(raw))
+	for _, v := range raw {
+		if kind == kindText {
+			if s, ok := v.(string); ok {
+				out = append(out, s)
+			}
+			continue
+		}
+		if cv, ok := comparable(v, kind); ok {
+			out = append(out, cv)
+		}
+	}
+	return out, kind
+}
+
+// matcher reports whether a candidate matches and its score.
+type matcher func(c candidate) (bool, float64)
+
+// queryContext compiles query DSL into matchers. Errors found while
+// matching (an unparsable range bound, say) are recorded in err.
+type queryContext struct {
+	now time.Time
+	err error
+}
+
+func (q *queryContext) fail(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+func matchAll(candidate) (bool, float64) { return true, 1 }
+
+func withBoost(m matcher, boost float64) matcher {
+	if boost == 1 {
+		return m
+	}
+	return func(c candidate) (bool, float64) {
+		ok, score := m(c)
+		return ok, score * boost
+	}
+}
+
+func boostOf(v interface{}) float64 {
+	if m, ok := asMap(v); ok {
+		if f, ok := toFloat(m["boost"]); ok {
+			return f
+		}
+	}
+	return 1
+}
+
+// fieldClause splits {"field": value} or {"field": {"value": ...}} as
+// used by term, prefix, wildcard and friends.
+func fieldClause(kind string, body interface{}, valueKeys ...string) (string, interface{}, map[string]interface{}, error) {
+	m, ok := asMap(body)
+	if !ok {
+		return "", nil, nil, parsingError("[%v] query malformed, no start_object after query name", kind)
+	}
+	var field string
+	var spec interface{}
+	for k, v := range m {
+		if k == "boost" || k == "_name" {
+			continue
+		}
+		if field != "" {
+			return "", nil, nil, parsingError("[%v] query doesn't support multiple fields, found [%v] and [%v]", kind, field, k)
+		}
+		field, spec = k, v
+	}
+	if field == "" {
+		return "", nil, nil, parsingError("[%v] query requires a field", kind)
+	}
+	opts, isObject := asMap(spec)
+	if !isObject {
+		return field, spec, map[string]interface{}{}, nil
+	}
+	for _, key := range valueKeys {
+		if v, ok := opts[key]; ok {
+			return field, v, opts, nil
+		}
+	}
+	return "", nil, nil, parsingError("[%v] query does not support [%v]", kind, field)
+}
+
+func (q *queryContext) compile(query interface{}) (matcher, error) {
+	if query == nil {
+		return matchAll, nil
+	}
+	kind, body, err := singleEntry(query, "query")
+	if err != nil {
+		if m, ok := asMap(query); ok && len(m) == 0 {
+			return matchAll, nil
+		}
+		return nil, err
+	}
+	switch kind {
+	case "match_all":
+		return withBoost(matchAll, boostOf(body)), nil
+	case "match_none":
+		return func(candidate) (bool, float64) { return false, 0 }, nil
+	case "term":
+		return q.compileTerm(body)
+	case "terms":
+		return q.compileTerms(body)
+	case "range":
+		return q.compileRange(body)
+	case "exists":
+		m, _ := asMap(body)
+		field := toString(m["field"])
+		if field == "" {
+			return nil, parsingError("[exists] must be provided with a [field]")
+		}
+		return func(c candidate) (bool, float64) {
+			values, _ := c.values(field)
+			return len(values) > 0, 1
+		}, nil
+	case "ids":
+		m, _ := asMap(body)
+		ids := map[string]bool{}
+		for _, id := range toStrings(m["values"]) {
+			ids[id] = true
+		}
+		return withBoost(func(c candidate) (bool, float64) {
+			return c.doc != nil && ids[c.doc.id], 1
+		}, boostOf(body)), nil
+	case "prefix", "wildcard", "regexp":
+		return q.compilePattern(kind, body)
+	case "match", "match_phrase", "match_phrase_prefix", "match_bool_prefix":
+		return q.compileMatch(kind, body)
+	case "multi_match":
+		return q.compileMultiMatch(body)
+	case "query_string", "simple_query_string":
+		return q.compileQueryString(kind, body)
+	case "bool":
+		return q.compileBool(body)
+	case "nested":
+		return q.compileNested(body)
+	case "constant_score":
+		m, _ := asMap(body)
+		inner, err := q.compile(m["filter"])
+		if err != nil {
+			return nil, err
+		}
+		boost := boostOf(body)
+		return func(c candidate) (bool, float64) {
+			ok, _ := inner(c)
+			return ok, boost
+		}, nil
+	case "dis_max":
+		m, _ := asMap(body)
+		list, _ := m["queries"].([]interface{})
+		tie, _ := toFloat(m["tie_breaker"])
+		var queries []matcher
+		for _, e := range list {
+			inner, err := q.compile(e)
+			if err != nil {
+				return nil, err
+			}
+			queries = append(queries, inner)
+		}
+		return func(c candidate) (bool, float64) {
+			matched, best, sum := false, 0.0, 0.0
+			for _, inner := range queries {
+				if ok, score := inner(c); ok {
+					matched = true
+					sum += score
+					best = math.Max(best, score)
+				}
+			}
+			return matched, best + tie*(sum-best)
+		}, nil
+	case "boosting":
+		m, _ := asMap(body)
+		positive, err := q.compile(m["positive"])
+		if err != nil {
+			return nil, err
+		}
+		negative, err := q.compile(m["negative"])
+		if err != nil {
+			return nil, err
+		}
+		factor, _ := toFloat(m["negative_boost"])
+		return func(c candidate) (bool, float64) {
+			ok, score := positive(c)
+			if ok {
+				if neg, _ := negative(c); neg {
+					score *= factor
+				}
+			}
+			return ok, score
+		}, nil
+	case "function_score":
+		//functions only change scores; the fake keeps the query score
+		m, _ := asMap(body)
+		return q.compile(m["query"])
+	}
+	return nil, parsingError("unknown query [%v]", kind)
+}
+
+func (q *queryContext) compileTerm(body interface{}) (matcher, error) {
+	field, value, opts, err := fieldClause("term", body, "value")
+	if err != nil {
+		return nil, err
+	}
+	insensitive, _ := toBool(opts["case_insensitive"])
+	return withBoost(func(c candidate) (bool, float64) {
+		values, kind := c.values(field)
+		return termMatches(values, kind, value, insensitive), 1
+	}, boostOf(opts)), nil
+}
+
+func termMatches(values []interface{}, kind int, query interface{}, insensitive bool) bool {
+	if kind == kindText {
+		term := toString(query)
+		for _, v := range values {
+			for _, tok := range tokenize(v.(string)) {
+				if tok == term || (insensitive && strings.EqualFold(tok, term)) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	qv, ok := comparable(query, kind)
+	if !ok {
+		return false
+	}
+	for _, v := range values {
+		if compareValues(v, qv) == 0 {
+			return true
+		}
+		if insensitive {
+			if s, ok := v.(string); ok && strings.EqualFold(s, toString(qv)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (q *queryContext) compileTerms(body interface{}) (matcher, error) {
+	m, ok := asMap(body)
+	if !ok {
+		return nil, parsingError("[terms] query malformed")
+	}
+	var field string
+	var terms []interface{}
+	for k, v := range m {
+		if k == "boost" || k == "_name" {
+			continue
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, parsingError("[terms] query does not support [%v]", k)
+		}
+		field, terms = k, list
+	}
+	if field == "" {
+		return nil, parsingError("[terms] query requires a field")
+	}
+	return withBoost(func(c candidate) (bool, float64) {
+		values, kind := c.values(field)
+		for _, t := range terms {
+			if termMatches(values, kind, t, false) {
+				return true, 1
+			}
+		}
+		return false, 0
+	}, boostOf(m)), nil
+}
+
+type rangeBound struct {
+	value     interface{}
+	inclusive bool
+	roundUp   bool
+}
+
+func (q *queryContext) compileRange(body interface{}) (matcher, error) {
+	field, _, opts, err := fieldClause("range", body, "gt", "gte", "lt", "lte", "from", "to")
+	if err != nil {
+		return nil, err
+	}
+	var lower, upper *rangeBound
+	if v, ok := opts["from"]; ok && v != nil {
+		inc, set := toBool(opts["include_lower"])
+		lower = &rangeBound{value: v, inclusive: inc || !set}
+	}
+	if v, ok := opts["to"]; ok && v != nil {
+		inc, set := toBool(opts["include_upper"])
+		upper = &rangeBound{value: v, inclusive: inc || !set, roundUp: inc || !set}
+	}
+	if v, ok := opts["gt"]; ok && v != nil {
+		lower = &rangeBound{value: v, roundUp: true}
+	}
+	if v, ok := opts["gte"]; ok && v != nil {
+		lower = &rangeBound{value: v, inclusive: true}
+	}
+	if v, ok := opts["lt"]; ok && v != nil {
+		upper = &rangeBound{value: v}
+	}
+	if v, ok := opts["lte"]; ok && v != nil {
+		upper = &rangeBound{value: v, inclusive: true, roundUp: true}
+	}
+	loc, err := loadLocation(toString(opts["time_zone"]))
+	if err != nil {
+		return nil, err
+	}
+	format := toString(opts["format"])
+
+	convert := func(b *rangeBound, kind int) (interface{}, bool) {
+		if b == nil {
+			return nil, true
+		}
+		switch kind {
+		case kindDate:
+			v := b.value
+			if format == "epoch_second" {
+				if f, ok := toFloat(v); ok {
+					v = f * 1000
+				}
+			}
+			t, err := parseDateMath(v, q.now, loc, b.roundUp)
+			if err != nil {
+				q.fail(err)
+				return nil, false
+			}
+			return float64(t.UnixMilli()), true
+		case kindNumber:
+			f, ok := toFloat(b.value)
+			if !ok {
+				q.fail(&esError{status: 400, typ: "number_format_exception", reason: fmt.Sprintf("For input string: \"%v\"", b.value)})
+			}
+			return f, ok
+		case kindText, kindKeyword:
+			return toString(b.value), true
+		}
+		return comparable(b.value, kind)
+	}
+	type bounds struct {
+		lo, hi interface{}
+		ok     bool
+	}
+	cache := map[int]bounds{}
+	boundsFor := func(kind int) bounds {
+		if b, ok := cache[kind]; ok {
+			return b
+		}
+		lo, ok1 := convert(lower, kind)
+		hi, ok2 := convert(upper, kind)
+		b := bounds{lo: lo, hi: hi, ok: ok1 && ok2}
+		cache[kind] = b
+		return b
+	}
+
+	return withBoost(func(c candidate) (bool, float64) {
+		values, kind := c.values(field)
+		if len(values) == 0 {
+			return false, 0
+		}
+		b := boundsFor(kind)
+		if !b.ok {
+			return false, 0
+		}
+		for _, v := range values {
+			if b.lo != nil {
+				cmp := compareValues(v, b.lo)
+				if cmp < 0 || (cmp == 0 && !lower.inclusive) {
+					continue
+				}
+			}
+			if b.hi != nil {
+				cmp := compareValues(v, b.hi)
+				if cmp > 0 || (cmp == 0 && !upper.inclusive) {
+					continue
+				}
+			}
+			return true, 1
+		}
+		return false, 0
+	}, boostOf(opts)), nil
+}
+
+func (q *queryContext) compilePattern(kind string, body interface{}) (matcher, error) {
+	field, value, opts, err := fieldClause(kind, body, "value", "wildcard")
+	if err != nil {
+		return nil, err
+	}
+	pattern := toString(value)
+	insensitive, _ := toBool(opts["case_insensitive"])
+	var test func(s string) bool
+	switch kind {
+	case "prefix":
+		test = func(s string) bool {
+			if insensitive {
+				return strings.HasPrefix(strings.ToLower(s), strings.ToLower(pattern))
+			}
+			return strings.HasPrefix(s, pattern)
+		}
+	case "wildcard":
+		test = func(s string) bool {
+			if insensitive {
+				return globMatch(strings.ToLower(pattern), strings.ToLower(s))
+			}
+			return globMatch(pattern, s)
+		}
+	case "regexp":
+		expr := "^(?:" + pattern + ")$"
+		if insensitive {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, badRequest("failed to parse regexp [%v]: %v", pattern, err)
+		}
+		test = re.MatchString
+	}
+	return withBoost(func(c candidate) (bool, float64) {
+		values, fieldKind := c.values(field)
+		for _, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			if fieldKind == kindText {
+				for _, tok := range tokenize(s) {
+					if test(tok) {
+						return true, 1
+					}
+				}
+				continue
+			}
+			if test(s) {
+				return true, 1
+			}
+		}
+		return false, 0
+	}, boostOf(opts)), nil
+}
+
+// textMatch scores the analyzed query against one field: the number of
+// query terms found, zero when the operator requires all and some miss.
+func textMatch(c candidate, field, query, kind, operator string, minShould interface{}) float64 {
+	values, fieldKind := c.values(field)
+	if len(values) == 0 {
+		return 0
+	}
+	if fieldKind != kindText {
+		if kind == "match_phrase_prefix" || kind == "phrase_prefix" {
+			for _, v := range values {
+				if s, ok := v.(string); ok && strings.HasPrefix(s, query) {
+					return 1
+				}
+			}
+			return 0
+		}
+		if termMatches(values, fieldKind, query, false) {
+			return 1
+		}
+		return 0
+	}
+
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return 0
+	}
+	var best float64
+	for _, v := range values {
+		tokens := tokenize(v.(string))
+		switch kind {
+		case "match_phrase", "phrase", "match_phrase_prefix", "phrase_prefix":
+			prefix := kind == "match_phrase_prefix" || kind == "phrase_prefix"
+			if containsPhrase(tokens, terms, prefix) {
+				best = math.Max(best, float64(len(terms)))
+			}
+			continue
+		}
+		present := map[string]bool{}
+		for _, tok := range tokens {
+			present[tok] = true
+		}
+		matched := 0
+		for i, term := range terms {
+			if present[term] {
+				matched++
+				continue
+			}
+			if kind == "match_bool_prefix" && i == len(terms)-1 {
+				for _, tok := range tokens {
+					if strings.HasPrefix(tok, term) {
+						matched++
+						break
+					}
+				}
+			}
+		}
+		required := 1
+		if strings.EqualFold(operator, "and") {
+			required = len(terms)
+		} else if minShould != nil {
+			required = minimumShouldMatch(minShould, len(terms))
+		}
+		if matched >= required && matched > 0 {
+			best = math.Max(best, float64(matched))
+		}
+	}
+	return best
+}
+
+func containsPhrase(tokens, terms []string, prefix bool) bool {
+	for i := 0; i+len(terms) <= len(tokens); i++ {
+		ok := true
+		for j, term := range terms {
+			tok := tokens[i+j]
+			if prefix && j == len(terms)-1 {
+				ok = strings.HasPrefix(tok, term)
+			} else {
+				ok = tok == term
+			}
+			if !ok {
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// minimumShouldMatch resolves 2, -1, "75%" and "-25%" against the number
+// of optional clauses.
+func minimumShouldMatch(v interface{}, optional int) int {
+	s := toString(v)
+	n := 0
+	if strings.HasSuffix(s, "%") {
+		pct, _ := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		n = int(float64(optional) * pct / 100)
+		if pct < 0 {
+			n = optional + int(float64(optional)*pct/100)
+		}
+	} else {
+		n, _ = strconv.Atoi(s)
+		if n < 0 {
+			n = optional + n
+		}
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n > optional {
+		n = optional
+	}
+	return n
+}
+
+func (q *queryContext) compileMatch(kind string, body interface{}) (matcher, error) {
+	field, value, opts, err := fieldClause(kind, body, "query")
+	if err != nil {
+		return nil, err
+	}
+	query := toString(value)
+	operator := toString(opts["operator"])
+	minShould := opts["minimum_should_match"]
+	return withBoost(func(c candidate) (bool, float64) {
+		score := textMatch(c, field, query, kind, operator, minShould)
+		return score > 0, score
+	}, boostOf(opts)), nil
+}
+
+// fieldPattern is an entry of a fields list such as "title^2" or "name.*".
+type fieldPattern struct {
+	name  string
+	boost float64
+}
+
+func parseFieldPatterns(fields []string) []fieldPattern {
+	out := make([]fieldPattern, 0, len(fields))
+	for _, f := range fields {
+		name, boost := f, 1.0
+		if i := strings.LastIndex(f, "^"); i > 0 {
+			if b, err := strconv.ParseFloat(f[i+1:], 64); err == nil {
+				name, boost = f[:i], b
+			}
+		}
+		out = append(out, fieldPattern{name: name, boost: boost})
+	}
+	return out
+}
+
+// expandFields resolves wildcard patterns against the mapping of an index.
+func expandFields(idx *index, patterns []fieldPattern) []fieldPattern {
+	var out []fieldPattern
+	for _, p := range patterns {
+		if !strings.ContainsAny(p.name, "*?") {
+			out = append(out, p)
+			continue
+		}
+		props, _ := asMap(idx.mappings["properties"])
+		walkFields(props, "", func(path string, def map[string]interface{}) {
+			if kind := kindOf(mappingType(def)); kind != kindObject && globMatch(p.name, path) {
+				out = append(out, fieldPattern{name: path, boost: p.boost})
+			}
+		})
+	}
+	return out
+}
+
+func (q *queryContext) compileMultiMatch(body interface{}) (matcher, error) {
+	m, ok := asMap(body)
+	if !ok {
+		return nil, parsingError("[multi_match] query malformed")
+	}
+	query := toString(m["query"])
+	fields := toStrings(m["fields"])
+	if len(fields) == 0 {
+		fields = []string{"*"}
+	}
+	patterns := parseFieldPatterns(fields)
+	kind := toString(m["type"])
+	operator := toString(m["operator"])
+	minShould := m["minimum_should_match"]
+	return withBoost(func(c candidate) (bool, float64) {
+		var best, sum float64
+		for _, f := range expandFields(c.idx, patterns) {
+			score := textMatch(c, f.name, query, kind, operator, minShould) * f.boost
+			best = math.Max(best, score)
+			sum += score
+		}
+		if kind == "most_fields" || kind == "cross_fields" {
+			return sum > 0, sum
+		}
+		return best > 0, best
+	}, boostOf(m)), nil
+}
+
+func (q *queryContext) compileBool(body interface{}) (matcher, error) {
+	m, ok := asMap(body)
+	if !ok {
+		return nil, parsingError("[bool] query malformed")
+	}
+	compileList := func(key string) ([]matcher, error) {
+		v, ok := m[key]
+		if !ok || v == nil {
+			return nil, nil
+		}
+		list, isList := v.([]interface{})
+		if !isList {
+			list = []interface{}{v}
+		}
+		out := make([]matcher, 0, len(list))
+		for _, e := range list {
+			inner, err := q.compile(e)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, inner)
+		}
+		return out, nil
+	}
+	must, err := compileList("must")
+	if err != nil {
+		return nil, err
+	}
+	filter, err := compileList("filter")
+	if err != nil {
+		return nil, err
+	}
+	should, err := compileList("should")
+	if err != nil {
+		return nil, err
+	}
+	mustNot, err := compileList("must_not")
+	if err != nil {
+		return nil, err
+	}
+	for k := range m {
+		switch k {
+		case "must", "filter", "should", "must_not", "minimum_should_match", "boost", "_name", "adjust_pure_negative":
+		default:
+			return nil, parsingError("[bool] query does not support [%v]", k)
+		}
+	}
+	minShould := 0
+	if v, ok := m["minimum_should_match"]; ok {
+		minShould = minimumShouldMatch(v, len(should))
+	} else if len(must) == 0 && len(filter) == 0 && len(should) > 0 {
+		minShould = 1
+	}
+
+	return withBoost(func(c candidate) (bool, float64) {
+		score := 0.0
+		for _, inner := range must {
+			ok, s := inner(c)
+			if !ok {
+				return false, 0
+			}
+			score += s
+		}
+		for _, inner := range filter {
+			if ok, _ := inner(c); !ok {
+				return false, 0
+			}
+		}
+		for _, inner := range mustNot {
+			if ok, _ := inner(c); ok {
+				return false, 0
+			}
+		}
+		matched := 0
+		for _, inner := range should {
+			if ok, s := inner(c); ok {
+				matched++
+				score += s
+			}
+		}
+		if matched < minShould {
+			return false, 0
+		}
+		return true, score
+	}, boostOf(m)), nil
+}
+
+func (q *queryContext) compileNested(body interface{}) (matcher, error) {
+	m, ok := asMap(body)
+	if !ok {
+		return nil, parsingError("[nested] query malformed")
+	}
+	path := toString(m["path"])
+	if path == "" {
+		return nil, parsingError("[nested] requires 'path' field")
+	}
+	inner, err := q.compile(m["query"])
+	if err != nil {
+		return nil, err
+	}
+	scoreMode := toString(m["score_mode"])
+	if scoreMode == "" {
+		scoreMode = "avg"
+	}
+	ignoreUnmapped, _ := toBool(m["ignore_unmapped"])
+	return withBoost(func(c candidate) (bool, float64) {
+		fieldType, _, mapped := c.idx.lookupField(path)
+		if !mapped && !ignoreUnmapped {
+			q.fail(&esError{status: 400, typ: "query_shard_exception",
+				reason: fmt.Sprintf("failed to create query: [nested] failed to find nested object under path [%v]", path), index: c.idx.name})
+			return false, 0
+		}
+		if mapped && fieldType != "nested" && !ignoreUnmapped {
+			q.fail(&esError{status: 400, typ: "query_shard_exception",
+				reason: fmt.Sprintf("failed to create query: [nested] nested object under path [%v] is not of nested type", path), index: c.idx.name})
+			return false, 0
+		}
+		matched := 0
+		var total, best float64
+		lowest := math.MaxFloat64
+		for _, obj := range nestedObjects(c.src, path) {
+			if ok, s := inner(candidate{idx: c.idx, doc: c.doc, src: withPath(c.src, path, obj)}); ok {
+				matched++
+				total += s
+				best = math.Max(best, s)
+				lowest = math.Min(lowest, s)
+			}
+		}
+		if matched == 0 {
+			return false, 0
+		}
+		switch scoreMode {
+		case "max":
+			return true, best
+		case "min":
+			return true, lowest
+		case "sum":
+			return true, total
+		case "none":
+			return true, 0
+		}
+		return true, total / float64(matched)
+	}, boostOf(m)), nil
+}
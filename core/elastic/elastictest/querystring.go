@@ -0,0 +1,400 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"strings"
+	"unicode"
+)
+
+// compileQueryString handles query_string and simple_query_string with the
+// classic Lucene semantics: terms, "phrases", field:value, field:[a TO b],
+// field:>=x, wildcards, _exists_:field, (groups), AND/OR/NOT, && || ! and
+// +/- prefixes.
+func (q *queryContext) compileQueryString(kind string, body interface{}) (matcher, error) {
+	m, ok := asMap(body)
+	if !ok {
+		return nil, parsingError("[%v] query malformed", kind)
+	}
+	query := toString(m["query"])
+	fields := toStrings(m["fields"])
+	if df := toString(m["default_field"]); df != "" {
+		fields = []string{df}
+	}
+	if len(fields) == 0 {
+		fields = []string{"*"}
+	}
+	p := &qsParser{
+		q:          q,
+		tokens:     lexQueryString(query, kind == "simple_query_string"),
+		fields:     parseFieldPatterns(fields),
+		defaultAnd: strings.EqualFold(toString(m["default_operator"]), "and"),
+	}
+	inner, err := p.parseSequence()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, parsingError("Failed to parse query [%v]", query)
+	}
+	return withBoost(inner, boostOf(m)), nil
+}
+
+type qsToken struct {
+	text   string
+	quoted bool
+}
+
+func lexQueryString(s string, simple bool) []qsToken {
+	var tokens []qsToken
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, qsToken{text: string(r)})
+			i++
+		case r == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				if rs[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, qsToken{text: string(rs[i+1 : min(j, len(rs))]), quoted: true})
+			i = j + 1
+		case simple && r == '|':
+			tokens = append(tokens, qsToken{text: "OR"})
+			i++
+		case simple && r == '+' && (i+1 >= len(rs) || unicode.IsSpace(rs[i+1])):
+			tokens = append(tokens, qsToken{text: "AND"})
+			i++
+		default:
+			j := i
+			depth := 0
+			for j < len(rs) {
+				c := rs[j]
+				if c == '[' || c == '{' {
+					depth++
+				} else if (c == ']' || c == '}') && depth > 0 {
+					depth--
+				} else if depth == 0 && (unicode.IsSpace(c) || c == '(' || c == ')' || c == '"') {
+					break
+				}
+				if c == '\\' {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, qsToken{text: string(rs[i:min(j, len(rs))])})
+			i = j
+		}
+	}
+	return tokens
+}
+
+type qsParser struct {
+	q          *queryContext
+	tokens     []qsToken
+	pos        int
+	fields     []fieldPattern
+	defaultAnd bool
+}
+
+const (
+	occurShould = iota
+	occurMust
+	occurMustNot
+)
+
+type qsClause struct {
+	occur    int
+	explicit bool
+	m        matcher
+}
+
+// parseSequence parses clauses up to a closing parenthesis and combines
+// them like Lucene's classic query parser does.
+func (p *qsParser) parseSequence() (matcher, error) {
+	var clauses []*qsClause
+	pendingAnd, pendingOr, pendingNot := false, false, false
+	for p.pos < len(p.tokens) {
+		tok := p.tokens[p.pos]
+		if !tok.quoted {
+			switch tok.text {
+			case ")":
+				return p.combine(clauses), nil
+			case "AND", "&&":
+				pendingAnd = true
+				if n := len(clauses); n > 0 && !clauses[n-1].explicit {
+					clauses[n-1].occur = occurMust
+				}
+				p.pos++
+				continue
+			case "OR", "||":
+				pendingOr = true
+				if n := len(clauses); n > 0 && !clauses[n-1].explicit && p.defaultAnd {
+					clauses[n-1].occur = occurShould
+				}
+				p.pos++
+				continue
+			case "NOT", "!":
+				pendingNot = true
+				p.pos++
+				continue
+			}
+		}
+
+		c := &qsClause{occur: occurShould}
+		if p.defaultAnd {
+			c.occur = occurMust
+		}
+		if !tok.quoted && len(tok.text) > 1 && (tok.text[0] == '+' || tok.text[0] == '-') {
+			c.explicit = true
+			if tok.text[0] == '+' {
+				c.occur = occurMust
+			} else {
+				c.occur = occurMustNot
+			}
+			p.tokens[p.pos].text = tok.text[1:]
+		}
+		switch {
+		case pendingNot:
+			c.occur, c.explicit = occurMustNot, true
+		case pendingAnd && !c.explicit:
+			c.occur = occurMust
+		case pendingOr && !c.explicit:
+			c.occur = occurShould
+		}
+		pendingAnd, pendingOr, pendingNot = false, false, false
+
+		inner, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		c.m = inner
+		clauses = append(clauses, c)
+	}
+	return p.combine(clauses), nil
+}
+
+func (p *qsParser) combine(clauses []*qsClause) matcher {
+	var must, should, mustNot []matcher
+	for _, c := range clauses {
+		switch c.occur {
+		case occurMust:
+			must = append(must, c.m)
+		case occurMustNot:
+			mustNot = append(mustNot, c.m)
+		default:
+			should = append(should, c.m)
+		}
+	}
+	return func(c candidate) (bool, float64) {
+		score := 0.0
+		for _, m := range must {
+			ok, s := m(c)
+			if !ok {
+				return false, 0
+			}
+			score += s
+		}
+		for _, m := range mustNot {
+			if ok, _ := m(c); ok {
+				return false, 0
+			}
+		}
+		matched := false
+		for _, m := range should {
+			if ok, s := m(c); ok {
+				matched = true
+				score += s
+			}
+		}
+		if !matched && len(must) == 0 && len(should) > 0 {
+			return false, 0
+		}
+		if score == 0 {
+			score = 1
+		}
+		return true, score
+	}
+}
+
+func (p *qsParser) parsePrimary() (matcher, error) {
+	tok := p.tokens[p.pos]
+	p.pos++
+	if !tok.quoted && tok.text == "(" {
+		inner, err := p.parseSequence()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].text != ")" {
+			return nil, parsingError("Cannot parse query: missing closing parenthesis")
+		}
+		p.pos++
+		return inner, nil
+	}
+	if tok.quoted {
+		return p.valueMatcher(p.fields, tok.text, true), nil
+	}
+
+	field, value, hasField := splitFieldValue(tok.text)
+	fields := p.fields
+	if hasField {
+		fields = parseFieldPatterns([]string{field})
+		if value == "" && p.pos < len(p.tokens) {
+			next := p.tokens[p.pos]
+			switch {
+			case next.quoted:
+				p.pos++
+				return p.valueMatcher(fields, next.text, true), nil
+			case next.text == "(":
+				saved := p.fields
+				p.fields = fields
+				inner, err := p.parsePrimary()
+				p.fields = saved
+				return inner, err
+			}
+		}
+	}
+	if hasField && field == "_exists_" {
+		exists, err := p.q.compile(map[string]interface{}{"exists": map[string]interface{}{"field": value}})
+		return exists, err
+	}
+	if r := parseQsRange(value); r != nil {
+		return p.rangeMatcher(fields, r)
+	}
+	return p.valueMatcher(fields, unescapeQs(value), false), nil
+}
+
+// splitFieldValue splits field:value at the first unescaped colon.
+func splitFieldValue(s string) (string, string, bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == ':' && i > 0 {
+			return unescapeQs(s[:i]), s[i+1:], true
+		}
+	}
+	return "", s, false
+}
+
+func unescapeQs(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func parseQsRange(v string) map[string]interface{} {
+	for _, op := range []struct{ prefix, key string }{{">=", "gte"}, {"<=", "lte"}, {">", "gt"}, {"<", "lt"}} {
+		if strings.HasPrefix(v, op.prefix) {
+			return map[string]interface{}{op.key: unescapeQs(v[len(op.prefix):])}
+		}
+	}
+	if len(v) < 2 || (v[0] != '[' && v[0] != '{') || (v[len(v)-1] != ']' && v[len(v)-1] != '}') {
+		return nil
+	}
+	lo, hi, ok := strings.Cut(v[1:len(v)-1], " TO ")
+	if !ok {
+		return nil
+	}
+	out := map[string]interface{}{}
+	if lo = strings.TrimSpace(lo); lo != "*" {
+		if v[0] == '[' {
+			out["gte"] = lo
+		} else {
+			out["gt"] = lo
+		}
+	}
+	if hi = strings.TrimSpace(hi); hi != "*" {
+		if v[len(v)-1] == ']' {
+			out["lte"] = hi
+		} else {
+			out["lt"] = hi
+		}
+	}
+	return out
+}
+
+func (p *qsParser) rangeMatcher(fields []fieldPattern, bounds map[string]interface{}) (matcher, error) {
+	return p.perField(fields, func(field string) (matcher, error) {
+		return p.q.compile(map[string]interface{}{"range": map[string]interface{}{field: bounds}})
+	})
+}
+
+// perField builds a matcher for each explicit field and ORs them; wildcard
+// fields are expanded against the candidate's mapping.
+func (p *qsParser) perField(fields []fieldPattern, build func(field string) (matcher, error)) (matcher, error) {
+	cache := map[string]matcher{}
+	var firstErr error
+	get := func(field string) matcher {
+		if m, ok := cache[field]; ok {
+			return m
+		}
+		m, err := build(field)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			m = func(candidate) (bool, float64) { return false, 0 }
+		}
+		cache[field] = m
+		return m
+	}
+	for _, f := range fields {
+		if !strings.ContainsAny(f.name, "*?") {
+			get(f.name)
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return func(c candidate) (bool, float64) {
+		var best float64
+		matched := false
+		for _, f := range expandFields(c.idx, fields) {
+			if ok, s := get(f.name)(c); ok {
+				matched = true
+				if s*f.boost > best {
+					best = s * f.boost
+				}
+			}
+		}
+		return matched, best
+	}, nil
+}
+
+func (p *qsParser) valueMatcher(fields []fieldPattern, value string, phrase bool) matcher {
+	m, _ := p.perField(fields, func(field string) (matcher, error) {
+		if !phrase && strings.ContainsAny(value, "*?") {
+			if value == "*" {
+				return p.q.compile(map[string]interface{}{"exists": map[string]interface{}{"field": field}})
+			}
+			return p.q.compile(map[string]interface{}{"wildcard": map[string]interface{}{
+				field: map[string]interface{}{"value": value, "case_insensitive": true}}})
+		}
+		kind := "match"
+		if phrase {
+			kind = "match_phrase"
+		}
+		return func(c candidate) (bool, float64) {
+			score := textMatch(c, field, value, kind, "or", nil)
+			return score > 0, score
+		}, nil
+	})
+	return m
+}
@@ -0,0 +1,1044 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hit is a matching document with its score and sort keys.
+type hit struct {
+	idx        *index
+	doc        *document
+	score      float64
+	sortKeys   []interface{}
+	sortValues []interface{}
+}
+
+type sortSpec struct {
+	field        string
+	desc         bool
+	missingFirst bool
+	missing      interface{}
+	mode         string
+	unmappedType string
+}
+
+type sourceFilter struct {
+	disabled bool
+	includes []string
+	excludes []string
+}
+
+type sliceSpec struct {
+	id, max int
+	field   string
+}
+
+// searchRequest is a parsed _search body merged with its URL parameters.
+type searchRequest struct {
+	query            interface{}
+	postFilter       interface{}
+	from, size       int
+	sort             []sortSpec
+	source           sourceFilter
+	aggs             map[string]interface{}
+	searchAfter      []interface{}
+	trackTotalHits   int
+	collapse         string
+	slice            *sliceSpec
+	version          bool
+	seqNoPrimaryTerm bool
+	trackScores      bool
+	minScore         *float64
+	scroll           time.Duration
+	totalAsInt       bool
+}
+
+// search body keys that are accepted; those without an effect here are
+// accepted and ignored.
+var searchBodyKeys = map[string]bool{
+	"query": true, "from": true, "size": true, "sort": true, "_source": true, "aggs": true, "aggregations": true,
+	"search_after": true, "track_total_hits": true, "collapse": true, "post_filter": true, "slice": true,
+	"version": true, "seq_no_primary_term": true, "track_scores": true, "min_score": true, "highlight": true,
+	"timeout": true, "stored_fields": true, "docvalue_fields": true, "script_fields": true, "explain": true,
+	"profile": true, "indices_boost": true, "terminate_after": true, "fields": true, "runtime_mappings": true,
+	"suggest": true, "rescore": true, "ext": true, "stats": true, "pit": true,
+}
+
+func parseSortSpecs(v interface{}) ([]sortSpec, error) {
+	var list []interface{}
+	switch x := v.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		list = x
+	default:
+		list = []interface{}{x}
+	}
+	var out []sortSpec
+	for _, e := range list {
+		switch x := e.(type) {
+		case string:
+			for _, part := range strings.Split(x, ",") {
+				field, order, _ := strings.Cut(part, ":")
+				spec := sortSpec{field: field, desc: field == "_score"}
+				if order != "" {
+					spec.desc = order == "desc"
+				}
+				out = append(out, spec)
+			}
+		case map[string]interface{}:
+			for field, opts := range x {
+				spec := sortSpec{field: field, desc: field == "_score"}
+				switch o := opts.(type) {
+				case string:
+					spec.desc = o == "desc"
+				case map[string]interface{}:
+					if order := toString(o["order"]); order != "" {
+						spec.desc = order == "desc"
+					}
+					switch m := o["missing"].(type) {
+					case nil:
+					case string:
+						if m == "_first" {
+							spec.missingFirst = true
+						} else if m != "_last" {
+							spec.missing = m
+						}
+					default:
+						spec.missing = m
+					}
+					spec.mode = toString(o["mode"])
+					spec.unmappedType = toString(o["unmapped_type"])
+				}
+				out = append(out, spec)
+			}
+		default:
+			return nil, parsingError("[sort] malformed sort %v", e)
+		}
+	}
+	return out, nil
+}
+
+func parseSourceFilter(v interface{}) (sourceFilter, error) {
+	switch x := v.(type) {
+	case nil:
+		return sourceFilter{}, nil
+	case bool:
+		return sourceFilter{disabled: !x}, nil
+	case string:
+		if b, err := strconv.ParseBool(x); err == nil {
+			return sourceFilter{disabled: !b}, nil
+		}
+		return sourceFilter{includes: strings.Split(x, ",")}, nil
+	case []interface{}:
+		return sourceFilter{includes: toStrings(x)}, nil
+	case map[string]interface{}:
+		f := sourceFilter{includes: toStrings(x["includes"]), excludes: toStrings(x["excludes"])}
+		f.includes = append(f.includes, toStrings(x["include"])...)
+		f.excludes = append(f.excludes, toStrings(x["exclude"])...)
+		return f, nil
+	}
+	return sourceFilter{}, parsingError("[_source] malformed source filter")
+}
+
+func sourceFilterFromParams(req *request) (sourceFilter, error) {
+	f, err := parseSourceFilter(nilIfEmpty(req.param("_source")))
+	if err != nil {
+		return f, err
+	}
+	for _, p := range []string{"_source_includes", "_source_include"} {
+		if v := req.param(p); v != "" {
+			f.includes = append(f.includes, strings.Split(v, ",")...)
+		}
+	}
+	for _, p := range []string{"_source_excludes", "_source_exclude"} {
+		if v := req.param(p); v != "" {
+			f.excludes = append(f.excludes, strings.Split(v, ",")...)
+		}
+	}
+	return f, nil
+}
+
+func nilIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// apply returns the source to render: the stored bytes when unfiltered,
+// nil when disabled.
+func (f sourceFilter) apply(doc *document) interface{} {
+	if f.disabled {
+		return nil
+	}
+	if len(f.includes) == 0 && len(f.excludes) == 0 {
+		return json.RawMessage(doc.source)
+	}
+	out, _ := f.prune(doc.fields, "", len(f.includes) == 0)
+	if out == nil {
+		return map[string]interface{}{}
+	}
+	return out
+}
+
+func (f sourceFilter) excluded(path string) bool {
+	for _, p := range f.excludes {
+		if globMatch(p, path) || strings.HasPrefix(path, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f sourceFilter) included(path string) (full, partial bool) {
+	for _, p := range f.includes {
+		if globMatch(p, path) || strings.HasPrefix(path, p+".") {
+			return true, true
+		}
+		if strings.HasPrefix(p, path+".") || strings.Contains(p, "*") {
+			partial = true
+		}
+	}
+	return false, partial
+}
+
+func (f sourceFilter) prune(v interface{}, path string, included bool) (interface{}, bool) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, e := range x {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			if f.excluded(p) {
+				continue
+			}
+			full, partial := f.included(p)
+			if !included && !full && !partial {
+				continue
+			}
+			if r, ok := f.prune(e, p, included || full); ok {
+				out[k] = r
+			}
+		}
+		return out, len(out) > 0 || included
+	case []interface{}:
+		var out []interface{}
+		for _, e := range x {
+			if r, ok := f.prune(e, path, included); ok {
+				out = append(out, r)
+			}
+		}
+		return out, len(out) > 0 || included
+	}
+	return v, included
+}
+
+func (s *Server) parseSearch(req *request, body map[string]interface{}) (*searchRequest, error) {
+	for k := range body {
+		if !searchBodyKeys[k] {
+			return nil, parsingError("Unknown key for a START_OBJECT in [%v].", k)
+		}
+	}
+	sr := &searchRequest{query: body["query"], postFilter: body["post_filter"], size: 10}
+	if s.major >= 7 {
+		sr.trackTotalHits = 10000
+	} else {
+		sr.trackTotalHits = -1
+	}
+	var err error
+	if v, ok := body["from"]; ok {
+		sr.from = toInt(v, 0)
+	}
+	if v, ok := body["size"]; ok {
+		sr.size = toInt(v, 10)
+	}
+	if sr.from, err = req.intParam("from", sr.from); err != nil {
+		return nil, err
+	}
+	if sr.size, err = req.intParam("size", sr.size); err != nil {
+		return nil, err
+	}
+	if sr.from < 0 || sr.size < 0 {
+		return nil, badRequest("[from] and [size] parameters cannot be negative")
+	}
+	if q := req.param("q"); q != "" {
+		qs := map[string]interface{}{"query": q}
+		if df := req.param("df"); df != "" {
+			qs["default_field"] = df
+		}
+		if op := req.param("default_operator"); op != "" {
+			qs["default_operator"] = op
+		}
+		sr.query = map[string]interface{}{"query_string": qs}
+	}
+	if sr.sort, err = parseSortSpecs(body["sort"]); err != nil {
+		return nil, err
+	}
+	if v := req.param("sort"); v != "" {
+		sr.sort, _ = parseSortSpecs(v)
+	}
+	if sr.source, err = parseSourceFilter(body["_source"]); err != nil {
+		return nil, err
+	}
+	if params, err := sourceFilterFromParams(req); err != nil {
+		return nil, err
+	} else if params.disabled || len(params.includes) > 0 || len(params.excludes) > 0 || req.param("_source") != "" {
+		sr.source = params
+	}
+	sr.aggs, _ = asMap(body["aggs"])
+	if sr.aggs == nil {
+		sr.aggs, _ = asMap(body["aggregations"])
+	}
+	sr.searchAfter, _ = body["search_after"].([]interface{})
+	if sr.searchAfter != nil && len(sr.searchAfter) != len(sr.sort) {
+		return nil, badRequest("search_after has %d value(s) but sort has %d.", len(sr.searchAfter), len(sr.sort))
+	}
+	track := body["track_total_hits"]
+	if v := req.param("track_total_hits"); v != "" {
+		track = v
+	}
+	switch {
+	case track == nil:
+	case toString(track) == "true":
+		sr.trackTotalHits = math.MaxInt32
+	case toString(track) == "false":
+		sr.trackTotalHits = 0
+	default:
+		sr.trackTotalHits = toInt(track, sr.trackTotalHits)
+	}
+	sr.totalAsInt = s.major < 7 || req.flag("rest_total_hits_as_int")
+	if c, ok := asMap(body["collapse"]); ok {
+		sr.collapse = toString(c["field"])
+	}
+	if sl, ok := asMap(body["slice"]); ok {
+		sr.slice = &sliceSpec{id: toInt(sl["id"], 0), max: toInt(sl["max"], 1), field: toString(sl["field"])}
+		if sr.slice.max <= 1 || sr.slice.id >= sr.slice.max {
+			return nil, badRequest("max must be greater than 1 and id must be lower than max")
+		}
+	}
+	sr.version, _ = toBool(body["version"])
+	sr.version = sr.version || req.flag("version")
+	sr.seqNoPrimaryTerm, _ = toBool(body["seq_no_primary_term"])
+	sr.seqNoPrimaryTerm = sr.seqNoPrimaryTerm || req.flag("seq_no_primary_term")
+	sr.trackScores, _ = toBool(body["track_scores"])
+	if f, ok := toFloat(body["min_score"]); ok {
+		sr.minScore = &f
+	}
+	if v := req.param("scroll"); v != "" {
+		if sr.scroll, err = parseTimeValue(v); err != nil {
+			return nil, err
+		}
+		if sr.searchAfter != nil {
+			return nil, badRequest("`search_after` cannot be used in a scroll context.")
+		}
+	}
+	return sr, nil
+}
+
+// parseTimeValue parses 1m, 30s, 500ms style durations.
+func parseTimeValue(v string) (time.Duration, error) {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{{"ms", time.Millisecond}, {"s", time.Second}, {"m", time.Minute}, {"h", time.Hour}, {"d", 24 * time.Hour}}
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(v, u.suffix), 64)
+			if err == nil {
+				return time.Duration(n * float64(u.unit)), nil
+			}
+		}
+	}
+	return 0, badRequest("failed to parse setting [scroll] with value [%v] as a time value: unit is missing or unrecognized", v)
+}
+
+func sliceOf(id string, max int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return int(h.Sum32() % uint32(max))
+}
+
+// sortedDocs returns the documents of an index in write order.
+func (idx *index) sortedDocs() []*document {
+	docs := make([]*document, 0, len(idx.docs))
+	for _, doc := range idx.docs {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].order < docs[j].order })
+	return docs
+}
+
+// match returns the documents of the indices matching the query.
+func (s *Server) match(indices []*index, qc *queryContext, query interface{}) ([]*hit, error) {
+	m, err := qc.compile(query)
+	if err != nil {
+		return nil, err
+	}
+	var hits []*hit
+	for _, idx := range indices {
+		idx.searchTotal++
+		for _, doc := range idx.sortedDocs() {
+			if ok, score := m(candidate{idx: idx, doc: doc, src: doc.fields}); ok {
+				hits = append(hits, &hit{idx: idx, doc: doc, score: score})
+			}
+		}
+	}
+	if qc.err != nil {
+		return nil, qc.err
+	}
+	return hits, nil
+}
+
+func textFieldError(field string) *esError {
+	return badRequest("Text fields are not optimised for operations that require per-document field data like aggregations and sorting, so these operations are disabled by default. Please use a keyword field instead. Alternatively, set fielddata=true on [%v] in order to load field data by uninverting the inverted index. Note that this can use significant memory.", field)
+}
+
+// fieldData checks that a field can be sorted or aggregated on in the
+// searched indices.
+func fieldData(indices []*index, field string, unmappedType string) error {
+	if strings.HasPrefix(field, "_") {
+		return nil
+	}
+	mapped := false
+	for _, idx := range indices {
+		fieldType, _, ok := idx.lookupField(field)
+		if !ok {
+			continue
+		}
+		mapped = true
+		if kindOf(fieldType) == kindText && !idx.fieldDataEnabled(field) {
+			return textFieldError(field)
+		}
+	}
+	if !mapped && unmappedType == "" && len(indices) > 0 {
+		return &esError{status: http.StatusBadRequest, typ: "query_shard_exception",
+			reason: fmt.Sprintf("No mapping found for [%v] in order to sort on", field), index: indices[0].name}
+	}
+	return nil
+}
+
+func (idx *index) fieldDataEnabled(path string) bool {
+	props, _ := asMap(idx.mappings["properties"])
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		def, ok := asMap(props[part])
+		if !ok {
+			return false
+		}
+		if i == len(parts)-1 {
+			b, _ := toBool(def["fielddata"])
+			return b
+		}
+		props, _ = asMap(def["properties"])
+	}
+	return false
+}
+
+// computeSortKeys fills the comparable keys and the rendered sort values.
+func computeSortKeys(hits []*hit, specs []sortSpec) {
+	for _, h := range hits {
+		h.sortKeys = make([]interface{}, len(specs))
+		h.sortValues = make([]interface{}, len(specs))
+		for i, spec := range specs {
+			var key interface{}
+			var rendered interface{}
+			switch spec.field {
+			case "_score":
+				key, rendered = h.score, h.score
+			case "_doc", "_shard_doc":
+				key, rendered = float64(h.doc.order), h.doc.order
+			case "_id":
+				key, rendered = h.doc.id, h.doc.id
+			case "_index":
+				key, rendered = h.idx.name, h.idx.name
+			default:
+				c := candidate{idx: h.idx, doc: h.doc, src: h.doc.fields}
+				values, kind := c.values(spec.field)
+				if len(values) == 0 && spec.missing != nil {
+					if cv, ok := comparable(spec.missing, kind); ok {
+						values = []interface{}{cv}
+					}
+				}
+				key = pickSortValue(values, spec)
+				rendered = key
+				if f, ok := key.(float64); ok {
+					fieldType, _, _ := h.idx.lookupField(spec.field)
+					if kind == kindDate || isIntegerType(fieldType) {
+						rendered = int64(f)
+					}
+				}
+				if b, ok := key.(bool); ok {
+					key = 0.0
+					rendered = 0
+					if b {
+						key, rendered = 1.0, 1
+					}
+				}
+			}
+			h.sortKeys[i] = key
+			h.sortValues[i] = rendered
+		}
+	}
+}
+
+// pickSortValue reduces a multi-valued field with the sort mode; min for
+// ascending and max for descending sorts by default.
+func pickSortValue(values []interface{}, spec sortSpec) interface{} {
+	if len(values) == 0 {
+		return nil
+	}
+	mode := spec.mode
+	if mode == "" {
+		mode = "min"
+		if spec.desc {
+			mode = "max"
+		}
+	}
+	if mode == "sum" || mode == "avg" || mode == "median" {
+		var sum float64
+		var nums []float64
+		for _, v := range values {
+			f, _ := toFloat(v)
+			sum += f
+			nums = append(nums, f)
+		}
+		switch mode {
+		case "sum":
+			return sum
+		case "median":
+			sort.Float64s(nums)
+			return percentile(nums, 50)
+		}
+		return sum / float64(len(values))
+	}
+	best := values[0]
+	for _, v := range values[1:] {
+		cmp := compareValues(v, best)
+		if (mode == "min" && cmp < 0) || (mode == "max" && cmp > 0) {
+			best = v
+		}
+	}
+	return best
+}
+
+func compareSortKeys(a, b []interface{}, specs []sortSpec) int {
+	for i, spec := range specs {
+		x, y := a[i], b[i]
+		switch {
+		case x == nil && y == nil:
+			continue
+		case x == nil:
+			if spec.missingFirst {
+				return -1
+			}
+			return 1
+		case y == nil:
+			if spec.missingFirst {
+				return 1
+			}
+			return -1
+		}
+		cmp := compareValues(x, y)
+		if spec.desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+func (s *Server) sortHits(hits []*hit, specs []sortSpec) {
+	if len(specs) == 0 {
+		specs = []sortSpec{{field: "_score", desc: true}}
+	}
+	computeSortKeys(hits, specs)
+	sort.SliceStable(hits, func(i, j int) bool {
+		if cmp := compareSortKeys(hits[i].sortKeys, hits[j].sortKeys, specs); cmp != 0 {
+			return cmp < 0
+		}
+		if hits[i].idx.name != hits[j].idx.name {
+			return hits[i].idx.name < hits[j].idx.name
+		}
+		return hits[i].doc.order < hits[j].doc.order
+	})
+}
+
+// afterKeys converts search_after values to the representation of the
+// sort keys they are compared with.
+func afterKeys(after []interface{}, sample []interface{}) []interface{} {
+	out := make([]interface{}, len(after))
+	for i, v := range after {
+		if v == nil {
+			continue
+		}
+		var ref interface{}
+		if i < len(sample) {
+			ref = sample[i]
+		}
+		switch ref.(type) {
+		case float64:
+			if f, ok := toFloat(v); ok {
+				out[i] = f
+			} else if t, ok := parseDate(v, time.UTC); ok {
+				out[i] = float64(t.UnixMilli())
+			}
+		default:
+			out[i] = toString(v)
+		}
+	}
+	return out
+}
+
+func (s *Server) renderHit(h *hit, sr *searchRequest, scored bool) map[string]interface{} {
+	out := map[string]interface{}{"_index": h.idx.name, "_id": h.doc.id}
+	if s.major < 8 {
+		out["_type"] = s.typeName(h.idx, "")
+	}
+	if scored {
+		out["_score"] = h.score
+	} else {
+		out["_score"] = nil
+	}
+	if h.doc.routing != "" {
+		out["_routing"] = h.doc.routing
+	}
+	if sr.version {
+		out["_version"] = h.doc.version
+	}
+	if sr.seqNoPrimaryTerm {
+		out["_seq_no"] = h.doc.seqNo
+		out["_primary_term"] = h.doc.primaryTerm
+	}
+	if source := sr.source.apply(h.doc); source != nil {
+		out["_source"] = source
+	}
+	if len(sr.sort) > 0 {
+		out["sort"] = h.sortValues
+	}
+	if sr.collapse != "" {
+		values, _ := candidate{idx: h.idx, doc: h.doc, src: h.doc.fields}.values(sr.collapse)
+		out["fields"] = map[string]interface{}{sr.collapse: values}
+	}
+	return out
+}
+
+// scored reports whether hits carry scores: when sorting by relevance or
+// with track_scores.
+func (sr *searchRequest) scored() bool {
+	if len(sr.sort) == 0 || sr.trackScores {
+		return true
+	}
+	for _, spec := range sr.sort {
+		if spec.field == "_score" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) renderHits(hits []*hit, total int, sr *searchRequest) map[string]interface{} {
+	scored := sr.scored()
+	list := make([]interface{}, 0, len(hits))
+	var maxScore interface{}
+	for _, h := range hits {
+		list = append(list, s.renderHit(h, sr, scored))
+		if scored {
+			if m, ok := maxScore.(float64); !ok || h.score > m {
+				maxScore = h.score
+			}
+		}
+	}
+	out := map[string]interface{}{"max_score": maxScore, "hits": list}
+	switch {
+	case sr.totalAsInt:
+		out["total"] = total
+	case sr.trackTotalHits == 0:
+	case sr.trackTotalHits > 0 && total > sr.trackTotalHits:
+		out["total"] = map[string]interface{}{"value": sr.trackTotalHits, "relation": "gte"}
+	default:
+		out["total"] = map[string]interface{}{"value": total, "relation": "eq"}
+	}
+	return out
+}
+
+// scrollCursor keeps the remaining hits of a scroll.
+type scrollCursor struct {
+	sr        *searchRequest
+	hits      []*hit
+	pos       int
+	total     int
+	shards    int
+	keepAlive time.Duration
+	expires   time.Time
+}
+
+func (s *Server) executeSearch(req *request, target string, body map[string]interface{}) (map[string]interface{}, error) {
+	start := time.Now()
+	sr, err := s.parseSearch(req, body)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		indices []*index
+		pitID   string
+	)
+	if clause, ok := asMap(body["pit"]); ok {
+		pitID, indices, err = s.pointInTimeIndices(req, target, clause)
+	} else {
+		indices, err = s.resolve(target, req.flag("ignore_unavailable"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sr.scroll == 0 && sr.from+sr.size > 10000 {
+		if max := toInt(firstSetting(indices, "index.max_result_window"), 10000); sr.from+sr.size > max {
+			return nil, badRequest("Result window is too large, from + size must be less than or equal to: [%d] but was [%d]. See the scroll api for a more efficient way to request large data sets.", max, sr.from+sr.size)
+		}
+	}
+	for _, spec := range sr.sort {
+		if err := fieldData(indices, spec.field, spec.unmappedType); err != nil {
+			return nil, err
+		}
+	}
+	if sr.collapse != "" {
+		if err := fieldData(indices, sr.collapse, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	qc := &queryContext{now: time.Now()}
+	hits, err := s.match(indices, qc, sr.query)
+	if err != nil {
+		return nil, err
+	}
+	if sr.slice != nil {
+		var sliced []*hit
+		for _, h := range hits {
+			if sliceOf(h.doc.id, sr.slice.max) == sr.slice.id {
+				sliced = append(sliced, h)
+			}
+		}
+		hits = sliced
+	}
+	if sr.minScore != nil {
+		var kept []*hit
+		for _, h := range hits {
+			if h.score >= *sr.minScore {
+				kept = append(kept, h)
+			}
+		}
+		hits = kept
+	}
+
+	resp := map[string]interface{}{
+		"took":      time.Since(start).Milliseconds(),
+		"timed_out": false,
+		"_shards":   shardsHeader(len(indices)),
+	}
+	if pitID != "" {
+		resp["pit_id"] = pitID
+	}
+	if len(sr.aggs) > 0 {
+		aggs, err := s.aggregate(qc, indices, sr.aggs, hits)
+		if err != nil {
+			return nil, err
+		}
+		resp["aggregations"] = aggs
+	}
+	if sr.postFilter != nil {
+		filtered, err := s.match(indices, qc, map[string]interface{}{"bool": map[string]interface{}{
+			"filter": []interface{}{sr.postFilter}}})
+		if err != nil {
+			return nil, err
+		}
+		keep := map[*document]bool{}
+		for _, h := range filtered {
+			keep[h.doc] = true
+		}
+		var kept []*hit
+		for _, h := range hits {
+			if keep[h.doc] {
+				kept = append(kept, h)
+			}
+		}
+		hits = kept
+	}
+
+	s.sortHits(hits, sr.sort)
+	total := len(hits)
+	if sr.searchAfter != nil && len(hits) > 0 {
+		after := afterKeys(sr.searchAfter, hits[0].sortKeys)
+		var kept []*hit
+		for _, h := range hits {
+			if compareSortKeys(h.sortKeys, after, sr.sort) > 0 {
+				kept = append(kept, h)
+			}
+		}
+		hits = kept
+	}
+	if sr.collapse != "" {
+		seen := map[string]bool{}
+		var kept []*hit
+		for _, h := range hits {
+			values, _ := candidate{idx: h.idx, doc: h.doc, src: h.doc.fields}.values(sr.collapse)
+			key := ""
+			if len(values) > 0 {
+				key = toString(values[0])
+			}
+			if !seen[key] {
+				seen[key] = true
+				kept = append(kept, h)
+			}
+		}
+		hits = kept
+	}
+
+	if sr.scroll > 0 {
+		cursor := &scrollCursor{sr: sr, hits: hits, total: total, shards: len(indices), keepAlive: sr.scroll}
+		id := base64.URLEncoding.EncodeToString([]byte("elastictest-scroll-" + strconv.FormatInt(s.nextSequence(), 10)))
+		s.scrolls[id] = cursor
+		resp["_scroll_id"] = id
+		resp["hits"] = s.nextScrollPage(cursor)
+		return resp, nil
+	}
+
+	page := hits
+	if sr.from >= len(page) {
+		page = nil
+	} else {
+		page = page[sr.from:]
+	}
+	if len(page) > sr.size {
+		page = page[:sr.size]
+	}
+	resp["hits"] = s.renderHits(page, total, sr)
+	return resp, nil
+}
+
+func firstSetting(indices []*index, key string) interface{} {
+	for _, idx := range indices {
+		if v, ok := idx.settings[key]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *Server) nextScrollPage(cursor *scrollCursor) map[string]interface{} {
+	cursor.expires = time.Now().Add(cursor.keepAlive)
+	end := cursor.pos + cursor.sr.size
+	if end > len(cursor.hits) {
+		end = len(cursor.hits)
+	}
+	page := cursor.hits[cursor.pos:end]
+	cursor.pos = end
+	return s.renderHits(page, cursor.total, cursor.sr)
+}
+
+func (s *Server) handleSearch(req *request, target string) (int, interface{}, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return 0, nil, noHandler(req.Request)
+	}
+	body, err := req.jsonBody()
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := s.executeSearch(req, target, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, resp, nil
+}
+
+func (s *Server) handleCount(req *request, target string) (int, interface{}, error) {
+	body, err := req.jsonBody()
+	if err != nil {
+		return 0, nil, err
+	}
+	for k := range body {
+		if k != "query" {
+			return 0, nil, parsingError("request does not support [%v]", k)
+		}
+	}
+	indices, err := s.resolve(target, req.flag("ignore_unavailable"))
+	if err != nil {
+		return 0, nil, err
+	}
+	query := body["query"]
+	if q := req.param("q"); q != "" {
+		query = map[string]interface{}{"query_string": map[string]interface{}{"query": q, "default_field": req.param("df")}}
+	}
+	hits, err := s.match(indices, &queryContext{now: time.Now()}, query)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, map[string]interface{}{"count": len(hits), "_shards": shardsHeader(len(indices))}, nil
+}
+
+func (s *Server) handleMultiSearch(req *request, target string) (int, interface{}, error) {
+	start := time.Now()
+	lines := bytes.Split(req.body, []byte("\n"))
+	var responses []interface{}
+	for i := 0; i+1 < len(lines); i += 2 {
+		if len(bytes.TrimSpace(lines[i])) == 0 && len(bytes.TrimSpace(lines[i+1])) == 0 {
+			continue
+		}
+		header := map[string]interface{}{}
+		if len(bytes.TrimSpace(lines[i])) > 0 {
+			if err := decodeJSON(lines[i], &header); err != nil {
+				return 0, nil, badRequest("msearch header line [%d] is malformed", i+1)
+			}
+		}
+		body := map[string]interface{}{}
+		if len(bytes.TrimSpace(lines[i+1])) > 0 {
+			if err := decodeJSON(lines[i+1], &body); err != nil {
+				return 0, nil, badRequest("msearch body line [%d] is malformed", i+2)
+			}
+		}
+		name := strings.Join(toStrings(header["index"]), ",")
+		if name == "" {
+			name = target
+		}
+		sub := &request{Request: req.Request, segments: req.segments, query: req.query}
+		resp, err := s.executeSearch(sub, name, body)
+		if err != nil {
+			e, ok := err.(*esError)
+			if !ok {
+				e = &esError{status: http.StatusInternalServerError, typ: "exception", reason: err.Error()}
+			}
+			responses = append(responses, e.body())
+			continue
+		}
+		resp["status"] = http.StatusOK
+		responses = append(responses, resp)
+	}
+	return http.StatusOK, map[string]interface{}{"took": time.Since(start).Milliseconds(), "responses": responses}, nil
+}
+
+// scrollIDs reads scroll ids from the path, the query string, a JSON body
+// or a raw body (the pre-5.0 wire format).
+func scrollIDs(req *request, rest []string) ([]string, string, error) {
+	keepAlive := req.param("scroll")
+	var ids []string
+	if len(rest) > 0 {
+		ids = strings.Split(rest[0], ",")
+	}
+	if v := req.param("scroll_id"); v != "" {
+		ids = append(ids, strings.Split(v, ",")...)
+	}
+	trimmed := bytes.TrimSpace(req.body)
+	if len(trimmed) > 0 {
+		if trimmed[0] == '{' {
+			body, err := req.jsonBody()
+			if err != nil {
+				return nil, "", err
+			}
+			ids = append(ids, toStrings(body["scroll_id"])...)
+			if v := toString(body["scroll"]); v != "" {
+				keepAlive = v
+			}
+		} else {
+			ids = append(ids, strings.Split(string(trimmed), ",")...)
+		}
+	}
+	return ids, keepAlive, nil
+}
+
+func (s *Server) handleScroll(req *request, rest []string) (int, interface{}, error) {
+	ids, keepAlive, err := scrollIDs(req, rest)
+	if err != nil {
+		return 0, nil, err
+	}
+	now := time.Now()
+	for id, cursor := range s.scrolls {
+		if now.After(cursor.expires) {
+			delete(s.scrolls, id)
+		}
+	}
+
+	if req.Method == http.MethodDelete {
+		freed := 0
+		for _, id := range ids {
+			if id == "_all" {
+				freed += len(s.scrolls)
+				s.scrolls = map[string]*scrollCursor{}
+				continue
+			}
+			if _, ok := s.scrolls[id]; ok {
+				delete(s.scrolls, id)
+				freed++
+			}
+		}
+		status := http.StatusOK
+		if freed == 0 {
+			status = http.StatusNotFound
+		}
+		return status, map[string]interface{}{"succeeded": true, "num_freed": freed}, nil
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return 0, nil, noHandler(req.Request)
+	}
+	if len(ids) != 1 {
+		return 0, nil, &esError{status: http.StatusBadRequest, typ: "action_request_validation_exception",
+			reason: "Validation Failed: 1: scrollId is missing;"}
+	}
+	cursor, ok := s.scrolls[ids[0]]
+	if !ok {
+		return 0, nil, &esError{status: http.StatusNotFound, typ: "search_context_missing_exception",
+			reason: fmt.Sprintf("No search context found for id [%v]", ids[0])}
+	}
+	if keepAlive != "" {
+		if cursor.keepAlive, err = parseTimeValue(keepAlive); err != nil {
+			return 0, nil, err
+		}
+	}
+	return http.StatusOK, map[string]interface{}{
+		"_scroll_id": ids[0],
+		"took":       0,
+		"timed_out":  false,
+		"_shards":    shardsHeader(cursor.shards),
+		"hits":       s.nextScrollPage(cursor),
+	}, nil
+}
+
+// queryDocuments runs the query of a by-query request.
+func (s *Server) queryDocuments(req *request, target string) ([]*hit, error) {
+	body, err := req.jsonBody()
+	if err != nil {
+		return nil, err
+	}
+	indices, err := s.resolve(target, req.flag("ignore_unavailable"))
+	if err != nil {
+		return nil, err
+	}
+	query := body["query"]
+	if q := req.param("q"); q != "" {
+		query = map[string]interface{}{"query_string": map[string]interface{}{"query": q}}
+	}
+	hits, err := s.match(indices, &queryContext{now: time.Now()}, query)
+	if err != nil {
+		return nil, err
+	}
+	maxDocs := toInt(body["max_docs"], toInt(req.param("max_docs"), -1))
+	if maxDocs >= 0 && len(hits) > maxDocs {
+		hits = hits[:maxDocs]
+	}
+	return hits, nil
+}
@@ -0,0 +1,211 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seedOrders creates an orders index with explicit mappings and six
+// documents spread over two days.
+func seedOrders(t *testing.T, srv *Server) {
+	t.Helper()
+	status, _ := call(t, srv, http.MethodPut, "/orders", `{"mappings":{"properties":{
+		"customer": {"type": "keyword"},
+		"note":     {"type": "text"},
+		"total":    {"type": "double"},
+		"qty":      {"type": "integer"},
+		"at":       {"type": "date"},
+		"items":    {"type": "nested", "properties": {"sku": {"type": "keyword"}, "price": {"type": "double"}}}
+	}}}`)
+	require.Equal(t, http.StatusOK, status)
+	docs := []string{
+		`{"customer":"alice","note":"express delivery please","total":10,"qty":1,"at":"2024-03-01T08:00:00Z","items":[{"sku":"a","price":10}]}`,
+		`{"customer":"alice","note":"gift wrap","total":20,"qty":2,"at":"2024-03-01T12:00:00Z","items":[{"sku":"b","price":5},{"sku":"c","price":15}]}`,
+		`{"customer":"bob","note":"express","total":30,"qty":3,"at":"2024-03-01T18:00:00Z","items":[{"sku":"a","price":30}]}`,
+		`{"customer":"bob","note":"leave at the door","total":40,"qty":4,"at":"2024-03-02T08:00:00Z","items":[{"sku":"c","price":40}]}`,
+		`{"customer":"carol","note":"express delivery","total":50,"qty":5,"at":"2024-03-02T12:00:00Z","items":[{"sku":"b","price":50}]}`,
+		`{"customer":"carol","total":60,"qty":6,"at":"2024-03-02T18:00:00Z"}`,
+	}
+	var bulk strings.Builder
+	for i, doc := range docs {
+		fmt.Fprintf(&bulk, "{\"index\":{\"_id\":\"%d\"}}\n%s\n", i+1, doc)
+	}
+	status, resp := call(t, srv, http.MethodPost, "/orders/_bulk", bulk.String())
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, false, path(resp, "errors"))
+}
+
+func searchIDs(t *testing.T, srv *Server, body string) []string {
+	t.Helper()
+	status, resp := call(t, srv, http.MethodPost, "/orders/_search", body)
+	require.Equal(t, http.StatusOK, status, resp)
+	var ids []string
+	hits, _ := path(resp, "hits", "hits").([]interface{})
+	for _, h := range hits {
+		ids = append(ids, path(h, "_id").(string))
+	}
+	return ids
+}
+
+func sorted(ids []string) []string {
+	sort.Strings(ids)
+	return ids
+}
+
+func TestQueryDSL(t *testing.T) {
+	srv := newTestServer(t, Options{})
+	seedOrders(t, srv)
+
+	for _, tc := range []struct {
+		name  string
+		query string
+		ids   []string
+	}{
+		{"term", `{"term":{"customer":"bob"}}`, []string{"3", "4"}},
+		{"terms", `{"terms":{"customer":["alice","carol"]}}`, []string{"1", "2", "5", "6"}},
+		{"range", `{"range":{"total":{"gt":20,"lte":40}}}`, []string{"3", "4"}},
+		{"date range", `{"range":{"at":{"gte":"2024-03-02","lt":"2024-03-02||+1d"}}}`, []string{"4", "5", "6"}},
+		{"exists", `{"exists":{"field":"note"}}`, []string{"1", "2", "3", "4", "5"}},
+		{"ids", `{"ids":{"values":["2","5","9"]}}`, []string{"2", "5"}},
+		{"prefix", `{"prefix":{"customer":"ca"}}`, []string{"5", "6"}},
+		{"wildcard", `{"wildcard":{"customer":"*o*"}}`, []string{"3", "4", "5", "6"}},
+		{"match", `{"match":{"note":"express door"}}`, []string{"1", "3", "4", "5"}},
+		{"match and", `{"match":{"note":{"query":"express delivery","operator":"and"}}}`, []string{"1", "5"}},
+		{"match phrase", `{"match_phrase":{"note":"at the door"}}`, []string{"4"}},
+		{"query string", `{"query_string":{"query":"customer:alice AND total:>=20"}}`, []string{"2"}},
+		{"simple query string", `{"simple_query_string":{"query":"gift | door","fields":["note"]}}`, []string{"2", "4"}},
+		{"bool", `{"bool":{"must":[{"match":{"note":"express"}}],"filter":[{"range":{"qty":{"gte":3}}}],"must_not":[{"term":{"customer":"carol"}}]}}`, []string{"3"}},
+		{"should minimum", `{"bool":{"should":[{"term":{"customer":"alice"}},{"range":{"total":{"gte":50}}}],"minimum_should_match":1}}`, []string{"1", "2", "5", "6"}},
+		{"nested", `{"nested":{"path":"items","query":{"bool":{"must":[{"term":{"items.sku":"c"}},{"range":{"items.price":{"gte":20}}}]}}}}`, []string{"4"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ids := searchIDs(t, srv, `{"query":`+tc.query+`}`)
+			assert.Equal(t, tc.ids, sorted(ids))
+		})
+	}
+
+	status, resp := call(t, srv, http.MethodPost, "/orders/_search", `{"query":{"bogus":{}}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "parsing_exception", path(resp, "error", "type"))
+
+	status, resp = call(t, srv, http.MethodPost, "/orders/_search", `{"sort":[{"note":"asc"}]}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, path(resp, "error", "reason"), "Text fields are not optimised")
+}
+
+func TestSearchOptions(t *testing.T) {
+	srv := newTestServer(t, Options{})
+	seedOrders(t, srv)
+
+	assert.Equal(t, []string{"6", "5"}, searchIDs(t, srv, `{"sort":[{"total":"desc"}],"size":2}`))
+	assert.Equal(t, []string{"4", "3"}, searchIDs(t, srv, `{"sort":[{"total":"desc"}],"size":2,"search_after":[50]}`))
+	assert.Equal(t, []string{"3"}, searchIDs(t, srv, `{"sort":[{"customer":"asc"},{"total":"asc"}],"from":2,"size":1}`))
+
+	_, resp := call(t, srv, http.MethodPost, "/orders/_search", `{"query":{"ids":{"values":["1"]}},"_source":["customer"]}`)
+	assert.Equal(t, map[string]interface{}{"customer": "alice"}, path(resp, "hits", "hits", 0, "_source"))
+	assert.EqualValues(t, 1, path(resp, "hits", "total", "value"))
+
+	_, resp = call(t, srv, http.MethodGet, "/orders/_search?q=customer:bob&rest_total_hits_as_int=true", "")
+	assert.EqualValues(t, 2, path(resp, "hits", "total"))
+
+	_, resp = call(t, srv, http.MethodPost, "/orders/_count", `{"query":{"match":{"note":"express"}}}`)
+	assert.EqualValues(t, 3, path(resp, "count"))
+
+	_, resp = call(t, srv, http.MethodPost, "/orders/_search", `{"collapse":{"field":"customer"},"sort":[{"total":"asc"}]}`)
+	assert.Len(t, path(resp, "hits", "hits"), 3)
+}
+
+func TestScroll(t *testing.T) {
+	srv := newTestServer(t, Options{})
+	seedOrders(t, srv)
+
+	_, resp := call(t, srv, http.MethodPost, "/orders/_search?scroll=1m", `{"size":4,"sort":["_doc"]}`)
+	scrollID, _ := path(resp, "_scroll_id").(string)
+	require.NotEmpty(t, scrollID)
+	assert.Len(t, path(resp, "hits", "hits"), 4)
+
+	_, resp = call(t, srv, http.MethodPost, "/_search/scroll", `{"scroll":"1m","scroll_id":"`+scrollID+`"}`)
+	assert.Len(t, path(resp, "hits", "hits"), 2)
+	_, resp = call(t, srv, http.MethodPost, "/_search/scroll", `{"scroll":"1m","scroll_id":"`+scrollID+`"}`)
+	assert.Len(t, path(resp, "hits", "hits"), 0)
+
+	status, resp := call(t, srv, http.MethodDelete, "/_search/scroll", `{"scroll_id":["`+scrollID+`"]}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.EqualValues(t, 1, path(resp, "num_freed"))
+
+	status, resp = call(t, srv, http.MethodPost, "/_search/scroll", `{"scroll_id":"`+scrollID+`"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, "search_context_missing_exception", path(resp, "error", "root_cause", 0, "type"))
+}
+
+func TestPointInTime(t *testing.T) {
+	srv := newTestServer(t, Options{Version: "8.15.0"})
+	seedOrders(t, srv)
+
+	status, resp := call(t, srv, http.MethodPost, "/orders/_pit?keep_alive=1m", "")
+	require.Equal(t, http.StatusOK, status, resp)
+	pitID, _ := path(resp, "id").(string)
+	require.NotEmpty(t, pitID)
+
+	//writes after opening are not visible through the point in time
+	status, _ = call(t, srv, http.MethodDelete, "/orders/_doc/1", "")
+	require.Equal(t, http.StatusOK, status)
+
+	page := `{"size":4,"sort":[{"_shard_doc":"asc"}],"pit":{"id":"` + pitID + `","keep_alive":"1m"}`
+	_, resp = call(t, srv, http.MethodPost, "/_search", page+`}`)
+	assert.Equal(t, pitID, path(resp, "pit_id"))
+	hits, _ := path(resp, "hits", "hits").([]interface{})
+	require.Len(t, hits, 4)
+	assert.Equal(t, "1", path(hits, 0, "_id"))
+	after, err := json.Marshal(path(hits, 3, "sort"))
+	require.NoError(t, err)
+	_, resp = call(t, srv, http.MethodPost, "/_search", page+`,"search_after":`+string(after)+`}`)
+	assert.Len(t, path(resp, "hits", "hits"), 2)
+
+	status, resp = call(t, srv, http.MethodPost, "/orders/_search", page+`}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, path(resp, "error", "reason"), "cannot be used with point in time")
+
+	status, resp = call(t, srv, http.MethodDelete, "/_pit", `{"id":"`+pitID+`"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.EqualValues(t, 1, path(resp, "num_freed"))
+	status, _ = call(t, srv, http.MethodPost, "/_search", page+`}`)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	forked := newTestServer(t, Options{Distribution: Opensearch, Version: "2.17.0"})
+	seedOrders(t, forked)
+	status, resp = call(t, forked, http.MethodPost, "/orders/_search/point_in_time?keep_alive=1m", "")
+	require.Equal(t, http.StatusOK, status, resp)
+	pitID, _ = path(resp, "pit_id").(string)
+	require.NotEmpty(t, pitID)
+	_, resp = call(t, forked, http.MethodDelete, "/_search/point_in_time", `{"pit_id":["`+pitID+`"]}`)
+	assert.Equal(t, true, path(resp, "pits", 0, "successful"))
+
+	old := newTestServer(t, Options{Version: "7.9.3"})
+	seedOrders(t, old)
+	status, _ = call(t, old, http.MethodPost, "/orders/_pit?keep_alive=1m", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestByQuery(t *testing.T) {
+	srv := newTestServer(t, Options{})
+	seedOrders(t, srv)
+
+	_, resp := call(t, srv, http.MethodPost, "/orders/_update_by_query", `{"query":{"term":{"customer":"bob"}},"script":{"source":"ctx._source.qty += params.n","params":{"n":10}}}`)
+	assert.EqualValues(t, 2, path(resp, "updated"))
+	_, resp = call(t, srv, http.MethodGet, "/orders/_doc/3", "")
+	assert.EqualValues(t, 13, path(resp, "_source", "qty"))
+
+	_, resp = call(t, srv, http.MethodPost, "/orders/_delete_by_query", `{"query":{"range":{"total":{"lt":30}}}}`)
+	assert.EqualValues(t, 2, path(resp, "deleted"))
+	assert.Equal(t, 4, srv.DocCount("orders"))
+}
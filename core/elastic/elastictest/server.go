@@ -0,0 +1,661 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+// Package elastictest provides an in-process fake Elasticsearch server for
+// tests. It answers the REST surface the adapters in modules/elastic/adapter,
+// the BulkProcessor and the elastic ORM rely on — the version banner, index
+// and mapping management, document CRUD, _bulk, _search/_count with a useful
+// subset of the query DSL and aggregations, scroll, point in time, _cat,
+// _cluster and _nodes — from memory, so that code can be exercised offline
+// in CI:
+//
+//	srv := elastictest.NewServer(elastictest.Options{Version: "7.17.0"})
+//	defer srv.Close()
+//	cfg := &elastic.ElasticsearchConfig{Endpoint: srv.URL, ...}
+//
+// The response shapes follow the configured distribution and version:
+// hits.total is a number before 7.0 and an object afterwards, _type is
+// reported up to 7.x, _seq_no/_primary_term from 6.0 on. OpenSearch and
+// Easysearch answer like Elasticsearch 7.10. Writes are visible to searches
+// immediately (every request behaves as if refresh=true).
+//
+// The package deliberately does not import core/elastic so that package's
+// own tests can use it.
+package elastictest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Distributions reported in the version banner.
+const (
+	Elasticsearch = "elasticsearch"
+	Opensearch    = "opensearch"
+	Easysearch    = "easysearch"
+)
+
+// Options configure the fake cluster.
+type Options struct {
+	// Distribution is one of Elasticsearch (default), Opensearch or Easysearch.
+	Distribution string
+	// Version is the version.number of the banner. It defaults to the latest
+	// release line of the distribution.
+	Version     string
+	ClusterName string
+	NodeName    string
+	// Replicas is the default number_of_replicas of new indices. With
+	// replicas the single-node cluster reports yellow, like a real one.
+	Replicas int
+}
+
+// Server is an in-memory Elasticsearch-compatible HTTP server. The embedded
+// httptest.Server provides URL, Close and Client.
+type Server struct {
+	*httptest.Server
+
+	opts        Options
+	major       int
+	minor       int
+	clusterUUID string
+	nodeID      string
+	started     time.Time
+
+	lock            sync.Mutex
+	indices         map[string]*index
+	templates       map[string]map[string]interface{}
+	indexTemplates  map[string]map[string]interface{}
+	scripts         map[string]interface{}
+	clusterSettings map[string]interface{}
+	scrolls         map[string]*scrollCursor
+	pits            map[string]*pointInTime
+	sequence        int64
+
+	rejectBulkRequests int
+	rejectBulkItems    int
+	writeCompleted     int64
+	writeRejected      int64
+	requests           map[string]int
+}
+
+// NewServer starts a fake cluster listening on a random local port.
+func NewServer(opts Options) *Server {
+	s := newServer(opts)
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+func newServer(opts Options) *Server {
+	if opts.Distribution == "" {
+		opts.Distribution = Elasticsearch
+	}
+	if opts.Version == "" {
+		switch opts.Distribution {
+		case Opensearch:
+			opts.Version = "2.17.0"
+		case Easysearch:
+			opts.Version = "1.12.0"
+		default:
+			opts.Version = "8.15.0"
+		}
+	}
+	if opts.ClusterName == "" {
+		opts.ClusterName = "elastictest"
+	}
+	if opts.NodeName == "" {
+		opts.NodeName = "node-1"
+	}
+	s := &Server{
+		opts:            opts,
+		clusterUUID:     "elastictest-cluster-uuid",
+		nodeID:          "elastictest-node-id",
+		started:         time.Now(),
+		indices:         map[string]*index{},
+		templates:       map[string]map[string]interface{}{},
+		indexTemplates:  map[string]map[string]interface{}{},
+		scripts:         map[string]interface{}{},
+		clusterSettings: map[string]interface{}{"persistent": map[string]interface{}{}, "transient": map[string]interface{}{}},
+		scrolls:         map[string]*scrollCursor{},
+		pits:            map[string]*pointInTime{},
+		requests:        map[string]int{},
+	}
+	parts := strings.SplitN(opts.Version, ".", 3)
+	s.major, _ = strconv.Atoi(parts[0])
+	if len(parts) > 1 {
+		s.minor, _ = strconv.Atoi(parts[1])
+	}
+	if opts.Distribution != Elasticsearch {
+		//both forks are wire compatible with Elasticsearch 7.10
+		s.major, s.minor = 7, 10
+	}
+	return s
+}
+
+// Host returns the host:port the server listens on.
+func (s *Server) Host() string {
+	u, _ := url.Parse(s.URL)
+	return u.Host
+}
+
+// Distribution returns the distribution reported in the banner.
+func (s *Server) Distribution() string {
+	return s.opts.Distribution
+}
+
+// Version returns the version.number reported in the banner.
+func (s *Server) Version() string {
+	return s.opts.Version
+}
+
+// RejectBulkRequests makes the next n _bulk requests fail as a whole with
+// 429 es_rejected_execution_exception.
+func (s *Server) RejectBulkRequests(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejectBulkRequests = n
+}
+
+// RejectBulkItems makes the next n _bulk items fail with a per-item 429
+// es_rejected_execution_exception while the rest of the request succeeds.
+func (s *Server) RejectBulkItems(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejectBulkItems = n
+}
+
+// RequestCount returns how many requests hit the endpoint, keyed like
+// "POST /_bulk" with index names replaced by {index}.
+func (s *Server) RequestCount(endpoint string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[endpoint]
+}
+
+// DocCount returns the number of documents stored in the index, -1 if the
+// index does not exist.
+func (s *Server) DocCount(indexName string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	idx, ok := s.indices[indexName]
+	if !ok {
+		return -1
+	}
+	return len(idx.docs)
+}
+
+// Reset drops every index, template, scroll, point in time and injected
+// fault.
+func (s *Server) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.indices = map[string]*index{}
+	s.templates = map[string]map[string]interface{}{}
+	s.indexTemplates = map[string]map[string]interface{}{}
+	s.scripts = map[string]interface{}{}
+	s.scrolls = map[string]*scrollCursor{}
+	s.pits = map[string]*pointInTime{}
+	s.rejectBulkRequests, s.rejectBulkItems = 0, 0
+	s.requests = map[string]int{}
+}
+
+// esError is an Elasticsearch error response.
+type esError struct {
+	status int
+	typ    string
+	reason string
+	index  string
+}
+
+func (e *esError) Error() string {
+	return fmt.Sprintf("%v: %v", e.typ, e.reason)
+}
+
+func (e *esError) body() map[string]interface{} {
+	cause := map[string]interface{}{"type": e.typ, "reason": e.reason}
+	if e.index != "" {
+		cause["index"] = e.index
+		cause["index_uuid"] = "_na_"
+	}
+	err := map[string]interface{}{"root_cause": []interface{}{cause}}
+	for k, v := range cause {
+		err[k] = v
+	}
+	return map[string]interface{}{"error": err, "status": e.status}
+}
+
+func badRequest(format string, args ...interface{}) *esError {
+	return &esError{status: http.StatusBadRequest, typ: "illegal_argument_exception", reason: fmt.Sprintf(format, args...)}
+}
+
+func parsingError(format string, args ...interface{}) *esError {
+	return &esError{status: http.StatusBadRequest, typ: "parsing_exception", reason: fmt.Sprintf(format, args...)}
+}
+
+func indexNotFound(name string) *esError {
+	return &esError{status: http.StatusNotFound, typ: "index_not_found_exception", reason: "no such index [" + name + "]", index: name}
+}
+
+func noHandler(r *http.Request) *esError {
+	return &esError{status: http.StatusBadRequest, typ: "illegal_argument_exception",
+		reason: fmt.Sprintf("no handler found for uri [%v] and method [%v]", r.URL.Path, r.Method)}
+}
+
+// request is the decoded HTTP request handed to the endpoint handlers.
+type request struct {
+	*http.Request
+	segments []string
+	query    url.Values
+	body     []byte
+}
+
+func (r *request) param(name string) string {
+	return r.query.Get(name)
+}
+
+func (r *request) flag(name string) bool {
+	if _, ok := r.query[name]; !ok {
+		return false
+	}
+	v := r.query.Get(name)
+	return v == "" || v == "true"
+}
+
+func (r *request) intParam(name string, def int) (int, error) {
+	v := r.query.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, badRequest("Failed to parse int parameter [%v] with value [%v]", name, v)
+	}
+	return i, nil
+}
+
+// jsonBody decodes the request body into a map; an empty body yields an
+// empty map.
+func (r *request) jsonBody() (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	if len(bytes.TrimSpace(r.body)) == 0 {
+		return out, nil
+	}
+	if err := decodeJSON(r.body, &out); err != nil {
+		return nil, &esError{status: http.StatusBadRequest, typ: "x_content_parse_exception", reason: err.Error()}
+	}
+	return out, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &request{Request: r, query: r.URL.Query()}
+	for _, seg := range strings.Split(strings.Trim(r.URL.Path, "/"), "/") {
+		if seg != "" {
+			if unescaped, err := url.PathUnescape(seg); err == nil {
+				seg = unescaped
+			}
+			req.segments = append(req.segments, seg)
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err == nil && strings.Contains(r.Header.Get("Content-Encoding"), "gzip") && len(body) > 0 {
+		var reader *gzip.Reader
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+		if err == nil {
+			body, err = io.ReadAll(reader)
+		}
+	}
+	if err != nil {
+		s.write(w, req, http.StatusBadRequest, (&esError{status: 400, typ: "parse_exception", reason: err.Error()}).body())
+		return
+	}
+	req.body = body
+	if source := req.param("source"); source != "" && len(body) == 0 {
+		req.body = []byte(source)
+	}
+
+	s.lock.Lock()
+	s.requests[r.Method+" "+endpointKey(req.segments)]++
+	status, resp, err := s.route(req)
+	s.lock.Unlock()
+
+	if err != nil {
+		e, ok := err.(*esError)
+		if !ok {
+			e = &esError{status: http.StatusInternalServerError, typ: "exception", reason: err.Error()}
+		}
+		status, resp = e.status, e.body()
+	}
+	s.write(w, req, status, resp)
+}
+
+// endpointKey replaces index names and ids in the path with placeholders.
+func endpointKey(segments []string) string {
+	if len(segments) == 0 {
+		return "/"
+	}
+	out := make([]string, len(segments))
+	for i, seg := range segments {
+		switch {
+		case strings.HasPrefix(seg, "_"):
+			out[i] = seg
+		case i == 0:
+			out[i] = "{index}"
+		case i > 0 && (segments[i-1] == "_doc" || segments[i-1] == "_create" || segments[i-1] == "_update" || segments[i-1] == "_source"):
+			out[i] = "{id}"
+		case i > 0 && strings.HasPrefix(segments[0], "_"):
+			out[i] = seg
+		default:
+			out[i] = "{" + strconv.Itoa(i) + "}"
+		}
+	}
+	return "/" + strings.Join(out, "/")
+}
+
+func (s *Server) write(w http.ResponseWriter, req *request, status int, resp interface{}) {
+	if req.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	switch v := resp.(type) {
+	case string:
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		w.WriteHeader(status)
+		_, _ = io.WriteString(w, v)
+		return
+	case nil:
+		resp = map[string]interface{}{}
+	}
+	if filter := req.param("filter_path"); filter != "" {
+		resp = filterPath(resp, strings.Split(filter, ","))
+	}
+	var data []byte
+	if req.flag("pretty") {
+		data, _ = json.MarshalIndent(resp, "", "  ")
+	} else {
+		data, _ = json.Marshal(resp)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("X-elastic-product", "Elasticsearch")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+// filterPath applies the filter_path response filter. Each pattern is a
+// dotted path whose segments may use * (one level) or ** (any depth).
+func filterPath(resp interface{}, patterns []string) interface{} {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return resp
+	}
+	var generic interface{}
+	if decodeJSON(data, &generic) != nil {
+		return resp
+	}
+	var paths [][]string
+	for _, p := range patterns {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, strings.Split(p, "."))
+		}
+	}
+	out, _ := filterValue(generic, paths)
+	if out == nil {
+		return map[string]interface{}{}
+	}
+	return out
+}
+
+func filterValue(v interface{}, paths [][]string) (interface{}, bool) {
+	for _, p := range paths {
+		if len(p) == 0 {
+			return v, true
+		}
+	}
+	switch x := v.(type) {
+	case []interface{}:
+		var out []interface{}
+		for _, e := range x {
+			if fv, ok := filterValue(e, paths); ok {
+				out = append(out, fv)
+			}
+		}
+		return out, len(out) > 0
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, e := range x {
+			var next [][]string
+			for _, p := range paths {
+				switch {
+				case p[0] == "**":
+					next = append(next, p, p[1:])
+					if len(p) > 1 && globMatch(p[1], k) {
+						next = append(next, p[2:])
+					}
+				case globMatch(p[0], k):
+					next = append(next, p[1:])
+				}
+			}
+			if len(next) == 0 {
+				continue
+			}
+			if fv, ok := filterValue(e, next); ok {
+				out[k] = fv
+			}
+		}
+		return out, len(out) > 0
+	}
+	return nil, false
+}
+
+func (s *Server) route(req *request) (int, interface{}, error) {
+	segs := req.segments
+	if len(segs) == 0 {
+		if req.Method == http.MethodGet || req.Method == http.MethodHead {
+			return http.StatusOK, s.banner(), nil
+		}
+		return 0, nil, noHandler(req.Request)
+	}
+	if strings.HasPrefix(segs[0], "_") && segs[0] != "_all" {
+		return s.routeSystem(req)
+	}
+	return s.routeIndex(req, segs[0], segs[1:])
+}
+
+func (s *Server) routeSystem(req *request) (int, interface{}, error) {
+	segs := req.segments
+	switch segs[0] {
+	case "_bulk":
+		return s.handleBulk(req, "", "")
+	case "_search":
+		if len(segs) > 1 && segs[1] == "scroll" {
+			return s.handleScroll(req, segs[2:])
+		}
+		if len(segs) > 1 && segs[1] == "point_in_time" && s.opts.Distribution == Opensearch {
+			return s.handleClosePointInTime(req, segs[2:])
+		}
+		if len(segs) == 1 {
+			return s.handleSearch(req, "")
+		}
+	case "_count":
+		return s.handleCount(req, "")
+	case "_pit":
+		if s.opts.Distribution == Elasticsearch {
+			return s.handleClosePointInTime(req, segs[1:])
+		}
+	case "_msearch":
+		return s.handleMultiSearch(req, "")
+	case "_mget":
+		return s.handleMultiGet(req, "")
+	case "_delete_by_query":
+		return s.handleDeleteByQuery(req, "")
+	case "_update_by_query":
+		return s.handleUpdateByQuery(req, "")
+	case "_cluster":
+		return s.handleCluster(req, segs[1:])
+	case "_nodes":
+		return s.handleNodes(req, segs[1:])
+	case "_cat":
+		return s.handleCat(req, segs[1:])
+	case "_template":
+		return s.handleTemplate(req, segs[1:], s.templates, false)
+	case "_index_template":
+		return s.handleTemplate(req, segs[1:], s.indexTemplates, true)
+	case "_scripts":
+		return s.handleScripts(req, segs[1:])
+	case "_refresh", "_flush", "_forcemerge", "_cache":
+		return s.handleRefresh(req, "")
+	case "_stats":
+		return s.handleStats(req, "", segs[1:])
+	case "_mapping", "_mappings":
+		return s.handleMapping(req, "", segs[1:])
+	case "_settings":
+		return s.handleSettings(req, "", segs[1:])
+	case "_alias", "_aliases":
+		return s.handleAliases(req, "", segs)
+	case "_remote":
+		return http.StatusOK, map[string]interface{}{}, nil
+	}
+	return 0, nil, noHandler(req.Request)
+}
+
+func (s *Server) routeIndex(req *request, target string, rest []string) (int, interface{}, error) {
+	if len(rest) == 0 {
+		return s.handleIndex(req, target)
+	}
+	op := rest[0]
+	switch op {
+	case "_search":
+		if len(rest) == 1 {
+			return s.handleSearch(req, target)
+		}
+		if len(rest) == 2 && rest[1] == "point_in_time" && s.opts.Distribution == Opensearch {
+			return s.handleOpenPointInTime(req, target)
+		}
+	case "_pit":
+		if len(rest) == 1 && s.opts.Distribution == Elasticsearch {
+			return s.handleOpenPointInTime(req, target)
+		}
+	case "_count":
+		return s.handleCount(req, target)
+	case "_msearch":
+		return s.handleMultiSearch(req, target)
+	case "_mget":
+		return s.handleMultiGet(req, target)
+	case "_bulk":
+		return s.handleBulk(req, target, "")
+	case "_doc", "_create", "_update", "_source":
+		return s.handleDocument(req, target, "", op, rest[1:])
+	case "_mapping", "_mappings":
+		return s.handleMapping(req, target, rest[1:])
+	case "_settings":
+		return s.handleSettings(req, target, rest[1:])
+	case "_refresh", "_flush", "_forcemerge", "_cache", "_open", "_close":
+		return s.handleRefresh(req, target)
+	case "_stats":
+		return s.handleStats(req, target, rest[1:])
+	case "_alias", "_aliases":
+		return s.handleAliases(req, target, rest)
+	case "_delete_by_query":
+		return s.handleDeleteByQuery(req, target)
+	case "_update_by_query":
+		return s.handleUpdateByQuery(req, target)
+	case "_field_caps":
+		return s.handleFieldCaps(req, target)
+	}
+	if strings.HasPrefix(op, "_") {
+		return 0, nil, noHandler(req.Request)
+	}
+
+	//legacy typed endpoints: /{index}/{type}/...
+	if !s.supportsTypes() {
+		return 0, nil, noHandler(req.Request)
+	}
+	docType := op
+	rest = rest[1:]
+	if len(rest) == 0 {
+		if req.Method == http.MethodPost || req.Method == http.MethodPut {
+			return s.handleDocument(req, target, docType, "_doc", nil)
+		}
+		return 0, nil, noHandler(req.Request)
+	}
+	switch rest[0] {
+	case "_search":
+		return s.handleSearch(req, target)
+	case "_count":
+		return s.handleCount(req, target)
+	case "_bulk":
+		return s.handleBulk(req, target, docType)
+	case "_mapping", "_mappings":
+		return s.handleMapping(req, target, append([]string{docType}, rest[1:]...))
+	case "_delete_by_query":
+		return s.handleDeleteByQuery(req, target)
+	case "_update_by_query":
+		return s.handleUpdateByQuery(req, target)
+	}
+	if len(rest) == 2 && (rest[1] == "_update" || rest[1] == "_create" || rest[1] == "_source") {
+		return s.handleDocument(req, target, docType, rest[1], rest[:1])
+	}
+	if len(rest) == 1 {
+		return s.handleDocument(req, target, docType, "_doc", rest)
+	}
+	return 0, nil, noHandler(req.Request)
+}
+
+// supportsTypes is false once the typed endpoints are gone, from
+// Elasticsearch 8.0 and OpenSearch 2.0 on.
+func (s *Server) supportsTypes() bool {
+	switch s.opts.Distribution {
+	case Elasticsearch:
+		return !versionAtLeast(s.opts.Version, 8, 0)
+	case Opensearch:
+		return !versionAtLeast(s.opts.Version, 2, 0)
+	}
+	return true
+}
+
+func (s *Server) banner() map[string]interface{} {
+	version := map[string]interface{}{
+		"number":                              s.opts.Version,
+		"build_flavor":                        "default",
+		"build_type":                          "tar",
+		"build_hash":                          "elastictest",
+		"build_date":                          "2024-01-01T00:00:00.000Z",
+		"build_snapshot":                      false,
+		"lucene_version":                      "9.0.0",
+		"minimum_wire_compatibility_version":  "7.17.0",
+		"minimum_index_compatibility_version": "7.0.0",
+	}
+	if s.opts.Distribution != Elasticsearch {
+		version["distribution"] = s.opts.Distribution
+	}
+	return map[string]interface{}{
+		"name":         s.opts.NodeName,
+		"cluster_name": s.opts.ClusterName,
+		"cluster_uuid": s.clusterUUID,
+		"version":      version,
+		"tagline":      "You Know, for Search",
+	}
+}
+
+func (s *Server) nextSequence() int64 {
+	s.sequence++
+	return s.sequence
+}
+
+func (s *Server) sortedIndexNames() []string {
+	names := make([]string, 0, len(s.indices))
+	for name := range s.indices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
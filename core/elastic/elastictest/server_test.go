@@ -0,0 +1,276 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// call sends a request to the fake and decodes a JSON response; text
+// responses are returned as a string.
+func call(t *testing.T, srv *Server, method, path, body string) (int, interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return resp.StatusCode, string(data)
+	}
+	var out interface{}
+	require.NoError(t, json.Unmarshal(data, &out), string(data))
+	return resp.StatusCode, out
+}
+
+// path walks a decoded response by keys and array indices.
+func path(v interface{}, keys ...interface{}) interface{} {
+	for _, k := range keys {
+		switch key := k.(type) {
+		case string:
+			m, _ := v.(map[string]interface{})
+			v = m[key]
+		case int:
+			a, _ := v.([]interface{})
+			if key >= len(a) {
+				return nil
+			}
+			v = a[key]
+		}
+	}
+	return v
+}
+
+func newTestServer(t *testing.T, opts Options) *Server {
+	srv := NewServer(opts)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBanner(t *testing.T) {
+	for _, tc := range []struct {
+		opts         Options
+		number       string
+		distribution interface{}
+	}{
+		{Options{}, "8.15.0", nil},
+		{Options{Version: "6.8.23"}, "6.8.23", nil},
+		{Options{Distribution: Opensearch}, "2.17.0", Opensearch},
+		{Options{Distribution: Easysearch, Version: "2.0.0"}, "2.0.0", Easysearch},
+	} {
+		srv := newTestServer(t, tc.opts)
+		status, resp := call(t, srv, http.MethodGet, "/", "")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, tc.number, path(resp, "version", "number"))
+		assert.Equal(t, tc.distribution, path(resp, "version", "distribution"))
+		assert.Equal(t, "You Know, for Search", path(resp, "tagline"))
+	}
+}
+
+func TestDocumentCRUD(t *testing.T) {
+	srv := newTestServer(t, Options{})
+
+	status, resp := call(t, srv, http.MethodPut, "/users/_doc/1", `{"name":"alice","age":30}`)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "created", path(resp, "result"))
+	assert.EqualValues(t, 0, path(resp, "_seq_no"))
+	assert.Nil(t, path(resp, "_type"))
+
+	status, resp = call(t, srv, http.MethodGet, "/users/_doc/1", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, path(resp, "found"))
+	assert.Equal(t, "alice", path(resp, "_source", "name"))
+
+	status, resp = call(t, srv, http.MethodPost, "/users/_update/1", `{"doc":{"age":31}}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "updated", path(resp, "result"))
+	assert.EqualValues(t, 2, path(resp, "_version"))
+
+	status, resp = call(t, srv, http.MethodPost, "/users/_update/1", `{"doc":{"age":31}}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "noop", path(resp, "result"))
+
+	status, resp = call(t, srv, http.MethodPut, "/users/_create/1", `{"name":"bob"}`)
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Equal(t, "version_conflict_engine_exception", path(resp, "error", "type"))
+
+	status, _ = call(t, srv, http.MethodPut, "/users/_doc/1?if_seq_no=0&if_primary_term=1", `{"name":"carol"}`)
+	assert.Equal(t, http.StatusConflict, status)
+
+	status, resp = call(t, srv, http.MethodGet, "/users/_source/1", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.EqualValues(t, 31, path(resp, "age"))
+
+	status, resp = call(t, srv, http.MethodDelete, "/users/_doc/1", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "deleted", path(resp, "result"))
+
+	status, resp = call(t, srv, http.MethodGet, "/users/_doc/1", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, false, path(resp, "found"))
+
+	status, resp = call(t, srv, http.MethodGet, "/missing/_doc/1", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, "index_not_found_exception", path(resp, "error", "type"))
+}
+
+func TestLegacyTypedDocuments(t *testing.T) {
+	srv := newTestServer(t, Options{Version: "5.6.16"})
+
+	status, resp := call(t, srv, http.MethodPut, "/logs/event/1", `{"msg":"hello"}`)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "event", path(resp, "_type"))
+	assert.Equal(t, true, path(resp, "created"))
+	assert.Nil(t, path(resp, "_seq_no"))
+
+	_, resp = call(t, srv, http.MethodGet, "/logs/_search", "")
+	assert.EqualValues(t, 1, path(resp, "hits", "total"))
+	assert.Equal(t, "event", path(resp, "hits", "hits", 0, "_type"))
+
+	_, resp = call(t, srv, http.MethodGet, "/logs/_mapping", "")
+	assert.Equal(t, "text", path(resp, "logs", "mappings", "event", "properties", "msg", "type"))
+}
+
+func TestTypedEndpointsRemoved(t *testing.T) {
+	for _, opts := range []Options{{Version: "8.15.0"}, {Distribution: Opensearch, Version: "2.17.0"}} {
+		srv := newTestServer(t, opts)
+		for _, p := range []string{"/logs/event/1", "/logs/event/1/_update", "/logs/event/_search"} {
+			status, resp := call(t, srv, http.MethodPost, p, `{"doc":{"msg":"hello"}}`)
+			assert.Equal(t, http.StatusBadRequest, status, p)
+			assert.Contains(t, path(resp, "error", "reason"), "no handler found", p)
+		}
+	}
+
+	srv := newTestServer(t, Options{Version: "7.17.24"})
+	status, _ := call(t, srv, http.MethodPut, "/logs/event/1", `{"msg":"hello"}`)
+	assert.Equal(t, http.StatusCreated, status)
+}
+
+func TestMappings(t *testing.T) {
+	srv := newTestServer(t, Options{})
+
+	status, _ := call(t, srv, http.MethodPut, "/strict", `{"mappings":{"dynamic":"strict","properties":{"name":{"type":"keyword"}}}}`)
+	require.Equal(t, http.StatusOK, status)
+	status, resp := call(t, srv, http.MethodPut, "/strict/_doc/1", `{"name":"a","extra":1}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "strict_dynamic_mapping_exception", path(resp, "error", "type"))
+
+	status, resp = call(t, srv, http.MethodPut, "/strict/_mapping", `{"properties":{"name":{"type":"long"}}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, path(resp, "error", "reason"), "cannot be changed from type [keyword] to [long]")
+
+	status, resp = call(t, srv, http.MethodPut, "/strict", `{}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "resource_already_exists_exception", path(resp, "error", "type"))
+
+	call(t, srv, http.MethodPut, "/dynamic/_doc/1", `{"title":"hello","count":3,"ratio":0.5,"at":"2024-01-02T03:04:05Z","ok":true}`)
+	_, resp = call(t, srv, http.MethodGet, "/dynamic/_mapping", "")
+	props := path(resp, "dynamic", "mappings", "properties")
+	assert.Equal(t, "text", path(props, "title", "type"))
+	assert.Equal(t, "keyword", path(props, "title", "fields", "keyword", "type"))
+	assert.Equal(t, "long", path(props, "count", "type"))
+	assert.Equal(t, "float", path(props, "ratio", "type"))
+	assert.Equal(t, "date", path(props, "at", "type"))
+	assert.Equal(t, "boolean", path(props, "ok", "type"))
+}
+
+func TestTemplatesAndAliases(t *testing.T) {
+	srv := newTestServer(t, Options{})
+
+	status, _ := call(t, srv, http.MethodPut, "/_index_template/logs", `{
+		"index_patterns": ["logs-*"],
+		"template": {"settings": {"number_of_replicas": 0}, "mappings": {"properties": {"level": {"type": "keyword"}}},
+			"aliases": {"logs": {"is_write_index": true}}}
+	}`)
+	require.Equal(t, http.StatusOK, status)
+
+	call(t, srv, http.MethodPut, "/logs-2024", "")
+	_, resp := call(t, srv, http.MethodGet, "/logs-2024/_mapping", "")
+	assert.Equal(t, "keyword", path(resp, "logs-2024", "mappings", "properties", "level", "type"))
+
+	status, resp = call(t, srv, http.MethodPost, "/logs/_doc", `{"level":"warn"}`)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "logs-2024", path(resp, "_index"))
+
+	status, _ = call(t, srv, http.MethodPost, "/_aliases", `{"actions":[{"add":{"index":"logs-2024","alias":"recent"}}]}`)
+	require.Equal(t, http.StatusOK, status)
+	_, resp = call(t, srv, http.MethodGet, "/recent/_count", "")
+	assert.EqualValues(t, 1, path(resp, "count"))
+}
+
+func TestBulk(t *testing.T) {
+	srv := newTestServer(t, Options{})
+
+	status, resp := call(t, srv, http.MethodPost, "/_bulk", `{"index":{"_index":"a","_id":"1"}}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, path(resp, "error", "reason"), "newline")
+
+	body := `{"index":{"_index":"a","_id":"1"}}
+{"n":1}
+{"create":{"_index":"a","_id":"1"}}
+{"n":2}
+{"update":{"_index":"a","_id":"1"}}
+{"doc":{"n":3}}
+{"delete":{"_index":"a","_id":"2"}}
+`
+	status, resp = call(t, srv, http.MethodPost, "/_bulk", body)
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, true, path(resp, "errors"))
+	assert.EqualValues(t, 201, path(resp, "items", 0, "index", "status"))
+	assert.EqualValues(t, 409, path(resp, "items", 1, "create", "status"))
+	assert.EqualValues(t, 200, path(resp, "items", 2, "update", "status"))
+	assert.EqualValues(t, 404, path(resp, "items", 3, "delete", "status"))
+
+	srv.RejectBulkItems(1)
+	_, resp = call(t, srv, http.MethodPost, "/a/_bulk", "{\"index\":{\"_id\":\"3\"}}\n{\"n\":3}\n{\"index\":{\"_id\":\"4\"}}\n{\"n\":4}\n")
+	assert.EqualValues(t, 429, path(resp, "items", 0, "index", "status"))
+	assert.Equal(t, "es_rejected_execution_exception", path(resp, "items", 0, "index", "error", "type"))
+	assert.EqualValues(t, 201, path(resp, "items", 1, "index", "status"))
+
+	srv.RejectBulkRequests(1)
+	status, _ = call(t, srv, http.MethodPost, "/a/_bulk", "{\"index\":{}}\n{\"n\":5}\n")
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.Equal(t, 2, srv.DocCount("a"))
+	assert.Equal(t, 2, srv.RequestCount("POST /{index}/_bulk"))
+
+	_, resp = call(t, srv, http.MethodGet, "/_nodes/stats", "")
+	nodes, _ := path(resp, "nodes").(map[string]interface{})
+	for _, node := range nodes {
+		assert.EqualValues(t, 2, path(node, "thread_pool", "write", "rejected"))
+	}
+}
+
+func TestClusterAndCat(t *testing.T) {
+	srv := newTestServer(t, Options{Replicas: 1})
+	call(t, srv, http.MethodPut, "/a/_doc/1", `{"n":1}`)
+
+	_, resp := call(t, srv, http.MethodGet, "/_cluster/health", "")
+	assert.Equal(t, "yellow", path(resp, "status"))
+	assert.EqualValues(t, 1, path(resp, "unassigned_shards"))
+
+	status, resp := call(t, srv, http.MethodGet, "/_cat/indices?format=json", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "a", path(resp, 0, "index"))
+	assert.Equal(t, "1", path(resp, 0, "docs.count"))
+
+	_, text := call(t, srv, http.MethodGet, "/_cat/count?v&h=count", "")
+	assert.Equal(t, "count\n1\n", text)
+
+	status, _ = call(t, srv, http.MethodPut, "/_cluster/settings", `{"persistent":{"cluster.routing.allocation.enable":"primaries"}}`)
+	assert.Equal(t, http.StatusOK, status)
+	_, resp = call(t, srv, http.MethodGet, "/_cluster/settings?flat_settings=true", "")
+	assert.Equal(t, "primaries", path(resp, "persistent", "cluster.routing.allocation.enable"))
+
+	_, resp = call(t, srv, http.MethodGet, "/_cluster/health?filter_path=status,number_of_nodes", "")
+	assert.Equal(t, map[string]interface{}{"status": "yellow", "number_of_nodes": float64(1)}, resp)
+}
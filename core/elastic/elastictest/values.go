@@ -0,0 +1,572 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastictest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// decodeJSON keeps numbers as json.Number so stored sources round-trip
+// without float rounding.
+func decodeJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case json.Number:
+		f, err := x.Float64()
+		return f, err == nil
+	case float64:
+		return x, true
+	case float32:
+		return float64(x), true
+	case int:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toInt(v interface{}, def int) int {
+	if f, ok := toFloat(v); ok {
+		return int(f)
+	}
+	return def
+}
+
+func toBool(v interface{}) (bool, bool) {
+	switch x := v.(type) {
+	case bool:
+		return x, true
+	case string:
+		b, err := strconv.ParseBool(x)
+		return b, err == nil
+	}
+	return false, false
+}
+
+func toString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case json.Number:
+		return x.String()
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func toStrings(v interface{}) []string {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		out := make([]string, 0, len(x))
+		for _, e := range x {
+			out = append(out, toString(e))
+		}
+		return out
+	case []string:
+		return x
+	case string:
+		return strings.Split(x, ",")
+	}
+	return []string{toString(v)}
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	return m, ok
+}
+
+// singleEntry returns the only key/value of an object such as
+// {"term":{...}}; clauses with zero or several keys are rejected.
+func singleEntry(v interface{}, what string) (string, interface{}, error) {
+	m, ok := asMap(v)
+	if !ok || len(m) != 1 {
+		return "", nil, parsingError("[%v] malformed query, expected a single field object", what)
+	}
+	for k, e := range m {
+		return k, e, nil
+	}
+	return "", nil, nil
+}
+
+// fieldValues collects the values at a dotted path, flattening arrays the
+// way Elasticsearch does. Source keys that themselves contain dots are
+// honoured.
+func fieldValues(src interface{}, path string) []interface{} {
+	switch x := src.(type) {
+	case map[string]interface{}:
+		if v, ok := x[path]; ok {
+			return flatten(v)
+		}
+		var out []interface{}
+		for i := 0; i < len(path); i++ {
+			if path[i] != '.' {
+				continue
+			}
+			if v, ok := x[path[:i]]; ok {
+				out = append(out, fieldValues(v, path[i+1:])...)
+			}
+		}
+		return out
+	case []interface{}:
+		var out []interface{}
+		for _, e := range x {
+			out = append(out, fieldValues(e, path)...)
+		}
+		return out
+	}
+	return nil
+}
+
+func flatten(v interface{}) []interface{} {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		var out []interface{}
+		for _, e := range x {
+			out = append(out, flatten(e)...)
+		}
+		return out
+	}
+	return []interface{}{v}
+}
+
+// withPath returns a shallow copy of src where the value at the dotted path
+// is replaced by v; nested queries and aggregations evaluate each nested
+// object this way.
+func withPath(src map[string]interface{}, path string, v interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(src))
+	for k, e := range src {
+		out[k] = e
+	}
+	head, rest, nested := strings.Cut(path, ".")
+	if !nested {
+		out[path] = v
+		return out
+	}
+	if _, ok := src[path]; ok {
+		out[path] = v
+		return out
+	}
+	child, _ := asMap(src[head])
+	if child == nil {
+		child = map[string]interface{}{}
+	}
+	out[head] = withPath(child, rest, v)
+	return out
+}
+
+// nestedObjects returns the objects found at a nested path.
+func nestedObjects(src map[string]interface{}, path string) []map[string]interface{} {
+	var out []map[string]interface{}
+	for _, v := range fieldValues(src, path) {
+		if m, ok := asMap(v); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// field kinds that decide how values compare.
+const (
+	kindKeyword = iota
+	kindText
+	kindNumber
+	kindDate
+	kindBool
+	kindObject
+)
+
+func kindOf(fieldType string) int {
+	switch fieldType {
+	case "text", "match_only_text", "search_as_you_type":
+		return kindText
+	case "long", "integer", "short", "byte", "double", "float", "half_float", "scaled_float", "unsigned_long", "token_count":
+		return kindNumber
+	case "date", "date_nanos":
+		return kindDate
+	case "boolean":
+		return kindBool
+	case "object", "nested", "flattened":
+		return kindObject
+	}
+	return kindKeyword
+}
+
+func isIntegerType(fieldType string) bool {
+	switch fieldType {
+	case "long", "integer", "short", "byte", "unsigned_long", "token_count":
+		return true
+	}
+	return false
+}
+
+// comparable converts a stored or query value to the representation used
+// for comparisons of the given kind: float64 for numbers and dates (epoch
+// millis), bool for booleans and string otherwise.
+func comparable(v interface{}, kind int) (interface{}, bool) {
+	switch kind {
+	case kindNumber:
+		f, ok := toFloat(v)
+		return f, ok
+	case kindDate:
+		t, ok := parseDate(v, time.UTC)
+		if !ok {
+			return nil, false
+		}
+		return float64(t.UnixMilli()), true
+	case kindBool:
+		b, ok := toBool(v)
+		return b, ok
+	}
+	if v == nil {
+		return nil, false
+	}
+	if _, ok := v.(map[string]interface{}); ok {
+		return nil, false
+	}
+	return toString(v), true
+}
+
+// compareValues orders two comparable values of the same kind.
+func compareValues(a, b interface{}) int {
+	switch x := a.(type) {
+	case float64:
+		y, _ := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case bool:
+		y, _ := b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	case string:
+		return strings.Compare(x, toString(b))
+	}
+	return 0
+}
+
+// tokenize is the standard analyzer in a nutshell: lowercase, split on
+// anything that is not a letter or digit.
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// globMatch matches a name against a pattern where * matches any run of
+// characters and ? a single one.
+func globMatch(pattern, name string) bool {
+	if pattern == "*" || pattern == name {
+		return true
+	}
+	if !strings.ContainsAny(pattern, "*?") {
+		return false
+	}
+	p, n := []rune(pattern), []rune(name)
+	var match func(i, j int) bool
+	match = func(i, j int) bool {
+		for i < len(p) {
+			switch p[i] {
+			case '*':
+				for k := j; k <= len(n); k++ {
+					if match(i+1, k) {
+						return true
+					}
+				}
+				return false
+			case '?':
+				if j >= len(n) {
+					return false
+				}
+			default:
+				if j >= len(n) || n[j] != p[i] {
+					return false
+				}
+			}
+			i++
+			j++
+		}
+		return j == len(n)
+	}
+	return match(0, 0)
+}
+
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"2006/01/02 15:04:05",
+	"2006/01/02",
+	"2006-01",
+	"2006",
+}
+
+// parseDate accepts epoch millis and the common ISO-8601 shapes that the
+// default strict_date_optional_time||epoch_millis format does. Values
+// without a zone are read in loc.
+func parseDate(v interface{}, loc *time.Location) (time.Time, bool) {
+	switch x := v.(type) {
+	case time.Time:
+		return x, true
+	case string:
+		x = strings.TrimSpace(x)
+		for _, layout := range dateLayouts {
+			if t, err := time.ParseInLocation(layout, x, loc); err == nil {
+				return t.UTC(), true
+			}
+		}
+		if ms, err := strconv.ParseInt(x, 10, 64); err == nil {
+			return time.UnixMilli(ms).UTC(), true
+		}
+		return time.Time{}, false
+	}
+	if f, ok := toFloat(v); ok {
+		return time.UnixMilli(int64(f)).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// parseDateMath resolves dates such as now-1d/d or 2024-01-01||+1M. With
+// roundUp the rounding moves to the last millisecond of the unit, which
+// is what gt and lte bounds use.
+func parseDateMath(v interface{}, now time.Time, loc *time.Location, roundUp bool) (time.Time, error) {
+	s, ok := v.(string)
+	if !ok {
+		if t, ok := parseDate(v, loc); ok {
+			return t, nil
+		}
+		return time.Time{}, badRequest("failed to parse date field [%v]", v)
+	}
+	var anchor time.Time
+	var expr string
+	switch {
+	case strings.HasPrefix(s, "now"):
+		anchor, expr = now.In(loc), s[3:]
+	case strings.Contains(s, "||"):
+		base, rest, _ := strings.Cut(s, "||")
+		t, ok := parseDate(base, loc)
+		if !ok {
+			return time.Time{}, badRequest("failed to parse date field [%v]", s)
+		}
+		anchor, expr = t.In(loc), rest
+	default:
+		t, ok := parseDate(s, loc)
+		if !ok {
+			return time.Time{}, badRequest("failed to parse date field [%v] with format [strict_date_optional_time||epoch_millis]", s)
+		}
+		return t, nil
+	}
+
+	t := anchor
+	for len(expr) > 0 {
+		op := expr[0]
+		expr = expr[1:]
+		switch op {
+		case '+', '-':
+			i := 0
+			for i < len(expr) && expr[i] >= '0' && expr[i] <= '9' {
+				i++
+			}
+			n := 1
+			if i > 0 {
+				n, _ = strconv.Atoi(expr[:i])
+			}
+			if i >= len(expr) {
+				return time.Time{}, badRequest("truncated date math [%v]", s)
+			}
+			if op == '-' {
+				n = -n
+			}
+			t = addUnit(t, expr[i], n)
+			expr = expr[i+1:]
+		case '/':
+			if len(expr) == 0 {
+				return time.Time{}, badRequest("truncated date math [%v]", s)
+			}
+			unit := expr[0]
+			t = truncateUnit(t, unit)
+			if roundUp {
+				t = addUnit(t, unit, 1).Add(-time.Millisecond)
+			}
+			expr = expr[1:]
+		default:
+			return time.Time{}, badRequest("operator not supported for date math [%v]", s)
+		}
+	}
+	return t.UTC(), nil
+}
+
+func addUnit(t time.Time, unit byte, n int) time.Time {
+	switch unit {
+	case 'y':
+		return t.AddDate(n, 0, 0)
+	case 'M':
+		return t.AddDate(0, n, 0)
+	case 'w':
+		return t.AddDate(0, 0, 7*n)
+	case 'd':
+		return t.AddDate(0, 0, n)
+	case 'h', 'H':
+		return t.Add(time.Duration(n) * time.Hour)
+	case 'm':
+		return t.Add(time.Duration(n) * time.Minute)
+	case 's':
+		return t.Add(time.Duration(n) * time.Second)
+	}
+	return t
+}
+
+func truncateUnit(t time.Time, unit byte) time.Time {
+	y, m, d := t.Date()
+	loc := t.Location()
+	switch unit {
+	case 'y':
+		return time.Date(y, 1, 1, 0, 0, 0, 0, loc)
+	case 'q':
+		return time.Date(y, m-(m-1)%3, 1, 0, 0, 0, 0, loc)
+	case 'M':
+		return time.Date(y, m, 1, 0, 0, 0, 0, loc)
+	case 'w':
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, loc)
+	case 'd':
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	case 'h', 'H':
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, loc)
+	case 'm':
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, loc)
+	case 's':
+		return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, loc)
+	}
+	return t
+}
+
+// loadLocation parses a time_zone parameter: an IANA name or an offset
+// such as +08:00.
+func loadLocation(tz string) (*time.Location, error) {
+	if tz == "" || tz == "Z" || strings.EqualFold(tz, "UTC") {
+		return time.UTC, nil
+	}
+	if tz[0] == '+' || tz[0] == '-' {
+		sign := 1
+		if tz[0] == '-' {
+			sign = -1
+		}
+		hh, mm, _ := strings.Cut(tz[1:], ":")
+		h, err := strconv.Atoi(hh)
+		if err != nil {
+			return nil, badRequest("unknown time_zone [%v]", tz)
+		}
+		min, _ := strconv.Atoi(mm)
+		return time.FixedZone(tz, sign*(h*3600+min*60)), nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, badRequest("unknown time_zone [%v]", tz)
+	}
+	return loc, nil
+}
+
+// formatDate renders a date with a Joda-style pattern; the default is the
+// strict_date_optional_time rendering Elasticsearch uses for
+// key_as_string.
+func formatDate(t time.Time, format string) string {
+	format, _, _ = strings.Cut(format, "||")
+	switch format {
+	case "", "strict_date_optional_time", "date_optional_time", "strict_date_time", "date_time":
+		return t.Format("2006-01-02T15:04:05.000Z07:00")
+	case "epoch_millis":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	case "epoch_second":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "date", "strict_date":
+		return t.Format("2006-01-02")
+	}
+	return t.Format(jodaLayout(format))
+}
+
+func jodaLayout(format string) string {
+	var b strings.Builder
+	tokens := []struct{ joda, layout string }{
+		{"yyyy", "2006"}, {"uuuu", "2006"}, {"yy", "06"}, {"MMM", "Jan"}, {"MM", "01"}, {"dd", "02"},
+		{"HH", "15"}, {"hh", "03"}, {"mm", "04"}, {"ss", "05"}, {"SSS", "000"}, {"XXX", "Z07:00"},
+		{"ZZ", "Z07:00"}, {"Z", "Z0700"}, {"a", "PM"}, {"EEE", "Mon"},
+	}
+	for i := 0; i < len(format); {
+		if format[i] == '\'' {
+			end := strings.IndexByte(format[i+1:], '\'')
+			if end < 0 {
+				b.WriteString(format[i+1:])
+				break
+			}
+			b.WriteString(format[i+1 : i+1+end])
+			i += end + 2
+			continue
+		}
+		matched := false
+		for _, tok := range tokens {
+			if strings.HasPrefix(format[i:], tok.joda) {
+				b.WriteString(tok.layout)
+				i += len(tok.joda)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			b.WriteByte(format[i])
+			i++
+		}
+	}
+	return b.String()
+}
+
+// jsonNumber renders whole floats as integers, the way Elasticsearch
+// prints long values.
+func jsonNumber(f float64) interface{} {
+	if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+		return int64(f)
+	}
+	return f
+}
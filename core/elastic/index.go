@@ -178,6 +178,7 @@ type IndexDocument struct {
 	Score     float32                  `json:"_score,omitempty"`
 	Source    map[string]interface{}   `json:"_source,omitempty"`
 	Highlight map[string][]interface{} `json:"highlight,omitempty"`
+	Sort      []interface{}            `json:"sort,omitempty"`
 }
 
 func (doc *IndexDocument) GetStringFieldFromSource(field string, defaultV string) string {
@@ -286,6 +287,9 @@ type InsertResponse struct {
 	ID      string `json:"_id"`
 	Version int    `json:"_version"`
 
+	SeqNo       int64 `json:"_seq_no,omitempty"`
+	PrimaryTerm int64 `json:"_primary_term,omitempty"`
+
 	Shards struct {
 		Total      int `json:"total" `
 		Failed     int `json:"failed"`
@@ -302,8 +306,15 @@ type GetResponse struct {
 	ID      string                 `json:"_id,omitempty"`
 	Version int                    `json:"_version,omitempty"`
 	Source  map[string]interface{} `json:"_source,omitempty"`
+
+	SeqNo       int64 `json:"_seq_no,omitempty"`
+	PrimaryTerm int64 `json:"_primary_term,omitempty"`
 }
 
+// ErrVersionConflict is returned by the IfMatch writes when the document's
+// seq_no and primary_term no longer match the expected ones.
+var ErrVersionConflict = errors.New("version conflict")
+
 // DeleteResponse is a delete response object
 type DeleteResponse struct {
 	ResponseBase
@@ -28,7 +28,11 @@
 package kv
 
 import (
-	log "github.com/cihub/seelog"
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
 	"infini.sh/framework/core/errors"
 )
 
@@ -48,63 +52,214 @@ type KVStore interface {
 	ExistsKey(bucket string, key []byte) (bool, error)
 
 	DeleteKey(bucket string, key []byte) error
+}
 
-	//DeleteBucket(bucket string) error
+// WriteOp is a single mutation inside a BatchWrite, a delete when Delete is
+// set, otherwise a put of Value under Key.
+type WriteOp struct {
+	Key    []byte
+	Value  []byte
+	Delete bool
 }
 
-var handler KVStore
+// KVIterator is an optional extension of KVStore for backends that can
+// list what they hold. Scans visit keys in ascending byte order, the key
+// passed to fn has the bucket stripped, and both slices are copies that are
+// safe to retain; returning false from fn stops the scan.
+type KVIterator interface {
+	ScanPrefix(bucket string, prefix []byte, fn func(key, value []byte) bool) error
 
-func getKVHandler() KVStore {
+	// ScanRange visits keys in [start, end), a nil end means no upper bound.
+	ScanRange(bucket string, start, end []byte, fn func(key, value []byte) bool) error
 
-	if handler == nil {
-		panic(errors.New("kv store handler is not registered"))
-	}
-	return handler
+	ListBuckets() ([]string, error)
+
+	DeleteBucket(bucket string) error
+
+	// BatchWrite applies all ops of one bucket atomically.
+	BatchWrite(bucket string, ops []WriteOp) error
+}
+
+var ErrIteratorNotSupported = errors.New("kv store does not support iteration")
+
+// ValueMeta describes a stored value, ExpiresAt is zero when it never expires.
+type ValueMeta struct {
+	ExpiresAt time.Time
+}
+
+// KVTTLStore is an optional extension of KVStore for backends that expire
+// values on their own, an expired value reads as missing.
+type KVTTLStore interface {
+	AddValueWithTTL(bucket string, key []byte, value []byte, ttl time.Duration) error
+
+	GetValueWithMeta(bucket string, key []byte) ([]byte, *ValueMeta, error)
 }
 
+var ErrTTLNotSupported = errors.New("kv store does not support ttl")
+
+// KVCASStore is an optional extension of KVStore for backends that can
+// replace a value atomically, also against writers of other processes.
+type KVCASStore interface {
+	// CompareAndSwap stores value only if key still holds old, a nil old
+	// expects the key to be missing. It returns false when the current
+	// value differs, another writer got there first.
+	CompareAndSwap(bucket string, key, old, value []byte) (bool, error)
+}
+
+var casLock sync.Mutex
+
 func GetValue(bucket string, key []byte) ([]byte, error) {
-	return getKVHandler().GetValue(bucket, key)
+	return getStore(bucket).GetValue(bucket, key)
 }
 
 func GetCompressedValue(bucket string, key []byte) ([]byte, error) {
-	return getKVHandler().GetCompressedValue(bucket, key)
+	return getStore(bucket).GetCompressedValue(bucket, key)
 }
 
 func AddValueCompress(bucket string, key []byte, value []byte) error {
-	return getKVHandler().AddValueCompress(bucket, key, value)
+	return getStore(bucket).AddValueCompress(bucket, key, value)
 }
 
 func AddValue(bucket string, key []byte, value []byte) error {
-	return getKVHandler().AddValue(bucket, key, value)
+	return getStore(bucket).AddValue(bucket, key, value)
 }
 
 func ExistsKey(bucket string, key []byte) (bool, error) {
-	return getKVHandler().ExistsKey(bucket, key)
+	return getStore(bucket).ExistsKey(bucket, key)
 }
 
 func DeleteKey(bucket string, key []byte) error {
-	return getKVHandler().DeleteKey(bucket, key)
+	return getStore(bucket).DeleteKey(bucket, key)
+}
+
+func getKVTTLStore(bucket string) (KVTTLStore, error) {
+	store, ok := getStore(bucket).(KVTTLStore)
+	if !ok {
+		return nil, ErrTTLNotSupported
+	}
+	return store, nil
+}
+
+// SupportsTTL reports whether the store serving bucket implements KVTTLStore,
+// it is false rather than a panic when no store is registered yet.
+func SupportsTTL(bucket string) bool {
+	_, store := resolve(bucket)
+	_, ok := store.(KVTTLStore)
+	return ok
+}
+
+func AddValueWithTTL(bucket string, key []byte, value []byte, ttl time.Duration) error {
+	store, err := getKVTTLStore(bucket)
+	if err != nil {
+		return err
+	}
+	return store.AddValueWithTTL(bucket, key, value, ttl)
 }
 
-//func DeleteBucket(bucket string) error {
-//	return getKVHandler().DeleteBucket(bucket)
-//}
+// GetValueWithMeta returns a nil meta together with a nil value when the key
+// does not exist.
+func GetValueWithMeta(bucket string, key []byte) ([]byte, *ValueMeta, error) {
+	store, err := getKVTTLStore(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.GetValueWithMeta(bucket, key)
+}
 
-var stores map[string]KVStore
+// CompareAndSwap replaces the value of key if it still holds old, see
+// KVCASStore. Stores without KVCASStore are only guarded against writers of
+// this process.
+func CompareAndSwap(bucket string, key, old, value []byte) (bool, error) {
+	store := getStore(bucket)
+	if cas, ok := store.(KVCASStore); ok {
+		return cas.CompareAndSwap(bucket, key, old, value)
+	}
 
-func Register(name string, h KVStore) {
-	log.Debugf("register kv store with type [%s]", name)
-	if stores == nil {
-		stores = map[string]KVStore{}
+	casLock.Lock()
+	defer casLock.Unlock()
+	current, err := store.GetValue(bucket, key)
+	if err != nil {
+		return false, err
 	}
-	_, ok := stores[name]
-	if ok {
-		panic(errors.Errorf("KV handler with same name: %v already exists", name))
+	if (old == nil) != (len(current) == 0) || !bytes.Equal(current, old) {
+		return false, nil
+	}
+	return true, store.AddValue(bucket, key, value)
+}
+
+func getKVIterator(bucket string) (KVIterator, error) {
+	it, ok := getStore(bucket).(KVIterator)
+	if !ok {
+		return nil, ErrIteratorNotSupported
 	}
+	return it, nil
+}
 
-	stores[name] = h
+// SupportsIterator reports whether the store serving bucket implements KVIterator.
+func SupportsIterator(bucket string) bool {
+	_, err := getKVIterator(bucket)
+	return err == nil
+}
 
-	handler = h
+func ScanPrefix(bucket string, prefix []byte, fn func(key, value []byte) bool) error {
+	it, err := getKVIterator(bucket)
+	if err != nil {
+		return err
+	}
+	return it.ScanPrefix(bucket, prefix, fn)
+}
 
-	log.Debug("register kv store: ", name)
+func ScanRange(bucket string, start, end []byte, fn func(key, value []byte) bool) error {
+	it, err := getKVIterator(bucket)
+	if err != nil {
+		return err
+	}
+	return it.ScanRange(bucket, start, end, fn)
+}
+
+// ListBuckets merges the buckets of every registered store that supports
+// iteration, it fails only when none of them does.
+func ListBuckets() ([]string, error) {
+	names := map[string]struct{}{}
+	supported := false
+	for _, store := range getAllStores() {
+		it, ok := store.(KVIterator)
+		if !ok {
+			continue
+		}
+		supported = true
+		buckets, err := it.ListBuckets()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range buckets {
+			names[v] = struct{}{}
+		}
+	}
+	if !supported {
+		return nil, ErrIteratorNotSupported
+	}
+
+	result := make([]string, 0, len(names))
+	for k := range names {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func DeleteBucket(bucket string) error {
+	it, err := getKVIterator(bucket)
+	if err != nil {
+		return err
+	}
+	return it.DeleteBucket(bucket)
+}
+
+func BatchWrite(bucket string, ops []WriteOp) error {
+	it, err := getKVIterator(bucket)
+	if err != nil {
+		return err
+	}
+	return it.BatchWrite(bucket, ops)
 }
@@ -0,0 +1,273 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+// Package kvtest provides a map backed kv store for tests. It implements
+// KVStore and the optional KVIterator, KVTTLStore and KVCASStore, Plain hides
+// the optional ones for code paths that have to work without them:
+//
+//	store := kvtest.Use("my_test")          //every bucket goes to store
+//	plain := kvtest.UsePlain("my_test_kv")  //only the KVStore methods
+//
+// Stores are registered once per test binary, kv.Register panics on a name
+// that is already taken.
+package kvtest
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"infini.sh/framework/core/kv"
+)
+
+type entry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// Store keeps every bucket in a map, values are copied in and out.
+type Store struct {
+	lock    sync.Mutex
+	buckets map[string]map[string]entry
+}
+
+func NewStore() *Store {
+	return &Store{buckets: map[string]map[string]entry{}}
+}
+
+func clone(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (s *Store) get(bucket string, key []byte) (entry, bool) {
+	e, ok := s.buckets[bucket][string(key)]
+	if ok && e.expired(time.Now()) {
+		delete(s.buckets[bucket], string(key))
+		return entry{}, false
+	}
+	return e, ok
+}
+
+func (s *Store) put(bucket string, key []byte, e entry) {
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = map[string]entry{}
+	}
+	e.value = clone(e.value)
+	s.buckets[bucket][string(key)] = e
+}
+
+func (s *Store) Open() error  { return nil }
+func (s *Store) Close() error { return nil }
+
+func (s *Store) GetValue(bucket string, key []byte) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, _ := s.get(bucket, key)
+	return clone(e.value), nil
+}
+
+func (s *Store) GetCompressedValue(bucket string, key []byte) ([]byte, error) {
+	return s.GetValue(bucket, key)
+}
+
+func (s *Store) AddValueCompress(bucket string, key []byte, value []byte) error {
+	return s.AddValue(bucket, key, value)
+}
+
+func (s *Store) AddValue(bucket string, key []byte, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.put(bucket, key, entry{value: value})
+	return nil
+}
+
+func (s *Store) ExistsKey(bucket string, key []byte) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.get(bucket, key)
+	return ok, nil
+}
+
+func (s *Store) DeleteKey(bucket string, key []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.buckets[bucket], string(key))
+	return nil
+}
+
+// scan visits the live keys of bucket in [start, end) in order, a nil end
+// means no upper bound.
+func (s *Store) scan(bucket string, start, end []byte, prefix []byte, fn func(key, value []byte) bool) error {
+	s.lock.Lock()
+	now := time.Now()
+	keys := []string{}
+	for k, e := range s.buckets[bucket] {
+		if e.expired(now) || !strings.HasPrefix(k, string(prefix)) {
+			continue
+		}
+		if bytes.Compare([]byte(k), start) < 0 || (end != nil && bytes.Compare([]byte(k), end) >= 0) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = clone(s.buckets[bucket][k].value)
+	}
+	s.lock.Unlock()
+
+	for i, k := range keys {
+		if !fn([]byte(k), values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *Store) ScanPrefix(bucket string, prefix []byte, fn func(key, value []byte) bool) error {
+	return s.scan(bucket, nil, nil, prefix, fn)
+}
+
+func (s *Store) ScanRange(bucket string, start, end []byte, fn func(key, value []byte) bool) error {
+	return s.scan(bucket, start, end, nil, fn)
+}
+
+func (s *Store) ListBuckets() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	buckets := []string{}
+	for k, v := range s.buckets {
+		if len(v) > 0 {
+			buckets = append(buckets, k)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets, nil
+}
+
+func (s *Store) DeleteBucket(bucket string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.buckets, bucket)
+	return nil
+}
+
+func (s *Store) BatchWrite(bucket string, ops []kv.WriteOp) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, op := range ops {
+		if op.Delete {
+			delete(s.buckets[bucket], string(op.Key))
+			continue
+		}
+		s.put(bucket, op.Key, entry{value: op.Value})
+	}
+	return nil
+}
+
+func (s *Store) AddValueWithTTL(bucket string, key []byte, value []byte, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e := entry{value: value}
+	if ttl > 0 {
+		e.expiresAt = time.Now().Add(ttl)
+	}
+	s.put(bucket, key, e)
+	return nil
+}
+
+func (s *Store) GetValueWithMeta(bucket string, key []byte) ([]byte, *kv.ValueMeta, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.get(bucket, key)
+	if !ok {
+		return nil, nil, nil
+	}
+	return clone(e.value), &kv.ValueMeta{ExpiresAt: e.expiresAt}, nil
+}
+
+func (s *Store) CompareAndSwap(bucket string, key, old, value []byte) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.get(bucket, key)
+	if (old == nil) == ok || !bytes.Equal(e.value, old) {
+		return false, nil
+	}
+	s.put(bucket, key, entry{value: value})
+	return true, nil
+}
+
+// Len counts the live keys of every bucket.
+func (s *Store) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	n := 0
+	for _, b := range s.buckets {
+		for _, e := range b {
+			if !e.expired(now) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+type plainStore struct {
+	kv.KVStore
+}
+
+// Plain returns s with only the KVStore methods, type assertions for the
+// optional interfaces fail on it.
+func (s *Store) Plain() kv.KVStore {
+	return plainStore{s}
+}
+
+var (
+	registeredLock sync.Mutex
+	registered     = map[string]*Store{}
+)
+
+// Use registers a new Store as name on the first call and routes every
+// bucket to it, later calls route to the same store again.
+func Use(name string) *Store {
+	return use(name, false)
+}
+
+// UsePlain is Use with the store registered through Plain.
+func UsePlain(name string) *Store {
+	return use(name, true)
+}
+
+func use(name string, plain bool) *Store {
+	registeredLock.Lock()
+	defer registeredLock.Unlock()
+	s, ok := registered[name]
+	if !ok {
+		s = NewStore()
+		if plain {
+			kv.Register(name, s.Plain())
+		} else {
+			kv.Register(name, s)
+		}
+		registered[name] = s
+	}
+	kv.SetRoutingConfig(kv.RoutingConfig{DefaultStore: name})
+	return s
+}
+
+var (
+	_ kv.KVStore    = (*Store)(nil)
+	_ kv.KVIterator = (*Store)(nil)
+	_ kv.KVTTLStore = (*Store)(nil)
+	_ kv.KVCASStore = (*Store)(nil)
+)
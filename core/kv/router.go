@@ -0,0 +1,250 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+package kv
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/env"
+	"infini.sh/framework/core/errors"
+)
+
+// RouteConfig maps a bucket, or every bucket starting with Prefix, to the
+// store registered under Store.
+type RouteConfig struct {
+	Bucket string `config:"bucket" json:"bucket,omitempty"`
+	Prefix string `config:"prefix" json:"prefix,omitempty"`
+	Store  string `config:"store" json:"store"`
+}
+
+// RoutingConfig is read from the `kv` section, eg:
+//
+//	kv:
+//	  default_store: badger
+//	  routes:
+//	    - prefix: cache_
+//	      store: simple_kv
+type RoutingConfig struct {
+	DefaultStore string        `config:"default_store" json:"default_store,omitempty"`
+	Routes       []RouteConfig `config:"routes" json:"routes,omitempty"`
+}
+
+// RoutingTable shows where data lives, Buckets holds the buckets resolved
+// so far and the store serving each of them.
+type RoutingTable struct {
+	Stores       []string          `json:"stores"`
+	DefaultStore string            `json:"default_store"`
+	Routes       []RouteConfig     `json:"routes,omitempty"`
+	Buckets      map[string]string `json:"buckets"`
+}
+
+var (
+	routerLock      sync.RWMutex
+	stores          = map[string]KVStore{}
+	lastRegistered  string
+	routingCfg      RoutingConfig
+	routingWatch    sync.Once
+	resolvedBuckets = map[string]string{}
+)
+
+// Register adds a named store, without a configured default_store the last
+// registered one serves every bucket that has no route.
+func Register(name string, h KVStore) {
+	log.Debugf("register kv store with type [%s]", name)
+
+	routerLock.Lock()
+	defer routerLock.Unlock()
+
+	_, ok := stores[name]
+	if ok {
+		panic(errors.Errorf("KV handler with same name: %v already exists", name))
+	}
+
+	stores[name] = h
+	lastRegistered = name
+	resolvedBuckets = map[string]string{}
+
+	log.Debug("register kv store: ", name)
+}
+
+// SetRoutingConfig replaces the routes loaded from the `kv` config section.
+func SetRoutingConfig(cfg RoutingConfig) {
+	routerLock.Lock()
+	defer routerLock.Unlock()
+	routingCfg = cfg
+	resolvedBuckets = map[string]string{}
+}
+
+// LoadRoutingConfig applies the `kv` config section and follows its later
+// changes. The store modules call it in Setup, once the config is parsed;
+// until then every bucket is served by the default store.
+func LoadRoutingConfig() {
+	routingWatch.Do(func() {
+		config.NotifyOnConfigSectionChange("kv", func(pCfg, cCfg *config.Config) {
+			cfg := RoutingConfig{}
+			if cCfg != nil {
+				if err := cCfg.Unpack(&cfg); err != nil {
+					log.Errorf("failed to parse kv routing config: %v", err)
+					return
+				}
+			}
+			SetRoutingConfig(cfg)
+		})
+	})
+
+	cfg := RoutingConfig{}
+	exists, err := env.ParseConfig("kv", &cfg)
+	if err != nil {
+		log.Debugf("failed to parse kv routing config: %v", err)
+		return
+	}
+	if exists {
+		SetRoutingConfig(cfg)
+	}
+}
+
+// GetStores lists the names of the registered stores.
+func GetStores() []string {
+	routerLock.RLock()
+	defer routerLock.RUnlock()
+
+	names := make([]string, 0, len(stores))
+	for k := range stores {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetStore returns the store registered under name.
+func GetStore(name string) (KVStore, bool) {
+	routerLock.RLock()
+	defer routerLock.RUnlock()
+	v, ok := stores[name]
+	return v, ok
+}
+
+// ResolveStore returns the name of the store serving bucket.
+func ResolveStore(bucket string) string {
+	name, _ := resolve(bucket)
+	return name
+}
+
+func GetRoutingTable() RoutingTable {
+	stores := GetStores()
+
+	routerLock.RLock()
+	defer routerLock.RUnlock()
+
+	table := RoutingTable{
+		Stores:       stores,
+		DefaultStore: routingCfg.DefaultStore,
+		Routes:       routingCfg.Routes,
+		Buckets:      make(map[string]string, len(resolvedBuckets)),
+	}
+	if table.DefaultStore == "" {
+		table.DefaultStore = lastRegistered
+	}
+	for k, v := range resolvedBuckets {
+		table.Buckets[k] = v
+	}
+	return table
+}
+
+func getStore(bucket string) KVStore {
+	_, store := resolve(bucket)
+	if store == nil {
+		panic(errors.New("kv store handler is not registered"))
+	}
+	return store
+}
+
+func getAllStores() []KVStore {
+	routerLock.RLock()
+	defer routerLock.RUnlock()
+
+	result := make([]KVStore, 0, len(stores))
+	for _, v := range stores {
+		result = append(result, v)
+	}
+	return result
+}
+
+// resolve picks an exact bucket route first, then the longest matching
+// prefix, then the default store. A route to a store that is not
+// registered falls back to the default store.
+func resolve(bucket string) (string, KVStore) {
+	routerLock.RLock()
+	name, ok := resolvedBuckets[bucket]
+	if ok {
+		store := stores[name]
+		routerLock.RUnlock()
+		return name, store
+	}
+	routerLock.RUnlock()
+
+	routerLock.Lock()
+	defer routerLock.Unlock()
+
+	var matched string
+	matchedPrefix := -1
+	for _, v := range routingCfg.Routes {
+		if v.Bucket != "" && v.Bucket == bucket {
+			matched = v.Store
+			break
+		}
+		if v.Prefix != "" && strings.HasPrefix(bucket, v.Prefix) && len(v.Prefix) > matchedPrefix {
+			matched = v.Store
+			matchedPrefix = len(v.Prefix)
+		}
+	}
+
+	if matched != "" {
+		if _, ok := stores[matched]; !ok {
+			log.Warnf("kv store [%v] routed for bucket [%v] is not registered, fallback to the default store", matched, bucket)
+			matched = ""
+		}
+	}
+
+	if matched == "" {
+		matched = routingCfg.DefaultStore
+		if _, ok := stores[matched]; !ok {
+			matched = lastRegistered
+		}
+	}
+
+	store, ok := stores[matched]
+	if !ok {
+		return "", nil
+	}
+	resolvedBuckets[bucket] = matched
+	return matched, store
+}
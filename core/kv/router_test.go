@@ -0,0 +1,132 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+package kv_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/env"
+	"infini.sh/framework/core/kv"
+	"infini.sh/framework/core/kv/kvtest"
+)
+
+func TestRouting(t *testing.T) {
+	a := kvtest.NewStore()
+	b := kvtest.NewStore()
+	kv.Register("router_test_a", a.Plain())
+	kv.Register("router_test_b", b.Plain())
+
+	kv.SetRoutingConfig(kv.RoutingConfig{
+		DefaultStore: "router_test_a",
+		Routes: []kv.RouteConfig{
+			{Prefix: "cache_", Store: "router_test_b"},
+			{Bucket: "cache_pinned", Store: "router_test_a"},
+			{Prefix: "offset_", Store: "not_registered"},
+		},
+	})
+
+	assert.Equal(t, "router_test_b", kv.ResolveStore("cache_users"))
+	assert.Equal(t, "router_test_a", kv.ResolveStore("cache_pinned"))
+	assert.Equal(t, "router_test_a", kv.ResolveStore("offset_queue"))
+	assert.Equal(t, "router_test_a", kv.ResolveStore("configs"))
+
+	assert.NoError(t, kv.AddValue("cache_users", []byte("k"), []byte("v")))
+	v, err := b.GetValue("cache_users", []byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), v)
+	assert.Equal(t, 0, a.Len())
+
+	v, err = kv.GetValue("cache_users", []byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), v)
+
+	assert.False(t, kv.SupportsIterator("cache_users"))
+	assert.Equal(t, kv.ErrIteratorNotSupported, kv.ScanPrefix("cache_users", nil, func(key, value []byte) bool { return true }))
+
+	table := kv.GetRoutingTable()
+	assert.Equal(t, []string{"router_test_a", "router_test_b"}, table.Stores)
+	assert.Equal(t, "router_test_a", table.DefaultStore)
+	assert.Equal(t, "router_test_b", table.Buckets["cache_users"])
+	assert.Equal(t, "router_test_a", table.Buckets["configs"])
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	//a store without CompareAndSwap, kv falls back to get and set
+	s := kvtest.NewStore()
+	kv.Register("cas_test", s.Plain())
+	kv.SetRoutingConfig(kv.RoutingConfig{Routes: []kv.RouteConfig{{Bucket: "cas_bucket", Store: "cas_test"}}})
+
+	//nil as old creates the key only if it is missing
+	ok, err := kv.CompareAndSwap("cas_bucket", []byte("k"), nil, []byte("v1"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = kv.CompareAndSwap("cas_bucket", []byte("k"), nil, []byte("v2"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = kv.CompareAndSwap("cas_bucket", []byte("k"), []byte("stale"), []byte("v2"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = kv.CompareAndSwap("cas_bucket", []byte("k"), []byte("v1"), []byte("v2"))
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	v, err := s.GetValue("cas_bucket", []byte("k"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), v)
+}
+
+func TestLoadRoutingConfig(t *testing.T) {
+	kv.Register("load_test_a", kvtest.NewStore())
+	kv.Register("load_test_b", kvtest.NewStore())
+	kv.SetRoutingConfig(kv.RoutingConfig{DefaultStore: "load_test_a"})
+
+	//a bucket resolved before the config is parsed does not keep its store
+	assert.Equal(t, "load_test_a", kv.ResolveStore("early_bucket"))
+
+	dir := t.TempDir()
+	file := path.Join(dir, "app.yml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+path.data: `+dir+`
+path.logs: `+dir+`
+kv:
+  default_store: load_test_a
+  routes:
+    - bucket: early_bucket
+      store: load_test_b
+`), 0644))
+	e := env.EmptyEnv()
+	e.SetConfigFile(file)
+	require.NoError(t, e.RefreshConfig())
+
+	kv.LoadRoutingConfig()
+	assert.Equal(t, "load_test_b", kv.ResolveStore("early_bucket"))
+	assert.Equal(t, "load_test_a", kv.ResolveStore("other_bucket"))
+}
@@ -28,9 +28,16 @@ func GetKey(bucket, name string) []byte {
 	return []byte(bucket + ":" + name)
 }
 
-func placeLock(bucket, name string, clientID string) (bool, error) {
+// placeLock records the holder, stores with ttl support let the lock vanish
+// on its own once the lease is over, so a crashed holder leaves nothing behind.
+func placeLock(bucket, name string, clientID string, expireTimeout time.Duration) (bool, error) {
 	v := fmt.Sprintf("%s/%v", clientID, util.GetLowPrecisionCurrentTime().Unix())
-	err := kv.AddValue(parentBucket, GetKey(bucket, name), []byte(v))
+	var err error
+	if kv.SupportsTTL(parentBucket) {
+		err = kv.AddValueWithTTL(parentBucket, GetKey(bucket, name), []byte(v), expireTimeout)
+	} else {
+		err = kv.AddValue(parentBucket, GetKey(bucket, name), []byte(v))
+	}
 	return true, err
 }
 
@@ -67,10 +74,11 @@ func Hold(bucket, name string, clientID string, expireTimeout time.Duration, all
 		panic(err)
 	}
 
+	if expireTimeout.Seconds() <= 0 {
+		expireTimeout = time.Duration(30) * time.Second
+	}
+
 	if ok {
-		if expireTimeout.Seconds() <= 0 {
-			expireTimeout = time.Duration(30) * time.Second
-		}
 
 		if info == nil {
 			panic("allocate info can't be nil")
@@ -82,7 +90,7 @@ func Hold(bucket, name string, clientID string, expireTimeout time.Duration, all
 					if global.Env().IsDebug {
 						log.Infof("lost someone, taking over: %v, client_id: %v, local_id:%v, duration: %v", string(GetKey(bucket, name)), info.ClientID, clientID, time.Since(info.Timestamp))
 					}
-					return placeLock(bucket, name, clientID)
+					return placeLock(bucket, name, clientID, expireTimeout)
 				} else {
 					return false, nil
 				}
@@ -98,14 +106,14 @@ func Hold(bucket, name string, clientID string, expireTimeout time.Duration, all
 				log.Debug("it's me, let's hold the lock again, bucket:", bucket, ", name:", name, ", client_id:", info.ClientID)
 			}
 			//update timestamp to extend the lease
-			return placeLock(bucket, name, clientID)
+			return placeLock(bucket, name, clientID, expireTimeout)
 		}
 	} else {
 		if global.Env().IsDebug {
 			log.Debug("no one hold this lock, let's hold the lock, client_id:", bucket, name)
 		}
 		//not exists
-		return placeLock(bucket, name, clientID)
+		return placeLock(bucket, name, clientID, expireTimeout)
 	}
 	return false, nil
 }
@@ -92,6 +92,9 @@ const (
 	ctxCollapseFieldKey  param.ParaKey = "collapse_field"
 	ctxQueryArgsKey      param.ParaKey = "query_args"
 	ctxTemplatedQueryKey param.ParaKey = "templated_query"
+
+	ctxKeyPrevObject param.ParaKey = "prev_object"
+	ctxKeyTxChanges  param.ParaKey = "tx_changes"
 )
 
 func SetWildcardIndex(ctx *Context, wildcard bool) *Context {
@@ -163,6 +166,36 @@ func GetModel(ctx *Context) interface{} {
 	return ctx.Get(ctxKeyModel)
 }
 
+// withPrevObject records the stored state a write replaces, nil when there
+// was none or it was not looked up.
+func withPrevObject(ctx *Context, prev interface{}) {
+	ctx.Set(ctxKeyPrevObject, prev)
+}
+
+// GetPrevObjectFromContext returns the stored state the current write replaces, for
+// data operation post hooks of update, save and delete. It is nil for
+// creates and when the write skipped the existence check.
+func GetPrevObjectFromContext(ctx *Context) interface{} {
+	if isNil(ctx) {
+		return nil
+	}
+	return ctx.Get(ctxKeyPrevObject)
+}
+
+// withTxChanges makes PublishChange collect the writes of a transaction
+// instead of publishing them, nil publishes again.
+func withTxChanges(ctx *Context, changes *txChanges) {
+	ctx.Set(ctxKeyTxChanges, changes)
+}
+
+func getTxChanges(ctx *Context) *txChanges {
+	if isNil(ctx) {
+		return nil
+	}
+	changes, _ := ctx.Get(ctxKeyTxChanges).(*txChanges)
+	return changes
+}
+
 // WithCollapseField stores the collapse field in the context.
 func WithCollapseField(ctx *Context, field string) *Context {
 	ctx.Set(ctxCollapseFieldKey, field)
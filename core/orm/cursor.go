@@ -0,0 +1,117 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package orm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"infini.sh/framework/core/errors"
+)
+
+// CursorTiebreakField is appended to the sort of cursor paginated queries
+// when it is not already part of it, so that every hit has a unique sort
+// position. It is the keyword copy of the document _id kept by ORMObjectBase.
+const CursorTiebreakField = "id"
+
+// SearchAfter switches the query to cursor pagination. Pass the NextCursor of
+// the previous SearchResult, or an empty string for the first page. The
+// cursor replaces From, and only stays valid for the same filters and sort.
+func (q *QueryBuilder) SearchAfter(cursor string) *QueryBuilder {
+	q.cursorEnabled = true
+	q.searchAfter = cursor
+	return q
+}
+
+func (q *QueryBuilder) SearchAfterVal() string {
+	return q.searchAfter
+}
+
+// CursorEnabled tells whether SearchAfter was called on the query.
+func (q *QueryBuilder) CursorEnabled() bool {
+	return q.cursorEnabled
+}
+
+// CursorSorts returns the sort a cursor paginated query runs with: the
+// requested sort plus an ascending CursorTiebreakField.
+func (q *QueryBuilder) CursorSorts() []Sort {
+	sorts := make([]Sort, 0, len(q.sort)+1)
+	for _, s := range q.sort {
+		if s.Field == CursorTiebreakField {
+			return append(sorts, s)
+		}
+		sorts = append(sorts, s)
+	}
+	return append(sorts, Sort{Field: CursorTiebreakField, SortType: ASC})
+}
+
+// SearchAfterValues decodes the cursor into the sort values of the last hit
+// of the previous page, nil for the first page. errors.HTTPCode maps the
+// error of a malformed cursor to 400.
+func (q *QueryBuilder) SearchAfterValues() ([]interface{}, error) {
+	return q.SearchAfterValuesFor(q.CursorSorts())
+}
+
+// SearchAfterValuesFor is SearchAfterValues for a backend running the query
+// with other sorts than CursorSorts, e.g. with an implicit _score first. The
+// cursor must have been encoded from the same sorts.
+func (q *QueryBuilder) SearchAfterValuesFor(sorts []Sort) ([]interface{}, error) {
+	if q.searchAfter == "" {
+		return nil, nil
+	}
+	values, err := DecodeCursor(q.searchAfter)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(sorts) {
+		return nil, invalidCursor("expected %v sort values, got %v", len(sorts), len(values))
+	}
+	return values, nil
+}
+
+func invalidCursor(format string, args ...interface{}) error {
+	return errors.NewWithHTTPCode(http.StatusBadRequest, "invalid cursor: "+fmt.Sprintf(format, args...))
+}
+
+// EncodeCursor turns the sort values of a hit into an opaque cursor token.
+func EncodeCursor(values []interface{}) string {
+	data, err := json.Marshal(values)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor is the reverse of EncodeCursor. Integral numbers come back as
+// int64 so that long sort values survive the round trip.
+func DecodeCursor(cursor string) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalidCursor("%v", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var values []interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return nil, invalidCursor("%v", err)
+	}
+
+	for i, v := range values {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
+		}
+		if i64, err := n.Int64(); err == nil {
+			values[i] = i64
+		} else if f64, err := n.Float64(); err == nil {
+			values[i] = f64
+		} else {
+			return nil, invalidCursor("bad number %v", n)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,49 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package orm
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/errors"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	values := []interface{}{int64(9007199254740993), 1.5, "abc", nil}
+	decoded, err := DecodeCursor(EncodeCursor(values))
+	require.NoError(t, err)
+	assert.Equal(t, values, decoded)
+
+	_, err = DecodeCursor("%%%")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, errors.HTTPCode(err))
+}
+
+func TestCursorSorts(t *testing.T) {
+	q := NewQuery().SortBy(Sort{Field: "name", SortType: ASC})
+	assert.Equal(t, []Sort{{Field: "name", SortType: ASC}, {Field: "id", SortType: ASC}}, q.CursorSorts())
+
+	q = NewQuery().SortBy(Sort{Field: "id", SortType: DESC}, Sort{Field: "name", SortType: ASC})
+	assert.Equal(t, []Sort{{Field: "id", SortType: DESC}}, q.CursorSorts())
+}
+
+func TestSearchAfterValues(t *testing.T) {
+	q := NewQuery().SortBy(Sort{Field: "age", SortType: DESC}).SearchAfter("")
+	values, err := q.SearchAfterValues()
+	require.NoError(t, err)
+	assert.Nil(t, values)
+	assert.True(t, q.CursorEnabled())
+
+	q.SearchAfter(EncodeCursor([]interface{}{30}))
+	_, err = q.SearchAfterValues()
+	assert.Error(t, err, "cursor from a different sort")
+	assert.Equal(t, http.StatusBadRequest, errors.HTTPCode(err))
+
+	q.SearchAfter(EncodeCursor([]interface{}{30, "c1"}))
+	values, err = q.SearchAfterValues()
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(30), "c1"}, values)
+}
@@ -0,0 +1,348 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package orm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/util"
+)
+
+// MigrationAPI is the backend half of schema migrations, the steps that
+// touch the physical layout rather than the documents. It is optional,
+// migrations with add_field or reindex steps fail on backends without it.
+type MigrationAPI interface {
+	// AddField makes a newly mapped field of model queryable on the data
+	// that is already stored. mapping is the Elasticsearch field mapping,
+	// e.g. {"type": "keyword"}.
+	AddField(ctx *Context, model interface{}, field string, mapping util.MapStr) error
+
+	// Reindex rebuilds the indexed form of every stored document of model
+	// against its current mapping.
+	Reindex(ctx *Context, model interface{}) error
+}
+
+type MigrationStepType string
+
+const (
+	MigrationStepAddField MigrationStepType = "add_field"
+	MigrationStepBackfill MigrationStepType = "backfill"
+	MigrationStepReindex  MigrationStepType = "reindex"
+)
+
+// BackfillFunc updates one stored object in place, o is a pointer to the
+// registered schema type. Returning false leaves the object untouched.
+type BackfillFunc func(o interface{}) (changed bool, err error)
+
+type MigrationStep struct {
+	Type     MigrationStepType
+	Field    string
+	Mapping  util.MapStr
+	Backfill BackfillFunc
+}
+
+func (s MigrationStep) String() string {
+	if s.Field != "" {
+		return fmt.Sprintf("%v %v", s.Type, s.Field)
+	}
+	return string(s.Type)
+}
+
+// AddField maps a new field, see MigrationAPI.AddField.
+func AddField(field string, mapping util.MapStr) MigrationStep {
+	return MigrationStep{Type: MigrationStepAddField, Field: field, Mapping: mapping}
+}
+
+// Backfill runs fn over every stored object and saves the changed ones.
+func Backfill(fn BackfillFunc) MigrationStep {
+	return MigrationStep{Type: MigrationStepBackfill, Backfill: fn}
+}
+
+// Reindex rebuilds the indexed form of every stored object.
+func Reindex() MigrationStep {
+	return MigrationStep{Type: MigrationStepReindex}
+}
+
+// Migration is one versioned change to a registered schema. Versions of a
+// schema apply in ascending order, each at most once per backend. Steps run
+// in order, the progress is recorded after each one and a failed migration
+// resumes at the step that failed, so that step has to be safe to run again.
+type Migration struct {
+	Version int
+	Name    string
+	Steps   []MigrationStep
+}
+
+// MigrationRecord marks a migration as applied on a backend, it is stored
+// through that backend like any other object.
+type MigrationRecord struct {
+	ORMObjectBase
+	Schema  string `json:"schema,omitempty" elastic_mapping:"schema: { type: keyword }"`
+	Version int    `json:"version,omitempty" elastic_mapping:"version: { type: integer }"`
+	Name    string `json:"name,omitempty" elastic_mapping:"name: { type: keyword }"`
+	// Steps counts the steps applied so far, Applied is set once all of
+	// them are.
+	Steps   int  `json:"steps,omitempty" elastic_mapping:"steps: { type: integer }"`
+	Applied bool `json:"applied,omitempty" elastic_mapping:"applied: { type: boolean }"`
+}
+
+const migrationRecordSchema = "orm-migration"
+
+var (
+	migrationsLock sync.Mutex
+	migrations     = map[string][]Migration{}
+	recordSchemas  = map[ORM]bool{}
+)
+
+// RegisterMigration adds a migration for a schema registered with
+// RegisterSchemaWithIndexName, it panics on a duplicated version.
+func RegisterMigration(schema string, m Migration) {
+	if m.Version <= 0 {
+		panic(errors.Errorf("migration [%v] of [%v] needs a positive version", m.Name, schema))
+	}
+
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+	for _, v := range migrations[schema] {
+		if v.Version == m.Version {
+			panic(errors.Errorf("migration version [%v] of [%v] already registered", m.Version, schema))
+		}
+	}
+	migrations[schema] = append(migrations[schema], m)
+	sort.Slice(migrations[schema], func(i, j int) bool {
+		return migrations[schema][i].Version < migrations[schema][j].Version
+	})
+}
+
+type MigrateOptions struct {
+	// DryRun reports the pending migrations without changing anything,
+	// backfills are run on copies to count the objects they would change.
+	DryRun bool
+	// Schemas limits the run to these schemas, all when empty.
+	Schemas []string
+	// BatchSize is the page size of backfills, 500 by default.
+	BatchSize int
+}
+
+// MigrationResult describes one pending migration and what happened to it.
+type MigrationResult struct {
+	Schema  string   `json:"schema"`
+	Version int      `json:"version"`
+	Name    string   `json:"name"`
+	Steps   []string `json:"steps"`
+	// SkippedSteps counts the steps an earlier, failed run already applied,
+	// they are not run again.
+	SkippedSteps int `json:"skipped_steps,omitempty"`
+	// Changed counts the objects backfills changed, or would change on a
+	// dry run.
+	Changed int64 `json:"changed"`
+	Applied bool  `json:"applied"`
+}
+
+// Migrate applies the pending migrations of every registered schema to h,
+// in version order. It stops at the first failing migration.
+func Migrate(h ORM, opts *MigrateOptions) ([]MigrationResult, error) {
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	if err := ensureMigrationRecordSchema(h); err != nil {
+		return nil, err
+	}
+
+	results := []MigrationResult{}
+	for _, schema := range registeredSchemas {
+		if len(opts.Schemas) > 0 && !util.StringInArray(opts.Schemas, schema.Key) {
+			continue
+		}
+
+		migrationsLock.Lock()
+		pending := append([]Migration{}, migrations[schema.Key]...)
+		migrationsLock.Unlock()
+		if len(pending) == 0 {
+			continue
+		}
+
+		records, err := migrationRecords(h, schema.Key)
+		if err != nil {
+			return results, err
+		}
+
+		for _, m := range pending {
+			record := records[m.Version]
+			if record == nil {
+				record = &MigrationRecord{Schema: schema.Key, Version: m.Version, Name: m.Name}
+				record.ID = fmt.Sprintf("%v-%v", schema.Key, m.Version)
+			}
+			if record.Applied {
+				continue
+			}
+			result := MigrationResult{Schema: schema.Key, Version: m.Version, Name: m.Name}
+			for _, step := range m.Steps {
+				result.Steps = append(result.Steps, step.String())
+			}
+
+			err := runMigration(h, schema, m, record, opts.DryRun, batchSize, &result)
+			results = append(results, result)
+			if err != nil {
+				return results, errors.Errorf("migration [%v] version [%v] of [%v] failed: %v", m.Name, m.Version, schema.Key, err)
+			}
+		}
+	}
+	return results, nil
+}
+
+// runMigration runs the steps of m that record has not seen applied yet,
+// recording the progress after each step.
+func runMigration(h ORM, schema util.KeyValue, m Migration, record *MigrationRecord, dryRun bool, batchSize int, result *MigrationResult) error {
+	migrator, _ := h.(MigrationAPI)
+	for _, step := range m.Steps {
+		if migrator == nil && (step.Type == MigrationStepAddField || step.Type == MigrationStepReindex) {
+			return errors.Errorf("orm backend %T does not support the %v step", h, step.Type)
+		}
+	}
+
+	result.SkippedSteps = record.Steps
+	if !dryRun {
+		if record.Steps > 0 {
+			log.Infof("resuming migration [%v] version [%v] of [%v] at step %v", m.Name, m.Version, schema.Key, record.Steps+1)
+		} else {
+			log.Infof("applying migration [%v] version [%v] of [%v]", m.Name, m.Version, schema.Key)
+		}
+	}
+
+	for i, step := range m.Steps {
+		if i < record.Steps {
+			continue
+		}
+		model := newSchemaObject(schema.Payload)
+		ctx := NewContext()
+		WithModel(ctx, model)
+
+		switch step.Type {
+		case MigrationStepAddField:
+			if !dryRun {
+				if err := migrator.AddField(ctx, model, step.Field, step.Mapping); err != nil {
+					return err
+				}
+			}
+		case MigrationStepReindex:
+			if !dryRun {
+				if err := migrator.Reindex(ctx, model); err != nil {
+					return err
+				}
+			}
+		case MigrationStepBackfill:
+			changed, err := backfill(h, schema.Payload, step.Backfill, dryRun, batchSize)
+			result.Changed += changed
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.Errorf("unknown migration step [%v]", step.Type)
+		}
+
+		if !dryRun {
+			record.Steps = i + 1
+			if err := saveMigrationRecord(h, record); err != nil {
+				return err
+			}
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	record.Applied = true
+	if err := saveMigrationRecord(h, record); err != nil {
+		return err
+	}
+	result.Applied = true
+	return nil
+}
+
+func saveMigrationRecord(h ORM, record *MigrationRecord) error {
+	now := time.Now()
+	if record.Created == nil {
+		record.Created = &now
+	}
+	record.Updated = &now
+	ctx := NewContext()
+	ctx.Refresh = WaitForRefresh
+	return h.Save(ctx, record)
+}
+
+func backfill(h ORM, payload interface{}, fn BackfillFunc, dryRun bool, batchSize int) (int64, error) {
+	var changed int64
+	err := scanSchema(h, payload, batchSize, func(hits []rawHit, total int) error {
+		for _, hit := range hits {
+			o := newSchemaObject(payload)
+			if err := util.FromJSONBytes(hit.Source, o); err != nil {
+				return err
+			}
+			ok, err := fn(o)
+			if err != nil {
+				return fmt.Errorf("backfill of [%v]: %w", hit.ID, err)
+			}
+			if !ok {
+				continue
+			}
+			changed++
+			if dryRun {
+				continue
+			}
+			//save through the data operation hooks like any other write, as
+			//the system and without touching the timestamps
+			ctx := NewContext().DirectAccess()
+			ctx.Set(NoAutoUpdateUpdatedField, true)
+			WithModel(ctx, o)
+			if err := saveOrUpdate(h, ctx, o, nil, OpSave, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// ensureMigrationRecordSchema registers MigrationRecord on h once.
+func ensureMigrationRecordSchema(h ORM) error {
+	migrationsLock.Lock()
+	defer migrationsLock.Unlock()
+	if recordSchemas[h] {
+		return nil
+	}
+	if err := h.RegisterSchemaWithName(MigrationRecord{}, migrationRecordSchema); err != nil {
+		return err
+	}
+	recordSchemas[h] = true
+	return nil
+}
+
+// migrationRecords returns the records of schema on h by version.
+func migrationRecords(h ORM, schema string) (map[int]*MigrationRecord, error) {
+	records := map[int]*MigrationRecord{}
+	err := scanSchema(h, MigrationRecord{}, 500, func(hits []rawHit, total int) error {
+		for _, hit := range hits {
+			record := &MigrationRecord{}
+			if err := util.FromJSONBytes(hit.Source, record); err != nil {
+				return err
+			}
+			if record.Schema == schema {
+				records[record.Version] = record
+			}
+		}
+		return nil
+	})
+	return records, err
+}
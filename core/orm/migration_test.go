@@ -0,0 +1,30 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package orm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/core/util"
+)
+
+func TestRegisterMigration(t *testing.T) {
+	RegisterMigration("migration_test_schema", Migration{Version: 2, Name: "second"})
+	RegisterMigration("migration_test_schema", Migration{Version: 1, Name: "first"})
+
+	assert.Equal(t, "first", migrations["migration_test_schema"][0].Name)
+	assert.Equal(t, "second", migrations["migration_test_schema"][1].Name)
+
+	assert.Panics(t, func() {
+		RegisterMigration("migration_test_schema", Migration{Version: 2, Name: "again"})
+	})
+	assert.Panics(t, func() {
+		RegisterMigration("migration_test_schema", Migration{Name: "no version"})
+	})
+}
+
+func TestMigrationStepString(t *testing.T) {
+	assert.Equal(t, "add_field slug", AddField("slug", util.MapStr{"type": "keyword"}).String())
+	assert.Equal(t, "reindex", Reindex().String())
+}
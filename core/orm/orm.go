@@ -79,6 +79,10 @@ type Capabilities struct {
 	Nested         bool // nested-document queries
 	RequestBodyDSL bool // merging a raw ES DSL request body
 	Collapse       bool // field collapsing
+	Vector         bool // semantic (vector) and hybrid queries
+
+	Transactions       bool // multi-object writes through Transaction
+	AtomicTransactions bool // false: best-effort, failed commits are compensated
 }
 
 type CapabilitiesAPI interface {
@@ -96,6 +100,8 @@ type ORM interface {
 
 	CapabilitiesAPI
 
+	TransactionAPI
+
 	RegisterSchemaWithName(t interface{}, customizedName string) error
 
 	Save(ctx *Context, o interface{}) error
@@ -262,6 +268,11 @@ type SearchResult struct {
 	Error   *error      // pointer to error
 	Status  int         // HTTP status or internal status code
 	Payload interface{} // raw response body (e.g. JSON)
+
+	// NextCursor is set on cursor paginated queries, pass it to
+	// QueryBuilder.SearchAfter to fetch the next page. Empty once the last
+	// page was returned.
+	NextCursor string
 }
 
 func (r *SearchResult) IsError() bool {
@@ -274,6 +285,10 @@ func GetWithSystemFields(ctx *Context, o interface{}) (bool, error) {
 }
 
 func GetV2(ctx *Context, o interface{}) (bool, error) {
+	return getV2(getHandler(), ctx, o)
+}
+
+func getV2(h Tx, ctx *Context, o interface{}) (bool, error) {
 	//TODO ctx should always be there, panic after all legacy code removed
 	if ctx == nil {
 		ctx = NewContext()
@@ -292,7 +307,7 @@ func GetV2(ctx *Context, o interface{}) (bool, error) {
 		return false, err
 	}
 
-	exists, err := getHandler().Get(ctx, o)
+	exists, err := h.Get(ctx, o)
 	if err != nil || !exists {
 		return exists, err
 	}
@@ -468,6 +483,10 @@ func setFieldValue(v reflect.Value, param string, value interface{}) {
 }
 
 func Create(ctx *Context, o interface{}) error {
+	return create(getHandler(), ctx, o)
+}
+
+func create(h Tx, ctx *Context, o interface{}) error {
 	//TODO ctx should always be there, panic after all legacy code removed
 	if ctx == nil {
 		ctx = NewContext()
@@ -484,6 +503,8 @@ func Create(ctx *Context, o interface{}) error {
 		setFieldValue(rValue, "ID", util.GetUUID())
 	}
 
+	withPrevObject(ctx, nil)
+
 	time1 := time.Now()
 	setFieldValue(rValue, "Created", &time1)
 	setFieldValue(rValue, "Updated", &time1)
@@ -493,7 +514,7 @@ func Create(ctx *Context, o interface{}) error {
 		return err
 	}
 
-	err = getHandler().Create(ctx, o)
+	err = h.Create(ctx, o)
 	if err != nil {
 		return err
 	}
@@ -506,6 +527,10 @@ func Create(ctx *Context, o interface{}) error {
 }
 
 func GetPrevObject(ctx *Context, o interface{}) (interface{}, bool, error) {
+	return getPrevObject(getHandler(), ctx, o)
+}
+
+func getPrevObject(h Tx, ctx *Context, o interface{}) (interface{}, bool, error) {
 	v := reflect.ValueOf(o)
 	if v.Kind() != reflect.Ptr || v.IsNil() {
 		return nil, false, errors.New("o must be a non-nil pointer")
@@ -519,7 +544,8 @@ func GetPrevObject(ctx *Context, o interface{}) (interface{}, bool, error) {
 	prev := reflect.New(v.Type().Elem()).Interface()
 	setFieldValue(reflect.ValueOf(prev), "ID", id)
 
-	exists, err := GetWithSystemFields(ctx, prev)
+	ctx.Set(KeepSystemFields, true)
+	exists, err := getV2(h, ctx, prev)
 	return prev, exists, err
 }
 
@@ -686,18 +712,18 @@ func mergeMapToStruct(delta map[string]interface{}, v reflect.Value) error {
 }
 
 func Update(ctx *Context, o interface{}) error {
-	return saveOrUpdate(ctx, o, nil, OpUpdate, false)
+	return saveOrUpdate(getHandler(), ctx, o, nil, OpUpdate, false)
 }
 
 func UpdatePartialFields(ctx *Context, o interface{}, delta util.MapStr) error {
-	return saveOrUpdate(ctx, o, delta, OpUpdate, false)
+	return saveOrUpdate(getHandler(), ctx, o, delta, OpUpdate, false)
 }
 
 func Save(ctx *Context, o interface{}) error {
-	return saveOrUpdate(ctx, o, nil, OpSave, true)
+	return saveOrUpdate(getHandler(), ctx, o, nil, OpSave, true)
 }
 
-func saveOrUpdate(ctx *Context, o interface{}, delta util.MapStr, opType Operation, createIfNotExists bool) error {
+func saveOrUpdate(h Tx, ctx *Context, o interface{}, delta util.MapStr, opType Operation, createIfNotExists bool) error {
 	//TODO ctx should always be there, panic after all legacy code removed
 	if ctx == nil {
 		ctx = NewContext()
@@ -714,8 +740,9 @@ func saveOrUpdate(ctx *Context, o interface{}, delta util.MapStr, opType Operati
 	mergePartial := ctx.GetBool(MergePartialFieldsBeforeUpdate, true)
 
 	var exists bool
+	withPrevObject(ctx, nil)
 	if needCheckExists || mergePartial || deltaNotEmpty {
-		prev, found, err := GetPrevObject(ctx, o)
+		prev, found, err := getPrevObject(h, ctx, o)
 		if err != nil && !strings.Contains(err.Error(), "record not found") {
 			return err
 		}
@@ -726,6 +753,7 @@ func saveOrUpdate(ctx *Context, o interface{}, delta util.MapStr, opType Operati
 		}
 
 		if exists {
+			withPrevObject(ctx, prev)
 			if mergePartial && deltaNotEmpty {
 				// Seed the target with the stored state before overlaying the
 				// delta, so fields absent from the delta keep their stored
@@ -735,7 +763,11 @@ func saveOrUpdate(ctx *Context, o interface{}, delta util.MapStr, opType Operati
 				prevValue := reflect.ValueOf(prev)
 				if prevValue.Kind() == reflect.Ptr && !prevValue.IsNil() &&
 					prevValue.Type().Elem() == rValue.Type().Elem() && rValue.Elem().CanSet() {
+					// the seeded state carries the stored version, keep
+					// checking against the one the caller expects
+					expected := GetObjectVersion(o)
 					rValue.Elem().Set(prevValue.Elem())
+					SetObjectVersion(o, expected)
 				}
 				if err := mergeMapToStruct(delta, rValue); err != nil {
 					return err
@@ -765,9 +797,9 @@ func saveOrUpdate(ctx *Context, o interface{}, delta util.MapStr, opType Operati
 	// Handler call
 	switch opType {
 	case OpSave:
-		err = getHandler().Save(ctx, o)
+		err = h.Save(ctx, o)
 	case OpUpdate:
-		err = getHandler().Update(ctx, o)
+		err = h.Update(ctx, o)
 	}
 	if err != nil {
 		return err
@@ -781,6 +813,10 @@ func saveOrUpdate(ctx *Context, o interface{}, delta util.MapStr, opType Operati
 }
 
 func Delete(ctx *Context, o interface{}) error {
+	return deleteObject(getHandler(), ctx, o)
+}
+
+func deleteObject(h Tx, ctx *Context, o interface{}) error {
 	//TODO ctx should always be there, panic after all legacy code removed
 	if ctx == nil {
 		ctx = NewContext()
@@ -791,8 +827,9 @@ func Delete(ctx *Context, o interface{}) error {
 		return errors.New("only non-nil pointer to object is allowed")
 	}
 
+	withPrevObject(ctx, nil)
 	if ctx.GetBool(CheckExistsBeforeDelete, true) {
-		prev, exists, err := GetPrevObject(ctx, o)
+		prev, exists, err := getPrevObject(h, ctx, o)
 		if err != nil && !strings.Contains(err.Error(), "record not found") {
 			return err
 		}
@@ -802,6 +839,7 @@ func Delete(ctx *Context, o interface{}) error {
 		}
 
 		if exists {
+			withPrevObject(ctx, prev)
 			// Preserve system fields from the previous object
 			copySystemFields(prev, o)
 		}
@@ -812,7 +850,7 @@ func Delete(ctx *Context, o interface{}) error {
 		return err
 	}
 
-	err = getHandler().Delete(ctx, o)
+	err = h.Delete(ctx, o)
 	if err != nil {
 		return err
 	}
@@ -25,14 +25,21 @@ import (
 )
 
 // ContractModel is the canonical test document: scalars, a text field, a
-// date, and system fields — enough to exercise filters, sorts, full-text
-// and aggregations on every backend.
+// date, nested entries and system fields — enough to exercise filters,
+// sorts, full-text, nested queries and aggregations on every backend.
 type ContractModel struct {
 	orm.ORMObjectBase
-	Name   string `json:"name,omitempty" elastic_mapping:"name: { type: keyword }"`
-	Status string `json:"status,omitempty" elastic_mapping:"status: { type: keyword }"`
-	Body   string `json:"body,omitempty" elastic_mapping:"body: { type: text }"`
-	Age    int    `json:"age,omitempty" elastic_mapping:"age: { type: integer }"`
+	Name    string          `json:"name,omitempty" elastic_mapping:"name: { type: keyword }"`
+	Status  string          `json:"status,omitempty" elastic_mapping:"status: { type: keyword }"`
+	Body    string          `json:"body,omitempty" elastic_mapping:"body: { type: text }"`
+	Age     int             `json:"age,omitempty" elastic_mapping:"age: { type: integer }"`
+	Entries []ContractEntry `json:"entries,omitempty" elastic_mapping:"entries: { type: nested }"`
+}
+
+// ContractEntry is an element of ContractModel.Entries.
+type ContractEntry struct {
+	Role  string `json:"role,omitempty" elastic_mapping:"role: { type: keyword }"`
+	Scope string `json:"scope,omitempty" elastic_mapping:"scope: { type: keyword }"`
 }
 
 // RunContractTests executes the backend contract suite against a handler
@@ -46,10 +53,12 @@ func RunContractTests(t *testing.T, factory func() orm.ORM) {
 
 	t.Run("CRUD roundtrip", func(t *testing.T) { contractCRUD(t, handler) })
 	t.Run("filters", func(t *testing.T) { contractFilters(t, handler) })
+	t.Run("nested", func(t *testing.T) { contractNested(t, handler) })
 	t.Run("sort and pagination", func(t *testing.T) { contractSortPaginate(t, handler) })
 	t.Run("ES-shaped response", func(t *testing.T) { contractResponseShape(t, handler) })
 	t.Run("partial update preserves fields", func(t *testing.T) { contractPartialUpdate(t, handler) })
 	t.Run("terms aggregation", func(t *testing.T) { contractTermsAgg(t, handler) })
+	t.Run("transaction", func(t *testing.T) { contractTransaction(t, handler) })
 }
 
 func seedContractData(t *testing.T, h orm.ORM) {
@@ -62,6 +71,12 @@ func seedContractData(t *testing.T, h orm.ORM) {
 			Status: statuses[i%3],
 			Body:   fmt.Sprintf("body text number %d about sqlite and elastic", i),
 			Age:    20 + i,
+			// every doc has an admin and a viewer entry, on alternating
+			// scopes: only nested queries tell the elements apart
+			Entries: []ContractEntry{
+				{Role: "admin", Scope: fmt.Sprintf("s%d", i%2)},
+				{Role: "viewer", Scope: fmt.Sprintf("s%d", (i+1)%2)},
+			},
 		}
 		doc.ID = fmt.Sprintf("c%02d", i)
 		doc.Created = &now
@@ -130,6 +145,54 @@ func contractFilters(t *testing.T, h orm.ORM) {
 	})
 }
 
+func contractNested(t *testing.T, h orm.ORM) {
+	if !h.Capabilities().Nested {
+		t.Skip("backend does not support nested queries")
+	}
+
+	ctx := orm.NewContext()
+	orm.WithModel(ctx, &ContractModel{})
+	entry := func(role, scope string) *orm.Clause {
+		return orm.NestedQuery("entries", orm.MustQuery(
+			orm.TermQuery("entries.role", role),
+			orm.TermQuery("entries.scope", scope),
+		))
+	}
+
+	t.Run("conditions hold on the same element", func(t *testing.T) {
+		res, err := h.SearchV2(ctx, orm.NewQuery().Filter(entry("admin", "s0")))
+		require.NoError(t, err)
+		items, total, err := elastic.DecodeHits[ContractModel](res)
+		require.NoError(t, err)
+		assert.Equal(t, int64(15), total)
+		for _, item := range items {
+			assert.Equal(t, 0, (item.Age-20)%2, "admin on s0 is on even docs only: %s", item.ID)
+		}
+	})
+
+	t.Run("combined with document filters", func(t *testing.T) {
+		res, err := h.SearchV2(ctx, orm.NewQuery().
+			Filter(orm.TermQuery("status", "active")).
+			Filter(entry("viewer", "s0")))
+		require.NoError(t, err)
+		_, total, err := elastic.DecodeHits[ContractModel](res)
+		require.NoError(t, err)
+		// active is every 3rd doc, viewer on s0 every odd one: 3,9,15,21,27
+		assert.Equal(t, int64(5), total)
+	})
+
+	t.Run("excluded", func(t *testing.T) {
+		res, err := h.SearchV2(ctx, orm.NewQuery().
+			Filter(orm.TermQuery("status", "pending")).
+			Not(entry("admin", "s1")))
+		require.NoError(t, err)
+		_, total, err := elastic.DecodeHits[ContractModel](res)
+		require.NoError(t, err)
+		// pending is 1,4,...,28, admin on s1 the odd ones: 4,10,16,22,28 remain
+		assert.Equal(t, int64(5), total)
+	})
+}
+
 func contractSortPaginate(t *testing.T, h orm.ORM) {
 	ctx := orm.NewContext()
 	orm.WithModel(ctx, &ContractModel{})
@@ -209,3 +272,63 @@ func contractTermsAgg(t *testing.T, h orm.ORM) {
 	require.True(t, ok, "aggregations.by_status missing: %+v", resp.Aggregations)
 	assert.Len(t, byStatus.Buckets, 3)
 }
+
+func contractTransaction(t *testing.T, h orm.ORM) {
+	if !h.Capabilities().Transactions {
+		t.Skip("backend does not support transactions")
+	}
+
+	ctx := orm.NewContext()
+	require.NoError(t, orm.Transaction(ctx, func(tx orm.Tx) error {
+		for _, id := range []string{"tx-1", "tx-2"} {
+			doc := ContractModel{Name: id, Status: "active", Age: 1}
+			doc.ID = id
+			if err := tx.Create(ctx, &doc); err != nil {
+				return err
+			}
+		}
+		doc := ContractModel{Name: "tx-1", Status: "active", Age: 2}
+		doc.ID = "tx-1"
+		return tx.Update(ctx, &doc)
+	}))
+
+	got := ContractModel{}
+	got.ID = "tx-1"
+	exists, err := h.Get(nil, &got)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, 2, got.Age, "update staged after create in the same transaction")
+	got.ID = "tx-2"
+	exists, _ = h.Get(nil, &got)
+	assert.True(t, exists)
+
+	failure := fmt.Errorf("abort")
+	err = orm.Transaction(ctx, func(tx orm.Tx) error {
+		doc := ContractModel{Name: "tx-3", Status: "active"}
+		doc.ID = "tx-3"
+		if err := tx.Create(ctx, &doc); err != nil {
+			return err
+		}
+		del := ContractModel{}
+		del.ID = "tx-1"
+		if err := tx.Delete(ctx, &del); err != nil {
+			return err
+		}
+		return failure
+	})
+	assert.Equal(t, failure, err)
+
+	got = ContractModel{}
+	got.ID = "tx-3"
+	exists, _ = h.Get(nil, &got)
+	assert.False(t, exists, "create of a failed transaction discarded")
+	got.ID = "tx-1"
+	exists, _ = h.Get(nil, &got)
+	assert.True(t, exists, "delete of a failed transaction discarded")
+
+	for _, id := range []string{"tx-1", "tx-2"} {
+		doc := ContractModel{}
+		doc.ID = id
+		require.NoError(t, h.Delete(nil, &doc))
+	}
+}
@@ -120,6 +120,10 @@ type QueryBuilder struct {
 	allowRequestBodyBytes bool
 	requestBodyBytes      []byte
 	Aggs                  map[string]Aggregation
+
+	//cursor pagination, see SearchAfter
+	cursorEnabled bool
+	searchAfter   string
 }
 
 func NewQuery() *QueryBuilder {
@@ -150,3 +150,29 @@ func runSearchOperationHooks(op Operation, ctx *Context, qb *QueryBuilder) error
 
 	return nil
 }
+
+// GetAdapter returns the ORM handler registered under name, the active
+// handler when name is empty.
+func GetAdapter(name string) (ORM, bool) {
+	if name == "" {
+		return handler, handler != nil
+	}
+	h, ok := adapters[name]
+	return h, ok
+}
+
+// GetAdapterNames lists the names ORM handlers were registered with.
+func GetAdapterNames() []string {
+	names := make([]string, 0, len(adapters))
+	for k := range adapters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetRegisteredSchemas returns the schemas InitSchema registers, keyed by
+// their index name.
+func GetRegisteredSchemas() []util.KeyValue {
+	return append([]util.KeyValue{}, registeredSchemas...)
+}
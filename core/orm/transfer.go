@@ -0,0 +1,221 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package orm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/progress"
+	"infini.sh/framework/core/util"
+)
+
+// TransferRecord is one line of the NDJSON stream Export writes and Import
+// reads. Schema is the name the type was registered with, so a stream taken
+// from one backend loads into another whatever its index prefix or table
+// naming. Source is the stored document, _system fields and timestamps
+// included.
+type TransferRecord struct {
+	Schema string          `json:"schema"`
+	ID     string          `json:"id"`
+	Source json.RawMessage `json:"source"`
+}
+
+type TransferOptions struct {
+	// Schemas limits the transfer to these registered schemas, all when empty.
+	Schemas []string
+	// BatchSize is the page size of the export, 500 by default.
+	BatchSize int
+}
+
+// TransferStats counts the objects moved per schema.
+type TransferStats map[string]int64
+
+const transferProgressCategory = "orm_transfer"
+
+func (opts *TransferOptions) selected(schema string) bool {
+	if opts == nil || len(opts.Schemas) == 0 {
+		return true
+	}
+	return util.StringInArray(opts.Schemas, schema)
+}
+
+func newSchemaObject(payload interface{}) interface{} {
+	t := reflect.TypeOf(payload)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return reflect.New(t).Interface()
+}
+
+// Export streams every registered schema out of h as NDJSON TransferRecords.
+// It pages with SearchAfter, so it holds one page in memory at a time.
+func Export(h ORM, w io.Writer, opts *TransferOptions) (TransferStats, error) {
+	batchSize := 500
+	if opts != nil && opts.BatchSize > 0 {
+		batchSize = opts.BatchSize
+	}
+
+	stats := TransferStats{}
+	writer := bufio.NewWriter(w)
+	for _, schema := range registeredSchemas {
+		if !opts.selected(schema.Key) {
+			continue
+		}
+
+		count, err := exportSchema(h, writer, schema, batchSize)
+		stats[schema.Key] = count
+		if err != nil {
+			return stats, errors.Errorf("failed to export [%v]: %v", schema.Key, err)
+		}
+		log.Debugf("exported %v objects of [%v]", count, schema.Key)
+	}
+	return stats, writer.Flush()
+}
+
+func exportSchema(h ORM, w *bufio.Writer, schema util.KeyValue, batchSize int) (int64, error) {
+	var count int64
+	err := scanSchema(h, schema.Payload, batchSize, func(hits []rawHit, total int) error {
+		for _, hit := range hits {
+			line := util.MustToJSONBytes(TransferRecord{Schema: schema.Key, ID: hit.ID, Source: hit.Source})
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			if err := w.WriteByte('\n'); err != nil {
+				return err
+			}
+		}
+		count += int64(len(hits))
+		progress.IncreaseWithTotal(transferProgressCategory, "export "+schema.Key, len(hits), total)
+		return nil
+	})
+	return count, err
+}
+
+type rawHit struct {
+	ID     string          `json:"_id"`
+	Source json.RawMessage `json:"_source"`
+}
+
+// scanSchema pages through every stored object of the schema payload with
+// SearchAfter and hands each page to fn, along with the total hit count.
+func scanSchema(h ORM, payload interface{}, batchSize int, fn func(hits []rawHit, total int) error) error {
+	return scanQuery(h, payload, NewQuery().Size(batchSize), fn)
+}
+
+// scanQuery is scanSchema limited to the objects qb matches.
+func scanQuery(h ORM, payload interface{}, qb *QueryBuilder, fn func(hits []rawHit, total int) error) error {
+	cursor := ""
+	for {
+		ctx := NewContext()
+		WithModel(ctx, newSchemaObject(payload))
+		qb.SearchAfter(cursor)
+
+		result, err := h.SearchV2(ctx, qb)
+		if err != nil {
+			return err
+		}
+		data, ok := result.Payload.([]byte)
+		if !ok {
+			return errors.Errorf("unexpected search payload %T", result.Payload)
+		}
+
+		response := struct {
+			Hits struct {
+				Total interface{} `json:"total"`
+				Hits  []rawHit    `json:"hits"`
+			} `json:"hits"`
+		}{}
+		if err := util.FromJSONBytes(data, &response); err != nil {
+			return err
+		}
+
+		if err := fn(response.Hits.Hits, transferTotal(response.Hits.Total)); err != nil {
+			return err
+		}
+
+		if result.NextCursor == "" {
+			return nil
+		}
+		cursor = result.NextCursor
+	}
+}
+
+// transferTotal reads hits.total in both the object and the legacy number
+// form.
+func transferTotal(total interface{}) int {
+	switch v := total.(type) {
+	case float64:
+		return int(v)
+	case map[string]interface{}:
+		if value, ok := v["value"].(float64); ok {
+			return int(value)
+		}
+	}
+	return 0
+}
+
+// Import loads an Export stream into h. Objects are written with the
+// backend's Save, skipping the data operation hooks, so ids, _system fields
+// and Created/Updated come through unchanged and existing objects with the
+// same id are overwritten.
+func Import(h ORM, r io.Reader, opts *TransferOptions) (TransferStats, error) {
+	schemas := map[string]interface{}{}
+	for _, v := range registeredSchemas {
+		schemas[v.Key] = v.Payload
+	}
+
+	stats := TransferStats{}
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(data)) > 0 {
+			if err := importRecord(h, schemas, data, opts, stats); err != nil {
+				return stats, fmt.Errorf("line %v: %w", line, err)
+			}
+		}
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+}
+
+func importRecord(h ORM, schemas map[string]interface{}, data []byte, opts *TransferOptions, stats TransferStats) error {
+	record := TransferRecord{}
+	if err := util.FromJSONBytes(data, &record); err != nil {
+		return err
+	}
+	if !opts.selected(record.Schema) {
+		return nil
+	}
+	payload, ok := schemas[record.Schema]
+	if !ok {
+		return errors.Errorf("schema [%v] is not registered", record.Schema)
+	}
+
+	o := newSchemaObject(payload)
+	if err := util.FromJSONBytes(record.Source, o); err != nil {
+		return err
+	}
+	if obj, ok := o.(Object); ok && obj.GetID() == "" {
+		obj.SetID(record.ID)
+	}
+
+	ctx := NewContext()
+	WithModel(ctx, o)
+	if err := h.Save(ctx, o); err != nil {
+		return err
+	}
+	stats[record.Schema]++
+	progress.IncreaseWithTotal(transferProgressCategory, "import "+record.Schema, 1, int(stats[record.Schema]))
+	return nil
+}
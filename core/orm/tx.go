@@ -0,0 +1,99 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package orm
+
+import (
+	"infini.sh/framework/core/errors"
+)
+
+// Tx is the write surface handed to a Transaction callback. Its methods
+// mirror the single-object ORM calls and only take effect when the
+// callback returns nil.
+type Tx interface {
+	Get(ctx *Context, o interface{}) (bool, error)
+
+	Create(ctx *Context, o interface{}) error
+
+	Save(ctx *Context, o interface{}) error
+
+	Update(ctx *Context, o interface{}) error
+
+	Delete(ctx *Context, o interface{}) error
+}
+
+// TransactionAPI groups writes to several objects. fn's writes are committed
+// when it returns nil and discarded when it returns an error or panics.
+// Capabilities().AtomicTransactions tells whether the backend does this
+// atomically or on a best-effort basis.
+type TransactionAPI interface {
+	Transaction(ctx *Context, fn func(tx Tx) error) error
+}
+
+// ErrTransactionRolledBack is wrapped by backends that could not commit a
+// transaction and undid its writes instead.
+var ErrTransactionRolledBack = errors.New("transaction rolled back")
+
+// Transaction runs fn inside a backend transaction. The tx passed to fn goes
+// through the same id/timestamp handling and data operation hooks as the
+// package level Create, Save, Update, Delete and GetV2; post hooks fire as
+// each write is staged, not after the commit. Watchers see the writes once
+// the transaction committed.
+func Transaction(ctx *Context, fn func(tx Tx) error) error {
+	//TODO ctx should always be there, panic after all legacy code removed
+	if ctx == nil {
+		ctx = NewContext()
+	}
+
+	changes := &txChanges{}
+	err := getHandler().Transaction(ctx, func(tx Tx) error {
+		return fn(&hookedTx{tx: tx, changes: changes})
+	})
+	if err == nil {
+		changes.publish()
+	}
+	return err
+}
+
+// hookedTx routes the package level write flow to a backend Tx.
+type hookedTx struct {
+	tx      Tx
+	changes *txChanges
+}
+
+// stage returns the context of a write, collecting its change events
+// until done is called.
+func (h *hookedTx) stage(ctx *Context) (*Context, func()) {
+	if ctx == nil {
+		ctx = NewContext()
+	}
+	withTxChanges(ctx, h.changes)
+	return ctx, func() { withTxChanges(ctx, nil) }
+}
+
+func (h *hookedTx) Get(ctx *Context, o interface{}) (bool, error) {
+	return getV2(h.tx, ctx, o)
+}
+
+func (h *hookedTx) Create(ctx *Context, o interface{}) error {
+	ctx, done := h.stage(ctx)
+	defer done()
+	return create(h.tx, ctx, o)
+}
+
+func (h *hookedTx) Save(ctx *Context, o interface{}) error {
+	ctx, done := h.stage(ctx)
+	defer done()
+	return saveOrUpdate(h.tx, ctx, o, nil, OpSave, true)
+}
+
+func (h *hookedTx) Update(ctx *Context, o interface{}) error {
+	ctx, done := h.stage(ctx)
+	defer done()
+	return saveOrUpdate(h.tx, ctx, o, nil, OpUpdate, false)
+}
+
+func (h *hookedTx) Delete(ctx *Context, o interface{}) error {
+	ctx, done := h.stage(ctx)
+	defer done()
+	return deleteObject(h.tx, ctx, o)
+}
@@ -0,0 +1,86 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package orm
+
+import (
+	"sync"
+
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/param"
+)
+
+// ErrNoTextEmbedder is returned by EmbedText when no embedder is registered.
+var ErrNoTextEmbedder = errors.New("no text embedder is registered")
+
+// TextEmbedder encodes text into a vector. Backends that search vectors
+// themselves (sqlite) use it to encode the query_text of semantic queries,
+// Elasticsearch does this server side.
+type TextEmbedder func(text string) ([]float32, error)
+
+var (
+	embedderLock sync.RWMutex
+	textEmbedder TextEmbedder
+)
+
+// RegisterTextEmbedder sets the embedder used by EmbedText, it must encode
+// queries with the same model as the stored vectors.
+func RegisterTextEmbedder(e TextEmbedder) {
+	embedderLock.Lock()
+	defer embedderLock.Unlock()
+	textEmbedder = e
+}
+
+// EmbedText encodes text with the registered embedder.
+func EmbedText(text string) ([]float32, error) {
+	embedderLock.RLock()
+	e := textEmbedder
+	embedderLock.RUnlock()
+	if e == nil {
+		return nil, ErrNoTextEmbedder
+	}
+	return e(text)
+}
+
+// SemanticVectorQuery creates a semantic query from an already encoded
+// vector, it returns the candidates nearest documents (0 for the default).
+func SemanticVectorQuery(field string, vector []float32, candidates int) *Clause {
+	params := &param.Parameters{}
+	params.Set("query_vector", vector)
+	if candidates > 0 {
+		params.Set("candidates", candidates)
+	}
+	return newLeaf(field, QuerySemantic, nil, params)
+}
+
+// QueryVector returns the vector of a semantic clause, the query_vector it
+// carries or its query_text encoded by the registered embedder.
+func QueryVector(clause *Clause) ([]float32, error) {
+	if clause == nil || clause.Parameters == nil {
+		return nil, errors.New("semantic query has neither query_vector nor query_text")
+	}
+	switch v := clause.Parameters.Get("query_vector").(type) {
+	case []float32:
+		return v, nil
+	case []float64:
+		out := make([]float32, len(v))
+		for i, f := range v {
+			out[i] = float32(f)
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]float32, len(v))
+		for i, f := range v {
+			n, ok := f.(float64)
+			if !ok {
+				return nil, errors.Errorf("invalid query_vector element: %v", f)
+			}
+			out[i] = float32(n)
+		}
+		return out, nil
+	}
+	text, ok := clause.Parameters.Get("query_text").(string)
+	if !ok || text == "" {
+		return nil, errors.New("semantic query has neither query_vector nor query_text")
+	}
+	return EmbedText(text)
+}
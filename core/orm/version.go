@@ -0,0 +1,110 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package orm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ObjectVersion is the optimistic concurrency token of a stored object.
+// Elasticsearch fills both fields from _seq_no/_primary_term, sqlite keeps a
+// per-row counter in SeqNo and leaves PrimaryTerm at zero.
+type ObjectVersion struct {
+	SeqNo       int64 `json:"_seq_no"`
+	PrimaryTerm int64 `json:"_primary_term"`
+}
+
+// Versioned is implemented by objects that opt into optimistic concurrency
+// control. Get fills the version in, Update and Save only succeed while the
+// stored object is still at the version the object carries, and set the new
+// one afterwards. Objects with a nil version are written unconditionally.
+type Versioned interface {
+	GetObjectVersion() *ObjectVersion
+	SetObjectVersion(v *ObjectVersion)
+}
+
+// VersionedObjectBase opts a model into Versioned when embedded next to
+// ORMObjectBase, the version itself is never stored in the document.
+type VersionedObjectBase struct {
+	ObjectVersion *ObjectVersion `json:"-"`
+}
+
+func (obj *VersionedObjectBase) GetObjectVersion() *ObjectVersion {
+	return obj.ObjectVersion
+}
+
+func (obj *VersionedObjectBase) SetObjectVersion(v *ObjectVersion) {
+	obj.ObjectVersion = v
+}
+
+// GetObjectVersion returns nil when o does not opt in or carries no version.
+func GetObjectVersion(o interface{}) *ObjectVersion {
+	if v, ok := o.(Versioned); ok {
+		return v.GetObjectVersion()
+	}
+	return nil
+}
+
+// SetObjectVersion is a no-op for objects that do not opt in.
+func SetObjectVersion(o interface{}, version *ObjectVersion) {
+	if v, ok := o.(Versioned); ok {
+		v.SetObjectVersion(version)
+	}
+}
+
+// VersionConflictError is returned by Update and Save when the stored object
+// moved past the expected version, errors.HTTPCode maps it to 409.
+type VersionConflictError struct {
+	ID       string
+	Expected ObjectVersion
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict on [%v], expected seq_no [%v] and primary_term [%v]", e.ID, e.Expected.SeqNo, e.Expected.PrimaryTerm)
+}
+
+func (e *VersionConflictError) HTTPCode() int {
+	return http.StatusConflict
+}
+
+func (e *VersionConflictError) Cause() error {
+	return nil
+}
+
+func NewVersionConflictError(id string, expected *ObjectVersion) error {
+	err := &VersionConflictError{ID: id}
+	if expected != nil {
+		err.Expected = *expected
+	}
+	return err
+}
+
+func IsVersionConflict(err error) bool {
+	var conflict *VersionConflictError
+	return errors.As(err, &conflict)
+}
+
+// ParseObjectVersion reads the expected version from the if_seq_no and
+// if_primary_term query parameters, nil when if_seq_no is absent.
+func ParseObjectVersion(req *http.Request) (*ObjectVersion, error) {
+	query := req.URL.Query()
+	seqNo := query.Get("if_seq_no")
+	if seqNo == "" {
+		return nil, nil
+	}
+
+	v := &ObjectVersion{}
+	var err error
+	if v.SeqNo, err = strconv.ParseInt(seqNo, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid if_seq_no: %v", seqNo)
+	}
+	if term := query.Get("if_primary_term"); term != "" {
+		if v.PrimaryTerm, err = strconv.ParseInt(term, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid if_primary_term: %v", term)
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,476 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package orm
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/util"
+)
+
+type ChangeType string
+
+const (
+	ChangeCreate ChangeType = "create"
+	ChangeUpdate ChangeType = "update"
+	ChangeDelete ChangeType = "delete"
+)
+
+// ChangeSource tells whether a change was written through this process or
+// picked up from the backend.
+type ChangeSource string
+
+const (
+	ChangeSourceLocal ChangeSource = "local"
+	ChangeSourcePoll  ChangeSource = "poll"
+)
+
+// ChangeEvent is one write to a watched schema. Before and After are
+// pointers to the registered schema type, Before is nil for creates and
+// when the previous state is unknown, After is nil for deletes.
+type ChangeEvent struct {
+	Type   ChangeType
+	Source ChangeSource
+	Schema string
+	ID     string
+	Before interface{}
+	After  interface{}
+	Time   time.Time
+}
+
+// WatchFilter selects the events a watcher receives, nil receives all.
+type WatchFilter func(event *ChangeEvent) bool
+
+var (
+	// WatchPollInterval is how often watched schemas are checked for
+	// writes made by other processes.
+	WatchPollInterval = 10 * time.Second
+	// WatchFullScanEvery makes every n-th poll a full scan, which is the
+	// only way to see deletes and writes that did not move `updated`.
+	WatchFullScanEvery = 6
+	// watchClockSkew widens the incremental poll window, so writes stamped
+	// by another node with a slightly late clock are not missed.
+	watchClockSkew = 5 * time.Second
+)
+
+// ErrWatchNotCancellable is returned by Watch for a context that is never
+// done, its watcher and tracker would never stop.
+var ErrWatchNotCancellable = errors.New("watch needs a cancellable context")
+
+// Watch streams the changes of a schema registered with
+// RegisterSchemaWithIndexName until ctx is done, ctx has to be cancellable,
+// eg: NewContextWithParent with a context.WithCancel. Writes through the
+// package level functions of this process arrive right after they return,
+// or after the commit inside a Transaction, see PublishChange; writes by
+// other processes arrive within WatchPollInterval. Events are queued per
+// watcher, a slow reader never blocks writers nor loses events.
+func Watch(ctx *Context, schema string, filter WatchFilter) (<-chan ChangeEvent, error) {
+	if ctx == nil || ctx.Done() == nil {
+		return nil, ErrWatchNotCancellable
+	}
+
+	hub, err := getWatchHub(schema)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{filter: filter, out: make(chan ChangeEvent), notify: make(chan struct{}, 1), done: ctx.Done()}
+	hub.subscribe(w)
+	go func() {
+		w.run()
+		hub.unsubscribe(w)
+	}()
+	return w.out, nil
+}
+
+// PublishChange feeds a local write into the watchers of its schema, it is
+// meant to be called from a data operation post hook. The replaced state is
+// read from GetPrevObjectFromContext. Writes staged by a Transaction are
+// held back until it commits, and dropped if it does not.
+func PublishChange(ctx *Context, op Operation, o interface{}) {
+	if o == nil {
+		return
+	}
+	hub := lookupWatchHub(reflect.TypeOf(o))
+	if hub == nil {
+		return
+	}
+
+	var changeType ChangeType
+	switch op {
+	case OpCreate:
+		changeType = ChangeCreate
+	case OpUpdate, OpSave:
+		changeType = ChangeUpdate
+	case OpDelete:
+		changeType = ChangeDelete
+	default:
+		return
+	}
+	change := stagedChange{hub: hub, changeType: changeType, before: GetPrevObjectFromContext(ctx), after: o}
+	if changes := getTxChanges(ctx); changes != nil {
+		changes.add(change)
+		return
+	}
+	change.publish()
+}
+
+// stagedChange is a local write waiting for its transaction to commit.
+type stagedChange struct {
+	hub        *watchHub
+	changeType ChangeType
+	before     interface{}
+	after      interface{}
+}
+
+func (c stagedChange) publish() {
+	c.hub.local(c.changeType, c.before, c.after)
+}
+
+// txChanges collects the local writes of a transaction.
+type txChanges struct {
+	lock    sync.Mutex
+	changes []stagedChange
+}
+
+func (t *txChanges) add(change stagedChange) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.changes = append(t.changes, change)
+}
+
+func (t *txChanges) publish() {
+	t.lock.Lock()
+	changes := t.changes
+	t.changes = nil
+	t.lock.Unlock()
+	for _, change := range changes {
+		change.publish()
+	}
+}
+
+type watcher struct {
+	filter WatchFilter
+	out    chan ChangeEvent
+	notify chan struct{}
+	done   <-chan struct{}
+
+	lock  sync.Mutex
+	queue []ChangeEvent
+}
+
+func (w *watcher) push(event ChangeEvent) {
+	if w.filter != nil && !w.filter(&event) {
+		return
+	}
+	w.lock.Lock()
+	w.queue = append(w.queue, event)
+	w.lock.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher) run() {
+	defer close(w.out)
+	for {
+		w.lock.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.lock.Unlock()
+
+		for _, event := range queue {
+			select {
+			case w.out <- event:
+			case <-w.done:
+				return
+			}
+		}
+
+		select {
+		case <-w.notify:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// watchEntry is the last known state of one object.
+type watchEntry struct {
+	updated time.Time
+	// raw is the stored document as last polled, nil after a local write
+	// until the next poll confirms it
+	raw []byte
+	obj interface{}
+	// written is when a local write set the entry, a poll started before
+	// may not have seen it
+	written time.Time
+	// deleted marks a delete, until the next full scan confirms it
+	deleted bool
+}
+
+// announced tells if the entry is known at the updated time of obj
+// already, zero times never match.
+func (entry *watchEntry) announced(obj interface{}) bool {
+	updated := getUpdated(obj)
+	return !entry.deleted && !updated.IsZero() && !updated.After(entry.updated)
+}
+
+// watchHub tracks one schema for all of its watchers.
+type watchHub struct {
+	schema  string
+	payload interface{}
+
+	lock      sync.Mutex
+	watchers  map[*watcher]bool
+	entries   map[string]*watchEntry
+	watermark time.Time
+	polls     int
+	stop      chan struct{}
+}
+
+var (
+	watchHubsLock sync.Mutex
+	watchHubs     = map[string]*watchHub{}
+	watchHubTypes = map[reflect.Type]*watchHub{}
+)
+
+func schemaType(o interface{}) reflect.Type {
+	t := reflect.TypeOf(o)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+func getWatchHub(schema string) (*watchHub, error) {
+	watchHubsLock.Lock()
+	defer watchHubsLock.Unlock()
+	if hub, ok := watchHubs[schema]; ok {
+		return hub, nil
+	}
+
+	var payload interface{}
+	for _, v := range registeredSchemas {
+		if v.Key == schema {
+			payload = v.Payload
+			break
+		}
+	}
+	if payload == nil {
+		return nil, errors.Errorf("schema [%v] is not registered", schema)
+	}
+
+	hub := &watchHub{schema: schema, payload: payload, watchers: map[*watcher]bool{}}
+	watchHubs[schema] = hub
+	watchHubTypes[schemaType(payload)] = hub
+	return hub, nil
+}
+
+func lookupWatchHub(t reflect.Type) *watchHub {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	watchHubsLock.Lock()
+	defer watchHubsLock.Unlock()
+	return watchHubTypes[t]
+}
+
+func (hub *watchHub) subscribe(w *watcher) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	hub.watchers[w] = true
+	if hub.stop == nil {
+		hub.stop = make(chan struct{})
+		hub.entries = nil
+		go hub.poll(hub.stop, WatchPollInterval, WatchFullScanEvery)
+	}
+}
+
+func (hub *watchHub) unsubscribe(w *watcher) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	delete(hub.watchers, w)
+	if len(hub.watchers) == 0 && hub.stop != nil {
+		close(hub.stop)
+		hub.stop = nil
+	}
+}
+
+func (hub *watchHub) publish(event ChangeEvent) {
+	for w := range hub.watchers {
+		w.push(event)
+	}
+}
+
+func (hub *watchHub) local(changeType ChangeType, before, after interface{}) {
+	id := getObjectID(after)
+	if id == "" {
+		return
+	}
+
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if len(hub.watchers) == 0 {
+		return
+	}
+
+	now := time.Now()
+	entry, known := hub.entries[id]
+	event := ChangeEvent{Type: changeType, Source: ChangeSourceLocal, Schema: hub.schema, ID: id, Before: before, Time: now}
+	if changeType == ChangeDelete {
+		if hub.entries != nil {
+			if known && entry.deleted {
+				return //a poll reported it already
+			}
+			hub.entries[id] = &watchEntry{deleted: true, written: now}
+		}
+		if event.Before == nil {
+			event.Before = after
+		}
+	} else {
+		if known && entry.announced(after) {
+			return //a poll reported this version already
+		}
+		event.After = after
+		if hub.entries != nil {
+			//the next poll sees this write, keep it from firing twice
+			hub.entries[id] = &watchEntry{updated: getUpdated(after), obj: after, written: now}
+		}
+	}
+	hub.publish(event)
+}
+
+func (hub *watchHub) poll(stop chan struct{}, interval time.Duration, fullScanEvery int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	hub.pollOnce(stop, fullScanEvery)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			hub.pollOnce(stop, fullScanEvery)
+		}
+	}
+}
+
+func (hub *watchHub) pollOnce(stop chan struct{}, fullScanEvery int) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("failed to poll [%v] for changes: %v", hub.schema, r)
+		}
+	}()
+
+	hub.lock.Lock()
+	if hub.stop != stop {
+		//superseded by a newer tracker
+		hub.lock.Unlock()
+		return
+	}
+	initial := hub.entries == nil
+	started := time.Now()
+	full := initial || (fullScanEvery > 0 && hub.polls%fullScanEvery == 0)
+	since := hub.watermark.Add(-watchClockSkew)
+	hub.polls++
+	hub.lock.Unlock()
+
+	qb := NewQuery().Size(500)
+	if !full {
+		qb.Filter(Range("updated").Gte(since.Format(time.RFC3339Nano)))
+	}
+	seen := map[string]bool{}
+	changes := map[string]rawHit{}
+	err := scanQuery(getHandler(), hub.payload, qb, func(hits []rawHit, total int) error {
+		for _, hit := range hits {
+			seen[hit.ID] = true
+			changes[hit.ID] = hit
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnf("failed to poll [%v] for changes: %v", hub.schema, err)
+		return
+	}
+
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.stop != stop {
+		return
+	}
+	if initial {
+		hub.entries = map[string]*watchEntry{}
+	}
+
+	for id, hit := range changes {
+		obj := newSchemaObject(hub.payload)
+		if err := util.FromJSONBytes(hit.Source, obj); err != nil {
+			log.Warnf("failed to decode [%v][%v]: %v", hub.schema, id, err)
+			continue
+		}
+		updated := getUpdated(obj)
+		if updated.After(hub.watermark) {
+			hub.watermark = updated
+		}
+
+		entry, ok := hub.entries[id]
+		if ok && entry.raw == nil && entry.written.After(started) && (entry.deleted || entry.announced(obj)) {
+			continue //read before a newer local write
+		}
+		hub.entries[id] = &watchEntry{updated: updated, raw: hit.Source, obj: obj}
+		if initial {
+			continue
+		}
+		if !ok || entry.deleted {
+			hub.publish(ChangeEvent{Type: ChangeCreate, Source: ChangeSourcePoll, Schema: hub.schema, ID: id, After: obj, Time: time.Now()})
+			continue
+		}
+		if entry.raw == nil {
+			if entry.updated.Equal(updated) {
+				continue //confirms a local write
+			}
+		} else if bytes.Equal(entry.raw, hit.Source) {
+			continue
+		}
+		hub.publish(ChangeEvent{Type: ChangeUpdate, Source: ChangeSourcePoll, Schema: hub.schema, ID: id, Before: entry.obj, After: obj, Time: time.Now()})
+	}
+
+	if full && !initial {
+		for id, entry := range hub.entries {
+			if seen[id] || entry.raw == nil && entry.written.After(started) {
+				continue
+			}
+			if entry.deleted {
+				delete(hub.entries, id)
+				continue
+			}
+			//keep a tombstone until the next full scan, for the local delete
+			hub.entries[id] = &watchEntry{deleted: true}
+			hub.publish(ChangeEvent{Type: ChangeDelete, Source: ChangeSourcePoll, Schema: hub.schema, ID: id, Before: entry.obj, Time: time.Now()})
+		}
+	}
+}
+
+func getObjectID(o interface{}) string {
+	if obj, ok := o.(Object); ok {
+		return obj.GetID()
+	}
+	_, id := getFieldStringValue(reflect.ValueOf(o), "ID")
+	return id
+}
+
+func getUpdated(o interface{}) time.Time {
+	v := findFieldValue(reflect.ValueOf(o), "Updated")
+	if v.IsValid() && v.CanInterface() {
+		if t, ok := v.Interface().(*time.Time); ok && t != nil {
+			return *t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,60 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package orm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type watchDedupItem struct {
+	ORMObjectBase
+	Name string `json:"name,omitempty"`
+}
+
+func TestWatchHubDedupesLocalAndPolledWrites(t *testing.T) {
+	hub := &watchHub{schema: "dedup", payload: watchDedupItem{}, watchers: map[*watcher]bool{}, entries: map[string]*watchEntry{}}
+	w := &watcher{notify: make(chan struct{}, 1)}
+	hub.watchers[w] = true
+	drain := func() []ChangeEvent {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		queue := w.queue
+		w.queue = nil
+		return queue
+	}
+
+	t1 := time.Now()
+	t2 := t1.Add(time.Second)
+	item := func(updated time.Time, name string) *watchDedupItem {
+		return &watchDedupItem{ORMObjectBase: ORMObjectBase{ID: "a", Updated: &updated}, Name: name}
+	}
+
+	//a poll reported the version before the local hook ran
+	hub.entries["a"] = &watchEntry{updated: t1, raw: []byte(`{}`), obj: item(t1, "v1")}
+	hub.local(ChangeUpdate, nil, item(t1, "v1"))
+	assert.Empty(t, drain())
+
+	//a newer local version is announced once
+	hub.local(ChangeUpdate, nil, item(t2, "v2"))
+	events := drain()
+	require.Len(t, events, 1)
+	assert.Equal(t, "v2", events[0].After.(*watchDedupItem).Name)
+	hub.local(ChangeUpdate, nil, item(t2, "v2"))
+	assert.Empty(t, drain())
+
+	//a delete reported by a poll is not announced again
+	hub.entries["a"] = &watchEntry{deleted: true}
+	hub.local(ChangeDelete, nil, item(t2, "v2"))
+	assert.Empty(t, drain())
+}
+
+func TestWatchNeedsCancellableContext(t *testing.T) {
+	_, err := Watch(NewContext(), "dedup", nil)
+	assert.Equal(t, ErrWatchNotCancellable, err)
+	_, err = Watch(nil, "dedup", nil)
+	assert.Equal(t, ErrWatchNotCancellable, err)
+}
@@ -62,6 +62,9 @@ type AdvancedQueueAPI interface {
 	GetOffset(k *QueueConfig, consumer *ConsumerConfig) (Offset, error)
 	DeleteOffset(k *QueueConfig, consumer *ConsumerConfig) error
 	CommitOffset(k *QueueConfig, consumer *ConsumerConfig, offset Offset) (bool, error)
+	//OffsetForTime returns the offset of the first message written at or after t,
+	//the latest offset if there is none
+	OffsetForTime(k *QueueConfig, t time.Time) (Offset, error)
 
 	AcquireConsumer(k *QueueConfig, consumer *ConsumerConfig) (ConsumerAPI, error)
 	ReleaseConsumer(k *QueueConfig, c *ConsumerConfig, consumer ConsumerAPI) error
@@ -449,6 +452,58 @@ func LatestOffset(k *QueueConfig) Offset {
 	panic(errors.New("handler is not registered"))
 }
 
+func OffsetForTime(k *QueueConfig, t time.Time) (Offset, error) {
+	if k == nil || k.ID == "" {
+		panic(errors.New("queue name can't be nil"))
+	}
+
+	handler := getAdvancedHandler(k)
+	if handler != nil {
+		return handler.OffsetForTime(k, t)
+	}
+	panic(errors.New("handler is not registered"))
+}
+
+// PartitionedOffsetAPI is implemented by queues spread over partitions, where
+// one Offset only covers one partition, they reset a consumer on all of them.
+type PartitionedOffsetAPI interface {
+	ResetOffsetForTime(k *QueueConfig, consumer *ConsumerConfig, t time.Time) (Offset, error)
+}
+
+// ResetOffsetForTime moves the committed offset of the consumer to the first
+// message written at or after t, the version is bumped so commits of messages
+// fetched before the reset are rejected. Partitioned queues move every
+// partition instead, see PartitionedOffsetAPI.
+func ResetOffsetForTime(k *QueueConfig, consumer *ConsumerConfig, t time.Time) (Offset, error) {
+	if k == nil || k.ID == "" {
+		panic(errors.New("queue name can't be nil"))
+	}
+
+	if h, ok := getHandler(k).(PartitionedOffsetAPI); ok {
+		return h.ResetOffsetForTime(k, consumer, t)
+	}
+
+	offset, err := OffsetForTime(k, t)
+	if err != nil {
+		return offset, err
+	}
+
+	current, err := GetOffset(k, consumer)
+	if err != nil {
+		return offset, err
+	}
+	offset.Version = current.Version + 1
+
+	ok, err := CommitOffset(k, consumer, offset)
+	if err != nil {
+		return offset, err
+	}
+	if !ok {
+		return offset, errors.Errorf("failed to commit offset %v for consumer %v", offset, consumer.Key())
+	}
+	return offset, nil
+}
+
 func GetQueues() map[string][]string {
 	results := map[string][]string{}
 	for q, handler := range adapters {
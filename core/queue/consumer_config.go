@@ -64,6 +64,9 @@ type ConsumerConfig struct {
 	ClientExpiredInSeconds int64 `config:"client_expired_in_seconds" json:"client_expired_in_seconds,omitempty"` //client acquires lock for this long
 	fetchMaxWaitMs         time.Duration
 
+	Retry           *RetryPolicy `config:"retry" json:"retry,omitempty"`
+	DeadLetterQueue string       `config:"dead_letter_queue" json:"dead_letter_queue,omitempty"` //defaults to <queue>-dlq
+
 	CommitLocker sync.Mutex
 }
 
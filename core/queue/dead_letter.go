@@ -0,0 +1,273 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+)
+
+// RetryPolicy controls how often a consumer retries a failed message before
+// it gives up and moves the message to the dead-letter queue.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a message is handed to the
+	// handler, retries are disabled when it is not positive.
+	MaxAttempts        int     `config:"max_attempts" json:"max_attempts,omitempty"`
+	InitialBackoffInMs int64   `config:"initial_backoff_in_ms" json:"initial_backoff_in_ms,omitempty"`
+	MaxBackoffInMs     int64   `config:"max_backoff_in_ms" json:"max_backoff_in_ms,omitempty"`
+	Multiplier         float64 `config:"multiplier" json:"multiplier,omitempty"`
+}
+
+func (p *RetryPolicy) Enabled() bool {
+	return p != nil && p.MaxAttempts > 0
+}
+
+// Backoff returns the delay before the given retry, 1 being the first one.
+// It starts at InitialBackoffInMs (1s) and grows by Multiplier (2) up to
+// MaxBackoffInMs (60s).
+func (p *RetryPolicy) Backoff(retry int) time.Duration {
+	initial, max, multiplier := int64(1000), int64(60000), 2.0
+	if p != nil {
+		if p.InitialBackoffInMs > 0 {
+			initial = p.InitialBackoffInMs
+		}
+		if p.MaxBackoffInMs > 0 {
+			max = p.MaxBackoffInMs
+		}
+		if p.Multiplier >= 1 {
+			multiplier = p.Multiplier
+		}
+	}
+	if retry < 1 {
+		retry = 1
+	}
+	delay := float64(initial) * math.Pow(multiplier, float64(retry-1))
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// Retry calls fn until it succeeds or MaxAttempts calls failed, sleeping
+// the backoff in between, at least once. It stops early when ctx is done
+// and returns the number of calls made along with the last error.
+func Retry(ctx context.Context, p *RetryPolicy, fn func(attempt int) error) (int, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	maxAttempts := 1
+	if p.Enabled() {
+		maxAttempts = p.MaxAttempts
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(attempt)
+		if err == nil || attempt >= maxAttempts {
+			return attempt, err
+		}
+		timer := time.NewTimer(p.Backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+	}
+}
+
+// Headers set on every message moved to a dead-letter queue, the original
+// key and headers of the message are kept.
+const (
+	HeaderDeadLetterReason       = "x-dlq-reason"
+	HeaderDeadLetterAttempts     = "x-dlq-attempts"
+	HeaderDeadLetterSourceQueue  = "x-dlq-source-queue"
+	HeaderDeadLetterSourceOffset = "x-dlq-source-offset"
+	HeaderDeadLetterConsumer     = "x-dlq-consumer"
+	HeaderDeadLetterFailedAt     = "x-dlq-failed-at"
+)
+
+// DeadLetterQueueSuffix names the default dead-letter queue of a queue.
+const DeadLetterQueueSuffix = "-dlq"
+
+// Labels of dead-letter queue configs.
+const (
+	LabelDeadLetter       = "dead_letter"
+	LabelDeadLetterSource = "dead_letter_source"
+)
+
+// DeadLetterQueueName is the DeadLetterQueue of the consumer, or the queue
+// name followed by DeadLetterQueueSuffix.
+func DeadLetterQueueName(qCfg *QueueConfig, cCfg *ConsumerConfig) string {
+	if cCfg != nil && cCfg.DeadLetterQueue != "" {
+		return cCfg.DeadLetterQueue
+	}
+	return qCfg.Name + DeadLetterQueueSuffix
+}
+
+// GetOrInitDeadLetterQueue returns the dead-letter queue of a consumer,
+// labeled with the source queue so it can be found again.
+func GetOrInitDeadLetterQueue(qCfg *QueueConfig, cCfg *ConsumerConfig) *QueueConfig {
+	return AdvancedGetOrInitConfig(qCfg.Type, DeadLetterQueueName(qCfg, cCfg), map[string]interface{}{
+		LabelDeadLetter:       true,
+		LabelDeadLetterSource: qCfg.ID,
+	})
+}
+
+// SendToDeadLetterQueue moves msgs, which failed attempts times with reason,
+// to the dead-letter queue of the consumer.
+func SendToDeadLetterQueue(qCfg *QueueConfig, cCfg *ConsumerConfig, msgs []Message, attempts int, reason error) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	dlq := GetOrInitDeadLetterQueue(qCfg, cCfg)
+	producer, err := AcquireProducer(dlq)
+	if err != nil {
+		return err
+	}
+
+	var consumer string
+	if cCfg != nil {
+		consumer = cCfg.Key()
+	}
+	failedAt := time.Now().Format(time.RFC3339)
+	reqs := make([]ProduceRequest, 0, len(msgs))
+	for _, msg := range msgs {
+		headers := make(map[string]string, len(msg.Headers)+6)
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		headers[HeaderDeadLetterReason] = fmt.Sprint(reason)
+		headers[HeaderDeadLetterAttempts] = strconv.Itoa(attempts)
+		headers[HeaderDeadLetterSourceQueue] = qCfg.ID
+		headers[HeaderDeadLetterSourceOffset] = msg.Offset.EncodeToString()
+		headers[HeaderDeadLetterConsumer] = consumer
+		headers[HeaderDeadLetterFailedAt] = failedAt
+		reqs = append(reqs, ProduceRequest{Topic: dlq.ID, Key: msg.Key, Headers: headers, Data: msg.Data})
+	}
+
+	if _, err := producer.Produce(&reqs); err != nil {
+		return errors.Errorf("failed to move %v messages of queue [%v] to [%v]: %v", len(msgs), qCfg.Name, dlq.Name, err)
+	}
+	stats.IncrementBy("dead_letter", qCfg.ID, int64(len(msgs)))
+	log.Warnf("moved %v messages of queue [%v] to [%v] after %v attempts: %v", len(msgs), qCfg.Name, dlq.Name, attempts, reason)
+	return nil
+}
+
+// DeadLetter is the failure a dead-letter queue message was recorded with.
+type DeadLetter struct {
+	Reason       string `json:"reason,omitempty"`
+	Attempts     int    `json:"attempts,omitempty"`
+	SourceQueue  string `json:"source_queue,omitempty"`
+	SourceOffset string `json:"source_offset,omitempty"`
+	Consumer     string `json:"consumer,omitempty"`
+	FailedAt     string `json:"failed_at,omitempty"`
+}
+
+// GetDeadLetter reads the failure headers of a dead-letter queue message.
+func GetDeadLetter(msg *Message) (DeadLetter, bool) {
+	source, ok := msg.Headers[HeaderDeadLetterSourceQueue]
+	if !ok {
+		return DeadLetter{}, false
+	}
+	attempts, _ := util.ToInt(msg.Headers[HeaderDeadLetterAttempts])
+	return DeadLetter{
+		Reason:       msg.Headers[HeaderDeadLetterReason],
+		Attempts:     attempts,
+		SourceQueue:  source,
+		SourceOffset: msg.Headers[HeaderDeadLetterSourceOffset],
+		Consumer:     msg.Headers[HeaderDeadLetterConsumer],
+		FailedAt:     msg.Headers[HeaderDeadLetterFailedAt],
+	}, true
+}
+
+// StripDeadLetterHeaders returns the headers a message had before it was
+// moved to the dead-letter queue.
+func StripDeadLetterHeaders(headers map[string]string) map[string]string {
+	var out map[string]string
+	for k, v := range headers {
+		switch k {
+		case HeaderDeadLetterReason, HeaderDeadLetterAttempts, HeaderDeadLetterSourceQueue,
+			HeaderDeadLetterSourceOffset, HeaderDeadLetterConsumer, HeaderDeadLetterFailedAt:
+			continue
+		}
+		if out == nil {
+			out = map[string]string{}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// ProcessWithRetry hands msgs to handler under the retry policy of the
+// consumer. When the batch still fails after the last attempt, every
+// message is tried once more on its own, and the ones that fail again are
+// moved to the dead-letter queue, so a single bad message does not hold back
+// the batch. Without a retry policy handler is called once and its error
+// returned. Each call gets its own copy of msgs, so changes made by a failed
+// attempt do not leak into the next one.
+func ProcessWithRetry(ctx context.Context, qCfg *QueueConfig, cCfg *ConsumerConfig, msgs []Message, handler func(msgs []Message) error) error {
+	if cCfg == nil || !cCfg.Retry.Enabled() {
+		return handler(msgs)
+	}
+
+	attempts, err := Retry(ctx, cCfg.Retry, func(attempt int) error {
+		if attempt > 1 {
+			stats.Increment("queue", qCfg.ID, "retry")
+		}
+		return handler(append([]Message(nil), msgs...))
+	})
+	if err == nil {
+		return nil
+	}
+	if ctx != nil && ctx.Err() != nil {
+		return err
+	}
+	if len(msgs) == 1 {
+		return SendToDeadLetterQueue(qCfg, cCfg, msgs, attempts, err)
+	}
+
+	for i := range msgs {
+		msg := msgs[i : i+1]
+		if err := handler(append([]Message(nil), msg...)); err != nil {
+			if err := SendToDeadLetterQueue(qCfg, cCfg, msg, attempts+1, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
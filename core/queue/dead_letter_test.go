@@ -0,0 +1,131 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	var p *RetryPolicy
+	assert.False(t, p.Enabled())
+	assert.Equal(t, time.Second, p.Backoff(1))
+	assert.Equal(t, 2*time.Second, p.Backoff(2))
+	assert.Equal(t, 60*time.Second, p.Backoff(20))
+
+	p = &RetryPolicy{MaxAttempts: 3, InitialBackoffInMs: 10, MaxBackoffInMs: 25, Multiplier: 3}
+	assert.True(t, p.Enabled())
+	assert.Equal(t, 10*time.Millisecond, p.Backoff(1))
+	assert.Equal(t, 25*time.Millisecond, p.Backoff(2))
+}
+
+func TestRetry(t *testing.T) {
+	p := &RetryPolicy{MaxAttempts: 3, InitialBackoffInMs: 1}
+
+	calls := 0
+	attempts, err := Retry(context.Background(), p, func(attempt int) error {
+		calls++
+		if attempt < 2 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 2, calls)
+
+	attempts, err = Retry(context.Background(), p, func(attempt int) error {
+		return errors.New("failed")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, attempts)
+
+	//without a policy the function runs once
+	attempts, err = Retry(nil, nil, func(attempt int) error {
+		return errors.New("failed")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+
+	//a cancelled context stops retrying
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts, _ = Retry(ctx, &RetryPolicy{MaxAttempts: 5, InitialBackoffInMs: 60000}, func(attempt int) error {
+		return errors.New("failed")
+	})
+	assert.Equal(t, 1, attempts)
+}
+
+func TestProcessWithRetry(t *testing.T) {
+	qCfg := &QueueConfig{ID: "q1", Name: "q1"}
+	cCfg := &ConsumerConfig{Retry: &RetryPolicy{MaxAttempts: 3, InitialBackoffInMs: 1}}
+	msgs := []Message{{Data: []byte("a")}, {Data: []byte("b")}}
+
+	calls := 0
+	err := ProcessWithRetry(context.Background(), qCfg, cCfg, msgs, func(batch []Message) error {
+		calls++
+		batch[0].Data = nil
+		if calls < 3 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, []byte("a"), msgs[0].Data, "attempts work on copies")
+
+	err = ProcessWithRetry(context.Background(), qCfg, &ConsumerConfig{}, msgs, func(batch []Message) error {
+		return errors.New("failed")
+	})
+	assert.Error(t, err)
+}
+
+func TestDeadLetterHeaders(t *testing.T) {
+	assert.Equal(t, "orders-dlq", DeadLetterQueueName(&QueueConfig{Name: "orders"}, nil))
+	assert.Equal(t, "parked", DeadLetterQueueName(&QueueConfig{Name: "orders"}, &ConsumerConfig{DeadLetterQueue: "parked"}))
+
+	msg := &Message{Headers: map[string]string{
+		"trace_id":                   "t1",
+		HeaderDeadLetterReason:       "bad json",
+		HeaderDeadLetterAttempts:     "3",
+		HeaderDeadLetterSourceQueue:  "orders",
+		HeaderDeadLetterSourceOffset: "0,42",
+	}}
+	v, ok := GetDeadLetter(msg)
+	assert.True(t, ok)
+	assert.Equal(t, DeadLetter{Reason: "bad json", Attempts: 3, SourceQueue: "orders", SourceOffset: "0,42"}, v)
+	assert.Equal(t, map[string]string{"trace_id": "t1"}, StripDeadLetterHeaders(msg.Headers))
+
+	_, ok = GetDeadLetter(&Message{})
+	assert.False(t, ok)
+	assert.Nil(t, StripDeadLetterHeaders(map[string]string{HeaderDeadLetterReason: "x"}))
+}
@@ -0,0 +1,83 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package queue
+
+import (
+	"strconv"
+	"time"
+)
+
+// Headers read by the delay queue, other backends keep them as plain
+// headers. HeaderNotBefore is a unix time in milliseconds, a message is not
+// delivered before it. Among the messages that are due, the ones with a
+// higher HeaderPriority are delivered first.
+const (
+	HeaderNotBefore = "x-not-before"
+	HeaderPriority  = "x-priority"
+)
+
+func (r *ProduceRequest) setHeader(k, v string) {
+	if r.Headers == nil {
+		r.Headers = map[string]string{}
+	}
+	r.Headers[k] = v
+}
+
+// SetNotBefore delays the delivery of the message until t.
+func (r *ProduceRequest) SetNotBefore(t time.Time) {
+	r.setHeader(HeaderNotBefore, strconv.FormatInt(t.UnixMilli(), 10))
+}
+
+// SetDelay delays the delivery of the message by d from now.
+func (r *ProduceRequest) SetDelay(d time.Duration) {
+	r.SetNotBefore(time.Now().Add(d))
+}
+
+// SetPriority sets the priority of the message, 0 by default.
+func (r *ProduceRequest) SetPriority(priority int) {
+	r.setHeader(HeaderPriority, strconv.Itoa(priority))
+}
+
+// NotBefore returns the time set by SetNotBefore, zero when there is none.
+func NotBefore(headers map[string]string) time.Time {
+	v, ok := headers[HeaderNotBefore]
+	if !ok {
+		return time.Time{}
+	}
+	ms, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// Priority returns the priority set by SetPriority.
+func Priority(headers map[string]string) int {
+	v, _ := strconv.Atoi(headers[HeaderPriority])
+	return v
+}
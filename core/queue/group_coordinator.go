@@ -0,0 +1,482 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package queue
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/kv"
+	"infini.sh/framework/core/locker"
+	"infini.sh/framework/core/util"
+)
+
+// GroupCoordinatorBucket keeps the members and the assignment of every
+// consumer group that rebalances, one key each per group. The members are
+// updated with kv.CompareAndSwap, groups spanning nodes need a shared store
+// implementing kv.KVCASStore, such as the elastic one.
+const GroupCoordinatorBucket = "queue_group_coordinator"
+
+// attempts of a member to update the members of its group per heartbeat
+const groupMembersMaxRetries = 10
+
+// locker buckets of the group leaders and of the slices owned by members
+const (
+	groupLeaderBucket = "queue_group_leader"
+	groupSliceBucket  = "queue_group_slice"
+)
+
+type GroupCoordinatorConfig struct {
+	Enabled               bool  `config:"enabled" json:"enabled,omitempty"`
+	HeartbeatIntervalInMs int64 `config:"heartbeat_interval_in_ms" json:"heartbeat_interval_in_ms,omitempty"`
+	//a member without heartbeat for this long is gone, its slices move
+	SessionTimeoutInMs int64 `config:"session_timeout_in_ms" json:"session_timeout_in_ms,omitempty"`
+}
+
+func (cfg *GroupCoordinatorConfig) heartbeatInterval() time.Duration {
+	if cfg.HeartbeatIntervalInMs > 0 {
+		return time.Duration(cfg.HeartbeatIntervalInMs) * time.Millisecond
+	}
+	return 3 * time.Second
+}
+
+func (cfg *GroupCoordinatorConfig) sessionTimeout() time.Duration {
+	if cfg.SessionTimeoutInMs > 0 {
+		return time.Duration(cfg.SessionTimeoutInMs) * time.Millisecond
+	}
+	return 15 * time.Second
+}
+
+// GroupSlice is the unit the members of a group share, a slice of a queue.
+type GroupSlice struct {
+	QueueID string `json:"queue_id"`
+	Slice   int    `json:"slice"`
+}
+
+func (s GroupSlice) Key() string {
+	return fmt.Sprintf("%v-%v", s.QueueID, s.Slice)
+}
+
+type GroupMember struct {
+	ID        string `json:"id"`
+	NodeID    string `json:"node_id"`
+	Timestamp int64  `json:"timestamp"` //unix ms of the last heartbeat
+}
+
+// GroupAssignment is written by the leader of a group, every change bumps
+// the generation.
+type GroupAssignment struct {
+	Generation int64                   `json:"generation"`
+	Members    map[string][]GroupSlice `json:"members"`
+	Timestamp  int64                   `json:"timestamp"`
+}
+
+func groupMembersKey(group string) []byte {
+	return []byte("members/" + group)
+}
+
+func groupAssignmentKey(group string) []byte {
+	return []byte("assignment/" + group)
+}
+
+func loadGroupMembers(group string) ([]byte, map[string]GroupMember, error) {
+	data, err := kv.GetValue(GroupCoordinatorBucket, groupMembersKey(group))
+	if err != nil {
+		return nil, nil, err
+	}
+	members := map[string]GroupMember{}
+	if len(data) > 0 {
+		if err := util.FromJSONBytes(data, &members); err != nil {
+			return nil, nil, err
+		}
+	}
+	return data, members, nil
+}
+
+// updateGroupMembers applies change to the members of group and drops the
+// expired ones, retrying while other members update them concurrently.
+func updateGroupMembers(group string, timeout time.Duration, change func(members map[string]GroupMember)) error {
+	for i := 0; i < groupMembersMaxRetries; i++ {
+		old, members, err := loadGroupMembers(group)
+		if err != nil {
+			return err
+		}
+		change(members)
+		for id, m := range members {
+			if time.Since(time.UnixMilli(m.Timestamp)) > timeout {
+				delete(members, id)
+			}
+		}
+		if len(old) == 0 {
+			old = nil
+		}
+		ok, err := kv.CompareAndSwap(GroupCoordinatorBucket, groupMembersKey(group), old, util.MustToJSONBytes(members))
+		if err != nil || ok {
+			return err
+		}
+	}
+	return errors.Errorf("members of consumer group [%v] keep changing, gave up after %v attempts", group, groupMembersMaxRetries)
+}
+
+// GetGroupMembers returns the members of group with a heartbeat within
+// timeout.
+func GetGroupMembers(group string, timeout time.Duration) ([]GroupMember, error) {
+	_, all, err := loadGroupMembers(group)
+	if err != nil {
+		return nil, err
+	}
+	members := []GroupMember{}
+	for _, m := range all {
+		if time.Since(time.UnixMilli(m.Timestamp)) <= timeout {
+			members = append(members, m)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members, nil
+}
+
+// GetGroupAssignment returns nil when the group has no leader yet.
+func GetGroupAssignment(group string) (*GroupAssignment, error) {
+	data, err := kv.GetValue(GroupCoordinatorBucket, groupAssignmentKey(group))
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	assignment := &GroupAssignment{}
+	err = util.FromJSONBytes(data, assignment)
+	return assignment, err
+}
+
+// AssignGroupSlices spreads slices over members evenly, a slice stays with
+// its previous owner while that owner has room for it.
+func AssignGroupSlices(previous map[string][]GroupSlice, members []string, slices []GroupSlice) map[string][]GroupSlice {
+	result := map[string][]GroupSlice{}
+	if len(members) == 0 {
+		return result
+	}
+	members = append([]string(nil), members...)
+	sort.Strings(members)
+	slices = append([]GroupSlice(nil), slices...)
+	sort.Slice(slices, func(i, j int) bool { return slices[i].Key() < slices[j].Key() })
+
+	//the first members take one more when slices do not divide evenly
+	capacity := map[string]int{}
+	for i, m := range members {
+		capacity[m] = len(slices) / len(members)
+		if i < len(slices)%len(members) {
+			capacity[m]++
+		}
+	}
+
+	owners := map[string]string{}
+	for m, v := range previous {
+		if _, ok := capacity[m]; !ok {
+			continue
+		}
+		for _, s := range v {
+			owners[s.Key()] = m
+		}
+	}
+
+	unassigned := []GroupSlice{}
+	for _, s := range slices {
+		m, ok := owners[s.Key()]
+		if ok && len(result[m]) < capacity[m] {
+			result[m] = append(result[m], s)
+		} else {
+			unassigned = append(unassigned, s)
+		}
+	}
+	for _, s := range unassigned {
+		for _, m := range members {
+			if len(result[m]) < capacity[m] {
+				result[m] = append(result[m], s)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// GroupCoordinator shares the slices of a consumer group among the members
+// that run it, on any node. Members send heartbeats to the kv store, the
+// member holding the group leader lock assigns the slices to the live
+// members, and every member takes the slices assigned to it once their
+// previous owner released them, or its lease ran out. OnAssigned and
+// OnRevoked are called from the heartbeat loop, OnRevoked returns the slices
+// still being consumed, the member keeps their lease and revokes them again
+// with its next heartbeat, so no other member takes them over meanwhile.
+type GroupCoordinator struct {
+	Group    string
+	MemberID string
+
+	Slices     func() []GroupSlice
+	OnAssigned func(slices []GroupSlice)
+	OnRevoked  func(slices []GroupSlice) []GroupSlice
+
+	cfg        GroupCoordinatorConfig
+	lock       sync.Mutex
+	owned      map[string]GroupSlice
+	revoking   map[string]GroupSlice //revoked, but still consumed
+	generation int64
+	quit       chan struct{}
+	done       chan struct{}
+}
+
+func NewGroupCoordinator(group, memberID string, cfg GroupCoordinatorConfig) *GroupCoordinator {
+	return &GroupCoordinator{
+		Group:    group,
+		MemberID: memberID,
+		cfg:      cfg,
+		owned:    map[string]GroupSlice{},
+		revoking: map[string]GroupSlice{},
+	}
+}
+
+func (c *GroupCoordinator) Start() {
+	c.quit = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(c.cfg.heartbeatInterval())
+		defer ticker.Stop()
+		for {
+			if err := c.Tick(); err != nil {
+				log.Errorf("consumer group [%v], member [%v]: %v", c.Group, c.MemberID, err)
+			}
+			select {
+			case <-c.quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop revokes every slice of the member and leaves the group, the other
+// members take them over with their next heartbeat.
+func (c *GroupCoordinator) Stop() {
+	if c.quit != nil {
+		close(c.quit)
+		<-c.done
+		c.quit = nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.revoke(c.ownedSlices())
+	err := updateGroupMembers(c.Group, c.cfg.sessionTimeout(), func(members map[string]GroupMember) {
+		delete(members, c.MemberID)
+	})
+	if err != nil {
+		log.Warnf("consumer group [%v], member [%v] failed to leave: %v", c.Group, c.MemberID, err)
+	}
+	locker.Release(groupLeaderBucket, c.Group, c.MemberID)
+}
+
+// Owned returns the slices the member holds.
+func (c *GroupCoordinator) Owned() []GroupSlice {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ownedSlices()
+}
+
+func (c *GroupCoordinator) ownedSlices() []GroupSlice {
+	slices := make([]GroupSlice, 0, len(c.owned))
+	for _, s := range c.owned {
+		slices = append(slices, s)
+	}
+	sort.Slice(slices, func(i, j int) bool { return slices[i].Key() < slices[j].Key() })
+	return slices
+}
+
+// Tick sends a heartbeat, rebalances the group when the member is its
+// leader, and follows the current assignment.
+func (c *GroupCoordinator) Tick() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	member := GroupMember{ID: c.MemberID, NodeID: global.Env().SystemConfig.NodeConfig.ID, Timestamp: time.Now().UnixMilli()}
+	err := updateGroupMembers(c.Group, c.cfg.sessionTimeout(), func(members map[string]GroupMember) {
+		members[c.MemberID] = member
+	})
+	if err != nil {
+		return err
+	}
+
+	leader, err := locker.Hold(groupLeaderBucket, c.Group, c.MemberID, c.cfg.sessionTimeout(), true)
+	if err != nil {
+		return err
+	}
+	if leader {
+		if err := c.rebalance(); err != nil {
+			return err
+		}
+	}
+
+	assignment, err := GetGroupAssignment(c.Group)
+	if err != nil || assignment == nil {
+		return err
+	}
+	c.follow(assignment)
+	return nil
+}
+
+func (c *GroupCoordinator) rebalance() error {
+	members, err := GetGroupMembers(c.Group, c.cfg.sessionTimeout())
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(members))
+	for _, m := range members {
+		ids = append(ids, m.ID)
+	}
+
+	var slices []GroupSlice
+	if c.Slices != nil {
+		slices = c.Slices()
+	}
+
+	previous, err := GetGroupAssignment(c.Group)
+	if err != nil {
+		return err
+	}
+	assignment := &GroupAssignment{Members: AssignGroupSlices(nil, ids, slices)}
+	if previous != nil {
+		assignment.Members = AssignGroupSlices(previous.Members, ids, slices)
+		if reflect.DeepEqual(previous.Members, assignment.Members) {
+			return nil
+		}
+		assignment.Generation = previous.Generation + 1
+	}
+	assignment.Timestamp = time.Now().UnixMilli()
+
+	log.Infof("consumer group [%v] rebalanced to generation %v, %v members, %v slices", c.Group, assignment.Generation, len(ids), len(slices))
+	return kv.AddValue(GroupCoordinatorBucket, groupAssignmentKey(c.Group), util.MustToJSONBytes(assignment))
+}
+
+// follow revokes the slices no longer assigned to the member, and takes or
+// renews the ones assigned to it, lock held
+func (c *GroupCoordinator) follow(assignment *GroupAssignment) {
+	if assignment.Generation != c.generation {
+		log.Debugf("consumer group [%v], member [%v] follows generation %v", c.Group, c.MemberID, assignment.Generation)
+		c.generation = assignment.Generation
+	}
+
+	mine := map[string]GroupSlice{}
+	for _, s := range assignment.Members[c.MemberID] {
+		mine[s.Key()] = s
+	}
+
+	revoked := []GroupSlice{}
+	for k, s := range c.owned {
+		if _, ok := mine[k]; !ok {
+			revoked = append(revoked, s)
+		}
+	}
+	for k, s := range c.revoking {
+		if _, ok := mine[k]; !ok {
+			revoked = append(revoked, s)
+		}
+	}
+
+	assigned := []GroupSlice{}
+	for k, s := range mine {
+		ok, err := locker.Hold(groupSliceBucket, c.sliceLockName(s), c.MemberID, c.cfg.sessionTimeout(), true)
+		if err != nil {
+			log.Errorf("consumer group [%v], failed to hold slice [%v]: %v", c.Group, k, err)
+			ok = false
+		}
+		_, owned := c.owned[k]
+		if ok && !owned {
+			assigned = append(assigned, s)
+		} else if !ok && owned {
+			//the lease ran out and someone else took the slice
+			revoked = append(revoked, s)
+		}
+	}
+
+	c.revoke(revoked)
+	if len(assigned) > 0 {
+		for _, s := range assigned {
+			delete(c.revoking, s.Key())
+			c.owned[s.Key()] = s
+		}
+		log.Infof("consumer group [%v], member [%v] assigned %v", c.Group, c.MemberID, sliceKeys(assigned))
+		if c.OnAssigned != nil {
+			c.OnAssigned(assigned)
+		}
+	}
+}
+
+// revoke releases the slices, except the ones OnRevoked reports as still
+// consumed, their lease is renewed until a later revoke releases them, lock
+// held
+func (c *GroupCoordinator) revoke(slices []GroupSlice) {
+	if len(slices) == 0 {
+		return
+	}
+	log.Infof("consumer group [%v], member [%v] revoked %v", c.Group, c.MemberID, sliceKeys(slices))
+	busy := map[string]bool{}
+	if c.OnRevoked != nil {
+		for _, s := range c.OnRevoked(slices) {
+			busy[s.Key()] = true
+		}
+	}
+	for _, s := range slices {
+		delete(c.owned, s.Key())
+		if busy[s.Key()] {
+			ok, err := locker.Hold(groupSliceBucket, c.sliceLockName(s), c.MemberID, c.cfg.sessionTimeout(), true)
+			if err == nil && ok {
+				c.revoking[s.Key()] = s
+				continue
+			}
+			log.Warnf("consumer group [%v], member [%v] lost slice [%v] while it is still consumed", c.Group, c.MemberID, s.Key())
+		}
+		delete(c.revoking, s.Key())
+		locker.Release(groupSliceBucket, c.sliceLockName(s), c.MemberID)
+	}
+}
+
+func (c *GroupCoordinator) sliceLockName(s GroupSlice) string {
+	return c.Group + "/" + s.Key()
+}
+
+func sliceKeys(slices []GroupSlice) string {
+	keys := make([]string, 0, len(slices))
+	for _, s := range slices {
+		keys = append(keys, s.Key())
+	}
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,75 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/kv"
+	"infini.sh/framework/core/kv/kvtest"
+)
+
+func TestGroupCoordinatorWithoutIterator(t *testing.T) {
+	kvtest.UsePlain("group_coordinator_test")
+	require.False(t, kv.SupportsIterator(GroupCoordinatorBucket))
+
+	slices := []GroupSlice{}
+	for i := 0; i < 4; i++ {
+		slices = append(slices, GroupSlice{QueueID: "q1", Slice: i})
+	}
+	newMember := func(id string) *GroupCoordinator {
+		c := NewGroupCoordinator(t.Name(), id, GroupCoordinatorConfig{Enabled: true})
+		c.Slices = func() []GroupSlice { return slices }
+		return c
+	}
+	a := newMember("a")
+	b := newMember("b")
+
+	require.NoError(t, a.Tick())
+	assert.Len(t, a.Owned(), 4)
+
+	//b joins, the leader a hands over half of the slices on its next tick
+	require.NoError(t, b.Tick())
+	require.NoError(t, a.Tick())
+	require.NoError(t, b.Tick())
+	members, err := GetGroupMembers(t.Name(), a.cfg.sessionTimeout())
+	require.NoError(t, err)
+	assert.Len(t, members, 2)
+	assert.Len(t, a.Owned(), 2)
+	assert.Len(t, b.Owned(), 2)
+	assert.NotSubset(t, a.Owned(), b.Owned())
+
+	assignment, err := GetGroupAssignment(t.Name())
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, assignment.Generation)
+
+	//b leaves, a takes everything back
+	b.Stop()
+	require.NoError(t, a.Tick())
+	assert.Len(t, a.Owned(), 4)
+	members, _ = GetGroupMembers(t.Name(), a.cfg.sessionTimeout())
+	assert.Len(t, members, 1)
+}
@@ -0,0 +1,82 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssignGroupSlices(t *testing.T) {
+	slices := []GroupSlice{}
+	for _, q := range []string{"q1", "q2"} {
+		for i := 0; i < 3; i++ {
+			slices = append(slices, GroupSlice{QueueID: q, Slice: i})
+		}
+	}
+	count := func(assignment map[string][]GroupSlice) map[string]int {
+		out := map[string]int{}
+		for m, v := range assignment {
+			out[m] = len(v)
+		}
+		return out
+	}
+
+	assert.Empty(t, AssignGroupSlices(nil, nil, slices))
+
+	//one member takes everything
+	a1 := AssignGroupSlices(nil, []string{"a"}, slices)
+	assert.Len(t, a1["a"], 6)
+
+	//a joining member takes half, the rest stays put
+	a2 := AssignGroupSlices(a1, []string{"b", "a"}, slices)
+	assert.Equal(t, map[string]int{"a": 3, "b": 3}, count(a2))
+	assert.Subset(t, a1["a"], a2["a"])
+
+	//uneven splits differ by one at most, kept slices stay with their owner
+	a3 := AssignGroupSlices(a2, []string{"a", "b", "c", "d"}, slices)
+	assert.Equal(t, map[string]int{"a": 2, "b": 2, "c": 1, "d": 1}, count(a3))
+	assert.Subset(t, a2["a"], a3["a"])
+	assert.Subset(t, a2["b"], a3["b"])
+
+	//the slices of a dead member move, nothing else
+	a4 := AssignGroupSlices(a3, []string{"a", "b", "d"}, slices)
+	assert.Equal(t, map[string]int{"a": 2, "b": 2, "d": 2}, count(a4))
+	assert.Subset(t, a4["d"], a3["d"])
+	assert.Contains(t, a4["d"], a3["c"][0])
+
+	//every slice is assigned once
+	seen := map[string]bool{}
+	for _, v := range a4 {
+		for _, s := range v {
+			assert.False(t, seen[s.Key()])
+			seen[s.Key()] = true
+		}
+	}
+	assert.Len(t, seen, 6)
+}
@@ -165,6 +165,11 @@ type Message struct {
 	NextOffset Offset `config:"next_offset" json:"next_offset"  parquet:"next_offset"` //offset for next message
 	Size       int    `config:"size" json:"size"  parquet:"size"`
 	Data       []byte `config:"data" json:"data"  parquet:"data,zstd"`
+
+	// Key and Headers are optional metadata set by the producer, Key is the
+	// partition key on backends that partition.
+	Key     []byte            `config:"key" json:"key,omitempty"  parquet:"key"`
+	Headers map[string]string `config:"headers" json:"headers,omitempty"  parquet:"headers"`
 }
 
 func (m *Message) String() string {
@@ -175,6 +180,8 @@ type ProduceRequest struct {
 	Topic string `config:"topic" json:"topic"` //queue_id
 	Key   []byte `config:"key" json:"key"`
 	Data  []byte `config:"data" json:"data"`
+
+	Headers map[string]string `config:"headers" json:"headers,omitempty"`
 }
 
 type ProduceResponse struct {
@@ -0,0 +1,333 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package queue
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/kv"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+)
+
+// Headers set by a Transaction on every message it produces, they identify
+// the source message a message was produced for, so that a restarted
+// transaction can skip what it already produced.
+const (
+	HeaderTransactionID           = "x-txn-id"
+	HeaderTransactionSourceOffset = "x-txn-source-offset"
+	HeaderTransactionSequence     = "x-txn-seq"
+)
+
+// TransactionBucket keeps the state of transactions on backends without
+// their own support.
+const TransactionBucket = "queue_transaction"
+
+// TransactionMarker identifies a produced message by the offset of the
+// source message it was produced for and its index among the messages
+// produced for that source message.
+type TransactionMarker struct {
+	SourceOffset Offset `json:"source_offset"`
+	Sequence     int    `json:"sequence"`
+}
+
+// After reports whether m was produced after v, the offset versions are
+// not compared.
+func (m *TransactionMarker) After(v *TransactionMarker) bool {
+	if m.SourceOffset.Segment != v.SourceOffset.Segment {
+		return m.SourceOffset.Segment > v.SourceOffset.Segment
+	}
+	if m.SourceOffset.Position != v.SourceOffset.Position {
+		return m.SourceOffset.Position > v.SourceOffset.Position
+	}
+	return m.Sequence > v.Sequence
+}
+
+// TransactionMarkerFromHeaders returns the marker of a message produced by
+// the transaction txnID.
+func TransactionMarkerFromHeaders(txnID string, headers map[string]string) (*TransactionMarker, bool) {
+	if headers == nil || headers[HeaderTransactionID] != txnID {
+		return nil, false
+	}
+	offset, ok := headers[HeaderTransactionSourceOffset]
+	if !ok || offset == "" {
+		return nil, false
+	}
+	seq, err := strconv.Atoi(headers[HeaderTransactionSequence])
+	if err != nil {
+		return nil, false
+	}
+	return &TransactionMarker{SourceOffset: DecodeFromString(offset), Sequence: seq}, true
+}
+
+// TransactionState is recorded by every commit of a transaction.
+type TransactionState struct {
+	ID string `json:"id"`
+	// SourceOffset is the consumer offset committed to the source queue
+	SourceOffset Offset `json:"source_offset"`
+	// TargetOffset is the end of the messages produced to the target queue
+	TargetOffset Offset `json:"target_offset"`
+	// Last is the last message produced to the target queue
+	Last      *TransactionMarker `json:"last,omitempty"`
+	Timestamp int64              `json:"timestamp"`
+}
+
+// TransactionalQueueAPI is implemented by backends which commit the
+// messages produced to a queue and the consumer offset of another queue of
+// the same backend as one unit.
+type TransactionalQueueAPI interface {
+	// CommitTransaction produces reqs to the target queue and commits
+	// offset for the consumer of the source queue.
+	CommitTransaction(txn *Transaction, reqs []ProduceRequest, offset Offset) (*[]ProduceResponse, error)
+	// RecoverTransaction completes a commit that was interrupted and
+	// returns the state of the transaction, Last is the last message found
+	// in the target queue.
+	RecoverTransaction(txn *Transaction) (*TransactionState, error)
+}
+
+// Transaction consumes a source queue and produces to a target queue
+// exactly once: the messages sent for a batch of source messages are
+// produced when the consumer offset after the batch is committed, and
+// messages which were produced before a restart are not produced again.
+//
+// Disk queues record the target position with the source offset, Kafka
+// uses its transactions, other backends fall back to recording both in the
+// kv store after producing, a crash between the two may duplicate the
+// messages of the last batch there.
+type Transaction struct {
+	ID       string
+	Source   *QueueConfig
+	Consumer *ConsumerConfig
+	Target   *QueueConfig
+
+	lock    sync.Mutex
+	version int64
+	state   *TransactionState
+	pending []ProduceRequest
+}
+
+// TransactionID is the id of the transaction between the consumer of the
+// source queue and the target queue, it stays the same across restarts.
+func TransactionID(source *QueueConfig, consumer *ConsumerConfig, target *QueueConfig) string {
+	return fmt.Sprintf("%v_%v_%v", source.ID, consumer.Key(), target.ID)
+}
+
+// BeginTransaction recovers the transaction between the consumer of the
+// source queue and the target queue, it should be called before the
+// consumer fetches, as it may move the consumer offset forward.
+func BeginTransaction(source *QueueConfig, consumer *ConsumerConfig, target *QueueConfig) (*Transaction, error) {
+	if source == nil || source.ID == "" || target == nil || target.ID == "" || consumer == nil {
+		panic(errors.New("source, consumer and target are required"))
+	}
+
+	txn := &Transaction{
+		ID:       TransactionID(source, consumer, target),
+		Source:   source,
+		Consumer: consumer,
+		Target:   target,
+	}
+
+	var state *TransactionState
+	var err error
+	if handler := txn.handler(); handler != nil {
+		state, err = handler.RecoverTransaction(txn)
+	} else {
+		state, err = recoverTransaction(txn)
+	}
+	if err != nil {
+		return nil, errors.Errorf("failed to recover transaction [%v]: %v", txn.ID, err)
+	}
+
+	committed, err := GetOffset(source, consumer)
+	if err != nil {
+		return nil, err
+	}
+	//the consumer offset was reset since, replay everything from there
+	if committed.Version > state.SourceOffset.Version {
+		state.Last = nil
+	}
+	txn.version = committed.Version
+	txn.state = state
+	return txn, nil
+}
+
+// handler is the backend of both queues when it supports transactions.
+func (txn *Transaction) handler() TransactionalQueueAPI {
+	handler := getHandler(txn.Target)
+	if handler != getHandler(txn.Source) {
+		return nil
+	}
+	h, _ := handler.(TransactionalQueueAPI)
+	return h
+}
+
+// State is the state of the transaction as of its last commit.
+func (txn *Transaction) State() TransactionState {
+	txn.lock.Lock()
+	defer txn.lock.Unlock()
+	return *txn.state
+}
+
+// Send queues reqs, the messages produced for msg of the source queue,
+// until Commit. Messages produced for msg before a restart are dropped, it
+// returns the number of messages queued.
+func (txn *Transaction) Send(msg *Message, reqs ...ProduceRequest) int {
+	txn.lock.Lock()
+	defer txn.lock.Unlock()
+
+	var queued int
+	for i, req := range reqs {
+		marker := TransactionMarker{SourceOffset: msg.Offset, Sequence: i}
+		if txn.state.Last != nil && !marker.After(txn.state.Last) {
+			stats.Increment("queue_transaction", txn.ID, "duplicated")
+			continue
+		}
+
+		headers := make(map[string]string, len(req.Headers)+3)
+		for k, v := range req.Headers {
+			headers[k] = v
+		}
+		headers[HeaderTransactionID] = txn.ID
+		headers[HeaderTransactionSourceOffset] = msg.Offset.EncodeToString()
+		headers[HeaderTransactionSequence] = strconv.Itoa(i)
+		req.Headers = headers
+		if req.Topic == "" {
+			req.Topic = txn.Target.ID
+		}
+		txn.pending = append(txn.pending, req)
+		queued++
+	}
+	return queued
+}
+
+// Commit produces the queued messages and commits offset, the consumer
+// offset after the last source message sent. After an error the
+// transaction should be begun again.
+func (txn *Transaction) Commit(offset Offset) (*[]ProduceResponse, error) {
+	txn.lock.Lock()
+	defer txn.lock.Unlock()
+
+	if offset.Version < txn.version {
+		offset.Version = txn.version
+	}
+
+	reqs := txn.pending
+	txn.pending = nil
+
+	var res *[]ProduceResponse
+	var err error
+	if handler := txn.handler(); handler != nil {
+		res, err = handler.CommitTransaction(txn, reqs, offset)
+	} else {
+		res, err = commitTransaction(txn, reqs, offset)
+	}
+	if err != nil {
+		return res, errors.Errorf("failed to commit transaction [%v]: %v", txn.ID, err)
+	}
+
+	txn.state.SourceOffset = offset
+	if len(reqs) > 0 {
+		txn.state.Last, _ = TransactionMarkerFromHeaders(txn.ID, reqs[len(reqs)-1].Headers)
+		if res != nil && len(*res) > 0 {
+			txn.state.TargetOffset = (*res)[len(*res)-1].Offset
+		}
+	}
+	stats.IncrementBy("queue_transaction", txn.ID+".produced", int64(len(reqs)))
+	return res, nil
+}
+
+// Abort drops the queued messages.
+func (txn *Transaction) Abort() {
+	txn.lock.Lock()
+	defer txn.lock.Unlock()
+	txn.pending = nil
+}
+
+// CompleteTransaction commits the source offset recorded by the last
+// commit of txn, in case it crashed before committing it.
+func CompleteTransaction(txn *Transaction, state *TransactionState) error {
+	committed, err := GetOffset(txn.Source, txn.Consumer)
+	if err != nil {
+		return err
+	}
+	if !state.SourceOffset.LatestThan(committed) {
+		return nil
+	}
+	log.Infof("complete transaction [%v], commit offset %v of queue [%v]", txn.ID, state.SourceOffset, txn.Source.Name)
+	_, err = CommitOffset(txn.Source, txn.Consumer, state.SourceOffset)
+	return err
+}
+
+func recoverTransaction(txn *Transaction) (*TransactionState, error) {
+	data, err := kv.GetValue(TransactionBucket, []byte(txn.ID))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return &TransactionState{ID: txn.ID}, nil
+	}
+	state := &TransactionState{}
+	err = util.FromJSONBytes(data, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, CompleteTransaction(txn, state)
+}
+
+func commitTransaction(txn *Transaction, reqs []ProduceRequest, offset Offset) (*[]ProduceResponse, error) {
+	state := *txn.state
+	var res *[]ProduceResponse
+	if len(reqs) > 0 {
+		producer, err := AcquireProducer(txn.Target)
+		if err != nil {
+			return nil, err
+		}
+		res, err = producer.Produce(&reqs)
+		if err != nil {
+			return res, err
+		}
+		state.Last, _ = TransactionMarkerFromHeaders(txn.ID, reqs[len(reqs)-1].Headers)
+		if len(*res) > 0 {
+			state.TargetOffset = (*res)[len(*res)-1].Offset
+		}
+	}
+	state.SourceOffset = offset
+	state.Timestamp = time.Now().Unix()
+
+	err := kv.AddValue(TransactionBucket, []byte(txn.ID), util.MustToJSONBytes(state))
+	if err != nil {
+		return res, err
+	}
+	_, err = CommitOffset(txn.Source, txn.Consumer, offset)
+	return res, err
+}
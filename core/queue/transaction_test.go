@@ -0,0 +1,81 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransactionMarker(t *testing.T) {
+	a := &TransactionMarker{SourceOffset: NewOffset(1, 10)}
+	b := &TransactionMarker{SourceOffset: NewOffset(1, 10), Sequence: 1}
+	c := &TransactionMarker{SourceOffset: NewOffsetWithVersion(1, 20, 0)}
+	d := &TransactionMarker{SourceOffset: NewOffsetWithVersion(2, 0, 3)}
+	assert.True(t, b.After(a))
+	assert.True(t, c.After(b))
+	assert.True(t, d.After(c))
+	assert.False(t, a.After(a))
+	assert.False(t, a.After(d))
+
+	_, ok := TransactionMarkerFromHeaders("txn", nil)
+	assert.False(t, ok)
+	_, ok = TransactionMarkerFromHeaders("txn", map[string]string{HeaderTransactionID: "other", HeaderTransactionSourceOffset: "1,10,0", HeaderTransactionSequence: "1"})
+	assert.False(t, ok)
+	marker, ok := TransactionMarkerFromHeaders("txn", map[string]string{HeaderTransactionID: "txn", HeaderTransactionSourceOffset: "1,10,0", HeaderTransactionSequence: "1"})
+	require.True(t, ok)
+	assert.Equal(t, b, marker)
+}
+
+func TestTransactionSendSkipsProduced(t *testing.T) {
+	txn := &Transaction{
+		ID:     "txn",
+		Target: &QueueConfig{ID: "target"},
+		state:  &TransactionState{ID: "txn", Last: &TransactionMarker{SourceOffset: NewOffset(0, 20), Sequence: 0}},
+	}
+
+	reqs := []ProduceRequest{
+		{Data: []byte("first"), Headers: map[string]string{"k": "v"}},
+		{Data: []byte("second")},
+	}
+	assert.Equal(t, 0, txn.Send(&Message{Offset: NewOffset(0, 10)}, reqs...))
+	assert.Equal(t, 1, txn.Send(&Message{Offset: NewOffset(0, 20)}, reqs...))
+	assert.Equal(t, 2, txn.Send(&Message{Offset: NewOffset(0, 30)}, reqs...))
+	require.Len(t, txn.pending, 3)
+
+	assert.Equal(t, "second", string(txn.pending[0].Data))
+	assert.Equal(t, "target", txn.pending[0].Topic)
+	assert.Equal(t, map[string]string{HeaderTransactionID: "txn", HeaderTransactionSourceOffset: "0,20,0", HeaderTransactionSequence: "1"}, txn.pending[0].Headers)
+	assert.Equal(t, map[string]string{"k": "v", HeaderTransactionID: "txn", HeaderTransactionSourceOffset: "0,30,0", HeaderTransactionSequence: "0"}, txn.pending[1].Headers)
+	//the request headers are not modified
+	assert.Equal(t, map[string]string{"k": "v"}, reqs[0].Headers)
+
+	txn.Abort()
+	assert.Empty(t, txn.pending)
+}
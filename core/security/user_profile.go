@@ -33,6 +33,7 @@ type User struct {
 
 type UserAccount struct {
 	orm.ORMObjectBase
+	orm.VersionedObjectBase
 	Name     string   `json:"name,omitempty"  elastic_mapping:"name: { type: keyword }" validate:"required" `
 	Email    string   `json:"email,omitempty" elastic_mapping:"email: { type: keyword }" validate:"required|email" ` //unique
 	Roles    []string `json:"roles,omitempty" elastic_mapping:"roles: { type: keyword }"`
@@ -10,6 +10,8 @@
 // Implementations live outside this package and register a Factory via
 // Register, typically from an init(); products activate them with a
 // blank-import (the same pattern as pipeline processor registration).
+// The built-in "file", "http", "elasticsearch" and "queue" shippers live
+// under plugins/shipper.
 package shipper
 
 import (
@@ -89,6 +89,15 @@ func Decompress(in io.Reader, out io.Writer) error {
 	return err
 }
 
+// NewReader returns a reader decompressing in as a stream.
+func NewReader(in io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
 // ZSTDDecompress decompresses a block using ZSTD algorithm.
 func ZSTDDecompress(dst, src []byte) ([]byte, error) {
 	decOnce.Do(func() {
@@ -0,0 +1,53 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+package api
+
+import (
+	"net/http"
+
+	"infini.sh/framework/core/api"
+	httprouter "infini.sh/framework/core/api/router"
+	"infini.sh/framework/core/kv"
+)
+
+func init() {
+	api.HandleAPIMethod(api.GET, "/_kv/stores", kvStoresAPIHandler)
+}
+
+// kvStoresAPIHandler lists the registered kv stores and the bucket to store
+// routing table, so operators can see where data lives.
+func kvStoresAPIHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	table := kv.GetRoutingTable()
+	if buckets, err := kv.ListBuckets(); err == nil {
+		for _, v := range buckets {
+			if _, ok := table.Buckets[v]; !ok {
+				table.Buckets[v] = kv.ResolveStore(v)
+			}
+		}
+	}
+	api.WriteJSON(w, table, http.StatusOK)
+}
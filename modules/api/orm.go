@@ -0,0 +1,122 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/api"
+	httprouter "infini.sh/framework/core/api/router"
+	"infini.sh/framework/core/orm"
+	"infini.sh/framework/core/util"
+)
+
+func init() {
+	api.HandleAPIMethod(api.GET, "/_orm/export", ormExportAPIHandler)
+	api.HandleAPIMethod(api.POST, "/_orm/import", ormImportAPIHandler)
+	api.HandleAPIMethod(api.POST, "/_orm/migrate", ormMigrateAPIHandler)
+}
+
+// transferParams reads ?backend= (the active ORM when empty) and
+// ?schema=a,b (all registered schemas when empty).
+func transferParams(req *http.Request) (orm.ORM, *orm.TransferOptions, bool) {
+	h, ok := orm.GetAdapter(req.URL.Query().Get("backend"))
+	if !ok {
+		return nil, nil, false
+	}
+
+	opts := &orm.TransferOptions{}
+	if v := req.URL.Query().Get("schema"); v != "" {
+		opts.Schemas = strings.Split(v, ",")
+	}
+	opts.BatchSize = api.GetIntOrDefault(req, "size", 0)
+	return h, opts, true
+}
+
+// ormExportAPIHandler streams the registered ORM schemas as NDJSON, the body
+// is the input of /_orm/import on another installation.
+func ormExportAPIHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	h, opts, ok := transferParams(req)
+	if !ok {
+		api.WriteError(w, "unknown orm backend, available: "+strings.Join(orm.GetAdapterNames(), ","), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	stats, err := orm.Export(h, w, opts)
+	if err != nil {
+		//the status is already sent, a truncated stream is all we can signal
+		log.Errorf("orm export failed after %v: %v", util.MustToJSON(stats), err)
+		return
+	}
+	log.Infof("orm export finished: %v", util.MustToJSON(stats))
+}
+
+// ormImportAPIHandler loads an NDJSON body produced by /_orm/export and
+// replies with the number of objects written per schema.
+func ormImportAPIHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	h, opts, ok := transferParams(req)
+	if !ok {
+		api.WriteError(w, "unknown orm backend, available: "+strings.Join(orm.GetAdapterNames(), ","), http.StatusBadRequest)
+		return
+	}
+	defer req.Body.Close()
+
+	stats, err := orm.Import(h, req.Body, opts)
+	if err != nil {
+		api.WriteJSON(w, util.MapStr{"imported": stats, "error": err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	log.Infof("orm import finished: %v", util.MustToJSON(stats))
+	api.WriteJSON(w, util.MapStr{"imported": stats}, http.StatusOK)
+}
+
+// ormMigrateAPIHandler applies the pending schema migrations, or only lists
+// them with ?dry_run=true.
+func ormMigrateAPIHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	h, transferOpts, ok := transferParams(req)
+	if !ok {
+		api.WriteError(w, "unknown orm backend, available: "+strings.Join(orm.GetAdapterNames(), ","), http.StatusBadRequest)
+		return
+	}
+
+	opts := &orm.MigrateOptions{
+		DryRun:    api.GetBoolOrDefault(req, "dry_run", false),
+		Schemas:   transferOpts.Schemas,
+		BatchSize: transferOpts.BatchSize,
+	}
+	results, err := orm.Migrate(h, opts)
+	if err != nil {
+		api.WriteJSON(w, util.MapStr{"migrations": results, "error": err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	api.WriteJSON(w, util.MapStr{"migrations": results, "dry_run": opts.DryRun}, http.StatusOK)
+}
@@ -475,6 +475,69 @@ func (c *ESAPIV0) Update(indexName, docType string, id interface{}, data interfa
 	return esResp, nil
 }
 
+// IndexIfMatch replaces the document only if it is still at seqNo/primaryTerm
+func (c *ESAPIV0) IndexIfMatch(indexName, docType string, id interface{}, data interface{}, seqNo, primaryTerm int64, refresh string) (*elastic.InsertResponse, error) {
+	if docType == "" {
+		docType = TypeName0
+	}
+
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/%s/%s/%s?if_seq_no=%d&if_primary_term=%d", c.GetEndpoint(), util.UrlEncode(indexName), docType, id, seqNo, primaryTerm)
+	if refresh != "" {
+		url = fmt.Sprintf("%s&refresh=%s", url, refresh)
+	}
+	return c.writeIfMatch(url, js)
+}
+
+// UpdateIfMatch merges data into the document only if it is still at seqNo/primaryTerm
+func (c *ESAPIV0) UpdateIfMatch(indexName, docType string, id interface{}, data interface{}, seqNo, primaryTerm int64, refresh string) (*elastic.InsertResponse, error) {
+	if docType == "" {
+		docType = TypeName0
+	}
+
+	js := util.MapStr{}
+	js["doc"] = data
+	js["detect_noop"] = false
+
+	url := fmt.Sprintf("%s/%s/%s/%s/_update?if_seq_no=%d&if_primary_term=%d", c.GetEndpoint(), util.UrlEncode(indexName), docType, id, seqNo, primaryTerm)
+	if refresh != "" {
+		url = fmt.Sprintf("%s&refresh=%s", url, refresh)
+	}
+	return c.writeIfMatch(url, util.MustToJSONBytes(js))
+}
+
+func (c *ESAPIV0) writeIfMatch(url string, body []byte) (*elastic.InsertResponse, error) {
+	resp, err := c.Request(nil, util.Verb_POST, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if global.Env().IsDebug {
+		log.Trace("conditional write response: ", string(resp.Body))
+	}
+
+	esResp := &elastic.InsertResponse{}
+	esResp.StatusCode = resp.StatusCode
+	esResp.RawResult = resp
+	if resp.StatusCode == http.StatusConflict {
+		return esResp, elastic.ErrVersionConflict
+	}
+
+	err = json.Unmarshal(resp.Body, esResp)
+	if err != nil {
+		return esResp, err
+	}
+	if !(esResp.Result == "created" || esResp.Result == "updated" || esResp.Shards.Successful > 0) {
+		return nil, errors.New(string(resp.Body))
+	}
+
+	return esResp, nil
+}
+
 // Get fetch document by id
 func (c *ESAPIV0) Get(indexName, docType, id string) (*elastic.GetResponse, error) {
 
@@ -1397,6 +1460,45 @@ func (s *ESAPIV0) ClearScroll(scrollId string) error {
 	return nil
 }
 
+func (s *ESAPIV0) OpenPointInTime(indexNames string, keepAlive string) (string, error) {
+	return "", elastic.ErrPointInTimeNotSupported
+}
+
+func (s *ESAPIV0) ClosePointInTime(pitID string) error {
+	return elastic.ErrPointInTimeNotSupported
+}
+
+// SearchWithPointInTime is shared by every distribution that opens points
+// in time, the search request format is the same.
+func (s *ESAPIV0) SearchWithPointInTime(pitID string, keepAlive string, query *elastic.SearchRequest) ([]byte, error) {
+	if query == nil {
+		query = &elastic.SearchRequest{}
+	}
+	err := query.Set("pit", util.MapStr{
+		"id":         pitID,
+		"keep_alive": keepAlive,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/_search", s.GetEndpoint())
+	jsonBody := query.ToJSONString()
+	resp, err := s.Request(nil, util.Verb_POST, url, util.UnsafeStringToBytes(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+
+	if global.Env().IsDebug {
+		log.Trace("search with point in time,", url, ",", jsonBody)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, errors.New(string(resp.Body))
+	}
+	return resp.Body, nil
+}
+
 func (c *ESAPIV0) TemplateExists(templateName string) (bool, error) {
 	url := fmt.Sprintf("%s/_template/%s", c.GetEndpoint(), templateName)
 	resp, err := c.Request(nil, util.Verb_GET, url, nil)
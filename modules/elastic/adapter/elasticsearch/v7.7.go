@@ -84,3 +84,52 @@ func (c *ESAPIV7_7) GetIndices(pattern string) (*map[string]elastic.IndexInfo, e
 
 	return &indexInfo, nil
 }
+
+// supportsPointInTime is true from Elasticsearch 7.10, Easysearch and the
+// OpenSearch adapters embedding this one are handled by their own checks.
+func (c *ESAPIV7_7) supportsPointInTime() bool {
+	ver := c.GetVersion()
+	if ver.Distribution != "" && ver.Distribution != elastic.Elasticsearch {
+		return false
+	}
+	cr, err := util.VersionCompare(ver.Number, "7.10")
+	return err == nil && cr >= 0
+}
+
+func (c *ESAPIV7_7) OpenPointInTime(indexNames string, keepAlive string) (string, error) {
+	if !c.supportsPointInTime() {
+		return c.ESAPIV7_3.OpenPointInTime(indexNames, keepAlive)
+	}
+	url := fmt.Sprintf("%s/%s/_pit?keep_alive=%s", c.GetEndpoint(), util.UrlEncode(indexNames), keepAlive)
+	resp, err := c.Request(nil, util.Verb_POST, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", errors.New(string(resp.Body))
+	}
+	pit := struct {
+		ID string `json:"id"`
+	}{}
+	err = json.Unmarshal(resp.Body, &pit)
+	if err != nil {
+		return "", err
+	}
+	return pit.ID, nil
+}
+
+func (c *ESAPIV7_7) ClosePointInTime(pitID string) error {
+	if !c.supportsPointInTime() {
+		return c.ESAPIV7_3.ClosePointInTime(pitID)
+	}
+	url := fmt.Sprintf("%s/_pit", c.GetEndpoint())
+	body := util.MustToJSONBytes(util.MapStr{"id": pitID})
+	resp, err := c.Request(nil, util.Verb_DELETE, url, body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 404 {
+		return errors.New(string(resp.Body))
+	}
+	return nil
+}
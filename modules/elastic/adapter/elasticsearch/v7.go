@@ -339,6 +339,33 @@ func (c *ESAPIV7) Index(indexName, docType string, id interface{}, data interfac
 	return esResp, nil
 }
 
+// IndexIfMatch uses the typeless endpoint, 8.x rejects the typed one, docType is ignored
+func (c *ESAPIV7) IndexIfMatch(indexName, docType string, id interface{}, data interface{}, seqNo, primaryTerm int64, refresh string) (*elastic.InsertResponse, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/%s/%s/%s?if_seq_no=%d&if_primary_term=%d", c.GetEndpoint(), util.UrlEncode(indexName), TypeName7, id, seqNo, primaryTerm)
+	if refresh != "" {
+		url = fmt.Sprintf("%s&refresh=%s", url, refresh)
+	}
+	return c.writeIfMatch(url, js)
+}
+
+// UpdateIfMatch uses the typeless _update endpoint, docType is ignored
+func (c *ESAPIV7) UpdateIfMatch(indexName, docType string, id interface{}, data interface{}, seqNo, primaryTerm int64, refresh string) (*elastic.InsertResponse, error) {
+	js := util.MapStr{}
+	js["doc"] = data
+	js["detect_noop"] = false
+
+	url := fmt.Sprintf("%s/%s/_update/%s?if_seq_no=%d&if_primary_term=%d", c.GetEndpoint(), util.UrlEncode(indexName), id, seqNo, primaryTerm)
+	if refresh != "" {
+		url = fmt.Sprintf("%s&refresh=%s", url, refresh)
+	}
+	return c.writeIfMatch(url, util.MustToJSONBytes(js))
+}
+
 func (c *ESAPIV7) Create(indexName, docType string, id interface{}, data interface{}, refresh string) (*elastic.InsertResponse, error) {
 
 	if docType == "" {
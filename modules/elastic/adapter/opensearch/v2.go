@@ -27,6 +27,56 @@
 
 package opensearch
 
+import (
+	"fmt"
+	"github.com/segmentio/encoding/json"
+	"infini.sh/framework/core/util"
+)
+
 type APIV2 struct {
 	APIV1
 }
+
+// OpenSearch has point in time from 2.4, under _search/point_in_time.
+func (s *APIV2) supportsPointInTime() bool {
+	cr, err := util.VersionCompare(s.GetVersion().Number, "2.4")
+	return err == nil && cr >= 0
+}
+
+func (s *APIV2) OpenPointInTime(indexNames string, keepAlive string) (string, error) {
+	if !s.supportsPointInTime() {
+		return s.APIV1.OpenPointInTime(indexNames, keepAlive)
+	}
+	url := fmt.Sprintf("%s/%s/_search/point_in_time?keep_alive=%s", s.GetEndpoint(), util.UrlEncode(indexNames), keepAlive)
+	resp, err := s.Request(nil, util.Verb_POST, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("%s", resp.Body)
+	}
+	pit := struct {
+		ID string `json:"pit_id"`
+	}{}
+	err = json.Unmarshal(resp.Body, &pit)
+	if err != nil {
+		return "", err
+	}
+	return pit.ID, nil
+}
+
+func (s *APIV2) ClosePointInTime(pitID string) error {
+	if !s.supportsPointInTime() {
+		return s.APIV1.ClosePointInTime(pitID)
+	}
+	url := fmt.Sprintf("%s/_search/point_in_time", s.GetEndpoint())
+	body := util.MustToJSONBytes(util.MapStr{"pit_id": []string{pitID}})
+	resp, err := s.Request(nil, util.Verb_DELETE, url, body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 404 {
+		return fmt.Errorf("%s", resp.Body)
+	}
+	return nil
+}
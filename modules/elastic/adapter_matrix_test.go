@@ -0,0 +1,347 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastic
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/elastic/elastictest"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+	"infini.sh/framework/modules/elastic/common"
+)
+
+var adapterMatrix = []elastictest.Options{
+	{Distribution: elastictest.Elasticsearch, Version: "5.6.16"},
+	{Distribution: elastictest.Elasticsearch, Version: "6.8.23"},
+	{Distribution: elastictest.Elasticsearch, Version: "7.10.2"},
+	{Distribution: elastictest.Elasticsearch, Version: "7.17.24"},
+	{Distribution: elastictest.Elasticsearch, Version: "8.15.0"},
+	{Distribution: elastictest.Elasticsearch, Version: "9.1.0"},
+	{Distribution: elastictest.Opensearch, Version: "1.3.19"},
+	{Distribution: elastictest.Opensearch, Version: "2.17.0"},
+	{Distribution: elastictest.Opensearch, Version: "3.0.0"},
+	{Distribution: elastictest.Easysearch, Version: "1.12.0"},
+	{Distribution: elastictest.Easysearch, Version: "2.0.0"},
+}
+
+// newFakeClient starts a fake cluster and builds a client for it through
+// the registered provider, probing the version banner like production does.
+func newFakeClient(t *testing.T, opts elastictest.Options) (*elastictest.Server, elastic.API) {
+	t.Helper()
+	srv := elastictest.NewServer(opts)
+	t.Cleanup(srv.Close)
+
+	elastic.ResetClientCacheForTest()
+	elastic.RegisterClientProvider(common.InitClientWithConfig)
+	cfg := elastic.ElasticsearchConfig{}
+	cfg.ID = fmt.Sprintf("fake-%v-%v-%v", opts.Distribution, opts.Version, util.GetUUID())
+	cfg.Name = cfg.ID
+	cfg.Endpoint = srv.URL
+	cfg.Enabled = true
+	t.Cleanup(elastic.ResetClientCacheForTest)
+
+	client, err := elastic.GetOrCreateClient(cfg)
+	require.NoError(t, err)
+	require.NotNil(t, client)
+	return srv, client
+}
+
+func TestAdapterMatrix(t *testing.T) {
+	for _, opts := range adapterMatrix {
+		opts := opts
+		t.Run(opts.Distribution+"-"+opts.Version, func(t *testing.T) {
+			srv, client := newFakeClient(t, opts)
+
+			ver := client.GetVersion()
+			assert.Equal(t, opts.Version, ver.Number)
+			if opts.Distribution != elastictest.Elasticsearch {
+				assert.Equal(t, opts.Distribution, ver.Distribution)
+			}
+
+			docType := ""
+			if client.GetMajorVersion() < 7 {
+				docType = "doc"
+			}
+			require.NoError(t, client.CreateIndex("products", map[string]interface{}{
+				"mappings": typedMapping(client.GetMajorVersion(), map[string]interface{}{
+					"name":  map[string]interface{}{"type": "keyword"},
+					"price": map[string]interface{}{"type": "double"},
+					"body":  map[string]interface{}{"type": "text"},
+				}),
+			}))
+			exists, err := client.IndexExists("products")
+			require.NoError(t, err)
+			assert.True(t, exists)
+
+			inserted, err := client.Index("products", docType, "1", map[string]interface{}{
+				"name": "apple", "price": 1.5, "body": "fresh red apple",
+			}, "true")
+			require.NoError(t, err)
+			assert.Equal(t, "1", inserted.ID)
+			assert.Equal(t, 1, inserted.Version)
+
+			got, err := client.Get("products", docType, "1")
+			require.NoError(t, err)
+			assert.True(t, got.Found)
+			assert.Equal(t, "apple", got.Source["name"])
+
+			var bulk strings.Builder
+			for i, name := range []string{"banana", "cherry", "durian"} {
+				meta := util.MapStr{"_index": "products", "_id": fmt.Sprint(i + 2)}
+				if docType != "" {
+					meta["_type"] = docType
+				}
+				bulk.WriteString(util.MustToJSON(util.MapStr{"index": meta}) + "\n")
+				bulk.WriteString(util.MustToJSON(util.MapStr{"name": name, "price": float64(i + 2), "body": name + " fruit"}) + "\n")
+			}
+			result, err := client.Bulk([]byte(bulk.String()))
+			require.NoError(t, err)
+			assert.Equal(t, 200, result.StatusCode)
+			assert.Equal(t, 4, srv.DocCount("products"))
+
+			count, err := client.Count(context.Background(), "products", []byte(`{"query":{"range":{"price":{"gte":2}}}}`))
+			require.NoError(t, err)
+			assert.EqualValues(t, 3, count.Count)
+
+			resp, err := client.SearchWithRawQueryDSL("products", []byte(`{
+				"query": {"bool": {"must": [{"match": {"body": "fruit"}}], "must_not": [{"term": {"name": "durian"}}]}},
+				"sort": [{"price": "desc"}],
+				"aggs": {"avg_price": {"avg": {"field": "price"}}}
+			}`))
+			require.NoError(t, err)
+			assert.EqualValues(t, 2, resp.GetTotal())
+			require.Len(t, resp.Hits.Hits, 2)
+			assert.Equal(t, "3", resp.Hits.Hits[0].ID)
+			assert.EqualValues(t, 2.5, resp.Aggregations["avg_price"].Value)
+
+			deleted, err := client.Delete("products", docType, "1", "true")
+			require.NoError(t, err)
+			assert.Equal(t, "deleted", deleted.Result)
+			assert.Equal(t, 3, srv.DocCount("products"))
+
+			health, err := client.ClusterHealth(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, "green", health.Status)
+
+			nodes, err := client.CatNodes("")
+			require.NoError(t, err)
+			assert.Len(t, nodes, 1)
+
+			require.NoError(t, client.DeleteIndex("products"))
+			assert.Equal(t, -1, srv.DocCount("products"))
+		})
+	}
+}
+
+func TestAdapterMatrixConditionalWrites(t *testing.T) {
+	for _, opts := range adapterMatrix {
+		opts := opts
+		t.Run(opts.Distribution+"-"+opts.Version, func(t *testing.T) {
+			srv, client := newFakeClient(t, opts)
+			legacy := opts.Distribution == elastictest.Elasticsearch && client.GetMajorVersion() < 7
+			if legacy && client.GetMajorVersion() < 6 {
+				t.Skip("if_seq_no needs 6.7")
+			}
+			docType := ""
+			if legacy {
+				docType = "doc"
+			}
+			_, err := client.Index("users", docType, "1", map[string]interface{}{"name": "alice"}, "true")
+			require.NoError(t, err)
+			got, err := client.Get("users", docType, "1")
+			require.NoError(t, err)
+
+			_, err = client.IndexIfMatch("users", docType, "1", map[string]interface{}{"name": "bob"}, got.SeqNo, got.PrimaryTerm, "true")
+			require.NoError(t, err)
+			_, err = client.UpdateIfMatch("users", docType, "1", map[string]interface{}{"name": "carol"}, got.SeqNo, got.PrimaryTerm, "true")
+			assert.ErrorIs(t, err, elastic.ErrVersionConflict)
+			got, err = client.Get("users", docType, "1")
+			require.NoError(t, err)
+			_, err = client.UpdateIfMatch("users", docType, "1", map[string]interface{}{"name": "carol"}, got.SeqNo, got.PrimaryTerm, "true")
+			require.NoError(t, err)
+
+			//7.x and later take the typeless endpoints, 8.x rejects the typed
+			//ones; Index and IndexIfMatch share the document endpoint
+			if legacy {
+				assert.Equal(t, 2, srv.RequestCount("POST /{index}/{1}/{2}"))
+				assert.Equal(t, 2, srv.RequestCount("POST /{index}/{1}/{2}/_update"))
+			} else {
+				assert.Equal(t, 2, srv.RequestCount("POST /{index}/_doc/{id}"))
+				assert.Zero(t, srv.RequestCount("POST /{index}/{1}/{2}"))
+				assert.Equal(t, 2, srv.RequestCount("POST /{index}/_update/{id}"))
+				assert.Zero(t, srv.RequestCount("POST /{index}/{1}/{2}/_update"))
+			}
+			got, err = client.Get("users", docType, "1")
+			require.NoError(t, err)
+			assert.Equal(t, "carol", got.Source["name"])
+		})
+	}
+}
+
+func TestAdapterMatrixScroll(t *testing.T) {
+	for _, opts := range adapterMatrix {
+		opts := opts
+		t.Run(opts.Distribution+"-"+opts.Version, func(t *testing.T) {
+			_, client := newFakeClient(t, opts)
+			docType := ""
+			if client.GetMajorVersion() < 7 {
+				docType = "doc"
+			}
+			var bulk strings.Builder
+			for i := 0; i < 25; i++ {
+				meta := util.MapStr{"_index": "logs", "_id": fmt.Sprint(i)}
+				if docType != "" {
+					meta["_type"] = docType
+				}
+				bulk.WriteString(util.MustToJSON(util.MapStr{"index": meta}) + "\n")
+				bulk.WriteString(util.MustToJSON(util.MapStr{"seq": i}) + "\n")
+			}
+			_, err := client.Bulk([]byte(bulk.String()))
+			require.NoError(t, err)
+
+			data, err := client.NewScroll("logs", "1m", 10, nil, -1, 0)
+			require.NoError(t, err)
+			apiCtx := &elastic.APIContext{Client: &fasthttp.Client{}, Request: &fasthttp.Request{}, Response: &fasthttp.Response{}}
+			seen := 0
+			for {
+				page := elastic.SearchResponse{}
+				require.NoError(t, util.FromJSONBytes(data, &page))
+				if len(page.Hits.Hits) == 0 {
+					break
+				}
+				seen += len(page.Hits.Hits)
+				scrollID := util.MapStr{}
+				require.NoError(t, util.FromJSONBytes(data, &scrollID))
+				data, err = client.NextScroll(apiCtx, "1m", scrollID["_scroll_id"].(string))
+				require.NoError(t, err)
+			}
+			assert.Equal(t, 25, seen)
+		})
+	}
+}
+
+func TestAdapterMatrixPointInTime(t *testing.T) {
+	for _, opts := range adapterMatrix {
+		opts := opts
+		t.Run(opts.Distribution+"-"+opts.Version, func(t *testing.T) {
+			_, client := newFakeClient(t, opts)
+			supported := false
+			switch opts.Distribution {
+			case elastictest.Elasticsearch:
+				cr, _ := util.VersionCompare(opts.Version, "7.10")
+				supported = cr >= 0
+			case elastictest.Opensearch:
+				cr, _ := util.VersionCompare(opts.Version, "2.4")
+				supported = cr >= 0
+			}
+			if !supported {
+				_, err := client.OpenPointInTime("logs", "1m")
+				assert.ErrorIs(t, err, elastic.ErrPointInTimeNotSupported)
+				return
+			}
+
+			var bulk strings.Builder
+			for i := 0; i < 25; i++ {
+				bulk.WriteString(util.MustToJSON(util.MapStr{"index": util.MapStr{"_index": "logs", "_id": fmt.Sprint(i)}}) + "\n")
+				bulk.WriteString(util.MustToJSON(util.MapStr{"seq": i}) + "\n")
+			}
+			_, err := client.Bulk([]byte(bulk.String()))
+			require.NoError(t, err)
+
+			pitID, err := client.OpenPointInTime("logs", "1m")
+			require.NoError(t, err)
+			require.NotEmpty(t, pitID)
+			sort := []interface{}{util.MapStr{"seq": "asc"}}
+			var searchAfter []interface{}
+			seen := 0
+			for {
+				query := &elastic.SearchRequest{Size: 10, Sort: &sort}
+				if searchAfter != nil {
+					query.Set("search_after", searchAfter)
+				}
+				data, err := client.SearchWithPointInTime(pitID, "1m", query)
+				require.NoError(t, err)
+				page := elastic.SearchResponse{}
+				require.NoError(t, util.FromJSONBytes(data, &page))
+				if len(page.Hits.Hits) == 0 {
+					break
+				}
+				seen += len(page.Hits.Hits)
+				searchAfter = page.Hits.Hits[len(page.Hits.Hits)-1].Sort
+			}
+			assert.Equal(t, 25, seen)
+			assert.NoError(t, client.ClosePointInTime(pitID))
+		})
+	}
+}
+
+// typedMapping wraps properties in the legacy "doc" type before 7.0.
+func typedMapping(major int, props map[string]interface{}) map[string]interface{} {
+	mapping := map[string]interface{}{"properties": props}
+	if major < 7 {
+		return map[string]interface{}{"doc": mapping}
+	}
+	return mapping
+}
+
+func TestBulkProcessorRetriesRejectedItems(t *testing.T) {
+	srv, client := newFakeClient(t, elastictest.Options{Version: "7.17.24"})
+	metadata := client.(interface {
+		GetMetadata() *elastic.ElasticsearchMetadata
+	}).GetMetadata()
+
+	cfg := elastic.DefaultBulkProcessorConfig
+	cfg.RejectDelayInSeconds = 1
+	cfg.MaxRejectRetryTimes = 3
+	cfg.BulkResponseParseConfig.SaveErrorBulkResultToMessageQueue = false
+	cfg.BulkResponseParseConfig.SaveBusyBulkResultToMessageQueue = false
+	processor := elastic.NewBulkProcessor("fake-bulk", metadata.Config.ID, cfg)
+	buffer := processor.BulkBufferPool.AcquireBulkBuffer()
+	defer processor.BulkBufferPool.ReturnBulkBuffer(buffer)
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprint(i)
+		buffer.WriteNewByteBufferLine("meta", []byte(`{"index":{"_index":"events","_id":"`+id+`"}}`))
+		buffer.WriteNewByteBufferLine("payload", []byte(`{"n":`+id+`}`))
+		buffer.WriteMessageID(id)
+	}
+
+	srv.RejectBulkItems(2)
+	continueNext, stats, _, err := processor.Bulk(context.Background(), "fake-bulk", metadata, srv.Host(), buffer)
+	require.NoError(t, err)
+	assert.True(t, continueNext)
+	assert.Equal(t, 2, stats[429])
+	assert.Equal(t, 5, srv.DocCount("events"))
+	assert.Equal(t, 2, srv.RequestCount("POST /_bulk"))
+
+	srv.RejectBulkRequests(1)
+	continueNext, stats, _, err = processor.Bulk(context.Background(), "fake-bulk", metadata, srv.Host(), buffer)
+	assert.Error(t, err)
+	assert.False(t, continueNext)
+	assert.Equal(t, 5, stats[429])
+}
+
+func TestVectorCapabilityFollowsCluster(t *testing.T) {
+	supported := map[string]bool{
+		elastictest.Elasticsearch + "-8.11.0": false,
+		elastictest.Elasticsearch + "-8.12.0": true,
+		elastictest.Elasticsearch + "-8.15.0": true,
+		elastictest.Elasticsearch + "-9.1.0":  true,
+		elastictest.Opensearch + "-2.17.0":    false,
+		elastictest.Easysearch + "-2.0.0":     false,
+	}
+	for name, want := range supported {
+		parts := strings.SplitN(name, "-", 2)
+		t.Run(name, func(t *testing.T) {
+			_, client := newFakeClient(t, elastictest.Options{Distribution: parts[0], Version: parts[1]})
+			handler := &ElasticORM{Client: client}
+			assert.Equal(t, want, handler.Capabilities().Vector)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+//go:build !integration
+
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/aggregate/aggstest"
+	"infini.sh/framework/core/elastic/elastictest"
+	"infini.sh/framework/core/orm"
+	"infini.sh/framework/core/orm/ormtest"
+)
+
+// The contract and aggregation conformance suites run offline against the
+// in-process fake; with -tags integration the same suites run against the
+// live cluster instead (the contract suite registers its handler globally,
+// so only one of the two may run per binary).
+
+func TestContract_ElasticFake(t *testing.T) {
+	_, client := newFakeClient(t, elastictest.Options{})
+	require.NoError(t, client.CreateIndex("contractmodel", map[string]interface{}{
+		"mappings": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"name":    map[string]interface{}{"type": "keyword"},
+				"status":  map[string]interface{}{"type": "keyword"},
+				"body":    map[string]interface{}{"type": "text"},
+				"age":     map[string]interface{}{"type": "integer"},
+				"created": map[string]interface{}{"type": "date"},
+				"entries": map[string]interface{}{"type": "nested"},
+			},
+		},
+	}))
+	ormtest.RunContractTests(t, func() orm.ORM {
+		return &ElasticORM{Client: client}
+	})
+}
+
+func TestAggConformance_ElasticFake(t *testing.T) {
+	_, client := newFakeClient(t, elastictest.Options{})
+	aggstest.RunConformance(t, &elasticAggstestBackend{client: client})
+}
@@ -436,6 +436,7 @@ func (module *ElasticModule) Start() error {
 		client := elastic.GetClient(global.MustLookupString(elastic.GlobalSystemElasticsearchID))
 		module.storeHandler = &ElasticStore{Client: client, Config: moduleConfig.StoreConfig}
 		kv.Register("elastic", module.storeHandler)
+		kv.LoadRoutingConfig()
 	}
 
 	if global.Env().SystemConfig.ORMConfig.Enabled {
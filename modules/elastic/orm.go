@@ -163,9 +163,25 @@ func (handler *ElasticORM) Get(ctx *api.Context, o interface{}) (bool, error) {
 	}
 
 	err = util.FromJSONBytes(str, o)
+	setObjectVersion(o, response.SeqNo, response.PrimaryTerm)
 	return true, err
 }
 
+// setObjectVersion is a no-op on clusters that report no primary term
+// (before 6.7), where versioned writes are not available.
+func setObjectVersion(o interface{}, seqNo, primaryTerm int64) {
+	if primaryTerm > 0 {
+		api.SetObjectVersion(o, &api.ObjectVersion{SeqNo: seqNo, PrimaryTerm: primaryTerm})
+	}
+}
+
+func versionedWriteError(docID string, expected *api.ObjectVersion, err error) error {
+	if err == elastic.ErrVersionConflict {
+		return api.NewVersionConflictError(docID, expected)
+	}
+	return err
+}
+
 func (handler *ElasticORM) GetBy(field string, value interface{}, t interface{}) (error, api.Result) {
 	query := api.Query{}
 	query.Conds = api.And(api.Eq(field, value))
@@ -182,7 +198,10 @@ func (handler *ElasticORM) Create(ctx *api.Context, o interface{}) error {
 	if global.Env().IsDebug {
 		log.Debug("docID:", docID)
 	}
-	_, err := handler.Client.Create(handler.GetIndexName(o), "", docID, o, refresh)
+	response, err := handler.Client.Create(handler.GetIndexName(o), "", docID, o, refresh)
+	if err == nil && response != nil {
+		setObjectVersion(o, response.SeqNo, response.PrimaryTerm)
+	}
 	return err
 }
 
@@ -196,7 +215,17 @@ func (handler *ElasticORM) Save(ctx *api.Context, o interface{}) error {
 	if global.Env().IsDebug {
 		log.Trace("save doc, ID:", docID)
 	}
-	_, err := handler.Client.Index(handler.GetIndexName(o), "", docID, o, refresh)
+	var response *elastic.InsertResponse
+	var err error
+	if expected := api.GetObjectVersion(o); expected != nil {
+		response, err = handler.Client.IndexIfMatch(handler.GetIndexName(o), "", docID, o, expected.SeqNo, expected.PrimaryTerm, refresh)
+		err = versionedWriteError(docID, expected, err)
+	} else {
+		response, err = handler.Client.Index(handler.GetIndexName(o), "", docID, o, refresh)
+	}
+	if err == nil && response != nil {
+		setObjectVersion(o, response.SeqNo, response.PrimaryTerm)
+	}
 	return err
 }
 
@@ -214,7 +243,17 @@ func (handler *ElasticORM) Update(ctx *api.Context, o interface{}) error {
 	//handle tenant and user's footprint
 	docID := getIndexID(o)
 
-	_, err := handler.Client.Update(handler.GetIndexName(o), "", docID, o, refresh)
+	var response *elastic.InsertResponse
+	var err error
+	if expected := api.GetObjectVersion(o); expected != nil {
+		response, err = handler.Client.UpdateIfMatch(handler.GetIndexName(o), "", docID, o, expected.SeqNo, expected.PrimaryTerm, refresh)
+		err = versionedWriteError(docID, expected, err)
+	} else {
+		response, err = handler.Client.Update(handler.GetIndexName(o), "", docID, o, refresh)
+	}
+	if err == nil && response != nil {
+		setObjectVersion(o, response.SeqNo, response.PrimaryTerm)
+	}
 	return err
 }
 
@@ -407,6 +446,12 @@ func (handler *ElasticORM) SearchV2(ctx *api.Context, qb *api.QueryBuilder) (*ap
 
 	if qb != nil {
 
+		if qb.CursorEnabled() {
+			if _, err := qb.SearchAfterValues(); err != nil {
+				return nil, err
+			}
+		}
+
 		bytes := qb.RequestBodyBytesVal()
 		var dsl map[string]interface{}
 		if bytes != nil && len(bytes) > 0 {
@@ -458,11 +503,28 @@ func (handler *ElasticORM) SearchV2(ctx *api.Context, qb *api.QueryBuilder) (*ap
 		//log.Info(searchResponse.RawResult.StatusCode, string(searchResponse.RawResult.Body))
 	}
 
+	if searchResponse != nil && qb != nil && qb.CursorEnabled() {
+		result.NextCursor = nextCursor(searchResponse.Hits.Hits, qb.SizeVal())
+	}
+
 	result.Error = &err
 
 	return result, err
 }
 
+// nextCursor encodes the sort values of the last hit, a page shorter than
+// the requested size is the last one.
+func nextCursor(hits []elastic.IndexDocument, size int) string {
+	if len(hits) == 0 || (size > 0 && len(hits) < size) {
+		return ""
+	}
+	last := hits[len(hits)-1]
+	if len(last.Sort) == 0 {
+		return ""
+	}
+	return api.EncodeCursor(last.Sort)
+}
+
 func (handler *ElasticORM) Search(t interface{}, q *api.Query) (error, api.Result) {
 
 	var err error
@@ -723,14 +785,35 @@ func (handler *ElasticORM) GroupBy(t interface{}, selectField, groupField string
 }
 
 // Capabilities declares what the elastic backend honors: the full
-// QueryBuilder surface (the DSL is native here).
+// QueryBuilder surface (the DSL is native here), vectors only where the
+// cluster has the knn query. Transactions are a compensated bulk, not
+// atomic (see orm_tx.go).
 func (handler *ElasticORM) Capabilities() api.Capabilities {
 	return api.Capabilities{
-		FullText:       true,
-		Aggregations:   true,
-		Fuzzy:          true,
-		Nested:         true,
-		RequestBodyDSL: true,
-		Collapse:       true,
+		FullText:           true,
+		Aggregations:       true,
+		Fuzzy:              true,
+		Nested:             true,
+		RequestBodyDSL:     true,
+		Collapse:           true,
+		Vector:             handler.supportsVector(),
+		Transactions:       true,
+		AtomicTransactions: false,
+	}
+}
+
+// supportsVector tells whether the cluster runs the knn query semantic
+// vector clauses are sent as, a query of Elasticsearch 8.12 and later. Older
+// 8.x only has the top-level knn section, other distributions use another
+// syntax.
+func (handler *ElasticORM) supportsVector() bool {
+	if handler.Client == nil {
+		return false
+	}
+	ver := handler.Client.GetVersion()
+	if ver.Distribution != "" && ver.Distribution != elastic.Elasticsearch {
+		return false
 	}
+	cr, err := util.VersionCompare(ver.Number, "8.12")
+	return err == nil && cr >= 0
 }
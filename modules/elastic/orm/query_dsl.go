@@ -197,7 +197,7 @@ func BuildQueryDSL(q *orm.QueryBuilder) map[string]interface{} {
 		dsl["query"] = flattenBoolClauses(query)
 	}
 
-	if q.FromVal() > 0 {
+	if q.FromVal() > 0 && !q.CursorEnabled() {
 		dsl["from"] = q.FromVal()
 	}
 
@@ -222,9 +222,19 @@ func BuildQueryDSL(q *orm.QueryBuilder) map[string]interface{} {
 		dsl["_source"] = sources
 	}
 
-	if len(q.Sorts()) > 0 {
+	sorts := q.Sorts()
+	if q.CursorEnabled() {
+		sorts = q.CursorSorts()
+		//a malformed cursor is left out, callers reject it up front with
+		//the 400 error of SearchAfterValues, see ElasticORM.SearchV2
+		if values, err := q.SearchAfterValues(); err == nil && len(values) > 0 {
+			dsl["search_after"] = values
+		}
+	}
+
+	if len(sorts) > 0 {
 		var sortList []interface{}
-		for _, s := range q.Sorts() {
+		for _, s := range sorts {
 			sortList = append(sortList, map[string]interface{}{
 				s.Field: map[string]interface{}{
 					"order": string(s.SortType), // correct usage of your SortType
@@ -489,6 +499,22 @@ func buildLeafQuery(clause *orm.Clause) map[string]interface{} {
 		}
 
 	case orm.QuerySemantic:
+		// A vector encoded by the caller is a knn query, Elasticsearch 8.12+
+		// only, see ElasticORM.Capabilities:
+		// {"knn": {"field": "...", "query_vector": [...], "num_candidates": 10}}
+		if params != nil && params.Get("query_vector") != nil {
+			m := map[string]interface{}{
+				"field":        field,
+				"query_vector": params.Get("query_vector"),
+			}
+			if candidates := params.Get("candidates"); candidates != nil {
+				m["num_candidates"] = candidates
+			}
+			return map[string]interface{}{
+				"knn": m,
+			}
+		}
+
 		// Build semantic query DSL
 		// {"semantic": {"field": {"query_text": "...", "candidates": 10, "query_strategy": "LSH_COSINE"}}}
 		m := map[string]interface{}{}
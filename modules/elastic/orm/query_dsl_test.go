@@ -1546,6 +1546,28 @@ func TestToDSL_SemanticQuery_Defaults(t *testing.T) {
 	assert.JSONEq(t, expected, string(actual))
 }
 
+func TestToDSL_SemanticVectorQuery(t *testing.T) {
+	q := orm.NewQuery().Must(
+		orm.SemanticVectorQuery("embedding", []float32{0.5, 1}, 10),
+	)
+
+	dsl := BuildQueryDSL(q)
+	printDSL(dsl)
+
+	expected := `{
+		"query": {
+			"knn": {
+				"field": "embedding",
+				"query_vector": [0.5, 1],
+				"num_candidates": 10
+			}
+		}
+	}`
+
+	actual, _ := json.Marshal(dsl)
+	assert.JSONEq(t, expected, string(actual))
+}
+
 func TestToDSL_HybridQuery(t *testing.T) {
 	matchClause := orm.MatchQuery("document_chunk.text", "mysql")
 	semanticClause := orm.SemanticQuery("document_chunk.embedding.embedding1024", "full text search", 10, "")
@@ -1652,3 +1674,28 @@ func TestToDSL_NestedQuery_SimpleMatch(t *testing.T) {
 	actual, _ := json.Marshal(dsl)
 	assert.JSONEq(t, expected, string(actual))
 }
+
+func TestBuildQueryDSL_SearchAfter(t *testing.T) {
+	q := orm.NewQuery().SortBy(orm.Sort{Field: "created", SortType: orm.DESC}).From(20).Size(5)
+	q.SearchAfter(orm.EncodeCursor([]interface{}{int64(1700000000000), "doc-9"}))
+
+	dsl := BuildQueryDSL(q)
+
+	_, hasFrom := dsl["from"]
+	assert.False(t, hasFrom, "search_after replaces from")
+	assert.Equal(t, []interface{}{int64(1700000000000), "doc-9"}, dsl["search_after"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"created": map[string]interface{}{"order": "desc"}},
+		map[string]interface{}{"id": map[string]interface{}{"order": "asc"}},
+	}, dsl["sort"])
+
+	first := BuildQueryDSL(orm.NewQuery().SearchAfter(""))
+	_, hasSearchAfter := first["search_after"]
+	assert.False(t, hasSearchAfter)
+	assert.Len(t, first["sort"], 1)
+
+	malformed := orm.NewQuery().SearchAfter("not a cursor")
+	assert.NotPanics(t, func() { BuildQueryDSL(malformed) })
+	_, hasSearchAfter = BuildQueryDSL(malformed)["search_after"]
+	assert.False(t, hasSearchAfter)
+}
@@ -0,0 +1,57 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastic
+
+import (
+	"strings"
+
+	"infini.sh/framework/core/errors"
+	api "infini.sh/framework/core/orm"
+	"infini.sh/framework/core/util"
+)
+
+// AddField puts the mapping of field into the index of model, dotted
+// fields become nested object properties. Existing documents are only
+// indexed for the new field after a Reindex step. The template used for new
+// indices is still built from the struct tags, so the field needs an
+// elastic_mapping tag too.
+func (handler *ElasticORM) AddField(ctx *api.Context, model interface{}, field string, mapping util.MapStr) error {
+	if field == "" || len(mapping) == 0 {
+		return errors.Errorf("field and mapping are required, got [%v] and %v", field, mapping)
+	}
+
+	indexName := handler.GetIndexName(model)
+	body := util.MustToJSONBytes(util.MapStr{"properties": fieldProperties(strings.Split(field, "."), mapping)})
+	res, err := handler.Client.UpdateMapping(indexName, "", body)
+	if err != nil {
+		return errors.Errorf("failed to add field %v to %v: %v, %v", field, indexName, err, string(res))
+	}
+	return nil
+}
+
+func fieldProperties(path []string, mapping util.MapStr) util.MapStr {
+	if len(path) == 1 {
+		return util.MapStr{path[0]: mapping}
+	}
+	return util.MapStr{path[0]: util.MapStr{"properties": fieldProperties(path[1:], mapping)}}
+}
+
+// Reindex runs an update by query over the index of model, which indexes
+// every document again against the current mapping in place. Incompatible
+// mapping changes, like a new type for an existing field, need a new index
+// instead.
+func (handler *ElasticORM) Reindex(ctx *api.Context, model interface{}) error {
+	indexName := handler.GetIndexName(model)
+	body := util.MustToJSONBytes(util.MapStr{
+		"conflicts": "proceed",
+		"query":     util.MapStr{"match_all": util.MapStr{}},
+	})
+	res, err := handler.Client.UpdateByQuery(indexName, body)
+	if err != nil {
+		return err
+	}
+	if len(res.Failures) > 0 {
+		return errors.Errorf("reindex of %v failed on %v documents: %v", indexName, len(res.Failures), util.MustToJSON(res.Failures[0]))
+	}
+	return handler.Client.Refresh(indexName)
+}
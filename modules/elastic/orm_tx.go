@@ -0,0 +1,223 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/errors"
+	api "infini.sh/framework/core/orm"
+	"infini.sh/framework/core/util"
+)
+
+// Transaction is best-effort: Elasticsearch has no multi-document
+// transactions. Writes made through tx are buffered and sent as one bulk
+// request once fn returns nil, nothing is written when fn fails. If the bulk
+// request or any of its items fails, every touched document is put back to
+// the state it had right before the commit; writes made by others to the
+// same documents in between are lost by that compensation.
+func (handler *ElasticORM) Transaction(ctx *api.Context, fn func(tx api.Tx) error) error {
+	tx := &esTx{handler: handler}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.commit(ctx)
+}
+
+type esTxOp struct {
+	action  string //create, index, update or delete
+	index   string
+	id      string
+	source  []byte
+	version *api.ObjectVersion
+}
+
+type esTxSnapshot struct {
+	index  string
+	id     string
+	exists bool
+	source map[string]interface{}
+}
+
+// esTx stages the writes of one transaction, reads see the staged writes
+// first and fall back to the cluster.
+type esTx struct {
+	handler *ElasticORM
+	ops     []esTxOp
+}
+
+func (tx *esTx) stage(action string, o interface{}) error {
+	id := getIndexID(o)
+	if id == "" {
+		return errors.Errorf("id is required for %v in transaction", action)
+	}
+
+	op := esTxOp{action: action, index: tx.handler.GetIndexName(o), id: id}
+	if action == "index" || action == "update" {
+		op.version = api.GetObjectVersion(o)
+	}
+	if action != "delete" {
+		op.source = util.MustToJSONBytes(o)
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+func (tx *esTx) Get(ctx *api.Context, o interface{}) (bool, error) {
+	id := getIndexID(o)
+	index := tx.handler.GetIndexName(o)
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		op := tx.ops[i]
+		if op.id != id || op.index != index {
+			continue
+		}
+		if op.action == "delete" {
+			return false, ErrNotFound
+		}
+		return true, util.FromJSONBytes(op.source, o)
+	}
+	return tx.handler.Get(ctx, o)
+}
+
+func (tx *esTx) Create(ctx *api.Context, o interface{}) error {
+	return tx.stage("create", o)
+}
+
+func (tx *esTx) Save(ctx *api.Context, o interface{}) error {
+	return tx.stage("index", o)
+}
+
+func (tx *esTx) Update(ctx *api.Context, o interface{}) error {
+	return tx.stage("update", o)
+}
+
+func (tx *esTx) Delete(ctx *api.Context, o interface{}) error {
+	return tx.stage("delete", o)
+}
+
+func (tx *esTx) bulkBody() []byte {
+	buffer := bytes.Buffer{}
+	for _, op := range tx.ops {
+		meta := util.MapStr{"_index": op.index, "_id": op.id}
+		if op.version != nil {
+			meta["if_seq_no"] = op.version.SeqNo
+			meta["if_primary_term"] = op.version.PrimaryTerm
+		}
+		buffer.Write(util.MustToJSONBytes(util.MapStr{op.action: meta}))
+		buffer.WriteByte('\n')
+		switch op.action {
+		case "delete":
+			continue
+		case "update":
+			buffer.Write(util.MustToJSONBytes(util.MapStr{"doc": json.RawMessage(op.source)}))
+		default:
+			buffer.Write(op.source)
+		}
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes()
+}
+
+func (tx *esTx) commit(ctx *api.Context) error {
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	var refresh string
+	if ctx != nil {
+		refresh = ctx.Refresh
+	}
+
+	client := tx.handler.Client
+	snapshots := []esTxSnapshot{}
+	seen := map[string]bool{}
+	for _, op := range tx.ops {
+		key := op.index + "/" + op.id
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		response, err := client.Get(op.index, "", op.id)
+		if err != nil {
+			return err
+		}
+		//fail early, the bulk would only report a generic item error
+		if v := op.version; v != nil && (!response.Found || response.SeqNo != v.SeqNo || response.PrimaryTerm != v.PrimaryTerm) {
+			return api.NewVersionConflictError(op.id, v)
+		}
+		snapshots = append(snapshots, esTxSnapshot{index: op.index, id: op.id, exists: response.Found, source: response.Source})
+	}
+
+	result, err := client.Bulk(tx.bulkBody())
+	if err == nil && result != nil {
+		//the bulk response is filtered down to the item errors, a failed
+		//item doesn't fail the request
+		if msgs := bulkItemErrors(result.Body); len(msgs) > 0 {
+			err = errors.Errorf("%v of %v bulk items failed: %v", len(msgs), len(tx.ops), strings.Join(msgs, "; "))
+		}
+	}
+	if err == nil {
+		if refresh != "" {
+			indices := map[string]bool{}
+			for _, v := range snapshots {
+				if !indices[v.index] {
+					indices[v.index] = true
+					if err := client.Refresh(v.index); err != nil {
+						log.Warnf("failed to refresh index %v after transaction: %v", v.index, err)
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	//restore the state before the commit, in reverse order
+	failed := 0
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		v := snapshots[i]
+		var restoreErr error
+		if v.exists {
+			_, restoreErr = client.Index(v.index, "", v.id, v.source, refresh)
+		} else {
+			_, restoreErr = client.Delete(v.index, "", v.id, refresh)
+		}
+		if restoreErr != nil {
+			failed++
+			log.Errorf("failed to compensate %v/%v after transaction failure: %v", v.index, v.id, restoreErr)
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("transaction failed: %v, and %v of %v documents could not be restored", err, failed, len(snapshots))
+	}
+	return fmt.Errorf("%w: %v", api.ErrTransactionRolledBack, err)
+}
+
+// bulkItemErrors returns the error of every failed item of a bulk response.
+func bulkItemErrors(body []byte) []string {
+	response := struct {
+		Items []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}{}
+	if len(body) == 0 || json.Unmarshal(body, &response) != nil {
+		return nil
+	}
+	var msgs []string
+	for _, item := range response.Items {
+		for action, result := range item {
+			if len(result.Error) > 0 && string(result.Error) != "null" {
+				msgs = append(msgs, fmt.Sprintf("%v: %s", action, result.Error))
+			} else if result.Status >= 300 {
+				msgs = append(msgs, fmt.Sprintf("%v: status %v", action, result.Status))
+			}
+		}
+	}
+	return msgs
+}
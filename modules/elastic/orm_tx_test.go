@@ -0,0 +1,71 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastic
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/elastic/elastictest"
+	"infini.sh/framework/core/orm"
+)
+
+func TestTransactionStagesWrites(t *testing.T) {
+	tx := &esTx{handler: &ElasticORM{}}
+
+	h := MyHost{Host: "a.com", Favicon: "v1"}
+	require.NoError(t, tx.Create(nil, &h))
+	h.Favicon = "v2"
+	require.NoError(t, tx.Update(nil, &h))
+	require.NoError(t, tx.Delete(nil, &MyHost{Host: "b.com"}))
+	assert.Error(t, tx.Save(nil, &MyHost{}), "id is required")
+
+	got := MyHost{Host: "a.com"}
+	exists, err := tx.Get(nil, &got)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "v2", got.Favicon, "latest staged write wins")
+
+	exists, err = tx.Get(nil, &MyHost{Host: "b.com"})
+	assert.False(t, exists)
+	assert.Equal(t, ErrNotFound, err)
+
+	index := tx.handler.GetIndexName(&h)
+	lines := strings.Split(strings.TrimSpace(string(tx.bulkBody())), "\n")
+	require.Len(t, lines, 5)
+	assert.Equal(t, `{"create":{"_id":"a.com","_index":"`+index+`"}}`, lines[0])
+	assert.Equal(t, `{"update":{"_id":"a.com","_index":"`+index+`"}}`, lines[2])
+	assert.True(t, strings.HasPrefix(lines[3], `{"doc":{"host":"a.com","favicon":"v2"`))
+	assert.Equal(t, `{"delete":{"_id":"b.com","_index":"`+index+`"}}`, lines[4])
+}
+
+func TestTransactionCompensatesFailedBulkItems(t *testing.T) {
+	_, client := newFakeClient(t, elastictest.Options{})
+	handler := &ElasticORM{Client: client}
+	index := handler.GetIndexName(&MyHost{})
+	_, err := client.Index(index, "", "a.com", MyHost{Host: "a.com", Favicon: "v1"}, "true")
+	require.NoError(t, err)
+
+	//the create of an existing document fails at commit time, the bulk
+	//request itself succeeds
+	err = handler.Transaction(nil, func(tx orm.Tx) error {
+		if err := tx.Save(nil, &MyHost{Host: "b.com", Favicon: "v1"}); err != nil {
+			return err
+		}
+		if err := tx.Save(nil, &MyHost{Host: "a.com", Favicon: "v2"}); err != nil {
+			return err
+		}
+		return tx.Create(nil, &MyHost{Host: "a.com", Favicon: "v3"})
+	})
+	assert.ErrorIs(t, err, orm.ErrTransactionRolledBack)
+	assert.Contains(t, err.Error(), "version_conflict_engine_exception")
+
+	got, err := client.Get(index, "", "a.com")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", got.Source["favicon"])
+	got, err = client.Get(index, "", "b.com")
+	require.NoError(t, err)
+	assert.False(t, got.Found)
+}
@@ -28,16 +28,19 @@
 package elastic
 
 import (
+	"bytes"
 	"encoding/base64"
 	"fmt"
 	"github.com/bkaradzic/go-lz4"
 	log "github.com/cihub/seelog"
 	"infini.sh/framework/core/elastic"
 	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/kv"
 	"infini.sh/framework/core/orm"
 	"infini.sh/framework/core/util"
 	"infini.sh/framework/modules/elastic/common"
 	"net/http"
+	"strings"
 )
 
 type ElasticStore struct {
@@ -141,6 +144,47 @@ func (store *ElasticStore) AddValue(bucket string, key []byte, value []byte) err
 	return err
 }
 
+var _ kv.KVCASStore = (*ElasticStore)(nil)
+
+// CompareAndSwap creates the document with op_type=create when old is nil,
+// otherwise replaces it only if its seq_no and primary_term did not move
+// since it was read.
+func (store *ElasticStore) CompareAndSwap(bucket string, key, old, value []byte) (bool, error) {
+	id := getKey(bucket, string(key))
+	file := Blob{}
+	file.Content = base64.URLEncoding.EncodeToString(value)
+
+	response, err := store.Client.Get(store.Config.IndexName, "_doc", id)
+	if err != nil {
+		return false, err
+	}
+	var current []byte
+	if response.Found {
+		if content, ok := response.Source["content"].(string); ok {
+			current, err = base64.URLEncoding.DecodeString(content)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	if (old == nil) != (len(current) == 0) || !bytes.Equal(current, old) {
+		return false, nil
+	}
+
+	if !response.Found {
+		_, err = store.Client.Create(store.Config.IndexName, "_doc", id, file, "")
+		if err != nil && strings.Contains(err.Error(), "version_conflict_engine_exception") {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	_, err = store.Client.IndexIfMatch(store.Config.IndexName, "_doc", id, file, response.SeqNo, response.PrimaryTerm, "")
+	if err == elastic.ErrVersionConflict {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 func (store *ElasticStore) DeleteKey(bucket string, key []byte) error {
 	_, err := store.Client.Delete(store.Config.IndexName, "_doc", getKey(bucket, string(key)))
 	return err
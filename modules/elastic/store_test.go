@@ -0,0 +1,44 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package elastic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/elastic/elastictest"
+	"infini.sh/framework/modules/elastic/common"
+)
+
+func TestElasticStoreCompareAndSwap(t *testing.T) {
+	for _, opts := range []elastictest.Options{
+		{Distribution: elastictest.Elasticsearch, Version: "6.8.23"},
+		{Distribution: elastictest.Elasticsearch, Version: "7.17.0"},
+		{Distribution: elastictest.Elasticsearch, Version: "8.15.0"},
+		{Distribution: elastictest.Opensearch, Version: "2.17.0"},
+	} {
+		t.Run(opts.Distribution+"-"+opts.Version, func(t *testing.T) {
+			_, client := newFakeClient(t, opts)
+			store := &ElasticStore{Client: client, Config: common.StoreConfig{IndexName: "kv"}}
+
+			ok, err := store.CompareAndSwap("bucket", []byte("k"), nil, []byte("v1"))
+			require.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = store.CompareAndSwap("bucket", []byte("k"), nil, []byte("v2"))
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			ok, err = store.CompareAndSwap("bucket", []byte("k"), []byte("stale"), []byte("v2"))
+			require.NoError(t, err)
+			assert.False(t, ok)
+			ok, err = store.CompareAndSwap("bucket", []byte("k"), []byte("v1"), []byte("v2"))
+			require.NoError(t, err)
+			assert.True(t, ok)
+
+			v, err := store.GetValue("bucket", []byte("k"))
+			require.NoError(t, err)
+			assert.Equal(t, []byte("v2"), v)
+		})
+	}
+}
@@ -53,7 +53,7 @@ import (
 //   - for_each:
 //     message_field: messages     # where the consumer stored []queue.Message
 //     codec: otel                # payload codec (see RecordCodec)
-//     on_failure: ignore          # ignore | tag | fail (sub-chain error policy)
+//     on_failure: ignore          # ignore | tag | fail | dead_letter (sub-chain error policy)
 //     failure_tag: _processing_failed   # tag appended when on_failure=tag
 //     processor:                  # sub-chain, executed per record
 //   - dissect:
@@ -70,6 +70,10 @@ import (
 //	fail    abort the whole batch: Process returns the error, so the
 //	        consumer leaves the offset uncommitted and the batch is
 //	        redelivered (at-least-once)
+//	dead_letter  retry the record from its original payload under the
+//	        retry policy of the consumer, then move the message to the
+//	        consumer's dead-letter queue and drop it from the batch; a
+//	        failing batch processor fails the whole batch
 //
 // Sub-processors implementing pipeline.BatchProcessor are executed once
 // per batch (after per-record decoding), before any per-record processor
@@ -106,9 +110,9 @@ func NewForEachProcessor(c *config.Config) (pipeline.Processor, error) {
 		return nil, fmt.Errorf("unknown for_each codec %q (registered: %v)", cfg.Codec, recordCodecNames())
 	}
 	switch cfg.OnFailure {
-	case "", "ignore", "tag", "fail":
+	case "", "ignore", "tag", "fail", "dead_letter":
 	default:
-		return nil, fmt.Errorf("invalid for_each on_failure %q (ignore|tag|fail)", cfg.OnFailure)
+		return nil, fmt.Errorf("invalid for_each on_failure %q (ignore|tag|fail|dead_letter)", cfg.OnFailure)
 	}
 	if cfg.FailureTag == "" {
 		cfg.FailureTag = "_processing_failed"
@@ -194,6 +198,7 @@ func (p *ForEachProcessor) Process(c *pipeline.Context) error {
 	// skips the rest of the chain for that record); tag needs the
 	// per-processor loop to continue the chain after a tagged failure.
 	plain := &pipeline.Processors{List: perRecord, SkipCatchError: p.sub.SkipCatchError}
+	deadLettered := map[int]bool{} // msgs index, moved to the dead-letter queue
 	for j, rec := range records {
 		if c.IsCanceled() || !c.ShouldContinue() {
 			break
@@ -226,7 +231,18 @@ func (p *ForEachProcessor) Process(c *pipeline.Context) error {
 			mergeFailureTags(rec, tags)
 		} else {
 			if err := plain.Process(c); err != nil {
-				if err2 := p.handleFailure(c, err); err2 != nil {
+				if p.cfg.OnFailure == "dead_letter" {
+					i := decodedIdx[j]
+					retried, err2 := p.deadLetter(c, plain, &msgs[i], err)
+					if err2 != nil {
+						return err2
+					}
+					if retried == nil {
+						deadLettered[i] = true
+						continue
+					}
+					rec = retried
+				} else if err2 := p.handleFailure(c, err); err2 != nil {
 					return err2
 				}
 			}
@@ -250,6 +266,18 @@ func (p *ForEachProcessor) Process(c *pipeline.Context) error {
 		msgs[i].Data = encoded
 		msgs[i].Size = len(encoded)
 	}
+
+	// Dead-lettered messages leave the batch, downstream stages only get
+	// the messages still owned by the source queue.
+	if len(deadLettered) > 0 {
+		kept := make([]queue.Message, 0, len(msgs)-len(deadLettered))
+		for i := range msgs {
+			if !deadLettered[i] {
+				kept = append(kept, msgs[i])
+			}
+		}
+		c.Set(param.ParaKey(p.cfg.MessageField), kept)
+	}
 	return nil
 }
 
@@ -259,8 +287,8 @@ func (p *ForEachProcessor) Process(c *pipeline.Context) error {
 // attached, so the tag strategy degrades to a warning there.
 func (p *ForEachProcessor) handleFailure(c *pipeline.Context, err error) error {
 	switch p.cfg.OnFailure {
-	case "fail":
-		return fmt.Errorf("for_each: sub-chain failed (on_failure=fail): %w", err)
+	case "fail", "dead_letter":
+		return fmt.Errorf("for_each: sub-chain failed (on_failure=%s): %w", p.cfg.OnFailure, err)
 	case "tag":
 		pipeline.AppendFailureTag(c, p.cfg.FailureTag)
 		log.Warnf("for_each: sub-chain error tagged %q: %v", p.cfg.FailureTag, err)
@@ -271,6 +299,44 @@ func (p *ForEachProcessor) handleFailure(c *pipeline.Context, err error) error {
 	}
 }
 
+// deadLetter retries a failed record on a fresh decode of its message, under
+// the retry policy of the consumer that fetched the batch, the failure that
+// got here counting as the first attempt. It returns the record that
+// eventually passed, or nil once the message was moved to the dead-letter
+// queue.
+func (p *ForEachProcessor) deadLetter(c *pipeline.Context, plain *pipeline.Processors, msg *queue.Message, failure error) (*event.Event, error) {
+	qCfg, _ := c.Get(param.ParaKey("QUEUE_CONFIG")).(*queue.QueueConfig)
+	cCfg, _ := c.Get(param.ParaKey("CONSUMER_CONFIG")).(*queue.ConsumerConfig)
+	if qCfg == nil {
+		return nil, fmt.Errorf("for_each: sub-chain failed, no source queue to dead-letter to (on_failure=dead_letter): %w", failure)
+	}
+	var policy *queue.RetryPolicy
+	if cCfg != nil {
+		policy = cCfg.Retry
+	}
+
+	var rec *event.Event
+	attempts, err := queue.Retry(c.Context, policy, func(attempt int) error {
+		if attempt == 1 {
+			return failure
+		}
+		r, err := p.codec.Decode(msg.Data)
+		if err != nil {
+			return err
+		}
+		rec = r
+		c.Set(pipeline.RecordContextKey, r)
+		return plain.Process(c)
+	})
+	if err == nil {
+		return rec, nil
+	}
+	if err := queue.SendToDeadLetterQueue(qCfg, cCfg, []queue.Message{*msg}, attempts, err); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
 // mergeFailureTags persists accumulated failure tags into the record's
 // Fields["tags"], preserving tags the record already carried.
 func mergeFailureTags(rec *event.Event, tags []string) {
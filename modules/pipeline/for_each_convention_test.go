@@ -10,10 +10,12 @@ import (
 
 	"infini.sh/framework/core/config"
 	"infini.sh/framework/core/event"
+	"infini.sh/framework/core/kv/kvtest"
 	"infini.sh/framework/core/param"
 	"infini.sh/framework/core/pipeline"
 	"infini.sh/framework/core/queue"
 	"infini.sh/framework/core/util"
+	"infini.sh/framework/modules/queue/mem_queue"
 )
 
 // batchSampler counts records per batch (BatchProcessor fixture).
@@ -177,6 +179,87 @@ func TestForEach_OnFailureFail(t *testing.T) {
 	}
 }
 
+// dead_letter retries the record from its original payload under the
+// consumer's retry policy; a record that passes on retry stays in the batch.
+func TestForEach_OnFailureDeadLetterRetries(t *testing.T) {
+	p := buildForEachCfg(t, util.MapStr{
+		"on_failure": "dead_letter",
+		"processor":  []interface{}{util.MapStr{"test_always_fail": util.MapStr{}}},
+	})
+	flaky := &flakyProc{failures: 2}
+	p.sub.List = []pipeline.Processor{flaky}
+
+	ctx := &pipeline.Context{Context: t.Context()}
+	msgs := []queue.Message{otelMsg(`{"payload":{"message":"x"}}`)}
+	ctx.Set(param.ParaKey("messages"), msgs)
+	ctx.Set(param.ParaKey("QUEUE_CONFIG"), &queue.QueueConfig{ID: "q1", Name: "q1"})
+	ctx.Set(param.ParaKey("CONSUMER_CONFIG"), &queue.ConsumerConfig{Retry: &queue.RetryPolicy{MaxAttempts: 3, InitialBackoffInMs: 1}})
+
+	if err := p.Process(ctx); err != nil {
+		t.Fatalf("dead_letter strategy must not fail the batch: %v", err)
+	}
+	if flaky.calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", flaky.calls)
+	}
+	if len(msgs[0].Data) == 0 {
+		t.Fatal("record that passed on retry must be kept")
+	}
+}
+
+// One record is dead-lettered, the others still run through the sub-chain
+// and only they are handed downstream.
+func TestForEach_OnFailureDeadLetterDropsRecord(t *testing.T) {
+	kvtest.Use("for_each_test")
+	queue.RegisterDefaultHandler(&mem_queue.MemoryQueue{Capacity: 100})
+	p := buildForEachCfg(t, util.MapStr{
+		"on_failure": "dead_letter",
+		"processor":  []interface{}{util.MapStr{"test_always_fail": util.MapStr{}}},
+	})
+	picky := &pickyProc{reject: "bad"}
+	p.sub.List = []pipeline.Processor{picky}
+
+	ctx := &pipeline.Context{Context: t.Context()}
+	msgs := []queue.Message{
+		otelMsg(`{"payload":{"message":"first"}}`),
+		otelMsg(`{"payload":{"message":"bad"}}`),
+		otelMsg(`{"payload":{"message":"last"}}`),
+	}
+	ctx.Set(param.ParaKey("messages"), msgs)
+	ctx.Set(param.ParaKey("QUEUE_CONFIG"), queue.AdvancedGetOrInitConfig("memory", "for_each_dlq_source", nil))
+	ctx.Set(param.ParaKey("CONSUMER_CONFIG"), &queue.ConsumerConfig{Group: "g", Name: "c", Retry: &queue.RetryPolicy{MaxAttempts: 1}})
+
+	if err := p.Process(ctx); err != nil {
+		t.Fatalf("dead_letter strategy must not fail the batch: %v", err)
+	}
+	if strings.Join(picky.seen, ",") != "first,bad,last" {
+		t.Fatalf("every record must reach the sub-chain, got %v", picky.seen)
+	}
+	kept, _ := ctx.Get(param.ParaKey("messages")).([]queue.Message)
+	if len(kept) != 2 {
+		t.Fatalf("expected 2 messages downstream, got %d", len(kept))
+	}
+	for _, m := range kept {
+		if len(m.Data) == 0 || strings.Contains(string(m.Data), "bad") {
+			t.Fatalf("dead-lettered record handed downstream: %q", m.Data)
+		}
+	}
+}
+
+// Without a source queue there is nowhere to dead-letter to.
+func TestForEach_OnFailureDeadLetterNoQueue(t *testing.T) {
+	p := buildForEachCfg(t, util.MapStr{
+		"on_failure": "dead_letter",
+		"processor":  []interface{}{util.MapStr{"test_always_fail": util.MapStr{}}},
+	})
+	ctx := &pipeline.Context{Context: t.Context()}
+	msgs := []queue.Message{otelMsg(`{"payload":{"message":"x"}}`)}
+	ctx.Set(param.ParaKey("messages"), msgs)
+
+	if err := p.Process(ctx); err == nil {
+		t.Fatal("dead_letter strategy without a queue must fail the batch")
+	}
+}
+
 func TestForEach_OnFailureInvalidRejected(t *testing.T) {
 	c, _ := config.NewConfigFrom(util.MapStr{
 		"on_failure": "explode",
@@ -229,6 +312,36 @@ type failProc struct{}
 func (failProc) Name() string                      { return "test_always_fail" }
 func (failProc) Process(c *pipeline.Context) error { return errBoom }
 
+// flakyProc fails its first failures calls.
+type flakyProc struct{ failures, calls int }
+
+func (f *flakyProc) Name() string { return "test_flaky" }
+func (f *flakyProc) Process(c *pipeline.Context) error {
+	f.calls++
+	if f.calls <= f.failures {
+		return errBoom
+	}
+	return nil
+}
+
+// pickyProc fails the records whose message is reject, and records the
+// messages it saw.
+type pickyProc struct {
+	reject string
+	seen   []string
+}
+
+func (p *pickyProc) Name() string { return "test_picky" }
+func (p *pickyProc) Process(c *pipeline.Context) error {
+	rec, _ := pipeline.CurrentRecord(c)
+	msg, _ := rec.Fields["message"].(string)
+	p.seen = append(p.seen, msg)
+	if msg == p.reject {
+		return errBoom
+	}
+	return nil
+}
+
 // markerProc records whether it ran (chain-position probe).
 type markerProc struct{ ran bool }
 
@@ -31,6 +31,8 @@ import (
 	"infini.sh/framework/core/global"
 	queue "infini.sh/framework/modules/queue/disk_queue"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	log "github.com/cihub/seelog"
@@ -60,6 +62,8 @@ func init() {
 
 	//reset consumer offset
 	api.HandleAPIMethod(api.PUT, "/queue/:id/consumer/:consumer_id/offset", module.QueueResetConsumerOffset)
+	//reset the consumers of a group to a point in time
+	api.HandleAPIMethod(api.PUT, "/queue/:id/group/:group/offset", module.QueueResetGroupOffsetForTime)
 	//get consumer offset
 	api.HandleAPIMethod(api.GET, "/queue/:id/consumer/:consumer_id/offset", module.QueueGetConsumerOffset)
 
@@ -67,6 +71,11 @@ func init() {
 	api.HandleAPIMethod(api.DELETE, "/queue/:id/consumer/:consumer_id", module.QueueDeleteConsumerByID)
 	// delete all consumers of queues specified by query
 	api.HandleAPIMethod(api.DELETE, "/queue/consumer/_search", module.DeleteConsumersByQuery)
+
+	//dead-letter queues
+	api.HandleAPIMethod(api.GET, "/queue/_dlq", module.ListDeadLetterQueues)
+	api.HandleAPIMethod(api.GET, "/queue/:id/_dlq", module.GetDeadLetters)
+	api.HandleAPIMethod(api.POST, "/queue/:id/_dlq/_replay", module.ReplayDeadLetters)
 }
 
 func (module *API) SingleQueueStatsAction(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
@@ -278,6 +287,12 @@ func (module *API) QueueExplore(w http.ResponseWriter, req *http.Request, ps htt
 					msg["message"] = string(v.Data)
 					msg["offset"] = v.Offset.String()
 					msg["size"] = v.Size
+					if len(v.Key) > 0 {
+						msg["key"] = string(v.Key)
+					}
+					if len(v.Headers) > 0 {
+						msg["headers"] = v.Headers
+					}
 					msgs = append(msgs, msg)
 				}
 				result["messages"] = msgs
@@ -457,3 +472,261 @@ func (module *API) QueueResetConsumerOffset(w http.ResponseWriter, req *http.Req
 
 	module.WriteAckJSON(w, ack, status, nil)
 }
+
+// parseOffsetTime parses a point in time given as RFC3339 or as unix
+// milliseconds.
+func parseOffsetTime(v string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// QueueResetGroupOffsetForTime moves every consumer of a group back or forth
+// to the first message written at or after the given time, eg: to replay
+// everything since an incident.
+func (module *API) QueueResetGroupOffsetForTime(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	queueID := ps.MustGetParameter("id")
+	group := ps.MustGetParameter("group")
+
+	cfg, ok := queue1.SmartGetConfig(queueID)
+	if !ok {
+		module.WriteError(w, fmt.Sprintf("queue [%v] not found", queueID), http.StatusNotFound)
+		return
+	}
+
+	t, err := parseOffsetTime(module.GetParameter(req, "time"))
+	if err != nil {
+		module.WriteError(w, fmt.Sprintf("invalid time, should be RFC3339 or unix milliseconds: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	consumers, _ := queue1.GetConsumerConfigsByQueueID(cfg.ID)
+	offsets := util.MapStr{}
+	for _, v := range consumers {
+		if v.Group != group {
+			continue
+		}
+		offset, err := queue1.ResetOffsetForTime(cfg, v, t)
+		if err != nil {
+			module.WriteError(w, fmt.Sprintf("failed to reset offset of consumer [%v]: %v", v.Key(), err), http.StatusInternalServerError)
+			return
+		}
+		offsets[v.Key()] = offset
+	}
+
+	if len(offsets) == 0 {
+		module.WriteError(w, fmt.Sprintf("no consumer of group [%v] found in queue [%v]", group, queueID), http.StatusNotFound)
+		return
+	}
+
+	module.WriteJSON(w, util.MapStr{
+		"acknowledged": true,
+		"time":         t,
+		"offsets":      offsets,
+	}, http.StatusOK)
+}
+
+const (
+	deadLetterReplayGroup = "dead_letter"
+	deadLetterReplayName  = "replay"
+)
+
+// replayLocks keeps concurrent replays of a dead-letter queue from handing
+// out the same messages twice, by queue id.
+var replayLocks sync.Map
+
+func getReplayLock(id string) *sync.Mutex {
+	v, _ := replayLocks.LoadOrStore(id, &sync.Mutex{})
+	return v.(*sync.Mutex)
+}
+
+// getDeadLetterQueue resolves a dead-letter queue, or the default one of a
+// source queue.
+func getDeadLetterQueue(id string) (*queue1.QueueConfig, bool) {
+	cfg, ok := queue1.SmartGetConfig(id)
+	if !ok {
+		return nil, false
+	}
+	if cfg.Labels != nil && util.ToString(cfg.Labels[queue1.LabelDeadLetter]) == "true" {
+		return cfg, true
+	}
+	return queue1.SmartGetConfig(queue1.DeadLetterQueueName(cfg, nil))
+}
+
+func deadLetterMessage(msg *queue1.Message) util.MapStr {
+	m := util.MapStr{
+		"offset":      msg.Offset.EncodeToString(),
+		"next_offset": msg.NextOffset.EncodeToString(),
+		"message":     string(msg.Data),
+	}
+	if len(msg.Key) > 0 {
+		m["key"] = string(msg.Key)
+	}
+	if headers := queue1.StripDeadLetterHeaders(msg.Headers); len(headers) > 0 {
+		m["headers"] = headers
+	}
+	if v, ok := queue1.GetDeadLetter(msg); ok {
+		m["dead_letter"] = v
+	}
+	return m
+}
+
+// fetchMessages reads up to size messages from offset without committing.
+func fetchMessages(qConfig *queue1.QueueConfig, consumer *queue1.ConsumerConfig, offset queue1.Offset, size int) ([]queue1.Message, *queue1.Context, error) {
+	consumer.FetchMaxMessages = size
+	consumer.FetchMaxWaitMs = 500
+	consumer.EOFMaxRetryTimes = 10
+	consumer.FetchMaxBytes = 1024 * 500
+
+	consumerAPI, err := queue1.AcquireConsumer(qConfig, consumer, "api")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer queue1.ReleaseConsumer(qConfig, consumer, consumerAPI)
+
+	err = consumerAPI.ResetOffset(offset.Segment, offset.Position)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx := &queue1.Context{InitOffset: offset}
+	messages, _, err := consumerAPI.FetchMessages(ctx, size)
+	return messages, ctx, err
+}
+
+func (module *API) ListDeadLetterQueues(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	queues := []util.MapStr{}
+	for _, cfg := range queue1.GetConfigByLabels(util.MapStr{queue1.LabelDeadLetter: true}) {
+		latest := queue1.LatestOffset(cfg)
+		q := util.MapStr{
+			"id":            cfg.ID,
+			"name":          cfg.Name,
+			"latest_offset": latest.EncodeToString(),
+		}
+		if source, ok := queue1.SmartGetConfig(util.ToString(cfg.Labels[queue1.LabelDeadLetterSource])); ok {
+			q["source"] = util.MapStr{"id": source.ID, "name": source.Name}
+		}
+		if consumer, ok := queue1.GetConsumerConfig(cfg.ID, deadLetterReplayGroup, deadLetterReplayName); ok {
+			if offset, err := queue1.GetOffset(cfg, consumer); err == nil {
+				q["replay_offset"] = offset.EncodeToString()
+			}
+		}
+		queues = append(queues, q)
+	}
+	module.WriteJSON(w, util.MapStr{"queues": queues}, 200)
+}
+
+func (module *API) GetDeadLetters(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	dlq, ok := getDeadLetterQueue(ps.MustGetParameter("id"))
+	if !ok {
+		module.WriteError(w, fmt.Sprintf("dead-letter queue of [%v] not found", ps.MustGetParameter("id")), http.StatusNotFound)
+		return
+	}
+	offset := queue1.DecodeFromString(module.GetParameterOrDefault(req, "offset", "0,0"))
+	size := module.GetIntOrDefault(req, "size", 10)
+
+	consumer := queue1.NewConsumerConfig(dlq.ID, "api", "dead_letter")
+	messages, ctx, err := fetchMessages(dlq, consumer, offset, size)
+	if err != nil {
+		module.WriteError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	msgs := []util.MapStr{}
+	for i := range messages {
+		msgs = append(msgs, deadLetterMessage(&messages[i]))
+	}
+	module.WriteJSON(w, util.MapStr{
+		"queue":       util.MapStr{"id": dlq.ID, "name": dlq.Name},
+		"messages":    msgs,
+		"next_offset": ctx.NextOffset.EncodeToString(),
+	}, 200)
+}
+
+// ReplayDeadLetters pushes the next size messages of a dead-letter queue
+// back to the queues they failed on, with their original key and headers.
+// Progress is kept as the offset of a dedicated consumer, so a replay picks
+// up where the previous one stopped.
+func (module *API) ReplayDeadLetters(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	dlq, ok := getDeadLetterQueue(ps.MustGetParameter("id"))
+	if !ok {
+		module.WriteError(w, fmt.Sprintf("dead-letter queue of [%v] not found", ps.MustGetParameter("id")), http.StatusNotFound)
+		return
+	}
+	size := module.GetIntOrDefault(req, "size", 100)
+
+	lock := getReplayLock(dlq.ID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	consumer := queue1.GetOrInitConsumerConfig(dlq.ID, deadLetterReplayGroup, deadLetterReplayName)
+
+	offset, err := queue1.GetOffset(dlq, consumer)
+	if err != nil {
+		module.WriteError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messages, _, err := fetchMessages(dlq, consumer, offset, size)
+	if err != nil {
+		module.WriteError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	replayed := map[string]int{}
+	producers := map[string]queue1.ProducerAPI{}
+	next := offset
+	for i := range messages {
+		msg := &messages[i]
+		err = replayDeadLetter(dlq, msg, producers, replayed)
+		if err != nil {
+			break
+		}
+		next = msg.NextOffset
+	}
+
+	if !next.Equals(offset) {
+		next.Version = offset.Version
+		if _, commitErr := queue1.CommitOffset(dlq, consumer, next); commitErr != nil && err == nil {
+			err = commitErr
+		}
+	}
+
+	result := util.MapStr{
+		"replayed":    replayed,
+		"next_offset": next.EncodeToString(),
+	}
+	status := 200
+	if err != nil {
+		result["error"] = err.Error()
+		status = 500
+	}
+	module.WriteJSON(w, result, status)
+}
+
+func replayDeadLetter(dlq *queue1.QueueConfig, msg *queue1.Message, producers map[string]queue1.ProducerAPI, replayed map[string]int) error {
+	source := util.ToString(dlq.Labels[queue1.LabelDeadLetterSource])
+	if v, ok := queue1.GetDeadLetter(msg); ok {
+		source = v.SourceQueue
+	}
+	target, ok := queue1.SmartGetConfig(source)
+	if !ok {
+		return errors.Errorf("source queue [%v] of message [%v] not found", source, msg.Offset.EncodeToString())
+	}
+
+	producer, ok := producers[target.ID]
+	if !ok {
+		var err error
+		producer, err = queue1.AcquireProducer(target)
+		if err != nil {
+			return err
+		}
+		producers[target.ID] = producer
+	}
+
+	reqs := []queue1.ProduceRequest{{Topic: target.ID, Key: msg.Key, Headers: queue1.StripDeadLetterHeaders(msg.Headers), Data: msg.Data}}
+	if _, err := producer.Produce(&reqs); err != nil {
+		return err
+	}
+	replayed[target.Name]++
+	return nil
+}
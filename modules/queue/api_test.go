@@ -0,0 +1,195 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	httprouter "infini.sh/framework/core/api/router"
+	"infini.sh/framework/core/kv/kvtest"
+	queue1 "infini.sh/framework/core/queue"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/modules/queue/mem_queue"
+)
+
+var (
+	setupAPITestOnce sync.Once
+	memoryQueue      = &mem_queue.MemoryQueue{Capacity: 1000}
+)
+
+// setupDeadLetters creates a memory queue named source, with count messages
+// in its dead-letter queue.
+func setupDeadLetters(t *testing.T, source string, count int) (*queue1.QueueConfig, *queue1.QueueConfig) {
+	t.Helper()
+	setupAPITestOnce.Do(func() {
+		kvtest.Use("queue_api_test")
+		queue1.Register("memory", memoryQueue)
+	})
+
+	qCfg := queue1.AdvancedGetOrInitConfig("memory", source, nil)
+	msgs := []queue1.Message{}
+	for i := 0; i < count; i++ {
+		msgs = append(msgs, queue1.Message{Key: []byte(fmt.Sprint(i)), Data: []byte(fmt.Sprintf("msg-%v", i))})
+	}
+	require.NoError(t, queue1.SendToDeadLetterQueue(qCfg, nil, msgs, 3, errors.New("bulk rejected")))
+	return qCfg, queue1.GetOrInitDeadLetterQueue(qCfg, nil)
+}
+
+func callAPI(t *testing.T, h httprouter.Handle, method, target string, ps httprouter.Params) (int, map[string]interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(method, target, nil), ps)
+	out := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out), w.Body.String())
+	return w.Code, out
+}
+
+// popAll drains the messages Pop has not returned yet.
+func popAll(q string) []string {
+	out := []string{}
+	for {
+		data, timeout := memoryQueue.Pop(q, 0)
+		if timeout {
+			return out
+		}
+		out = append(out, string(data))
+	}
+}
+
+func TestDeadLetterAPI(t *testing.T) {
+	module := API{}
+	source, dlq := setupDeadLetters(t, "dlq_api_orders", 3)
+	ps := httprouter.Params{{Key: "id", Value: source.Name}}
+
+	code, out := callAPI(t, module.ListDeadLetterQueues, http.MethodGet, "/queue/dead_letter", nil)
+	assert.Equal(t, http.StatusOK, code)
+	var found util.MapStr
+	for _, q := range out["queues"].([]interface{}) {
+		if m := util.MapStr(q.(map[string]interface{})); m["id"] == dlq.ID {
+			found = m
+		}
+	}
+	require.NotNil(t, found)
+	assert.Equal(t, source.ID, found["source"].(map[string]interface{})["id"])
+	assert.Equal(t, encodeOffset(3), found["latest_offset"])
+
+	code, out = callAPI(t, module.GetDeadLetters, http.MethodGet, "/queue/"+source.Name+"/dead_letter?size=2", ps)
+	assert.Equal(t, http.StatusOK, code)
+	msgs := out["messages"].([]interface{})
+	require.Len(t, msgs, 2)
+	first := msgs[0].(map[string]interface{})
+	assert.Equal(t, "msg-0", first["message"])
+	assert.Equal(t, "0", first["key"])
+	assert.Equal(t, "bulk rejected", first["dead_letter"].(map[string]interface{})["reason"])
+	assert.Equal(t, encodeOffset(2), out["next_offset"])
+
+	code, _ = callAPI(t, module.GetDeadLetters, http.MethodGet, "/queue/missing/dead_letter", httprouter.Params{{Key: "id", Value: "missing"}})
+	assert.Equal(t, http.StatusNotFound, code)
+
+	//replays continue where the previous one stopped
+	code, out = callAPI(t, module.ReplayDeadLetters, http.MethodPost, "/queue/"+source.Name+"/dead_letter/_replay?size=2", ps)
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 2, out["replayed"].(map[string]interface{})[source.Name])
+	assert.Equal(t, encodeOffset(2), out["next_offset"])
+	code, out = callAPI(t, module.ReplayDeadLetters, http.MethodPost, "/queue/"+source.Name+"/dead_letter/_replay?size=2", ps)
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 1, out["replayed"].(map[string]interface{})[source.Name])
+	assert.Equal(t, []string{"msg-0", "msg-1", "msg-2"}, popAll(source.ID))
+
+	_, out = callAPI(t, module.ListDeadLetterQueues, http.MethodGet, "/queue/dead_letter", nil)
+	for _, q := range out["queues"].([]interface{}) {
+		if m := q.(map[string]interface{}); m["id"] == dlq.ID {
+			assert.Equal(t, encodeOffset(3), m["replay_offset"])
+		}
+	}
+}
+
+func TestReplayDeadLettersLocksPerQueue(t *testing.T) {
+	module := API{}
+	source, dlq := setupDeadLetters(t, "dlq_api_concurrent", 32)
+	other, _ := setupDeadLetters(t, "dlq_api_other", 1)
+
+	//concurrent replays of one queue hand out every message once
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			callAPI(t, module.ReplayDeadLetters, http.MethodPost, "/?size=2", httprouter.Params{{Key: "id", Value: source.Name}})
+		}()
+	}
+	close(start)
+	wg.Wait()
+	replayed := popAll(source.ID)
+	assert.Len(t, replayed, 32)
+	assert.Len(t, distinct(replayed), 32)
+
+	//a replay in progress does not hold up the ones of other queues
+	lock := getReplayLock(dlq.ID)
+	lock.Lock()
+	code, out := callAPI(t, module.ReplayDeadLetters, http.MethodPost, "/?size=1", httprouter.Params{{Key: "id", Value: other.Name}})
+	assert.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 1, out["replayed"].(map[string]interface{})[other.Name])
+	assert.Equal(t, []string{"msg-0"}, popAll(other.ID))
+
+	//but the ones of the same queue wait
+	require.NoError(t, queue1.SendToDeadLetterQueue(source, nil, []queue1.Message{{Data: []byte("late")}}, 1, errors.New("bulk rejected")))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		callAPI(t, module.ReplayDeadLetters, http.MethodPost, "/?size=1", httprouter.Params{{Key: "id", Value: source.Name}})
+	}()
+	select {
+	case <-done:
+		t.Fatal("replay of a locked queue did not wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock.Unlock()
+	<-done
+	assert.Equal(t, []string{"late"}, popAll(source.ID))
+}
+
+func distinct(values []string) map[string]bool {
+	out := map[string]bool{}
+	for _, v := range values {
+		out[v] = true
+	}
+	return out
+}
+
+func encodeOffset(position int64) string {
+	offset := queue1.NewOffset(0, position)
+	return offset.EncodeToString()
+}
@@ -0,0 +1,71 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI Ltd. All rights reserved.
+ * web: https://infinilabs.com
+ * mail: hello#infini.ltd */
+
+package delay_queue
+
+import (
+	"time"
+
+	"infini.sh/framework/core/queue"
+)
+
+// Consumer takes due messages of a delay queue, the messages it did not
+// commit are redelivered once it is closed.
+type Consumer struct {
+	dq   *delayQueue
+	qCfg *queue.QueueConfig
+	cCfg *queue.ConsumerConfig
+}
+
+func (c *Consumer) Close() error {
+	c.dq.requeue(c.cCfg.Key())
+	return nil
+}
+
+// ResetOffset does nothing, delivered messages can not be replayed.
+func (c *Consumer) ResetOffset(segment, readPos int64) error {
+	return nil
+}
+
+func (c *Consumer) FetchMessages(ctx *queue.Context, numOfMessages int) (messages []queue.Message, isTimeout bool, err error) {
+	if numOfMessages <= 0 || (c.cCfg.FetchMaxMessages > 0 && numOfMessages > c.cCfg.FetchMaxMessages) {
+		numOfMessages = c.cCfg.FetchMaxMessages
+	}
+
+	messages = c.dq.deliver(c.cCfg.Key(), numOfMessages, c.cCfg.FetchMaxBytes, time.Duration(c.cCfg.FetchMaxWaitMs)*time.Millisecond)
+	if len(messages) > 0 {
+		ctx.InitOffset = messages[0].Offset
+		ctx.NextOffset = messages[len(messages)-1].NextOffset
+	}
+	ctx.MessageCount = len(messages)
+	return messages, len(messages) == 0, nil
+}
+
+func (c *Consumer) CommitOffset(offset queue.Offset) error {
+	c.dq.ack(c.cCfg.Key(), offset)
+	return nil
+}
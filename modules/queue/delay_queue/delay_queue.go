@@ -0,0 +1,340 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI Ltd. All rights reserved.
+ * web: https://infinilabs.com
+ * mail: hello#infini.ltd */
+
+package delay_queue
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/queue"
+)
+
+// message is a message of a delay queue as it is stored.
+type message struct {
+	Seq       int64             `json:"seq"`
+	NotBefore int64             `json:"not_before"` //unix ms
+	Priority  int               `json:"priority,omitempty"`
+	Timestamp int64             `json:"timestamp"`
+	Key       []byte            `json:"key,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Data      []byte            `json:"data"`
+}
+
+// waitingHeap orders the messages that are not due yet by due time.
+type waitingHeap []*message
+
+func (h waitingHeap) Len() int { return len(h) }
+func (h waitingHeap) Less(i, j int) bool {
+	if h[i].NotBefore != h[j].NotBefore {
+		return h[i].NotBefore < h[j].NotBefore
+	}
+	return h[i].Seq < h[j].Seq
+}
+func (h waitingHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *waitingHeap) Push(x interface{}) { *h = append(*h, x.(*message)) }
+func (h *waitingHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	v := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return v
+}
+
+// readyHeap orders the messages that are due, higher priorities first, then
+// by due time.
+type readyHeap []*message
+
+func (h readyHeap) Len() int { return len(h) }
+func (h readyHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	return waitingHeap(h).Less(i, j)
+}
+func (h readyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *readyHeap) Push(x interface{}) { *h = append(*h, x.(*message)) }
+func (h *readyHeap) Pop() interface{}   { return (*waitingHeap)(h).Pop() }
+
+type delivery struct {
+	offset int64
+	msg    *message
+}
+
+// delayQueue schedules the messages of one queue. Every message is handed
+// out once, to Pop or to one of the consumers, consumers acknowledge their
+// messages by committing, and get the ones they did not commit redelivered
+// to any consumer once they are closed.
+type delayQueue struct {
+	name  string
+	store store
+
+	lock    sync.Mutex
+	seq     int64
+	waiting waitingHeap
+	ready   readyHeap
+	size    uint64
+	//delivered counts the deliveries to consumers, it is the offset of the
+	//next delivery
+	delivered int64
+	inflight  map[string][]delivery
+	notify    chan struct{}
+}
+
+func newDelayQueue(name string, s store) (*delayQueue, error) {
+	q := &delayQueue{
+		name:     name,
+		store:    s,
+		inflight: map[string][]delivery{},
+		notify:   make(chan struct{}),
+	}
+	err := s.load(name, func(msg *message) {
+		if msg.Seq >= q.seq {
+			q.seq = msg.Seq + 1
+		}
+		q.schedule(msg)
+	})
+	return q, err
+}
+
+func (q *delayQueue) schedule(msg *message) {
+	q.size += uint64(len(msg.Data))
+	heap.Push(&q.waiting, msg)
+}
+
+// wake up the ones waiting in take, lock held
+func (q *delayQueue) signal() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+func (q *delayQueue) add(req *queue.ProduceRequest) (*message, error) {
+	now := time.Now()
+	msg := &message{
+		NotBefore: now.UnixMilli(),
+		Priority:  queue.Priority(req.Headers),
+		Timestamp: now.Unix(),
+		Data:      append([]byte(nil), req.Data...),
+	}
+	if t := queue.NotBefore(req.Headers); !t.IsZero() {
+		msg.NotBefore = t.UnixMilli()
+	}
+	if len(req.Key) > 0 {
+		msg.Key = append([]byte(nil), req.Key...)
+	}
+	if len(req.Headers) > 0 {
+		msg.Headers = make(map[string]string, len(req.Headers))
+		for k, v := range req.Headers {
+			msg.Headers[k] = v
+		}
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	msg.Seq = q.seq
+	err := q.store.put(q.name, msg)
+	if err != nil {
+		return nil, err
+	}
+	q.seq++
+	q.schedule(msg)
+	q.signal()
+	return msg, nil
+}
+
+// promote moves the messages that are due to the ready heap, lock held
+func (q *delayQueue) promote(now time.Time) {
+	ms := now.UnixMilli()
+	for q.waiting.Len() > 0 && q.waiting[0].NotBefore <= ms {
+		heap.Push(&q.ready, heap.Pop(&q.waiting))
+	}
+}
+
+// take removes up to max due messages, up to maxBytes unless the first one
+// is larger, and passes them to fn with the lock held. It waits up to
+// timeout for a message to become due.
+func (q *delayQueue) take(max, maxBytes int, timeout time.Duration, fn func(msg *message)) int {
+	if max <= 0 {
+		max = 1
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		q.lock.Lock()
+		now := time.Now()
+		q.promote(now)
+		if q.ready.Len() > 0 {
+			var count, bytes int
+			for q.ready.Len() > 0 && count < max {
+				if count > 0 && maxBytes > 0 && bytes+len(q.ready[0].Data) > maxBytes {
+					break
+				}
+				msg := heap.Pop(&q.ready).(*message)
+				count++
+				bytes += len(msg.Data)
+				fn(msg)
+			}
+			q.lock.Unlock()
+			return count
+		}
+
+		wait := deadline.Sub(now)
+		if wait <= 0 {
+			q.lock.Unlock()
+			return 0
+		}
+		if q.waiting.Len() > 0 {
+			if due := time.UnixMilli(q.waiting[0].NotBefore).Sub(now); due < wait {
+				wait = due
+			}
+		}
+		notify := q.notify
+		q.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// remove drops a message that was handed out, lock held
+func (q *delayQueue) remove(msg *message) {
+	q.size -= uint64(len(msg.Data))
+	if err := q.store.delete(q.name, msg.Seq); err != nil {
+		log.Errorf("failed to delete message [%v] of delay queue [%v]: %v", msg.Seq, q.name, err)
+	}
+}
+
+func (q *delayQueue) pop(timeout time.Duration) *message {
+	var out *message
+	q.take(1, 0, timeout, func(msg *message) {
+		q.remove(msg)
+		out = msg
+	})
+	return out
+}
+
+// deliver hands due messages to a consumer, they stay in flight until the
+// consumer commits an offset after them.
+func (q *delayQueue) deliver(consumer string, max, maxBytes int, timeout time.Duration) []queue.Message {
+	messages := []queue.Message{}
+	q.take(max, maxBytes, timeout, func(msg *message) {
+		offset := q.delivered
+		q.delivered++
+		q.inflight[consumer] = append(q.inflight[consumer], delivery{offset: offset, msg: msg})
+		messages = append(messages, queue.Message{
+			Timestamp:  msg.Timestamp,
+			Offset:     queue.NewOffset(0, offset),
+			NextOffset: queue.NewOffset(0, offset+1),
+			Size:       len(msg.Data),
+			Data:       msg.Data,
+			Key:        msg.Key,
+			Headers:    msg.Headers,
+		})
+	})
+	return messages
+}
+
+// ack removes the messages delivered to consumer before offset.
+func (q *delayQueue) ack(consumer string, offset queue.Offset) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	pending := q.inflight[consumer][:0]
+	for _, v := range q.inflight[consumer] {
+		if v.offset < offset.Position {
+			q.remove(v.msg)
+		} else {
+			pending = append(pending, v)
+		}
+	}
+	if len(pending) == 0 {
+		delete(q.inflight, consumer)
+	} else {
+		q.inflight[consumer] = pending
+	}
+}
+
+// requeue makes the messages consumer did not acknowledge visible again.
+func (q *delayQueue) requeue(consumer string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	pending := q.inflight[consumer]
+	if len(pending) == 0 {
+		return
+	}
+	delete(q.inflight, consumer)
+	for _, v := range pending {
+		heap.Push(&q.ready, v.msg)
+	}
+	q.signal()
+}
+
+// depth counts every message that was not acknowledged yet, due or not.
+func (q *delayQueue) depth() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	depth := q.waiting.Len() + q.ready.Len()
+	for _, v := range q.inflight {
+		depth += len(v)
+	}
+	return int64(depth)
+}
+
+func (q *delayQueue) storageSize() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
+
+// latestOffset is where a consumer is after taking every message that is
+// due now.
+func (q *delayQueue) latestOffset() queue.Offset {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.promote(time.Now())
+	return queue.NewOffset(0, q.delivered+int64(q.ready.Len()))
+}
+
+// offset is the latest offset without the messages consumer did not
+// acknowledge yet.
+func (q *delayQueue) offset(consumer string) queue.Offset {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if pending := q.inflight[consumer]; len(pending) > 0 {
+		return queue.NewOffset(0, pending[0].offset)
+	}
+	return queue.NewOffset(0, q.delivered)
+}
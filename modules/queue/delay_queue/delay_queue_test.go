@@ -0,0 +1,136 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package delay_queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/kv"
+	"infini.sh/framework/core/kv/kvtest"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/util"
+)
+
+// newStore keeps the messages of the test in a bucket of its own.
+func newStore(t *testing.T) *kvStore {
+	kvtest.Use("delay_queue_test")
+	return &kvStore{bucket: "delay_queue_" + t.Name()}
+}
+
+func TestDelayQueuePriorityAndDelay(t *testing.T) {
+	dq := &DelayQueue{store: newStore(t)}
+	cfg := &queue.QueueConfig{ID: "jobs"}
+	producer, err := dq.AcquireProducer(cfg)
+	require.NoError(t, err)
+
+	later := queue.ProduceRequest{Data: []byte("later")}
+	later.SetDelay(150 * time.Millisecond)
+	later.SetPriority(100)
+	low := queue.ProduceRequest{Data: []byte("low")}
+	high := queue.ProduceRequest{Data: []byte("high")}
+	high.SetPriority(5)
+	reqs := []queue.ProduceRequest{later, low, high, {Data: []byte("low2")}}
+	_, err = producer.Produce(&reqs)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), dq.Depth(cfg.ID))
+
+	//due messages by priority, then in order
+	for _, v := range []string{"high", "low", "low2"} {
+		data, timeout := dq.Pop(cfg.ID, 0)
+		assert.False(t, timeout)
+		assert.Equal(t, v, string(data))
+	}
+	_, timeout := dq.Pop(cfg.ID, 0)
+	assert.True(t, timeout)
+
+	//Pop waits for the delayed message to be due
+	start := time.Now()
+	data, timeout := dq.Pop(cfg.ID, time.Second)
+	assert.False(t, timeout)
+	assert.Equal(t, "later", string(data))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+	assert.Equal(t, int64(0), dq.Depth(cfg.ID))
+	assert.Equal(t, uint64(0), dq.GetStorageSize(cfg.ID))
+}
+
+func TestDelayQueueConsumers(t *testing.T) {
+	s := newStore(t)
+	dq := &DelayQueue{store: s}
+	cfg := &queue.QueueConfig{ID: "consumers"}
+	for _, v := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, dq.Push(cfg.ID, []byte(v)))
+	}
+
+	c1 := &queue.ConsumerConfig{Group: "g", Name: "c1", FetchMaxMessages: 2}
+	c2 := &queue.ConsumerConfig{Group: "g", Name: "c2", FetchMaxMessages: 10}
+	consumer, err := dq.AcquireConsumer(cfg, c1)
+	require.NoError(t, err)
+	ctx := &queue.Context{}
+	msgs, timeout, err := consumer.FetchMessages(ctx, 2)
+	require.NoError(t, err)
+	assert.False(t, timeout)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "a", string(msgs[0].Data))
+	assert.Equal(t, queue.NewOffset(0, 2), ctx.NextOffset)
+
+	//the messages are handed out once
+	other, err := dq.AcquireConsumer(cfg, c2)
+	require.NoError(t, err)
+	msgs, _, err = other.FetchMessages(&queue.Context{}, 10)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "c", string(msgs[0].Data))
+	assert.Equal(t, queue.NewOffset(0, 4), dq.LatestOffset(cfg))
+
+	//committed messages are deleted, the others come back once closed
+	require.NoError(t, consumer.CommitOffset(ctx.NextOffset))
+	offset, err := dq.GetOffset(cfg, c2)
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffset(0, 2), offset)
+	require.NoError(t, dq.ReleaseConsumer(cfg, c2, other))
+	assert.Equal(t, int64(2), dq.Depth(cfg.ID))
+
+	//unacknowledged messages survive a restart
+	msgs, _, err = consumer.FetchMessages(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "c", string(msgs[0].Data))
+
+	restarted := &DelayQueue{store: s}
+	assert.Equal(t, int64(2), restarted.Depth(cfg.ID))
+	for _, v := range []string{"c", "d"} {
+		data, _ := restarted.Pop(cfg.ID, 0)
+		assert.Equal(t, v, string(data))
+	}
+	require.NoError(t, restarted.Push(cfg.ID, []byte("e")))
+	//the sequence continues after the stored messages
+	msg := &message{}
+	value, err := kv.GetValue(s.bucket, messageKey(cfg.ID, 4))
+	require.NoError(t, err)
+	require.NoError(t, util.FromJSONBytes(value, msg))
+	assert.Equal(t, "e", string(msg.Data))
+}
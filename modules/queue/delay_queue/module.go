@@ -0,0 +1,221 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI Ltd. All rights reserved.
+ * web: https://infinilabs.com
+ * mail: hello#infini.ltd */
+
+package delay_queue
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/env"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/util"
+)
+
+// DelayQueue is the `delay` queue type, for jobs that should run later or
+// by priority. Messages set a not-before time and a priority through their
+// headers, see ProduceRequest.SetDelay and SetPriority, and only become
+// visible to Pop and consumers once they are due, higher priorities first.
+// Messages are kept in the kv store until they are popped or committed.
+type DelayQueue struct {
+	Enabled bool   `config:"enabled"`
+	Bucket  string `config:"bucket"`
+
+	store  store
+	queues sync.Map
+	locker sync.Mutex
+}
+
+func (this *DelayQueue) Setup() {
+	this.Enabled = true
+	this.Bucket = "delay_queue"
+	ok, err := env.ParseConfig("delay_queue", &this)
+	if ok && err != nil && global.Env().SystemConfig.Configs.PanicOnConfigError {
+		panic(err)
+	}
+
+	if !this.Enabled {
+		return
+	}
+
+	this.store = &kvStore{bucket: this.Bucket}
+	queue.Register("delay", this)
+}
+
+func (this *DelayQueue) Start() error {
+	return nil
+}
+
+func (this *DelayQueue) Stop() error {
+	return nil
+}
+
+func (this *DelayQueue) Name() string {
+	return "delay_queue"
+}
+
+func (this *DelayQueue) getQueue(q string) (*delayQueue, error) {
+	v, ok := this.queues.Load(q)
+	if ok {
+		return v.(*delayQueue), nil
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	v, ok = this.queues.Load(q)
+	if ok {
+		return v.(*delayQueue), nil
+	}
+
+	dq, err := newDelayQueue(q, this.store)
+	if err != nil {
+		return nil, errors.Errorf("failed to load delay queue [%v]: %v", q, err)
+	}
+	this.queues.Store(q, dq)
+	return dq, nil
+}
+
+func (this *DelayQueue) mustGetQueue(q string) *delayQueue {
+	dq, err := this.getQueue(q)
+	if err != nil {
+		panic(err)
+	}
+	return dq
+}
+
+func (this *DelayQueue) Init(q string) error {
+	_, err := this.getQueue(q)
+	return err
+}
+
+func (this *DelayQueue) Push(q string, data []byte) error {
+	dq, err := this.getQueue(q)
+	if err != nil {
+		return err
+	}
+	_, err = dq.add(&queue.ProduceRequest{Data: data})
+	return err
+}
+
+func (this *DelayQueue) Pop(q string, t time.Duration) (data []byte, timeout bool) {
+	msg := this.mustGetQueue(q).pop(t)
+	if msg == nil {
+		return nil, true
+	}
+	return msg.Data, false
+}
+
+func (this *DelayQueue) Close(string) error {
+	return nil
+}
+
+func (this *DelayQueue) Destroy(q string) error {
+	this.queues.Delete(q)
+	return this.store.destroy(q)
+}
+
+func (this *DelayQueue) GetStorageSize(q string) uint64 {
+	return this.mustGetQueue(q).storageSize()
+}
+
+func (this *DelayQueue) Depth(q string) int64 {
+	return this.mustGetQueue(q).depth()
+}
+
+func (this *DelayQueue) GetQueues() []string {
+	q := []string{}
+	this.queues.Range(func(key, value interface{}) bool {
+		q = append(q, util.ToString(key))
+		return true
+	})
+	return q
+}
+
+func (this *DelayQueue) LatestOffset(k *queue.QueueConfig) queue.Offset {
+	return this.mustGetQueue(k.ID).latestOffset()
+}
+
+// OffsetForTime returns the latest offset, delivered messages are gone.
+func (this *DelayQueue) OffsetForTime(k *queue.QueueConfig, t time.Time) (queue.Offset, error) {
+	return this.LatestOffset(k), nil
+}
+
+// GetOffset is the offset of the first message delivered to the consumer
+// and not committed yet, or the latest offset.
+func (this *DelayQueue) GetOffset(k *queue.QueueConfig, consumer *queue.ConsumerConfig) (queue.Offset, error) {
+	return this.mustGetQueue(k.ID).offset(consumer.Key()), nil
+}
+
+// DeleteOffset returns the messages the consumer did not commit to the
+// queue.
+func (this *DelayQueue) DeleteOffset(k *queue.QueueConfig, consumer *queue.ConsumerConfig) error {
+	this.mustGetQueue(k.ID).requeue(consumer.Key())
+	return nil
+}
+
+// CommitOffset acknowledges the messages delivered to the consumer before
+// offset, they are deleted.
+func (this *DelayQueue) CommitOffset(k *queue.QueueConfig, consumer *queue.ConsumerConfig, offset queue.Offset) (bool, error) {
+	if global.Env().IsDebug {
+		log.Tracef("commit offset, queue [%v] [%v][%v] commit offset:%v", k.ID, consumer.Group, consumer.Name, offset)
+	}
+	this.mustGetQueue(k.ID).ack(consumer.Key(), offset)
+	return true, nil
+}
+
+func (this *DelayQueue) AcquireConsumer(k *queue.QueueConfig, consumer *queue.ConsumerConfig) (queue.ConsumerAPI, error) {
+	dq, err := this.getQueue(k.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &Consumer{dq: dq, qCfg: k, cCfg: consumer}, nil
+}
+
+func (this *DelayQueue) ReleaseConsumer(k *queue.QueueConfig, c *queue.ConsumerConfig, consumer queue.ConsumerAPI) error {
+	if consumer != nil {
+		return consumer.Close()
+	}
+	return nil
+}
+
+func (this *DelayQueue) AcquireProducer(cfg *queue.QueueConfig) (queue.ProducerAPI, error) {
+	if cfg == nil || cfg.ID == "" {
+		panic("queue config is nil")
+	}
+	dq, err := this.getQueue(cfg.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &Producer{dq: dq, cfg: cfg}, nil
+}
+
+func (this *DelayQueue) ReleaseProducer(k *queue.QueueConfig, producer queue.ProducerAPI) error {
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI Ltd. All rights reserved.
+ * web: https://infinilabs.com
+ * mail: hello#infini.ltd */
+
+package delay_queue
+
+import (
+	"fmt"
+
+	"infini.sh/framework/core/kv"
+	"infini.sh/framework/core/util"
+)
+
+// store keeps the messages of delay queues until they are acknowledged.
+type store interface {
+	put(queueID string, msg *message) error
+	delete(queueID string, seq int64) error
+	load(queueID string, fn func(msg *message)) error
+	destroy(queueID string) error
+}
+
+// kvStore keeps every message under <queue>/<seq> in one kv bucket, it
+// needs a kv store that supports iteration to load the queues on restart.
+type kvStore struct {
+	bucket string
+}
+
+func messageKey(queueID string, seq int64) []byte {
+	return []byte(fmt.Sprintf("%v/%020d", queueID, seq))
+}
+
+func (s *kvStore) put(queueID string, msg *message) error {
+	return kv.AddValue(s.bucket, messageKey(queueID, msg.Seq), util.MustToJSONBytes(msg))
+}
+
+func (s *kvStore) delete(queueID string, seq int64) error {
+	return kv.DeleteKey(s.bucket, messageKey(queueID, seq))
+}
+
+func (s *kvStore) load(queueID string, fn func(msg *message)) error {
+	var err error
+	scanErr := kv.ScanPrefix(s.bucket, []byte(queueID+"/"), func(key, value []byte) bool {
+		msg := &message{}
+		err = util.FromJSONBytes(value, msg)
+		if err != nil {
+			err = fmt.Errorf("invalid message [%v] of delay queue: %v", string(key), err)
+			return false
+		}
+		fn(msg)
+		return true
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	return err
+}
+
+func (s *kvStore) destroy(queueID string) error {
+	ops := []kv.WriteOp{}
+	err := kv.ScanPrefix(s.bucket, []byte(queueID+"/"), func(key, value []byte) bool {
+		ops = append(ops, kv.WriteOp{Key: key, Delete: true})
+		return true
+	})
+	if err != nil || len(ops) == 0 {
+		return err
+	}
+	return kv.BatchWrite(s.bucket, ops)
+}
@@ -28,12 +28,9 @@
 package queue
 
 import (
-	"os"
-
 	log "github.com/cihub/seelog"
 	"infini.sh/framework/core/global"
 	"infini.sh/framework/core/queue"
-	"infini.sh/framework/core/util"
 )
 
 func (module *DiskQueue) GetEarlierOffsetByQueueID(queueID string) (int, int64) {
@@ -129,6 +126,11 @@ func (module *DiskQueue) deleteUnusedFiles(queueID string, fileNum int64) {
 	if consumers > 0 && fileStartToDelete > 0 && fileStartToDelete < eSegmentNum && eSegmentNum > 0 {
 		log.Trace(queueID, " start to delete:", fileStartToDelete, ",consumers:", consumers, ",consumer_on:", eSegmentNum)
 
+		var d *DiskBasedQueue
+		if q, ok := module.queues.Load(queueID); ok {
+			d = q.(*DiskBasedQueue)
+		}
+
 		//TODO do not wall all files, when numbers growing, it will be slow to check each file exists or not
 		for x := fileStartToDelete; x >= 0; x-- {
 
@@ -137,32 +139,16 @@ func (module *DiskQueue) deleteUnusedFiles(queueID string, fileNum int64) {
 				continue
 			}
 
-			file := GetFileName(queueID, x)
-			log.Trace(queueID, " start to delete:", file)
-			var exists = false
-			if util.FileExists(file) {
-				exists = true
-				log.Trace("delete queue file:", file)
-				err := os.Remove(file)
-				if err != nil {
-					log.Error(err)
-					break
-				}
-			}
-			compressedFile := file + compressFileSuffix
-			if util.FileExists(compressedFile) {
-				exists = true
-				log.Trace("delete compressed queue file:", compressedFile)
-				err := os.Remove(compressedFile)
-				if err != nil {
-					log.Error(err)
-					break
-				}
+			log.Trace(queueID, " start to delete:", x)
+			exists, err := deleteSegment(queueID, d, x, DeleteReasonConsumed)
+			if err != nil {
+				log.Error(err)
+				break
 			}
 
 			//no compress or flat file exists
 			if !exists {
-				log.Tracef("continue further delete, missing queue file:", file)
+				log.Tracef("continue further delete, missing queue file:", GetFileName(queueID, x))
 				continue
 			}
 		}
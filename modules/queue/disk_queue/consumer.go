@@ -111,6 +111,8 @@ func (this *Consumer) CommitOffset(offset queue.Offset) error {
 func (d *Consumer) FetchMessages(ctx *queue.Context, numOfMessages int) (messages []queue.Message, isTimeout bool, err error) {
 
 	var msgSize int32
+	var metadata bool
+	var checksum bool
 	var totalMessageSize int = 0
 	ctx.MessageCount = 0
 
@@ -236,6 +238,7 @@ READ_MSG:
 		}
 		return messages, false, err
 	}
+	msgSize, metadata, checksum = decodeRecordSize(msgSize)
 	log.Debugf("queue:%v, offset:%v,%v, msgSize:%v", d.queue, d.segment, d.readPos, msgSize)
 	if int32(msgSize) < d.mCfg.MinMsgSize || int32(msgSize) > d.mCfg.MaxMsgSize {
 		//current have changes, reload file with new position
@@ -292,11 +295,15 @@ READ_MSG:
 		return messages, false, err
 	}
 
-	//read message
-	readBuf := make([]byte, msgSize)
+	//read message, with its checksum
+	recordSize := msgSize
+	if checksum {
+		recordSize += recordChecksumSize
+	}
+	readBuf := make([]byte, recordSize)
 	_, err = io.ReadFull(d.reader, readBuf)
 
-	totalBytes := int(4 + msgSize)
+	totalBytes := int(4 + recordSize)
 	nextReadPos := d.readPos + int64(totalBytes)
 	previousPos := d.readPos
 
@@ -342,6 +349,16 @@ READ_MSG:
 			goto RELOAD_FILE
 		}
 
+		if checksum {
+			readBuf, err = verifyRecordChecksum(d.segment, previousPos, readBuf)
+			if err != nil {
+				stats.Increment("consumer", d.qCfg.ID, d.cCfg.ID, "checksum_mismatch")
+				log.Errorf("queue:%v, consumer:%v, %v", d.queue, d.cCfg.Key(), err)
+				ctx.UpdateNextOffset(d.segment, nextReadPos)
+				return messages, false, err
+			}
+		}
+
 		if d.mCfg.Compress.Message.Enabled {
 			if global.Env().IsDebug {
 				log.Tracef("decompress message: %v %v", d.fileName, d.segment)
@@ -356,11 +373,20 @@ READ_MSG:
 		}
 
 		message := queue.Message{
-			Data:       readBuf,
 			Size:       totalBytes,
 			Offset:     queue.NewOffsetWithVersion(d.segment, previousPos, d.version),
 			NextOffset: queue.NewOffsetWithVersion(d.segment, nextReadPos, d.version),
 		}
+		if metadata {
+			message.Key, message.Headers, message.Data, err = decodeRecordBody(readBuf)
+			if err != nil {
+				log.Errorf("invalid message metadata: %v %v,%v %v", d.fileName, d.segment, previousPos, err)
+				ctx.UpdateNextOffset(d.segment, nextReadPos)
+				return messages, false, err
+			}
+		} else {
+			message.Data = readBuf
+		}
 
 		ctx.UpdateNextOffset(d.segment, nextReadPos)
 
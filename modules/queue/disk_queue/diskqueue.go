@@ -103,7 +103,7 @@ type DiskBasedQueue struct {
 
 	// internal channels
 	depthChan         chan int64
-	writeChan         chan []byte
+	writeChan         chan writeRequest
 	writeResponseChan chan WriteResponse
 	emptyChan         chan int
 	emptyResponseChan chan error
@@ -112,6 +112,14 @@ type DiskBasedQueue struct {
 
 	consumersInReading sync.Map
 
+	//time range of the writes in each segment, persisted with the metadata
+	segmentLock sync.Mutex
+	segments    map[int64]SegmentRange
+
+	//sparse time index of the segment in writing
+	timeIndexFile   *os.File
+	lastIndexedTime int64
+
 	cfg *DiskQueueConfig
 }
 
@@ -124,7 +132,7 @@ func NewDiskQueueByConfig(name, dataPath string, cfg *DiskQueueConfig) *DiskBase
 		cfg:                cfg,
 		readChan:           make(chan []byte, cfg.ReadChanBuffer),
 		depthChan:          make(chan int64),
-		writeChan:          make(chan []byte, cfg.WriteChanBuffer),
+		writeChan:          make(chan writeRequest, cfg.WriteChanBuffer),
 		writeResponseChan:  make(chan WriteResponse),
 		emptyChan:          make(chan int),
 		emptyResponseChan:  make(chan error),
@@ -197,6 +205,17 @@ func (d *DiskBasedQueue) ReadChan() <-chan []byte {
 
 // Put writes a []byte to the queue
 func (d *DiskBasedQueue) Put(data []byte) WriteResponse {
+	return d.put(writeRequest{body: data})
+}
+
+// PutWithMetadata writes data along with its key and headers, it falls
+// back to a plain record when both are empty.
+func (d *DiskBasedQueue) PutWithMetadata(key []byte, headers map[string]string, data []byte) WriteResponse {
+	return d.put(newWriteRequest(key, headers, data))
+}
+
+func (d *DiskBasedQueue) put(req writeRequest) WriteResponse {
+	data := req.body
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(d.cfg.WriteTimeoutInMS)*time.Millisecond)
 	defer cancel()
 
@@ -242,7 +261,7 @@ func (d *DiskBasedQueue) Put(data []byte) WriteResponse {
 	}
 
 	select {
-	case d.writeChan <- data:
+	case d.writeChan <- req:
 		return <-d.writeResponseChan
 	case <-ctx.Done():
 		// Handle context cancellation or timeout
@@ -341,6 +360,7 @@ func (d *DiskBasedQueue) exit(deleted bool) error {
 		d.writeFile.Close()
 		d.writeFile = nil
 	}
+	d.closeTimeIndex()
 
 	return nil
 }
@@ -412,6 +432,7 @@ func (d *DiskBasedQueue) skipToNextRWFile(delete bool) error {
 		}
 		d.writeFile = nil
 	}
+	d.closeTimeIndex()
 
 	if delete {
 		for i := d.readSegmentFileNum; i <= d.writeSegmentNum; i++ {
@@ -425,6 +446,7 @@ func (d *DiskBasedQueue) skipToNextRWFile(delete bool) error {
 				log.Errorf("diskqueue(%s) failed to remove data file - %s", d.name, innerErr)
 				err = innerErr
 			}
+			os.Remove(GetTimeIndexFileName(d.name, i))
 		}
 	}
 
@@ -492,6 +514,7 @@ func (d *DiskBasedQueue) readOne() ([]byte, error) {
 		d.readFile = nil
 		return nil, err
 	}
+	msgSize, metadata, checksum := decodeRecordSize(msgSize)
 
 	if msgSize < d.cfg.MinMsgSize || msgSize > d.cfg.MaxMsgSize {
 		// this file is corrupt and we have no reasonable guarantee on
@@ -501,7 +524,11 @@ func (d *DiskBasedQueue) readOne() ([]byte, error) {
 		return nil, fmt.Errorf("invalid message read size (%d)", msgSize)
 	}
 
-	readBuf := make([]byte, msgSize)
+	recordSize := msgSize
+	if checksum {
+		recordSize += recordChecksumSize
+	}
+	readBuf := make([]byte, recordSize)
 	_, err = io.ReadFull(d.reader, readBuf)
 	if err != nil {
 		d.readFile.Close()
@@ -509,7 +536,16 @@ func (d *DiskBasedQueue) readOne() ([]byte, error) {
 		return nil, err
 	}
 
-	totalBytes := int64(4 + msgSize)
+	if checksum {
+		readBuf, err = verifyRecordChecksum(d.readSegmentFileNum, d.readPos, readBuf)
+		if err != nil {
+			d.readFile.Close()
+			d.readFile = nil
+			return nil, err
+		}
+	}
+
+	totalBytes := int64(4 + recordSize)
 
 	//log.Error("position:",d.readSegmentFileNum,",",d.readPos,",",totalBytes)
 
@@ -540,9 +576,15 @@ func (d *DiskBasedQueue) readOne() ([]byte, error) {
 			log.Errorf("diskqueue(%s) failed to decompress %v,%v - %s", d.name, d.readSegmentFileNum, d.readPos)
 			return nil, err
 		}
-		return newData, nil
+		readBuf = newData
 	}
 
+	if metadata {
+		_, _, readBuf, err = decodeRecordBody(readBuf)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return readBuf, nil
 }
 
@@ -554,9 +596,10 @@ type WriteResponse struct {
 
 // writeOne performs a low level filesystem write for a single []byte
 // while advancing write positions and rolling files, if necessary
-func (d *DiskBasedQueue) writeOne(data []byte) WriteResponse {
+func (d *DiskBasedQueue) writeOne(req writeRequest) WriteResponse {
 	var err error
 	var res WriteResponse
+	data := req.body
 
 	if d.writeFile == nil {
 		curFileName := d.GetFileName(d.writeSegmentNum)
@@ -600,13 +643,27 @@ func (d *DiskBasedQueue) writeOne(data []byte) WriteResponse {
 		return res
 	}
 
+	now := time.Now()
+	err = d.indexRecord(d.writePos, now)
+	if err != nil {
+		log.Errorf("diskqueue(%s) failed to write time index - %s", d.name, err)
+	}
+
 	d.writeBuf.Reset()
-	err = binary.Write(&d.writeBuf, binary.BigEndian, dataLen)
+	err = binary.Write(&d.writeBuf, binary.BigEndian, encodeRecordSize(dataLen, req.metadata, d.cfg.RecordChecksum))
 	if err != nil {
 		res.Error = err
 		return res
 	}
 
+	if d.cfg.RecordChecksum {
+		err = binary.Write(&d.writeBuf, binary.BigEndian, recordChecksum(data))
+		if err != nil {
+			res.Error = err
+			return res
+		}
+	}
+
 	_, err = d.writeBuf.Write(data)
 	if err != nil {
 		res.Error = err
@@ -622,9 +679,10 @@ func (d *DiskBasedQueue) writeOne(data []byte) WriteResponse {
 		return res
 	}
 
-	totalBytes := int64(4 + dataLen)
+	totalBytes := int64(d.writeBuf.Len())
 	d.writePos += totalBytes
 	d.depth += 1
+	d.touchSegment(d.writeSegmentNum, now)
 
 	if d.writePos >= d.cfg.MaxBytesPerFile {
 		if d.readSegmentFileNum == d.writeSegmentNum {
@@ -634,6 +692,7 @@ func (d *DiskBasedQueue) writeOne(data []byte) WriteResponse {
 		//notify listener that we are writing to a new file
 		Notify(d.name, WriteComplete, d.writeSegmentNum)
 
+		d.closeTimeIndex()
 		d.writeSegmentNum++
 		d.writePos = 0
 
@@ -691,7 +750,8 @@ func (d *DiskBasedQueue) retrieveMetaData() error {
 	}
 
 	var depth int64
-	_, err = fmt.Fscanf(f, "%d\n%d,%d\n%d,%d\n",
+	reader := bufio.NewReader(f)
+	_, err = fmt.Fscanf(reader, "%d\n%d,%d\n%d,%d\n",
 		&depth,
 		&d.readSegmentFileNum, &d.readPos,
 		&d.writeSegmentNum, &d.writePos)
@@ -702,6 +762,19 @@ func (d *DiskBasedQueue) retrieveMetaData() error {
 	d.nextReadFileNum = d.readSegmentFileNum
 	d.nextReadPos = d.readPos
 
+	//the segment time ranges follow, one per line, missing in older metadata
+	d.segmentLock.Lock()
+	defer d.segmentLock.Unlock()
+	d.segments = map[int64]SegmentRange{}
+	for {
+		var segment, first, last int64
+		_, err = fmt.Fscanf(reader, "%d,%d,%d\n", &segment, &first, &last)
+		if err != nil {
+			break
+		}
+		d.segments[segment] = SegmentRange{FirstWrite: time.UnixMilli(first), LastWrite: time.UnixMilli(last)}
+	}
+
 	return nil
 }
 
@@ -749,6 +822,13 @@ func (d *DiskBasedQueue) persistMetaData() error {
 		f.Close()
 		return err
 	}
+	for _, v := range d.segmentRanges() {
+		_, err = fmt.Fprintf(f, "%d,%d,%d\n", v.Segment, v.FirstWrite.UnixMilli(), v.LastWrite.UnixMilli())
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
 	f.Sync()
 	f.Close()
 
@@ -822,15 +902,12 @@ func (d *DiskBasedQueue) readMoveForward() {
 
 		consumers, ok := queue.GetConsumerConfigsByQueueID(d.name)
 		if !ok || len(consumers) == 0 {
-			fn := d.GetFileName(oldReadFileNum)
-			if util.FileExists(fn) {
-				if global.Env().IsDebug {
-					log.Debugf("queue:%v delete old file:%v, new file:%v", d.name, oldReadFileNum, d.nextReadFileNum)
-				}
-				err := os.Remove(fn)
-				if err != nil {
-					log.Errorf("failed to Remove(%s) - %s", fn, err)
-				}
+			if global.Env().IsDebug {
+				log.Debugf("queue:%v delete old file:%v, new file:%v", d.name, oldReadFileNum, d.nextReadFileNum)
+			}
+			_, err := deleteSegment(d.name, d, oldReadFileNum, DeleteReasonConsumed)
+			if err != nil {
+				log.Errorf("failed to delete segment %v of queue %v - %s", oldReadFileNum, d.name, err)
 			}
 		}
 	}
@@ -847,6 +924,7 @@ func (d *DiskBasedQueue) handleReadError() {
 			d.writeFile.Close()
 			d.writeFile = nil
 		}
+		d.closeTimeIndex()
 		d.writeSegmentNum++
 		d.writePos = 0
 	}
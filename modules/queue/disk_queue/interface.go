@@ -48,10 +48,25 @@ type EventType string
 const WriteComplete = EventType("WriteComplete")
 const ReadComplete = EventType("ReadComplete")
 
+// SegmentDeleted is sent after a segment was removed from the local disk,
+// Reason tells which policy dropped it
+const SegmentDeleted = EventType("SegmentDeleted")
+
+type DeleteReason string
+
+const DeleteReasonConsumed = DeleteReason("consumed")
+const DeleteReasonMaxAge = DeleteReason("max_age")
+const DeleteReasonMaxBytes = DeleteReason("max_bytes")
+
 type Event struct {
 	Queue   string
 	Type    EventType
 	FileNum int64
+
+	//only set on SegmentDeleted
+	Reason DeleteReason
+	Bytes  int64
+	Range  SegmentRange
 }
 
 type EventHandler func(event Event) error
@@ -77,6 +92,30 @@ func Notify(queue string, eventType EventType, fileNum int64) {
 		FileNum: fileNum,
 	}
 
+	notify(event)
+}
+
+// NotifySegmentDeleted tells listeners that segment fileNum of the queue was
+// removed from the local disk, with the bytes and time range it held
+func NotifySegmentDeleted(queue string, fileNum int64, reason DeleteReason, bytes int64, rng SegmentRange) {
+
+	if global.Env().IsDebug {
+		log.Tracef("notify on queue: %v, type: %v, segment: %v, reason: %v", queue, SegmentDeleted, fileNum, reason)
+	}
+
+	notify(Event{
+		Queue:   queue,
+		Type:    SegmentDeleted,
+		FileNum: fileNum,
+		Reason:  reason,
+		Bytes:   bytes,
+		Range:   rng,
+	})
+}
+
+func notify(event Event) {
+	locker.RLock()
+	defer locker.RUnlock()
 	for _, v := range handlers {
 		v(event)
 	}
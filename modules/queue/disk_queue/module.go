@@ -63,8 +63,15 @@ func (module *DiskQueue) Name() string {
 
 type RetentionConfig struct {
 	MaxNumOfLocalFiles int64 `config:"max_num_of_local_files"`
-	//DeleteAfterSaveToS3 bool `config:"delete_after_save_to_s3"`
-	//MaxAge int  	   `config:"max_age"`
+
+	//drop segments whose last write is older than this, eg: 7d, no matter if consumed or not
+	MaxAge string `config:"max_age"`
+	//drop the oldest segments once the queue takes more bytes than this on the local disk
+	MaxBytes uint64 `config:"max_bytes"`
+	//only drop segments by max_age or max_bytes once they were uploaded to s3
+	DeleteAfterSaveToS3 bool `config:"delete_after_save_to_s3"`
+	//how often to check max_age for queues without new writes
+	CheckInterval string `config:"check_interval"`
 }
 
 //#  disk.max_used_bytes:  100GB #trigger warning message
@@ -91,11 +98,18 @@ type DiskQueueConfig struct {
 
 	AutoSkipCorruptFile bool `config:"auto_skip_corrupted_file"`
 
+	//write a CRC32C with every record, verified on read, opt-in as versions
+	//without it can not read such records
+	RecordChecksum bool `config:"record_checksum"`
+
 	UploadToS3     bool `config:"upload_to_s3"`
 	AlwaysDownload bool `config:"always_download"`
 
 	PrepareFilesToRead bool `config:"prepare_files_to_read"`
 
+	//min interval between two entries of the sparse time index of a segment
+	TimeIndexIntervalInMs int64 `config:"time_index_interval_in_ms"`
+
 	CompressAndCleanupDuringInit bool `config:"cleanup_files_on_init"`
 
 	//default queue adaptor
@@ -210,6 +224,7 @@ func (module *DiskQueue) Init(name string) error {
 	if module.cfg.CompressAndCleanupDuringInit {
 		module.compressFiles(name, tempQueue.ReadContext().WriteFileNum)
 		module.deleteUnusedFiles(name, tempQueue.ReadContext().WriteFileNum)
+		module.applyRetention(name)
 	}
 
 	return nil
@@ -229,7 +244,7 @@ func (module *DiskQueue) Setup() {
 		Default:                         true,
 		AutoSkipCorruptFile:             true,
 		UploadToS3:                      false,
-		Retention:                       RetentionConfig{MaxNumOfLocalFiles: 5},
+		Retention:                       RetentionConfig{MaxNumOfLocalFiles: 5, CheckInterval: "1m"},
 		MinMsgSize:                      1,
 		MaxMsgSize:                      104857600,         //100MB
 		MaxBytesPerFile:                 100 * 1024 * 1024, //100MB
@@ -244,6 +259,7 @@ func (module *DiskQueue) Setup() {
 		WarningFreeBytes:                10 * 1024 * 1024 * 1024,
 		ReservedFreeBytes:               5 * 1024 * 1024 * 1024,
 		PrepareFilesToRead:              true,
+		TimeIndexIntervalInMs:           1000,
 		Compress: DiskCompress{
 			IdleThreshold:             3,
 			DeleteAfterCompress:       false,
@@ -287,6 +303,11 @@ func (module *DiskQueue) Setup() {
 
 	RegisterEventListener(func(event Event) error {
 
+		//deletions are sent from the worker itself, nothing to handle
+		if event.Type == SegmentDeleted {
+			return nil
+		}
+
 		module.messages <- event
 
 		return nil
@@ -433,6 +454,20 @@ func (module *DiskQueue) LatestOffset(k *queue.QueueConfig) queue.Offset {
 	panic(errors.Errorf("queue [%v] not found", k.ID))
 }
 
+func (module *DiskQueue) OffsetForTime(k *queue.QueueConfig, t time.Time) (queue.Offset, error) {
+	q, ok := module.queues.Load(k.ID)
+	if !ok {
+		//try init
+		module.Init(k.ID)
+		q, ok = module.queues.Load(k.ID)
+	}
+	if ok {
+		return (q.(*DiskBasedQueue)).OffsetForTime(t)
+	}
+
+	panic(errors.Errorf("queue [%v] not found", k.ID))
+}
+
 func (module *DiskQueue) Depth(k string) int64 {
 	q, ok := module.queues.Load(k)
 	if !ok {
@@ -543,20 +578,34 @@ func (module *DiskQueue) Start() error {
 			}
 		}()
 
+		//queues without new writes still need to expire by max_age
+		var retentionTicker <-chan time.Time
+		if module.cfg.Retention.maxAge() > 0 {
+			ticker := time.NewTicker(util.GetDurationOrDefault(module.cfg.Retention.CheckInterval, time.Minute))
+			defer ticker.Stop()
+			retentionTicker = ticker.C
+		}
+
 		//keep this worker always running in background
 		var lastFilePrepared int64
 		for {
-			evt := <-module.messages
-			switch evt.Type {
-			case WriteComplete:
-				module.onWriteComplete(evt)
-				break
-			case ReadComplete:
-				v := module.onReadComplete(evt, lastFilePrepared)
-				if v > 0 {
-					lastFilePrepared = v
+			select {
+			case evt := <-module.messages:
+				switch evt.Type {
+				case WriteComplete:
+					module.onWriteComplete(evt)
+					break
+				case ReadComplete:
+					v := module.onReadComplete(evt, lastFilePrepared)
+					if v > 0 {
+						lastFilePrepared = v
+					}
+					break
+				}
+			case <-retentionTicker:
+				for _, v := range module.GetQueues() {
+					module.applyRetention(v)
 				}
-				break
 			}
 		}
 
@@ -595,6 +644,9 @@ func (module *DiskQueue) onWriteComplete(evt Event) {
 	//delete old unused files
 	module.deleteUnusedFiles(evt.Queue, evt.FileNum)
 
+	//drop segments out of the retention policy
+	module.applyRetention(evt.Queue)
+
 }
 
 func (module *DiskQueue) onReadComplete(evt Event, lastFilePrepared int64) int64 {
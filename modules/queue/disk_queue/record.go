@@ -0,0 +1,182 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* ©INFINI, All Rights Reserved.
+ * mail: contact#infini.ltd */
+
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"sort"
+
+	"infini.sh/framework/core/errors"
+)
+
+// A segment file is a sequence of records, each a big endian int32 size
+// followed by that many bytes of body. Plain records carry the message data
+// as body, exactly as older versions wrote them.
+//
+// When the high bit of the size is set, the body starts with the message
+// metadata, all lengths being uvarints:
+//
+//	keyLen key headerCount (nameLen name valueLen value)... data
+//
+// Compression applies to the whole body. Records without key and headers
+// are always written in the plain form, so older versions can still read
+// queues that do not use metadata.
+//
+// When the second highest bit of the size is set, the size is followed by
+// the big endian CRC32C (Castagnoli) of the body as stored, before the body.
+// The flags version every record on its own, so segments mixing records
+// with and without checksum, eg: written before an upgrade, stay readable.
+// Versions without the checksum flag can not read such records, so it is
+// only written when record_checksum is enabled.
+const recordMetadataFlag = uint32(1) << 31
+const recordChecksumFlag = uint32(1) << 30
+
+const recordChecksumSize = 4
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+type writeRequest struct {
+	body     []byte
+	metadata bool
+}
+
+func encodeRecordSize(size int32, metadata, checksum bool) int32 {
+	v := uint32(size)
+	if metadata {
+		v |= recordMetadataFlag
+	}
+	if checksum {
+		v |= recordChecksumFlag
+	}
+	return int32(v)
+}
+
+func decodeRecordSize(v int32) (size int32, metadata, checksum bool) {
+	return int32(uint32(v) &^ (recordMetadataFlag | recordChecksumFlag)), uint32(v)&recordMetadataFlag != 0, uint32(v)&recordChecksumFlag != 0
+}
+
+func recordChecksum(body []byte) uint32 {
+	return crc32.Checksum(body, crc32cTable)
+}
+
+func newWriteRequest(key []byte, headers map[string]string, data []byte) writeRequest {
+	if len(key) == 0 && len(headers) == 0 {
+		return writeRequest{body: data}
+	}
+	return writeRequest{body: encodeRecordBody(key, headers, data), metadata: true}
+}
+
+// encodeRecordBody prefixes data with the key and headers, headers are
+// written in name order.
+func encodeRecordBody(key []byte, headers map[string]string, data []byte) []byte {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	buf := bytes.Buffer{}
+	buf.Grow(len(key) + len(data) + 16)
+	writeUvarint(&buf, uint64(len(key)))
+	buf.Write(key)
+	writeUvarint(&buf, uint64(len(names)))
+	for _, k := range names {
+		writeUvarint(&buf, uint64(len(k)))
+		buf.WriteString(k)
+		writeUvarint(&buf, uint64(len(headers[k])))
+		buf.WriteString(headers[k])
+	}
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	buf.Write(tmp[:n])
+}
+
+// decodeRecordBody is the reverse of encodeRecordBody, data shares the
+// memory of body.
+func decodeRecordBody(body []byte) (key []byte, headers map[string]string, data []byte, err error) {
+	reader := recordReader{buf: body}
+	key = reader.next()
+	count := reader.uvarint()
+	if reader.err == nil && count > uint64(len(body)) {
+		return nil, nil, nil, errors.Errorf("invalid record metadata, %v headers", count)
+	}
+	if count > 0 {
+		headers = make(map[string]string, count)
+	}
+	for i := uint64(0); i < count && reader.err == nil; i++ {
+		name := reader.next()
+		value := reader.next()
+		headers[string(name)] = string(value)
+	}
+	if reader.err != nil {
+		return nil, nil, nil, reader.err
+	}
+	if len(key) == 0 {
+		key = nil
+	}
+	return key, headers, body[reader.pos:], nil
+}
+
+type recordReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *recordReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		r.err = errors.New("invalid record metadata, bad length")
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *recordReader) next() []byte {
+	size := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if size > uint64(len(r.buf)-r.pos) {
+		r.err = errors.Errorf("invalid record metadata, length %v exceeds record", size)
+		return nil
+	}
+	v := r.buf[r.pos : r.pos+int(size)]
+	r.pos += int(size)
+	return v
+}
@@ -0,0 +1,213 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* ©INFINI, All Rights Reserved.
+ * mail: contact#infini.ltd */
+
+package queue
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/env"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/queue"
+)
+
+func TestRecordSize(t *testing.T) {
+	size, metadata, checksum := decodeRecordSize(encodeRecordSize(1024, false, false))
+	assert.Equal(t, int32(1024), size)
+	assert.False(t, metadata)
+	assert.False(t, checksum)
+
+	v := encodeRecordSize(1024, true, false)
+	assert.True(t, v < 0, "older readers must reject the record")
+	size, metadata, checksum = decodeRecordSize(v)
+	assert.Equal(t, int32(1024), size)
+	assert.True(t, metadata)
+	assert.False(t, checksum)
+
+	v = encodeRecordSize(1024, false, true)
+	assert.True(t, v > 104857600, "older readers must reject the record")
+	size, metadata, checksum = decodeRecordSize(v)
+	assert.Equal(t, int32(1024), size)
+	assert.False(t, metadata)
+	assert.True(t, checksum)
+}
+
+func TestRecordBody(t *testing.T) {
+	body := encodeRecordBody([]byte("user-1"), map[string]string{"trace_id": "abc", "content_type": "application/json"}, []byte(`{"a":1}`))
+	key, headers, data, err := decodeRecordBody(body)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("user-1"), key)
+	assert.Equal(t, map[string]string{"trace_id": "abc", "content_type": "application/json"}, headers)
+	assert.Equal(t, []byte(`{"a":1}`), data)
+
+	key, headers, data, err = decodeRecordBody(encodeRecordBody(nil, map[string]string{"h": ""}, []byte("x")))
+	require.NoError(t, err)
+	assert.Nil(t, key)
+	assert.Equal(t, map[string]string{"h": ""}, headers)
+	assert.Equal(t, []byte("x"), data)
+
+	_, _, _, err = decodeRecordBody(body[:5])
+	assert.Error(t, err)
+}
+
+func TestDiskQueueRecordMetadata(t *testing.T) {
+	env1 := env.EmptyEnv()
+	env1.SystemConfig.PathConfig.Data = t.TempDir()
+	global.RegisterEnv(env1)
+
+	cfg := &DiskQueueConfig{
+		MinMsgSize:       1,
+		MaxMsgSize:       1024 * 1024,
+		MaxBytesPerFile:  1024 * 1024,
+		WriteTimeoutInMS: 1000,
+		SyncEveryRecords: 1000,
+		SyncTimeoutInMS:  1000,
+	}
+	cfg.Compress.Message.Enabled = true
+	qCfg := &queue.QueueConfig{ID: "record_metadata", Name: "record_metadata"}
+	require.NoError(t, os.MkdirAll(GetDataPath(qCfg.ID), 0755))
+	q := &DiskBasedQueue{name: qCfg.ID, dataPath: GetDataPath(qCfg.ID), cfg: cfg}
+	defer q.writeFile.Close()
+
+	res := q.writeOne(newWriteRequest(nil, nil, []byte("plain")))
+	require.NoError(t, res.Error)
+	res = q.writeOne(newWriteRequest([]byte("k1"), map[string]string{"trace_id": "t1"}, []byte("with metadata")))
+	require.NoError(t, res.Error)
+
+	//plain records keep the original layout
+	file, err := os.Open(GetFileName(qCfg.ID, 0))
+	require.NoError(t, err)
+	var size int32
+	require.NoError(t, binary.Read(file, binary.BigEndian, &size))
+	file.Close()
+	assert.True(t, size > 0)
+
+	cCfg := &queue.ConsumerConfig{FetchMaxMessages: 10}
+	cCfg.ID = "c1"
+	consumer, err := q.AcquireConsumer(qCfg, cCfg, queue.NewOffset(0, 0))
+	require.NoError(t, err)
+	defer consumer.Close()
+	messages, _, err := consumer.FetchMessages(&queue.Context{}, 2)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+
+	assert.Equal(t, []byte("plain"), messages[0].Data)
+	assert.Nil(t, messages[0].Key)
+	assert.Nil(t, messages[0].Headers)
+
+	assert.Equal(t, []byte("with metadata"), messages[1].Data)
+	assert.Equal(t, []byte("k1"), messages[1].Key)
+	assert.Equal(t, map[string]string{"trace_id": "t1"}, messages[1].Headers)
+	assert.Equal(t, messages[0].NextOffset, messages[1].Offset)
+
+	//the simple read path only hands out the data
+	data, err := q.readOne()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("plain"), data)
+	q.readPos = q.nextReadPos
+	data, err = q.readOne()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("with metadata"), data)
+	q.readFile.Close()
+}
+
+func TestDiskQueueRecordChecksum(t *testing.T) {
+	env1 := env.EmptyEnv()
+	env1.SystemConfig.PathConfig.Data = t.TempDir()
+	global.RegisterEnv(env1)
+
+	cfg := &DiskQueueConfig{
+		MinMsgSize:       1,
+		MaxMsgSize:       1024 * 1024,
+		MaxBytesPerFile:  1024 * 1024,
+		WriteTimeoutInMS: 1000,
+		SyncEveryRecords: 1000,
+		SyncTimeoutInMS:  1000,
+	}
+	qCfg := &queue.QueueConfig{ID: "record_checksum", Name: "record_checksum"}
+	require.NoError(t, os.MkdirAll(GetDataPath(qCfg.ID), 0755))
+	q := &DiskBasedQueue{name: qCfg.ID, dataPath: GetDataPath(qCfg.ID), cfg: cfg}
+	defer q.writeFile.Close()
+
+	//written before the upgrade, without checksum
+	require.NoError(t, q.writeOne(newWriteRequest(nil, nil, []byte("old"))).Error)
+	cfg.RecordChecksum = true
+	require.NoError(t, q.writeOne(newWriteRequest(nil, nil, []byte("plain"))).Error)
+	second := q.writePos
+	require.NoError(t, q.writeOne(newWriteRequest([]byte("k1"), map[string]string{"trace_id": "t1"}, []byte("with metadata"))).Error)
+	assert.Equal(t, int64(4+3+4+4+5), second)
+
+	cCfg := &queue.ConsumerConfig{FetchMaxMessages: 10}
+	cCfg.ID = "c1"
+	consumer, err := q.AcquireConsumer(qCfg, cCfg, queue.NewOffset(0, 0))
+	require.NoError(t, err)
+	messages, _, err := consumer.FetchMessages(&queue.Context{}, 3)
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	assert.Equal(t, []byte("old"), messages[0].Data)
+	assert.Equal(t, []byte("plain"), messages[1].Data)
+	assert.Equal(t, []byte("with metadata"), messages[2].Data)
+	assert.Equal(t, []byte("k1"), messages[2].Key)
+	assert.Equal(t, queue.NewOffset(0, second), messages[2].Offset)
+	consumer.Close()
+
+	//flip a byte in the body of the last record
+	file := GetFileName(qCfg.ID, 0)
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(file, data, 0600))
+
+	consumer, err = q.AcquireConsumer(qCfg, cCfg, queue.NewOffset(0, 0))
+	require.NoError(t, err)
+	defer consumer.Close()
+	ctx := &queue.Context{}
+	messages, _, err = consumer.FetchMessages(ctx, 3)
+	require.Error(t, err)
+	corruption, ok := err.(*SegmentCorruption)
+	require.True(t, ok, err.Error())
+	assert.Equal(t, int64(0), corruption.Segment)
+	assert.Equal(t, second, corruption.Position)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, q.writePos, ctx.NextOffset.Position, "the damaged record is skipped")
+
+	size, err := ScanSegment(file, SegmentScanOptions{}, nil)
+	require.Error(t, err)
+	assert.Equal(t, second, size)
+
+	_, err = q.readOne()
+	require.NoError(t, err)
+	q.readPos = q.nextReadPos
+	_, err = q.readOne()
+	require.NoError(t, err)
+	q.readPos = q.nextReadPos
+	_, err = q.readOne()
+	assert.IsType(t, &SegmentCorruption{}, err)
+}
@@ -0,0 +1,270 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+)
+
+// SegmentRange is the time range of the writes in a segment
+type SegmentRange struct {
+	FirstWrite time.Time `json:"first_write,omitempty"`
+	LastWrite  time.Time `json:"last_write,omitempty"`
+}
+
+type segmentRange struct {
+	Segment int64
+	SegmentRange
+}
+
+func (d *DiskBasedQueue) touchSegment(segment int64, t time.Time) {
+	d.segmentLock.Lock()
+	defer d.segmentLock.Unlock()
+	if d.segments == nil {
+		d.segments = map[int64]SegmentRange{}
+	}
+	v, ok := d.segments[segment]
+	if !ok {
+		v.FirstWrite = t
+	}
+	v.LastWrite = t
+	d.segments[segment] = v
+}
+
+// GetSegmentRange returns the time range of the writes in the segment, false
+// if the segment is unknown, eg: it was written before ranges were tracked
+func (d *DiskBasedQueue) GetSegmentRange(segment int64) (SegmentRange, bool) {
+	d.segmentLock.Lock()
+	defer d.segmentLock.Unlock()
+	v, ok := d.segments[segment]
+	return v, ok
+}
+
+func (d *DiskBasedQueue) removeSegmentRange(segment int64) {
+	d.segmentLock.Lock()
+	defer d.segmentLock.Unlock()
+	delete(d.segments, segment)
+}
+
+// segmentRanges returns the tracked ranges, ordered by segment
+func (d *DiskBasedQueue) segmentRanges() []segmentRange {
+	d.segmentLock.Lock()
+	defer d.segmentLock.Unlock()
+	result := make([]segmentRange, 0, len(d.segments))
+	for k, v := range d.segments {
+		result = append(result, segmentRange{Segment: k, SegmentRange: v})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Segment < result[j].Segment
+	})
+	return result
+}
+
+type segmentFile struct {
+	Segment int64
+	Bytes   int64
+	Range   SegmentRange
+}
+
+// localSegments lists the segments of the queue still on the local disk,
+// flat or compressed, ordered by segment. Segments without a tracked range
+// fall back to the modification time of their files.
+func (d *DiskBasedQueue) localSegments() ([]segmentFile, error) {
+	entries, err := os.ReadDir(GetDataPath(d.name))
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[int64]*segmentFile{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), compressFileSuffix)
+		if filepath.Ext(name) != ".dat" {
+			continue
+		}
+		segment, err := strconv.ParseInt(strings.TrimSuffix(name, ".dat"), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		v, ok := files[segment]
+		if !ok {
+			v = &segmentFile{Segment: segment}
+			files[segment] = v
+		}
+		v.Bytes += info.Size()
+		if info.ModTime().After(v.Range.LastWrite) {
+			v.Range = SegmentRange{FirstWrite: info.ModTime(), LastWrite: info.ModTime()}
+		}
+	}
+
+	result := make([]segmentFile, 0, len(files))
+	for _, v := range files {
+		if rng, ok := d.GetSegmentRange(v.Segment); ok {
+			v.Range = rng
+		}
+		result = append(result, *v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Segment < result[j].Segment
+	})
+	return result, nil
+}
+
+// deleteSegment removes the flat and compressed files of the segment, and
+// notifies the listeners when anything was removed, d is optional
+func deleteSegment(queueID string, d *DiskBasedQueue, segment int64, reason DeleteReason) (bool, error) {
+	var exists = false
+	var bytes int64
+	file := GetFileName(queueID, segment)
+	for _, v := range []string{file, file + compressFileSuffix} {
+		info, err := os.Stat(v)
+		if err != nil {
+			continue
+		}
+		exists = true
+		log.Trace("delete queue file:", v)
+		err = os.Remove(v)
+		if err != nil {
+			return exists, err
+		}
+		bytes += info.Size()
+	}
+
+	if !exists {
+		return false, nil
+	}
+	os.Remove(GetTimeIndexFileName(queueID, segment))
+
+	var rng SegmentRange
+	if d != nil {
+		rng, _ = d.GetSegmentRange(segment)
+		d.removeSegmentRange(segment)
+	}
+
+	stats.Increment("disk_queue", queueID, "deleted_segments", string(reason))
+	stats.IncrementBy("disk_queue", queueID+".deleted_bytes", bytes)
+	NotifySegmentDeleted(queueID, segment, reason, bytes, rng)
+	return true, nil
+}
+
+func (cfg *RetentionConfig) maxAge() time.Duration {
+	if cfg.MaxAge == "" {
+		return 0
+	}
+	v, err := util.ParseDuration(cfg.MaxAge)
+	if err != nil {
+		log.Errorf("invalid disk_queue retention max_age [%v]: %v", cfg.MaxAge, err)
+		return 0
+	}
+	return v
+}
+
+// applyRetention drops the oldest segments of the queue which exceed the max
+// age or the max bytes of the retention policy, no matter if they were
+// consumed or not. The segment in writing is always kept, and so are the
+// segments not uploaded to s3 yet, if delete_after_save_to_s3 is enabled.
+func (module *DiskQueue) applyRetention(queueID string) {
+	cfg := &module.cfg.Retention
+	maxAge := cfg.maxAge()
+	if maxAge <= 0 && cfg.MaxBytes <= 0 {
+		return
+	}
+
+	q, ok := module.queues.Load(queueID)
+	if !ok {
+		return
+	}
+	d := q.(*DiskBasedQueue)
+
+	segments, err := d.localSegments()
+	if err != nil {
+		log.Errorf("queue: %v, failed to list segments: %v", queueID, err)
+		return
+	}
+
+	var totalBytes uint64
+	for _, v := range segments {
+		totalBytes += uint64(v.Bytes)
+	}
+
+	var lastSavedFileNum int64 = -1
+	if cfg.DeleteAfterSaveToS3 {
+		lastSavedFileNum = GetLastS3UploadFileNum(queueID)
+	}
+
+	writeSegmentNum := d.LatestOffset().Segment
+	now := time.Now()
+	for _, v := range segments {
+		if v.Segment >= writeSegmentNum {
+			break
+		}
+
+		var reason DeleteReason
+		if maxAge > 0 && now.Sub(v.Range.LastWrite) > maxAge {
+			reason = DeleteReasonMaxAge
+		} else if cfg.MaxBytes > 0 && totalBytes > cfg.MaxBytes {
+			reason = DeleteReasonMaxBytes
+		} else {
+			//segments are in write order, the rest are within the policy
+			break
+		}
+
+		if cfg.DeleteAfterSaveToS3 && v.Segment > lastSavedFileNum {
+			log.Warnf("queue: %v, segment %v exceeds %v but is not uploaded to s3 yet, last uploaded: %v", queueID, v.Segment, reason, lastSavedFileNum)
+			break
+		}
+
+		if global.Env().IsDebug {
+			log.Debugf("queue: %v, delete segment %v by %v, range: %v - %v", queueID, v.Segment, reason, v.Range.FirstWrite, v.Range.LastWrite)
+		}
+
+		_, err := deleteSegment(queueID, d, v.Segment, reason)
+		if err != nil {
+			log.Errorf("queue: %v, failed to delete segment %v: %v", queueID, v.Segment, err)
+			break
+		}
+		totalBytes -= uint64(v.Bytes)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* ©INFINI, All Rights Reserved.
+ * mail: contact#infini.ltd */
+
+package queue
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/env"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/util"
+)
+
+func TestSegmentRangeMetadata(t *testing.T) {
+	env1 := env.EmptyEnv()
+	env1.SystemConfig.PathConfig.Data = t.TempDir()
+	global.RegisterEnv(env1)
+
+	cfg := &DiskQueueConfig{
+		MinMsgSize:       1,
+		MaxMsgSize:       1024,
+		MaxBytesPerFile:  10,
+		WriteTimeoutInMS: 1000,
+		SyncEveryRecords: 1000,
+		SyncTimeoutInMS:  1000,
+	}
+	name := "segment_range"
+	require.NoError(t, os.MkdirAll(GetDataPath(name), 0755))
+	q := &DiskBasedQueue{name: name, dataPath: GetDataPath(name), cfg: cfg}
+
+	for i := 0; i < 3; i++ {
+		res := q.writeOne(newWriteRequest(nil, nil, []byte("message")))
+		require.NoError(t, res.Error)
+	}
+	assert.Equal(t, int64(3), q.writeSegmentNum)
+	require.NoError(t, q.persistMetaData())
+
+	q1 := &DiskBasedQueue{name: name, dataPath: GetDataPath(name), cfg: cfg}
+	require.NoError(t, q1.retrieveMetaData())
+	assert.Equal(t, int64(3), q1.writeSegmentNum)
+	assert.Equal(t, int64(3), q1.depth)
+	for i := int64(0); i < 3; i++ {
+		expected, ok := q.GetSegmentRange(i)
+		require.True(t, ok)
+		rng, ok := q1.GetSegmentRange(i)
+		require.True(t, ok, "segment %v", i)
+		assert.Equal(t, expected.FirstWrite.UnixMilli(), rng.FirstWrite.UnixMilli())
+		assert.Equal(t, expected.LastWrite.UnixMilli(), rng.LastWrite.UnixMilli())
+	}
+
+	//metadata written before ranges were tracked
+	require.NoError(t, os.WriteFile(q.metaDataFileName(), []byte("2\n1,0\n3,0\n"), 0600))
+	q2 := &DiskBasedQueue{name: name, dataPath: GetDataPath(name), cfg: cfg}
+	require.NoError(t, q2.retrieveMetaData())
+	assert.Equal(t, int64(2), q2.depth)
+	assert.Equal(t, int64(3), q2.writeSegmentNum)
+	_, ok := q2.GetSegmentRange(0)
+	assert.False(t, ok)
+}
+
+func TestApplyRetention(t *testing.T) {
+	env1 := env.EmptyEnv()
+	env1.SystemConfig.PathConfig.Data = t.TempDir()
+	global.RegisterEnv(env1)
+
+	name := "retention"
+	require.NoError(t, os.MkdirAll(GetDataPath(name), 0755))
+	cfg := &DiskQueueConfig{}
+	q := &DiskBasedQueue{name: name, dataPath: GetDataPath(name), cfg: cfg, writeSegmentNum: 4}
+	module := &DiskQueue{cfg: cfg}
+	module.queues.Store(name, q)
+
+	now := time.Now()
+	for i, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 0, 0, 0} {
+		require.NoError(t, os.WriteFile(GetFileName(name, int64(i)), make([]byte, 100), 0600))
+		q.touchSegment(int64(i), now.Add(-age))
+	}
+	//compressed copies count as well
+	require.NoError(t, os.WriteFile(GetFileName(name, 2)+compressFileSuffix, make([]byte, 50), 0600))
+
+	var lock sync.Mutex
+	events := []Event{}
+	RegisterEventListener(func(event Event) error {
+		if event.Type == SegmentDeleted && event.Queue == name {
+			lock.Lock()
+			events = append(events, event)
+			lock.Unlock()
+		}
+		return nil
+	})
+
+	//nothing configured, nothing dropped
+	module.applyRetention(name)
+	assert.Empty(t, events)
+
+	cfg.Retention.MaxAge = "1h"
+	module.applyRetention(name)
+	require.Len(t, events, 2)
+	for i, v := range events {
+		assert.Equal(t, int64(i), v.FileNum)
+		assert.Equal(t, DeleteReasonMaxAge, v.Reason)
+		assert.Equal(t, int64(100), v.Bytes)
+		assert.False(t, v.Range.LastWrite.IsZero())
+		assert.False(t, util.FileExists(GetFileName(name, int64(i))))
+		_, ok := q.GetSegmentRange(int64(i))
+		assert.False(t, ok)
+	}
+
+	//250 bytes in segment 2 to 4, the segment in writing is never dropped
+	events = events[:0]
+	cfg.Retention.MaxBytes = 120
+	module.applyRetention(name)
+	require.Len(t, events, 2)
+	assert.Equal(t, int64(2), events[0].FileNum)
+	assert.Equal(t, int64(150), events[0].Bytes)
+	assert.Equal(t, DeleteReasonMaxBytes, events[0].Reason)
+	assert.Equal(t, int64(3), events[1].FileNum)
+	assert.False(t, util.FileExists(GetFileName(name, 2)+compressFileSuffix))
+	assert.True(t, util.FileExists(GetFileName(name, 4)))
+}
@@ -0,0 +1,245 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"infini.sh/framework/core/util/zstd"
+)
+
+// SegmentRecord is a record read from a segment file by ScanSegment
+type SegmentRecord struct {
+	Position int64 //position of the record in the segment
+	Size     int32 //size of the body on disk
+	Metadata bool
+	Checksum bool //the record has a checksum, and it matched
+	Key      []byte
+	Headers  map[string]string
+	Data     []byte
+
+	//write time from the time index, exact if the record has an index entry,
+	//else the time of the previous entry, zero without a time index
+	Time      time.Time
+	TimeExact bool
+}
+
+type SegmentScanOptions struct {
+	MinMsgSize int32
+	MaxMsgSize int32
+	//the messages were compressed with compress.message.enabled
+	CompressedMessages bool
+}
+
+// SegmentCorruption is a damaged record, found by ScanSegment or by a
+// consumer, the records before Position are good
+type SegmentCorruption struct {
+	Segment  int64
+	Position int64
+	Reason   string
+}
+
+func (e *SegmentCorruption) Error() string {
+	return fmt.Sprintf("corrupted record at segment %v, position %v: %v", e.Segment, e.Position, e.Reason)
+}
+
+// verifyRecordChecksum checks the checksum prefix of buf, and returns the
+// body after it.
+func verifyRecordChecksum(segment, pos int64, buf []byte) ([]byte, error) {
+	expected := binary.BigEndian.Uint32(buf[:recordChecksumSize])
+	body := buf[recordChecksumSize:]
+	if actual := recordChecksum(body); actual != expected {
+		return nil, &SegmentCorruption{Segment: segment, Position: pos, Reason: fmt.Sprintf("checksum mismatch, expected %08x, got %08x", expected, actual)}
+	}
+	return body, nil
+}
+
+// ParseSegmentFileName returns the segment number of a segment file, flat or
+// compressed, eg: 000000012.dat.zstd
+func ParseSegmentFileName(file string) (int64, bool) {
+	name := strings.TrimSuffix(filepath.Base(file), compressFileSuffix)
+	if filepath.Ext(name) != ".dat" {
+		return -1, false
+	}
+	v, err := strconv.ParseInt(strings.TrimSuffix(name, ".dat"), 10, 64)
+	if err != nil {
+		return -1, false
+	}
+	return v, true
+}
+
+// SegmentTimeIndexFile returns the time index written alongside a segment file
+func SegmentTimeIndexFile(file string) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(file, compressFileSuffix), ".dat")
+	return name + ".idx"
+}
+
+// ScanSegment reads the records of a segment file, flat or compressed, and
+// calls fn with every good one, without a running queue. It returns the size
+// of the good records, and a *SegmentCorruption if the file does not end
+// right after them.
+func ScanSegment(file string, opts SegmentScanOptions, fn func(record *SegmentRecord) error) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var in io.Reader = f
+	if strings.HasSuffix(file, compressFileSuffix) {
+		r, err := zstd.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+		in = r
+	}
+
+	//the time index is optional
+	entries, _ := readTimeIndex(SegmentTimeIndexFile(file))
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Position < entries[j].Position
+	})
+
+	if opts.MinMsgSize <= 0 {
+		opts.MinMsgSize = 1
+	}
+	if opts.MaxMsgSize <= 0 {
+		opts.MaxMsgSize = 104857600
+	}
+
+	segment, _ := ParseSegmentFileName(file)
+	corruption := func(pos int64, reason string, args ...interface{}) *SegmentCorruption {
+		return &SegmentCorruption{Segment: segment, Position: pos, Reason: fmt.Sprintf(reason, args...)}
+	}
+
+	reader := bufio.NewReader(in)
+	var pos int64
+	var entry int
+	for {
+		var v int32
+		err := binary.Read(reader, binary.BigEndian, &v)
+		if err == io.EOF {
+			return pos, nil
+		}
+		if err != nil {
+			return pos, corruption(pos, "incomplete record size: %v", err)
+		}
+
+		size, metadata, checksum := decodeRecordSize(v)
+		if size < opts.MinMsgSize || size > opts.MaxMsgSize {
+			return pos, corruption(pos, "invalid record size %v, should between %v and %v", size, opts.MinMsgSize, opts.MaxMsgSize)
+		}
+
+		total := size
+		if checksum {
+			total += recordChecksumSize
+		}
+		body := make([]byte, total)
+		n, err := io.ReadFull(reader, body)
+		if err != nil {
+			return pos, corruption(pos, "incomplete record, %v of %v bytes", n, total)
+		}
+
+		record := &SegmentRecord{Position: pos, Size: size, Metadata: metadata, Checksum: checksum}
+		if checksum {
+			body, err = verifyRecordChecksum(segment, pos, body)
+			if err != nil {
+				return pos, err
+			}
+		}
+		if opts.CompressedMessages {
+			body, err = zstd.ZSTDDecompress(nil, body)
+			if err != nil {
+				return pos, corruption(pos, "failed to decompress record: %v", err)
+			}
+		}
+		if metadata {
+			record.Key, record.Headers, body, err = decodeRecordBody(body)
+			if err != nil {
+				return pos, corruption(pos, "%v", err)
+			}
+		}
+		record.Data = body
+
+		for entry < len(entries) && entries[entry].Position <= pos {
+			record.Time = time.UnixMilli(entries[entry].Time)
+			record.TimeExact = entries[entry].Position == pos
+			entry++
+		}
+		if entry > 0 && record.Time.IsZero() {
+			record.Time = time.UnixMilli(entries[entry-1].Time)
+		}
+
+		if fn != nil {
+			err = fn(record)
+			if err != nil {
+				return pos, err
+			}
+		}
+		pos += int64(4 + total)
+	}
+}
+
+// TruncateSegment cuts a flat segment file after its good records, found by
+// ScanSegment, and drops the time index entries past them.
+func TruncateSegment(file string, size int64) error {
+	if strings.HasSuffix(file, compressFileSuffix) {
+		return fmt.Errorf("can't truncate compressed segment %v, decompress it first", file)
+	}
+	err := os.Truncate(file, size)
+	if err != nil {
+		return err
+	}
+
+	indexFile := SegmentTimeIndexFile(file)
+	entries, err := readTimeIndex(indexFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	buf := make([]byte, 0, len(entries)*timeIndexEntrySize)
+	for _, v := range entries {
+		if v.Position < size {
+			buf = binary.BigEndian.AppendUint64(buf, uint64(v.Time))
+			buf = binary.BigEndian.AppendUint64(buf, uint64(v.Position))
+		}
+	}
+	return os.WriteFile(indexFile, buf, 0600)
+}
@@ -0,0 +1,129 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* ©INFINI, All Rights Reserved.
+ * mail: contact#infini.ltd */
+
+package queue
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/env"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/util/zstd"
+)
+
+func TestScanSegment(t *testing.T) {
+	env1 := env.EmptyEnv()
+	env1.SystemConfig.PathConfig.Data = t.TempDir()
+	global.RegisterEnv(env1)
+
+	cfg := &DiskQueueConfig{
+		MinMsgSize:       1,
+		MaxMsgSize:       1024,
+		MaxBytesPerFile:  1024 * 1024,
+		WriteTimeoutInMS: 1000,
+		SyncEveryRecords: 1000,
+		SyncTimeoutInMS:  1000,
+	}
+	name := "scan_segment"
+	require.NoError(t, os.MkdirAll(GetDataPath(name), 0755))
+	q := &DiskBasedQueue{name: name, dataPath: GetDataPath(name), cfg: cfg}
+	require.NoError(t, q.writeOne(newWriteRequest(nil, nil, []byte("a"))).Error)
+	require.NoError(t, q.writeOne(newWriteRequest([]byte("k"), map[string]string{"h": "v"}, []byte("bb"))).Error)
+	require.NoError(t, q.writeOne(newWriteRequest(nil, nil, []byte("ccc"))).Error)
+	q.writeFile.Close()
+	q.closeTimeIndex()
+
+	file := GetFileName(name, 0)
+	segment, ok := ParseSegmentFileName(file + compressFileSuffix)
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), segment)
+
+	records := []*SegmentRecord{}
+	scan := func(file string) (int64, error) {
+		records = records[:0]
+		return ScanSegment(file, SegmentScanOptions{MinMsgSize: cfg.MinMsgSize, MaxMsgSize: cfg.MaxMsgSize}, func(record *SegmentRecord) error {
+			records = append(records, record)
+			return nil
+		})
+	}
+
+	size, err := scan(file)
+	require.NoError(t, err)
+	assert.Equal(t, q.writePos, size)
+	require.Len(t, records, 3)
+	assert.Equal(t, int64(5), records[1].Position)
+	assert.Equal(t, []byte("k"), records[1].Key)
+	assert.Equal(t, map[string]string{"h": "v"}, records[1].Headers)
+	assert.Equal(t, []byte("bb"), records[1].Data)
+	assert.True(t, records[0].TimeExact)
+	assert.False(t, records[1].Time.IsZero())
+
+	//compressed segments read the same
+	require.NoError(t, zstd.CompressFile(file, file+compressFileSuffix))
+	size, err = scan(file + compressFileSuffix)
+	require.NoError(t, err)
+	assert.Equal(t, q.writePos, size)
+	assert.Len(t, records, 3)
+
+	//a torn write at the end
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 9, 'd'})
+	require.NoError(t, err)
+	f.Close()
+
+	size, err = scan(file)
+	require.Error(t, err)
+	corruption, ok := err.(*SegmentCorruption)
+	require.True(t, ok)
+	assert.Equal(t, q.writePos, corruption.Position)
+	assert.Equal(t, q.writePos, size)
+	assert.Len(t, records, 3)
+
+	require.NoError(t, TruncateSegment(file, size))
+	size, err = scan(file)
+	require.NoError(t, err)
+	assert.Equal(t, q.writePos, size)
+
+	//an invalid size in the middle
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	data[5] = 0x7f
+	require.NoError(t, os.WriteFile(file, data, 0600))
+	size, err = scan(file)
+	assert.Error(t, err)
+	assert.Equal(t, int64(5), size)
+	assert.Len(t, records, 1)
+	require.NoError(t, TruncateSegment(file, size))
+	entries, err := readTimeIndex(GetTimeIndexFileName(name, 0))
+	require.NoError(t, err)
+	for _, v := range entries {
+		assert.True(t, v.Position < 5)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package queue
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/queue"
+)
+
+// the time index is a sparse index written alongside every segment file, each
+// entry is the write time in unix milliseconds and the position of the record
+// written at that time, both as big endian int64. An entry is added for the
+// first record of the segment, and then at most once per index interval.
+const timeIndexEntrySize = 16
+
+func GetTimeIndexFileName(queueID string, segmentID int64) string {
+	return path.Join(GetDataPath(queueID), fmt.Sprintf("%09d.idx", segmentID))
+}
+
+type timeIndexEntry struct {
+	Time     int64
+	Position int64
+}
+
+// indexRecord adds an entry for the record to be written at pos, if the
+// index interval passed since the last entry of the segment.
+func (d *DiskBasedQueue) indexRecord(pos int64, t time.Time) error {
+	ms := t.UnixMilli()
+	interval := d.timeIndexInterval()
+	if d.timeIndexFile != nil && ms-d.lastIndexedTime < interval {
+		return nil
+	}
+
+	if d.timeIndexFile == nil {
+		f, err := os.OpenFile(GetTimeIndexFileName(d.name, d.writeSegmentNum), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		d.timeIndexFile = f
+	}
+
+	var buf [timeIndexEntrySize]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(ms))
+	binary.BigEndian.PutUint64(buf[8:], uint64(pos))
+	_, err := d.timeIndexFile.Write(buf[:])
+	if err != nil {
+		return err
+	}
+	d.lastIndexedTime = ms
+	return nil
+}
+
+func (d *DiskBasedQueue) timeIndexInterval() int64 {
+	if d.cfg.TimeIndexIntervalInMs <= 0 {
+		return 1000
+	}
+	return d.cfg.TimeIndexIntervalInMs
+}
+
+func (d *DiskBasedQueue) closeTimeIndex() {
+	if d.timeIndexFile != nil {
+		d.timeIndexFile.Close()
+		d.timeIndexFile = nil
+	}
+	d.lastIndexedTime = 0
+}
+
+func readTimeIndex(file string) ([]timeIndexEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	//a partially written entry at the end is ignored
+	entries := make([]timeIndexEntry, 0, len(data)/timeIndexEntrySize)
+	for i := 0; i+timeIndexEntrySize <= len(data); i += timeIndexEntrySize {
+		entries = append(entries, timeIndexEntry{
+			Time:     int64(binary.BigEndian.Uint64(data[i : i+8])),
+			Position: int64(binary.BigEndian.Uint64(data[i+8 : i+16])),
+		})
+	}
+	return entries, nil
+}
+
+// OffsetForTime returns the offset to read from to get every message written
+// at or after t. As the time index is sparse, it may start with a few messages
+// written less than one index interval earlier. Segments without a time index
+// are read from the start.
+func (d *DiskBasedQueue) OffsetForTime(t time.Time) (queue.Offset, error) {
+	segments, err := d.localSegments()
+	if err != nil {
+		return queue.Offset{}, err
+	}
+
+	for _, v := range segments {
+		if v.Range.LastWrite.Before(t) {
+			continue
+		}
+		if !v.Range.FirstWrite.Before(t) {
+			return queue.NewOffset(v.Segment, 0), nil
+		}
+
+		entries, err := readTimeIndex(GetTimeIndexFileName(d.name, v.Segment))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Warnf("queue: %v, failed to read time index of segment %v: %v", d.name, v.Segment, err)
+			}
+			return queue.NewOffset(v.Segment, 0), nil
+		}
+
+		ms := t.UnixMilli()
+		i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].Time >= ms
+		})
+		if i == 0 {
+			return queue.NewOffset(v.Segment, 0), nil
+		}
+		//records after an entry are written within one interval, if that
+		//ended before t, the next entry is the first record at or after t
+		if i < len(entries) && entries[i-1].Time+d.timeIndexInterval() <= ms {
+			return queue.NewOffset(v.Segment, entries[i].Position), nil
+		}
+		return queue.NewOffset(v.Segment, entries[i-1].Position), nil
+	}
+
+	return d.LatestOffset(), nil
+}
@@ -0,0 +1,92 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* ©INFINI, All Rights Reserved.
+ * mail: contact#infini.ltd */
+
+package queue
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/env"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/queue"
+)
+
+func TestDiskQueueOffsetForTime(t *testing.T) {
+	env1 := env.EmptyEnv()
+	env1.SystemConfig.PathConfig.Data = t.TempDir()
+	global.RegisterEnv(env1)
+
+	cfg := &DiskQueueConfig{
+		MinMsgSize:            1,
+		MaxMsgSize:            1024,
+		MaxBytesPerFile:       30,
+		WriteTimeoutInMS:      1000,
+		SyncEveryRecords:      1000,
+		SyncTimeoutInMS:       1000,
+		TimeIndexIntervalInMs: 1,
+	}
+	name := "offset_for_time"
+	require.NoError(t, os.MkdirAll(GetDataPath(name), 0755))
+	q := &DiskBasedQueue{name: name, dataPath: GetDataPath(name), cfg: cfg}
+	defer q.closeTimeIndex()
+
+	//every record takes 11 bytes, the segment rotates after 3 records
+	times := []time.Time{}
+	for i := 0; i < 5; i++ {
+		time.Sleep(3 * time.Millisecond)
+		times = append(times, time.Now())
+		time.Sleep(3 * time.Millisecond)
+		require.NoError(t, q.writeOne(newWriteRequest(nil, nil, []byte("message"))).Error)
+	}
+
+	cases := []struct {
+		t        time.Time
+		expected queue.Offset
+	}{
+		{times[0].Add(-time.Hour), queue.NewOffset(0, 0)},
+		{times[0], queue.NewOffset(0, 0)},
+		{times[1], queue.NewOffset(0, 11)},
+		{times[2], queue.NewOffset(0, 22)},
+		{times[3], queue.NewOffset(1, 0)},
+		{times[4], queue.NewOffset(1, 11)},
+		{time.Now().Add(time.Hour), queue.NewOffset(1, 22)},
+	}
+	for i, v := range cases {
+		offset, err := q.OffsetForTime(v.t)
+		require.NoError(t, err)
+		assert.Equal(t, v.expected, offset, "case %v", i)
+	}
+
+	//segments without a time index are read from the start
+	require.NoError(t, os.Remove(GetTimeIndexFileName(name, 0)))
+	offset, err := q.OffsetForTime(times[2])
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffset(0, 0), offset)
+}
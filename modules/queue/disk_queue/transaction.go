@@ -0,0 +1,212 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package queue
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/util"
+)
+
+// the state of a transaction is kept next to the segments of its target
+// queue, and replaced atomically by every commit
+func (d *DiskBasedQueue) transactionStateFileName(txnID string) string {
+	return path.Join(d.dataPath, fmt.Sprintf("txn_%v.json", util.MD5digest(txnID)))
+}
+
+func (d *DiskBasedQueue) readTransactionState(txnID string) (*queue.TransactionState, error) {
+	fileName := d.transactionStateFileName(txnID)
+	if !util.FileExists(fileName) {
+		return nil, nil
+	}
+	data, err := util.FileGetContent(fileName)
+	if err != nil {
+		return nil, err
+	}
+	state := &queue.TransactionState{}
+	err = util.FromJSONBytes(data, state)
+	if err != nil {
+		return nil, errors.Errorf("invalid transaction state [%v]: %v", fileName, err)
+	}
+	return state, nil
+}
+
+func (d *DiskBasedQueue) writeTransactionState(state *queue.TransactionState) error {
+	fileName := d.transactionStateFileName(state.ID)
+	tmpFileName := fmt.Sprintf("%s.%d.tmp", fileName, rand.Int())
+
+	f, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(util.MustToJSONBytes(state))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	f.Sync()
+	f.Close()
+
+	return util.AtomicFileRename(tmpFileName, fileName)
+}
+
+// scanTransaction returns the last message the transaction produced at or
+// after from
+func (d *DiskBasedQueue) scanTransaction(txnID string, from queue.Offset) (*queue.TransactionMarker, error) {
+	opts := SegmentScanOptions{
+		MinMsgSize:         d.cfg.MinMsgSize,
+		MaxMsgSize:         d.cfg.MaxMsgSize,
+		CompressedMessages: d.cfg.Compress.Message.Enabled,
+	}
+
+	var last *queue.TransactionMarker
+	end := d.LatestOffset()
+	for segment := from.Segment; segment <= end.Segment; segment++ {
+		file := d.GetFileName(segment)
+		if !util.FileExists(file) {
+			file = file + compressFileSuffix
+			if !util.FileExists(file) {
+				continue
+			}
+		}
+
+		_, err := ScanSegment(file, opts, func(record *SegmentRecord) error {
+			if segment == from.Segment && record.Position < from.Position {
+				return nil
+			}
+			marker, ok := queue.TransactionMarkerFromHeaders(txnID, record.Headers)
+			if ok && (last == nil || marker.After(last)) {
+				last = marker
+			}
+			return nil
+		})
+		if err != nil {
+			//the tail of the segment being written may be incomplete
+			if _, ok := err.(*SegmentCorruption); ok && segment == end.Segment {
+				break
+			}
+			return last, err
+		}
+	}
+	return last, nil
+}
+
+func (module *DiskQueue) getQueue(k *queue.QueueConfig) (*DiskBasedQueue, error) {
+	q, ok := module.queues.Load(k.ID)
+	if !ok {
+		err := module.Init(k.ID)
+		if err != nil {
+			return nil, err
+		}
+		q, ok = module.queues.Load(k.ID)
+	}
+	if !ok {
+		return nil, errors.Errorf("queue:%v not found", k.ID)
+	}
+	return q.(*DiskBasedQueue), nil
+}
+
+// CommitTransaction produces reqs to the target queue, then records the
+// target position along with offset in the transaction state before
+// committing offset, a crash in between is completed by
+// RecoverTransaction.
+func (module *DiskQueue) CommitTransaction(txn *queue.Transaction, reqs []queue.ProduceRequest, offset queue.Offset) (*[]queue.ProduceResponse, error) {
+	q, err := module.getQueue(txn.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := q.readTransactionState(txn.ID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &queue.TransactionState{ID: txn.ID}
+	}
+
+	var res *[]queue.ProduceResponse
+	if len(reqs) > 0 {
+		producer := &Producer{q: q, cfg: txn.Target, diskQueueConfig: module.cfg}
+		res, err = producer.Produce(&reqs)
+		if err != nil {
+			return res, err
+		}
+		state.Last, _ = queue.TransactionMarkerFromHeaders(txn.ID, reqs[len(reqs)-1].Headers)
+		state.TargetOffset = (*res)[len(*res)-1].Offset
+	}
+	state.SourceOffset = offset
+	state.Timestamp = time.Now().Unix()
+
+	err = q.writeTransactionState(state)
+	if err != nil {
+		return res, err
+	}
+
+	_, err = queue.CommitOffset(txn.Source, txn.Consumer, offset)
+	return res, err
+}
+
+// RecoverTransaction commits the source offset of the last recorded commit,
+// and looks for messages produced after it, which were written before a
+// crash but not committed.
+func (module *DiskQueue) RecoverTransaction(txn *queue.Transaction) (*queue.TransactionState, error) {
+	q, err := module.getQueue(txn.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := q.readTransactionState(txn.ID)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &queue.TransactionState{ID: txn.ID}
+	} else {
+		err = queue.CompleteTransaction(txn, state)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	last, err := q.scanTransaction(txn.ID, state.TargetOffset)
+	if err != nil {
+		return nil, err
+	}
+	if last != nil && (state.Last == nil || last.After(state.Last)) {
+		log.Warnf("transaction [%v] produced to queue [%v] up to %v without committing, skipping them on replay", txn.ID, txn.Target.Name, last.SourceOffset)
+		state.Last = last
+	}
+	return state, nil
+}
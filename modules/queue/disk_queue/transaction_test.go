@@ -0,0 +1,110 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* ©INFINI, All Rights Reserved.
+ * mail: contact#infini.ltd */
+
+package queue
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/env"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/queue"
+)
+
+func TestDiskQueueTransactionRecovery(t *testing.T) {
+	env1 := env.EmptyEnv()
+	env1.SystemConfig.PathConfig.Data = t.TempDir()
+	global.RegisterEnv(env1)
+
+	cfg := &DiskQueueConfig{
+		MinMsgSize:       1,
+		MaxMsgSize:       1024,
+		MaxBytesPerFile:  200,
+		WriteTimeoutInMS: 1000,
+		SyncEveryRecords: 1000,
+		SyncTimeoutInMS:  1000,
+	}
+	name := "transaction_target"
+	require.NoError(t, os.MkdirAll(GetDataPath(name), 0755))
+	q := &DiskBasedQueue{name: name, dataPath: GetDataPath(name), cfg: cfg}
+
+	headers := func(txnID string, pos int64, seq string) map[string]string {
+		offset := queue.NewOffset(0, pos)
+		return map[string]string{
+			queue.HeaderTransactionID:           txnID,
+			queue.HeaderTransactionSourceOffset: offset.EncodeToString(),
+			queue.HeaderTransactionSequence:     seq,
+		}
+	}
+
+	//the outputs of two transactions and a plain message, spread over segments
+	var committed queue.Offset
+	for i := int64(0); i < 6; i++ {
+		res := q.writeOne(newWriteRequest(nil, headers("txn-a", i*10, "0"), []byte("message")))
+		require.NoError(t, res.Error)
+		if i == 2 {
+			committed = queue.NewOffset(res.Segment, res.Position)
+		}
+		require.NoError(t, q.writeOne(newWriteRequest(nil, headers("txn-b", 1000+i, "0"), []byte("message"))).Error)
+	}
+	require.NoError(t, q.writeOne(newWriteRequest(nil, headers("txn-a", 50, "1"), []byte("message"))).Error)
+	require.NoError(t, q.writeOne(newWriteRequest(nil, nil, []byte("message"))).Error)
+	require.NoError(t, q.writeFile.Close())
+	assert.True(t, q.LatestOffset().Segment > 0)
+
+	state, err := q.readTransactionState("txn-a")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	state = &queue.TransactionState{
+		ID:           "txn-a",
+		SourceOffset: queue.NewOffsetWithVersion(0, 21, 1),
+		TargetOffset: committed,
+		Last:         &queue.TransactionMarker{SourceOffset: queue.NewOffset(0, 20)},
+	}
+	require.NoError(t, q.writeTransactionState(state))
+	loaded, err := q.readTransactionState("txn-a")
+	require.NoError(t, err)
+	assert.Equal(t, state, loaded)
+
+	//what was produced after the last commit is found
+	last, err := q.scanTransaction("txn-a", committed)
+	require.NoError(t, err)
+	require.NotNil(t, last)
+	assert.Equal(t, queue.TransactionMarker{SourceOffset: queue.NewOffset(0, 50), Sequence: 1}, *last)
+
+	last, err = q.scanTransaction("txn-b", queue.Offset{})
+	require.NoError(t, err)
+	require.NotNil(t, last)
+	assert.Equal(t, queue.NewOffset(0, 1005), last.SourceOffset)
+
+	last, err = q.scanTransaction("txn-c", queue.Offset{})
+	require.NoError(t, err)
+	assert.Nil(t, last)
+}
@@ -0,0 +1,90 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI Ltd. All rights reserved.
+ * web: https://infinilabs.com
+ * mail: hello#infini.ltd */
+package mem_queue
+
+import (
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/queue"
+)
+
+// Consumer reads the ring log of a queue from its own offset, it is not
+// thread-safe.
+type Consumer struct {
+	mq   *MemoryQueue
+	log  *ringLog
+	qCfg *queue.QueueConfig
+	cCfg *queue.ConsumerConfig
+
+	pos     int64
+	version int64 //offset version
+}
+
+func (c *Consumer) Close() error {
+	return nil
+}
+
+func (c *Consumer) ResetOffset(segment, readPos int64) error {
+	if global.Env().IsDebug {
+		log.Debugf("reset %v offset to %v", c.qCfg.ID, readPos)
+	}
+	c.pos = readPos
+	return nil
+}
+
+func (c *Consumer) FetchMessages(ctx *queue.Context, numOfMessages int) (messages []queue.Message, isTimeout bool, err error) {
+	if numOfMessages <= 0 || (c.cCfg.FetchMaxMessages > 0 && numOfMessages > c.cCfg.FetchMaxMessages) {
+		numOfMessages = c.cCfg.FetchMaxMessages
+	}
+
+	msgs, next := c.log.fetch(c.pos, numOfMessages, c.cCfg.FetchMaxBytes, time.Duration(c.cCfg.FetchMaxWaitMs)*time.Millisecond)
+	if len(msgs) > 0 {
+		//the log may have skipped evicted messages
+		c.pos = msgs[0].Offset.Position
+	}
+	ctx.UpdateInitOffset(0, c.pos, c.version)
+	ctx.NextOffset = queue.NewOffsetWithVersion(0, next, c.version)
+	ctx.MessageCount = len(msgs)
+
+	messages = make([]queue.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		m := *msg
+		m.Offset.Version = c.version
+		m.NextOffset.Version = c.version
+		messages = append(messages, m)
+	}
+	c.pos = next
+
+	return messages, len(messages) == 0, nil
+}
+
+func (c *Consumer) CommitOffset(offset queue.Offset) error {
+	_, err := c.mq.CommitOffset(c.qCfg, c.cCfg, offset)
+	return err
+}
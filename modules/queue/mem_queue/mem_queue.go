@@ -28,19 +28,22 @@
 package mem_queue
 
 import (
+	"sync"
+	"time"
+
 	log "github.com/cihub/seelog"
 	"infini.sh/framework/core/env"
 	"infini.sh/framework/core/errors"
 	"infini.sh/framework/core/global"
 	"infini.sh/framework/core/queue"
-	"infini.sh/framework/core/stats"
 	"infini.sh/framework/core/util"
-	memQueue "infini.sh/framework/lib/lock_free/queue"
-	"runtime"
-	"sync"
-	"time"
 )
 
+// MemoryQueue keeps every queue as an in-memory ring log of up to capacity
+// messages, all the queues together retain no more than total_memory_size
+// bytes. Push and Pop share a single read position, while consumers acquired
+// through the queue api read the log at their own offset, like on the disk
+// queue, so a message can be consumed by several groups.
 type MemoryQueue struct {
 	Capacity uint32 `config:"capacity"`
 	Default  bool   `config:"default"`
@@ -49,6 +52,8 @@ type MemoryQueue struct {
 	MemorySize int `config:"total_memory_size"`
 	q          sync.Map
 	locker     sync.RWMutex
+	budget     *memoryBudget
+	budgetOnce sync.Once
 }
 
 func (this *MemoryQueue) Setup() {
@@ -81,95 +86,189 @@ func (this *MemoryQueue) Name() string {
 }
 
 func (this *MemoryQueue) Init(q string) error {
-	q1 := memQueue.NewQueue(this.Capacity)
-	this.q.Store(q, q1)
+	this.getLog(q)
 	return nil
 }
 
-func (this *MemoryQueue) Push(q string, data []byte) error {
-	q1, ok := this.q.Load(q)
+func (this *MemoryQueue) getLog(q string) *ringLog {
+	v, ok := this.q.Load(q)
 	if !ok {
-		err := this.Init(q)
-		if err != nil {
-			panic(err)
-		}
-		q1, _ = this.q.Load(q)
+		this.budgetOnce.Do(func() {
+			this.budget = &memoryBudget{}
+			if this.MemorySize > 0 {
+				this.budget.limit = uint64(this.MemorySize)
+			}
+		})
+		v, _ = this.q.LoadOrStore(q, newRingLog(q, this.Capacity, this.budget))
 	}
+	return v.(*ringLog)
+}
 
-	retryTimes := 0
-	da := []byte(string(data)) //TODO memory copy
-	mq, ok := q1.(*memQueue.EsQueue)
-	if !ok {
-		panic("invalid memory queue")
-	}
+// Push queues data, it waits for consumers for a few seconds when the queue
+// is full, and fails with capacityFull if they do not catch up.
+func (this *MemoryQueue) Push(q string, data []byte) error {
+	_, err := this.getLog(q).append(&queue.Message{Data: append([]byte(nil), data...), Size: len(data), Timestamp: time.Now().Unix()})
+	return err
+}
 
-RETRY:
-	ok, _ = mq.Put(da)
-	if !ok {
-		if retryTimes > 3 {
-			stats.Increment("mem_queue", "dead_retry")
-			return capacityFull
-		} else {
-			retryTimes++
-			runtime.Gosched()
-			log.Debugf("memory_queue %v of %v, sleep 1s", mq.Quantity(), mq.Capaciity())
-			time.Sleep(1000 * time.Millisecond)
-			stats.Increment("mem_queue", "retry")
-			goto RETRY
+var capacityFull = errors.New("memory capacity full")
+
+// PushMessage queues data along with its key and headers, they come back
+// from Consume and consumers, while Pop only returns the data.
+func (this *MemoryQueue) PushMessage(q string, msg *queue.ProduceRequest) error {
+	_, err := this.pushMessage(q, msg)
+	return err
+}
+
+func (this *MemoryQueue) pushMessage(q string, msg *queue.ProduceRequest) (int64, error) {
+	m := &queue.Message{
+		Data:      append([]byte(nil), msg.Data...),
+		Size:      len(msg.Data),
+		Timestamp: time.Now().Unix(),
+	}
+	if len(msg.Key) > 0 {
+		m.Key = append([]byte(nil), msg.Key...)
+	}
+	if len(msg.Headers) > 0 {
+		m.Headers = make(map[string]string, len(msg.Headers))
+		for k, v := range msg.Headers {
+			m.Headers[k] = v
 		}
 	}
-	return nil
+	return this.getLog(q).append(m)
 }
 
-var capacityFull = errors.New("memory capacity full")
-
 func (this *MemoryQueue) Pop(q string, t time.Duration) (data []byte, timeout bool) {
-	queue, ok := this.q.Load(q)
-	if !ok || queue == nil {
-		return nil, true
+	msg, timeout := this.pop(q, t)
+	if msg == nil {
+		return nil, timeout
 	}
+	return msg.Data, timeout
+}
 
-	mq, ok := queue.(*memQueue.EsQueue)
+func (this *MemoryQueue) pop(q string, t time.Duration) (*queue.Message, bool) {
+	v, ok := this.q.Load(q)
 	if !ok {
-		panic("invalid memory queue")
+		return nil, true
 	}
-
-	v, ok, _ := mq.Get()
-	if ok && v != nil {
-		d, ok := v.([]byte)
-		if ok {
-			return d, false
-		}
+	msg := v.(*ringLog).pop(t)
+	if msg == nil {
+		return nil, true
 	}
-	return nil, true
+	return msg, false
 }
 
 func (this *MemoryQueue) Close(string) error {
 	return nil
 }
 
-func (this *MemoryQueue) Depth(q string) int64 {
-	q1, ok := this.q.Load(q)
+func (this *MemoryQueue) Destroy(q string) error {
+	v, ok := this.q.LoadAndDelete(q)
 	if ok {
-		mq, ok := q1.(*memQueue.EsQueue)
-		if !ok {
-			panic("invalid memory queue")
-		}
-		return int64(mq.Quantity())
+		v.(*ringLog).release()
 	}
-	return 0
+	return nil
 }
 
+func (this *MemoryQueue) GetStorageSize(q string) uint64 {
+	v, ok := this.q.Load(q)
+	if !ok {
+		return 0
+	}
+	return v.(*ringLog).storageSize()
+}
+
+func (this *MemoryQueue) Depth(q string) int64 {
+	v, ok := this.q.Load(q)
+	if !ok {
+		return 0
+	}
+	return v.(*ringLog).depth()
+}
+
+// Consume pops a single message, with its key and headers.
 func (this *MemoryQueue) Consume(q *queue.QueueConfig, consumer *queue.ConsumerConfig, offsetStr string) (*queue.Context, []queue.Message, bool, error) {
 	ctx := &queue.Context{}
-	d, t := this.Pop(q.ID, consumer.GetFetchMaxWaitMs())
-	msg := queue.Message{Data: d}
-	msgs := []queue.Message{msg}
+	msg, t := this.pop(q.ID, 0)
+	if msg == nil {
+		msg = &queue.Message{}
+	}
+	msgs := []queue.Message{*msg}
 	return ctx, msgs, t, nil
 }
 
-func (this *MemoryQueue) LatestOffset(string) string {
-	return ""
+func (this *MemoryQueue) LatestOffset(k *queue.QueueConfig) queue.Offset {
+	return this.getLog(k.ID).latestOffset()
+}
+
+func (this *MemoryQueue) OffsetForTime(k *queue.QueueConfig, t time.Time) (queue.Offset, error) {
+	return this.getLog(k.ID).offsetForTime(t), nil
+}
+
+func (this *MemoryQueue) GetOffset(k *queue.QueueConfig, consumer *queue.ConsumerConfig) (queue.Offset, error) {
+	return this.getLog(k.ID).getOffset(consumer.Key()), nil
+}
+
+// DeleteOffset resets the offset of the consumer to the start, bumping its
+// version so commits of messages fetched before are rejected.
+func (this *MemoryQueue) DeleteOffset(k *queue.QueueConfig, consumer *queue.ConsumerConfig) error {
+	consumer.CommitLocker.Lock()
+	defer consumer.CommitLocker.Unlock()
+
+	l := this.getLog(k.ID)
+	offset := l.getOffset(consumer.Key())
+	l.setOffset(consumer.Key(), queue.NewOffsetWithVersion(0, 0, offset.Version+1))
+	return nil
+}
+
+func (this *MemoryQueue) CommitOffset(k *queue.QueueConfig, consumer *queue.ConsumerConfig, offset queue.Offset) (bool, error) {
+	consumer.CommitLocker.Lock()
+	defer consumer.CommitLocker.Unlock()
+
+	l := this.getLog(k.ID)
+	current := l.getOffset(consumer.Key())
+	if current.LatestThan(offset) {
+		return false, errors.Errorf("consumer:%v, current offset(%v) is larger than committed value(%v)", consumer.String(), current.EncodeToString(), offset.EncodeToString())
+	}
+	if global.Env().IsDebug {
+		log.Tracef("commit offset, queue [%v] [%v][%v] commit offset:%v", k.ID, consumer.Group, consumer.Name, offset)
+	}
+	l.setOffset(consumer.Key(), offset)
+	return true, nil
+}
+
+// AcquireConsumer registers the group of consumer with the queue, so its
+// messages are kept until the group commits them.
+func (this *MemoryQueue) AcquireConsumer(k *queue.QueueConfig, consumer *queue.ConsumerConfig) (queue.ConsumerAPI, error) {
+	offset := this.getLog(k.ID).addConsumer(consumer.Key())
+	c := &Consumer{
+		mq:      this,
+		log:     this.getLog(k.ID),
+		qCfg:    k,
+		cCfg:    consumer,
+		version: offset.Version,
+	}
+	err := c.ResetOffset(offset.Segment, offset.Position)
+	return c, err
+}
+
+func (this *MemoryQueue) ReleaseConsumer(k *queue.QueueConfig, c *queue.ConsumerConfig, consumer queue.ConsumerAPI) error {
+	if consumer != nil {
+		return consumer.Close()
+	}
+	return nil
+}
+
+func (this *MemoryQueue) AcquireProducer(cfg *queue.QueueConfig) (queue.ProducerAPI, error) {
+	if cfg == nil || cfg.ID == "" {
+		panic("queue config is nil")
+	}
+	this.getLog(cfg.ID)
+	return &Producer{mq: this, cfg: cfg}, nil
+}
+
+func (this *MemoryQueue) ReleaseProducer(k *queue.QueueConfig, producer queue.ProducerAPI) error {
+	return nil
 }
 
 func (this *MemoryQueue) GetQueues() []string {
@@ -0,0 +1,250 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package mem_queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/queue"
+)
+
+func TestMemoryQueueMessageMetadata(t *testing.T) {
+	mq := &MemoryQueue{Capacity: 16}
+	cfg := &queue.QueueConfig{ID: "metadata"}
+	require.NoError(t, mq.Init(cfg.ID))
+
+	require.NoError(t, mq.Push(cfg.ID, []byte("plain")))
+	req := &queue.ProduceRequest{Key: []byte("k1"), Headers: map[string]string{"trace_id": "t1"}, Data: []byte("with metadata")}
+	require.NoError(t, mq.PushMessage(cfg.ID, req))
+	req.Headers["trace_id"] = "changed"
+
+	_, msgs, timeout, err := mq.Consume(cfg, &queue.ConsumerConfig{}, "")
+	require.NoError(t, err)
+	assert.False(t, timeout)
+	assert.Equal(t, []byte("plain"), msgs[0].Data)
+	assert.Nil(t, msgs[0].Key)
+
+	_, msgs, _, err = mq.Consume(cfg, &queue.ConsumerConfig{}, "")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("with metadata"), msgs[0].Data)
+	assert.Equal(t, []byte("k1"), msgs[0].Key)
+	assert.Equal(t, map[string]string{"trace_id": "t1"}, msgs[0].Headers)
+
+	require.NoError(t, mq.PushMessage(cfg.ID, req))
+	data, _ := mq.Pop(cfg.ID, 0)
+	assert.Equal(t, []byte("with metadata"), data)
+}
+
+func TestMemoryQueueConsumerGroups(t *testing.T) {
+	mq := &MemoryQueue{Capacity: 16}
+	cfg := &queue.QueueConfig{ID: "groups"}
+	producer, err := mq.AcquireProducer(cfg)
+	require.NoError(t, err)
+	reqs := []queue.ProduceRequest{}
+	for _, v := range []string{"a", "b", "c", "d", "e"} {
+		reqs = append(reqs, queue.ProduceRequest{Topic: cfg.ID, Data: []byte(v)})
+	}
+	res, err := producer.Produce(&reqs)
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffset(0, 4), (*res)[4].Offset)
+	assert.Equal(t, queue.NewOffset(0, 5), mq.LatestOffset(cfg))
+
+	c1 := &queue.ConsumerConfig{Group: "g1", Name: "c", FetchMaxMessages: 3}
+	c2 := &queue.ConsumerConfig{Group: "g2", Name: "c", FetchMaxMessages: 10}
+
+	consumer, err := mq.AcquireConsumer(cfg, c1)
+	require.NoError(t, err)
+	ctx := &queue.Context{}
+	msgs, timeout, err := consumer.FetchMessages(ctx, 3)
+	require.NoError(t, err)
+	assert.False(t, timeout)
+	require.Len(t, msgs, 3)
+	assert.Equal(t, []byte("a"), msgs[0].Data)
+	assert.Equal(t, queue.NewOffset(0, 3), ctx.NextOffset)
+	require.NoError(t, consumer.CommitOffset(ctx.NextOffset))
+
+	//every group has its own offset
+	other, err := mq.AcquireConsumer(cfg, c2)
+	require.NoError(t, err)
+	msgs, _, err = other.FetchMessages(&queue.Context{}, 10)
+	require.NoError(t, err)
+	assert.Len(t, msgs, 5)
+
+	//a new consumer continues from the committed offset
+	consumer, err = mq.AcquireConsumer(cfg, c1)
+	require.NoError(t, err)
+	msgs, _, err = consumer.FetchMessages(ctx, 3)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, []byte("d"), msgs[0].Data)
+
+	msgs, timeout, err = consumer.FetchMessages(ctx, 3)
+	require.NoError(t, err)
+	assert.True(t, timeout)
+	assert.Empty(t, msgs)
+
+	//offsets only move forward, until deleted
+	_, err = mq.CommitOffset(cfg, c1, queue.NewOffset(0, 1))
+	assert.Error(t, err)
+	require.NoError(t, mq.DeleteOffset(cfg, c1))
+	offset, err := mq.GetOffset(cfg, c1)
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffsetWithVersion(0, 0, 1), offset)
+
+	//Pop keeps its own position
+	data, timeout := mq.Pop(cfg.ID, 0)
+	assert.False(t, timeout)
+	assert.Equal(t, []byte("a"), data)
+	assert.Equal(t, int64(4), mq.Depth(cfg.ID))
+}
+
+func TestMemoryQueueBackpressure(t *testing.T) {
+	fullRetryInterval = 10 * time.Millisecond
+	defer func() { fullRetryInterval = time.Second }()
+
+	mq := &MemoryQueue{Capacity: 4}
+	cfg := &queue.QueueConfig{ID: "backpressure"}
+	for i := 0; i < 4; i++ {
+		require.NoError(t, mq.Push(cfg.ID, []byte{byte('0' + i)}))
+	}
+	//nothing is consumed yet, nothing may be evicted
+	assert.Equal(t, capacityFull, mq.Push(cfg.ID, []byte("4")))
+	assert.Equal(t, int64(4), mq.Depth(cfg.ID))
+
+	//consumed messages make room
+	data, _ := mq.Pop(cfg.ID, 0)
+	assert.Equal(t, []byte("0"), data)
+	require.NoError(t, mq.Push(cfg.ID, []byte("4")))
+	assert.Equal(t, uint64(4), mq.GetStorageSize(cfg.ID))
+
+	//a blocked push continues once a message is consumed
+	done := make(chan error)
+	fullRetryInterval = time.Second
+	go func() { done <- mq.Push(cfg.ID, []byte("5")) }()
+	time.Sleep(20 * time.Millisecond)
+	mq.Pop(cfg.ID, 0)
+	require.NoError(t, <-done)
+
+	//a consumer group keeps the messages until it commits them
+	fullRetryInterval = 10 * time.Millisecond
+	group := &queue.ConsumerConfig{Group: "g", Name: "c"}
+	consumer, err := mq.AcquireConsumer(cfg, group)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		mq.Pop(cfg.ID, 0)
+	}
+	assert.Equal(t, capacityFull, mq.Push(cfg.ID, []byte("6")))
+
+	ctx := &queue.Context{}
+	msgs, _, err := consumer.FetchMessages(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, msgs, 4)
+	assert.Equal(t, []byte("2"), msgs[0].Data)
+	assert.Equal(t, capacityFull, mq.Push(cfg.ID, []byte("6")))
+	require.NoError(t, consumer.CommitOffset(ctx.NextOffset))
+	require.NoError(t, mq.Push(cfg.ID, []byte("6")))
+}
+
+func TestMemoryQueueTotalMemorySize(t *testing.T) {
+	fullRetryInterval = 10 * time.Millisecond
+	defer func() { fullRetryInterval = time.Second }()
+
+	mq := &MemoryQueue{Capacity: 100, MemorySize: 10}
+	require.NoError(t, mq.Push("q1", []byte("12345")))
+	require.NoError(t, mq.Push("q2", []byte("1234")))
+	//the budget is shared by all queues
+	assert.Equal(t, capacityFull, mq.Push("q2", []byte("12")))
+
+	mq.Pop("q1", 0)
+	assert.Equal(t, capacityFull, mq.Push("q2", []byte("12")), "consumed messages of other queues are not evicted")
+	require.NoError(t, mq.Push("q1", []byte("123456")))
+	assert.Equal(t, uint64(6), mq.GetStorageSize("q1"))
+
+	require.NoError(t, mq.Destroy("q1"))
+	require.NoError(t, mq.Push("q2", []byte("12")))
+}
+
+func TestMemoryQueueWait(t *testing.T) {
+	mq := &MemoryQueue{Capacity: 4}
+	cfg := &queue.QueueConfig{ID: "wait"}
+	require.NoError(t, mq.Init(cfg.ID))
+
+	consumer, err := mq.AcquireConsumer(cfg, &queue.ConsumerConfig{Group: "g", Name: "c", FetchMaxWaitMs: 5000})
+	require.NoError(t, err)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		mq.Push(cfg.ID, []byte("late"))
+	}()
+	msgs, timeout, err := consumer.FetchMessages(&queue.Context{}, 1)
+	require.NoError(t, err)
+	assert.False(t, timeout)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, []byte("late"), msgs[0].Data)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		mq.Push(cfg.ID, []byte("popped"))
+	}()
+	data, timeout := mq.Pop(cfg.ID, 5*time.Second)
+	assert.False(t, timeout)
+	assert.Equal(t, []byte("late"), data)
+	data, timeout = mq.Pop(cfg.ID, 5*time.Second)
+	assert.False(t, timeout)
+	assert.Equal(t, []byte("popped"), data)
+
+	_, timeout = mq.Pop(cfg.ID, 10*time.Millisecond)
+	assert.True(t, timeout)
+}
+
+func TestMemoryQueueOffsetForTime(t *testing.T) {
+	mq := &MemoryQueue{Capacity: 4}
+	cfg := &queue.QueueConfig{ID: "offset_for_time"}
+	base := time.Unix(1700000000, 0)
+	for i := 0; i < 6; i++ {
+		_, err := mq.getLog(cfg.ID).append(&queue.Message{Data: []byte{byte(i)}, Size: 1, Timestamp: base.Add(time.Duration(i) * time.Minute).Unix()})
+		require.NoError(t, err)
+		mq.Pop(cfg.ID, 0)
+	}
+
+	offset, err := mq.OffsetForTime(cfg, base.Add(3*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffset(0, 3), offset)
+
+	offset, err = mq.OffsetForTime(cfg, base.Add(150*time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffset(0, 3), offset)
+
+	//consumed messages are evicted when room is needed, start with the
+	//oldest retained
+	offset, err = mq.OffsetForTime(cfg, base)
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffset(0, 2), offset)
+
+	offset, err = mq.OffsetForTime(cfg, base.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, mq.LatestOffset(cfg), offset)
+}
@@ -0,0 +1,68 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI Ltd. All rights reserved.
+ * web: https://infinilabs.com
+ * mail: hello#infini.ltd */
+package mem_queue
+
+import (
+	"time"
+
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/queue"
+)
+
+type Producer struct {
+	mq  *MemoryQueue
+	cfg *queue.QueueConfig
+}
+
+func (p *Producer) Produce(reqs *[]queue.ProduceRequest) (*[]queue.ProduceResponse, error) {
+	results := []queue.ProduceResponse{}
+	for i := range *reqs {
+		req := &(*reqs)[i]
+		topic := req.Topic
+		if topic == "" {
+			topic = p.cfg.ID
+		}
+		if topic != p.cfg.ID {
+			return &results, errors.Errorf("invalid topic: %v vs %v", topic, p.cfg.ID)
+		}
+
+		pos, err := p.mq.pushMessage(topic, req)
+		if err != nil {
+			return &results, err
+		}
+		results = append(results, queue.ProduceResponse{
+			Topic:     topic,
+			Offset:    queue.NewOffset(0, pos),
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	return &results, nil
+}
+
+func (p *Producer) Close() error {
+	return nil
+}
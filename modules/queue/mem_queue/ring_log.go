@@ -0,0 +1,342 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI Ltd. All rights reserved.
+ * web: https://infinilabs.com
+ * mail: hello#infini.ltd */
+
+package mem_queue
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/stats"
+)
+
+// memoryBudget limits the bytes retained by all the ring logs of a memory
+// queue, unlimited if limit is 0.
+type memoryBudget struct {
+	sync.Mutex
+	limit uint64
+	used  uint64
+}
+
+// ringLog keeps the latest messages of a queue in a fixed size ring,
+// addressed by a sequence number starting at 0, which is the position of the
+// offset, the segment is always 0. Consumed messages stay in the ring until
+// their room is needed, a message is consumed once every consumer group
+// committed past it, or once Pop returned it while there are no groups. An
+// append that would evict an unconsumed message fails, as does one that
+// exceeds the memory budget.
+type ringLog struct {
+	sync.Mutex
+	name    string
+	records []*queue.Message
+	first   int64 //offset of the oldest retained message
+	next    int64 //offset of the next appended message
+	bytes   uint64
+	budget  *memoryBudget
+
+	//read position of the destructive Pop
+	popPos int64
+	//committed offsets, by consumer key
+	offsets map[string]queue.Offset
+	//closed and replaced on every append, to wake up waiting readers
+	notify chan struct{}
+	//closed and replaced whenever messages are consumed, to wake up
+	//waiting writers
+	consumed chan struct{}
+}
+
+func newRingLog(name string, capacity uint32, budget *memoryBudget) *ringLog {
+	if capacity == 0 {
+		capacity = 1
+	}
+	if budget == nil {
+		budget = &memoryBudget{}
+	}
+	return &ringLog{
+		name:     name,
+		records:  make([]*queue.Message, capacity),
+		budget:   budget,
+		offsets:  map[string]queue.Offset{},
+		notify:   make(chan struct{}),
+		consumed: make(chan struct{}),
+	}
+}
+
+// consumedPos returns the offset up to which every message is consumed,
+// lock held
+func (l *ringLog) consumedPos() int64 {
+	if len(l.offsets) == 0 {
+		return l.popPos
+	}
+	pos := l.next
+	for _, offset := range l.offsets {
+		if offset.Position < pos {
+			pos = offset.Position
+		}
+	}
+	return pos
+}
+
+// room returns how many of the oldest messages have to be evicted to make
+// room for size more bytes, false if that would evict unconsumed ones, lock
+// and budget lock held
+func (l *ringLog) room(size int) (int64, bool) {
+	capacity := int64(len(l.records))
+	consumed := l.consumedPos()
+	first := l.first
+	var freed uint64
+	for first < l.next && (l.next-first >= capacity || l.budget.limit > 0 && l.budget.used-freed+uint64(size) > l.budget.limit) {
+		if first >= consumed {
+			return 0, false
+		}
+		freed += uint64(l.records[first%capacity].Size)
+		first++
+	}
+	return first - l.first, true
+}
+
+// tryAppend adds msg to the log and returns its offset, evicting consumed
+// messages to make room, it returns false when the log is full.
+func (l *ringLog) tryAppend(msg *queue.Message) (int64, bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.budget.Lock()
+	defer l.budget.Unlock()
+
+	evict, ok := l.room(msg.Size)
+	if !ok {
+		return -1, false
+	}
+	capacity := int64(len(l.records))
+	for ; evict > 0; evict-- {
+		size := uint64(l.records[l.first%capacity].Size)
+		l.bytes -= size
+		l.budget.used -= size
+		l.records[l.first%capacity] = nil
+		l.first++
+		stats.Increment("mem_queue", l.name, "evicted")
+	}
+
+	pos := l.next
+	msg.Offset = queue.NewOffset(0, pos)
+	msg.NextOffset = queue.NewOffset(0, pos+1)
+	l.records[pos%capacity] = msg
+	l.bytes += uint64(msg.Size)
+	l.budget.used += uint64(msg.Size)
+	l.next++
+
+	close(l.notify)
+	l.notify = make(chan struct{})
+	return pos, true
+}
+
+// release gives the bytes of the log back to the budget, when the queue is
+// destroyed.
+func (l *ringLog) release() {
+	l.Lock()
+	defer l.Unlock()
+	l.budget.Lock()
+	defer l.budget.Unlock()
+	l.budget.used -= l.bytes
+	l.bytes = 0
+}
+
+// how long an append waits for consumers when the log is full, per retry
+var fullRetryInterval = time.Second
+
+// append adds msg to the log and returns its offset, retrying for a few
+// seconds while the log is full before it gives up with capacityFull.
+func (l *ringLog) append(msg *queue.Message) (int64, error) {
+	retryTimes := 0
+	for {
+		l.Lock()
+		consumed := l.consumed
+		l.Unlock()
+		if pos, ok := l.tryAppend(msg); ok {
+			return pos, nil
+		}
+		if retryTimes > 3 {
+			stats.Increment("mem_queue", "dead_retry")
+			return -1, capacityFull
+		}
+		retryTimes++
+		log.Debugf("memory_queue [%v] is full, wait %v", l.name, fullRetryInterval)
+		stats.Increment("mem_queue", "retry")
+		select {
+		case <-consumed:
+		case <-time.After(fullRetryInterval):
+		}
+	}
+}
+
+// wakeWriters lets blocked appends retry, lock held
+func (l *ringLog) wakeWriters() {
+	close(l.consumed)
+	l.consumed = make(chan struct{})
+}
+
+// fetch returns up to max messages from pos on, but no more than maxBytes
+// bytes when positive, and the position to continue from. It waits up to
+// timeout for a message when there is none yet. A pos older than the oldest
+// retained message reads from that one.
+func (l *ringLog) fetch(pos int64, max int, maxBytes int, timeout time.Duration) ([]*queue.Message, int64) {
+	var timer *time.Timer
+	for {
+		l.Lock()
+		msgs, next := l.readLocked(pos, max, maxBytes)
+		notify := l.notify
+		l.Unlock()
+		if len(msgs) > 0 || timeout <= 0 {
+			return msgs, next
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			return msgs, next
+		}
+	}
+}
+
+func (l *ringLog) readLocked(pos int64, max int, maxBytes int) ([]*queue.Message, int64) {
+	if pos < l.first {
+		stats.IncrementBy("mem_queue", "skipped", l.first-pos)
+		pos = l.first
+	}
+	capacity := int64(len(l.records))
+	msgs := []*queue.Message{}
+	size := 0
+	for pos < l.next && (max <= 0 || len(msgs) < max) {
+		msg := l.records[pos%capacity]
+		if maxBytes > 0 && len(msgs) > 0 && size+msg.Size > maxBytes {
+			break
+		}
+		msgs = append(msgs, msg)
+		size += msg.Size
+		pos++
+	}
+	return msgs, pos
+}
+
+// pop hands out the next message of the destructive read path, waiting up
+// to timeout for one to be appended.
+func (l *ringLog) pop(timeout time.Duration) *queue.Message {
+	var timer *time.Timer
+	for {
+		l.Lock()
+		msgs, next := l.readLocked(l.popPos, 1, 0)
+		l.popPos = next
+		if len(msgs) > 0 {
+			l.wakeWriters()
+		}
+		notify := l.notify
+		l.Unlock()
+		if len(msgs) > 0 {
+			return msgs[0]
+		}
+
+		if timeout <= 0 {
+			return nil
+		}
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+func (l *ringLog) depth() int64 {
+	l.Lock()
+	defer l.Unlock()
+	if l.popPos < l.first {
+		return l.next - l.first
+	}
+	return l.next - l.popPos
+}
+
+func (l *ringLog) latestOffset() queue.Offset {
+	l.Lock()
+	defer l.Unlock()
+	return queue.NewOffset(0, l.next)
+}
+
+// offsetForTime returns the offset of the first retained message with a
+// timestamp at or after t, the next offset if there is none.
+func (l *ringLog) offsetForTime(t time.Time) queue.Offset {
+	l.Lock()
+	defer l.Unlock()
+	capacity := int64(len(l.records))
+	ts := t.Unix()
+	i := sort.Search(int(l.next-l.first), func(i int) bool {
+		return l.records[(l.first+int64(i))%capacity].Timestamp >= ts
+	})
+	return queue.NewOffset(0, l.first+int64(i))
+}
+
+func (l *ringLog) storageSize() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.bytes
+}
+
+func (l *ringLog) getOffset(consumer string) queue.Offset {
+	l.Lock()
+	defer l.Unlock()
+	return l.offsets[consumer]
+}
+
+func (l *ringLog) setOffset(consumer string, offset queue.Offset) {
+	l.Lock()
+	defer l.Unlock()
+	l.offsets[consumer] = offset
+	l.wakeWriters()
+}
+
+// addConsumer registers the group of consumer, keeping the messages from
+// its offset on until it commits them.
+func (l *ringLog) addConsumer(consumer string) queue.Offset {
+	l.Lock()
+	defer l.Unlock()
+	offset, ok := l.offsets[consumer]
+	if !ok {
+		offset = queue.NewOffset(0, l.first)
+		l.offsets[consumer] = offset
+	}
+	return offset
+}
@@ -0,0 +1,144 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* ©INFINI, All Rights Reserved.
+ * mail: contact#infini.ltd */
+package redis
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/go-redis/redis/v8"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/util"
+)
+
+// Consumer reads a stream through the consumer group of its consumer config.
+type Consumer struct {
+	rq   *RedisQueue
+	qCfg *queue.QueueConfig
+	cCfg *queue.ConsumerConfig
+
+	stream  string
+	group   string
+	version int64 //offset version
+}
+
+func (c *Consumer) Close() error {
+	return nil
+}
+
+// ResetOffset moves the group, so the next fetch starts at the offset.
+func (c *Consumer) ResetOffset(segment, readPos int64) error {
+	if global.Env().IsDebug {
+		log.Debugf("reset %v offset to %v,%v", c.qCfg.ID, segment, readPos)
+	}
+	return c.rq.client.XGroupSetID(ctx, c.stream, c.group, streamIDBefore(queue.NewOffset(segment, readPos))).Err()
+}
+
+func (c *Consumer) FetchMessages(ctx1 *queue.Context, numOfMessages int) (messages []queue.Message, isTimeout bool, err error) {
+	if numOfMessages <= 0 || (c.cCfg.FetchMaxMessages > 0 && numOfMessages > c.cCfg.FetchMaxMessages) {
+		numOfMessages = c.cCfg.FetchMaxMessages
+	}
+	ctx1.MessageCount = 0
+
+	args := &redis.XReadGroupArgs{
+		Group:    c.group,
+		Consumer: c.consumerName(),
+		Streams:  []string{c.stream, ">"},
+		Count:    int64(numOfMessages),
+		Block:    -1,
+	}
+	if c.cCfg.FetchMaxWaitMs > 0 {
+		args.Block = time.Duration(c.cCfg.FetchMaxWaitMs) * time.Millisecond
+	}
+	streams, err := c.rq.client.XReadGroup(ctx, args).Result()
+	if err == redis.Nil {
+		return nil, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			m, err := c.toMessage(msg)
+			if err != nil {
+				return messages, false, err
+			}
+			if len(messages) == 0 {
+				ctx1.InitOffset = m.Offset
+			}
+			ctx1.NextOffset = m.NextOffset
+			messages = append(messages, m)
+		}
+	}
+	ctx1.MessageCount = len(messages)
+	return messages, len(messages) == 0, nil
+}
+
+func (c *Consumer) consumerName() string {
+	if c.cCfg.ID != "" {
+		return c.cCfg.ID
+	}
+	return c.cCfg.Name
+}
+
+func (c *Consumer) toMessage(msg redis.XMessage) (queue.Message, error) {
+	offset, err := parseStreamID(msg.ID)
+	if err != nil {
+		return queue.Message{}, err
+	}
+	offset.Version = c.version
+	next := offset
+	next.Position++
+
+	data := []byte(util.ToString(msg.Values[fieldData]))
+	m := queue.Message{
+		Offset:     offset,
+		NextOffset: next,
+		Data:       data,
+		Size:       len(data),
+		Timestamp:  offset.Segment / 1000,
+	}
+	if v, ok := msg.Values[fieldKey]; ok {
+		m.Key = []byte(util.ToString(v))
+	}
+	for k, v := range msg.Values {
+		if strings.HasPrefix(k, fieldHeader) {
+			if m.Headers == nil {
+				m.Headers = map[string]string{}
+			}
+			m.Headers[strings.TrimPrefix(k, fieldHeader)] = util.ToString(v)
+		}
+	}
+	return m, nil
+}
+
+func (c *Consumer) CommitOffset(offset queue.Offset) error {
+	_, err := c.rq.CommitOffset(c.qCfg, c.cCfg, offset)
+	return err
+}
@@ -0,0 +1,72 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* ©INFINI, All Rights Reserved.
+ * mail: contact#infini.ltd */
+package redis
+
+import (
+	"github.com/go-redis/redis/v8"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/queue"
+)
+
+type Producer struct {
+	rq  *RedisQueue
+	cfg *queue.QueueConfig
+}
+
+// Produce adds the messages to the stream in a single round trip.
+func (p *Producer) Produce(reqs *[]queue.ProduceRequest) (*[]queue.ProduceResponse, error) {
+	results := []queue.ProduceResponse{}
+	pipe := p.rq.client.Pipeline()
+	cmds := make([]*redis.StringCmd, 0, len(*reqs))
+	for i := range *reqs {
+		req := &(*reqs)[i]
+		if req.Topic != "" && req.Topic != p.cfg.ID {
+			return &results, errors.Errorf("invalid topic: %v vs %v", req.Topic, p.cfg.ID)
+		}
+		cmd, _ := p.rq.add(pipe, p.cfg.ID, req)
+		cmds = append(cmds, cmd)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return &results, err
+	}
+
+	for _, cmd := range cmds {
+		offset, err := parseStreamID(cmd.Val())
+		if err != nil {
+			return &results, err
+		}
+		results = append(results, queue.ProduceResponse{
+			Topic:     p.cfg.ID,
+			Offset:    offset,
+			Timestamp: offset.Segment / 1000,
+		})
+	}
+	return &results, nil
+}
+
+func (p *Producer) Close() error {
+	return nil
+}
@@ -29,13 +29,18 @@ package redis
 import (
 	"context"
 	"fmt"
-	"infini.sh/framework/core/global"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	log "github.com/cihub/seelog"
 	"github.com/go-redis/redis/v8"
 	"infini.sh/framework/core/env"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/global"
 	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/util"
 )
 
 type RedisModule struct {
@@ -51,6 +56,18 @@ type RedisConfig struct {
 	Password string `config:"password"`
 	PoolSize int    `config:"pool_size"`
 	Db       int    `config:"db"`
+
+	Queue StreamQueueConfig `config:"queue"`
+}
+
+// StreamQueueConfig enables the `redis` queue type, every queue is a Redis
+// stream.
+type StreamQueueConfig struct {
+	Enabled bool   `config:"enabled"`
+	Default bool   `config:"default"`
+	Prefix  string `config:"prefix"`
+	//trims streams to about this many entries on write, unbounded when 0
+	MaxLen int64 `config:"max_len"`
 }
 
 func (module *RedisModule) Name() string {
@@ -66,76 +83,165 @@ func (module *RedisModule) Setup() {
 	if ok && err != nil && global.Env().SystemConfig.Configs.PanicOnConfigError {
 		panic(err)
 	}
+
+	if !module.config.Enabled {
+		return
+	}
+
+	module.client = redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%v", module.config.Host, module.config.Port),
+		Username: module.config.Username,
+		Password: module.config.Password,
+		PoolSize: module.config.PoolSize,
+		DB:       module.config.Db,
+	})
+
+	if module.config.Queue.Enabled {
+		handler := NewRedisQueue(module.client, &module.config.Queue)
+		queue.Register("redis", handler)
+		if module.config.Queue.Default {
+			queue.RegisterDefaultHandler(handler)
+		}
+	}
 }
 
 var ctx = context.Background()
 
+// RedisQueue stores every queue as a Redis stream. Consumers of the queue api
+// read through a consumer group per consumer, named after the consumer key,
+// and their committed offsets are kept in a hash next to the stream. The
+// offset of a message is its stream id, the millisecond part being the
+// segment and the sequence part the position.
 type RedisQueue struct {
 	client *redis.Client
-	pubsub map[string]int
+	cfg    *StreamQueueConfig
+	queues sync.Map
+	groups sync.Map //stream+group of groups known to exist
 }
 
+func NewRedisQueue(client *redis.Client, cfg *StreamQueueConfig) *RedisQueue {
+	if cfg == nil {
+		cfg = &StreamQueueConfig{}
+	}
+	return &RedisQueue{client: client, cfg: cfg}
+}
+
+const (
+	fieldData     = "data"
+	fieldKey      = "key"
+	fieldHeader   = "header."
+	popGroup      = "pop"
+	popConsumer   = "pop"
+	offsetsSuffix = ":offsets"
+)
+
 func (module *RedisQueue) Name() string {
 	return "redis_queue"
 }
 
-func (module *RedisQueue) Push(k string, v []byte) error {
-	module.Init(k)
-	_, err := module.client.LPush(ctx, k, v).Result()
-	return err
+func (module *RedisQueue) streamKey(k string) string {
+	return module.cfg.Prefix + k
+}
+
+func (module *RedisQueue) offsetsKey(k string) string {
+	return module.cfg.Prefix + k + offsetsSuffix
 }
 
 func (module *RedisQueue) Init(k string) error {
-	_, ok := module.pubsub[k]
-	if ok {
-		return nil
-	}
-	module.pubsub[k] = 1
+	module.queues.Store(k, true)
 	return nil
 }
 
-var lock sync.RWMutex
+func (module *RedisQueue) Push(k string, v []byte) error {
+	_, err := module.add(module.client, k, &queue.ProduceRequest{Data: v})
+	return err
+}
+
+func (module *RedisQueue) add(c redis.Cmdable, k string, req *queue.ProduceRequest) (*redis.StringCmd, error) {
+	module.Init(k)
+	values := []interface{}{fieldData, req.Data}
+	if len(req.Key) > 0 {
+		values = append(values, fieldKey, req.Key)
+	}
+	for name, v := range req.Headers {
+		values = append(values, fieldHeader+name, v)
+	}
+	args := &redis.XAddArgs{Stream: module.streamKey(k), Values: values}
+	if module.cfg.MaxLen > 0 {
+		args.MaxLen = module.cfg.MaxLen
+		args.Approx = true
+	}
+	cmd := c.XAdd(ctx, args)
+	return cmd, cmd.Err()
+}
 
-func (module *RedisQueue) Consume(q *queue.QueueConfig, consumer *queue.ConsumerConfig, offsetStr string) (ctx *queue.Context, messages []queue.Message, timeout bool, err error) {
-	//TODO
-	panic("consume is not supported in redis queue")
+// ensureGroup creates the consumer group on the stream, positioned after
+// start, unless it is already there.
+func (module *RedisQueue) ensureGroup(stream, group, start string) error {
+	if _, ok := module.groups.Load(stream + "/" + group); ok {
+		return nil
+	}
+	err := module.client.XGroupCreateMkStream(ctx, stream, group, start).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	module.groups.Store(stream+"/"+group, true)
+	return nil
 }
 
 func (module *RedisQueue) Pop(k string, timeoutDuration time.Duration) (data []byte, timeout bool) {
+	stream := module.streamKey(k)
+	if err := module.ensureGroup(stream, popGroup, "0"); err != nil {
+		log.Error(err)
+		return nil, true
+	}
 
-	lock.Lock()
-	defer lock.Unlock()
-
+	args := &redis.XReadGroupArgs{Group: popGroup, Consumer: popConsumer, Streams: []string{stream, ">"}, Count: 1, Block: -1}
 	if timeoutDuration > 0 {
-		v, err := module.client.BLPop(ctx, timeoutDuration, k).Result()
-		if err != nil {
-			return nil, true
-		}
-
-		if len(v) == 1 {
-			return []byte(v[0]), false
+		args.Block = timeoutDuration
+	}
+	streams, err := module.client.XReadGroup(ctx, args).Result()
+	if err != nil || len(streams) == 0 || len(streams[0].Messages) == 0 {
+		if err != nil && err != redis.Nil {
+			log.Error(err)
 		}
+		return nil, true
+	}
 
-	} else {
-		v, err := module.client.LPop(ctx, k).Result()
-		if err != nil {
-			return nil, true
-		}
-		return []byte(v), false
+	msg := streams[0].Messages[0]
+	if err := module.client.XAck(ctx, stream, popGroup, msg.ID).Err(); err != nil {
+		log.Error(err)
 	}
-	return nil, true
+	return []byte(util.ToString(msg.Values[fieldData])), false
 }
 
 func (module *RedisQueue) Close(k string) error {
-	return module.client.Subscribe(ctx, k).Close()
+	return nil
 }
 
-func (module *RedisQueue) LatestOffset(string) string {
-	panic("consume is not supported in redis queue")
+func (module *RedisQueue) Destroy(k string) error {
+	module.queues.Delete(k)
+	stream := module.streamKey(k)
+	module.groups.Range(func(key, value interface{}) bool {
+		if strings.HasPrefix(util.ToString(key), stream+"/") {
+			module.groups.Delete(key)
+		}
+		return true
+	})
+	return module.client.Del(ctx, stream, module.offsetsKey(k)).Err()
+}
+
+func (module *RedisQueue) GetStorageSize(k string) uint64 {
+	size, err := module.client.MemoryUsage(ctx, module.streamKey(k)).Result()
+	if err != nil {
+		return 0
+	}
+	return uint64(size)
 }
 
+// Depth is the number of entries retained in the stream.
 func (module *RedisQueue) Depth(k string) int64 {
-	c, err := module.client.LLen(ctx, k).Result()
+	c, err := module.client.XLen(ctx, module.streamKey(k)).Result()
 	if err != nil {
 		return -1
 	}
@@ -144,33 +250,205 @@ func (module *RedisQueue) Depth(k string) int64 {
 
 func (module *RedisQueue) GetQueues() []string {
 	result := []string{}
-	for k, _ := range module.pubsub {
-		result = append(result, k)
-	}
+	module.queues.Range(func(key, value interface{}) bool {
+		result = append(result, util.ToString(key))
+		return true
+	})
 	return result
 }
 
+func (module *RedisQueue) LatestOffset(k *queue.QueueConfig) queue.Offset {
+	msgs, err := module.client.XRevRangeN(ctx, module.streamKey(k.ID), "+", "-", 1).Result()
+	if err != nil {
+		log.Errorf("%v, error on get offset: %v", k.Name, err)
+		panic(err)
+	}
+	if len(msgs) == 0 {
+		return queue.NewOffset(0, 0)
+	}
+	offset, err := parseStreamID(msgs[0].ID)
+	if err != nil {
+		panic(err)
+	}
+	offset.Position++
+	return offset
+}
+
+// OffsetForTime returns the offset of the first entry added at or after t,
+// stream ids start with the millisecond the entry was added.
+func (module *RedisQueue) OffsetForTime(k *queue.QueueConfig, t time.Time) (queue.Offset, error) {
+	start := t.UnixMilli()
+	if start < 0 {
+		start = 0
+	}
+	msgs, err := module.client.XRangeN(ctx, module.streamKey(k.ID), strconv.FormatInt(start, 10), "+", 1).Result()
+	if err != nil {
+		return queue.Offset{}, err
+	}
+	if len(msgs) == 0 {
+		return module.LatestOffset(k), nil
+	}
+	return parseStreamID(msgs[0].ID)
+}
+
+func (module *RedisQueue) GetOffset(k *queue.QueueConfig, consumer *queue.ConsumerConfig) (queue.Offset, error) {
+	v, err := module.client.HGet(ctx, module.offsetsKey(k.ID), consumer.Key()).Result()
+	if err == redis.Nil {
+		return queue.NewOffset(0, 0), nil
+	}
+	if err != nil {
+		return queue.NewOffset(0, 0), err
+	}
+	return queue.DecodeFromString(v), nil
+}
+
+// DeleteOffset resets the offset of the consumer to the start, bumping its
+// version so commits of messages fetched before are rejected.
+func (module *RedisQueue) DeleteOffset(k *queue.QueueConfig, consumer *queue.ConsumerConfig) error {
+	consumer.CommitLocker.Lock()
+	defer consumer.CommitLocker.Unlock()
+
+	offset, err := module.GetOffset(k, consumer)
+	if err != nil {
+		return err
+	}
+	offset = queue.NewOffsetWithVersion(0, 0, offset.Version+1)
+	return module.client.HSet(ctx, module.offsetsKey(k.ID), consumer.Key(), offset.EncodeToString()).Err()
+}
+
+// CommitOffset records the offset and acknowledges the messages before it in
+// the consumer group.
+func (module *RedisQueue) CommitOffset(k *queue.QueueConfig, consumer *queue.ConsumerConfig, offset queue.Offset) (bool, error) {
+	consumer.CommitLocker.Lock()
+	defer consumer.CommitLocker.Unlock()
+
+	current, err := module.GetOffset(k, consumer)
+	if err != nil {
+		return false, err
+	}
+	if current.LatestThan(offset) {
+		return false, errors.Errorf("consumer:%v, current offset(%v) is larger than committed value(%v)", consumer.String(), current.EncodeToString(), offset.EncodeToString())
+	}
+
+	err = module.client.HSet(ctx, module.offsetsKey(k.ID), consumer.Key(), offset.EncodeToString()).Err()
+	if err != nil {
+		return false, err
+	}
+	if global.Env().IsDebug {
+		log.Tracef("commit offset, queue [%v] [%v][%v] commit offset:%v", k.ID, consumer.Group, consumer.Name, offset)
+	}
+	return true, module.ack(module.streamKey(k.ID), consumer.Key(), offset)
+}
+
+// ack acknowledges the pending messages of the group before offset.
+func (module *RedisQueue) ack(stream, group string, offset queue.Offset) error {
+	if offset.Segment == 0 && offset.Position == 0 {
+		return nil
+	}
+	end := streamIDBefore(offset)
+	for {
+		pending, err := module.client.XPendingExt(ctx, &redis.XPendingExtArgs{Stream: stream, Group: group, Start: "-", End: end, Count: 1000}).Result()
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				return nil
+			}
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		ids := make([]string, 0, len(pending))
+		for _, v := range pending {
+			ids = append(ids, v.ID)
+		}
+		if err := module.client.XAck(ctx, stream, group, ids...).Err(); err != nil {
+			return err
+		}
+		if len(pending) < 1000 {
+			return nil
+		}
+	}
+}
+
+func (module *RedisQueue) AcquireConsumer(k *queue.QueueConfig, consumer *queue.ConsumerConfig) (queue.ConsumerAPI, error) {
+	offset, err := module.GetOffset(k, consumer)
+	if err != nil {
+		return nil, err
+	}
+	module.Init(k.ID)
+
+	c := &Consumer{
+		rq:      module,
+		qCfg:    k,
+		cCfg:    consumer,
+		stream:  module.streamKey(k.ID),
+		group:   consumer.Key(),
+		version: offset.Version,
+	}
+	if err := module.ensureGroup(c.stream, c.group, streamIDBefore(offset)); err != nil {
+		return nil, err
+	}
+	return c, c.ResetOffset(offset.Segment, offset.Position)
+}
+
+func (module *RedisQueue) ReleaseConsumer(k *queue.QueueConfig, c *queue.ConsumerConfig, consumer queue.ConsumerAPI) error {
+	if consumer != nil {
+		return consumer.Close()
+	}
+	return nil
+}
+
+func (module *RedisQueue) AcquireProducer(cfg *queue.QueueConfig) (queue.ProducerAPI, error) {
+	if cfg == nil || cfg.ID == "" {
+		panic("queue config is nil")
+	}
+	module.Init(cfg.ID)
+	return &Producer{rq: module, cfg: cfg}, nil
+}
+
+func (module *RedisQueue) ReleaseProducer(k *queue.QueueConfig, producer queue.ProducerAPI) error {
+	return nil
+}
+
+// parseStreamID converts a stream id to an offset.
+func parseStreamID(id string) (queue.Offset, error) {
+	ms, seq, ok := strings.Cut(id, "-")
+	if !ok {
+		return queue.Offset{}, errors.Errorf("invalid stream id: %v", id)
+	}
+	segment, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return queue.Offset{}, errors.Errorf("invalid stream id: %v", id)
+	}
+	position, err := strconv.ParseInt(seq, 10, 64)
+	if err != nil {
+		return queue.Offset{}, errors.Errorf("invalid stream id: %v", id)
+	}
+	return queue.NewOffset(segment, position), nil
+}
+
+// streamIDBefore is the stream id right before offset, so reading after it
+// starts at offset.
+func streamIDBefore(offset queue.Offset) string {
+	if offset.Position > 0 {
+		return fmt.Sprintf("%d-%d", offset.Segment, offset.Position-1)
+	}
+	if offset.Segment > 0 {
+		return fmt.Sprintf("%d-%d", offset.Segment-1, uint64(1<<64-1))
+	}
+	return "0"
+}
+
 func (module *RedisModule) Start() error {
 	if !module.config.Enabled {
 		return nil
 	}
 
-	module.client = redis.NewClient(&redis.Options{
-		Addr:     fmt.Sprintf("%s:%v", module.config.Host, module.config.Port),
-		Username: module.config.Username,
-		Password: module.config.Password,
-		PoolSize: module.config.PoolSize,
-		DB:       module.config.Db,
-	})
-
 	_, err := module.client.Ping(ctx).Result()
 	if err != nil {
 		return err
 	}
 
-	//handler:=&RedisQueue{client: module.client,pubsub: map[string]int{}}
-	//queue.Register("redis",handler)
-
 	return nil
 }
 
@@ -0,0 +1,197 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* ©INFINI, All Rights Reserved.
+ * mail: contact#infini.ltd */
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/queue"
+)
+
+func newTestQueue(t *testing.T, cfg *StreamQueueConfig) *RedisQueue {
+	server := newTestServer(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisQueue(client, cfg)
+}
+
+func TestStreamID(t *testing.T) {
+	offset, err := parseStreamID("1700000000000-3")
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffset(1700000000000, 3), offset)
+	_, err = parseStreamID("3")
+	assert.Error(t, err)
+
+	assert.Equal(t, "0", streamIDBefore(queue.NewOffset(0, 0)))
+	assert.Equal(t, "5-2", streamIDBefore(queue.NewOffset(5, 3)))
+	assert.Equal(t, "4-18446744073709551615", streamIDBefore(queue.NewOffset(5, 0)))
+}
+
+func TestRedisQueueConsumer(t *testing.T) {
+	rq := newTestQueue(t, &StreamQueueConfig{Prefix: "test:"})
+	cfg := &queue.QueueConfig{ID: "orders", Name: "orders"}
+
+	assert.Equal(t, queue.NewOffset(0, 0), rq.LatestOffset(cfg))
+
+	producer, err := rq.AcquireProducer(cfg)
+	require.NoError(t, err)
+	reqs := []queue.ProduceRequest{
+		{Topic: cfg.ID, Data: []byte("a"), Key: []byte("k1"), Headers: map[string]string{"trace_id": "t1"}},
+		{Topic: cfg.ID, Data: []byte("b")},
+		{Topic: cfg.ID, Data: []byte("c")},
+	}
+	res, err := producer.Produce(&reqs)
+	require.NoError(t, err)
+	require.Len(t, *res, 3)
+	last := (*res)[2].Offset
+	latest := rq.LatestOffset(cfg)
+	assert.Equal(t, last.Position+1, latest.Position)
+	assert.Equal(t, int64(3), rq.Depth(cfg.ID))
+
+	c1 := &queue.ConsumerConfig{Group: "g1", Name: "c", FetchMaxMessages: 2}
+	consumer, err := rq.AcquireConsumer(cfg, c1)
+	require.NoError(t, err)
+	ctx1 := &queue.Context{}
+	msgs, timeout, err := consumer.FetchMessages(ctx1, 2)
+	require.NoError(t, err)
+	assert.False(t, timeout)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, []byte("a"), msgs[0].Data)
+	assert.Equal(t, []byte("k1"), msgs[0].Key)
+	assert.Equal(t, map[string]string{"trace_id": "t1"}, msgs[0].Headers)
+	assert.Nil(t, msgs[1].Key)
+	assert.Equal(t, (*res)[0].Offset, msgs[0].Offset)
+	assert.Equal(t, msgs[1].NextOffset, ctx1.NextOffset)
+
+	ok, err := rq.CommitOffset(cfg, c1, ctx1.NextOffset)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	offset, err := rq.GetOffset(cfg, c1)
+	require.NoError(t, err)
+	assert.Equal(t, ctx1.NextOffset, offset)
+
+	//another group reads every message
+	c2 := &queue.ConsumerConfig{Group: "g2", Name: "c", FetchMaxMessages: 10}
+	other, err := rq.AcquireConsumer(cfg, c2)
+	require.NoError(t, err)
+	msgs, _, err = other.FetchMessages(&queue.Context{}, 10)
+	require.NoError(t, err)
+	assert.Len(t, msgs, 3)
+
+	//a new consumer of the group continues from the committed offset
+	consumer, err = rq.AcquireConsumer(cfg, c1)
+	require.NoError(t, err)
+	msgs, _, err = consumer.FetchMessages(ctx1, 2)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, []byte("c"), msgs[0].Data)
+	require.NoError(t, consumer.CommitOffset(ctx1.NextOffset))
+
+	msgs, timeout, err = consumer.FetchMessages(ctx1, 2)
+	require.NoError(t, err)
+	assert.True(t, timeout)
+	assert.Empty(t, msgs)
+
+	//offsets only move forward, until deleted
+	_, err = rq.CommitOffset(cfg, c1, (*res)[0].Offset)
+	assert.Error(t, err)
+	require.NoError(t, rq.DeleteOffset(cfg, c1))
+	offset, err = rq.GetOffset(cfg, c1)
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffsetWithVersion(0, 0, 1), offset)
+
+	consumer, err = rq.AcquireConsumer(cfg, c1)
+	require.NoError(t, err)
+	msgs, _, err = consumer.FetchMessages(ctx1, 10)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2, "capped by fetch_max_messages")
+	assert.Equal(t, []byte("a"), msgs[0].Data)
+	assert.Equal(t, int64(1), msgs[0].Offset.Version)
+}
+
+func TestRedisQueuePushPop(t *testing.T) {
+	rq := newTestQueue(t, &StreamQueueConfig{MaxLen: 2})
+
+	data, timeout := rq.Pop("simple", 0)
+	assert.True(t, timeout)
+	assert.Nil(t, data)
+
+	require.NoError(t, rq.Push("simple", []byte("1")))
+	require.NoError(t, rq.Push("simple", []byte("2")))
+	require.NoError(t, rq.Push("simple", []byte("3")))
+	assert.Equal(t, int64(2), rq.Depth("simple"))
+	assert.Equal(t, []string{"simple"}, rq.GetQueues())
+	assert.True(t, rq.GetStorageSize("simple") > 0)
+
+	data, timeout = rq.Pop("simple", 0)
+	assert.False(t, timeout)
+	assert.Equal(t, []byte("2"), data)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		rq.Push("simple", []byte("4"))
+	}()
+	data, _ = rq.Pop("simple", time.Second)
+	assert.Equal(t, []byte("3"), data)
+	data, timeout = rq.Pop("simple", 5*time.Second)
+	assert.False(t, timeout)
+	assert.Equal(t, []byte("4"), data)
+
+	require.NoError(t, rq.Destroy("simple"))
+	assert.Equal(t, int64(0), rq.Depth("simple"))
+}
+
+func TestRedisQueueOffsetForTime(t *testing.T) {
+	rq := newTestQueue(t, &StreamQueueConfig{})
+	cfg := &queue.QueueConfig{ID: "events", Name: "events"}
+
+	require.NoError(t, rq.Push(cfg.ID, []byte("a")))
+	time.Sleep(5 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	require.NoError(t, rq.Push(cfg.ID, []byte("b")))
+	require.NoError(t, rq.Push(cfg.ID, []byte("c")))
+
+	offset, err := rq.OffsetForTime(cfg, since)
+	require.NoError(t, err)
+	c1 := &queue.ConsumerConfig{Group: "g1", Name: "c", FetchMaxMessages: 10}
+	consumer, err := rq.AcquireConsumer(cfg, c1)
+	require.NoError(t, err)
+	require.NoError(t, consumer.ResetOffset(offset.Segment, offset.Position))
+	msgs, _, err := consumer.FetchMessages(&queue.Context{}, 10)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, []byte("b"), msgs[0].Data)
+	assert.Equal(t, offset, msgs[0].Offset)
+
+	offset, err = rq.OffsetForTime(cfg, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, rq.LatestOffset(cfg), offset)
+}
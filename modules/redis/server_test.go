@@ -0,0 +1,381 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* ©INFINI, All Rights Reserved.
+ * mail: contact#infini.ltd */
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is a local stand-in for Redis, speaking enough RESP to cover
+// the stream, hash and key commands the queue uses.
+type testServer struct {
+	sync.Mutex
+	listener net.Listener
+	streams  map[string]*testStream
+	hashes   map[string]map[string]string
+}
+
+type testEntry struct {
+	ms, seq uint64
+	fields  []string
+}
+
+func (e testEntry) id() string {
+	return fmt.Sprintf("%d-%d", e.ms, e.seq)
+}
+
+type testGroup struct {
+	last    testEntry
+	pending map[string]testEntry
+}
+
+type testStream struct {
+	entries []testEntry
+	last    testEntry
+	groups  map[string]*testGroup
+}
+
+func newTestServer(t *testing.T) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{listener: l, streams: map[string]*testStream{}, hashes: map[string]map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *testServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.exec(w, args)
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func writeBulk(w *bufio.Writer, v string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+}
+
+func writeEntries(w *bufio.Writer, entries []testEntry) {
+	fmt.Fprintf(w, "*%d\r\n", len(entries))
+	for _, e := range entries {
+		w.WriteString("*2\r\n")
+		writeBulk(w, e.id())
+		fmt.Fprintf(w, "*%d\r\n", len(e.fields))
+		for _, f := range e.fields {
+			writeBulk(w, f)
+		}
+	}
+}
+
+func parseID(id string) testEntry {
+	ms, seq, _ := strings.Cut(id, "-")
+	e := testEntry{}
+	e.ms, _ = strconv.ParseUint(ms, 10, 64)
+	e.seq, _ = strconv.ParseUint(seq, 10, 64)
+	return e
+}
+
+func (e testEntry) after(o testEntry) bool {
+	return e.ms > o.ms || e.ms == o.ms && e.seq > o.seq
+}
+
+func (s *testServer) exec(w *bufio.Writer, args []string) {
+	cmd := strings.ToLower(args[0])
+	if cmd == "xreadgroup" {
+		s.xreadgroup(w, args)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	switch cmd {
+	case "ping":
+		w.WriteString("+PONG\r\n")
+	case "xadd":
+		st := s.stream(args[1])
+		i, maxLen := 2, -1
+		if strings.ToLower(args[i]) == "maxlen" {
+			i++
+			if args[i] == "~" || args[i] == "=" {
+				i++
+			}
+			maxLen, _ = strconv.Atoi(args[i])
+			i++
+		}
+		e := testEntry{ms: uint64(time.Now().UnixMilli()), fields: args[i+1:]}
+		if !e.after(st.last) {
+			e.ms, e.seq = st.last.ms, st.last.seq+1
+		}
+		st.last = e
+		st.entries = append(st.entries, e)
+		if maxLen >= 0 && len(st.entries) > maxLen {
+			st.entries = st.entries[len(st.entries)-maxLen:]
+		}
+		writeBulk(w, e.id())
+	case "xlen":
+		fmt.Fprintf(w, ":%d\r\n", len(s.stream(args[1]).entries))
+	case "xrevrange":
+		st := s.stream(args[1])
+		count := len(st.entries)
+		if len(args) > 5 {
+			count, _ = strconv.Atoi(args[5])
+		}
+		out := []testEntry{}
+		for i := len(st.entries) - 1; i >= 0 && len(out) < count; i-- {
+			out = append(out, st.entries[i])
+		}
+		writeEntries(w, out)
+	case "xrange":
+		st := s.stream(args[1])
+		start := parseID(args[2])
+		count := len(st.entries)
+		if len(args) > 5 {
+			count, _ = strconv.Atoi(args[5])
+		}
+		out := []testEntry{}
+		for _, e := range st.entries {
+			if len(out) < count && !start.after(e) {
+				out = append(out, e)
+			}
+		}
+		writeEntries(w, out)
+	case "xgroup":
+		st := s.stream(args[2])
+		switch strings.ToLower(args[1]) {
+		case "create":
+			if _, ok := st.groups[args[3]]; ok {
+				w.WriteString("-BUSYGROUP Consumer Group name already exists\r\n")
+				return
+			}
+			st.groups[args[3]] = &testGroup{last: parseID(args[4]), pending: map[string]testEntry{}}
+		case "setid":
+			g, ok := st.groups[args[3]]
+			if !ok {
+				w.WriteString("-NOGROUP no such group\r\n")
+				return
+			}
+			g.last = parseID(args[4])
+		}
+		w.WriteString("+OK\r\n")
+	case "xack":
+		n := 0
+		if g, ok := s.stream(args[1]).groups[args[2]]; ok {
+			for _, id := range args[3:] {
+				if _, ok := g.pending[id]; ok {
+					delete(g.pending, id)
+					n++
+				}
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", n)
+	case "xpending":
+		g, ok := s.stream(args[1]).groups[args[2]]
+		if !ok {
+			w.WriteString("-NOGROUP no such group\r\n")
+			return
+		}
+		end := testEntry{ms: ^uint64(0), seq: ^uint64(0)}
+		if args[4] != "+" {
+			end = parseID(args[4])
+		}
+		count, _ := strconv.Atoi(args[5])
+		out := []testEntry{}
+		for _, e := range g.pending {
+			if !e.after(end) {
+				out = append(out, e)
+			}
+		}
+		sort.Slice(out, func(i, j int) bool { return out[j].after(out[i]) })
+		if len(out) > count {
+			out = out[:count]
+		}
+		fmt.Fprintf(w, "*%d\r\n", len(out))
+		for _, e := range out {
+			w.WriteString("*4\r\n")
+			writeBulk(w, e.id())
+			writeBulk(w, "c")
+			w.WriteString(":0\r\n:1\r\n")
+		}
+	case "hget":
+		v, ok := s.hashes[args[1]][args[2]]
+		if !ok {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		writeBulk(w, v)
+	case "hset":
+		h, ok := s.hashes[args[1]]
+		if !ok {
+			h = map[string]string{}
+			s.hashes[args[1]] = h
+		}
+		h[args[2]] = args[3]
+		w.WriteString(":1\r\n")
+	case "del":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := s.streams[k]; ok {
+				n++
+			}
+			if _, ok := s.hashes[k]; ok {
+				n++
+			}
+			delete(s.streams, k)
+			delete(s.hashes, k)
+		}
+		fmt.Fprintf(w, ":%d\r\n", n)
+	case "memory":
+		size := 0
+		for _, e := range s.stream(args[2]).entries {
+			for _, f := range e.fields {
+				size += len(f)
+			}
+		}
+		fmt.Fprintf(w, ":%d\r\n", size)
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func (s *testServer) stream(k string) *testStream {
+	st, ok := s.streams[k]
+	if !ok {
+		st = &testStream{groups: map[string]*testGroup{}}
+		s.streams[k] = st
+	}
+	return st
+}
+
+// xreadgroup handles XREADGROUP GROUP g c [COUNT n] [BLOCK ms] STREAMS key >
+func (s *testServer) xreadgroup(w *bufio.Writer, args []string) {
+	group, count, block := args[2], 0, -1
+	var key string
+	for i := 4; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "count":
+			count, _ = strconv.Atoi(args[i+1])
+			i++
+		case "block":
+			block, _ = strconv.Atoi(args[i+1])
+			i++
+		case "streams":
+			key = args[i+1]
+			i = len(args)
+		}
+	}
+
+	deadline := time.Now().Add(time.Duration(block) * time.Millisecond)
+	for {
+		s.Lock()
+		g, ok := s.stream(key).groups[group]
+		if !ok {
+			s.Unlock()
+			w.WriteString("-NOGROUP no such group\r\n")
+			return
+		}
+		out := []testEntry{}
+		for _, e := range s.stream(key).entries {
+			if e.after(g.last) && (count <= 0 || len(out) < count) {
+				out = append(out, e)
+			}
+		}
+		if len(out) > 0 {
+			g.last = out[len(out)-1]
+			for _, e := range out {
+				g.pending[e.id()] = e
+			}
+			s.Unlock()
+			w.WriteString("*1\r\n*2\r\n")
+			writeBulk(w, key)
+			writeEntries(w, out)
+			return
+		}
+		s.Unlock()
+
+		if block < 0 || time.Now().After(deadline) {
+			w.WriteString("*-1\r\n")
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
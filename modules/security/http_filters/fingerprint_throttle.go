@@ -18,12 +18,14 @@ import (
 	log "github.com/cihub/seelog"
 	"infini.sh/framework/core/api"
 	httprouter "infini.sh/framework/core/api/router"
+	"infini.sh/framework/core/kv"
+	"infini.sh/framework/core/util"
 )
 
 func init() {
 	f := &FingerprintThrottleFilter{}
 
-	// Register cleanup task only once
+	// Register cleanup task only once, it only sweeps the in-memory records
 	global.RegisterBackgroundCallback(&global.BackgroundTask{
 		Tag:      "fingerprint_throttle_filter_cleanup",
 		Func:     func() { f.cleanupOldEntries() },
@@ -45,6 +47,12 @@ func (f *FingerprintThrottleFilter) GetPriority() int {
 const FeatureFingerprintThrottle = "fingerprint_throttle"
 const throttleWindow = 100 * time.Millisecond
 
+const fingerprintBucket = "fingerprint_throttle"
+
+// badger ttls have a granularity of one second, the recorded time keeps
+// the window itself exact
+const fingerprintTTL = time.Second
+
 func (f *FingerprintThrottleFilter) ApplyFilter(
 	method string,
 	pattern string,
@@ -70,21 +78,47 @@ func (f *FingerprintThrottleFilter) ApplyFilter(
 			return
 		}
 
-		now := time.Now()
+		if f.throttled(fingerprint, time.Now()) {
+			log.Warnf("duplicate request throttled: %s", fingerprint)
+			http.Error(w, "Too many duplicate requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next(w, r, ps)
+	}
+}
 
+// throttled reports whether the fingerprint was seen within the throttle
+// window, and records it otherwise. The records live in kv when the store
+// expires values on its own, in memory swept by the cleanup task if not, or
+// when no kv store is registered at all. In kv every request costs a read and
+// a write, on simple_kv the write is a fsynced WAL append. The get and the set
+// are not atomic, duplicates arriving between them still get through.
+func (f *FingerprintThrottleFilter) throttled(fingerprint string, now time.Time) bool {
+	if !kv.SupportsTTL(fingerprintBucket) {
 		if tsRaw, exists := f.recent.Load(fingerprint); exists {
 			if ts, ok := tsRaw.(time.Time); ok && now.Sub(ts) < throttleWindow {
-				log.Warnf("duplicate request throttled: %s", fingerprint)
-				http.Error(w, "Too many duplicate requests", http.StatusTooManyRequests)
-				return
+				return true
 			}
 		}
-
-		// Store/Update fingerprint
 		f.recent.Store(fingerprint, now)
+		return false
+	}
 
-		next(w, r, ps)
+	key := []byte(fingerprint)
+	v, err := kv.GetValue(fingerprintBucket, key)
+	if err != nil {
+		log.Warn("could not load fingerprint:", err)
+	} else if len(v) > 0 {
+		if ts, err := util.ToInt64(string(v)); err == nil && now.Sub(time.Unix(0, ts)) < throttleWindow {
+			return true
+		}
+	}
+	err = kv.AddValueWithTTL(fingerprintBucket, key, []byte(util.Int64ToString(now.UnixNano())), fingerprintTTL)
+	if err != nil {
+		log.Warn("could not save fingerprint:", err)
 	}
+	return false
 }
 
 func (f *FingerprintThrottleFilter) computeFingerprint(r *http.Request) (string, error) {
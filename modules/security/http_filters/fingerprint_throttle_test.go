@@ -0,0 +1,65 @@
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package http_filters
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/kv"
+	"infini.sh/framework/core/kv/kvtest"
+)
+
+func recentCount(f *FingerprintThrottleFilter) int {
+	n := 0
+	f.recent.Range(func(key, value any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestFingerprintThrottleInMemory(t *testing.T) {
+	//runs first, before any kv store is registered
+	require.False(t, kv.SupportsTTL(fingerprintBucket))
+	f := &FingerprintThrottleFilter{}
+	now := time.Now()
+	assert.False(t, f.throttled("a", now))
+	assert.True(t, f.throttled("a", now.Add(throttleWindow/2)))
+	assert.False(t, f.throttled("b", now))
+	assert.False(t, f.throttled("a", now.Add(2*throttleWindow)))
+
+	//a store without ttl keeps the records in memory too
+	store := kvtest.UsePlain("fingerprint_throttle_plain")
+	require.False(t, kv.SupportsTTL(fingerprintBucket))
+	f = &FingerprintThrottleFilter{}
+	assert.False(t, f.throttled("a", now))
+	assert.True(t, f.throttled("a", now.Add(throttleWindow/2)))
+	assert.Equal(t, 1, recentCount(f))
+	assert.Equal(t, 0, store.Len())
+}
+
+func TestFingerprintThrottleKV(t *testing.T) {
+	store := kvtest.Use("fingerprint_throttle_test")
+	require.True(t, kv.SupportsTTL(fingerprintBucket))
+	f := &FingerprintThrottleFilter{}
+	now := time.Now()
+	assert.False(t, f.throttled("a", now))
+	assert.True(t, f.throttled("a", now.Add(throttleWindow/2)))
+	assert.False(t, f.throttled("b", now))
+	assert.False(t, f.throttled("a", now.Add(2*throttleWindow)))
+
+	//the records are shared through kv, not kept by the filter
+	assert.Equal(t, 0, recentCount(f))
+	assert.Equal(t, 2, store.Len())
+	assert.True(t, (&FingerprintThrottleFilter{}).throttled("b", now.Add(throttleWindow/2)))
+
+	_, meta, err := kv.GetValueWithMeta(fingerprintBucket, []byte("a"))
+	require.NoError(t, err)
+	require.NotNil(t, meta)
+	assert.False(t, meta.ExpiresAt.IsZero())
+}
@@ -11,6 +11,7 @@ import (
 	"infini.sh/framework/core/api"
 	httprouter "infini.sh/framework/core/api/router"
 	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/errors"
 	"infini.sh/framework/core/global"
 	"infini.sh/framework/core/orm"
 	"infini.sh/framework/core/security"
@@ -33,6 +34,10 @@ func GetRole(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		return
 	}
 
+	if v := obj.GetObjectVersion(); v != nil {
+		api.WriteGetOKJSONWithVersion(w, id, obj, v.SeqNo, v.PrimaryTerm)
+		return
+	}
 	api.WriteGetOKJSON(w, id, obj)
 }
 
@@ -50,6 +55,13 @@ func UpdateRole(w http.ResponseWriter, req *http.Request, ps httprouter.Params)
 
 	api.MustValidateInput(w, obj)
 
+	expected, err := orm.ParseObjectVersion(req)
+	if err != nil {
+		api.WriteError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	obj.SetObjectVersion(expected)
+
 	//bypass managed mode
 	if !global.Env().SystemConfig.WebAppConfig.Security.Managed {
 		sessionUser := security.MustGetUserFromContext(ctx)
@@ -74,7 +86,7 @@ func UpdateRole(w http.ResponseWriter, req *http.Request, ps httprouter.Params)
 	ctx.Refresh = orm.WaitForRefresh
 	err = orm.Save(ctx, &obj)
 	if err != nil {
-		api.WriteError(w, err.Error(), http.StatusInternalServerError)
+		api.WriteError(w, err.Error(), errors.HTTPCode(err))
 		return
 	}
 
@@ -33,6 +33,10 @@ func GetUser(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		return
 	}
 
+	if v := obj.GetObjectVersion(); v != nil {
+		api.WriteGetOKJSONWithVersion(w, id, obj, v.SeqNo, v.PrimaryTerm)
+		return
+	}
 	api.WriteGetOKJSON(w, id, obj)
 }
 
@@ -48,6 +52,13 @@ func UpdateUser(w http.ResponseWriter, req *http.Request, ps httprouter.Params)
 
 	api.MustValidateInput(w, obj)
 
+	//a conflicting update panics with orm.VersionConflictError, answered with 409
+	expected, err := orm.ParseObjectVersion(req)
+	if err != nil {
+		panic(err)
+	}
+	obj.SetObjectVersion(expected)
+
 	oldObj := security.UserAccount{}
 	oldObj.ID = id
 	exists, err := orm.GetV2(ctx, &oldObj)
@@ -0,0 +1,15 @@
+package orm_hooks
+
+import (
+	"infini.sh/framework/core/orm"
+)
+
+func init() {
+	// Change feed: hand every local write to orm.Watch subscribers. Runs
+	// after the auto-audit hook, so only writes that went through all the
+	// business hooks are announced.
+	orm.RegisterDataOperationPostHook(10000, func(ctx *orm.Context, op orm.Operation, o interface{}) (*orm.Context, interface{}, error) {
+		orm.PublishChange(ctx, op, o)
+		return ctx, o, nil
+	}, orm.OpCreate, orm.OpUpdate, orm.OpDelete, orm.OpSave)
+}
@@ -19,6 +19,10 @@ type conformModel struct {
 	Stream   string `json:"stream,omitempty" elastic_mapping:"stream: { type: keyword }"`
 	Severity string `json:"severity,omitempty" elastic_mapping:"severity: { type: keyword }"`
 	N        int    `json:"n,omitempty" elastic_mapping:"n: { type: integer }"`
+	Labels   []struct {
+		Key   string `json:"key,omitempty" elastic_mapping:"key: { type: keyword }"`
+		Value string `json:"value,omitempty" elastic_mapping:"value: { type: keyword }"`
+	} `json:"labels,omitempty" elastic_mapping:"labels: { type: nested }"`
 }
 
 // sqliteAggstestBackend adapts SQLiteORM to the conformance suite.
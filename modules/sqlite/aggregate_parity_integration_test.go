@@ -40,6 +40,13 @@ func (e *elasticAggstestBackend) Setup(t *testing.T, docs []aggstest.Doc) (*orm.
 				"stream":   map[string]interface{}{"type": "keyword"},
 				"severity": map[string]interface{}{"type": "keyword"},
 				"n":        map[string]interface{}{"type": "integer"},
+				"labels": map[string]interface{}{
+					"type": "nested",
+					"properties": map[string]interface{}{
+						"key":   map[string]interface{}{"type": "keyword"},
+						"value": map[string]interface{}{"type": "keyword"},
+					},
+				},
 			},
 		},
 	}); err != nil {
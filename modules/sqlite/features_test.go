@@ -153,6 +153,65 @@ func TestUnsupportedOperators_WarnAndDegrade(t *testing.T) {
 	}
 }
 
+func TestNestedQuery_ElementsObjectsAndDeepPaths(t *testing.T) {
+	type grant struct {
+		Action string `json:"action"`
+	}
+	type perm struct {
+		Role   string  `json:"role"`
+		Grants []grant `json:"grants,omitempty"`
+	}
+	type nestedDoc struct {
+		orm.ORMObjectBase
+		Owner string      `json:"owner,omitempty" elastic_mapping:"owner: { type: keyword }"`
+		Perms interface{} `json:"perms,omitempty" elastic_mapping:"perms: { type: nested }"`
+	}
+	handler := &SQLiteORM{Config: SQLiteConfig{Enabled: true, DBPath: filepath.Join(t.TempDir(), "nested.db")}}
+	require.NoError(t, handler.Open())
+	defer handler.Close()
+	require.NoError(t, handler.RegisterSchemaWithName(nestedDoc{}, "nested_docs"))
+
+	for _, d := range []nestedDoc{
+		{Owner: "alice", Perms: []perm{{Role: "admin", Grants: []grant{{"read"}}}, {Role: "viewer", Grants: []grant{{"write"}}}}},
+		{Owner: "bob", Perms: []perm{{Role: "admin", Grants: []grant{{"read"}, {"write"}}}}},
+		{Owner: "carol", Perms: perm{Role: "admin", Grants: []grant{{"write"}}}}, // a single object
+		{Owner: "dave", Perms: "admin"}, // not an object, never matches
+	} {
+		d.ID = d.Owner
+		require.NoError(t, handler.Save(nil, &d))
+	}
+
+	ctx := orm.NewContext()
+	orm.WithModel(ctx, &nestedDoc{})
+	search := func(qb *orm.QueryBuilder) []string {
+		res, err := handler.SearchV2(ctx, qb.SortBy(orm.Sort{Field: "id", SortType: orm.ASC}))
+		require.NoError(t, err)
+		items, _, err := decodeLocal[nestedDoc](res)
+		require.NoError(t, err)
+		var ids []string
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+
+	// admin that may write: alice's write is on her viewer entry
+	adminWrites := orm.NestedQuery("perms", orm.MustQuery(
+		orm.TermQuery("perms.role", "admin"),
+		orm.NestedQuery("perms.grants", orm.TermQuery("perms.grants.action", "write")),
+	))
+	assert.Equal(t, []string{"bob", "carol"}, search(orm.NewQuery().Filter(adminWrites)))
+
+	// document fields inside the nested query read the document
+	assert.Equal(t, []string{"carol"}, search(orm.NewQuery().Filter(orm.NestedQuery("perms", orm.MustQuery(
+		orm.TermQuery("perms.role", "admin"),
+		orm.TermQuery("owner", "carol"),
+	)))))
+
+	assert.Equal(t, []string{"alice", "bob", "carol"}, search(orm.NewQuery().Filter(
+		orm.NestedQuery("perms", orm.TermQuery("perms.role", "admin")))))
+}
+
 func TestCompositeIndex(t *testing.T) {
 	type compositeModel struct {
 		orm.ORMObjectBase
@@ -6,12 +6,14 @@ import (
 	"database/sql"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 
 	log "github.com/cihub/seelog"
 
 	"infini.sh/framework/core/global"
+	api "infini.sh/framework/core/orm"
 	sqliteOrm "infini.sh/framework/modules/sqlite/orm"
 )
 
@@ -51,7 +53,8 @@ var flattenedTypeAffinity = map[string]string{
 // fieldInfo is one mapped leaf found on the model struct.
 type fieldInfo struct {
 	Path   string // dotted JSON path, e.g. "basic_auth.username"
-	ESType string // keyword/date/long/integer/boolean/double/float/text
+	ESType string // keyword/date/long/integer/boolean/double/float/text/dense_vector
+	Tag    string // elastic_mapping fragment, for dense_vector options
 }
 
 // columnInfo describes one promoted generated column.
@@ -68,16 +71,26 @@ type ftsInfo struct {
 	Expr   string // SQL expression of the backing generated column
 }
 
+// vectorInfo describes one dense_vector field, stored as a float32 blob
+// in a generated column.
+type vectorInfo struct {
+	Path       string // dotted JSON path (also the quoted column name)
+	Similarity string // mapping similarity, cosine when unset
+	Dims       int    // mapping dims, 0 when unset
+}
+
 // tableSchema is the flattened layout derived from a registered model.
 type tableSchema struct {
 	Name      string
 	Columns   []columnInfo // scalar leaves promoted to generated columns
 	FTSFields []ftsInfo    // text leaves synced into the FTS table
+	Vectors   []vectorInfo // dense_vector leaves, searched by brute force
 	Composite [][]string   // composite index column lists (sqlite_composite tag)
 
 	// lookup maps JSON path → column expression / FTS info for the resolver.
 	columnByPath map[string]string
 	ftsByPath    map[string]ftsInfo
+	vectorByPath map[string]vectorInfo
 	// dateEpochByPath maps date-mapped paths to their integer-epoch shadow
 	// column expression — histogram bucketing does integer arithmetic on it
 	// instead of parsing the RFC3339 text per row.
@@ -106,6 +119,27 @@ func (s *tableSchema) resolver() sqliteOrm.FieldResolver {
 	}
 }
 
+// vectorResolver returns the vector column of a dense_vector path.
+func (s *tableSchema) vectorResolver() sqliteOrm.VectorResolver {
+	return func(path string) *sqliteOrm.VectorPlan {
+		if s == nil {
+			return nil
+		}
+		v, ok := s.vectorByPath[path]
+		if !ok {
+			return nil
+		}
+		return &sqliteOrm.VectorPlan{Table: s.Name, Column: quoteIdent(v.Path), Similarity: v.Similarity, Dims: v.Dims}
+	}
+}
+
+// buildSearchWhere translates qb for a search on table, semantic and hybrid
+// clauses run against its vector columns and FTS index.
+func buildSearchWhere(table string, qb *api.QueryBuilder) (string, []interface{}, *sqliteOrm.Ranking) {
+	s := lookupTableSchema(table)
+	return sqliteOrm.BuildRankedWhereClause(qb, table, s.resolver(), s.vectorResolver())
+}
+
 func jsonExtractExpr(path string) string {
 	return fmt.Sprintf("json_extract(raw, '$.%s')", path)
 }
@@ -133,19 +167,19 @@ func lookupTableSchema(table string) *tableSchema {
 // Mirrors the promotion rules: scalar leaves become generated columns,
 // text leaves also join the FTS table. Slices/maps are not recursed
 // (json_extract cannot address array elements via dotted paths).
-func collectFields(model interface{}) (scalars, texts []fieldInfo, composites [][]string) {
+func collectFields(model interface{}) (scalars, texts, vectors []fieldInfo, composites [][]string) {
 	t := reflect.TypeOf(model)
 	for t != nil && t.Kind() == reflect.Ptr {
 		t = t.Elem()
 	}
 	if t == nil || t.Kind() != reflect.Struct {
-		return nil, nil, nil
+		return nil, nil, nil, nil
 	}
-	walkFields(t, "", &scalars, &texts, &composites)
-	return scalars, texts, composites
+	walkFields(t, "", &scalars, &texts, &vectors, &composites)
+	return scalars, texts, vectors, composites
 }
 
-func walkFields(t reflect.Type, prefix string, scalars, texts *[]fieldInfo, composites *[][]string) {
+func walkFields(t reflect.Type, prefix string, scalars, texts, vectors *[]fieldInfo, composites *[][]string) {
 	for i := 0; i < t.NumField(); i++ {
 		field := t.Field(i)
 		tag := strings.TrimSpace(field.Tag.Get("elastic_mapping"))
@@ -172,7 +206,7 @@ func walkFields(t reflect.Type, prefix string, scalars, texts *[]fieldInfo, comp
 		// fields (e.g. orm.ORMObjectBase) — recurse at the same path.
 		if field.Anonymous && tag == "" {
 			if ft := objectStructType(field.Type); ft != nil {
-				walkFields(ft, prefix, scalars, texts, composites)
+				walkFields(ft, prefix, scalars, texts, vectors, composites)
 			}
 			continue
 		}
@@ -194,67 +228,99 @@ func walkFields(t reflect.Type, prefix string, scalars, texts *[]fieldInfo, comp
 				*scalars = append(*scalars, fieldInfo{Path: path, ESType: esType})
 			} else if esType == "text" {
 				*texts = append(*texts, fieldInfo{Path: path, ESType: esType})
+			} else if esType == "dense_vector" {
+				*vectors = append(*vectors, fieldInfo{Path: path, ESType: esType, Tag: tag})
 			}
 		}
 
 		if ft := objectStructType(field.Type); ft != nil {
-			walkFields(ft, path, scalars, texts, composites)
+			walkFields(ft, path, scalars, texts, vectors, composites)
 		}
 	}
 }
 
 // buildTableSchema derives the flattened layout for a model.
 func buildTableSchema(tableName string, model interface{}) *tableSchema {
-	scalars, texts, composites := collectFields(model)
+	scalars, texts, vectors, composites := collectFields(model)
 	s := &tableSchema{
 		Name:            tableName,
 		Columns:         make([]columnInfo, 0, len(scalars)),
 		FTSFields:       make([]ftsInfo, 0, len(texts)),
+		Vectors:         make([]vectorInfo, 0, len(vectors)),
 		Composite:       composites,
 		columnByPath:    map[string]string{},
 		ftsByPath:       map[string]ftsInfo{},
+		vectorByPath:    map[string]vectorInfo{},
 		dateEpochByPath: map[string]string{},
 	}
 	for _, f := range scalars {
-		// "id" is the table's primary key and "raw" the document column —
-		// promoting either would collide with the real column.
-		if f.Path == "id" || f.Path == "raw" {
-			continue
-		}
-		col := columnInfo{
-			Path:     f.Path,
-			Affinity: flattenedTypeAffinity[f.ESType],
-			Expr:     quoteIdent(f.Path),
-		}
-		s.Columns = append(s.Columns, col)
-		s.columnByPath[f.Path] = col.Expr
-		// Date fields get an integer-epoch shadow for bucketing math.
-		if f.ESType == "date" {
-			epochPath := dateEpochColumn(f.Path)
-			s.Columns = append(s.Columns, columnInfo{
-				Path:     epochPath,
-				Affinity: "INTEGER",
-				Expr:     quoteIdent(epochPath),
-			})
-			s.dateEpochByPath[f.Path] = quoteIdent(epochPath)
-		}
+		s.addScalar(f)
 	}
 	// The PK column serves id-path queries directly.
 	s.columnByPath["id"] = quoteIdent("id")
-	// Text fields are materialized as generated columns too — the FTS
-	// triggers read them (verified: triggers may reference VIRTUAL columns).
 	for _, f := range texts {
-		fts := ftsInfo{
-			Path:   f.Path,
-			Column: sanitizeForIndexName(f.Path),
-			Expr:   quoteIdent(f.Path),
-		}
-		s.FTSFields = append(s.FTSFields, fts)
-		s.ftsByPath[f.Path] = fts
+		s.addText(f)
+	}
+	for _, f := range vectors {
+		v := vectorInfo{Path: f.Path, Similarity: mappingOption(f.Tag, "similarity")}
+		v.Dims, _ = strconv.Atoi(mappingOption(f.Tag, "dims"))
+		s.addVector(v)
 	}
 	return s
 }
 
+// hasField reports whether path has a column of its own.
+func (s *tableSchema) hasField(path string) bool {
+	_, scalar := s.columnByPath[path]
+	_, text := s.ftsByPath[path]
+	_, vector := s.vectorByPath[path]
+	return scalar || text || vector
+}
+
+// addScalar promotes a scalar leaf to a generated column.
+func (s *tableSchema) addScalar(f fieldInfo) {
+	// "id" is the table's primary key and "raw" the document column —
+	// promoting either would collide with the real column.
+	if f.Path == "id" || f.Path == "raw" {
+		return
+	}
+	col := columnInfo{
+		Path:     f.Path,
+		Affinity: flattenedTypeAffinity[f.ESType],
+		Expr:     quoteIdent(f.Path),
+	}
+	s.Columns = append(s.Columns, col)
+	s.columnByPath[f.Path] = col.Expr
+	// Date fields get an integer-epoch shadow for bucketing math.
+	if f.ESType == "date" {
+		epochPath := dateEpochColumn(f.Path)
+		s.Columns = append(s.Columns, columnInfo{
+			Path:     epochPath,
+			Affinity: "INTEGER",
+			Expr:     quoteIdent(epochPath),
+		})
+		s.dateEpochByPath[f.Path] = quoteIdent(epochPath)
+	}
+}
+
+// addText materializes a text leaf as a generated column too — the FTS
+// triggers read them (verified: triggers may reference VIRTUAL columns).
+func (s *tableSchema) addText(f fieldInfo) {
+	fts := ftsInfo{
+		Path:   f.Path,
+		Column: sanitizeForIndexName(f.Path),
+		Expr:   quoteIdent(f.Path),
+	}
+	s.FTSFields = append(s.FTSFields, fts)
+	s.ftsByPath[f.Path] = fts
+}
+
+// addVector packs a dense_vector leaf into a blob column.
+func (s *tableSchema) addVector(v vectorInfo) {
+	s.Vectors = append(s.Vectors, v)
+	s.vectorByPath[v.Path] = v
+}
+
 // ensureFlattenedTable creates or migrates the table to the flattened
 // layout: generated columns inline, plain column indexes, FTS sync.
 // Migration is a transactional rebuild when an existing table predates
@@ -306,6 +372,12 @@ func createOrMigrateTable(db *sql.DB, s *tableSchema) (bool, error) {
 		colDefs = append(colDefs, fmt.Sprintf("%s TEXT GENERATED ALWAYS AS (json_extract(raw, '$.%s')) STORED",
 			quoteIdent(f.Path), f.Path))
 	}
+	// Vectors are packed once at write time (vec_f32, see vector.go), the
+	// brute-force scan then reads blobs instead of parsing JSON arrays.
+	for _, v := range s.Vectors {
+		colDefs = append(colDefs, fmt.Sprintf("%s BLOB GENERATED ALWAYS AS (vec_f32(json_extract(raw, '$.%s'))) STORED",
+			quoteIdent(v.Path), v.Path))
+	}
 	colsDDL := ""
 	if len(colDefs) > 0 {
 		colsDDL = ", " + strings.Join(colDefs, ", ")
@@ -316,7 +388,7 @@ func createOrMigrateTable(db *sql.DB, s *tableSchema) (bool, error) {
 		return false, err
 	}
 	if !exists {
-		ddl := fmt.Sprintf("CREATE TABLE [%s] (id TEXT PRIMARY KEY, raw JSON NOT NULL%s)", s.Name, colsDDL)
+		ddl := fmt.Sprintf("CREATE TABLE [%s] (id TEXT PRIMARY KEY, raw JSON NOT NULL, %s INTEGER NOT NULL DEFAULT 0%s)", s.Name, versionColumn, colsDDL)
 		if _, err := db.Exec(ddl); err != nil {
 			return false, fmt.Errorf("failed to create table %s: %w", s.Name, err)
 		}
@@ -331,6 +403,13 @@ func createOrMigrateTable(db *sql.DB, s *tableSchema) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if !have[versionColumn] {
+		// A plain column, unlike the generated ones it can be ALTERed in;
+		// rows written before start at version 0.
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE [%s] ADD COLUMN %s INTEGER NOT NULL DEFAULT 0", s.Name, versionColumn)); err != nil {
+			return false, fmt.Errorf("failed to add version column to %s: %w", s.Name, err)
+		}
+	}
 	missing := false
 	for _, c := range s.Columns {
 		if !have[c.Path] {
@@ -346,13 +425,21 @@ func createOrMigrateTable(db *sql.DB, s *tableSchema) (bool, error) {
 			}
 		}
 	}
+	if !missing {
+		for _, v := range s.Vectors {
+			if !have[v.Path] {
+				missing = true
+				break
+			}
+		}
+	}
 	if !missing {
 		return false, nil
 	}
 
 	// Generated columns cannot be ALTERed in — rebuild the table inside a
 	// transaction: create shadow with the new layout, copy id+raw, swap.
-	log.Infof("sqlite: migrating table %s to flattened layout (%d generated columns)", s.Name, len(s.Columns)+len(s.FTSFields))
+	log.Infof("sqlite: migrating table %s to flattened layout (%d generated columns)", s.Name, len(s.Columns)+len(s.FTSFields)+len(s.Vectors))
 	tx, err := db.Begin()
 	if err != nil {
 		return false, err
@@ -362,11 +449,11 @@ func createOrMigrateTable(db *sql.DB, s *tableSchema) (bool, error) {
 	if _, err := tx.Exec(fmt.Sprintf("DROP TABLE IF EXISTS [%s]", shadow)); err != nil {
 		return false, err
 	}
-	ddl := fmt.Sprintf("CREATE TABLE [%s] (id TEXT PRIMARY KEY, raw JSON NOT NULL%s)", shadow, colsDDL)
+	ddl := fmt.Sprintf("CREATE TABLE [%s] (id TEXT PRIMARY KEY, raw JSON NOT NULL, %s INTEGER NOT NULL DEFAULT 0%s)", shadow, versionColumn, colsDDL)
 	if _, err := tx.Exec(ddl); err != nil {
 		return false, fmt.Errorf("failed to create migration table for %s: %w", s.Name, err)
 	}
-	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO [%s] (id, raw) SELECT id, raw FROM [%s]", shadow, s.Name)); err != nil {
+	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO [%[1]s] (id, raw, %[3]s) SELECT id, raw, %[3]s FROM [%[2]s]", shadow, s.Name, versionColumn)); err != nil {
 		return false, err
 	}
 	if _, err := tx.Exec(fmt.Sprintf("DROP TABLE [%s]", s.Name)); err != nil {
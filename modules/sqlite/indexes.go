@@ -55,6 +55,24 @@ func parseMappingTag(tag string) (jsonField, esType string, ok bool) {
 	jsonField = strings.TrimSpace(tag[:colon])
 	rest := tag[colon+1:]
 
+	esType, ok = mappingValue(rest, "type")
+	return jsonField, esType, ok
+}
+
+// mappingOption returns the value of a top-level option of the field's
+// mapping, e.g. "similarity" of "embedding: { type: dense_vector, similarity: cosine }".
+func mappingOption(tag, key string) string {
+	colon := strings.Index(tag, ":")
+	if colon < 0 {
+		return ""
+	}
+	v, _ := mappingValue(tag[colon+1:], key)
+	return v
+}
+
+// mappingValue finds "key:" directly inside the mapping object (brace
+// depth 1) and returns the token after it.
+func mappingValue(rest, key string) (string, bool) {
 	depth := 0
 	for i := 0; i < len(rest); i++ {
 		switch rest[i] {
@@ -65,27 +83,28 @@ func parseMappingTag(tag string) (jsonField, esType string, ok bool) {
 				depth--
 			}
 		}
-		if depth != 1 || !strings.HasPrefix(rest[i:], "type:") {
+		if depth != 1 || !strings.HasPrefix(rest[i:], key+":") {
 			continue
 		}
 		// Word boundary: "type:" must be a key, not a suffix like "subtype:".
 		if i > 0 && !isMappingSep(rest[i-1]) {
 			continue
 		}
-		after := strings.TrimSpace(rest[i+len("type:"):])
-		// The type token runs until a delimiter (',', '}', or whitespace).
+		after := strings.TrimSpace(rest[i+len(key)+1:])
+		// The value token runs until a delimiter (',', '}', or whitespace).
+		value := ""
 		for j, c := range after {
 			if c == ',' || c == '}' || c == ' ' || c == '\t' {
-				esType = after[:j]
+				value = after[:j]
 				break
 			}
 		}
-		if esType == "" {
-			esType = after
+		if value == "" {
+			value = after
 		}
-		return jsonField, esType, true
+		return value, true
 	}
-	return jsonField, "", false
+	return "", false
 }
 
 // isMappingSep reports whether b can precede a mapping key like "type:".
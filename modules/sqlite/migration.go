@@ -0,0 +1,75 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package sqlite
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/errors"
+	api "infini.sh/framework/core/orm"
+	"infini.sh/framework/core/util"
+)
+
+// AddField brings the table of model in line with its current
+// elastic_mapping tags plus field, which becomes a generated column (an FTS
+// column for text, a vector column for dense_vector) filled from the stored
+// documents. The tag of field wins over mapping when the struct has one,
+// without a tag the column is only used until the schema is registered
+// again, later queries go through json_extract.
+func (handler *SQLiteORM) AddField(ctx *api.Context, model interface{}, field string, mapping util.MapStr) error {
+	esType, _ := mapping["type"].(string)
+	if field == "" || esType == "" {
+		return errors.Errorf("field and mapping type are required, got [%v] and %v", field, mapping)
+	}
+
+	tableName := handler.GetIndexName(model)
+	schema := buildTableSchema(tableName, model)
+	if !schema.hasField(field) {
+		log.Warnf("sqlite: field %v of %v has no elastic_mapping tag, add one to keep its column after a restart", field, tableName)
+		switch {
+		case flattenedTypeAffinity[esType] != "":
+			schema.addScalar(fieldInfo{Path: field, ESType: esType})
+		case esType == "text":
+			schema.addText(fieldInfo{Path: field, ESType: esType})
+		case esType == "dense_vector":
+			v := vectorInfo{Path: field}
+			v.Similarity, _ = mapping["similarity"].(string)
+			if dims, ok := mapping["dims"]; ok {
+				v.Dims, _ = strconv.Atoi(fmt.Sprint(dims))
+			}
+			schema.addVector(v)
+		default:
+			log.Warnf("sqlite: field %v of %v is mapped as %v, which has no column, it is queried through json_extract", field, tableName, esType)
+		}
+	}
+
+	if err := ensureFlattenedTable(handler.DB, schema); err != nil {
+		return err
+	}
+	registerTableSchema(schema)
+	return nil
+}
+
+// Reindex rebuilds the FTS index of model from scratch and refreshes the
+// planner statistics. Generated columns are STORED and computed on write,
+// they never need rebuilding.
+func (handler *SQLiteORM) Reindex(ctx *api.Context, model interface{}) error {
+	tableName := handler.GetIndexName(model)
+	schema := buildTableSchema(tableName, model)
+	if len(schema.FTSFields) > 0 {
+		if _, err := handler.DB.Exec(fmt.Sprintf("DROP TABLE IF EXISTS [%s]", ftsTableName(tableName))); err != nil {
+			return err
+		}
+	}
+	if err := ensureFlattenedTable(handler.DB, schema); err != nil {
+		return err
+	}
+	registerTableSchema(schema)
+
+	if _, err := handler.DB.Exec("ANALYZE"); err != nil {
+		log.Warnf("sqlite ANALYZE after reindexing %s: %v", tableName, err)
+	}
+	return nil
+}
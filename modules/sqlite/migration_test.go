@@ -0,0 +1,197 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package sqlite
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/orm"
+	"infini.sh/framework/core/util"
+)
+
+type migratedItem struct {
+	orm.ORMObjectBase
+	Name string `json:"name,omitempty" elastic_mapping:"name: { type: keyword }"`
+	Slug string `json:"slug,omitempty" elastic_mapping:"slug: { type: keyword }"`
+}
+
+func TestSQLiteORM_Migrate(t *testing.T) {
+	handler, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// the table as it was before slug was added to the struct
+	_, err := handler.DB.Exec(`CREATE TABLE migrated_items (id TEXT PRIMARY KEY, raw JSON NOT NULL)`)
+	require.NoError(t, err)
+	now := time.Now()
+	for _, id := range []string{"m1", "m2", "m3"} {
+		raw := util.MustToJSON(migratedItem{ORMObjectBase: orm.ORMObjectBase{ID: id, Created: &now, Updated: &now}, Name: "Name " + id})
+		_, err := handler.DB.Exec("INSERT INTO migrated_items (id, raw) VALUES (?, ?)", id, raw)
+		require.NoError(t, err)
+	}
+	initTableName(migratedItem{}, "migrated_items")
+	orm.MustRegisterSchemaWithIndexName(migratedItem{}, "migrated_items")
+
+	orm.RegisterMigration("migrated_items", orm.Migration{
+		Version: 1,
+		Name:    "add slug",
+		Steps: []orm.MigrationStep{
+			orm.AddField("slug", util.MapStr{"type": "keyword"}),
+			orm.Backfill(func(o interface{}) (bool, error) {
+				item := o.(*migratedItem)
+				if item.Slug != "" {
+					return false, nil
+				}
+				item.Slug = strings.ReplaceAll(strings.ToLower(item.Name), " ", "-")
+				return true, nil
+			}),
+			orm.Reindex(),
+		},
+	})
+	opts := &orm.MigrateOptions{Schemas: []string{"migrated_items"}, BatchSize: 2}
+
+	opts.DryRun = true
+	results, err := orm.Migrate(handler, opts)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, []string{"add_field slug", "backfill", "reindex"}, results[0].Steps)
+	assert.Equal(t, int64(3), results[0].Changed)
+	assert.False(t, results[0].Applied)
+	cols, err := tableColumns(handler.DB, "migrated_items")
+	require.NoError(t, err)
+	assert.False(t, cols["slug"], "dry run must not touch the table")
+
+	opts.DryRun = false
+	results, err = orm.Migrate(handler, opts)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.True(t, results[0].Applied)
+	assert.Equal(t, int64(3), results[0].Changed)
+
+	cols, err = tableColumns(handler.DB, "migrated_items")
+	require.NoError(t, err)
+	assert.True(t, cols["slug"])
+
+	ctx := orm.NewContext()
+	orm.WithModel(ctx, &migratedItem{})
+	result, err := handler.SearchV2(ctx, orm.NewQuery().Filter(orm.TermQuery("slug", "name-m2")))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"m2"}, requireSearchResultIDs(t, result))
+
+	item := &migratedItem{ORMObjectBase: orm.ORMObjectBase{ID: "m1"}}
+	_, err = handler.Get(nil, item)
+	require.NoError(t, err)
+	assert.True(t, now.Equal(*item.Updated), "backfill keeps the timestamps")
+
+	results, err = orm.Migrate(handler, opts)
+	require.NoError(t, err)
+	assert.Empty(t, results, "applied migrations are recorded")
+}
+
+type resumedItem struct {
+	orm.ORMObjectBase
+	Name     string `json:"name,omitempty" elastic_mapping:"name: { type: keyword }"`
+	Nickname string `json:"nickname,omitempty"`
+}
+
+func TestSQLiteORM_MigrateResumesAndRunsHooks(t *testing.T) {
+	handler, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	initTableName(resumedItem{}, "resumed_items")
+	orm.MustRegisterSchemaWithIndexName(resumedItem{}, "resumed_items")
+	require.NoError(t, handler.RegisterSchemaWithName(resumedItem{}, "resumed_items"))
+	for _, id := range []string{"r1", "r2"} {
+		require.NoError(t, handler.Save(nil, &resumedItem{ORMObjectBase: orm.ORMObjectBase{ID: id}, Name: "name-" + id}))
+	}
+
+	hooked := 0
+	orm.RegisterDataOperationPreHook(100, func(ctx *orm.Context, op orm.Operation, o interface{}) (*orm.Context, interface{}, error) {
+		if _, ok := o.(*resumedItem); ok {
+			hooked++
+		}
+		return ctx, o, nil
+	}, orm.OpSave)
+
+	firstRuns, failures := 0, 1
+	orm.RegisterMigration("resumed_items", orm.Migration{
+		Version: 1,
+		Name:    "nickname",
+		Steps: []orm.MigrationStep{
+			orm.Backfill(func(o interface{}) (bool, error) {
+				firstRuns++
+				return false, nil
+			}),
+			orm.AddField("nickname", util.MapStr{"type": "keyword"}),
+			orm.Backfill(func(o interface{}) (bool, error) {
+				if failures > 0 {
+					failures--
+					return false, errors.New("interrupted")
+				}
+				item := o.(*resumedItem)
+				item.Nickname = strings.TrimPrefix(item.Name, "name-")
+				return true, nil
+			}),
+		},
+	})
+	opts := &orm.MigrateOptions{Schemas: []string{"resumed_items"}}
+
+	_, err := orm.Migrate(struct{ orm.ORM }{handler}, opts)
+	assert.ErrorContains(t, err, "does not support the add_field step")
+	assert.Equal(t, 0, firstRuns)
+
+	results, err := orm.Migrate(handler, opts)
+	assert.ErrorContains(t, err, "interrupted")
+	require.Len(t, results, 1)
+	assert.False(t, results[0].Applied)
+	assert.Equal(t, 2, firstRuns)
+
+	//the applied steps are recorded and not run again
+	results, err = orm.Migrate(handler, opts)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.True(t, results[0].Applied)
+	assert.Equal(t, 2, results[0].SkippedSteps)
+	assert.Equal(t, int64(2), results[0].Changed)
+	assert.Equal(t, 2, firstRuns)
+	assert.Equal(t, 2, hooked, "backfills save through the hooks")
+
+	//the column comes from the mapping, the struct has no tag for it
+	cols, err := tableColumns(handler.DB, "resumed_items")
+	require.NoError(t, err)
+	assert.True(t, cols["nickname"])
+	ctx := orm.NewContext()
+	orm.WithModel(ctx, &resumedItem{})
+	result, err := handler.SearchV2(ctx, orm.NewQuery().Filter(orm.TermQuery("nickname", "r2")))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"r2"}, requireSearchResultIDs(t, result))
+
+	results, err = orm.Migrate(handler, opts)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
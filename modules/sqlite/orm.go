@@ -43,6 +43,14 @@ import (
 
 var ErrNotFound = errors.New("record not found")
 
+// rankScoreExpr is the score of a row in the ranking of a semantic or
+// hybrid clause, 0 for the rows it does not rank (optional clauses).
+const rankScoreExpr = "COALESCE(_rank._score, 0)"
+
+// versionColumn holds the row version used for optimistic concurrency, it
+// is bumped by every write through the ORM.
+const versionColumn = "_version"
+
 // SQLiteORM implements the orm.ORM interface using SQLite as the backend.
 type SQLiteORM struct {
 	Config SQLiteConfig
@@ -126,20 +134,25 @@ func (handler *SQLiteORM) RegisterSchemaWithName(t interface{}, indexName string
 }
 
 func (handler *SQLiteORM) Get(ctx *api.Context, o interface{}) (bool, error) {
+	return handler.get(handler.DB, o)
+}
+
+func (handler *SQLiteORM) get(db dbExecutor, o interface{}) (bool, error) {
 	id := getObjectID(o)
 	if id == "" {
 		return false, errors.Errorf("id was not found in object: %v", o)
 	}
 
 	tableName := handler.GetIndexName(o)
-	query := fmt.Sprintf("SELECT raw FROM [%s] WHERE id = ?", tableName)
+	query := fmt.Sprintf("SELECT raw, %s FROM [%s] WHERE id = ?", versionColumn, tableName)
 
 	if global.Env().IsDebug {
 		log.Debug("sqlite Get: ", query, " id=", id)
 	}
 
 	var rawJSON []byte
-	err := handler.DB.QueryRow(query, id).Scan(&rawJSON)
+	var version int64
+	err := db.QueryRow(query, id).Scan(&rawJSON, &version)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, ErrNotFound
@@ -148,10 +161,15 @@ func (handler *SQLiteORM) Get(ctx *api.Context, o interface{}) (bool, error) {
 	}
 
 	err = util.FromJSONBytes(rawJSON, o)
+	api.SetObjectVersion(o, &api.ObjectVersion{SeqNo: version})
 	return true, err
 }
 
 func (handler *SQLiteORM) Create(ctx *api.Context, o interface{}) error {
+	return handler.create(handler.DB, o)
+}
+
+func (handler *SQLiteORM) create(db dbExecutor, o interface{}) error {
 	id := getObjectID(o)
 	if id == "" {
 		return errors.New("id is required for create")
@@ -160,34 +178,54 @@ func (handler *SQLiteORM) Create(ctx *api.Context, o interface{}) error {
 	tableName := handler.GetIndexName(o)
 	rawJSON := util.MustToJSONBytes(o)
 
-	query := fmt.Sprintf("INSERT INTO [%s] (id, raw) VALUES (?, ?)", tableName)
+	query := fmt.Sprintf("INSERT INTO [%s] (id, raw, %s) VALUES (?, ?, 1)", tableName, versionColumn)
 	if global.Env().IsDebug {
 		log.Debug("sqlite Create: ", query, " id=", id)
 	}
 
-	_, err := handler.DB.Exec(query, id, rawJSON)
+	_, err := db.Exec(query, id, rawJSON)
+	if err == nil {
+		api.SetObjectVersion(o, &api.ObjectVersion{SeqNo: 1})
+	}
 	return err
 }
 
 func (handler *SQLiteORM) Save(ctx *api.Context, o interface{}) error {
+	return handler.save(handler.DB, o)
+}
+
+func (handler *SQLiteORM) save(db dbExecutor, o interface{}) error {
 	id := getObjectID(o)
 	if id == "" {
 		return errors.New("id is required for save")
 	}
 
+	// an expected version means the object must exist, so this is an update
+	if api.GetObjectVersion(o) != nil {
+		return handler.update(db, o)
+	}
+
 	tableName := handler.GetIndexName(o)
 	rawJSON := util.MustToJSONBytes(o)
 
-	query := fmt.Sprintf("INSERT OR REPLACE INTO [%s] (id, raw) VALUES (?, ?)", tableName)
+	query := fmt.Sprintf("INSERT OR REPLACE INTO [%[1]s] (id, raw, %[2]s) VALUES (?, ?, COALESCE((SELECT %[2]s FROM [%[1]s] WHERE id = ?), 0) + 1) RETURNING %[2]s", tableName, versionColumn)
 	if global.Env().IsDebug {
 		log.Debug("sqlite Save: ", query, " id=", id)
 	}
 
-	_, err := handler.DB.Exec(query, id, rawJSON)
+	var version int64
+	err := db.QueryRow(query, id, rawJSON, id).Scan(&version)
+	if err == nil {
+		api.SetObjectVersion(o, &api.ObjectVersion{SeqNo: version})
+	}
 	return err
 }
 
 func (handler *SQLiteORM) Update(ctx *api.Context, o interface{}) error {
+	return handler.update(handler.DB, o)
+}
+
+func (handler *SQLiteORM) update(db dbExecutor, o interface{}) error {
 	id := getObjectID(o)
 	if id == "" {
 		return errors.New("id is required for update")
@@ -196,26 +234,46 @@ func (handler *SQLiteORM) Update(ctx *api.Context, o interface{}) error {
 	tableName := handler.GetIndexName(o)
 	rawJSON := util.MustToJSONBytes(o)
 
-	query := fmt.Sprintf("UPDATE [%s] SET raw = ? WHERE id = ?", tableName)
+	query := fmt.Sprintf("UPDATE [%[1]s] SET raw = ?, %[2]s = %[2]s + 1 WHERE id = ?", tableName, versionColumn)
+	args := []interface{}{rawJSON, id}
+	expected := api.GetObjectVersion(o)
+	if expected != nil {
+		query += fmt.Sprintf(" AND %s = ?", versionColumn)
+		args = append(args, expected.SeqNo)
+	}
+	query += " RETURNING " + versionColumn
 	if global.Env().IsDebug {
 		log.Debug("sqlite Update: ", query, " id=", id)
 	}
 
-	result, err := handler.DB.Exec(query, rawJSON, id)
-	if err != nil {
-		return err
+	var version int64
+	err := db.QueryRow(query, args...).Scan(&version)
+	if err == sql.ErrNoRows {
+		if expected == nil {
+			return ErrNotFound
+		}
+		var exists int
+		err = db.QueryRow(fmt.Sprintf("SELECT 1 FROM [%s] WHERE id = ?", tableName), id).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return api.NewVersionConflictError(id, expected)
 	}
-	affected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
-	if affected == 0 {
-		return ErrNotFound
-	}
+	api.SetObjectVersion(o, &api.ObjectVersion{SeqNo: version})
 	return nil
 }
 
 func (handler *SQLiteORM) Delete(ctx *api.Context, o interface{}) error {
+	return handler.deleteObject(handler.DB, o)
+}
+
+func (handler *SQLiteORM) deleteObject(db dbExecutor, o interface{}) error {
 	id := getObjectID(o)
 	if id == "" {
 		return errors.New("id is required for delete")
@@ -227,7 +285,7 @@ func (handler *SQLiteORM) Delete(ctx *api.Context, o interface{}) error {
 		log.Debug("sqlite Delete: ", query, " id=", id)
 	}
 
-	_, err := handler.DB.Exec(query, id)
+	_, err := db.Exec(query, id)
 	return err
 }
 
@@ -512,7 +570,9 @@ func (handler *SQLiteORM) SearchV2(ctx *api.Context, qb *api.QueryBuilder) (*api
 	schema := lookupTableSchema(indexName)
 	resolver := schema.resolver()
 
-	where, args := sqliteOrm.BuildWhereClause(qb, resolver)
+	// A semantic or hybrid clause ranks the matches, they are joined with
+	// its ranking and sorted by score unless the query sorts otherwise.
+	where, args, rank := buildSearchWhere(indexName, qb)
 
 	// Count total
 	countSQL := fmt.Sprintf("SELECT COUNT(*) FROM [%s]", indexName)
@@ -527,35 +587,90 @@ func (handler *SQLiteORM) SearchV2(ctx *api.Context, qb *api.QueryBuilder) (*api
 	}
 
 	// Build SELECT
-	sqlStr := fmt.Sprintf("SELECT raw FROM [%s]", indexName)
-	if where != "" {
-		sqlStr += " WHERE " + where
+	var sorts []api.Sort
+	var sortExprs []string
+	var cursorValues []interface{}
+	cursor := qb != nil && qb.CursorEnabled()
+	if qb != nil {
+		sorts = qb.Sorts()
+		if cursor {
+			sorts = qb.CursorSorts()
+		}
+		if rank != nil && len(qb.Sorts()) == 0 {
+			sorts = append([]api.Sort{{Field: "_score", SortType: api.DESC}}, sorts...)
+		}
+		// NextCursor carries a value for every sort, the implicit _score too
+		if cursor {
+			if cursorValues, err = qb.SearchAfterValuesFor(sorts); err != nil {
+				return nil, err
+			}
+		}
+		for _, s := range sorts {
+			expr, epochExpr, _ := resolver(s.Field)
+			if epochExpr != "" {
+				// Integer epoch orders identically to the TEXT form and
+				// matches epoch-bearing composite indexes (walk plans).
+				expr = epochExpr
+			}
+			if s.Field == "_score" {
+				expr = "id" // no ranking clause; stable tiebreaker
+				if rank != nil {
+					expr = rankScoreExpr
+				}
+			}
+			sortExprs = append(sortExprs, expr)
+		}
+	}
+
+	sqlStr := "SELECT raw"
+	if rank != nil {
+		sqlStr += ", " + rankScoreExpr
+	}
+	if cursor {
+		// the sort values of the last row make the next cursor
+		sqlStr += ", " + strings.Join(sortExprs, ", ")
+	}
+	sqlStr += fmt.Sprintf(" FROM [%s]", indexName)
+	if rank != nil {
+		sqlStr += fmt.Sprintf(" LEFT JOIN (%s) AS _rank ON _rank._rid = [%s].rowid", rank.SQL, indexName)
+	}
+
+	selectWhere, selectArgs := where, args
+	if len(cursorValues) > 0 {
+		orders := make([]api.SortType, len(sorts))
+		for i, s := range sorts {
+			orders[i] = s.SortType
+		}
+		keyset, keysetArgs := sqliteOrm.BuildKeysetClause(sortExprs, orders, cursorValues)
+		if selectWhere != "" {
+			selectWhere = selectWhere + " AND " + keyset
+		} else {
+			selectWhere = keyset
+		}
+		selectArgs = append(append([]interface{}{}, args...), keysetArgs...)
+	}
+	if rank != nil {
+		selectArgs = append(append([]interface{}{}, rank.Args...), selectArgs...)
+	}
+	if selectWhere != "" {
+		sqlStr += " WHERE " + selectWhere
 	}
 
 	if qb != nil {
-		if sorts := qb.Sorts(); len(sorts) > 0 {
+		if len(sorts) > 0 {
 			var sortParts []string
-			for _, s := range sorts {
-				expr, epochExpr, _ := resolver(s.Field)
-				if epochExpr != "" {
-					// Integer epoch orders identically to the TEXT form and
-					// matches epoch-bearing composite indexes (walk plans).
-					expr = epochExpr
-				}
-				if s.Field == "_score" {
-					expr = "id" // no scoring in sqlite; stable tiebreaker
-				}
-				sortParts = append(sortParts, fmt.Sprintf("%s %s", expr, string(s.SortType)))
+			for i, s := range sorts {
+				sortParts = append(sortParts, fmt.Sprintf("%s %s", sortExprs[i], string(s.SortType)))
 			}
 			sqlStr += " ORDER BY " + strings.Join(sortParts, ", ")
 		}
 
 		// Pagination: OFFSET without LIMIT is invalid SQL — treat an unset
-		// size as "no upper bound" (LIMIT -1).
+		// size as "no upper bound" (LIMIT -1). The cursor replaces OFFSET.
 		if qb.SizeVal() > 0 {
 			sqlStr += fmt.Sprintf(" LIMIT %d", qb.SizeVal())
 		}
-		if qb.FromVal() > 0 {
+		if qb.FromVal() > 0 && !cursor {
 			if qb.SizeVal() <= 0 {
 				sqlStr += " LIMIT -1"
 			}
@@ -564,19 +679,32 @@ func (handler *SQLiteORM) SearchV2(ctx *api.Context, qb *api.QueryBuilder) (*api
 	}
 
 	if global.Env().IsDebug {
-		log.Debug("sqlite SearchV2: ", sqlStr, " args=", args)
+		log.Debug("sqlite SearchV2: ", sqlStr, " args=", selectArgs)
 	}
 
-	rows, err := handler.DB.Query(sqlStr, args...)
+	rows, err := handler.DB.Query(sqlStr, selectArgs...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
 	var docs []map[string]interface{}
+	var scores []float64
+	var lastSortValues []interface{}
 	for rows.Next() {
 		var rawJSON []byte
-		if err := rows.Scan(&rawJSON); err != nil {
+		var score float64
+		dest := []interface{}{&rawJSON}
+		if rank != nil {
+			dest = append(dest, &score)
+		}
+		sortValues := make([]interface{}, len(sortExprs))
+		if cursor {
+			for i := range sortValues {
+				dest = append(dest, &sortValues[i])
+			}
+		}
+		if err := rows.Scan(dest...); err != nil {
 			return nil, err
 		}
 		var doc map[string]interface{}
@@ -584,16 +712,35 @@ func (handler *SQLiteORM) SearchV2(ctx *api.Context, qb *api.QueryBuilder) (*api
 			return nil, err
 		}
 		docs = append(docs, doc)
+		scores = append(scores, score)
+		lastSortValues = sortValues
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// A page shorter than the requested size is the last one.
+	if cursor && len(docs) > 0 && qb.SizeVal() > 0 && len(docs) == qb.SizeVal() {
+		for i, v := range lastSortValues {
+			if b, ok := v.([]byte); ok {
+				lastSortValues[i] = string(b)
+			}
+		}
+		result.NextCursor = api.EncodeCursor(lastSortValues)
 	}
 
 	// Build an Elasticsearch-compatible response structure
 	hitsArray := make([]map[string]interface{}, 0, len(docs))
-	for _, doc := range docs {
+	for i, doc := range docs {
 		id, _ := doc["id"].(string)
-		hitsArray = append(hitsArray, map[string]interface{}{
+		hit := map[string]interface{}{
 			"_id":     id,
 			"_source": doc,
-		})
+		}
+		if rank != nil {
+			hit["_score"] = scores[i]
+		}
+		hitsArray = append(hitsArray, hit)
 	}
 
 	response := util.MapStr{
@@ -650,7 +797,7 @@ func (handler *SQLiteORM) DeleteByQuery(ctx *api.Context, qb *api.QueryBuilder)
 	}
 
 	qb.Build()
-	where, args := sqliteOrm.BuildWhereClause(qb, lookupTableSchema(indexName).resolver())
+	where, args, _ := buildSearchWhere(indexName, qb)
 
 	// Count before delete
 	countSQL := fmt.Sprintf("SELECT COUNT(*) FROM [%s]", indexName)
@@ -779,16 +926,21 @@ func buildLegacyWhere(conds []*api.Cond) ([]string, []interface{}) {
 	return clauses, args
 }
 
-// Capabilities declares what the sqlite backend honors. FullText and
-// Aggregations are real (FTS5, GROUP BY); fuzzy is LIKE-approximated; the
-// rest warn and degrade (see query_builder.go / aggs_exec.go).
+// Capabilities declares what the sqlite backend honors: full text on FTS5,
+// vectors by a brute-force scan, nested fields through json_each and
+// aggregations as GROUP BY. Fuzzy is approximated with LIKE and the rest warn
+// and degrade (see query_builder.go and aggs_exec.go). Transactions are plain
+// SQL transactions (see tx.go).
 func (handler *SQLiteORM) Capabilities() api.Capabilities {
 	return api.Capabilities{
-		FullText:       true,
-		Aggregations:   true,
-		Fuzzy:          false,
-		Nested:         false,
-		RequestBodyDSL: false,
-		Collapse:       false,
+		FullText:           true,
+		Aggregations:       true,
+		Fuzzy:              false,
+		Nested:             true,
+		RequestBodyDSL:     false,
+		Collapse:           false,
+		Vector:             true,
+		Transactions:       true,
+		AtomicTransactions: true,
 	}
 }
@@ -0,0 +1,90 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the License, or (at your option) any later version.
+// See the GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package orm
+
+import (
+	"fmt"
+	"strings"
+
+	"infini.sh/framework/core/orm"
+)
+
+// nestedScope is the element of a nested clause being matched: the
+// json_each row over the array at path, aliased by depth.
+type nestedScope struct {
+	path   string
+	depth  int
+	parent *nestedScope
+}
+
+func (s *nestedScope) alias() string {
+	return fmt.Sprintf("_n%d", s.depth)
+}
+
+// nestedToSQL compiles a nested clause to an EXISTS over the elements of
+// the array at its path, so every condition of the inner query must hold
+// on the same element. Inner fields under the path read the element, the
+// others the document. A single object is a one-element array, like in
+// Elasticsearch, and nested paths inside nested paths iterate the element.
+func (b *whereBuilder) nestedToSQL(clause *orm.Clause) (string, []interface{}, error) {
+	inner, ok := clause.Value.(*orm.Clause)
+	if !ok || inner == nil {
+		return "", nil, fmt.Errorf("nested query value must be *orm.Clause")
+	}
+	var path string
+	if clause.Parameters != nil {
+		path, _ = clause.Parameters.GetString("path")
+	}
+	if path == "" {
+		return "", nil, fmt.Errorf("nested query has no path")
+	}
+
+	source, rel := "raw", path
+	scope := &nestedScope{path: path, parent: b.nested}
+	if b.nested != nil {
+		scope.depth = b.nested.depth + 1
+		if strings.HasPrefix(path, b.nested.path+".") {
+			source, rel = b.nested.alias()+".value", strings.TrimPrefix(path, b.nested.path+".")
+		}
+	}
+
+	// json_each columns (key, value, type, id, path...) shadow document
+	// columns of the same name inside the subquery, so fields of the
+	// document are read from raw there.
+	outer := b.resolve
+	b.resolve = func(p string) (string, string, *FTSPlan) {
+		if strings.HasPrefix(p, path+".") {
+			return fmt.Sprintf("json_extract(%s.value, '$.%s')", scope.alias(), strings.TrimPrefix(p, path+".")), "", nil
+		}
+		if scope.parent != nil {
+			return outer(p)
+		}
+		return ExprFor(nil, p), "", nil
+	}
+	rank, parent := b.rank, b.nested
+	b.nested = scope
+	where, args := clauseToSQL(inner, b)
+	b.resolve, b.nested, b.rank = outer, parent, rank
+	if where == "" {
+		where = "1 = 1"
+	}
+
+	elements := fmt.Sprintf("CASE json_type(%[1]s, '$.%[2]s') WHEN 'array' THEN json_extract(%[1]s, '$.%[2]s') WHEN 'object' THEN '[' || json_extract(%[1]s, '$.%[2]s') || ']' END",
+		source, rel)
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s) AS %s WHERE %s.type = 'object' AND %s)", elements, scope.alias(), scope.alias(), where), args, nil
+}
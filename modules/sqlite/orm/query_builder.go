@@ -47,17 +47,38 @@ type FTSPlan struct {
 // conditions exist. The resolver (may be nil) decides per path whether the
 // comparison hits a promoted generated column or a json_extract fallback.
 func BuildWhereClause(qb *orm.QueryBuilder, resolve FieldResolver) (string, []interface{}) {
+	where, args, _ := BuildRankedWhereClause(qb, "", resolve, nil)
+	return where, args
+}
+
+// BuildRankedWhereClause is BuildWhereClause for searches on table: semantic
+// clauses run against the vector columns given by vectors (may be nil), and
+// the ranking of the first semantic or hybrid clause is returned so the
+// caller can order the matches by it. Such a clause keeps only its top-K
+// candidates, the other clauses filter them.
+func BuildRankedWhereClause(qb *orm.QueryBuilder, table string, resolve FieldResolver, vectors VectorResolver) (string, []interface{}, *Ranking) {
 	if qb == nil {
-		return "", nil
+		return "", nil, nil
 	}
 
 	root := qb.Root()
 	if root == nil {
-		return "", nil
+		return "", nil, nil
 	}
 
-	where, args := clauseToSQL(root, resolve)
-	return where, args
+	b := &whereBuilder{table: table, resolve: resolve, vectors: vectors}
+	where, args := clauseToSQL(root, b)
+	return where, args, b.rank
+}
+
+// whereBuilder carries one translation: the table and resolvers, and the
+// ranking of the first semantic or hybrid clause met.
+type whereBuilder struct {
+	table   string
+	resolve FieldResolver
+	vectors VectorResolver
+	rank    *Ranking
+	nested  *nestedScope
 }
 
 // ExprFor resolves a JSON path to its comparison expression via the
@@ -120,26 +141,28 @@ func rangeFor(resolve FieldResolver, path string, op string, value interface{})
 	return fmt.Sprintf("%s %s ?", expr, op), []interface{}{value}
 }
 
-// unsupportedOnce deduplicates warnings for operators sqlite cannot honor;
+// unsupportedOnce deduplicates warnings for clauses sqlite cannot run;
 // per-query spam would hide the first occurrence in logs.
 var unsupportedOnce sync.Map
 
-func warnUnsupported(op orm.QueryType) {
-	if _, loaded := unsupportedOnce.LoadOrStore(op, true); !loaded {
-		log.Warnf("sqlite orm: %s queries are not supported on this backend; "+
-			"the clause matches no documents (grace period: warning only, will become an error in a future release)", op)
+// warnUnusable reports a semantic, hybrid or nested clause that cannot run,
+// once per field and reason.
+func warnUnusable(clause *orm.Clause, err error) {
+	key := fmt.Sprintf("%s/%s/%v", clause.Operator, clause.Field, err)
+	if _, loaded := unsupportedOnce.LoadOrStore(key, true); !loaded {
+		log.Warnf("sqlite orm: %s query on [%s] matches no documents: %v", clause.Operator, clause.Field, err)
 	}
 }
 
 // clauseToSQL recursively translates a Clause tree into a SQL WHERE expression.
-func clauseToSQL(clause *orm.Clause, resolve FieldResolver) (string, []interface{}) {
+func clauseToSQL(clause *orm.Clause, b *whereBuilder) (string, []interface{}) {
 	if clause == nil {
 		return "", nil
 	}
 
 	// Leaf node
 	if clause.IsLeaf() {
-		return leafToSQL(clause, resolve)
+		return leafToSQL(clause, b)
 	}
 
 	var parts []string
@@ -147,7 +170,7 @@ func clauseToSQL(clause *orm.Clause, resolve FieldResolver) (string, []interface
 
 	// filter and must are combined with AND
 	for _, sub := range clause.FilterClauses {
-		sql, args := clauseToSQL(sub, resolve)
+		sql, args := clauseToSQL(sub, b)
 		if sql != "" {
 			parts = append(parts, sql)
 			allArgs = append(allArgs, args...)
@@ -155,7 +178,7 @@ func clauseToSQL(clause *orm.Clause, resolve FieldResolver) (string, []interface
 	}
 
 	for _, sub := range clause.MustClauses {
-		sql, args := clauseToSQL(sub, resolve)
+		sql, args := clauseToSQL(sub, b)
 		if sql != "" {
 			parts = append(parts, sql)
 			allArgs = append(allArgs, args...)
@@ -164,7 +187,9 @@ func clauseToSQL(clause *orm.Clause, resolve FieldResolver) (string, []interface
 
 	// must_not is combined with AND NOT
 	for _, sub := range clause.MustNotClauses {
-		sql, args := clauseToSQL(sub, resolve)
+		rank := b.rank
+		sql, args := clauseToSQL(sub, b)
+		b.rank = rank // an excluded clause does not rank the matches
 		if sql != "" {
 			parts = append(parts, fmt.Sprintf("NOT (%s)", sql))
 			allArgs = append(allArgs, args...)
@@ -196,7 +221,7 @@ func clauseToSQL(clause *orm.Clause, resolve FieldResolver) (string, []interface
 		if shouldRequired {
 			var shouldParts []string
 			for _, sub := range clause.ShouldClauses {
-				sql, args := clauseToSQL(sub, resolve)
+				sql, args := clauseToSQL(sub, b)
 				if sql != "" {
 					shouldParts = append(shouldParts, sql)
 					allArgs = append(allArgs, args...)
@@ -230,6 +255,11 @@ func clauseToSQL(clause *orm.Clause, resolve FieldResolver) (string, []interface
 // its words in order inside one quoted string; a plain match joins its
 // words with OR — matching ES's analyzed match semantics (any term).
 func ftsMatchSQL(plan *FTSPlan, phrase bool, value interface{}) (string, []interface{}) {
+	return fmt.Sprintf("rowid IN (SELECT rowid FROM [%s] WHERE [%s] MATCH ?)", plan.Table, plan.Table), []interface{}{ftsTerm(phrase, value)}
+}
+
+// ftsTerm quotes value into an FTS5 query, see ftsMatchSQL.
+func ftsTerm(phrase bool, value interface{}) string {
 	raw := fmt.Sprintf("%v", value)
 	quote := func(s string) string { return `"` + strings.ReplaceAll(s, `"`, `""`) + `"` }
 	term := quote(raw)
@@ -242,11 +272,12 @@ func ftsMatchSQL(plan *FTSPlan, phrase bool, value interface{}) (string, []inter
 			term = strings.Join(quoted, " OR ")
 		}
 	}
-	return fmt.Sprintf("rowid IN (SELECT rowid FROM [%s] WHERE [%s] MATCH ?)", plan.Table, plan.Table), []interface{}{term}
+	return term
 }
 
 // leafToSQL converts a single leaf Clause to a SQL fragment.
-func leafToSQL(clause *orm.Clause, resolve FieldResolver) (string, []interface{}) {
+func leafToSQL(clause *orm.Clause, b *whereBuilder) (string, []interface{}) {
+	resolve := b.resolve
 	field := clause.Field
 	value := clause.Value
 
@@ -256,12 +287,30 @@ func leafToSQL(clause *orm.Clause, resolve FieldResolver) (string, []interface{}
 	}
 
 	switch clause.Operator {
-	case orm.QuerySemantic, orm.QueryHybrid, orm.QueryNested:
-		// These cannot be approximated on sqlite (vector search, nested docs).
-		// Previously they silently compiled to a never-matching equality; now
-		// the same empty result carries a one-time warning.
-		warnUnsupported(clause.Operator)
-		return "1 = 0", nil
+	case orm.QuerySemantic, orm.QueryHybrid:
+		var rank *Ranking
+		var err error
+		if clause.Operator == orm.QuerySemantic {
+			rank, err = b.semanticRanking(clause)
+		} else {
+			rank, err = b.hybridRanking(clause)
+		}
+		if err != nil {
+			warnUnusable(clause, err)
+			return "1 = 0", nil
+		}
+		if b.rank == nil {
+			b.rank = rank
+		}
+		return fmt.Sprintf("rowid IN (SELECT _rid FROM (%s))", rank.SQL), rank.Args
+
+	case orm.QueryNested:
+		sql, args, err := b.nestedToSQL(clause)
+		if err != nil {
+			warnUnusable(clause, err)
+			return "1 = 0", nil
+		}
+		return sql, args
 
 	case orm.QueryMatch:
 		if fts != nil {
@@ -379,3 +428,49 @@ func termsToSQL(jsonPath string, value interface{}) (string, []interface{}) {
 	}
 	return fmt.Sprintf("%s IN (%s)", jsonPath, strings.Join(placeholders, ",")), args
 }
+
+// BuildKeysetClause builds the keyset pagination predicate that selects the
+// rows sorted after values, the sort values of the last row of the previous
+// page. exprs and orders describe the ORDER BY, which must end with a unique
+// column. Mixed directions rule out a row value comparison, so it expands to
+//
+//	(e1 > ?) OR (e1 IS ? AND e2 > ?) OR ...
+//
+// with < for descending columns. SQLite sorts NULL before any value, so
+// after a NULL come all the values of an ascending column and none of a
+// descending one, and after a value of a descending column come its NULLs.
+func BuildKeysetClause(exprs []string, orders []orm.SortType, values []interface{}) (string, []interface{}) {
+	if len(exprs) == 0 || len(exprs) != len(values) {
+		return "", nil
+	}
+
+	var parts []string
+	var args []interface{}
+	for i := range exprs {
+		var conds []string
+		var condArgs []interface{}
+		for j := 0; j < i; j++ {
+			conds = append(conds, fmt.Sprintf("%s IS ?", exprs[j]))
+			condArgs = append(condArgs, values[j])
+		}
+		desc := strings.EqualFold(string(orders[i]), string(orm.DESC))
+		switch {
+		case values[i] == nil && desc:
+			continue
+		case values[i] == nil:
+			conds = append(conds, fmt.Sprintf("%s IS NOT NULL", exprs[i]))
+		case desc:
+			conds = append(conds, fmt.Sprintf("(%s < ? OR %s IS NULL)", exprs[i], exprs[i]))
+			condArgs = append(condArgs, values[i])
+		default:
+			conds = append(conds, fmt.Sprintf("%s > ?", exprs[i]))
+			condArgs = append(condArgs, values[i])
+		}
+		parts = append(parts, "("+strings.Join(conds, " AND ")+")")
+		args = append(args, condArgs...)
+	}
+	if len(parts) == 0 {
+		return "(0)", nil
+	}
+	return "(" + strings.Join(parts, " OR ") + ")", args
+}
@@ -486,3 +486,28 @@ func TestBuildWhereClause_OptionalShouldWithoutMinShouldMatch(t *testing.T) {
 	assert.Equal(t, []interface{}{"active"}, args)
 	assert.NotContains(t, where, "priority")
 }
+
+func TestBuildWhereClause_Nested(t *testing.T) {
+	qb := orm.NewQuery().Filter(orm.NestedQuery("perms", orm.MustQuery(
+		orm.TermQuery("perms.role", "admin"),
+		orm.NestedQuery("perms.grants", orm.TermQuery("perms.grants.action", "write")),
+		orm.TermQuery("owner", "alice"),
+	)))
+	qb.Build()
+	where, args := BuildWhereClause(qb, nil)
+
+	assert.Equal(t, "EXISTS (SELECT 1 FROM json_each(CASE json_type(raw, '$.perms') WHEN 'array' THEN json_extract(raw, '$.perms') "+
+		"WHEN 'object' THEN '[' || json_extract(raw, '$.perms') || ']' END) AS _n0 WHERE _n0.type = 'object' AND "+
+		"(json_extract(_n0.value, '$.role') = ? AND "+
+		"EXISTS (SELECT 1 FROM json_each(CASE json_type(_n0.value, '$.grants') WHEN 'array' THEN json_extract(_n0.value, '$.grants') "+
+		"WHEN 'object' THEN '[' || json_extract(_n0.value, '$.grants') || ']' END) AS _n1 WHERE _n1.type = 'object' AND "+
+		"json_extract(_n1.value, '$.action') = ?) AND "+
+		"json_extract(raw, '$.owner') = ?))", where)
+	assert.Equal(t, []interface{}{"admin", "write", "alice"}, args)
+
+	// without an inner query the clause matches nothing
+	qb = orm.NewQuery().Filter(&orm.Clause{Operator: orm.QueryNested, Value: "x"})
+	qb.Build()
+	where, _ = BuildWhereClause(qb, nil)
+	assert.Equal(t, "1 = 0", where)
+}
@@ -0,0 +1,226 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the License, or (at your option) any later version.
+// See the GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package orm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"infini.sh/framework/core/orm"
+)
+
+// VectorPlan identifies the generated column backing a dense_vector field.
+// The column holds the vector as a little-endian float32 blob (vec_f32).
+type VectorPlan struct {
+	Table      string
+	Column     string // quoted column expression
+	Similarity string // cosine (default), dot_product or l2_norm
+	Dims       int    // 0 when the mapping does not declare dims
+}
+
+// VectorResolver maps a dotted JSON path to its vector column, nil when the
+// path is not a dense_vector field.
+type VectorResolver func(path string) *VectorPlan
+
+// Ranking is the relevance order of a semantic or hybrid clause: a subquery
+// of (_rid, _score) rows, the rowid and the score of every match.
+type Ranking struct {
+	SQL  string
+	Args []interface{}
+}
+
+// defaultCandidates is the top-K of semantic and hybrid clauses that do not
+// set candidates, matching the default of orm.SemanticQuery.
+const defaultCandidates = 100
+
+// rrfRankConstant dampens the weight of the top ranks in reciprocal rank
+// fusion, 60 as in the original paper and Elasticsearch.
+const rrfRankConstant = 60
+
+// similarityScores maps a similarity to its score expression, normalized
+// like Elasticsearch so scores are positive and higher is nearer.
+var similarityScores = map[string]string{
+	"cosine":      "(1 + vec_cosine(%s, ?)) / 2",
+	"dot_product": "(1 + vec_dot(%s, ?)) / 2",
+	"l2_norm":     "1 / (1 + vec_l2_squared(%s, ?))",
+}
+
+// EncodeVector packs a vector into the little-endian float32 blob stored in
+// vector columns.
+func EncodeVector(v []float32) []byte {
+	buf := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return buf
+}
+
+// DecodeVector unpacks a blob written by EncodeVector, ok is false when the
+// length is not a multiple of 4.
+func DecodeVector(b []byte) ([]float32, bool) {
+	if len(b)%4 != 0 {
+		return nil, false
+	}
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v, true
+}
+
+// Dot returns the dot product of two vectors of the same length.
+func Dot(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// Cosine returns the cosine similarity of two vectors of the same length,
+// 0 when either is a zero vector.
+func Cosine(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+// L2Squared returns the squared euclidean distance of two vectors of the
+// same length.
+func L2Squared(a, b []float32) float64 {
+	var sum float64
+	for i := range a {
+		d := float64(a[i]) - float64(b[i])
+		sum += d * d
+	}
+	return sum
+}
+
+func candidatesOf(clause *orm.Clause) int {
+	if clause.Parameters != nil {
+		if k, ok := clause.Parameters.GetInt("candidates", 0); ok && k > 0 {
+			return k
+		}
+	}
+	return defaultCandidates
+}
+
+// semanticRanking brute-forces the candidates nearest vectors of the field:
+// every row is scored, the top-K kept. Rows whose vector has another
+// dimension than the query score NULL and are skipped.
+func (b *whereBuilder) semanticRanking(clause *orm.Clause) (*Ranking, error) {
+	var plan *VectorPlan
+	if b.vectors != nil {
+		plan = b.vectors(clause.Field)
+	}
+	if plan == nil {
+		return nil, fmt.Errorf("[%s] is not a dense_vector field", clause.Field)
+	}
+	vector, err := orm.QueryVector(clause)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Dims > 0 && len(vector) != plan.Dims {
+		return nil, fmt.Errorf("query vector has %d dims, [%s] has %d", len(vector), clause.Field, plan.Dims)
+	}
+	score, ok := similarityScores[plan.Similarity]
+	if !ok {
+		score = similarityScores["cosine"]
+	}
+	score = fmt.Sprintf(score, plan.Column)
+	return &Ranking{
+		SQL: fmt.Sprintf("SELECT _rid, _score FROM (SELECT rowid AS _rid, %s AS _score FROM [%s] WHERE %s IS NOT NULL) WHERE _score IS NOT NULL ORDER BY _score DESC LIMIT %d",
+			score, plan.Table, plan.Column, candidatesOf(clause)),
+		Args: []interface{}{EncodeVector(vector)},
+	}, nil
+}
+
+// hybridRanking fuses the rankings of the sub-queries with reciprocal rank
+// fusion: a row scores the sum of 1/(60+rank) over the lists it is in.
+// Semantic sub-queries rank by similarity, full-text ones by BM25, and the
+// others, which do not score, by insertion order.
+func (b *whereBuilder) hybridRanking(clause *orm.Clause) (*Ranking, error) {
+	queries, ok := clause.Value.([]*orm.Clause)
+	if !ok || len(queries) == 0 {
+		return nil, fmt.Errorf("hybrid query value must be []*orm.Clause")
+	}
+	k := candidatesOf(clause)
+
+	var lists []string
+	var args []interface{}
+	for _, q := range queries {
+		sql, a, err := b.rankList(q, k)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, fmt.Sprintf("SELECT _rid, _r FROM (%s)", sql))
+		args = append(args, a...)
+	}
+	return &Ranking{
+		SQL: fmt.Sprintf("SELECT _rid, SUM(1.0 / (%d + _r)) AS _score FROM (%s) GROUP BY _rid ORDER BY _score DESC",
+			rrfRankConstant, strings.Join(lists, " UNION ALL ")),
+		Args: args,
+	}, nil
+}
+
+// rankList returns the top-K of one hybrid sub-query as (_rid, _r) rows,
+// _r being the 1-based rank.
+func (b *whereBuilder) rankList(clause *orm.Clause, k int) (string, []interface{}, error) {
+	if clause.Operator == orm.QuerySemantic {
+		rank, err := b.semanticRanking(clause)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("SELECT _rid, ROW_NUMBER() OVER (ORDER BY _score DESC) AS _r FROM (%s)", rank.SQL), rank.Args, nil
+	}
+
+	var fts *FTSPlan
+	if b.resolve != nil && clause.IsLeaf() {
+		_, _, fts = b.resolve(clause.Field)
+	}
+	if fts != nil {
+		switch clause.Operator {
+		case orm.QueryMatch, orm.QueryMatchPhrase, orm.QueryQueryString:
+			// bm25() is lower for better matches
+			term := ftsTerm(clause.Operator != orm.QueryMatch, clause.Value)
+			return fmt.Sprintf("SELECT _rid, ROW_NUMBER() OVER (ORDER BY _bm25) AS _r FROM (SELECT rowid AS _rid, bm25([%[1]s]) AS _bm25 FROM [%[1]s] WHERE [%[1]s] MATCH ? ORDER BY _bm25 LIMIT %[2]d)",
+				fts.Table, k), []interface{}{term}, nil
+		}
+	}
+
+	if b.table == "" {
+		return "", nil, fmt.Errorf("hybrid sub-query %s needs the table", clause.Operator)
+	}
+	rank := b.rank
+	where, args := clauseToSQL(clause, b)
+	b.rank = rank
+	if where == "" {
+		where = "1 = 1"
+	}
+	return fmt.Sprintf("SELECT _rid, ROW_NUMBER() OVER (ORDER BY _rid) AS _r FROM (SELECT rowid AS _rid FROM [%s] WHERE %s ORDER BY rowid LIMIT %d)",
+		b.table, where, k), args, nil
+}
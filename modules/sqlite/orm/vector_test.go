@@ -0,0 +1,109 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package orm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/orm"
+)
+
+func TestEncodeVector_RoundTrip(t *testing.T) {
+	v := []float32{1, -0.5, 3.25}
+	b := EncodeVector(v)
+	assert.Len(t, b, 12)
+	out, ok := DecodeVector(b)
+	require.True(t, ok)
+	assert.Equal(t, v, out)
+
+	_, ok = DecodeVector([]byte{1, 2, 3})
+	assert.False(t, ok)
+}
+
+func TestVectorSimilarities(t *testing.T) {
+	assert.InDelta(t, 1, Cosine([]float32{1, 1}, []float32{2, 2}), 1e-9)
+	assert.InDelta(t, 0, Cosine([]float32{1, 0}, []float32{0, 1}), 1e-9)
+	assert.Equal(t, float64(0), Cosine([]float32{0, 0}, []float32{1, 1}))
+	assert.InDelta(t, 11, Dot([]float32{1, 2}, []float32{3, 4}), 1e-9)
+	assert.InDelta(t, 8, L2Squared([]float32{1, 2}, []float32{3, 4}), 1e-9)
+}
+
+func TestBuildRankedWhereClause_Semantic(t *testing.T) {
+	vectors := func(path string) *VectorPlan {
+		if path == "embedding" {
+			return &VectorPlan{Table: "docs", Column: `"embedding"`, Similarity: "dot_product"}
+		}
+		return nil
+	}
+
+	qb := orm.NewQuery().Must(orm.SemanticVectorQuery("embedding", []float32{1, 0}, 5)).Filter(orm.TermQuery("status", "ok"))
+	qb.Build()
+	where, args, rank := BuildRankedWhereClause(qb, "docs", nil, vectors)
+	require.NotNil(t, rank)
+	assert.Contains(t, where, "rowid IN (SELECT _rid FROM (")
+	assert.Contains(t, rank.SQL, `vec_dot("embedding", ?)`)
+	assert.Contains(t, rank.SQL, "LIMIT 5")
+	assert.Equal(t, []interface{}{"ok", EncodeVector([]float32{1, 0})}, args)
+
+	// without vector columns the clause matches nothing
+	where, _, rank = BuildRankedWhereClause(qb, "docs", nil, nil)
+	assert.Nil(t, rank)
+	assert.Contains(t, where, "1 = 0")
+
+	// an excluded semantic clause filters but does not rank
+	qb = orm.NewQuery().Not(orm.SemanticVectorQuery("embedding", []float32{1, 0}, 5))
+	qb.Build()
+	where, _, rank = BuildRankedWhereClause(qb, "docs", nil, vectors)
+	assert.Nil(t, rank)
+	assert.True(t, strings.HasPrefix(where, "NOT (rowid IN"))
+}
+
+func TestBuildRankedWhereClause_Hybrid(t *testing.T) {
+	resolve := func(path string) (string, string, *FTSPlan) {
+		if path == "title" {
+			return `"title"`, "", &FTSPlan{Table: "fts_docs", Column: "title"}
+		}
+		return `"` + path + `"`, "", nil
+	}
+	vectors := func(path string) *VectorPlan {
+		return &VectorPlan{Table: "docs", Column: `"` + path + `"`}
+	}
+
+	qb := orm.NewQuery().Must(orm.HybridQuery(
+		orm.MatchQuery("title", "green"),
+		orm.SemanticVectorQuery("embedding", []float32{1}, 0),
+		orm.TermQuery("tag", "car"),
+	))
+	qb.Build()
+	_, args, rank := BuildRankedWhereClause(qb, "docs", resolve, vectors)
+	require.NotNil(t, rank)
+	assert.Contains(t, rank.SQL, "SUM(1.0 / (60 + _r))")
+	assert.Contains(t, rank.SQL, "bm25([fts_docs])")
+	assert.Contains(t, rank.SQL, `vec_cosine("embedding", ?)`)
+	assert.Contains(t, rank.SQL, `FROM [docs] WHERE "tag" = ?`)
+	assert.Equal(t, []interface{}{`"green"`, EncodeVector([]float32{1}), "car"}, args)
+}
@@ -45,7 +45,7 @@ func (handler *SQLiteORM) Aggregate(ctx *api.Context, qb *api.QueryBuilder) (*ap
 	}
 	qb.Build()
 	resolver := lookupTableSchema(indexName).resolver()
-	where, args := sqliteOrm.BuildWhereClause(qb, resolver)
+	where, args, _ := buildSearchWhere(indexName, qb)
 
 	exec := &aggExecutor{handler: handler, index: indexName, resolve: resolver, schema: lookupTableSchema(indexName), where: where, args: args}
 	nodes, err := exec.execute(qb.Aggs)
@@ -254,6 +254,80 @@ func TestSQLiteORM_SearchV2(t *testing.T) {
 	assert.Equal(t, 200, searchResult.Status)
 }
 
+func TestSQLiteORM_SearchV2_SearchAfter(t *testing.T) {
+	handler, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now()
+	ages := map[string]int{"c1": 30, "c2": 25, "c3": 30, "c4": 40, "c5": 25, "c6": 30, "c7": 20}
+	for id, age := range ages {
+		require.NoError(t, handler.Create(nil, &TestItem{ORMObjectBase: orm.ORMObjectBase{ID: id, Created: &now, Updated: &now}, Status: "active", Age: age}))
+	}
+	require.NoError(t, handler.Create(nil, &TestItem{ORMObjectBase: orm.ORMObjectBase{ID: "c8", Created: &now, Updated: &now}, Status: "pending", Age: 50}))
+
+	ctx := orm.NewContext()
+	orm.WithModel(ctx, &TestItem{})
+
+	var seen []string
+	cursor := ""
+	for page := 0; page < 10; page++ {
+		qb := orm.NewQuery()
+		qb.Filter(orm.TermQuery("status", "active"))
+		qb.SortBy(orm.Sort{Field: "age", SortType: orm.DESC})
+		qb.Size(3)
+		qb.SearchAfter(cursor)
+
+		result, err := handler.SearchV2(ctx, qb)
+		require.NoError(t, err)
+		seen = append(seen, requireSearchResultIDs(t, result)...)
+		if result.NextCursor == "" {
+			break
+		}
+		cursor = result.NextCursor
+	}
+
+	// age desc, then the id tiebreak ascending
+	assert.Equal(t, []string{"c4", "c1", "c3", "c6", "c2", "c5", "c7"}, seen)
+
+	qb := orm.NewQuery().SearchAfter("not a cursor")
+	_, err := handler.SearchV2(ctx, qb)
+	assert.Error(t, err)
+}
+
+func TestSQLiteORM_SearchV2_SearchAfterNullSortValues(t *testing.T) {
+	handler, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now()
+	//an empty name is left out of the document and sorts as NULL
+	names := map[string]string{"n1": "b", "n2": "", "n3": "a", "n4": "", "n5": "b", "n6": "", "n7": "c"}
+	for id, name := range names {
+		require.NoError(t, handler.Create(nil, &TestItem{ORMObjectBase: orm.ORMObjectBase{ID: id, Created: &now, Updated: &now}, Name: name}))
+	}
+
+	ctx := orm.NewContext()
+	orm.WithModel(ctx, &TestItem{})
+
+	pages := func(order orm.SortType) []string {
+		var seen []string
+		cursor := ""
+		for page := 0; page < 10; page++ {
+			qb := orm.NewQuery().SortBy(orm.Sort{Field: "name", SortType: order}).Size(2).SearchAfter(cursor)
+			result, err := handler.SearchV2(ctx, qb)
+			require.NoError(t, err)
+			seen = append(seen, requireSearchResultIDs(t, result)...)
+			if result.NextCursor == "" {
+				break
+			}
+			cursor = result.NextCursor
+		}
+		return seen
+	}
+
+	assert.Equal(t, []string{"n2", "n4", "n6", "n3", "n1", "n5", "n7"}, pages(orm.ASC))
+	assert.Equal(t, []string{"n7", "n1", "n5", "n3", "n2", "n4", "n6"}, pages(orm.DESC))
+}
+
 func TestSQLiteORM_DeleteByQuery(t *testing.T) {
 	handler, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -0,0 +1,84 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package sqlite
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/orm"
+	"infini.sh/framework/core/util"
+)
+
+func TestORMTransfer_ExportImport(t *testing.T) {
+	orm.MustRegisterSchemaWithIndexName(TestItem{}, "test_items")
+
+	source, cleanupSource := setupTestDB(t)
+	defer cleanupSource()
+	target, cleanupTarget := setupTestDB(t)
+	defer cleanupTarget()
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	updated := created.Add(time.Hour)
+	for _, id := range []string{"t1", "t2", "t3", "t4", "t5"} {
+		require.NoError(t, source.Create(nil, &TestItem{
+			ORMObjectBase: orm.ORMObjectBase{ID: id, Created: &created, Updated: &updated, System: util.MapStr{"owner_id": "u-" + id}},
+			Name:          "name-" + id,
+		}))
+	}
+
+	buffer := bytes.Buffer{}
+	stats, err := orm.Export(source, &buffer, &orm.TransferOptions{Schemas: []string{"test_items"}, BatchSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), stats["test_items"])
+
+	lines := 0
+	scanner := bufio.NewScanner(bytes.NewReader(buffer.Bytes()))
+	for scanner.Scan() {
+		lines++
+	}
+	assert.Equal(t, 5, lines)
+
+	stats, err = orm.Import(target, &buffer, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), stats["test_items"])
+
+	ctx := orm.NewContext()
+	ctx.Set(orm.KeepSystemFields, true)
+	item := &TestItem{ORMObjectBase: orm.ORMObjectBase{ID: "t3"}}
+	exists, err := target.Get(ctx, item)
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.Equal(t, "name-t3", item.Name)
+	assert.Equal(t, "u-t3", item.System["owner_id"])
+	assert.True(t, created.Equal(*item.Created))
+	assert.True(t, updated.Equal(*item.Updated))
+
+	_, err = orm.Import(target, bytes.NewReader([]byte(`{"schema":"unknown","id":"x","source":{}}`)), nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,81 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	log "github.com/cihub/seelog"
+	api "infini.sh/framework/core/orm"
+)
+
+// dbExecutor is the part of *sql.DB and *sql.Tx the single-object writes
+// need, so the same code runs inside and outside a transaction.
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Transaction runs fn inside a SQL transaction: every write made through tx
+// is committed together when fn returns nil, and rolled back when it
+// returns an error or panics. Reads through tx see the pending writes.
+func (handler *SQLiteORM) Transaction(ctx *api.Context, fn func(tx api.Tx) error) (err error) {
+	parent := context.Background()
+	if ctx != nil && ctx.Context != nil {
+		parent = ctx.Context
+	}
+
+	sqlTx, err := handler.DB.BeginTx(parent, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if rbErr := sqlTx.Rollback(); rbErr != nil {
+				log.Errorf("sqlite rollback after panic: %v", rbErr)
+			}
+			panic(r)
+		}
+	}()
+
+	if err = fn(&sqliteTx{handler: handler, tx: sqlTx}); err != nil {
+		if rbErr := sqlTx.Rollback(); rbErr != nil {
+			log.Errorf("sqlite rollback: %v", rbErr)
+		}
+		return err
+	}
+
+	if err = sqlTx.Commit(); err != nil {
+		return fmt.Errorf("%w: %v", api.ErrTransactionRolledBack, err)
+	}
+	return nil
+}
+
+// sqliteTx binds the single-object writes of SQLiteORM to one *sql.Tx.
+type sqliteTx struct {
+	handler *SQLiteORM
+	tx      *sql.Tx
+}
+
+func (t *sqliteTx) Get(ctx *api.Context, o interface{}) (bool, error) {
+	return t.handler.get(t.tx, o)
+}
+
+func (t *sqliteTx) Create(ctx *api.Context, o interface{}) error {
+	return t.handler.create(t.tx, o)
+}
+
+func (t *sqliteTx) Save(ctx *api.Context, o interface{}) error {
+	return t.handler.save(t.tx, o)
+}
+
+func (t *sqliteTx) Update(ctx *api.Context, o interface{}) error {
+	return t.handler.update(t.tx, o)
+}
+
+func (t *sqliteTx) Delete(ctx *api.Context, o interface{}) error {
+	return t.handler.deleteObject(t.tx, o)
+}
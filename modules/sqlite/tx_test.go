@@ -0,0 +1,70 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package sqlite
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/orm"
+)
+
+func TestSQLiteORM_TransactionRollsBackFailedWrite(t *testing.T) {
+	handler, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	existing := &TestItem{Name: "existing"}
+	existing.ID = "dup"
+	require.NoError(t, handler.Create(nil, existing))
+
+	err := handler.Transaction(nil, func(tx orm.Tx) error {
+		item := &TestItem{Name: "first"}
+		item.ID = "tx-first"
+		if err := tx.Create(nil, item); err != nil {
+			return err
+		}
+
+		staged := &TestItem{}
+		staged.ID = "tx-first"
+		exists, err := tx.Get(nil, staged)
+		require.NoError(t, err)
+		assert.True(t, exists, "reads inside the transaction see pending writes")
+
+		dup := &TestItem{Name: "dup"}
+		dup.ID = "dup"
+		return tx.Create(nil, dup)
+	})
+	assert.Error(t, err)
+
+	got := &TestItem{}
+	got.ID = "tx-first"
+	exists, _ := handler.Get(nil, got)
+	assert.False(t, exists)
+}
+
+func TestSQLiteORM_TransactionRollsBackOnPanic(t *testing.T) {
+	handler, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	assert.Panics(t, func() {
+		_ = handler.Transaction(nil, func(tx orm.Tx) error {
+			item := &TestItem{Name: "panic"}
+			item.ID = "tx-panic"
+			if err := tx.Create(nil, item); err != nil {
+				return err
+			}
+			panic("boom")
+		})
+	})
+
+	got := &TestItem{}
+	got.ID = "tx-panic"
+	exists, _ := handler.Get(nil, got)
+	assert.False(t, exists)
+
+	// the connection went back to the pool in a usable state
+	item := &TestItem{Name: "after"}
+	item.ID = "after-panic"
+	assert.NoError(t, handler.Create(nil, item))
+}
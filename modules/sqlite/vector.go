@@ -0,0 +1,59 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package sqlite
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+
+	sqliteOrm "infini.sh/framework/modules/sqlite/orm"
+	"modernc.org/sqlite"
+)
+
+// The vector functions are registered with the driver, so every pooled
+// connection has them. vec_f32 backs the generated vector columns: a table
+// with one can only be written through this driver (reads work anywhere).
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("vec_f32", 1, vecF32)
+	sqlite.MustRegisterDeterministicScalarFunction("vec_cosine", 2, vecSimilarity(sqliteOrm.Cosine))
+	sqlite.MustRegisterDeterministicScalarFunction("vec_dot", 2, vecSimilarity(sqliteOrm.Dot))
+	sqlite.MustRegisterDeterministicScalarFunction("vec_l2_squared", 2, vecSimilarity(sqliteOrm.L2Squared))
+}
+
+// vecF32 packs a JSON array of numbers into a float32 blob. Anything else
+// is NULL rather than an error, so a malformed vector never fails the write
+// of its document, it is just not searchable.
+func vecF32(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	var raw []byte
+	switch v := args[0].(type) {
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw = v
+	default:
+		return nil, nil
+	}
+	var vector []float32
+	if err := json.Unmarshal(raw, &vector); err != nil || len(vector) == 0 {
+		return nil, nil
+	}
+	return sqliteOrm.EncodeVector(vector), nil
+}
+
+// vecSimilarity wraps a similarity of two blobs, NULL when either is not a
+// vector or their dimensions differ.
+func vecSimilarity(f func(a, b []float32) float64) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		x, ok1 := args[0].([]byte)
+		y, ok2 := args[1].([]byte)
+		if !ok1 || !ok2 {
+			return nil, nil
+		}
+		a, ok1 := sqliteOrm.DecodeVector(x)
+		b, ok2 := sqliteOrm.DecodeVector(y)
+		if !ok1 || !ok2 || len(a) != len(b) || len(a) == 0 {
+			return nil, nil
+		}
+		return f(a, b), nil
+	}
+}
@@ -0,0 +1,208 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package sqlite
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"infini.sh/framework/core/orm"
+)
+
+// vectorDoc is a model with a text field and two vector fields.
+type vectorDoc struct {
+	orm.ORMObjectBase
+	Title     string    `json:"title,omitempty" elastic_mapping:"title: { type: text }"`
+	Tag       string    `json:"tag,omitempty" elastic_mapping:"tag: { type: keyword }"`
+	Embedding []float32 `json:"embedding,omitempty" elastic_mapping:"embedding: { type: dense_vector, dims: 2, similarity: cosine }"`
+	Dot       []float32 `json:"dot,omitempty" elastic_mapping:"dot: { type: dense_vector, similarity: dot_product }"`
+}
+
+func openVectorTestDB(t *testing.T) *SQLiteORM {
+	t.Helper()
+	handler := &SQLiteORM{Config: SQLiteConfig{Enabled: true, DBPath: filepath.Join(t.TempDir(), "vector.db")}}
+	require.NoError(t, handler.Open())
+	t.Cleanup(func() { handler.Close() })
+	require.NoError(t, handler.RegisterSchemaWithName(vectorDoc{}, "vector_docs"))
+
+	for _, d := range []vectorDoc{
+		{Title: "red apple", Tag: "fruit", Embedding: []float32{1, 0}, Dot: []float32{0.1, 0}},
+		{Title: "green apple", Tag: "fruit", Embedding: []float32{0.8, 0.6}, Dot: []float32{0.9, 0}},
+		{Title: "green car", Tag: "car", Embedding: []float32{0, 1}, Dot: []float32{0.5, 0}},
+		{Title: "no vector", Tag: "car"},
+	} {
+		d.ID = d.Title
+		require.NoError(t, handler.Save(nil, &d))
+	}
+	return handler
+}
+
+type scoredHit struct {
+	ID    string
+	Score float64
+}
+
+func searchScored(t *testing.T, handler *SQLiteORM, qb *orm.QueryBuilder) []scoredHit {
+	t.Helper()
+	ctx := orm.NewContext()
+	orm.WithModel(ctx, &vectorDoc{})
+	res, err := handler.SearchV2(ctx, qb)
+	require.NoError(t, err)
+	var payload struct {
+		Hits struct {
+			Hits []struct {
+				ID    string  `json:"_id"`
+				Score float64 `json:"_score"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	require.NoError(t, json.Unmarshal(res.Payload.([]byte), &payload))
+	var out []scoredHit
+	for _, h := range payload.Hits.Hits {
+		out = append(out, scoredHit{ID: h.ID, Score: h.Score})
+	}
+	return out
+}
+
+func ids(hits []scoredHit) []string {
+	var out []string
+	for _, h := range hits {
+		out = append(out, h.ID)
+	}
+	return out
+}
+
+func TestVector_SemanticQuery(t *testing.T) {
+	handler := openVectorTestDB(t)
+
+	t.Run("nearest first, normalized cosine score", func(t *testing.T) {
+		hits := searchScored(t, handler, orm.NewQuery().Must(orm.SemanticVectorQuery("embedding", []float32{1, 0}, 0)))
+		require.Equal(t, []string{"red apple", "green apple", "green car"}, ids(hits))
+		assert.InDelta(t, 1, hits[0].Score, 1e-6)
+		assert.InDelta(t, 0.9, hits[1].Score, 1e-6)
+		assert.InDelta(t, 0.5, hits[2].Score, 1e-6)
+	})
+
+	t.Run("candidates is the top-K", func(t *testing.T) {
+		hits := searchScored(t, handler, orm.NewQuery().Must(orm.SemanticVectorQuery("embedding", []float32{0, 1}, 2)))
+		assert.Equal(t, []string{"green car", "green apple"}, ids(hits))
+	})
+
+	t.Run("filters apply to the candidates", func(t *testing.T) {
+		hits := searchScored(t, handler, orm.NewQuery().
+			Must(orm.SemanticVectorQuery("embedding", []float32{0, 1}, 0)).
+			Filter(orm.TermQuery("tag", "fruit")))
+		assert.Equal(t, []string{"green apple", "red apple"}, ids(hits))
+	})
+
+	t.Run("dot product similarity from the mapping", func(t *testing.T) {
+		hits := searchScored(t, handler, orm.NewQuery().Must(orm.SemanticVectorQuery("dot", []float32{1, 0}, 0)))
+		require.Equal(t, []string{"green apple", "green car", "red apple"}, ids(hits))
+		assert.InDelta(t, 0.95, hits[0].Score, 1e-6)
+	})
+
+	t.Run("explicit sort wins over the score", func(t *testing.T) {
+		hits := searchScored(t, handler, orm.NewQuery().
+			Must(orm.SemanticVectorQuery("embedding", []float32{1, 0}, 0)).
+			SortBy(orm.Sort{Field: "id", SortType: orm.ASC}))
+		assert.Equal(t, []string{"green apple", "green car", "red apple"}, ids(hits))
+	})
+
+	t.Run("query text goes through the registered embedder", func(t *testing.T) {
+		orm.RegisterTextEmbedder(func(text string) ([]float32, error) {
+			return []float32{0, 1}, nil
+		})
+		defer orm.RegisterTextEmbedder(nil)
+		hits := searchScored(t, handler, orm.NewQuery().Must(orm.SemanticQuery("embedding", "vehicle", 1, "")))
+		assert.Equal(t, []string{"green car"}, ids(hits))
+	})
+
+	t.Run("unusable queries match nothing", func(t *testing.T) {
+		// no embedder for the text, wrong dims, not a vector field
+		assert.Empty(t, searchScored(t, handler, orm.NewQuery().Must(orm.SemanticQuery("embedding", "vehicle", 0, ""))))
+		assert.Empty(t, searchScored(t, handler, orm.NewQuery().Must(orm.SemanticVectorQuery("embedding", []float32{1, 0, 0}, 0))))
+		assert.Empty(t, searchScored(t, handler, orm.NewQuery().Must(orm.SemanticVectorQuery("title", []float32{1, 0}, 0))))
+	})
+}
+
+func TestVector_SemanticQueryCursor(t *testing.T) {
+	handler := openVectorTestDB(t)
+
+	pages := [][]string{}
+	cursor := ""
+	for i := 0; i < 3; i++ {
+		ctx := orm.NewContext()
+		orm.WithModel(ctx, &vectorDoc{})
+		res, err := handler.SearchV2(ctx, orm.NewQuery().
+			Must(orm.SemanticVectorQuery("embedding", []float32{1, 0}, 0)).
+			Size(2).SearchAfter(cursor))
+		require.NoError(t, err)
+		var payload struct {
+			Hits struct {
+				Hits []struct {
+					ID string `json:"_id"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		require.NoError(t, json.Unmarshal(res.Payload.([]byte), &payload))
+		page := []string{}
+		for _, h := range payload.Hits.Hits {
+			page = append(page, h.ID)
+		}
+		pages = append(pages, page)
+		if res.NextCursor == "" {
+			break
+		}
+		cursor = res.NextCursor
+	}
+	// the cursor carries the implicit _score sort, pages keep the ranking
+	assert.Equal(t, [][]string{{"red apple", "green apple"}, {"green car"}}, pages)
+}
+
+func TestVector_HybridQuery(t *testing.T) {
+	handler := openVectorTestDB(t)
+
+	// "green" matches green apple and green car by BM25, the vector ranks
+	// red apple, green apple, green car: green apple is in both lists near
+	// the top and wins the fusion.
+	hits := searchScored(t, handler, orm.NewQuery().Must(orm.HybridQuery(
+		orm.MatchQuery("title", "green"),
+		orm.SemanticVectorQuery("embedding", []float32{1, 0}, 0),
+	)))
+	require.Len(t, hits, 3)
+	assert.Equal(t, "green apple", hits[0].ID)
+	assert.ElementsMatch(t, []string{"green apple", "green car", "red apple"}, ids(hits))
+	for i := 1; i < len(hits); i++ {
+		assert.GreaterOrEqual(t, hits[i-1].Score, hits[i].Score)
+	}
+
+	// sub-queries that do not score still contribute their matches
+	hits = searchScored(t, handler, orm.NewQuery().Must(orm.HybridQuery(
+		orm.TermQuery("tag", "car"),
+		orm.SemanticVectorQuery("embedding", []float32{0, 1}, 1),
+	)))
+	assert.Equal(t, "green car", hits[0].ID)
+	assert.ElementsMatch(t, []string{"green car", "no vector"}, ids(hits))
+}
+
+func TestVector_SchemaAndCapabilities(t *testing.T) {
+	handler := openVectorTestDB(t)
+	assert.True(t, handler.Capabilities().Vector)
+
+	schema := lookupTableSchema("vector_docs")
+	require.Len(t, schema.Vectors, 2)
+	assert.Equal(t, vectorInfo{Path: "embedding", Similarity: "cosine", Dims: 2}, schema.Vectors[0])
+	assert.Equal(t, vectorInfo{Path: "dot", Similarity: "dot_product"}, schema.Vectors[1])
+
+	// vectors are stored packed, a document without one stores NULL
+	var size int
+	require.NoError(t, handler.DB.QueryRow(`SELECT length("embedding") FROM [vector_docs] WHERE id = 'red apple'`).Scan(&size))
+	assert.Equal(t, 8, size)
+	var missing interface{}
+	require.NoError(t, handler.DB.QueryRow(`SELECT "embedding" FROM [vector_docs] WHERE id = 'no vector'`).Scan(&missing))
+	assert.Nil(t, missing)
+}
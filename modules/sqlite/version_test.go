@@ -0,0 +1,91 @@
+/* Copyright © INFINI LTD. All rights reserved. */
+
+package sqlite
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/orm"
+)
+
+type versionedItem struct {
+	orm.ORMObjectBase
+	orm.VersionedObjectBase
+	Name string `json:"name,omitempty" elastic_mapping:"name: { type: keyword }"`
+}
+
+// legacyItem backs a table created before the version column existed.
+type legacyItem struct {
+	orm.ORMObjectBase
+	orm.VersionedObjectBase
+	Name string `json:"name,omitempty" elastic_mapping:"name: { type: keyword }"`
+}
+
+func TestSQLiteORM_OptimisticConcurrency(t *testing.T) {
+	handler, cleanup := setupTestDB(t)
+	defer cleanup()
+	require.NoError(t, handler.RegisterSchemaWithName(versionedItem{}, "versioned_items"))
+
+	item := &versionedItem{Name: "a"}
+	item.ID = "v-1"
+	require.NoError(t, handler.Create(nil, item))
+	assert.Equal(t, int64(1), item.GetObjectVersion().SeqNo)
+
+	first := &versionedItem{}
+	first.ID = "v-1"
+	_, err := handler.Get(nil, first)
+	require.NoError(t, err)
+	second := &versionedItem{}
+	second.ID = "v-1"
+	_, err = handler.Get(nil, second)
+	require.NoError(t, err)
+
+	first.Name = "first"
+	require.NoError(t, handler.Update(nil, first))
+	assert.Equal(t, int64(2), first.GetObjectVersion().SeqNo)
+
+	second.Name = "second"
+	err = handler.Update(nil, second)
+	assert.True(t, orm.IsVersionConflict(err), "stale update: %v", err)
+	assert.Equal(t, 409, errors.HTTPCode(err))
+	err = handler.Save(nil, second)
+	assert.True(t, orm.IsVersionConflict(err), "stale save: %v", err)
+
+	// no expected version, written unconditionally
+	second.SetObjectVersion(nil)
+	require.NoError(t, handler.Save(nil, second))
+	assert.Equal(t, int64(3), second.GetObjectVersion().SeqNo)
+
+	missing := &versionedItem{}
+	missing.ID = "v-missing"
+	missing.SetObjectVersion(&orm.ObjectVersion{SeqNo: 1})
+	assert.Equal(t, ErrNotFound, handler.Update(nil, missing))
+}
+
+func TestSQLiteORM_VersionColumnAddedToExistingTable(t *testing.T) {
+	handler := &SQLiteORM{Config: SQLiteConfig{Enabled: true, DBPath: filepath.Join(t.TempDir(), "legacy.db")}}
+	require.NoError(t, handler.Open())
+	defer handler.Close()
+
+	_, err := handler.DB.Exec(`CREATE TABLE [pre_version_items] (id TEXT PRIMARY KEY, raw JSON NOT NULL)`)
+	require.NoError(t, err)
+	_, err = handler.DB.Exec(`INSERT INTO [pre_version_items] (id, raw) VALUES ('old', '{"id":"old","name":"old"}')`)
+	require.NoError(t, err)
+
+	require.NoError(t, handler.RegisterSchemaWithName(legacyItem{}, "pre_version_items"))
+
+	item := &legacyItem{}
+	item.ID = "old"
+	exists, err := handler.Get(nil, item)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, int64(0), item.GetObjectVersion().SeqNo)
+
+	item.Name = "new"
+	require.NoError(t, handler.Update(nil, item))
+	assert.Equal(t, int64(1), item.GetObjectVersion().SeqNo)
+}
@@ -0,0 +1,176 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/orm"
+	_ "infini.sh/framework/modules/security/orm_hooks"
+)
+
+type watchedItem struct {
+	orm.ORMObjectBase
+	Name string `json:"name,omitempty" elastic_mapping:"name: { type: keyword }"`
+}
+
+func nextChange(t *testing.T, ch <-chan orm.ChangeEvent) orm.ChangeEvent {
+	t.Helper()
+	select {
+	case event, ok := <-ch:
+		require.True(t, ok, "watch channel closed")
+		return event
+	case <-time.After(3 * time.Second):
+		t.Fatal("no change event")
+	}
+	return orm.ChangeEvent{}
+}
+
+func noChange(t *testing.T, ch <-chan orm.ChangeEvent, wait time.Duration) {
+	t.Helper()
+	select {
+	case event := <-ch:
+		t.Fatalf("unexpected event %v", event)
+	case <-time.After(wait):
+	}
+}
+
+func TestORMWatch(t *testing.T) {
+	handler, cleanup := setupTestDB(t)
+	defer cleanup()
+	require.NoError(t, handler.RegisterSchemaWithName(watchedItem{}, "watched_items"))
+	orm.MustRegisterSchemaWithIndexName(watchedItem{}, "watched_items")
+	orm.Register("sqlite-watch", handler)
+
+	interval, every := orm.WatchPollInterval, orm.WatchFullScanEvery
+	orm.WatchPollInterval, orm.WatchFullScanEvery = 50*time.Millisecond, 2
+	defer func() { orm.WatchPollInterval, orm.WatchFullScanEvery = interval, every }()
+
+	at := func(d time.Duration) *time.Time {
+		v := time.Now().Add(d)
+		return &v
+	}
+	require.NoError(t, handler.Create(nil, &watchedItem{ORMObjectBase: orm.ORMObjectBase{ID: "w1", Updated: at(0)}, Name: "initial"}))
+
+	_, err := orm.Watch(orm.NewContext(), "watched_items", nil)
+	assert.Equal(t, orm.ErrWatchNotCancellable, err)
+	parent, cancel := context.WithCancel(context.Background())
+	_, err = orm.Watch(orm.NewContextWithParent(parent), "not_registered", nil)
+	assert.Error(t, err)
+
+	ch, err := orm.Watch(orm.NewContextWithParent(parent), "watched_items", nil)
+	require.NoError(t, err)
+	deletes, err := orm.Watch(orm.NewContextWithParent(parent), "watched_items", func(e *orm.ChangeEvent) bool {
+		return e.Type == orm.ChangeDelete
+	})
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond) //the initial scan emits nothing
+
+	//writes by another process
+	require.NoError(t, handler.Create(nil, &watchedItem{ORMObjectBase: orm.ORMObjectBase{ID: "w2", Updated: at(time.Second)}, Name: "created"}))
+	event := nextChange(t, ch)
+	assert.Equal(t, orm.ChangeCreate, event.Type)
+	assert.Equal(t, orm.ChangeSourcePoll, event.Source)
+	assert.Equal(t, "w2", event.ID)
+	assert.Equal(t, "created", event.After.(*watchedItem).Name)
+
+	require.NoError(t, handler.Save(nil, &watchedItem{ORMObjectBase: orm.ORMObjectBase{ID: "w1", Updated: at(2 * time.Second)}, Name: "changed"}))
+	event = nextChange(t, ch)
+	assert.Equal(t, orm.ChangeUpdate, event.Type)
+	assert.Equal(t, "initial", event.Before.(*watchedItem).Name)
+	assert.Equal(t, "changed", event.After.(*watchedItem).Name)
+
+	require.NoError(t, handler.Delete(nil, &watchedItem{ORMObjectBase: orm.ORMObjectBase{ID: "w2"}}))
+	event = nextChange(t, ch)
+	assert.Equal(t, orm.ChangeDelete, event.Type)
+	assert.Equal(t, "w2", event.ID)
+	assert.Equal(t, "created", event.Before.(*watchedItem).Name)
+	assert.Equal(t, "w2", nextChange(t, deletes).ID)
+
+	//a local write is announced once, by the post hook of orm_hooks or by a
+	//poll that got there first
+	require.NoError(t, orm.Save(orm.NewContext(), &watchedItem{ORMObjectBase: orm.ORMObjectBase{ID: "w1"}, Name: "local"}))
+	event = nextChange(t, ch)
+	assert.Equal(t, orm.ChangeUpdate, event.Type)
+	assert.Equal(t, "local", event.After.(*watchedItem).Name)
+	noChange(t, ch, 300*time.Millisecond)
+
+	cancel()
+	for _, c := range []<-chan orm.ChangeEvent{ch, deletes} {
+		select {
+		case _, ok := <-c:
+			assert.False(t, ok)
+		case <-time.After(time.Second):
+			t.Fatal("watch channel not closed")
+		}
+	}
+	time.Sleep(50 * time.Millisecond) //the tracker stops with the last watcher
+
+	//without incremental polls, local writes only arrive through the hook
+	orm.WatchPollInterval = time.Hour
+	parent, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	ch, err = orm.Watch(orm.NewContextWithParent(parent), "watched_items", nil)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	require.NoError(t, orm.Save(orm.NewContext(), &watchedItem{ORMObjectBase: orm.ORMObjectBase{ID: "w1"}, Name: "hooked"}))
+	event = nextChange(t, ch)
+	assert.Equal(t, orm.ChangeSourceLocal, event.Source)
+	assert.Equal(t, "local", event.Before.(*watchedItem).Name)
+	assert.Equal(t, "hooked", event.After.(*watchedItem).Name)
+
+	//writes of a transaction are announced after the commit, and not at all
+	//when it rolls back
+	err = orm.Transaction(orm.NewContext(), func(tx orm.Tx) error {
+		require.NoError(t, tx.Create(orm.NewContext(), &watchedItem{ORMObjectBase: orm.ORMObjectBase{ID: "w3"}, Name: "rolled back"}))
+		return errors.New("abort")
+	})
+	assert.Error(t, err)
+	noChange(t, ch, 100*time.Millisecond)
+
+	err = orm.Transaction(orm.NewContext(), func(tx orm.Tx) error {
+		require.NoError(t, tx.Create(nil, &watchedItem{ORMObjectBase: orm.ORMObjectBase{ID: "w4"}, Name: "committed"}))
+		noChange(t, ch, 100*time.Millisecond)
+		return nil
+	})
+	require.NoError(t, err)
+	event = nextChange(t, ch)
+	assert.Equal(t, orm.ChangeCreate, event.Type)
+	assert.Equal(t, orm.ChangeSourceLocal, event.Source)
+	assert.Equal(t, "w4", event.ID)
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("watch channel not closed")
+	}
+}
@@ -40,6 +40,7 @@ import (
 	"github.com/dgraph-io/badger/v4"
 	"github.com/dgraph-io/badger/v4/options"
 	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/kv"
 	"infini.sh/framework/core/util"
 )
 
@@ -316,6 +317,59 @@ func (filter *Module) AddValue(bucket string, key []byte, value []byte) error {
 	return err
 }
 
+var _ kv.KVTTLStore = (*Module)(nil)
+
+// AddValueWithTTL relies on badger's native entry ttl, which has a
+// granularity of one second.
+func (filter *Module) AddValueWithTTL(bucket string, key []byte, value []byte, ttl time.Duration) error {
+	if filter.closed {
+		return errors.New("module closed")
+	}
+
+	stats.Increment("badger", bucket+"::add_ttl")
+
+	if filter.cfg.SingleBucketMode {
+		key = joinKey(bucket, key)
+	}
+	bkt := filter.getOrInitBucket(bucket)
+	return bkt.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(key, value).WithTTL(ttl))
+	})
+}
+
+func (filter *Module) GetValueWithMeta(bucket string, key []byte) ([]byte, *kv.ValueMeta, error) {
+	if filter.closed {
+		return nil, nil, errors.New("module closed")
+	}
+
+	stats.Increment("badger", bucket+"::get")
+
+	if filter.cfg.SingleBucketMode {
+		key = joinKey(bucket, key)
+	}
+
+	var valCopy []byte
+	var meta *kv.ValueMeta
+	bkt := filter.getOrInitBucket(bucket)
+	err := bkt.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				return nil
+			}
+			return err
+		}
+
+		meta = &kv.ValueMeta{}
+		if item.ExpiresAt() > 0 {
+			meta.ExpiresAt = time.Unix(int64(item.ExpiresAt()), 0)
+		}
+		valCopy, err = item.ValueCopy(nil)
+		return err
+	})
+	return valCopy, meta, err
+}
+
 func (filter *Module) ExistsKey(bucket string, key []byte) (bool, error) {
 	ok := filter.Exists(bucket, key)
 	return ok, nil
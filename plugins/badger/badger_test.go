@@ -0,0 +1,63 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+package badger
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValueWithTTL(t *testing.T) {
+	m := newTestModule(t)
+
+	bucket := "ttl_test"
+	assert.NoError(t, m.AddValueWithTTL(bucket, []byte("session"), []byte("1"), time.Second))
+	assert.NoError(t, m.AddValue(bucket, []byte("forever"), []byte("2")))
+
+	v, meta, err := m.GetValueWithMeta(bucket, []byte("session"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(v))
+	assert.False(t, meta.ExpiresAt.IsZero())
+
+	v, meta, err = m.GetValueWithMeta(bucket, []byte("forever"))
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(v))
+	assert.True(t, meta.ExpiresAt.IsZero())
+
+	time.Sleep(2 * time.Second)
+
+	v, meta, err = m.GetValueWithMeta(bucket, []byte("session"))
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+	assert.Nil(t, meta)
+
+	ok, err := m.ExistsKey(bucket, []byte("session"))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
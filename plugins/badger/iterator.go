@@ -0,0 +1,192 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package badger
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+	"infini.sh/framework/core/kv"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+)
+
+var _ kv.KVIterator = (*Module)(nil)
+
+func (filter *Module) bucketPrefix(bucket string) []byte {
+	if filter.cfg.SingleBucketMode {
+		return joinKey(bucket, nil)
+	}
+	return nil
+}
+
+func (filter *Module) ScanPrefix(bucket string, prefix []byte, fn func(key, value []byte) bool) error {
+	return filter.scan(bucket, prefix, prefix, nil, fn)
+}
+
+func (filter *Module) ScanRange(bucket string, start, end []byte, fn func(key, value []byte) bool) error {
+	return filter.scan(bucket, nil, start, end, fn)
+}
+
+// scan walks the keys of bucket that carry prefix, starting at start and
+// stopping before end, all three given without the bucket prefix.
+func (filter *Module) scan(bucket string, prefix, start, end []byte, fn func(key, value []byte) bool) error {
+	if filter.closed {
+		return errors.New("module closed")
+	}
+
+	stats.Increment("badger", bucket+"::scan")
+
+	bucketPrefix := filter.bucketPrefix(bucket)
+	fullPrefix := append(append([]byte{}, bucketPrefix...), prefix...)
+	seek := append(append([]byte{}, bucketPrefix...), start...)
+	var fullEnd []byte
+	if end != nil {
+		fullEnd = append(append([]byte{}, bucketPrefix...), end...)
+	}
+
+	bkt := filter.getOrInitBucket(bucket)
+	return bkt.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = fullPrefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(seek); it.ValidForPrefix(fullPrefix); it.Next() {
+			item := it.Item()
+			if fullEnd != nil && bytes.Compare(item.Key(), fullEnd) >= 0 {
+				break
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			key := item.KeyCopy(nil)[len(bucketPrefix):]
+			if !fn(key, value) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// ListBuckets returns the buckets opened by this process together with the
+// ones persisted under the data path.
+func (filter *Module) ListBuckets() ([]string, error) {
+	names := map[string]struct{}{}
+	buckets.Range(func(key, value any) bool {
+		names[key.(string)] = struct{}{}
+		return true
+	})
+
+	if !filter.cfg.InMemoryMode && util.FileExists(filter.cfg.Path) {
+		entries, err := os.ReadDir(filter.cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range entries {
+			if v.IsDir() {
+				names[v.Name()] = struct{}{}
+			}
+		}
+	}
+
+	result := make([]string, 0, len(names))
+	for k := range names {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// DeleteBucket drops every key of the bucket, then closes and removes its
+// database, the shared single-bucket database is only emptied.
+func (filter *Module) DeleteBucket(bucket string) error {
+	if filter.closed {
+		return errors.New("module closed")
+	}
+
+	stats.Increment("badger", bucket+"::delete_bucket")
+
+	dir := path.Join(filter.cfg.Path, bucket)
+	if _, ok := buckets.Load(bucket); !ok && (filter.cfg.InMemoryMode || !util.FileExists(dir)) {
+		return nil
+	}
+
+	bkt := filter.getOrInitBucket(bucket)
+	if err := bkt.DropAll(); err != nil {
+		return err
+	}
+
+	if bkt == filter.bucket {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	buckets.Delete(bucket)
+	if err := bkt.Close(); err != nil {
+		return err
+	}
+	if !filter.cfg.InMemoryMode {
+		return os.RemoveAll(dir)
+	}
+	return nil
+}
+
+func (filter *Module) BatchWrite(bucket string, ops []kv.WriteOp) error {
+	if filter.closed {
+		return errors.New("module closed")
+	}
+
+	stats.Increment("badger", bucket+"::batch_write")
+
+	bkt := filter.getOrInitBucket(bucket)
+	return bkt.Update(func(txn *badger.Txn) error {
+		for _, op := range ops {
+			key := op.Key
+			if filter.cfg.SingleBucketMode {
+				key = joinKey(bucket, key)
+			}
+			var err error
+			if op.Delete {
+				err = txn.Delete(key)
+			} else {
+				err = txn.Set(key, op.Value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
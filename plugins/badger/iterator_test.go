@@ -0,0 +1,105 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package badger
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	. "infini.sh/framework/core/env"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/kv"
+)
+
+// newTestModule opens a module under a fresh path, the opened databases are
+// kept in the package level bucket registry, so tests use distinct buckets.
+func newTestModule(t *testing.T) *Module {
+	global.RegisterEnv(EmptyEnv())
+
+	dir, err := os.MkdirTemp("", "badger_")
+	assert.NoError(t, err)
+
+	m := &Module{cfg: &Config{
+		Path:                    dir,
+		SingleBucketMode:        true,
+		MemTableSize:            10 * 1024 * 1024,
+		ValueLogFileSize:        1 << 20,
+		ValueThreshold:          1048576,
+		ValueLogMaxEntries:      1000000,
+		NumMemtables:            1,
+		NumLevelZeroTables:      1,
+		NumLevelZeroTablesStall: 2,
+	}}
+	assert.NoError(t, m.Open())
+	return m
+}
+
+func TestIterator(t *testing.T) {
+	m := newTestModule(t)
+
+	bucket := "iterator_test"
+	assert.NoError(t, m.BatchWrite(bucket, []kv.WriteOp{
+		{Key: []byte("a/1"), Value: []byte("1")},
+		{Key: []byte("a/2"), Value: []byte("2")},
+		{Key: []byte("b/1"), Value: []byte("3")},
+		{Key: []byte("c/1"), Value: []byte("4")},
+	}))
+	assert.NoError(t, m.AddValue("iterator_other", []byte("a/3"), []byte("5")))
+
+	var keys []string
+	assert.NoError(t, m.ScanPrefix(bucket, []byte("a/"), func(key, value []byte) bool {
+		keys = append(keys, string(key)+"="+string(value))
+		return true
+	}))
+	assert.Equal(t, []string{"a/1=1", "a/2=2"}, keys)
+
+	keys = nil
+	assert.NoError(t, m.ScanRange(bucket, []byte("a/2"), []byte("c/1"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"a/2", "b/1"}, keys)
+
+	assert.NoError(t, m.BatchWrite(bucket, []kv.WriteOp{{Key: []byte("a/1"), Delete: true}}))
+	v, err := m.GetValue(bucket, []byte("a/1"))
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	names, err := m.ListBuckets()
+	assert.NoError(t, err)
+	assert.Contains(t, names, bucket)
+
+	assert.NoError(t, m.DeleteBucket(bucket))
+	keys = nil
+	assert.NoError(t, m.ScanPrefix(bucket, nil, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Empty(t, keys)
+}
@@ -97,6 +97,7 @@ func (module *Module) Setup() {
 	if module.cfg.Enabled {
 		filter.Register("badger", module)
 		kv.Register("badger", module)
+		kv.LoadRoutingConfig()
 		api.HandleAPIMethod(api.GET, "/badger/stats", module.dumpKeyStats)
 	}
 
@@ -912,7 +912,13 @@ READ_DOCS:
 				msgSize := mainBuf.GetMessageSize()
 				msgCount := mainBuf.GetMessageCount()
 
-				if (bulkSizeInByte > 0 && msgSize > (bulkSizeInByte)) || (msgCount > 0 && processor.config.BulkConfig.BulkMaxDocsCount > 0 && msgCount > processor.config.BulkConfig.BulkMaxDocsCount) {
+				//adaptive bulk resizes batches between requests
+				if bulkProcessor.Adaptive != nil {
+					bulkSizeInByte = bulkProcessor.GetBulkSizeInBytes()
+				}
+				bulkMaxDocsCount := bulkProcessor.GetBulkMaxDocsCount()
+
+				if (bulkSizeInByte > 0 && msgSize > (bulkSizeInByte)) || (msgCount > 0 && bulkMaxDocsCount > 0 && msgCount > bulkMaxDocsCount) {
 					if global.Env().IsDebug {
 						log.Debugf("slice worker, worker:[%v], consuming [%v], slice_id:%v, hit buffer limit, size:%v, count:%v, submit now", workerID, qConfig.Name, sliceID, msgSize, msgCount)
 					}
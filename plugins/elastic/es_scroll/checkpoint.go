@@ -0,0 +1,90 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package es_scroll
+
+import (
+	"encoding/json"
+
+	"infini.sh/framework/core/kv"
+	"infini.sh/framework/core/util"
+)
+
+const checkpointBucket = "es_scroll_checkpoint"
+
+// checkpoint is the progress of one task, saved after every page so a
+// restarted pipeline skips the finished units and resumes the others.
+type checkpoint struct {
+	Mode  string       `json:"mode"`
+	Units []*unitState `json:"units"`
+}
+
+// unitState is one partition, or one slice of a partition with sliced
+// scroll. A unit whose cursor expired is read again from its start, the
+// documents keep their _id so replaying them is idempotent.
+type unitState struct {
+	Partition int                    `json:"partition"`
+	Slice     int                    `json:"slice"`
+	Slices    int                    `json:"slices"`
+	Query     map[string]interface{} `json:"query,omitempty"`
+	Done      bool                   `json:"done"`
+	Docs      int64                  `json:"docs"`
+
+	ScrollID string `json:"scroll_id,omitempty"`
+	PitID    string `json:"pit_id,omitempty"`
+	// SearchAfter is kept as raw JSON, long sort values don't survive a
+	// float64 round trip.
+	SearchAfter json.RawMessage `json:"search_after,omitempty"`
+}
+
+func (c *checkpoint) pending() []*unitState {
+	var units []*unitState
+	for _, u := range c.Units {
+		if !u.Done {
+			units = append(units, u)
+		}
+	}
+	return units
+}
+
+// checkpointStore persists checkpoints by task id.
+type checkpointStore interface {
+	load(taskID string) (*checkpoint, error)
+	save(taskID string, c *checkpoint) error
+}
+
+type kvCheckpointStore struct{}
+
+func (s *kvCheckpointStore) load(taskID string) (*checkpoint, error) {
+	data, err := kv.GetValue(checkpointBucket, []byte(taskID))
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	c := &checkpoint{}
+	err = util.FromJSONBytes(data, c)
+	return c, err
+}
+
+func (s *kvCheckpointStore) save(taskID string, c *checkpoint) error {
+	return kv.AddValue(checkpointBucket, []byte(taskID), util.MustToJSONBytes(c))
+}
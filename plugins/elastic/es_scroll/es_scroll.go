@@ -0,0 +1,591 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package es_scroll
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/buger/jsonparser"
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/stats"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+const (
+	ModeAuto   = "auto"
+	ModePIT    = "pit"
+	ModeScroll = "scroll"
+)
+
+// EsScrollProcessor reads indices of a cluster with sliced scroll or point
+// in time and pushes the documents as bulk requests to a queue, for the
+// bulk_indexing processor to write them into the target cluster.
+type EsScrollProcessor struct {
+	initLocker sync.Mutex
+	config     Config
+
+	client   elastic.API
+	metadata *elastic.ElasticsearchMetadata
+	store    checkpointStore
+	producer queue.ProducerAPI
+	queueID  string
+
+	stateLock  sync.Mutex
+	checkpoint *checkpoint
+}
+
+type PartitionConfig struct {
+	FieldName string      `config:"field"`
+	FieldType string      `config:"type"`
+	Step      interface{} `config:"step"`
+}
+
+type Config struct {
+	Elasticsearch string                 `config:"elasticsearch"`
+	Indices       string                 `config:"indices"`
+	Query         map[string]interface{} `config:"query"`
+	Source        []string               `config:"source"`
+
+	Mode      string        `config:"mode"`
+	BatchSize int           `config:"batch_size"`
+	KeepAlive string        `config:"keep_alive"`
+	SliceSize int           `config:"slice_size"`
+	Sort      []interface{} `config:"sort"`
+
+	NumOfWorkers int              `config:"worker_size"`
+	Partition    *PartitionConfig `config:"partition"`
+
+	TargetIndex string `config:"target_index"`
+	TargetType  string `config:"target_type"`
+
+	TaskID string `config:"task_id"`
+
+	OutputQueue struct {
+		Name   string                 `config:"name"`
+		Labels map[string]interface{} `config:"label" json:"label,omitempty"`
+	} `config:"output_queue"`
+}
+
+func init() {
+	pipeline.RegisterProcessorPlugin("es_scroll", New)
+}
+
+func New(c *config.Config) (pipeline.Processor, error) {
+	cfg := Config{
+		Mode:         ModeAuto,
+		BatchSize:    1000,
+		KeepAlive:    "5m",
+		SliceSize:    1,
+		NumOfWorkers: 1,
+	}
+
+	if err := c.Unpack(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unpack the configuration of es_scroll processor: %s", err)
+	}
+
+	if cfg.Elasticsearch == "" {
+		return nil, errors.New("elasticsearch can't be nil")
+	}
+	if cfg.Indices == "" {
+		return nil, errors.New("indices can't be nil")
+	}
+	if cfg.OutputQueue.Name == "" {
+		return nil, errors.New("name of output_queue can't be nil")
+	}
+	switch cfg.Mode {
+	case ModeAuto, ModePIT, ModeScroll:
+	default:
+		return nil, fmt.Errorf("invalid mode [%v], expect one of auto, pit or scroll", cfg.Mode)
+	}
+	if cfg.Partition != nil {
+		switch cfg.Partition.FieldType {
+		case elastic.PartitionByDate, elastic.PartitionByNumber:
+		default:
+			return nil, fmt.Errorf("invalid partition type [%v], expect date or number", cfg.Partition.FieldType)
+		}
+		if cfg.Partition.FieldName == "" || cfg.Partition.Step == nil {
+			return nil, errors.New("partition needs a field and a step")
+		}
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1000
+	}
+	if cfg.SliceSize <= 0 {
+		cfg.SliceSize = 1
+	}
+	if cfg.NumOfWorkers <= 0 {
+		cfg.NumOfWorkers = 1
+	}
+	if cfg.TaskID == "" {
+		cfg.TaskID = fmt.Sprintf("%v/%v", cfg.Elasticsearch, cfg.Indices)
+	}
+
+	return &EsScrollProcessor{config: cfg}, nil
+}
+
+func (processor *EsScrollProcessor) Name() string {
+	return "es_scroll"
+}
+
+// init resolves the source cluster and the output queue on first use,
+// the cluster and the queue module may come up after the pipeline.
+func (processor *EsScrollProcessor) init() error {
+	processor.initLocker.Lock()
+	defer processor.initLocker.Unlock()
+
+	if processor.client == nil {
+		processor.metadata = elastic.GetMetadata(processor.config.Elasticsearch)
+		if processor.metadata == nil {
+			return fmt.Errorf("cluster metadata [%v] not ready", processor.config.Elasticsearch)
+		}
+		processor.client = elastic.GetClientNoPanic(processor.config.Elasticsearch)
+		if processor.client == nil {
+			return fmt.Errorf("elasticsearch client [%v] not ready", processor.config.Elasticsearch)
+		}
+	}
+
+	if processor.producer == nil {
+		labels := util.MapStr{}
+		labels["type"] = "es_scroll"
+		for k, v := range processor.config.OutputQueue.Labels {
+			labels[k] = v
+		}
+		queueConfig := queue.AdvancedGetOrInitConfig("", processor.config.OutputQueue.Name, labels)
+		queueConfig.ReplaceLabels(labels)
+		producer, err := queue.AcquireProducer(queueConfig)
+		if err != nil {
+			return err
+		}
+		processor.queueID = queueConfig.ID
+		processor.producer = producer
+	}
+
+	if processor.store == nil {
+		processor.store = &kvCheckpointStore{}
+	}
+	return nil
+}
+
+func (processor *EsScrollProcessor) Process(ctx *pipeline.Context) error {
+	if err := processor.init(); err != nil {
+		return err
+	}
+
+	state, err := processor.store.load(processor.config.TaskID)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state, err = processor.plan()
+		if err != nil {
+			return err
+		}
+		if err := processor.store.save(processor.config.TaskID, state); err != nil {
+			return err
+		}
+	}
+	processor.checkpoint = state
+
+	units := state.pending()
+	if len(units) == 0 {
+		log.Debugf("es_scroll task [%v] is already complete", processor.config.TaskID)
+		return nil
+	}
+	log.Debugf("es_scroll task [%v], mode: %v, %v of %v units pending", processor.config.TaskID, state.Mode, len(units), len(state.Units))
+
+	tasks := make(chan *unitState, len(units))
+	for _, u := range units {
+		tasks <- u
+	}
+	close(tasks)
+
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < processor.config.NumOfWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range tasks {
+				if ctx.IsCanceled() || global.ShuttingDown() {
+					return
+				}
+				var err error
+				if state.Mode == ModePIT {
+					err = processor.readWithPointInTime(ctx, u)
+				} else {
+					err = processor.readWithScroll(ctx, u)
+				}
+				if err != nil {
+					errLock.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errLock.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if len(state.pending()) == 0 {
+		log.Infof("es_scroll task [%v] finished, %v documents", processor.config.TaskID, processor.totalDocs())
+	}
+	return nil
+}
+
+// plan splits the source into units and picks the read mode, both are kept
+// in the checkpoint so a resumed task reads the same units the same way.
+func (processor *EsScrollProcessor) plan() (*checkpoint, error) {
+	mode, err := processor.resolveMode()
+	if err != nil {
+		return nil, err
+	}
+
+	queries := []map[string]interface{}{processor.config.Query}
+	if processor.config.Partition != nil {
+		partitions, err := elastic.GetPartitions(processor.partitionQuery(), processor.client)
+		if err != nil {
+			return nil, err
+		}
+		queries = queries[:0]
+		for _, p := range partitions {
+			filter := p.Filter
+			if p.Other && processor.config.Query != nil {
+				//the partition of documents without the field does not carry the query
+				filter = util.MapStr{"bool": util.MapStr{"must": []interface{}{p.Filter, processor.config.Query}}}
+			}
+			queries = append(queries, filter)
+		}
+	}
+
+	//sliced scroll came with Elasticsearch 5.0, the forks always have it
+	slices := 1
+	ver := processor.client.GetVersion()
+	if mode == ModeScroll && processor.config.SliceSize > 1 &&
+		(ver.Distribution != "" && ver.Distribution != elastic.Elasticsearch || ver.Major >= 5) {
+		slices = processor.config.SliceSize
+	}
+	state := &checkpoint{Mode: mode}
+	for i, q := range queries {
+		for slice := 0; slice < slices; slice++ {
+			state.Units = append(state.Units, &unitState{Partition: i, Slice: slice, Slices: slices, Query: q})
+		}
+	}
+	return state, nil
+}
+
+// resolveMode probes point in time support for the auto and pit modes.
+func (processor *EsScrollProcessor) resolveMode() (string, error) {
+	if processor.config.Mode == ModeScroll {
+		return ModeScroll, nil
+	}
+	pitID, err := processor.client.OpenPointInTime(processor.config.Indices, processor.config.KeepAlive)
+	if err == nil {
+		if err := processor.client.ClosePointInTime(pitID); err != nil {
+			log.Warnf("failed to close point in time: %v", err)
+		}
+		return ModePIT, nil
+	}
+	if errors.Is(err, elastic.ErrPointInTimeNotSupported) && processor.config.Mode == ModeAuto {
+		return ModeScroll, nil
+	}
+	return "", err
+}
+
+func (processor *EsScrollProcessor) partitionQuery() *elastic.PartitionQuery {
+	cfg := processor.config.Partition
+	step := cfg.Step
+	if cfg.FieldType == elastic.PartitionByNumber {
+		//config numbers unpack as integers, GetPartitions wants a float64
+		if v, err := strconv.ParseFloat(fmt.Sprint(step), 64); err == nil {
+			step = v
+		}
+	}
+	q := &elastic.PartitionQuery{
+		IndexName: processor.config.Indices,
+		FieldType: cfg.FieldType,
+		FieldName: cfg.FieldName,
+		Step:      step,
+	}
+	if processor.config.Query != nil {
+		q.Filter = processor.config.Query
+	}
+	return q
+}
+
+func (processor *EsScrollProcessor) searchRequest(u *unitState) *elastic.SearchRequest {
+	req := &elastic.SearchRequest{Size: processor.config.BatchSize}
+	if u.Query != nil {
+		req.Set("query", u.Query)
+	}
+	if len(processor.config.Source) > 0 {
+		req.Source = processor.config.Source
+	}
+	return req
+}
+
+func (processor *EsScrollProcessor) readWithScroll(ctx *pipeline.Context, u *unitState) error {
+	var (
+		data []byte
+		err  error
+	)
+	if u.ScrollID != "" {
+		data, err = processor.nextScroll(ctx, u.ScrollID)
+		if err != nil {
+			log.Warnf("es_scroll task [%v], scroll of partition %v slice %v expired, reading it again: %v", processor.config.TaskID, u.Partition, u.Slice, err)
+			if err := processor.update(u, func() { u.ScrollID, u.Docs = "", 0 }); err != nil {
+				return err
+			}
+			data = nil
+		}
+	}
+	first := data == nil
+	if first {
+		data, err = processor.client.NewScroll(processor.config.Indices, processor.config.KeepAlive, processor.config.BatchSize, processor.searchRequest(u), u.Slice, u.Slices)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		scrollID, _ := jsonparser.GetString(data, "_scroll_id")
+		n, _, err := processor.produce(data)
+		if err != nil {
+			return err
+		}
+		//the scan scroll of clusters before 5.0 returns no hits on the first page
+		if n == 0 && first && totalHits(data) > 0 {
+			first = false
+			if data, err = processor.nextScroll(ctx, scrollID); err != nil {
+				return err
+			}
+			continue
+		}
+		first = false
+		if n == 0 {
+			if scrollID != "" {
+				if err := processor.client.ClearScroll(scrollID); err != nil {
+					log.Debugf("failed to clear scroll: %v", err)
+				}
+			}
+			return processor.update(u, func() { u.Done, u.ScrollID = true, "" })
+		}
+		if err := processor.update(u, func() { u.ScrollID, u.Docs = scrollID, u.Docs+int64(n) }); err != nil {
+			return err
+		}
+		if ctx.IsCanceled() || global.ShuttingDown() {
+			return nil
+		}
+		data, err = processor.nextScroll(ctx, scrollID)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (processor *EsScrollProcessor) nextScroll(ctx *pipeline.Context, scrollID string) ([]byte, error) {
+	apiCtx := &elastic.APIContext{
+		Context:  ctx,
+		Client:   processor.metadata.GetHttpClient(processor.metadata.GetActiveHost()),
+		Request:  &fasthttp.Request{},
+		Response: &fasthttp.Response{},
+	}
+	return processor.client.NextScroll(apiCtx, processor.config.KeepAlive, scrollID)
+}
+
+func (processor *EsScrollProcessor) readWithPointInTime(ctx *pipeline.Context, u *unitState) error {
+	if u.PitID == "" {
+		pitID, err := processor.client.OpenPointInTime(processor.config.Indices, processor.config.KeepAlive)
+		if err != nil {
+			return err
+		}
+		if err := processor.update(u, func() { u.PitID, u.SearchAfter, u.Docs = pitID, nil, 0 }); err != nil {
+			return err
+		}
+	}
+
+	sort := processor.config.Sort
+	if len(sort) == 0 {
+		sort = defaultPointInTimeSort(processor.client.GetVersion())
+	}
+	resumed := len(u.SearchAfter) > 0
+	for {
+		req := processor.searchRequest(u)
+		req.Sort = &sort
+		if len(u.SearchAfter) > 0 {
+			req.Set("search_after", u.SearchAfter)
+		}
+		data, err := processor.client.SearchWithPointInTime(u.PitID, processor.config.KeepAlive, req)
+		if err != nil {
+			if !resumed {
+				return err
+			}
+			//the point in time expired while the task was stopped, sort values
+			//of another point in time don't apply so the unit starts over
+			log.Warnf("es_scroll task [%v], point in time of partition %v expired, reading it again: %v", processor.config.TaskID, u.Partition, err)
+			if err := processor.update(u, func() { u.PitID = "" }); err != nil {
+				return err
+			}
+			return processor.readWithPointInTime(ctx, u)
+		}
+		resumed = false
+
+		n, last, err := processor.produce(data)
+		if err != nil {
+			return err
+		}
+		pitID, _ := jsonparser.GetString(data, "pit_id")
+		if pitID == "" {
+			pitID = u.PitID
+		}
+		if n < processor.config.BatchSize {
+			if err := processor.client.ClosePointInTime(pitID); err != nil {
+				log.Debugf("failed to close point in time: %v", err)
+			}
+			return processor.update(u, func() {
+				u.Done, u.PitID, u.SearchAfter, u.Docs = true, "", nil, u.Docs+int64(n)
+			})
+		}
+		if err := processor.update(u, func() {
+			u.PitID, u.SearchAfter, u.Docs = pitID, last, u.Docs+int64(n)
+		}); err != nil {
+			return err
+		}
+		if ctx.IsCanceled() || global.ShuttingDown() {
+			return nil
+		}
+	}
+}
+
+// defaultPointInTimeSort is the cheapest total order of a point in time:
+// _shard_doc on Elasticsearch, OpenSearch has no _shard_doc and sorts by _id.
+func defaultPointInTimeSort(ver elastic.Version) []interface{} {
+	if ver.Distribution == elastic.Opensearch {
+		return []interface{}{util.MapStr{"_id": "asc"}}
+	}
+	return []interface{}{util.MapStr{"_shard_doc": "asc"}}
+}
+
+// produce pushes the hits of a search response to the output queue as one
+// bulk request, and returns the number of hits and the sort values of the
+// last one.
+func (processor *EsScrollProcessor) produce(data []byte) (int, json.RawMessage, error) {
+	var (
+		buf      bytes.Buffer
+		n        int
+		last     []byte
+		parseErr error
+	)
+	_, err := jsonparser.ArrayEach(data, func(hit []byte, dataType jsonparser.ValueType, offset int, err error) {
+		if parseErr != nil {
+			return
+		}
+		source, _, _, err := jsonparser.Get(hit, "_source")
+		if err != nil {
+			parseErr = fmt.Errorf("hit without _source: %s", util.SubString(string(hit), 0, 200))
+			return
+		}
+		id, _ := jsonparser.GetString(hit, "_id")
+		index, _ := jsonparser.GetString(hit, "_index")
+		if processor.config.TargetIndex != "" {
+			index = processor.config.TargetIndex
+		}
+		meta := util.MapStr{"_index": index, "_id": id}
+		if processor.config.TargetType != "" {
+			meta["_type"] = processor.config.TargetType
+		}
+		if routing, err := jsonparser.GetString(hit, "_routing"); err == nil && routing != "" {
+			meta["routing"] = routing
+		}
+		buf.Write(util.MustToJSONBytes(util.MapStr{"index": meta}))
+		buf.WriteByte('\n')
+		buf.Write(bytes.ReplaceAll(source, []byte("\n"), []byte(" ")))
+		buf.WriteByte('\n')
+		if sort, _, _, err := jsonparser.Get(hit, "sort"); err == nil {
+			last = append(last[:0], sort...)
+		}
+		n++
+	}, "hits", "hits")
+	if parseErr != nil {
+		return 0, nil, parseErr
+	}
+	if err != nil && err != jsonparser.KeyPathNotFoundError {
+		return 0, nil, err
+	}
+	if n == 0 {
+		return 0, nil, nil
+	}
+
+	r := []queue.ProduceRequest{{Topic: processor.queueID, Data: buf.Bytes()}}
+	if _, err := processor.producer.Produce(&r); err != nil {
+		return 0, nil, fmt.Errorf("failed to push documents to queue [%v]: %w", processor.config.OutputQueue.Name, err)
+	}
+	stats.IncrementBy("es_scroll", processor.config.TaskID+".docs", int64(n))
+	return n, last, nil
+}
+
+func totalHits(data []byte) int64 {
+	if total, err := jsonparser.GetInt(data, "hits", "total"); err == nil {
+		return total
+	}
+	total, _ := jsonparser.GetInt(data, "hits", "total", "value")
+	return total
+}
+
+// update changes a unit and saves the checkpoint, units are updated by
+// several workers while the checkpoint is saved as a whole.
+func (processor *EsScrollProcessor) update(u *unitState, change func()) error {
+	processor.stateLock.Lock()
+	defer processor.stateLock.Unlock()
+	change()
+	return processor.store.save(processor.config.TaskID, processor.checkpoint)
+}
+
+func (processor *EsScrollProcessor) totalDocs() int64 {
+	processor.stateLock.Lock()
+	defer processor.stateLock.Unlock()
+	var total int64
+	for _, u := range processor.checkpoint.Units {
+		total += u.Docs
+	}
+	return total
+}
@@ -0,0 +1,261 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package es_scroll
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/elastic/elastictest"
+	"infini.sh/framework/core/kv/kvtest"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/modules/elastic/common"
+)
+
+// memProducer collects the bulk requests, failing once failAfter requests
+// went through when failAfter is set.
+type memProducer struct {
+	lock      sync.Mutex
+	requests  [][]byte
+	failAfter int
+}
+
+func (p *memProducer) Produce(reqs *[]queue.ProduceRequest) (*[]queue.ProduceResponse, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.failAfter > 0 && len(p.requests) >= p.failAfter {
+		return nil, errors.New("queue is full")
+	}
+	for _, r := range *reqs {
+		p.requests = append(p.requests, append([]byte(nil), r.Data...))
+	}
+	return &[]queue.ProduceResponse{}, nil
+}
+
+func (p *memProducer) Close() error {
+	return nil
+}
+
+// ids returns the _id of every index action, and the target indices seen.
+func (p *memProducer) ids(t *testing.T) ([]string, map[string]bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var ids []string
+	indices := map[string]bool{}
+	for _, req := range p.requests {
+		lines := strings.Split(strings.TrimSpace(string(req)), "\n")
+		require.Equal(t, 0, len(lines)%2)
+		for i := 0; i < len(lines); i += 2 {
+			meta := util.MapStr{}
+			require.NoError(t, util.FromJSONBytes([]byte(lines[i]), &meta))
+			action, _ := meta["index"].(map[string]interface{})
+			ids = append(ids, util.ToString(action["_id"]))
+			indices[util.ToString(action["_index"])] = true
+		}
+	}
+	return ids, indices
+}
+
+// newSource starts a fake cluster with docs documents in the logs index,
+// every tenth one without the n field.
+func newSource(t *testing.T, opts elastictest.Options, docs int) elastic.API {
+	t.Helper()
+	srv := elastictest.NewServer(opts)
+	t.Cleanup(srv.Close)
+
+	elastic.ResetClientCacheForTest()
+	elastic.RegisterClientProvider(common.InitClientWithConfig)
+	t.Cleanup(elastic.ResetClientCacheForTest)
+	cfg := elastic.ElasticsearchConfig{}
+	cfg.ID = "source-" + util.GetUUID()
+	cfg.Name = cfg.ID
+	cfg.Endpoint = srv.URL
+	cfg.Enabled = true
+	client, err := elastic.GetOrCreateClient(cfg)
+	require.NoError(t, err)
+
+	var bulk strings.Builder
+	for i := 0; i < docs; i++ {
+		meta := util.MapStr{"_index": "logs", "_id": fmt.Sprint(i)}
+		if client.GetMajorVersion() < 7 {
+			meta["_type"] = "doc"
+		}
+		doc := util.MapStr{"msg": fmt.Sprintf("line %d", i)}
+		if i%10 != 9 {
+			doc["n"] = i
+		}
+		bulk.WriteString(util.MustToJSON(util.MapStr{"index": meta}) + "\n")
+		bulk.WriteString(util.MustToJSON(doc) + "\n")
+	}
+	_, err = client.Bulk([]byte(bulk.String()))
+	require.NoError(t, err)
+	return client
+}
+
+func newProcessor(t *testing.T, client elastic.API, settings util.MapStr, store checkpointStore, producer *memProducer) *EsScrollProcessor {
+	t.Helper()
+	kvtest.Use("es_scroll_test")
+	metadata := client.(interface {
+		GetMetadata() *elastic.ElasticsearchMetadata
+	}).GetMetadata()
+	cfg := util.MapStr{
+		"elasticsearch": metadata.Config.ID,
+		"indices":       "logs",
+		"output_queue":  util.MapStr{"name": "migrate"},
+	}
+	for k, v := range settings {
+		cfg[k] = v
+	}
+	c, err := config.NewConfigFrom(cfg)
+	require.NoError(t, err)
+	p, err := New(c)
+	require.NoError(t, err)
+	processor := p.(*EsScrollProcessor)
+	processor.client = client
+	processor.metadata = metadata
+	processor.store = store
+	processor.producer = producer
+	processor.queueID = "migrate"
+	return processor
+}
+
+func distinct(ids []string) map[string]bool {
+	out := map[string]bool{}
+	for _, id := range ids {
+		out[id] = true
+	}
+	return out
+}
+
+func TestSlicedScrollWithPartitions(t *testing.T) {
+	for _, opts := range []elastictest.Options{
+		{Distribution: elastictest.Elasticsearch, Version: "5.6.16"},
+		{Distribution: elastictest.Elasticsearch, Version: "6.8.23"},
+		{Distribution: elastictest.Easysearch, Version: "1.12.0"},
+	} {
+		t.Run(opts.Distribution+"-"+opts.Version, func(t *testing.T) {
+			client := newSource(t, opts, 37)
+			store := &kvCheckpointStore{}
+			producer := &memProducer{}
+			processor := newProcessor(t, client, util.MapStr{
+				"batch_size":   4,
+				"slice_size":   2,
+				"worker_size":  3,
+				"target_index": "logs-copy",
+				"partition":    util.MapStr{"field": "n", "type": "number", "step": 10},
+			}, store, producer)
+
+			require.NoError(t, processor.Process(&pipeline.Context{Context: t.Context()}))
+			ids, indices := producer.ids(t)
+			assert.Len(t, ids, 37)
+			assert.Len(t, distinct(ids), 37)
+			assert.Equal(t, map[string]bool{"logs-copy": true}, indices)
+
+			state, err := store.load(processor.config.TaskID)
+			require.NoError(t, err)
+			assert.Equal(t, ModeScroll, state.Mode)
+			//four number partitions and the one without the field, two slices each
+			assert.Len(t, state.Units, 10)
+			assert.Empty(t, state.pending())
+
+			//a finished task does nothing when the pipeline runs again
+			require.NoError(t, processor.Process(&pipeline.Context{Context: t.Context()}))
+			ids, _ = producer.ids(t)
+			assert.Len(t, ids, 37)
+		})
+	}
+}
+
+func TestPointInTimeResume(t *testing.T) {
+	for _, opts := range []elastictest.Options{
+		{Distribution: elastictest.Elasticsearch, Version: "8.15.0"},
+		{Distribution: elastictest.Opensearch, Version: "2.17.0"},
+	} {
+		t.Run(opts.Distribution+"-"+opts.Version, func(t *testing.T) {
+			client := newSource(t, opts, 23)
+			store := &kvCheckpointStore{}
+			producer := &memProducer{failAfter: 2}
+			processor := newProcessor(t, client, util.MapStr{"batch_size": 5, "query": util.MapStr{"match_all": util.MapStr{}}}, store, producer)
+
+			err := processor.Process(&pipeline.Context{Context: t.Context()})
+			assert.ErrorContains(t, err, "queue is full")
+			state, err := store.load(processor.config.TaskID)
+			require.NoError(t, err)
+			assert.Equal(t, ModePIT, state.Mode)
+			require.Len(t, state.Units, 1)
+			assert.EqualValues(t, 10, state.Units[0].Docs)
+			assert.NotEmpty(t, state.Units[0].PitID)
+			assert.NotEmpty(t, state.Units[0].SearchAfter)
+
+			//the restarted task continues after the last pushed page
+			producer.failAfter = 0
+			processor = newProcessor(t, client, util.MapStr{"batch_size": 5}, store, producer)
+			require.NoError(t, processor.Process(&pipeline.Context{Context: t.Context()}))
+			ids, _ := producer.ids(t)
+			assert.Len(t, ids, 23)
+			assert.Len(t, distinct(ids), 23)
+			state, _ = store.load(processor.config.TaskID)
+			assert.True(t, state.Units[0].Done)
+			assert.EqualValues(t, 23, state.Units[0].Docs)
+		})
+	}
+}
+
+func TestExpiredPointInTimeRestartsUnit(t *testing.T) {
+	client := newSource(t, elastictest.Options{Version: "8.15.0"}, 12)
+	store := &kvCheckpointStore{}
+	producer := &memProducer{failAfter: 1}
+	processor := newProcessor(t, client, util.MapStr{"batch_size": 5}, store, producer)
+	assert.Error(t, processor.Process(&pipeline.Context{Context: t.Context()}))
+
+	state, _ := store.load(processor.config.TaskID)
+	require.Len(t, state.Units, 1)
+	state.Units[0].PitID = "expired"
+	require.NoError(t, store.save(processor.config.TaskID, state))
+
+	producer.failAfter = 0
+	processor = newProcessor(t, client, util.MapStr{"batch_size": 5}, store, producer)
+	require.NoError(t, processor.Process(&pipeline.Context{Context: t.Context()}))
+	ids, _ := producer.ids(t)
+	//the first page is pushed again, the documents keep their ids
+	assert.Len(t, ids, 17)
+	assert.Len(t, distinct(ids), 12)
+	state, _ = store.load(processor.config.TaskID)
+	assert.EqualValues(t, 12, state.Units[0].Docs)
+}
+
+func TestPointInTimeModeNeedsSupport(t *testing.T) {
+	client := newSource(t, elastictest.Options{Version: "7.9.3"}, 3)
+	processor := newProcessor(t, client, util.MapStr{"mode": ModePIT}, &kvCheckpointStore{}, &memProducer{})
+	assert.ErrorIs(t, processor.Process(&pipeline.Context{Context: t.Context()}), elastic.ErrPointInTimeNotSupported)
+}
@@ -52,6 +52,8 @@ type QueueConsumerProcessor struct {
 
 	processors *pipeline.Processors
 	onCleanup  func() bool
+
+	sliceWorkers sync.Map //queue-slice=worker context, for revoking slices
 }
 
 type MessageHandlerAPI interface {
@@ -85,6 +87,9 @@ type Config struct {
 	WaitingAfter           []string `config:"waiting_after"`
 	RetryDelayIntervalInMs int      `config:"retry_delay_interval"`
 	AutoCommitOffset       bool     `config:"auto_commit_offset"`
+
+	//share the queue slices among the consumers of the group on every node
+	Rebalance queue.GroupCoordinatorConfig `config:"rebalance"`
 }
 
 const name = "consumer"
@@ -210,6 +215,10 @@ func (processor *QueueConsumerProcessor) Process(c *pipeline.Context) error {
 		log.Debug("exit consumer processor")
 	}()
 
+	if processor.config.Rebalance.Enabled {
+		return processor.processWithRebalance(c)
+	}
+
 	//handle updates
 	if processor.config.DetectActiveQueue {
 		log.Tracef("detector running [%v]", processor.detectorRunning)
@@ -342,50 +351,65 @@ func (processor *QueueConsumerProcessor) HandleQueueConfig(qConfig *queue.QueueC
 			}
 		}
 
-		//queue-slice
-		key := fmt.Sprintf("%v-%v", qConfig.ID, sliceID)
-
 		if processor.config.MaxWorkers > 0 && util.MapLength(&processor.inFlightQueueConfigs) > processor.config.MaxWorkers {
 			log.Debugf("reached max num of workers, skip init [%v], slice_id:%v", qConfig.Name, sliceID)
 			return nil
 		}
 
-		processor.Lock()
-		v2, exists := processor.inFlightQueueConfigs.Load(key)
-		if exists {
-			log.Debugf("queue [%v], slice_id:%v has more then one consumer, key:%v,v:%v", qConfig.ID, sliceID, key, v2)
-			processor.Unlock()
-			continue
-		} else {
-			var workerID = util.GetUUID()
-			log.Debugf("starting worker:[%v], queue:[%v], slice_id:%v", workerID, qConfig.Name, sliceID)
+		err := processor.startSliceWorker(qConfig, sliceID, ctx)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return nil
+}
 
-			processor.wg.Add(1)
-			contextForWorker := pipeline.Context{}
-			contextForWorker.ResetContext()
-			err := processor.pool.Submit(&pipeline.Task{
-				Handler: func(ctx *pipeline.Context, v ...interface{}) {
-					processor.NewSlicedWorker(ctx, v...)
-					//if slice worker failed, add to failed queue
-					if ctx.IsFailed() || ctx.HasError() {
-						if len(v) > 4 {
-							parentContext := v[4].(*pipeline.Context)
-							if parentContext != nil {
-								parentContext.Increment(sliceStats, 1)
-							}
-						}
+// startSliceWorker consumes the slice of the queue, unless a worker already
+// does
+func (processor *QueueConsumerProcessor) startSliceWorker(qConfig *queue.QueueConfig, sliceID int, ctx *pipeline.Context) error {
+	var sliceStats = qConfig.ID + "FAILED_SLICES"
+
+	//queue-slice
+	key := fmt.Sprintf("%v-%v", qConfig.ID, sliceID)
+
+	processor.Lock()
+	defer processor.Unlock()
+
+	v2, exists := processor.inFlightQueueConfigs.Load(key)
+	if exists {
+		log.Debugf("queue [%v], slice_id:%v has more then one consumer, key:%v,v:%v", qConfig.ID, sliceID, key, v2)
+		return nil
+	}
+
+	var workerID = util.GetUUID()
+	log.Debugf("starting worker:[%v], queue:[%v], slice_id:%v", workerID, qConfig.Name, sliceID)
+
+	processor.wg.Add(1)
+	contextForWorker := pipeline.Context{}
+	contextForWorker.ResetContext()
+	processor.sliceWorkers.Store(key, &contextForWorker)
+	err := processor.pool.Submit(&pipeline.Task{
+		Handler: func(ctx *pipeline.Context, v ...interface{}) {
+			defer processor.sliceWorkers.Delete(key)
+			processor.NewSlicedWorker(ctx, v...)
+			//if slice worker failed, add to failed queue
+			if ctx.IsFailed() || ctx.HasError() {
+				if len(v) > 4 {
+					parentContext := v[4].(*pipeline.Context)
+					if parentContext != nil {
+						parentContext.Increment(sliceStats, 1)
 					}
-				},
-				Context: &contextForWorker,
-				Params:  []interface{}{qConfig, workerID, sliceID, processor.config.NumOfSlices, ctx}, //在创建任务时设置参数
-			})
-			processor.Unlock()
-			if err != nil {
-				panic(err)
+				}
 			}
-		}
+		},
+		Context: &contextForWorker,
+		Params:  []interface{}{qConfig, workerID, sliceID, processor.config.NumOfSlices, ctx}, //在创建任务时设置参数
+	})
+	if err != nil {
+		processor.sliceWorkers.Delete(key)
+		processor.wg.Done()
 	}
-	return nil
+	return err
 }
 
 var xxHashPool = sync.Pool{
@@ -460,6 +484,12 @@ func (processor *QueueConsumerProcessor) NewSlicedWorker(ctx *pipeline.Context,
 	if processor.config.Consumer.FetchMaxBytes > 0 {
 		consumerConfig.FetchMaxBytes = processor.config.Consumer.FetchMaxBytes
 	}
+	if processor.config.Consumer.Retry != nil {
+		consumerConfig.Retry = processor.config.Consumer.Retry
+	}
+	if processor.config.Consumer.DeadLetterQueue != "" {
+		consumerConfig.DeadLetterQueue = processor.config.Consumer.DeadLetterQueue
+	}
 
 	//skip empty queue
 	if processor.config.SkipEmptyQueue && !queue.ConsumerHasLag(qConfig, consumerConfig) {
@@ -627,34 +657,36 @@ READ_DOCS:
 
 		if len(messages) > 0 {
 
-			newCtx := pipeline.Context{}
-			newCtx.ParentContext = ctx
-			newCtx.Context = ctx.Context
-			newCtx.Data = ctx.CloneData()
+			//failed batches are retried and then moved to the dead-letter queue, if the consumer has a retry policy
+			err := queue.ProcessWithRetry(ctx.Context, qConfig, consumerConfig, messages, func(messages []queue.Message) error {
+				newCtx := pipeline.Context{}
+				newCtx.ParentContext = ctx
+				newCtx.Context = ctx.Context
+				newCtx.Data = ctx.CloneData()
 
-			_, err := newCtx.PutValue(processor.config.QueueField, qConfig.Name)
-			if err != nil {
-				panic(err)
-			}
+				_, err := newCtx.PutValue(processor.config.QueueField, qConfig.Name)
+				if err != nil {
+					panic(err)
+				}
 
-			_, err = newCtx.PutValue("QUEUE_CONFIG", qConfig)
-			if err != nil {
-				panic(err)
-			}
+				_, err = newCtx.PutValue("QUEUE_CONFIG", qConfig)
+				if err != nil {
+					panic(err)
+				}
 
-			_, err = newCtx.PutValue("CONSUMER_CONFIG", consumerConfig)
-			if err != nil {
-				panic(err)
-			}
+				_, err = newCtx.PutValue("CONSUMER_CONFIG", consumerConfig)
+				if err != nil {
+					panic(err)
+				}
 
-			_, err = newCtx.PutValue(processor.config.MessageField, messages)
-			if err != nil {
-				panic(err)
-			}
+				_, err = newCtx.PutValue(processor.config.MessageField, messages)
+				if err != nil {
+					panic(err)
+				}
 
-			//log.Error("start processing message:",len(messages),",",qConfig.Name)
-			err = processor.processors.Process(&newCtx)
-			//log.Error("end processing message:",len(messages),",",qConfig.Name,",",err)
+				//log.Error("start processing message:",len(messages),",",qConfig.Name)
+				return processor.processors.Process(&newCtx)
+			})
 			if err != nil {
 				panic(err)
 			}
@@ -0,0 +1,120 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package consumer
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/queue"
+)
+
+// processWithRebalance consumes the slices the group coordinator assigns
+// to this processor, instead of every slice it can lock.
+func (processor *QueueConsumerProcessor) processWithRebalance(c *pipeline.Context) error {
+	memberID := fmt.Sprintf("%v-%v", global.Env().SystemConfig.NodeConfig.ID, processor.id)
+	coordinator := queue.NewGroupCoordinator(processor.config.Consumer.Group, memberID, processor.config.Rebalance)
+	coordinator.Slices = processor.groupSlices
+	coordinator.OnRevoked = processor.stopSliceWorkers
+	coordinator.Start()
+	defer coordinator.Stop()
+
+	interval := time.Duration(processor.config.DetectIntervalInMs) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	for !c.IsCanceled() && !global.ShuttingDown() {
+		for _, s := range coordinator.Owned() {
+			if _, ok := processor.inFlightQueueConfigs.Load(s.Key()); ok {
+				continue
+			}
+			qConfig, ok := queue.GetConfigByUUID(s.QueueID)
+			if !ok {
+				continue
+			}
+			if processor.config.SkipEmptyQueue && !queue.HasLag(qConfig) {
+				continue
+			}
+			err := processor.startSliceWorker(qConfig, s.Slice, c)
+			if err != nil {
+				return err
+			}
+		}
+		time.Sleep(interval)
+	}
+
+	processor.wg.Wait()
+	return nil
+}
+
+// groupSlices lists the slices of every selected queue, the leader of the
+// group assigns them
+func (processor *QueueConsumerProcessor) groupSlices() []queue.GroupSlice {
+	slices := []queue.GroupSlice{}
+	for _, v := range queue.GetConfigBySelector(&processor.config.Selector) {
+		for sliceID := 0; sliceID < processor.config.NumOfSlices; sliceID++ {
+			if len(processor.config.enabledSlice) > 0 {
+				if _, ok := processor.config.enabledSlice[sliceID]; !ok {
+					continue
+				}
+			}
+			slices = append(slices, queue.GroupSlice{QueueID: v.ID, Slice: sliceID})
+		}
+	}
+	return slices
+}
+
+// stopSliceWorkers cancels the workers of revoked slices and waits for them
+// to commit and exit, so the next owner starts where they stopped. It returns
+// the slices whose workers outlived the consume timeout, the coordinator
+// keeps them until they are gone.
+func (processor *QueueConsumerProcessor) stopSliceWorkers(slices []queue.GroupSlice) []queue.GroupSlice {
+	for _, s := range slices {
+		if v, ok := processor.sliceWorkers.Load(s.Key()); ok {
+			v.(*pipeline.Context).CancelTask()
+		}
+	}
+
+	timeout := time.Duration(processor.config.Consumer.ConsumeTimeoutInSeconds) * time.Second
+	start := time.Now()
+	busy := []queue.GroupSlice{}
+	for _, s := range slices {
+		for {
+			if _, ok := processor.sliceWorkers.Load(s.Key()); !ok {
+				break
+			}
+			if timeout > 0 && time.Since(start) > timeout {
+				log.Warnf("worker of slice [%v] did not stop in %v, keeping the slice until it exits", s.Key(), timeout)
+				busy = append(busy, s)
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return busy
+}
@@ -0,0 +1,64 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package consumer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/kv/kvtest"
+	"infini.sh/framework/core/pipeline"
+	"infini.sh/framework/core/queue"
+)
+
+func TestRevokeSliceWithRunningWorker(t *testing.T) {
+	kvtest.Use("consumer_rebalance_test")
+	processor := &QueueConsumerProcessor{config: &Config{Consumer: &queue.ConsumerConfig{ConsumeTimeoutInSeconds: 1}}}
+	slices := []queue.GroupSlice{{QueueID: "q1", Slice: 0}, {QueueID: "q1", Slice: 1}}
+	newMember := func(id string) *queue.GroupCoordinator {
+		c := queue.NewGroupCoordinator(t.Name(), id, queue.GroupCoordinatorConfig{Enabled: true})
+		c.Slices = func() []queue.GroupSlice { return slices }
+		return c
+	}
+	a := newMember("a")
+	a.OnRevoked = processor.stopSliceWorkers
+	b := newMember("b")
+
+	require.NoError(t, a.Tick())
+	require.Len(t, a.Owned(), 2)
+
+	//the workers of a do not react to being canceled
+	workers := map[string]*pipeline.Context{}
+	for _, s := range slices {
+		ctx := &pipeline.Context{}
+		ctx.ResetContext()
+		processor.sliceWorkers.Store(s.Key(), ctx)
+		workers[s.Key()] = ctx
+	}
+
+	//b joins, a hands over one slice but keeps it while its worker runs
+	require.NoError(t, b.Tick())
+	require.NoError(t, a.Tick())
+	require.Len(t, a.Owned(), 1)
+	kept := a.Owned()[0].Key()
+	revoked := slices[0].Key()
+	if revoked == kept {
+		revoked = slices[1].Key()
+	}
+	assert.True(t, workers[revoked].IsCanceled())
+	assert.False(t, workers[kept].IsCanceled())
+
+	require.NoError(t, b.Tick())
+	assert.Empty(t, b.Owned())
+
+	//once the worker exited the slice is released and b takes it
+	processor.sliceWorkers.Delete(revoked)
+	require.NoError(t, a.Tick())
+	require.NoError(t, b.Tick())
+	require.Len(t, b.Owned(), 1)
+	assert.Equal(t, revoked, b.Owned()[0].Key())
+	assert.Equal(t, kept, a.Owned()[0].Key())
+}
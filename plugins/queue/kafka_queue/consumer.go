@@ -30,6 +30,8 @@ package kafka_queue
 import (
 	"context"
 	log "github.com/cihub/seelog"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"github.com/twmb/franz-go/pkg/kerr"
 	"github.com/twmb/franz-go/pkg/kgo"
 	"github.com/twmb/franz-go/pkg/kmsg"
 	"infini.sh/framework/core/global"
@@ -67,6 +69,35 @@ func (this *Consumer) ResetOffset(part, readPos int64) (err error) {
 	return err
 }
 
+// resetOffsets moves the consumer to the listed offsets and commits them,
+// partitions that are not assigned to it are only committed.
+func (this *Consumer) resetOffsets(partitions map[int32]kadm.ListedOffset) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*10))
+	defer cancel()
+
+	offsets := map[string]map[int32]kgo.EpochOffset{this.qCfg.ID: {}}
+	for _, p := range partitions {
+		offsets[this.qCfg.ID][p.Partition] = kgo.EpochOffset{Offset: p.Offset, Epoch: p.LeaderEpoch}
+	}
+	this.client.SetOffsets(offsets)
+
+	var ret error
+	this.client.CommitOffsetsSync(ctx, offsets, func(client *kgo.Client, request *kmsg.OffsetCommitRequest, response *kmsg.OffsetCommitResponse, err error) {
+		if err != nil {
+			ret = err
+			return
+		}
+		for _, t := range response.Topics {
+			for _, p := range t.Partitions {
+				if ret == nil {
+					ret = kerr.ErrorForCode(p.ErrorCode)
+				}
+			}
+		}
+	})
+	return ret
+}
+
 func (this *Consumer) CommitOffset(off queue.Offset) error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*10))
@@ -141,7 +172,13 @@ func (this *Consumer) FetchMessages(ctx *queue.Context, numOfMessages int) (mess
 			}
 			nextOffset = nextOffsetStr
 			size := len(r.Value)
-			m := queue.Message{Offset: offsetStr, NextOffset: nextOffsetStr, Data: r.Value, Size: size, Timestamp: r.Timestamp.Unix()}
+			m := queue.Message{Offset: offsetStr, NextOffset: nextOffsetStr, Data: r.Value, Size: size, Timestamp: r.Timestamp.Unix(), Key: r.Key}
+			if len(r.Headers) > 0 {
+				m.Headers = make(map[string]string, len(r.Headers))
+				for _, h := range r.Headers {
+					m.Headers[h.Key] = string(h.Value)
+				}
+			}
 			msgs = append(msgs, m)
 			ctx.MessageCount++
 			byteSize += size
@@ -76,11 +76,12 @@ const SCRAM_SHA_256_Mechanism = "SCRAM-SHA-256"
 const SCRAM_SHA_512_Mechanism = "SCRAM-SHA-512"
 
 type KafkaQueue struct {
-	cfg         *Config
-	q           sync.Map
-	consumers   sync.Map //q+consumer=instance
-	producers   sync.Map //q=instance
-	adminClient *kadm.Client
+	cfg          *Config
+	q            sync.Map
+	consumers    sync.Map //q+consumer=instance
+	producers    sync.Map //q=instance
+	transactions sync.Map //transaction id=transactional client
+	adminClient  *kadm.Client
 }
 
 func (this *KafkaQueue) newClient(opt []kgo.Opt) *kgo.Client {
@@ -196,6 +197,8 @@ func (this *KafkaQueue) AcquireConsumer(qconfig *queue.QueueConfig, consumer *qu
 			kgo.FetchMinBytes(int32(consumer.FetchMinBytes)),
 			kgo.FetchMaxBytes(int32(consumer.FetchMaxBytes)),
 			kgo.FetchMaxWait(time.Duration(consumer.FetchMaxWaitMs) * time.Millisecond),
+			//skip messages of aborted transactions
+			kgo.FetchIsolationLevel(kgo.ReadCommitted()),
 		}
 
 		if consumer.AutoResetOffset == "earliest" {
@@ -289,6 +292,10 @@ func (this *KafkaQueue) Stop() error {
 	}
 
 	if this.cfg != nil && this.cfg.Enabled {
+		this.transactions.Range(func(key, value interface{}) bool {
+			value.(*kgo.Client).Close()
+			return true
+		})
 		this.adminClient.Close()
 	}
 
@@ -497,6 +504,93 @@ func (this *KafkaQueue) GetOffset(k *queue.QueueConfig, consumer *queue.Consumer
 	return str, nil
 }
 
+// OffsetForTime looks t up on every partition of the topic and returns the
+// offset of the earliest message written at or after t, the end offset of
+// partition 0 when no partition has one.
+func (this *KafkaQueue) OffsetForTime(k *queue.QueueConfig, t time.Time) (queue.Offset, error) {
+	partitions, err := this.offsetsForTime(k.ID, t)
+	if err != nil {
+		return queue.Offset{}, err
+	}
+	return firstOffsetAfter(k.ID, partitions)
+}
+
+// ResetOffsetForTime moves the group to the first message written at or
+// after t on every partition, a single queue.Offset only covers one of them.
+func (this *KafkaQueue) ResetOffsetForTime(k *queue.QueueConfig, consumer *queue.ConsumerConfig, t time.Time) (queue.Offset, error) {
+	partitions, err := this.offsetsForTime(k.ID, t)
+	if err != nil {
+		return queue.Offset{}, err
+	}
+
+	group := getGroupForKafka(consumer.Group, k.ID)
+	cor, ok := this.consumers.Load(group)
+	if ins, ok1 := cor.(*Consumer); ok && ok1 {
+		//the group has a live member here, the broker only takes its commits
+		err = ins.resetOffsets(partitions)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*60))
+		defer cancel()
+
+		offsets := kadm.Offsets{}
+		for _, p := range partitions {
+			offsets.AddOffset(k.ID, p.Partition, p.Offset, p.LeaderEpoch)
+		}
+		var res kadm.OffsetResponses
+		res, err = this.adminClient.CommitOffsets(ctx, group, offsets)
+		if err == nil {
+			err = res.Error()
+		}
+	}
+	if err != nil {
+		return queue.Offset{}, err
+	}
+	return firstOffsetAfter(k.ID, partitions)
+}
+
+// offsetsForTime lists the first offset at or after t of every partition of
+// the topic, the end offset for partitions without records after t.
+func (this *KafkaQueue) offsetsForTime(topic string, t time.Time) (map[int32]kadm.ListedOffset, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*60))
+	defer cancel()
+
+	res, err := this.adminClient.ListOffsetsAfterMilli(ctx, t.UnixMilli(), topic)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.Error(); err != nil {
+		return nil, err
+	}
+	if len(res[topic]) == 0 {
+		return nil, errors.Errorf("no offset found for topic [%v]", topic)
+	}
+	return res[topic], nil
+}
+
+// firstOffsetAfter picks the partition whose message after the looked up
+// time is the earliest one, the timestamp is -1 on partitions that have none.
+func firstOffsetAfter(topic string, partitions map[int32]kadm.ListedOffset) (queue.Offset, error) {
+	var first *kadm.ListedOffset
+	for _, p := range partitions {
+		p := p
+		if p.Timestamp < 0 {
+			continue
+		}
+		if first == nil || p.Timestamp < first.Timestamp || (p.Timestamp == first.Timestamp && p.Partition < first.Partition) {
+			first = &p
+		}
+	}
+	if first != nil {
+		return queue.NewOffset(int64(first.Partition), first.Offset), nil
+	}
+
+	end, ok := partitions[0]
+	if !ok {
+		return queue.Offset{}, errors.Errorf("no offset found for partition 0 of topic [%v]", topic)
+	}
+	return queue.NewOffset(0, end.Offset), nil
+}
+
 func (this *KafkaQueue) GetStorageSize(k string) uint64 {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*60))
 	defer cancel()
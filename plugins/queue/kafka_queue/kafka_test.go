@@ -0,0 +1,48 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package kafka_queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kadm"
+	"infini.sh/framework/core/queue"
+)
+
+func TestFirstOffsetAfter(t *testing.T) {
+	listed := func(partition int32, offset, timestamp int64) kadm.ListedOffset {
+		return kadm.ListedOffset{Topic: "logs", Partition: partition, Offset: offset, Timestamp: timestamp}
+	}
+
+	//the partition with the earliest message after t wins
+	offset, err := firstOffsetAfter("logs", map[int32]kadm.ListedOffset{
+		0: listed(0, 40, 1200),
+		1: listed(1, 7, 1100),
+		2: listed(2, 90, -1),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffset(1, 7), offset)
+
+	//ties go to the lower partition
+	offset, err = firstOffsetAfter("logs", map[int32]kadm.ListedOffset{
+		2: listed(2, 3, 1100),
+		1: listed(1, 5, 1100),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffset(1, 5), offset)
+
+	//no message after t, the end of partition 0
+	offset, err = firstOffsetAfter("logs", map[int32]kadm.ListedOffset{
+		0: listed(0, 40, -1),
+		1: listed(1, 7, -1),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, queue.NewOffset(0, 40), offset)
+
+	_, err = firstOffsetAfter("logs", map[int32]kadm.ListedOffset{1: listed(1, 7, -1)})
+	assert.Error(t, err)
+}
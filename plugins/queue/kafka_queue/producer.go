@@ -48,27 +48,41 @@ func (p *Producer) Produce(reqs *[]queue.ProduceRequest) (*[]queue.ProduceRespon
 		panic(errors.New("invalid request"))
 	}
 
+	messages := newRecords(*reqs, p.cfg.ID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*10))
+	defer cancel()
+
+	response := p.client.ProduceSync(ctx, messages...)
+	return produceResults(response), response.FirstErr()
+}
+
+func newRecords(reqs []queue.ProduceRequest, topic string) []*kgo.Record {
 	messages := []*kgo.Record{}
-	for _, req := range *reqs {
+	for _, req := range reqs {
 		msg := &kgo.Record{}
 		if req.Topic != "" {
 			msg.Topic = req.Topic
 		} else {
-			msg.Topic = p.cfg.ID
+			msg.Topic = topic
 		}
 		msg.Timestamp = time.Now()
-		msg.Key = util.UnsafeStringToBytes(util.GetUUID())
+		if len(req.Key) > 0 {
+			msg.Key = req.Key
+		} else {
+			msg.Key = util.UnsafeStringToBytes(util.GetUUID())
+		}
 		msg.Value = req.Data
+		for k, v := range req.Headers {
+			msg.Headers = append(msg.Headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+		}
 		messages = append(messages, msg)
 	}
+	return messages
+}
 
+func produceResults(response kgo.ProduceResults) *[]queue.ProduceResponse {
 	results := []queue.ProduceResponse{}
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(time.Second*10))
-	defer cancel()
-
-	response := p.client.ProduceSync(ctx, messages...)
-
 	for _, r := range response {
 		if r.Err == nil {
 			if r.Record != nil {
@@ -81,7 +95,7 @@ func (p *Producer) Produce(reqs *[]queue.ProduceRequest) (*[]queue.ProduceRespon
 			}
 		}
 	}
-	return &results, response.FirstErr()
+	return &results
 }
 
 func (p *Producer) Close() error {
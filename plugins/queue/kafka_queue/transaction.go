@@ -0,0 +1,175 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package kafka_queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/queue"
+)
+
+// transactionClient returns the producer of a transaction, its transactional
+// id fences off the producer of a previous run with the same id.
+func (this *KafkaQueue) transactionClient(txn *queue.Transaction) *kgo.Client {
+	v, ok := this.transactions.Load(txn.ID)
+	if ok {
+		return v.(*kgo.Client)
+	}
+
+	opts := []kgo.Opt{
+		kgo.AllowAutoTopicCreation(),
+		kgo.TransactionalID(txn.ID),
+		kgo.TransactionTimeout(60 * time.Second),
+		kgo.ProducerBatchMaxBytes(this.cfg.ProducerBatchMaxBytes),
+		kgo.MaxBufferedRecords(this.cfg.MaxBufferedRecords),
+		kgo.RetryTimeout(10 * time.Second),
+		kgo.RequestTimeoutOverhead(10 * time.Second),
+		kgo.ClientID(global.Env().SystemConfig.NodeConfig.ID),
+	}
+	client := this.newClient(opts)
+	v, ok = this.transactions.LoadOrStore(txn.ID, client)
+	if ok {
+		client.Close()
+	}
+	return v.(*kgo.Client)
+}
+
+// CommitTransaction produces reqs and commits offset in one kafka
+// transaction, consumers only see the messages once it is committed.
+func (this *KafkaQueue) CommitTransaction(txn *queue.Transaction, reqs []queue.ProduceRequest, offset queue.Offset) (*[]queue.ProduceResponse, error) {
+	//kafka does not end a transaction without records, commit the offset only
+	if len(reqs) == 0 {
+		_, err := this.CommitOffset(txn.Source, txn.Consumer, offset)
+		return &[]queue.ProduceResponse{}, err
+	}
+
+	client := this.transactionClient(txn)
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	err := client.BeginTransaction()
+	if err != nil {
+		return nil, err
+	}
+
+	response := client.ProduceSync(ctx, newRecords(reqs, txn.Target.ID)...)
+	results := produceResults(response)
+	err = response.FirstErr()
+	if err == nil {
+		err = this.commitTransactionOffset(ctx, client, txn, offset)
+	}
+	if err != nil {
+		if abortErr := client.EndTransaction(ctx, kgo.TryAbort); abortErr != nil {
+			return results, abortErr
+		}
+		return results, err
+	}
+	return results, client.EndTransaction(ctx, kgo.TryCommit)
+}
+
+// commitTransactionOffset adds the consumer offset of the source topic to
+// the ongoing transaction.
+func (this *KafkaQueue) commitTransactionOffset(ctx context.Context, client *kgo.Client, txn *queue.Transaction, offset queue.Offset) error {
+	producerID, epoch, err := client.ProducerID(ctx)
+	if err != nil {
+		return err
+	}
+	group := getGroupForKafka(txn.Consumer.Group, txn.Source.ID)
+
+	add := kmsg.NewPtrAddOffsetsToTxnRequest()
+	add.TransactionalID = txn.ID
+	add.ProducerID = producerID
+	add.ProducerEpoch = epoch
+	add.Group = group
+	addResp, err := add.RequestWith(ctx, client)
+	if err != nil {
+		return err
+	}
+	if err := kerr.ErrorForCode(addResp.ErrorCode); err != nil {
+		return err
+	}
+
+	commit := txnOffsetCommitRequest(txn, group, producerID, epoch, offset)
+	commitResp, err := commit.RequestWith(ctx, client)
+	if err != nil {
+		return err
+	}
+	for _, t := range commitResp.Topics {
+		for _, p := range t.Partitions {
+			if err := kerr.ErrorForCode(p.ErrorCode); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// txnOffsetCommitRequest commits offset for the group as part of the
+// transaction, the segment of the offset is the partition of the source topic.
+func txnOffsetCommitRequest(txn *queue.Transaction, group string, producerID int64, epoch int16, offset queue.Offset) *kmsg.TxnOffsetCommitRequest {
+	commit := kmsg.NewPtrTxnOffsetCommitRequest()
+	commit.TransactionalID = txn.ID
+	commit.Group = group
+	commit.ProducerID = producerID
+	commit.ProducerEpoch = epoch
+	commit.Generation = -1
+	topic := kmsg.NewTxnOffsetCommitRequestTopic()
+	topic.Topic = txn.Source.ID
+	partition := kmsg.NewTxnOffsetCommitRequestTopicPartition()
+	partition.Partition = int32(offset.Segment)
+	partition.Offset = offset.Position
+	topic.Partitions = append(topic.Partitions, partition)
+	commit.Topics = append(commit.Topics, topic)
+	return commit
+}
+
+// RecoverTransaction aborts the transaction left open by a previous run,
+// kafka committed its offset only if its messages were committed, so there
+// is nothing to skip.
+func (this *KafkaQueue) RecoverTransaction(txn *queue.Transaction) (*queue.TransactionState, error) {
+	client := this.transactionClient(txn)
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	//initializing the producer id with the transactional id aborts it
+	_, _, err := client.ProducerID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := this.GetOffset(txn.Source, txn.Consumer)
+	if err != nil {
+		return nil, err
+	}
+	return &queue.TransactionState{ID: txn.ID, SourceOffset: offset}, nil
+}
@@ -0,0 +1,53 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package kafka_queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"infini.sh/framework/core/queue"
+)
+
+func TestTxnOffsetCommitRequest(t *testing.T) {
+	txn := &queue.Transaction{
+		ID:       "orders_g_c_shipments",
+		Source:   &queue.QueueConfig{ID: "orders"},
+		Consumer: &queue.ConsumerConfig{Group: "g", Name: "c"},
+		Target:   &queue.QueueConfig{ID: "shipments"},
+	}
+	group := getGroupForKafka(txn.Consumer.Group, txn.Source.ID)
+	req := txnOffsetCommitRequest(txn, group, 42, 3, queue.NewOffset(2, 1500))
+
+	assert.Equal(t, txn.ID, req.TransactionalID)
+	assert.Equal(t, "g_orders", req.Group)
+	assert.Equal(t, int64(42), req.ProducerID)
+	assert.Equal(t, int16(3), req.ProducerEpoch)
+	assert.Equal(t, int32(-1), req.Generation)
+
+	//the offset is committed on the source topic, its segment is the partition
+	require.Len(t, req.Topics, 1)
+	assert.Equal(t, "orders", req.Topics[0].Topic)
+	require.Len(t, req.Topics[0].Partitions, 1)
+	assert.Equal(t, int32(2), req.Topics[0].Partitions[0].Partition)
+	assert.Equal(t, int64(1500), req.Topics[0].Partitions[0].Offset)
+}
+
+func TestTransactionResults(t *testing.T) {
+	records := newRecords([]queue.ProduceRequest{{Data: []byte("a")}, {Data: []byte("b"), Topic: "audit"}}, "shipments")
+	require.Len(t, records, 2)
+	assert.Equal(t, "shipments", records[0].Topic)
+	assert.Equal(t, "audit", records[1].Topic)
+
+	records[0].Partition, records[0].Offset = 1, 10
+	records[1].Partition, records[1].Offset = 0, 4
+	results := produceResults(kgo.ProduceResults{{Record: records[0]}, {Record: records[1]}})
+	require.Len(t, *results, 2)
+	assert.Equal(t, queue.NewOffset(1, 10), (*results)[0].Offset)
+	assert.Equal(t, "audit", (*results)[1].Topic)
+	assert.Equal(t, queue.NewOffset(0, 4), (*results)[1].Offset)
+}
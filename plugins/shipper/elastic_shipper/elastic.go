@@ -0,0 +1,119 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+// Package elastic_shipper registers the "elasticsearch" shipper, which
+// indexes each envelope as one document through the _bulk API.
+package elastic_shipper
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/shipper"
+	"infini.sh/framework/core/util"
+)
+
+type Config struct {
+	Elasticsearch string                      `config:"elasticsearch"`
+	IndexName     string                      `config:"index_name"`
+	BulkConfig    elastic.BulkProcessorConfig `config:"bulk"`
+}
+
+type ElasticShipper struct {
+	config        *Config
+	actionLine    []byte
+	bulkProcessor elastic.BulkProcessor
+}
+
+func init() {
+	shipper.Register("elasticsearch", New)
+}
+
+func New(c map[string]interface{}) (shipper.Shipper, error) {
+	cfg := Config{
+		BulkConfig: elastic.DefaultBulkProcessorConfig,
+	}
+
+	cfgObj, err := config.NewConfigFrom(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfgObj.Unpack(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unpack the configuration of elasticsearch shipper: %s", err)
+	}
+
+	if cfg.Elasticsearch == "" || cfg.IndexName == "" {
+		return nil, fmt.Errorf("elasticsearch shipper requires both elasticsearch and index_name")
+	}
+	//without it the documents elasticsearch rejects for good would be dropped
+	if cfg.BulkConfig.InvalidRequestsQueue == "" {
+		return nil, fmt.Errorf("elasticsearch shipper requires bulk.invalid_queue")
+	}
+
+	action := util.MapStr{"index": util.MapStr{"_index": cfg.IndexName}}
+
+	return &ElasticShipper{
+		config:        &cfg,
+		actionLine:    util.MustToJSONBytes(action),
+		bulkProcessor: elastic.NewBulkProcessor("shipper_"+cfg.IndexName, cfg.Elasticsearch, cfg.BulkConfig),
+	}, nil
+}
+
+// Ship submits the batch as a single bulk request. When the bulk processor
+// gives up on it, the request has been parked in the invalid queue
+// (rejected for good) or in the cluster's dead-letter queue (out of
+// retries), so the batch counts as delivered; a redelivered batch would be
+// rejected forever. Any other failure returns the error.
+func (s *ElasticShipper) Ship(batch [][]byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	meta := elastic.GetMetadata(s.config.Elasticsearch)
+	if meta == nil {
+		return errors.Errorf("elasticsearch [%v] metadata was not found", s.config.Elasticsearch)
+	}
+	if !meta.IsAvailable() {
+		return errors.Errorf("elasticsearch [%v] is not available", s.config.Elasticsearch)
+	}
+	host := meta.GetActiveHost()
+	if host == "" {
+		return errors.Errorf("elasticsearch [%v] has no active host", s.config.Elasticsearch)
+	}
+
+	buffer := s.bulkProcessor.BulkBufferPool.AcquireBulkBuffer()
+	defer s.bulkProcessor.BulkBufferPool.ReturnBulkBuffer(buffer)
+
+	for i, v := range batch {
+		if len(v) == 0 {
+			continue
+		}
+		buffer.WriteNewByteBufferLine("index", s.actionLine)
+		buffer.WriteNewByteBufferLine("body", v)
+		buffer.WriteMessageID(util.IntToString(i))
+	}
+
+	if buffer.GetMessageCount() == 0 {
+		return nil
+	}
+
+	continueNext, statsMap, _, err := s.bulkProcessor.Bulk(context.Background(), "shipper", meta, host, buffer)
+	if err != nil {
+		if continueNext {
+			log.Warnf("elasticsearch [%v], failed to ship %v events, parked them in queue [%v] or [%v_dead_letter_queue], stats: %v, err: %v",
+				s.config.Elasticsearch, buffer.GetMessageCount(), s.config.BulkConfig.InvalidRequestsQueue, meta.Config.ID, statsMap, err)
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *ElasticShipper) Close() error {
+	return nil
+}
@@ -0,0 +1,141 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package elastic_shipper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/elastic"
+	"infini.sh/framework/core/elastic/elastictest"
+	"infini.sh/framework/core/kv/kvtest"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/shipper"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/modules/queue/mem_queue"
+)
+
+var (
+	setupOnce   sync.Once
+	memoryQueue = &mem_queue.MemoryQueue{Capacity: 1000}
+)
+
+// newShipper registers the cluster behind endpoint and builds a shipper
+// writing to the events index, parking rejected requests in a queue of its
+// own.
+func newShipper(t *testing.T, endpoint string, available bool, bulk util.MapStr) (shipper.Shipper, *elastic.ElasticsearchMetadata, *queue.QueueConfig) {
+	t.Helper()
+	setupOnce.Do(func() {
+		kvtest.Use("elastic_shipper_test")
+		queue.RegisterDefaultHandler(memoryQueue)
+	})
+
+	cfg := &elastic.ElasticsearchConfig{}
+	cfg.ID = "shipper-" + util.GetUUID()
+	cfg.Name = cfg.ID
+	cfg.Endpoint = endpoint
+	cfg.Enabled = true
+	meta := elastic.InitMetadata(cfg, available)
+
+	invalid := "invalid-" + cfg.ID
+	settings := util.MapStr{"invalid_queue": invalid, "reject_retry_delay_in_seconds": 1}
+	for k, v := range bulk {
+		settings[k] = v
+	}
+	s, err := shipper.Get("elasticsearch", map[string]interface{}{
+		"elasticsearch": cfg.ID,
+		"index_name":    "events",
+		"bulk":          settings,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s, meta, queue.GetOrInitConfig(invalid)
+}
+
+func popAll(q *queue.QueueConfig) []string {
+	out := []string{}
+	for {
+		data, timeout := memoryQueue.Pop(q.ID, 0)
+		if timeout {
+			return out
+		}
+		out = append(out, string(data))
+	}
+}
+
+func TestElasticShipperShip(t *testing.T) {
+	srv := elastictest.NewServer(elastictest.Options{Version: "8.15.0"})
+	defer srv.Close()
+	s, _, invalid := newShipper(t, srv.URL, true, nil)
+
+	assert.NoError(t, s.Ship(nil))
+	assert.NoError(t, s.Ship([][]byte{[]byte(`{"n":1}`), nil, []byte(`{"n":2}`)}))
+	assert.Equal(t, 2, srv.DocCount("events"))
+	assert.Empty(t, popAll(invalid))
+}
+
+func TestElasticShipperParksRejectedDocuments(t *testing.T) {
+	srv := elastictest.NewServer(elastictest.Options{Version: "7.17.24"})
+	defer srv.Close()
+	s, _, invalid := newShipper(t, srv.URL, true, nil)
+
+	//the invalid document is rejected for good, the batch is not redelivered
+	assert.NoError(t, s.Ship([][]byte{[]byte(`{"n":1}`), []byte(`not json`), []byte(`{"n":3}`)}))
+	assert.Equal(t, 2, srv.DocCount("events"))
+	parked := popAll(invalid)
+	require.Len(t, parked, 1)
+	assert.Contains(t, parked[0], "not json")
+}
+
+func TestElasticShipperParksDocumentsOutOfRetries(t *testing.T) {
+	srv := elastictest.NewServer(elastictest.Options{Version: "8.15.0"})
+	defer srv.Close()
+	s, meta, invalid := newShipper(t, srv.URL, true, nil)
+
+	srv.RejectBulkItems(2)
+	assert.NoError(t, s.Ship([][]byte{[]byte(`{"n":1}`), []byte(`{"n":2}`), []byte(`{"n":3}`)}))
+	assert.Equal(t, 1, srv.DocCount("events"))
+	assert.Empty(t, popAll(invalid))
+	dead := popAll(queue.GetOrInitConfig(meta.Config.ID + "_dead_letter_queue"))
+	require.Len(t, dead, 1)
+	assert.Equal(t, 2, strings.Count(dead[0], `"index"`))
+}
+
+func TestElasticShipperFailedRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	batch := [][]byte{[]byte(`{"n":1}`)}
+
+	//retryable, the caller redelivers the batch
+	s, _, invalid := newShipper(t, srv.URL, true, nil)
+	assert.Error(t, s.Ship(batch))
+	assert.Empty(t, popAll(invalid))
+
+	//not retryable, the request is parked instead of being dropped
+	s, _, invalid = newShipper(t, srv.URL, true, util.MapStr{"retry_rules": util.MapStr{"denied": util.MapStr{"status": []int{503}}}})
+	assert.NoError(t, s.Ship(batch))
+	parked := popAll(invalid)
+	require.Len(t, parked, 1)
+	assert.Contains(t, parked[0], `{"n":1}`)
+
+	s, _, _ = newShipper(t, srv.URL, false, nil)
+	assert.ErrorContains(t, s.Ship(batch), "is not available")
+}
+
+func TestElasticShipperNeedsInvalidQueue(t *testing.T) {
+	_, err := shipper.Get("elasticsearch", map[string]interface{}{
+		"elasticsearch": "default",
+		"index_name":    "events",
+		"bulk":          map[string]interface{}{"invalid_queue": ""},
+	})
+	assert.ErrorContains(t, err, "bulk.invalid_queue")
+}
@@ -0,0 +1,91 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+// Package file_shipper registers the "file" shipper, which appends each
+// envelope as one line to a rolling file managed by core/rotate.
+package file_shipper
+
+import (
+	"fmt"
+	"path"
+
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/global"
+	"infini.sh/framework/core/rotate"
+	"infini.sh/framework/core/shipper"
+	"infini.sh/framework/core/util"
+)
+
+type Config struct {
+	// Path is the target file; relative paths resolve against the data dir.
+	Path   string              `config:"path"`
+	Rotate rotate.RotateConfig `config:"rotate"`
+}
+
+type FileShipper struct {
+	path   string
+	writer *rotate.RotateWriter
+}
+
+var newline = []byte("\n")
+
+func init() {
+	shipper.Register("file", New)
+}
+
+func New(c map[string]interface{}) (shipper.Shipper, error) {
+	cfg := Config{
+		Rotate: rotate.DefaultConfig,
+	}
+
+	cfgObj, err := config.NewConfigFrom(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfgObj.Unpack(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unpack the configuration of file shipper: %s", err)
+	}
+
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("file shipper requires a path")
+	}
+
+	filePath := cfg.Path
+	if !path.IsAbs(filePath) {
+		filePath = path.Join(global.Env().GetDataDir(), filePath)
+	}
+
+	return &FileShipper{
+		path:   filePath,
+		writer: rotate.GetFileHandler(filePath, cfg.Rotate),
+	}, nil
+}
+
+// Ship writes the whole batch under a single writer lock, one envelope per
+// line. A write failure part way through leaves the earlier lines on disk,
+// so a redelivered batch may duplicate them (at-least-once).
+func (s *FileShipper) Ship(batch [][]byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	lines := make([][]byte, 0, len(batch)*2)
+	for _, v := range batch {
+		if len(v) == 0 {
+			continue
+		}
+		lines = append(lines, v)
+		if !util.BytesHasSuffix(v, newline) {
+			lines = append(lines, newline)
+		}
+	}
+
+	_, err := s.writer.WriteBytesArray(lines...)
+	return err
+}
+
+func (s *FileShipper) Close() error {
+	rotate.ReleaseFileHandler(s.path)
+	return nil
+}
@@ -0,0 +1,34 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package file_shipper
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/core/shipper"
+)
+
+func TestFileShipper_Ship(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "events.log")
+
+	s, err := shipper.Get("file", map[string]interface{}{"path": file})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Ship([][]byte{[]byte(`{"a":1}`), []byte("{\"b\":2}\n"), nil}))
+	assert.NoError(t, s.Ship([][]byte{[]byte(`{"c":3}`)}))
+	assert.NoError(t, s.Close())
+
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"a\":1}\n{\"b\":2}\n{\"c\":3}\n", string(data))
+}
+
+func TestFileShipper_MissingPath(t *testing.T) {
+	_, err := shipper.Get("file", map[string]interface{}{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,158 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+// Package http_shipper registers the "http" shipper, which POSTs each batch
+// as one NDJSON request body, trying the configured endpoints in order.
+package http_shipper
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/api"
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/errors"
+	"infini.sh/framework/core/model"
+	"infini.sh/framework/core/shipper"
+	"infini.sh/framework/core/util"
+	"infini.sh/framework/lib/bytebufferpool"
+	"infini.sh/framework/lib/fasthttp"
+)
+
+type Config struct {
+	Endpoints []string          `config:"endpoints"` //full url, eg: http://localhost:8080/_ingest
+	Method    string            `config:"method"`
+	Headers   map[string]string `config:"headers"`
+	BasicAuth *model.BasicAuth  `config:"basic_auth"`
+	TLSConfig *config.TLSConfig `config:"tls"`
+
+	Compress             bool `config:"compress"`              // gzip the request body, default false
+	CompressionThreshold int  `config:"compression_threshold"` // default 1024 bytes
+
+	ValidatedStatusCode []int `config:"valid_status_code"` //default 200, 201, 202
+
+	MaxConnection int           `config:"max_connection_per_node"`
+	Timeout       time.Duration `config:"timeout"`
+}
+
+type HTTPShipper struct {
+	config   *Config
+	client   *fasthttp.Client
+	httpPool *fasthttp.RequestResponsePool
+}
+
+var newline = []byte("\n")
+
+func init() {
+	shipper.Register("http", New)
+}
+
+func New(c map[string]interface{}) (shipper.Shipper, error) {
+	cfg := Config{
+		Method:               http.MethodPost,
+		ValidatedStatusCode:  []int{200, 201, 202},
+		CompressionThreshold: 1024,
+		Timeout:              10 * time.Second,
+	}
+
+	cfgObj, err := config.NewConfigFrom(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfgObj.Unpack(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unpack the configuration of http shipper: %s", err)
+	}
+
+	if len(cfg.Endpoints) == 0 {
+		return nil, fmt.Errorf("http shipper requires at least one endpoint")
+	}
+
+	s := &HTTPShipper{
+		config:   &cfg,
+		httpPool: fasthttp.NewRequestResponsePool("http_shipper_" + util.GetUUID()),
+	}
+	s.client = &fasthttp.Client{
+		Name:                          "http_shipper",
+		DisableHeaderNamesNormalizing: true,
+		MaxConnsPerHost:               cfg.MaxConnection,
+		ReadTimeout:                   cfg.Timeout,
+		WriteTimeout:                  cfg.Timeout,
+		DialDualStack:                 true,
+		TLSConfig:                     api.SimpleGetTLSConfig(cfg.TLSConfig),
+	}
+	return s, nil
+}
+
+// Ship succeeds as soon as one endpoint accepts the whole batch; the batch
+// is reported undelivered only after every endpoint has failed.
+func (s *HTTPShipper) Ship(batch [][]byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	buffer := bytebufferpool.Get("http_shipper")
+	defer bytebufferpool.Put("http_shipper", buffer)
+
+	for _, v := range batch {
+		if len(v) == 0 {
+			continue
+		}
+		buffer.Write(v)
+		if !util.BytesHasSuffix(v, newline) {
+			buffer.Write(newline)
+		}
+	}
+
+	req := s.httpPool.AcquireRequestWithTag("http_shipper")
+	resp := s.httpPool.AcquireResponseWithTag("http_shipper")
+	defer s.httpPool.ReleaseRequest(req)
+	defer s.httpPool.ReleaseResponse(resp)
+
+	req.Header.SetMethod(s.config.Method)
+	req.Header.SetContentType("application/x-ndjson")
+	for k, v := range s.config.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.config.BasicAuth != nil {
+		req.SetBasicAuth(s.config.BasicAuth.Username, s.config.BasicAuth.Password.Get())
+	}
+
+	if s.config.Compress && buffer.Len() >= s.config.CompressionThreshold {
+		_, err := fasthttp.WriteGzipLevel(req.BodyWriter(), buffer.B, fasthttp.CompressBestSpeed)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(fasthttp.HeaderContentEncoding, "gzip")
+	} else {
+		req.SetBody(buffer.B)
+	}
+
+	var lastErr error
+	for _, endpoint := range s.config.Endpoints {
+		req.SetRequestURI(endpoint)
+		resp.Reset()
+
+		err := s.client.DoTimeout(req, resp, s.config.Timeout)
+		if err != nil {
+			log.Debugf("failed to ship %v events to %v: %v", len(batch), endpoint, err)
+			lastErr = err
+			continue
+		}
+
+		if !util.ContainsInAnyInt32Array(resp.StatusCode(), s.config.ValidatedStatusCode) {
+			lastErr = errors.Errorf("unexpected status code: %v from %v, response: %v", resp.StatusCode(), endpoint, util.SubString(string(resp.Body()), 0, 256))
+			log.Debug(lastErr)
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+func (s *HTTPShipper) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,49 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package http_shipper
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/core/shipper"
+)
+
+func TestHTTPShipper_Ship(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r.Header.Get("Content-Type")+"|"+string(body))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	s, err := shipper.Get("http", map[string]interface{}{
+		"endpoints": []string{"http://127.0.0.1:1/unreachable", server.URL + "/_ingest"},
+	})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.Ship([][]byte{[]byte(`{"a":1}`), []byte(`{"b":2}`)}))
+	assert.Equal(t, []string{"application/x-ndjson|{\"a\":1}\n{\"b\":2}\n"}, received)
+}
+
+func TestHTTPShipper_RejectedBatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	s, err := shipper.Get("http", map[string]interface{}{
+		"endpoints": []string{server.URL},
+	})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.Error(t, s.Ship([][]byte{[]byte(`{"a":1}`)}))
+}
@@ -0,0 +1,99 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+// Package queue_shipper registers the "queue" shipper, which pushes each
+// envelope as one message into a core/queue topic.
+package queue_shipper
+
+import (
+	"fmt"
+
+	"infini.sh/framework/core/config"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/shipper"
+)
+
+type Config struct {
+	Queue  string                 `config:"queue"`
+	Labels map[string]interface{} `config:"labels"`
+}
+
+type QueueShipper struct {
+	qConfig  *queue.QueueConfig
+	producer queue.ProducerAPI
+}
+
+func init() {
+	shipper.Register("queue", New)
+}
+
+func New(c map[string]interface{}) (shipper.Shipper, error) {
+	cfg := Config{}
+
+	cfgObj, err := config.NewConfigFrom(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfgObj.Unpack(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to unpack the configuration of queue shipper: %s", err)
+	}
+
+	if cfg.Queue == "" {
+		return nil, fmt.Errorf("queue shipper requires a queue")
+	}
+
+	s := &QueueShipper{}
+	if len(cfg.Labels) > 0 {
+		s.qConfig = queue.AdvancedGetOrInitConfig("", cfg.Queue, cfg.Labels)
+	} else {
+		s.qConfig = queue.GetOrInitConfig(cfg.Queue)
+	}
+
+	if _, ok := queue.GetHandlerByType(s.qConfig.Type).(queue.AdvancedQueueAPI); ok {
+		s.producer, err = queue.AcquireProducer(s.qConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Ship hands the batch to the queue producer in one call when the backend
+// supports it, and falls back to pushing message by message otherwise. The
+// fallback stops at the first failure, so a redelivered batch may repeat
+// the messages pushed before it (at-least-once).
+func (s *QueueShipper) Ship(batch [][]byte) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if s.producer != nil {
+		reqs := make([]queue.ProduceRequest, 0, len(batch))
+		for _, v := range batch {
+			if len(v) == 0 {
+				continue
+			}
+			reqs = append(reqs, queue.ProduceRequest{Topic: s.qConfig.ID, Data: v})
+		}
+		_, err := s.producer.Produce(&reqs)
+		return err
+	}
+
+	for _, v := range batch {
+		if len(v) == 0 {
+			continue
+		}
+		if err := queue.Push(s.qConfig, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *QueueShipper) Close() error {
+	if s.producer != nil {
+		return s.producer.Close()
+	}
+	return nil
+}
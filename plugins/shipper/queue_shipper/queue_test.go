@@ -0,0 +1,100 @@
+/* Copyright © INFINI Ltd. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package queue_shipper
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"infini.sh/framework/core/kv/kvtest"
+	"infini.sh/framework/core/queue"
+	"infini.sh/framework/core/shipper"
+	"infini.sh/framework/modules/queue/mem_queue"
+)
+
+// listQueue is a queue without producers, failing once failAfter messages
+// went through when failAfter is set.
+type listQueue struct {
+	lock      sync.Mutex
+	messages  map[string][]string
+	failAfter int
+}
+
+func (q *listQueue) Name() string                   { return "list" }
+func (q *listQueue) Init(string) error              { return nil }
+func (q *listQueue) Close(string) error             { return nil }
+func (q *listQueue) GetStorageSize(k string) uint64 { return 0 }
+func (q *listQueue) Destroy(string) error           { return nil }
+func (q *listQueue) GetQueues() []string            { return nil }
+func (q *listQueue) Push(k string, data []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.failAfter > 0 && len(q.messages[k]) >= q.failAfter {
+		return errors.New("queue is full")
+	}
+	q.messages[k] = append(q.messages[k], string(data))
+	return nil
+}
+
+var (
+	setupOnce   sync.Once
+	memoryQueue = &mem_queue.MemoryQueue{Capacity: 1000}
+	simpleQueue = &listQueue{messages: map[string][]string{}}
+)
+
+func setup() {
+	setupOnce.Do(func() {
+		kvtest.Use("queue_shipper_test")
+		queue.RegisterDefaultHandler(memoryQueue)
+		queue.Register("list", simpleQueue)
+	})
+}
+
+func TestQueueShipperProduces(t *testing.T) {
+	setup()
+	s, err := shipper.Get("queue", map[string]interface{}{"queue": "shipped_events"})
+	require.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.Ship(nil))
+	assert.NoError(t, s.Ship([][]byte{[]byte("a"), nil, []byte("b")}))
+	assert.NoError(t, s.Ship([][]byte{[]byte("c")}))
+
+	qCfg := queue.GetOrInitConfig("shipped_events")
+	out := []string{}
+	for {
+		data, timeout := memoryQueue.Pop(qCfg.ID, 0)
+		if timeout {
+			break
+		}
+		out = append(out, string(data))
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, out)
+}
+
+func TestQueueShipperPushesWithoutProducer(t *testing.T) {
+	setup()
+	qCfg := queue.AdvancedGetOrInitConfig("list", "shipped_lines", nil)
+	s, err := shipper.Get("queue", map[string]interface{}{"queue": "shipped_lines"})
+	require.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.Ship([][]byte{[]byte("a"), nil, []byte("b")}))
+	assert.Equal(t, []string{"a", "b"}, simpleQueue.messages[qCfg.ID])
+
+	//the batch stops at the first failure and is redelivered as a whole
+	simpleQueue.failAfter = 3
+	defer func() { simpleQueue.failAfter = 0 }()
+	assert.ErrorContains(t, s.Ship([][]byte{[]byte("c"), []byte("d")}), "queue is full")
+	assert.Equal(t, []string{"a", "b", "c"}, simpleQueue.messages[qCfg.ID])
+}
+
+func TestQueueShipperNeedsQueue(t *testing.T) {
+	_, err := shipper.Get("queue", map[string]interface{}{})
+	assert.ErrorContains(t, err, "requires a queue")
+}
@@ -0,0 +1,117 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package simple_kv
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"infini.sh/framework/core/kv"
+)
+
+var _ kv.KVIterator = (*SimpleKV)(nil)
+
+func (filter *SimpleKV) ScanPrefix(bucket string, prefix []byte, fn func(key, value []byte) bool) error {
+	return filter.scan(bucket, prefix, prefix, nil, fn)
+}
+
+func (filter *SimpleKV) ScanRange(bucket string, start, end []byte, fn func(key, value []byte) bool) error {
+	return filter.scan(bucket, nil, start, end, fn)
+}
+
+// scan runs fn outside of the store lock, so fn may write back to the store.
+func (filter *SimpleKV) scan(bucket string, prefix, start, end []byte, fn func(key, value []byte) bool) error {
+	if filter.closed {
+		return errors.New("module closed")
+	}
+
+	bucketPrefix := joinKey(bucket, nil)
+	startKey := bucketPrefix + string(start)
+	endKey := bucketPrefix + string(end)
+
+	for _, v := range filter.kvstore.Entries(joinKey(bucket, prefix)) {
+		if v.Key < startKey {
+			continue
+		}
+		if end != nil && v.Key >= endKey {
+			break
+		}
+		if !fn([]byte(v.Key[len(bucketPrefix):]), v.Value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (filter *SimpleKV) ListBuckets() ([]string, error) {
+	names := map[string]struct{}{}
+	for _, v := range filter.kvstore.Entries("") {
+		if i := strings.Index(v.Key, ","); i >= 0 {
+			names[v.Key[:i]] = struct{}{}
+		}
+	}
+
+	result := make([]string, 0, len(names))
+	for k := range names {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (filter *SimpleKV) DeleteBucket(bucket string) error {
+	if filter.closed {
+		return errors.New("module closed")
+	}
+
+	entries := filter.kvstore.Entries(joinKey(bucket, nil))
+	if len(entries) == 0 {
+		return nil
+	}
+	for i := range entries {
+		entries[i].Value = nil
+	}
+	return filter.kvstore.Apply(entries)
+}
+
+func (filter *SimpleKV) BatchWrite(bucket string, ops []kv.WriteOp) error {
+	if filter.closed {
+		return errors.New("module closed")
+	}
+
+	entries := make([]Entry, 0, len(ops))
+	for _, op := range ops {
+		if op.Delete {
+			entries = append(entries, Entry{Key: joinKey(bucket, op.Key)})
+		} else {
+			entries = append(entries, Entry{Key: joinKey(bucket, op.Key), Value: op.Value})
+		}
+	}
+	return filter.kvstore.Apply(entries)
+}
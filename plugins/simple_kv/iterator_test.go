@@ -0,0 +1,79 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+
+package simple_kv
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"infini.sh/framework/core/kv"
+)
+
+func TestIterator(t *testing.T) {
+	dir := t.TempDir()
+	m := SimpleKV{cfg: &Config{}, kvstore: NewKVStore(path.Join(dir, "last_state"), path.Join(dir, "wal"))}
+
+	assert.NoError(t, m.BatchWrite("b1", []kv.WriteOp{
+		{Key: []byte("a/1"), Value: []byte("1")},
+		{Key: []byte("a/2"), Value: []byte("2")},
+		{Key: []byte("b/1"), Value: []byte("3")},
+	}))
+	assert.NoError(t, m.AddValue("b2", []byte("a/3"), []byte("4")))
+
+	var keys []string
+	assert.NoError(t, m.ScanPrefix("b1", []byte("a/"), func(key, value []byte) bool {
+		keys = append(keys, string(key)+"="+string(value))
+		return true
+	}))
+	assert.Equal(t, []string{"a/1=1", "a/2=2"}, keys)
+
+	keys = nil
+	assert.NoError(t, m.ScanRange("b1", []byte("a/2"), nil, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"a/2", "b/1"}, keys)
+
+	names, err := m.ListBuckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b1", "b2"}, names)
+
+	assert.NoError(t, m.DeleteBucket("b1"))
+	names, err = m.ListBuckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b2"}, names)
+
+	reloaded := NewKVStore(path.Join(dir, "last_state"), path.Join(dir, "wal"))
+	v, err := reloaded.Get(joinKey("b2", []byte("a/3")))
+	assert.NoError(t, err)
+	assert.Equal(t, "4", string(v))
+	v, err = reloaded.Get(joinKey("b1", []byte("a/1")))
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+}
@@ -30,12 +30,16 @@ package simple_kv
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	log "github.com/cihub/seelog"
 	"infini.sh/framework/core/global"
 	"infini.sh/framework/core/util"
+	"io"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -43,6 +47,7 @@ import (
 // KVStore represents a simple key-value store.
 type KVStore struct {
 	data     map[string][]byte
+	expires  map[string]int64 //key -> unix nano, only for keys stored with a ttl
 	wal      *WAL
 	mu       sync.Mutex
 	filename string
@@ -50,7 +55,8 @@ type KVStore struct {
 
 // LastState represents the last state of the key-value store.
 type LastState struct {
-	Data map[string][]byte `json:"data"`
+	Data    map[string][]byte `json:"data"`
+	Expires map[string]int64  `json:"expires,omitempty"`
 }
 
 // WAL represents a Write-Ahead Log for storing key-value changes.
@@ -64,11 +70,18 @@ type WAL struct {
 func NewKVStore(lastStateFilename, walFilename string) *KVStore {
 	kv := &KVStore{
 		data:     make(map[string][]byte),
+		expires:  make(map[string]int64),
 		wal:      &WAL{filename: walFilename},
 		filename: lastStateFilename,
 	}
 	kv.loadFromLastState()
-	kv.loadFromWAL()
+	if legacy := kv.loadFromWAL(); legacy {
+		//new entries must not be appended to a wal of the old format
+		kv.saveToLastState()
+		if err := os.Rename(walFilename, walFilename+".bak"); err != nil {
+			log.Errorf("Error renmae old WAL file: %v", err)
+		}
+	}
 
 	kv.wal.Open()
 
@@ -81,12 +94,28 @@ func NewKVStore(lastStateFilename, walFilename string) *KVStore {
 	},
 	})
 
+	global.RegisterBackgroundCallback(&global.BackgroundTask{Tag: "simple_kv_ttl_sweeper", Interval: time.Second * 5, Func: func() {
+		kv.sweepExpired()
+	},
+	})
+
 	return kv
 }
 
+// Open appends to the WAL file, a new file starts with the format header.
 func (wal *WAL) Open() error {
 	var err error
 	wal.walFile, err = os.OpenFile(wal.filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := wal.walFile.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 {
+		_, err = wal.walFile.WriteString(walHeader + "\n")
+	}
 	return err
 }
 
@@ -101,17 +130,30 @@ func (kv *KVStore) Set(key string, value []byte) error {
 	defer kv.mu.Unlock()
 
 	kv.data[key] = value
+	delete(kv.expires, key)
 	if err := kv.wal.writeEntry(key, value); err != nil {
 		return err
 	}
 	return nil
 }
 
+// SetWithExpiry stores the pair until expireAt, the expiry is kept in the
+// WAL so it survives a restart.
+func (kv *KVStore) SetWithExpiry(key string, value []byte, expireAt time.Time) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.data[key] = value
+	kv.expires[key] = expireAt.UnixNano()
+	return kv.wal.writeEntries([]Entry{{Key: key, Value: value, ExpireAt: kv.expires[key]}})
+}
+
 // Delete removes a key-value pair from the store and writes to the WAL synchronously.
 func (kv *KVStore) Delete(key string) error {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 	delete(kv.data, key)
+	delete(kv.expires, key)
 
 	if err := kv.wal.writeEntry(key, []byte("")); err != nil {
 		return err
@@ -119,6 +161,58 @@ func (kv *KVStore) Delete(key string) error {
 	return nil
 }
 
+// Entry is one key-value pair of the store, an empty Value marks a delete
+// when passed to Apply.
+type Entry struct {
+	Key      string
+	Value    []byte
+	ExpireAt int64 //unix nano, zero means never
+}
+
+// Apply sets or deletes all entries under a single lock and appends them to
+// the WAL with one write.
+func (kv *KVStore) Apply(entries []Entry) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	for _, v := range entries {
+		if len(v.Value) == 0 {
+			delete(kv.data, v.Key)
+		} else {
+			kv.data[v.Key] = v.Value
+		}
+		if v.ExpireAt > 0 {
+			kv.expires[v.Key] = v.ExpireAt
+		} else {
+			delete(kv.expires, v.Key)
+		}
+	}
+	return kv.wal.writeEntries(entries)
+}
+
+// Entries returns copies of the pairs whose key starts with prefix, sorted
+// by key.
+func (kv *KVStore) Entries(prefix string) []Entry {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	result := []Entry{}
+	for k, v := range kv.data {
+		if strings.HasPrefix(k, prefix) {
+			expireAt := kv.expires[k]
+			if expireAt > 0 && expireAt <= now {
+				continue
+			}
+			result = append(result, Entry{Key: k, Value: append([]byte{}, v...), ExpireAt: expireAt})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
 // Load the current state from the last state file.
 func (kv *KVStore) loadFromLastState() {
 	if _, err := os.Stat(kv.filename); err == nil {
@@ -135,55 +229,120 @@ func (kv *KVStore) loadFromLastState() {
 		kv.mu.Lock()
 		defer kv.mu.Unlock()
 		kv.data = lastState.Data
+		if lastState.Expires != nil {
+			kv.expires = lastState.Expires
+		}
 	}
 }
 
 const splitChar = "\t\t"
 
+// walHeader starts the WAL files whose keys and values are base64 encoded,
+// so they may hold the separator or line breaks. Files without it were
+// written with raw keys and values.
+const walHeader = "#simple_kv_wal v2"
+
+var walEncoding = base64.StdEncoding
+
 // Split a line into key and value.
 func splitLine(line []byte) [][]byte {
 	return bytes.Split(line, []byte(splitChar))
 }
 
-// LoadFromWAL loads the data from the WAL file and applies it to the store.
-func (kv *KVStore) loadFromWAL() {
+// decodeLine splits an encoded line, nil if it is malformed.
+func decodeLine(line []byte) [][]byte {
+	parts := splitLine(line)
+	for i := 0; i < len(parts) && i < 2; i++ {
+		v, err := walEncoding.DecodeString(string(parts[i]))
+		if err != nil {
+			return nil
+		}
+		parts[i] = v
+	}
+	return parts
+}
+
+// LoadFromWAL loads the data from the WAL file and applies it to the store,
+// and reports whether the file has the old format.
+func (kv *KVStore) loadFromWAL() (legacy bool) {
 	kv.wal.mu.Lock()
 	defer kv.wal.mu.Unlock()
 	if !util.FileExists(kv.wal.filename) {
-		return
+		return false
 	}
 	file, err := os.Open(kv.wal.filename)
 	if err != nil {
 		log.Errorf("Error opening WAL file: %v", err)
-		return
+		return false
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Bytes()
-		parts := splitLine(line)
-		if len(parts) == 2 {
+	reader := bufio.NewReader(file)
+	first := true
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err != io.EOF {
+				log.Errorf("Error reading WAL file: %v", err)
+			}
+			break
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if first {
+			first = false
+			legacy = string(line) != walHeader
+			if !legacy {
+				continue
+			}
+		}
+
+		var parts [][]byte
+		if legacy {
+			parts = splitLine(line)
+		} else {
+			parts = decodeLine(line)
+		}
+		if len(parts) == 2 || len(parts) == 3 {
 			key, value := parts[0], parts[1]
 			if len(value) == 0 {
 				delete(kv.data, string(key))
 			} else {
 				kv.data[string(key)] = value
 			}
+
+			//a third column carries the expiry of values stored with a ttl
+			delete(kv.expires, string(key))
+			if len(parts) == 3 {
+				if expireAt, err := util.ToInt64(string(parts[2])); err == nil && expireAt > 0 {
+					kv.expires[string(key)] = expireAt
+				}
+			}
 		}
 	}
+	return legacy
 }
 
 // Write an entry to the WAL file.
 func (wal *WAL) writeEntry(key string, value []byte) error {
+	return wal.writeEntries([]Entry{{Key: key, Value: value}})
+}
+
+// Write entries to the WAL file in one write.
+func (wal *WAL) writeEntries(entries []Entry) error {
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
 	buffer := bytes.Buffer{}
-	buffer.WriteString(key)
-	buffer.WriteString(splitChar)
-	buffer.Write(value)
-	buffer.WriteString("\n")
+	for _, v := range entries {
+		buffer.WriteString(walEncoding.EncodeToString([]byte(v.Key)))
+		buffer.WriteString(splitChar)
+		buffer.WriteString(walEncoding.EncodeToString(v.Value))
+		if v.ExpireAt > 0 {
+			buffer.WriteString(splitChar)
+			buffer.WriteString(util.Int64ToString(v.ExpireAt))
+		}
+		buffer.WriteString("\n")
+	}
 	_, err := wal.walFile.Write(buffer.Bytes())
 	wal.walFile.Sync()
 
@@ -202,7 +361,7 @@ func (kv *KVStore) saveToLastState() {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
-	lastState := LastState{Data: kv.data}
+	lastState := LastState{Data: kv.data, Expires: kv.expires}
 	data, err := json.Marshal(lastState)
 	if err != nil {
 		log.Errorf("Error marshaling last state to JSON: %v", err)
@@ -227,13 +386,40 @@ func (kv *KVStore) createNewWAL() {
 }
 
 func (kv *KVStore) Get(key string) ([]byte, error) {
+	v, _, err := kv.GetWithExpiry(key)
+	return v, err
+}
+
+// GetWithExpiry returns the value and its expiry in unix nano, zero when the
+// value has no ttl. Expired values read as missing even before the sweeper
+// has removed them.
+func (kv *KVStore) GetWithExpiry(key string) ([]byte, int64, error) {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
 	v, ok := kv.data[key]
 	if !ok {
-		return nil, nil
+		return nil, 0, nil
+	}
+	expireAt := kv.expires[key]
+	if expireAt > 0 && expireAt <= time.Now().UnixNano() {
+		return nil, 0, nil
 	}
 	valCopy := append([]byte{}, v...)
-	return valCopy, nil
+	return valCopy, expireAt, nil
+}
+
+// sweepExpired drops the expired values from memory, the next state
+// snapshot then persists their removal.
+func (kv *KVStore) sweepExpired() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	for k, expireAt := range kv.expires {
+		if expireAt <= now {
+			delete(kv.data, k)
+			delete(kv.expires, k)
+		}
+	}
 }
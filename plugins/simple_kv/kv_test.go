@@ -0,0 +1,131 @@
+// Copyright (C) INFINI Labs & INFINI LIMITED.
+//
+// The INFINI Framework is offered under the GNU Affero General Public License v3.0
+// and as commercial software.
+//
+// For commercial licensing, contact us at:
+//   - Website: infinilabs.com
+//   - Email: hello@infini.ltd
+//
+// Open Source licensed under AGPL V3:
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+/* Copyright © INFINI LTD. All rights reserved.
+ * Web: https://infinilabs.com
+ * Email: hello#infini.ltd */
+package simple_kv
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKVStore_Expiry(t *testing.T) {
+	dir := t.TempDir()
+	store := NewKVStore(path.Join(dir, "last_state"), path.Join(dir, "wal"))
+
+	assert.NoError(t, store.SetWithExpiry("b,short", []byte("1"), time.Now().Add(50*time.Millisecond)))
+	assert.NoError(t, store.SetWithExpiry("b,long", []byte("2"), time.Now().Add(time.Hour)))
+	assert.NoError(t, store.Set("b,plain", []byte("3")))
+
+	v, expireAt, err := store.GetWithExpiry("b,long")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(v))
+	assert.True(t, expireAt > 0)
+
+	time.Sleep(100 * time.Millisecond)
+
+	v, err = store.Get("b,short")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	store.sweepExpired()
+	assert.Len(t, store.Entries("b,"), 2)
+
+	//the expiry survives a reload from the wal
+	reloaded := NewKVStore(path.Join(dir, "last_state"), path.Join(dir, "wal"))
+	v, expireAt, err = reloaded.GetWithExpiry("b,long")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", string(v))
+	assert.True(t, expireAt > 0)
+
+	v, expireAt, err = reloaded.GetWithExpiry("b,plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "3", string(v))
+	assert.Equal(t, int64(0), expireAt)
+
+	v, err = reloaded.Get("b,short")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+}
+
+func TestKVStore_WALKeepsSeparatorsInValues(t *testing.T) {
+	dir := t.TempDir()
+	store := NewKVStore(path.Join(dir, "last_state"), path.Join(dir, "wal"))
+
+	values := map[string][]byte{
+		"b,tabs":       []byte("left\t\tright\t\t"),
+		"b,lines":      []byte("first\nsecond\r\n"),
+		"b,binary":     {0, '\t', '\t', 0xff, '\n', 1},
+		"b,key\t\ttab": []byte("v"),
+	}
+	for k, v := range values {
+		require.NoError(t, store.Set(k, v))
+	}
+	require.NoError(t, store.SetWithExpiry("b,ttl", []byte("a\t\tb"), time.Now().Add(time.Hour)))
+
+	reloaded := NewKVStore(path.Join(dir, "last_state"), path.Join(dir, "wal"))
+	for k, v := range values {
+		got, err := reloaded.Get(k)
+		assert.NoError(t, err)
+		assert.Equal(t, v, got, k)
+	}
+	v, expireAt, err := reloaded.GetWithExpiry("b,ttl")
+	assert.NoError(t, err)
+	assert.Equal(t, "a\t\tb", string(v))
+	assert.True(t, expireAt > 0)
+}
+
+func TestKVStore_LegacyWAL(t *testing.T) {
+	dir := t.TempDir()
+	wal := path.Join(dir, "wal")
+	require.NoError(t, os.WriteFile(wal, []byte("b,k1\t\tv1\nb,k2\t\tv2\nb,k1\t\t\n"), 0644))
+
+	store := NewKVStore(path.Join(dir, "last_state"), wal)
+	v, err := store.Get("b,k2")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(v))
+	v, err = store.Get("b,k1")
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+
+	//the old file is put aside, new entries go to a wal of the new format
+	require.NoError(t, store.Set("b,k3", []byte("v\t\t3")))
+	data, err := os.ReadFile(wal)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), walHeader+"\n")
+
+	reloaded := NewKVStore(path.Join(dir, "last_state"), wal)
+	v, err = reloaded.Get("b,k2")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(v))
+	v, err = reloaded.Get("b,k3")
+	assert.NoError(t, err)
+	assert.Equal(t, "v\t\t3", string(v))
+}
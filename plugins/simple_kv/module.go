@@ -72,6 +72,7 @@ func (module *SimpleKV) Setup() {
 	if module.cfg.Enabled {
 		filter.Register("simple_kv", module)
 		kv.Register("simple_kv", module)
+		kv.LoadRoutingConfig()
 	}
 
 	module.kvstore = NewKVStore(path.Join(module.cfg.Path, "last_state"), path.Join(module.cfg.Path, "wal"))
@@ -30,9 +30,11 @@ package simple_kv
 import (
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/bkaradzic/go-lz4"
 	log "github.com/cihub/seelog"
+	"infini.sh/framework/core/kv"
 	"infini.sh/framework/core/util"
 )
 
@@ -128,6 +130,31 @@ func (filter *SimpleKV) AddValue(bucket string, key []byte, value []byte) error
 	return filter.kvstore.Set(joinKey(bucket, key), value)
 }
 
+var _ kv.KVTTLStore = (*SimpleKV)(nil)
+
+func (filter *SimpleKV) AddValueWithTTL(bucket string, key []byte, value []byte, ttl time.Duration) error {
+	if filter.closed {
+		return errors.New("module closed")
+	}
+	return filter.kvstore.SetWithExpiry(joinKey(bucket, key), value, time.Now().Add(ttl))
+}
+
+func (filter *SimpleKV) GetValueWithMeta(bucket string, key []byte) ([]byte, *kv.ValueMeta, error) {
+	if filter.closed {
+		return nil, nil, errors.New("module closed")
+	}
+
+	valCopy, expireAt, err := filter.kvstore.GetWithExpiry(joinKey(bucket, key))
+	if err != nil || valCopy == nil {
+		return valCopy, nil, err
+	}
+	meta := &kv.ValueMeta{}
+	if expireAt > 0 {
+		meta.ExpiresAt = time.Unix(0, expireAt)
+	}
+	return valCopy, meta, nil
+}
+
 func (filter *SimpleKV) ExistsKey(bucket string, key []byte) (bool, error) {
 	ok := filter.Exists(bucket, key)
 	return ok, nil